@@ -0,0 +1,255 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package chunkmap is the guts of the `btrfs-rec inspect chunk-map`
+// command, which displays which parts of the logical address space
+// are mapped, and to where.
+package chunkmap
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// A Segment is a contiguous range of the logical address space that
+// is either a single chunk, or a gap between chunks.
+type Segment struct {
+	LAddr   btrfsvol.LogicalAddr
+	Size    btrfsvol.AddrDelta
+	Mapped  bool
+	Flags   containers.Optional[btrfsvol.BlockGroupFlags]
+	Stripes []btrfsvol.QualifiedPhysicalAddr
+
+	// InChunkTree is whether the chunk tree has a CHUNK_ITEM for
+	// this chunk; a mapped segment that is not in the chunk tree
+	// came from the superblock's sys_chunk_array or from
+	// --mappings.
+	InChunkTree bool
+}
+
+const profileMask = btrfsvol.BLOCK_GROUP_RAID0 | btrfsvol.BLOCK_GROUP_RAID_MASK
+
+// Profile returns the name of the segment's RAID profile ("single",
+// "DUP", "RAID1", ...), or "unknown" if the mapping doesn't say, or
+// "unmapped" for a gap.
+func (seg Segment) Profile() string {
+	switch {
+	case !seg.Mapped:
+		return "unmapped"
+	case !seg.Flags.OK:
+		return "unknown"
+	case seg.Flags.Val&profileMask == 0:
+		// BlockGroupFlags.String() would say "none|single".
+		return "single"
+	case seg.Flags.Val&profileMask == btrfsvol.BLOCK_GROUP_RAID0:
+		// BlockGroupFlags.String() would say "RAID0|single".
+		return "RAID0"
+	default:
+		return (seg.Flags.Val & profileMask).String()
+	}
+}
+
+// Type returns the name of the segment's block group type (a
+// combination of "DATA", "METADATA", and "SYSTEM"), or "" if it
+// isn't known.
+func (seg Segment) Type() string {
+	if !seg.Flags.OK {
+		return ""
+	}
+	var parts []string
+	for _, typ := range []struct {
+		Flag btrfsvol.BlockGroupFlags
+		Name string
+	}{
+		{btrfsvol.BLOCK_GROUP_DATA, "DATA"},
+		{btrfsvol.BLOCK_GROUP_METADATA, "METADATA"},
+		{btrfsvol.BLOCK_GROUP_SYSTEM, "SYSTEM"},
+	} {
+		if seg.Flags.Val.Has(typ.Flag) {
+			parts = append(parts, typ.Name)
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// Segments splits the logical address space (from 0 to the end of
+// the last chunk) in to a sorted list of chunks and the gaps between
+// them.
+func Segments(mappings []btrfsvol.Mapping, inChunkTree containers.Set[btrfsvol.LogicalAddr]) []Segment {
+	chunks := make(map[btrfsvol.LogicalAddr]*Segment)
+	for _, mapping := range mappings {
+		seg, ok := chunks[mapping.LAddr]
+		if !ok {
+			seg = &Segment{
+				LAddr:       mapping.LAddr,
+				Size:        mapping.Size,
+				Mapped:      true,
+				Flags:       mapping.Flags,
+				InChunkTree: inChunkTree.Has(mapping.LAddr),
+			}
+			chunks[mapping.LAddr] = seg
+		}
+		seg.Stripes = append(seg.Stripes, mapping.PAddr)
+	}
+
+	var ret []Segment
+	var pos btrfsvol.LogicalAddr
+	for _, laddr := range maps.SortedKeys(chunks) {
+		seg := chunks[laddr]
+		sort.Slice(seg.Stripes, func(i, j int) bool {
+			return seg.Stripes[i].Compare(seg.Stripes[j]) < 0
+		})
+		if seg.LAddr > pos {
+			ret = append(ret, Segment{
+				LAddr: pos,
+				Size:  seg.LAddr.Sub(pos),
+			})
+		}
+		ret = append(ret, *seg)
+		if end := seg.LAddr.Add(seg.Size); end > pos {
+			pos = end
+		}
+	}
+	return ret
+}
+
+// ReadChunkTreeAddrs returns the logical addresses of all chunks that
+// have a CHUNK_ITEM in the chunk tree.
+func ReadChunkTreeAddrs(ctx context.Context, fs btrfs.ReadableFS) (containers.Set[btrfsvol.LogicalAddr], error) {
+	chunkTree, err := fs.ForrestLookup(ctx, btrfsprim.CHUNK_TREE_OBJECTID)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(containers.Set[btrfsvol.LogicalAddr])
+	err = chunkTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		if item.Key.ItemType != btrfsitem.CHUNK_ITEM_KEY {
+			return true
+		}
+		if _, ok := item.Body.(*btrfsitem.Chunk); ok {
+			ret.Insert(btrfsvol.LogicalAddr(item.Key.Offset))
+		}
+		return true
+	})
+	return ret, err
+}
+
+// ChunkMap writes a textual listing of the segments of the logical
+// address space of `fs` to `out`, followed by a summary.
+func ChunkMap(ctx context.Context, out io.Writer, fs *btrfs.FS) []Segment {
+	inChunkTree, err := ReadChunkTreeAddrs(ctx, fs)
+	if err != nil {
+		dlog.Errorf(ctx, "error reading chunk tree: %v", err)
+	}
+	segs := Segments(fs.LV.Mappings(), inChunkTree)
+
+	totals := make(map[string]btrfsvol.AddrDelta)
+	for _, seg := range segs {
+		totals[seg.Profile()] += seg.Size
+		if !seg.Mapped {
+			textui.Fprintf(out, "%v-%v (%v) UNMAPPED\n",
+				seg.LAddr, seg.LAddr.Add(seg.Size), textui.IEC(seg.Size, "B"))
+			continue
+		}
+		var notes string
+		if !seg.InChunkTree {
+			notes = " (not in chunk tree)"
+		}
+		stripes := make([]string, 0, len(seg.Stripes))
+		for _, stripe := range seg.Stripes {
+			stripes = append(stripes, fmt.Sprintf("dev=%v@%v", stripe.Dev, stripe.Addr))
+		}
+		textui.Fprintf(out, "%v-%v (%v) %v %v: %v%v\n",
+			seg.LAddr, seg.LAddr.Add(seg.Size), textui.IEC(seg.Size, "B"),
+			seg.Profile(), seg.Type(), strings.Join(stripes, " "), notes)
+	}
+
+	textui.Fprintf(out, "\nSummary:\n")
+	for _, profile := range maps.SortedKeys(totals) {
+		textui.Fprintf(out, "  %v: %v\n", profile, textui.IEC(totals[profile], "B"))
+	}
+	return segs
+}
+
+// svgColors are the colors for each profile in the SVG output.
+var svgColors = map[string]string{
+	"unmapped": "#d62728",
+	"unknown":  "#7f7f7f",
+	"single":   "#1f77b4",
+	"DUP":      "#2ca02c",
+	"RAID0":    "#ff7f0e",
+	"RAID1":    "#9467bd",
+	"RAID10":   "#8c564b",
+	"RAID5":    "#e377c2",
+	"RAID6":    "#bcbd22",
+	"RAID1C3":  "#17becf",
+	"RAID1C4":  "#aec7e8",
+}
+
+const (
+	svgWidth     = 1024
+	svgBarHeight = 48
+	svgLegendRow = 20
+)
+
+// WriteSVG writes the segments as a fixed-width SVG image, with each
+// segment's width proportional to its size, and colored by profile.
+func WriteSVG(out io.Writer, segs []Segment) error {
+	var total btrfsvol.AddrDelta
+	for _, seg := range segs {
+		total += seg.Size
+	}
+	profiles := make(containers.Set[string])
+	for _, seg := range segs {
+		profiles.Insert(seg.Profile())
+	}
+	height := svgBarHeight + svgLegendRow*(len(profiles)+1)
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+"\n", svgWidth, height)
+	var pos btrfsvol.AddrDelta
+	for _, seg := range segs {
+		if total == 0 {
+			break
+		}
+		x := float64(pos) * svgWidth / float64(total)
+		w := float64(seg.Size) * svgWidth / float64(total)
+		pos += seg.Size
+		color, ok := svgColors[seg.Profile()]
+		if !ok {
+			color = svgColors["unknown"]
+		}
+		fmt.Fprintf(&buf, `  <rect x="%f" y="0" width="%f" height="%d" fill="%s"><title>%s</title></rect>`+"\n",
+			x, w, svgBarHeight, color, html.EscapeString(fmt.Sprintf("%v-%v %v %v",
+				seg.LAddr, seg.LAddr.Add(seg.Size), seg.Profile(), seg.Type())))
+	}
+	for i, profile := range maps.SortedKeys(profiles) {
+		y := svgBarHeight + svgLegendRow*(i+1)
+		color, ok := svgColors[profile]
+		if !ok {
+			color = svgColors["unknown"]
+		}
+		fmt.Fprintf(&buf, `  <rect x="4" y="%d" width="12" height="12" fill="%s"/>`+"\n", y-12, color)
+		fmt.Fprintf(&buf, `  <text x="20" y="%d" font-family="sans-serif" font-size="12">%s</text>`+"\n",
+			y, html.EscapeString(profile))
+	}
+	buf.WriteString("</svg>\n")
+
+	_, err := io.WriteString(out, buf.String())
+	return err
+}
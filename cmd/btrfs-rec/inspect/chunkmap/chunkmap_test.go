@@ -0,0 +1,145 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package chunkmap_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/chunkmap"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func TestSegments(t *testing.T) {
+	t.Parallel()
+	qpa := func(dev btrfsvol.DeviceID, addr btrfsvol.PhysicalAddr) btrfsvol.QualifiedPhysicalAddr {
+		return btrfsvol.QualifiedPhysicalAddr{Dev: dev, Addr: addr}
+	}
+	flags := func(f btrfsvol.BlockGroupFlags) containers.Optional[btrfsvol.BlockGroupFlags] {
+		return containers.OptionalValue(f)
+	}
+	type TestCase struct {
+		Mappings    []btrfsvol.Mapping
+		InChunkTree containers.Set[btrfsvol.LogicalAddr]
+		Exp         []chunkmap.Segment
+	}
+	testcases := map[string]TestCase{
+		"empty": {
+			Exp: nil,
+		},
+		"at-zero": {
+			Mappings: []btrfsvol.Mapping{
+				{LAddr: 0, PAddr: qpa(1, 0x1000), Size: 0x100, Flags: flags(btrfsvol.BLOCK_GROUP_DATA)},
+			},
+			InChunkTree: containers.NewSet[btrfsvol.LogicalAddr](0),
+			Exp: []chunkmap.Segment{
+				{LAddr: 0, Size: 0x100, Mapped: true, Flags: flags(btrfsvol.BLOCK_GROUP_DATA), Stripes: []btrfsvol.QualifiedPhysicalAddr{qpa(1, 0x1000)}, InChunkTree: true},
+			},
+		},
+		"gaps": {
+			Mappings: []btrfsvol.Mapping{
+				{LAddr: 0x300, PAddr: qpa(1, 0x3000), Size: 0x100},
+				{LAddr: 0x100, PAddr: qpa(1, 0x1000), Size: 0x100},
+			},
+			Exp: []chunkmap.Segment{
+				{LAddr: 0, Size: 0x100},
+				{LAddr: 0x100, Size: 0x100, Mapped: true, Stripes: []btrfsvol.QualifiedPhysicalAddr{qpa(1, 0x1000)}},
+				{LAddr: 0x200, Size: 0x100},
+				{LAddr: 0x300, Size: 0x100, Mapped: true, Stripes: []btrfsvol.QualifiedPhysicalAddr{qpa(1, 0x3000)}},
+			},
+		},
+		"adjacent": {
+			Mappings: []btrfsvol.Mapping{
+				{LAddr: 0, PAddr: qpa(1, 0), Size: 0x100},
+				{LAddr: 0x100, PAddr: qpa(1, 0x100), Size: 0x100},
+			},
+			InChunkTree: containers.NewSet[btrfsvol.LogicalAddr](0x100),
+			Exp: []chunkmap.Segment{
+				{LAddr: 0, Size: 0x100, Mapped: true, Stripes: []btrfsvol.QualifiedPhysicalAddr{qpa(1, 0)}},
+				{LAddr: 0x100, Size: 0x100, Mapped: true, Stripes: []btrfsvol.QualifiedPhysicalAddr{qpa(1, 0x100)}, InChunkTree: true},
+			},
+		},
+		"stripes-sorted": {
+			Mappings: []btrfsvol.Mapping{
+				{LAddr: 0, PAddr: qpa(2, 0x1000), Size: 0x100, Flags: flags(btrfsvol.BLOCK_GROUP_RAID1)},
+				{LAddr: 0, PAddr: qpa(1, 0x5000), Size: 0x100, Flags: flags(btrfsvol.BLOCK_GROUP_RAID1)},
+				{LAddr: 0, PAddr: qpa(1, 0x2000), Size: 0x100, Flags: flags(btrfsvol.BLOCK_GROUP_RAID1)},
+			},
+			Exp: []chunkmap.Segment{
+				{LAddr: 0, Size: 0x100, Mapped: true, Flags: flags(btrfsvol.BLOCK_GROUP_RAID1), Stripes: []btrfsvol.QualifiedPhysicalAddr{
+					qpa(1, 0x2000), qpa(1, 0x5000), qpa(2, 0x1000),
+				}},
+			},
+		},
+		"overlapping": {
+			// A chunk that starts inside of an earlier chunk
+			// doesn't get a gap before it, and doesn't pull
+			// the end back.
+			Mappings: []btrfsvol.Mapping{
+				{LAddr: 0, PAddr: qpa(1, 0), Size: 0x300},
+				{LAddr: 0x100, PAddr: qpa(2, 0), Size: 0x100},
+				{LAddr: 0x400, PAddr: qpa(3, 0), Size: 0x100},
+			},
+			Exp: []chunkmap.Segment{
+				{LAddr: 0, Size: 0x300, Mapped: true, Stripes: []btrfsvol.QualifiedPhysicalAddr{qpa(1, 0)}},
+				{LAddr: 0x100, Size: 0x100, Mapped: true, Stripes: []btrfsvol.QualifiedPhysicalAddr{qpa(2, 0)}},
+				{LAddr: 0x300, Size: 0x100},
+				{LAddr: 0x400, Size: 0x100, Mapped: true, Stripes: []btrfsvol.QualifiedPhysicalAddr{qpa(3, 0)}},
+			},
+		},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.Exp, chunkmap.Segments(tc.Mappings, tc.InChunkTree))
+		})
+	}
+}
+
+func TestSegmentProfileType(t *testing.T) {
+	t.Parallel()
+	type TestCase struct {
+		Seg        chunkmap.Segment
+		ExpProfile string
+		ExpType    string
+	}
+	testcases := map[string]TestCase{
+		"unmapped": {
+			Seg:        chunkmap.Segment{},
+			ExpProfile: "unmapped",
+		},
+		"no-flags": {
+			Seg:        chunkmap.Segment{Mapped: true},
+			ExpProfile: "unknown",
+		},
+		"single-data": {
+			Seg:        chunkmap.Segment{Mapped: true, Flags: containers.OptionalValue(btrfsvol.BLOCK_GROUP_DATA)},
+			ExpProfile: "single",
+			ExpType:    "DATA",
+		},
+		"raid0-mixed": {
+			Seg: chunkmap.Segment{Mapped: true, Flags: containers.OptionalValue(
+				btrfsvol.BLOCK_GROUP_RAID0 | btrfsvol.BLOCK_GROUP_DATA | btrfsvol.BLOCK_GROUP_METADATA)},
+			ExpProfile: "RAID0",
+			ExpType:    "DATA|METADATA",
+		},
+		"dup-system": {
+			Seg:        chunkmap.Segment{Mapped: true, Flags: containers.OptionalValue(btrfsvol.BLOCK_GROUP_DUP | btrfsvol.BLOCK_GROUP_SYSTEM)},
+			ExpProfile: "DUP",
+			ExpType:    "SYSTEM",
+		},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.ExpProfile, tc.Seg.Profile())
+			assert.Equal(t, tc.ExpType, tc.Seg.Type())
+		})
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package comparekernel is the guts of the `btrfs-rec inspect
+// compare-with-kernel` command, which compares a recovered subvolume
+// against a trusted copy of it that is mounted by the kernel.
+package comparekernel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/datawire/dlib/derror"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+type Kind string
+
+const (
+	// KindMissing means that the path exists in the reference,
+	// but not in the recovered subvolume.
+	KindMissing Kind = "missing"
+	// KindExtra means that the path exists in the recovered
+	// subvolume, but not in the reference.
+	KindExtra Kind = "extra"
+	// KindType means that the path is of a different type on
+	// each side; it is not descended in to.
+	KindType Kind = "type"
+	// KindSize means that the file's size differs.
+	KindSize Kind = "size"
+	// KindContent means that the file's or symlink's content
+	// differs; Divergence.Offset is the first byte that differs.
+	KindContent Kind = "content"
+	// KindError means that the path could not be read on one of
+	// the sides.
+	KindError Kind = "error"
+)
+
+// A Divergence is a single difference between the recovered subvolume
+// and the reference.
+type Divergence struct {
+	Path      string
+	Kind      Kind
+	Offset    int64 // for KindContent, and KindError when reading content
+	Recovered string
+	Reference string
+}
+
+func (d Divergence) String() string {
+	ret := textui.Sprintf("%s: %q", d.Kind, d.Path)
+	if d.Kind == KindContent || d.Offset != 0 {
+		ret += textui.Sprintf(" at offset %v", d.Offset)
+	}
+	if d.Recovered != "" || d.Reference != "" {
+		ret += textui.Sprintf(": recovered=%q reference=%q", d.Recovered, d.Reference)
+	}
+	return ret
+}
+
+type Config struct {
+	// MaxDivergences is how many divergences to report before
+	// stopping the comparison; 0 means no limit.
+	MaxDivergences int
+	// ContentMaxSize is the size of the largest file whose
+	// content is compared; larger files only have their size
+	// compared.  A negative value means no limit.
+	ContentMaxSize int64
+	// ContentSample compares the content of only 1 in
+	// ContentSample files (chosen by a hash of the path, so that
+	// repeated runs sample the same files); 0 or 1 means every
+	// file.
+	ContentSample uint32
+	// Subvolume configures how files are read from the
+	// filesystem.
+	Subvolume btrfs.SubvolumeConfig
+}
+
+type Stats struct {
+	Paths           int
+	ContentCompared int
+	Divergences     int
+	// Truncated is whether the comparison was stopped early
+	// because Config.MaxDivergences was reached.
+	Truncated bool
+}
+
+func (s Stats) String() string {
+	ret := textui.Sprintf("compared %v paths (content of %v files): %v divergences",
+		s.Paths, s.ContentCompared, s.Divergences)
+	if s.Truncated {
+		ret += " (stopped early; there may be more)"
+	}
+	return ret
+}
+
+var errTooManyDivergences = errors.New("too many divergences")
+
+// Compare walks the recovered subvolume `treeID` (and any subvolumes
+// nested within it) alongside the directory `refDir` (which is
+// expected to be a mountpoint of a trusted copy of the same
+// subvolume), calling fn for each divergence.  Paths are compared by
+// type and size, symlinks by target, and (per cfg) files by content.
+// Ownership, modes, timestamps, and xattrs are not compared.
+func Compare(ctx context.Context, fs btrfs.ReadableFS, treeID btrfsprim.ObjID, refDir string, cfg Config, fn func(Divergence) error) (Stats, error) {
+	c := &comparer{ctx: ctx, refDir: refDir, cfg: cfg, fn: fn}
+	err := c.compareSubvol("/", btrfs.NewSubvolume(ctx, fs, treeID, cfg.Subvolume))
+	if errors.Is(err, errTooManyDivergences) {
+		c.stats.Truncated = true
+		err = nil
+	}
+	return c.stats, err
+}
+
+type comparer struct {
+	ctx    context.Context //nolint:containedctx // only lives for the duration of Compare
+	refDir string
+	cfg    Config
+	fn     func(Divergence) error
+	stats  Stats
+}
+
+func (c *comparer) report(d Divergence) error {
+	c.stats.Divergences++
+	if err := c.fn(d); err != nil {
+		return err
+	}
+	if c.cfg.MaxDivergences > 0 && c.stats.Divergences >= c.cfg.MaxDivergences {
+		return errTooManyDivergences
+	}
+	return nil
+}
+
+func (c *comparer) refPath(name string) string {
+	return filepath.Join(c.refDir, filepath.FromSlash(name))
+}
+
+func (c *comparer) compareSubvol(name string, sv *btrfs.Subvolume) error {
+	rootInode, err := sv.GetRootInode()
+	if err != nil {
+		c.stats.Paths++
+		return c.report(Divergence{Path: name, Kind: KindError, Recovered: err.Error()})
+	}
+	return c.compareDir(name, sv, rootInode)
+}
+
+func (c *comparer) compareDir(name string, sv *btrfs.Subvolume, inode btrfsprim.ObjID) error {
+	c.stats.Paths++
+	dir, err := sv.AcquireDir(inode)
+	if err != nil {
+		return c.report(Divergence{Path: name, Kind: KindError, Recovered: err.Error()})
+	}
+	children := dir.ChildrenByName
+	sv.ReleaseDir(inode)
+
+	refEntries, err := os.ReadDir(c.refPath(name))
+	if err != nil {
+		return c.report(Divergence{Path: name, Kind: KindError, Reference: err.Error()})
+	}
+	refNames := make(containers.Set[string], len(refEntries))
+	for _, refEntry := range refEntries {
+		refNames.Insert(refEntry.Name())
+	}
+
+	allNames := make(containers.Set[string], len(children)+len(refNames))
+	for childName := range children {
+		allNames.Insert(childName)
+	}
+	allNames.InsertFrom(refNames)
+
+	for _, childName := range maps.SortedKeys(allNames) {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		childPath := path.Join(name, childName)
+		dirent, inRecovered := children[childName]
+		switch {
+		case !inRecovered:
+			c.stats.Paths++
+			err = c.report(Divergence{Path: childPath, Kind: KindMissing})
+		case !refNames.Has(childName):
+			c.stats.Paths++
+			err = c.report(Divergence{Path: childPath, Kind: KindExtra})
+		default:
+			err = c.compareDirEntry(sv, childPath, dirent)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileType returns the btrfs file type corresponding to an
+// fs.FileMode.
+func fileType(mode fs.FileMode) btrfsitem.FileType {
+	switch mode.Type() {
+	case 0:
+		return btrfsitem.FT_REG_FILE
+	case fs.ModeDir:
+		return btrfsitem.FT_DIR
+	case fs.ModeSymlink:
+		return btrfsitem.FT_SYMLINK
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return btrfsitem.FT_CHRDEV
+	case fs.ModeDevice:
+		return btrfsitem.FT_BLKDEV
+	case fs.ModeNamedPipe:
+		return btrfsitem.FT_FIFO
+	case fs.ModeSocket:
+		return btrfsitem.FT_SOCK
+	default:
+		return btrfsitem.FT_UNKNOWN
+	}
+}
+
+func (c *comparer) compareDirEntry(sv *btrfs.Subvolume, name string, dirent btrfsitem.DirEntry) error {
+	refInfo, err := os.Lstat(c.refPath(name))
+	if err != nil {
+		c.stats.Paths++
+		return c.report(Divergence{Path: name, Kind: KindError, Reference: err.Error()})
+	}
+	if refType := fileType(refInfo.Mode()); refType != dirent.Type {
+		c.stats.Paths++
+		return c.report(Divergence{Path: name, Kind: KindType, Recovered: dirent.Type.String(), Reference: refType.String()})
+	}
+
+	switch {
+	case dirent.Type == btrfsitem.FT_DIR && dirent.Location.ItemType == btrfsitem.ROOT_ITEM_KEY:
+		return c.compareSubvol(name, sv.NewChildSubvolume(dirent.Location.ObjectID))
+	case dirent.Location.ItemType != btrfsitem.INODE_ITEM_KEY:
+		c.stats.Paths++
+		return c.report(Divergence{Path: name, Kind: KindError,
+			Recovered: fmt.Sprintf("%v with location.ItemType=%v", dirent.Type, dirent.Location.ItemType)})
+	case dirent.Type == btrfsitem.FT_DIR:
+		return c.compareDir(name, sv, dirent.Location.ObjectID)
+	default:
+		c.stats.Paths++
+		if d := c.compareFile(sv, name, dirent, refInfo); d != nil {
+			return c.report(*d)
+		}
+		return nil
+	}
+}
+
+// compareFile compares a non-directory; it returns a nil Divergence
+// if the two sides match.
+func (c *comparer) compareFile(sv *btrfs.Subvolume, name string, dirent btrfsitem.DirEntry, refInfo fs.FileInfo) (d *Divergence) {
+	// Subvolume.AcquireFile panics on some malformed inodes;
+	// that should only affect this one path.
+	defer func() {
+		if err := derror.PanicToError(recover()); err != nil {
+			d = &Divergence{Path: name, Kind: KindError, Recovered: err.Error()}
+		}
+	}()
+
+	file, err := sv.AcquireFile(dirent.Location.ObjectID)
+	if err != nil {
+		return &Divergence{Path: name, Kind: KindError, Recovered: err.Error()}
+	}
+	defer sv.ReleaseFile(dirent.Location.ObjectID)
+	if file.InodeItem == nil {
+		return &Divergence{Path: name, Kind: KindError, Recovered: "no inode item"}
+	}
+	size := file.InodeItem.Size
+
+	switch dirent.Type {
+	case btrfsitem.FT_REG_FILE:
+		if size != refInfo.Size() {
+			return &Divergence{Path: name, Kind: KindSize,
+				Recovered: textui.Sprintf("%v", size), Reference: textui.Sprintf("%v", refInfo.Size())}
+		}
+		if !c.shouldCompareContent(name, size) {
+			return nil
+		}
+		c.stats.ContentCompared++
+		refFile, err := os.Open(c.refPath(name))
+		if err != nil {
+			return &Divergence{Path: name, Kind: KindError, Reference: err.Error()}
+		}
+		defer func() {
+			_ = refFile.Close()
+		}()
+		return diffContent(name, io.NewSectionReader(file, 0, size), refFile)
+	case btrfsitem.FT_SYMLINK:
+		target, err := io.ReadAll(io.NewSectionReader(file, 0, size))
+		if err != nil {
+			return &Divergence{Path: name, Kind: KindError, Recovered: err.Error()}
+		}
+		refTarget, err := os.Readlink(c.refPath(name))
+		if err != nil {
+			return &Divergence{Path: name, Kind: KindError, Reference: err.Error()}
+		}
+		if string(target) != refTarget {
+			return &Divergence{Path: name, Kind: KindContent, Recovered: string(target), Reference: refTarget}
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (c *comparer) shouldCompareContent(name string, size int64) bool {
+	if c.cfg.ContentMaxSize >= 0 && size > c.cfg.ContentMaxSize {
+		return false
+	}
+	return sampled(name, c.cfg.ContentSample)
+}
+
+// sampled returns whether `name` is one of the 1-in-`every` paths
+// whose content gets compared.
+func sampled(name string, every uint32) bool {
+	if every <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	_, _ = io.WriteString(h, name)
+	return h.Sum32()%every == 0
+}
+
+// diffContent compares the content of a recovered file against the
+// reference; it returns a nil Divergence if they are identical.
+func diffContent(name string, recovered, reference io.Reader) *Divergence {
+	const bufSize = 64 * 1024
+	rec := bufio.NewReaderSize(recovered, bufSize)
+	ref := bufio.NewReaderSize(reference, bufSize)
+	for off := int64(0); ; off++ {
+		recByte, recErr := rec.ReadByte()
+		refByte, refErr := ref.ReadByte()
+		switch {
+		case recErr != nil && !errors.Is(recErr, io.EOF):
+			return &Divergence{Path: name, Kind: KindError, Offset: off, Recovered: recErr.Error()}
+		case refErr != nil && !errors.Is(refErr, io.EOF):
+			return &Divergence{Path: name, Kind: KindError, Offset: off, Reference: refErr.Error()}
+		case recErr != nil && refErr != nil:
+			return nil
+		case recErr != nil:
+			return &Divergence{Path: name, Kind: KindContent, Offset: off, Recovered: "EOF", Reference: fmt.Sprintf("%#02x", refByte)}
+		case refErr != nil:
+			return &Divergence{Path: name, Kind: KindContent, Offset: off, Recovered: fmt.Sprintf("%#02x", recByte), Reference: "EOF"}
+		case recByte != refByte:
+			return &Divergence{Path: name, Kind: KindContent, Offset: off,
+				Recovered: fmt.Sprintf("%#02x", recByte), Reference: fmt.Sprintf("%#02x", refByte)}
+		}
+	}
+}
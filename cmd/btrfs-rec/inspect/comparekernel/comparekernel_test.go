@@ -0,0 +1,93 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package comparekernel
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+)
+
+func TestDiffContent(t *testing.T) {
+	t.Parallel()
+	type testcase struct {
+		Recovered string
+		Reference string
+		Exp       *Divergence
+	}
+	testcases := map[string]testcase{
+		"equal": {
+			Recovered: "hello world",
+			Reference: "hello world",
+		},
+		"empty": {},
+		"differ": {
+			Recovered: "hello world",
+			Reference: "hello World",
+			Exp:       &Divergence{Path: "/f", Kind: KindContent, Offset: 6, Recovered: "0x77", Reference: "0x57"},
+		},
+		"short": {
+			Recovered: "hello",
+			Reference: "hello world",
+			Exp:       &Divergence{Path: "/f", Kind: KindContent, Offset: 5, Recovered: "EOF", Reference: "0x20"},
+		},
+		"long": {
+			Recovered: "hello world",
+			Reference: "hello",
+			Exp:       &Divergence{Path: "/f", Kind: KindContent, Offset: 5, Recovered: "0x20", Reference: "EOF"},
+		},
+		"big": {
+			Recovered: strings.Repeat("a", 200*1024) + "b",
+			Reference: strings.Repeat("a", 200*1024) + "c",
+			Exp:       &Divergence{Path: "/f", Kind: KindContent, Offset: 200 * 1024, Recovered: "0x62", Reference: "0x63"},
+		},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.Exp, diffContent("/f", strings.NewReader(tc.Recovered), strings.NewReader(tc.Reference)))
+		})
+	}
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+		rec := iotest.TimeoutReader(strings.NewReader(strings.Repeat("a", 100*1024)))
+		d := diffContent("/f", rec, strings.NewReader(strings.Repeat("a", 100*1024)))
+		assert.Equal(t, &Divergence{Path: "/f", Kind: KindError, Offset: 64 * 1024, Recovered: iotest.ErrTimeout.Error()}, d)
+	})
+}
+
+func TestSampled(t *testing.T) {
+	t.Parallel()
+	assert.True(t, sampled("/a", 0))
+	assert.True(t, sampled("/a", 1))
+	n := 0
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("/dir/file-%d", i)
+		if sampled(name, 10) {
+			n++
+		}
+		// Stable across calls.
+		assert.Equal(t, sampled(name, 10), sampled(name, 10))
+	}
+	assert.InDelta(t, 100, n, 50)
+}
+
+func TestFileType(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, btrfsitem.FT_REG_FILE, fileType(0o644))
+	assert.Equal(t, btrfsitem.FT_DIR, fileType(fs.ModeDir|0o755))
+	assert.Equal(t, btrfsitem.FT_SYMLINK, fileType(fs.ModeSymlink|0o777))
+	assert.Equal(t, btrfsitem.FT_CHRDEV, fileType(fs.ModeDevice|fs.ModeCharDevice))
+	assert.Equal(t, btrfsitem.FT_BLKDEV, fileType(fs.ModeDevice))
+	assert.Equal(t, btrfsitem.FT_FIFO, fileType(fs.ModeNamedPipe))
+	assert.Equal(t, btrfsitem.FT_SOCK, fileType(fs.ModeSocket))
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package difftrees is the guts of the `btrfs-rec inspect diff-trees`
+// command, which compares two sets of tree roots (as output by
+// `btrfs-rec inspect rebuild-trees`).
+package difftrees
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// Roots is a set of tree roots, as output by `btrfs-rec inspect
+// rebuild-trees`.
+type Roots = map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]
+
+// A Side is one of the two things being compared.
+type Side[T any] struct {
+	Name string
+	Val  T
+}
+
+func fmtAddrs(set containers.Set[btrfsvol.LogicalAddr]) string {
+	var buf strings.Builder
+	for i, addr := range maps.SortedKeys(set) {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		textui.Fprintf(&buf, "%v", addr)
+	}
+	return buf.String()
+}
+
+// DiffRoots prints, for each tree, the roots that are in one set but
+// not in the other, followed by a one-line summary.  It does not need
+// to read the filesystem, and so is quick.  It returns the IDs of the
+// trees that differ.
+func DiffRoots(out io.Writer, a, b Side[Roots]) []btrfsprim.ObjID {
+	allIDs := make(containers.Set[btrfsprim.ObjID], len(a.Val)+len(b.Val))
+	for treeID := range a.Val {
+		allIDs.Insert(treeID)
+	}
+	for treeID := range b.Val {
+		allIDs.Insert(treeID)
+	}
+
+	var differ []btrfsprim.ObjID
+	for _, treeID := range maps.SortedKeys(allIDs) {
+		aRoots, inA := a.Val[treeID]
+		bRoots, inB := b.Val[treeID]
+		onlyA := make(containers.Set[btrfsvol.LogicalAddr])
+		for addr := range aRoots {
+			if !bRoots.Has(addr) {
+				onlyA.Insert(addr)
+			}
+		}
+		onlyB := make(containers.Set[btrfsvol.LogicalAddr])
+		for addr := range bRoots {
+			if !aRoots.Has(addr) {
+				onlyB.Insert(addr)
+			}
+		}
+		if len(onlyA) == 0 && len(onlyB) == 0 && inA == inB {
+			continue
+		}
+		differ = append(differ, treeID)
+		switch {
+		case !inB:
+			textui.Fprintf(out, "tree %v: only in %s: %s\n", treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), a.Name, fmtAddrs(onlyA))
+		case !inA:
+			textui.Fprintf(out, "tree %v: only in %s: %s\n", treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), b.Name, fmtAddrs(onlyB))
+		default:
+			if len(onlyA) > 0 {
+				textui.Fprintf(out, "tree %v: roots only in %s: %s\n", treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), a.Name, fmtAddrs(onlyA))
+			}
+			if len(onlyB) > 0 {
+				textui.Fprintf(out, "tree %v: roots only in %s: %s\n", treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), b.Name, fmtAddrs(onlyB))
+			}
+		}
+	}
+	textui.Fprintf(out, "%v of %v trees differ\n", len(differ), len(allIDs))
+	return differ
+}
+
+// DiffItems compares the keys of the items in each of the given trees
+// between two RebuiltForrests, and prints the keys that are in one
+// tree but not the other.
+//
+// The item maps are walked one tree at a time (and released after
+// each tree), and at most `maxItems` keys are printed per tree per
+// side (0 for no limit), so that the output stays usable on large
+// trees; the counts are always exact.
+func DiffItems(ctx context.Context, out io.Writer, a, b Side[*btrfsutil.RebuiltForrest], treeIDs []btrfsprim.ObjID, maxItems int) {
+	for _, treeID := range treeIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		treeA, err := a.Val.RebuiltTree(ctx, treeID)
+		if err != nil {
+			textui.Fprintf(out, "tree %v: %s: %v\n", treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), a.Name, err)
+			continue
+		}
+		treeB, err := b.Val.RebuiltTree(ctx, treeID)
+		if err != nil {
+			textui.Fprintf(out, "tree %v: %s: %v\n", treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), b.Name, err)
+			continue
+		}
+
+		itemsA := treeA.RebuiltAcquireItems(ctx)
+		itemsB := treeB.RebuiltAcquireItems(ctx)
+		onlyIn := func(name string, this, other *containers.SortedMap[btrfsprim.Key, btrfsutil.ItemPtr]) int {
+			n := 0
+			this.Range(func(key btrfsprim.Key, _ btrfsutil.ItemPtr) bool {
+				if other.Has(key) {
+					return true
+				}
+				if maxItems <= 0 || n < maxItems {
+					textui.Fprintf(out, "tree %v: item only in %s: key %v\n", treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), name, key.Format(treeID))
+				}
+				n++
+				return ctx.Err() == nil
+			})
+			return n
+		}
+		nA := onlyIn(a.Name, itemsA, itemsB)
+		nB := onlyIn(b.Name, itemsB, itemsA)
+		textui.Fprintf(out, "tree %v: %v items in %s (%v only there), %v items in %s (%v only there)",
+			treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), itemsA.Len(), a.Name, nA, itemsB.Len(), b.Name, nB)
+		if maxItems > 0 && (nA > maxItems || nB > maxItems) {
+			textui.Fprintf(out, "; only the first %v of each are shown", maxItems)
+		}
+		textui.Fprintf(out, "\n")
+		treeA.RebuiltReleaseItems()
+		treeB.RebuiltReleaseItems()
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package difftrees
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func TestDiffRoots(t *testing.T) {
+	t.Parallel()
+	a := Side[Roots]{Name: "a.json", Val: Roots{
+		btrfsprim.FS_TREE_OBJECTID:  containers.NewSet[btrfsvol.LogicalAddr](0x1000, 0x2000),
+		btrfsprim.DEV_TREE_OBJECTID: containers.NewSet[btrfsvol.LogicalAddr](0x3000),
+		256:                         containers.NewSet[btrfsvol.LogicalAddr](0x5000),
+	}}
+	b := Side[Roots]{Name: "b.json", Val: Roots{
+		btrfsprim.FS_TREE_OBJECTID:  containers.NewSet[btrfsvol.LogicalAddr](0x1000, 0x4000),
+		btrfsprim.DEV_TREE_OBJECTID: containers.NewSet[btrfsvol.LogicalAddr](0x3000),
+		257:                         containers.NewSet[btrfsvol.LogicalAddr](),
+	}}
+	var out strings.Builder
+	differ := DiffRoots(&out, a, b)
+	assert.Equal(t, []btrfsprim.ObjID{btrfsprim.FS_TREE_OBJECTID, 256, 257}, differ)
+	assert.Equal(t, ""+
+		"tree FS_TREE: roots only in a.json: 0x0000000000002000\n"+
+		"tree FS_TREE: roots only in b.json: 0x0000000000004000\n"+
+		"tree 256: only in a.json: 0x0000000000005000\n"+
+		"tree 257: only in b.json: \n"+
+		"3 of 4 trees differ\n",
+		out.String())
+}
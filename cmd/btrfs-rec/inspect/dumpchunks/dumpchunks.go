@@ -0,0 +1,231 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package dumpchunks is the guts of the `btrfs-rec inspect
+// dump-chunks` command, which prints every chunk from both the
+// superblock's sys_chunk_array and the chunk tree, and checks that
+// the two agree.
+package dumpchunks
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// A Chunk is a single chunk, as described by the sys_chunk_array,
+// by the chunk tree, or by both.
+type Chunk struct {
+	LAddr     btrfsvol.LogicalAddr
+	SysArray  containers.Optional[btrfsitem.Chunk]
+	ChunkTree containers.Optional[btrfsitem.Chunk]
+}
+
+// A Problem is an inconsistency found by Compare.  A Serious problem
+// is one that affects the bootstrap (SYSTEM) chunks, which must be
+// self-consistent to even be able to read the chunk tree.
+type Problem struct {
+	LAddr   btrfsvol.LogicalAddr
+	Serious bool
+	Msg     string
+}
+
+func (p Problem) String() string {
+	sev := "warning"
+	if p.Serious {
+		sev = "SERIOUS"
+	}
+	return fmt.Sprintf("%s: chunk@%v: %s", sev, p.LAddr, p.Msg)
+}
+
+// Compare merges the chunks from the sys_chunk_array with the chunks
+// from the chunk tree, and checks them against each other and
+// against the known device UUIDs.
+func Compare(
+	sysArray []btrfstree.SysChunk,
+	chunkTree map[btrfsvol.LogicalAddr]btrfsitem.Chunk,
+	devUUIDs map[btrfsvol.DeviceID]btrfsprim.UUID,
+) ([]Chunk, []Problem) {
+	chunks := make(map[btrfsvol.LogicalAddr]*Chunk)
+	get := func(laddr btrfsvol.LogicalAddr) *Chunk {
+		chunk, ok := chunks[laddr]
+		if !ok {
+			chunk = &Chunk{LAddr: laddr}
+			chunks[laddr] = chunk
+		}
+		return chunk
+	}
+	var problems []Problem
+	for _, sc := range sysArray {
+		laddr := btrfsvol.LogicalAddr(sc.Key.Offset)
+		chunk := get(laddr)
+		if chunk.SysArray.OK {
+			problems = append(problems, Problem{laddr, true, "appears more than once in the sys_chunk_array"})
+		}
+		chunk.SysArray = containers.OptionalValue(sc.Chunk)
+	}
+	for laddr, body := range chunkTree {
+		get(laddr).ChunkTree = containers.OptionalValue(body)
+	}
+
+	ret := make([]Chunk, 0, len(chunks))
+	for _, laddr := range maps.SortedKeys(chunks) {
+		chunk := *chunks[laddr]
+		ret = append(ret, chunk)
+		switch {
+		case chunk.SysArray.OK && chunk.ChunkTree.OK:
+			if !chunk.SysArray.Val.Head.Type.Has(btrfsvol.BLOCK_GROUP_SYSTEM) {
+				problems = append(problems, Problem{laddr, true, fmt.Sprintf("in the sys_chunk_array, but has type %v, not SYSTEM",
+					chunk.SysArray.Val.Head.Type)})
+			}
+			if !chunksEqual(chunk.SysArray.Val, chunk.ChunkTree.Val) {
+				problems = append(problems, Problem{laddr, true, "the sys_chunk_array and the chunk tree disagree about this chunk"})
+			}
+		case chunk.SysArray.OK:
+			problems = append(problems, Problem{laddr, true, "in the sys_chunk_array, but not in the chunk tree"})
+		case chunk.ChunkTree.OK && chunk.ChunkTree.Val.Head.Type.Has(btrfsvol.BLOCK_GROUP_SYSTEM):
+			problems = append(problems, Problem{laddr, true, "a SYSTEM chunk in the chunk tree, but not in the sys_chunk_array; " +
+				"chunk tree nodes in it can't be read"})
+		}
+		for _, body := range []containers.Optional[btrfsitem.Chunk]{chunk.SysArray, chunk.ChunkTree} {
+			if !body.OK {
+				continue
+			}
+			for i, stripe := range body.Val.Stripes {
+				uuid, ok := devUUIDs[stripe.DeviceID]
+				switch {
+				case !ok:
+					problems = append(problems, Problem{laddr, body.Val.Head.Type.Has(btrfsvol.BLOCK_GROUP_SYSTEM),
+						fmt.Sprintf("stripe %v: unknown device %v", i, stripe.DeviceID)})
+				case uuid != stripe.DeviceUUID:
+					problems = append(problems, Problem{laddr, body.Val.Head.Type.Has(btrfsvol.BLOCK_GROUP_SYSTEM),
+						fmt.Sprintf("stripe %v: device %v has uuid=%v, but the stripe says uuid=%v",
+							i, stripe.DeviceID, uuid, stripe.DeviceUUID)})
+				}
+			}
+			if chunk.SysArray.OK && chunk.ChunkTree.OK {
+				// Only check the stripes once if they're
+				// the same.
+				break
+			}
+		}
+	}
+	return ret, problems
+}
+
+func chunksEqual(a, b btrfsitem.Chunk) bool {
+	if a.Head != b.Head || len(a.Stripes) != len(b.Stripes) {
+		return false
+	}
+	for i := range a.Stripes {
+		if a.Stripes[i] != b.Stripes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// DeviceUUIDs returns the UUID of each device, both from the opened
+// devices' superblocks, and from the DEV_ITEMs in the chunk tree.
+func DeviceUUIDs(ctx context.Context, fs *btrfs.FS) map[btrfsvol.DeviceID]btrfsprim.UUID {
+	ret := make(map[btrfsvol.DeviceID]btrfsprim.UUID)
+	for devID, dev := range fs.LV.PhysicalVolumes() {
+		if sb, err := dev.Superblock(); err == nil {
+			ret[devID] = sb.DevItem.DevUUID
+		}
+	}
+	if chunkTree, err := fs.ForrestLookup(ctx, btrfsprim.CHUNK_TREE_OBJECTID); err == nil {
+		_ = chunkTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+			if body, ok := item.Body.(*btrfsitem.Dev); ok && item.Key.ItemType == btrfsitem.DEV_ITEM_KEY {
+				if _, have := ret[body.DevID]; !have {
+					ret[body.DevID] = body.DevUUID
+				}
+			}
+			return true
+		})
+	}
+	return ret
+}
+
+// DumpChunks writes every chunk, and every problem found by Compare,
+// to `out`.  It returns the number of serious problems.
+func DumpChunks(ctx context.Context, out io.Writer, fs *btrfs.FS) (int, error) {
+	sb, err := fs.Superblock()
+	if err != nil {
+		return 0, err
+	}
+	var problems []Problem
+	sysArray, err := sb.ParseSysChunkArray()
+	if err != nil {
+		problems = append(problems, Problem{0, true, fmt.Sprintf("sys_chunk_array: %v", err)})
+	}
+	treeChunks := make(map[btrfsvol.LogicalAddr]btrfsitem.Chunk)
+	chunkTree, err := fs.ForrestLookup(ctx, btrfsprim.CHUNK_TREE_OBJECTID)
+	if err != nil {
+		problems = append(problems, Problem{0, true, fmt.Sprintf("chunk tree: %v", err)})
+	} else {
+		err := chunkTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+			if item.Key.ItemType != btrfsitem.CHUNK_ITEM_KEY {
+				return true
+			}
+			laddr := btrfsvol.LogicalAddr(item.Key.Offset)
+			switch body := item.Body.(type) {
+			case *btrfsitem.Chunk:
+				treeChunks[laddr] = body.Clone()
+			case *btrfsitem.Error:
+				problems = append(problems, Problem{laddr, false, fmt.Sprintf("chunk tree: %v", body.Err)})
+			}
+			return ctx.Err() == nil
+		})
+		if err != nil {
+			problems = append(problems, Problem{0, true, fmt.Sprintf("chunk tree: %v", err)})
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	devUUIDs := DeviceUUIDs(ctx, fs)
+
+	chunks, compareProblems := Compare(sysArray, treeChunks, devUUIDs)
+	problems = append(problems, compareProblems...)
+
+	for _, chunk := range chunks {
+		body := chunk.ChunkTree
+		var sources string
+		switch {
+		case chunk.SysArray.OK && chunk.ChunkTree.OK:
+			sources = "sys_chunk_array+chunk_tree"
+		case chunk.SysArray.OK:
+			sources = "sys_chunk_array"
+			body = chunk.SysArray
+		default:
+			sources = "chunk_tree"
+		}
+		textui.Fprintf(out, "chunk laddr=%v size=%v type=%v owner=%v from=%s\n",
+			chunk.LAddr, body.Val.Head.Size, body.Val.Head.Type, body.Val.Head.Owner, sources)
+		for i, stripe := range body.Val.Stripes {
+			textui.Fprintf(out, "\tstripe %v: devid=%v uuid=%v paddr=%v\n",
+				i, stripe.DeviceID, stripe.DeviceUUID, stripe.Offset)
+		}
+	}
+	var numSerious int
+	for _, problem := range problems {
+		if problem.Serious {
+			numSerious++
+		}
+		textui.Fprintf(out, "%v\n", problem)
+	}
+	textui.Fprintf(out, "%v chunks (%v in sys_chunk_array, %v in chunk tree); %v problems (%v serious)\n",
+		len(chunks), len(sysArray), len(treeChunks), len(problems), numSerious)
+	return numSerious, nil
+}
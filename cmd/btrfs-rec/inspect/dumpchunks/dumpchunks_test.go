@@ -0,0 +1,77 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package dumpchunks_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/dumpchunks"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+	uuid1 := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000001")
+	uuid2 := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000002")
+	chunk := func(typ btrfsvol.BlockGroupFlags, paddr btrfsvol.PhysicalAddr, uuid btrfsprim.UUID) btrfsitem.Chunk {
+		return btrfsitem.Chunk{
+			Head: btrfsitem.ChunkHeader{
+				Size:       0x100000,
+				Owner:      btrfsprim.EXTENT_TREE_OBJECTID,
+				Type:       typ,
+				NumStripes: 1,
+			},
+			Stripes: []btrfsitem.ChunkStripe{{DeviceID: 1, Offset: paddr, DeviceUUID: uuid}},
+		}
+	}
+	sysKey := func(laddr btrfsvol.LogicalAddr) btrfsprim.Key {
+		return btrfsprim.Key{
+			ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID,
+			ItemType: btrfsitem.CHUNK_ITEM_KEY,
+			Offset:   uint64(laddr),
+		}
+	}
+
+	sysArray := []btrfstree.SysChunk{
+		// OK: in both, and they agree.
+		{Key: sysKey(0x100000), Chunk: chunk(btrfsvol.BLOCK_GROUP_SYSTEM, 0x100000, uuid1)},
+		// In both, but they disagree.
+		{Key: sysKey(0x200000), Chunk: chunk(btrfsvol.BLOCK_GROUP_SYSTEM, 0x200000, uuid1)},
+		// Only in the sys_chunk_array.
+		{Key: sysKey(0x300000), Chunk: chunk(btrfsvol.BLOCK_GROUP_SYSTEM, 0x300000, uuid1)},
+	}
+	chunkTree := map[btrfsvol.LogicalAddr]btrfsitem.Chunk{
+		0x100000: chunk(btrfsvol.BLOCK_GROUP_SYSTEM, 0x100000, uuid1),
+		0x200000: chunk(btrfsvol.BLOCK_GROUP_SYSTEM, 0x280000, uuid1),
+		// A SYSTEM chunk that is only in the chunk tree.
+		0x400000: chunk(btrfsvol.BLOCK_GROUP_SYSTEM, 0x400000, uuid1),
+		// A DATA chunk (which belongs only in the chunk
+		// tree), with the wrong device UUID.
+		0x500000: chunk(btrfsvol.BLOCK_GROUP_DATA, 0x500000, uuid2),
+	}
+	devUUIDs := map[btrfsvol.DeviceID]btrfsprim.UUID{1: uuid1}
+
+	chunks, problems := dumpchunks.Compare(sysArray, chunkTree, devUUIDs)
+	assert.Len(t, chunks, 5)
+	assert.True(t, chunks[0].SysArray.OK && chunks[0].ChunkTree.OK)
+	assert.True(t, chunks[2].SysArray.OK && !chunks[2].ChunkTree.OK)
+	assert.True(t, !chunks[3].SysArray.OK && chunks[3].ChunkTree.OK)
+
+	var strs []string
+	for _, problem := range problems {
+		strs = append(strs, problem.String())
+	}
+	assert.Equal(t, []string{
+		"SERIOUS: chunk@0x0000000000200000: the sys_chunk_array and the chunk tree disagree about this chunk",
+		"SERIOUS: chunk@0x0000000000300000: in the sys_chunk_array, but not in the chunk tree",
+		"SERIOUS: chunk@0x0000000000400000: a SYSTEM chunk in the chunk tree, but not in the sys_chunk_array; chunk tree nodes in it can't be read",
+		"warning: chunk@0x0000000000500000: stripe 0: device 1 has uuid=" + uuid1.String() + ", but the stripe says uuid=" + uuid2.String(),
+	}, strs)
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package dumptrees
+
+import (
+	"fmt"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// A rootEntry is a ROOT_ITEM in the ROOT_TREE.
+type rootEntry struct {
+	Key btrfsprim.Key
+
+	// OK is whether the ROOT_ITEM body could be decoded; if not,
+	// then UUID and ParentUUID are zero.
+	OK         bool
+	UUID       btrfsprim.UUID
+	ParentUUID btrfsprim.UUID
+
+	// Note is an annotation about the entry's lineage, set by
+	// orderByLineage.
+	Note string
+}
+
+func isSubvol(treeID btrfsprim.ObjID) bool {
+	return treeID == btrfsprim.FS_TREE_OBJECTID ||
+		(treeID >= btrfsprim.FIRST_FREE_OBJECTID && treeID <= btrfsprim.LAST_FREE_OBJECTID)
+}
+
+// orderByLineage re-orders the ROOT_ITEMs so that each subvolume tree
+// comes after its parent; a snapshot's parent is the subvolume that
+// it is a snapshot of (by ParentUUID), and any other subvolume's
+// parent is the subvolume that contains it (by ROOT_REF).  Non-subvolume
+// trees come first, in their original order.
+//
+// If `start` is non-zero, then only `start` and its descendants are
+// included (along with no non-subvolume trees).
+//
+// Lineage cycles are broken, and both cycles and parents that can't
+// be resolved are annotated in the entries' .Note, rather than
+// causing any trees to be omitted.
+func orderByLineage(entries []rootEntry, refs map[btrfsprim.ObjID]btrfsprim.ObjID, start btrfsprim.ObjID) []rootEntry {
+	byID := make(map[btrfsprim.ObjID]int, len(entries))
+	byUUID := make(map[btrfsprim.UUID]btrfsprim.ObjID)
+	for i, entry := range entries {
+		if _, dup := byID[entry.Key.ObjectID]; dup {
+			continue
+		}
+		byID[entry.Key.ObjectID] = i
+		if entry.OK && entry.UUID != (btrfsprim.UUID{}) {
+			byUUID[entry.UUID] = entry.Key.ObjectID
+		}
+	}
+
+	var ret []rootEntry
+	parents := make(map[btrfsprim.ObjID]btrfsprim.ObjID)
+	children := make(map[btrfsprim.ObjID][]btrfsprim.ObjID)
+	snapshots := make(containers.Set[btrfsprim.ObjID])
+	var topLevel []btrfsprim.ObjID
+	for i, entry := range entries {
+		treeID := entry.Key.ObjectID
+		if byID[treeID] != i {
+			continue
+		}
+		if !isSubvol(treeID) {
+			if start == 0 {
+				ret = append(ret, entry)
+			}
+			continue
+		}
+		var parent btrfsprim.ObjID
+		switch {
+		case entry.OK && entry.ParentUUID != (btrfsprim.UUID{}):
+			var ok bool
+			parent, ok = byUUID[entry.ParentUUID]
+			if !ok {
+				entries[i].Note = fmt.Sprintf("broken lineage: parent UUID %v does not match any tree", entry.ParentUUID)
+			}
+		case maps.HasKey(refs, treeID):
+			parent = refs[treeID]
+			if !maps.HasKey(byID, parent) {
+				entries[i].Note = fmt.Sprintf("broken lineage: containing subvolume %v has no ROOT_ITEM", parent)
+				parent = 0
+			}
+		}
+		if parent == 0 || parent == treeID {
+			topLevel = append(topLevel, treeID)
+			continue
+		}
+		parents[treeID] = parent
+		children[parent] = append(children[parent], treeID)
+		if entry.OK && entry.ParentUUID != (btrfsprim.UUID{}) {
+			snapshots.Insert(treeID)
+		}
+	}
+
+	// Anything that is part of a cycle is not reachable from
+	// topLevel; break each cycle at its lowest-numbered member.
+	reachable := make(containers.Set[btrfsprim.ObjID])
+	var mark func(btrfsprim.ObjID)
+	mark = func(treeID btrfsprim.ObjID) {
+		if reachable.Has(treeID) {
+			return
+		}
+		reachable.Insert(treeID)
+		for _, child := range children[treeID] {
+			mark(child)
+		}
+	}
+	for _, treeID := range topLevel {
+		mark(treeID)
+	}
+	for _, treeID := range maps.SortedKeys(parents) {
+		if reachable.Has(treeID) {
+			continue
+		}
+		entries[byID[treeID]].Note = fmt.Sprintf("broken lineage: cycle through parent %v", parents[treeID])
+		topLevel = append(topLevel, treeID)
+		delete(parents, treeID)
+		mark(treeID)
+	}
+
+	var walk func(btrfsprim.ObjID)
+	walk = func(treeID btrfsprim.ObjID) {
+		entry := entries[byID[treeID]]
+		if parent, ok := parents[treeID]; ok && entry.Note == "" {
+			if snapshots.Has(treeID) {
+				entry.Note = fmt.Sprintf("snapshot of %v", parent)
+			} else {
+				entry.Note = fmt.Sprintf("inside %v", parent)
+			}
+		}
+		ret = append(ret, entry)
+		for _, child := range children[treeID] {
+			if _, stillChild := parents[child]; stillChild {
+				walk(child)
+			}
+		}
+	}
+	if start != 0 {
+		if maps.HasKey(byID, start) && isSubvol(start) {
+			delete(parents, start)
+			walk(start)
+		}
+		return ret
+	}
+	for _, treeID := range topLevel {
+		walk(treeID)
+	}
+	return ret
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package dumptrees
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func TestOrderByLineage(t *testing.T) {
+	t.Parallel()
+
+	uuid := func(n byte) btrfsprim.UUID {
+		return btrfsprim.UUID{15: n}
+	}
+	entry := func(id btrfsprim.ObjID, self, parent byte) rootEntry {
+		ret := rootEntry{
+			Key: btrfsprim.Key{ObjectID: id, ItemType: btrfsitem.ROOT_ITEM_KEY},
+			OK:  true,
+		}
+		if self != 0 {
+			ret.UUID = uuid(self)
+		}
+		if parent != 0 {
+			ret.ParentUUID = uuid(parent)
+		}
+		return ret
+	}
+	type result struct {
+		ID   btrfsprim.ObjID
+		Note string
+	}
+	summarize := func(entries []rootEntry) []result {
+		var ret []result
+		for _, entry := range entries {
+			ret = append(ret, result{entry.Key.ObjectID, entry.Note})
+		}
+		return ret
+	}
+
+	entries := func() []rootEntry {
+		return []rootEntry{
+			entry(btrfsprim.EXTENT_TREE_OBJECTID, 0, 0),
+			entry(btrfsprim.FS_TREE_OBJECTID, 5, 0),
+			entry(256, 1, 3),  // snapshot of 258
+			entry(257, 2, 0),  // contained in FS_TREE
+			entry(258, 3, 0),  // contained in 257
+			entry(259, 4, 99), // snapshot of something that's gone
+			entry(260, 6, 7),  // cycle
+			entry(261, 7, 6),  // cycle
+		}
+	}
+	refs := map[btrfsprim.ObjID]btrfsprim.ObjID{
+		256: btrfsprim.FS_TREE_OBJECTID,
+		257: btrfsprim.FS_TREE_OBJECTID,
+		258: 257,
+	}
+
+	assert.Equal(t, []result{
+		{btrfsprim.EXTENT_TREE_OBJECTID, ""},
+		{btrfsprim.FS_TREE_OBJECTID, ""},
+		{257, "inside FS_TREE"},
+		{258, "inside 257"},
+		{256, "snapshot of 258"},
+		{259, "broken lineage: parent UUID 00000000-0000-0000-0000-000000000063 does not match any tree"},
+		{260, "broken lineage: cycle through parent 261"},
+		{261, "snapshot of 260"},
+	}, summarize(orderByLineage(entries(), refs, 0)))
+
+	assert.Equal(t, []result{
+		{257, ""},
+		{258, "inside 257"},
+		{256, "snapshot of 258"},
+	}, summarize(orderByLineage(entries(), refs, 257)))
+
+	assert.Nil(t, orderByLineage(entries(), refs, btrfsprim.EXTENT_TREE_OBJECTID))
+}
@@ -7,9 +7,13 @@
 package dumptrees
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 
+	"github.com/datawire/dlib/dgroup"
 	"github.com/datawire/dlib/dlog"
 
 	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
@@ -19,41 +23,135 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
 	"git.lukeshu.com/btrfs-progs-ng/lib/slices"
 	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
-func DumpTrees(ctx context.Context, out io.Writer, fs btrfs.ReadableFS) {
+// Config configures DumpTrees.
+type Config struct {
+	// FollowRootRefs orders the subvolume trees by lineage, so
+	// that each subvolume comes after its parent (the subvolume
+	// that it is a snapshot of, or else the subvolume that
+	// contains it), rather than by tree ID.
+	FollowRootRefs bool
+	// StartSubvol, if non-zero, restricts the dump to just that
+	// subvolume tree and its descendants; it implies
+	// FollowRootRefs.
+	StartSubvol btrfsprim.ObjID
+	// KeyFilter restricts which items are printed; subtrees that
+	// cannot contain any matching items are not walked at all.
+	KeyFilter btrfstree.KeyFilter
+	// Workers, if greater than 1, is the number of goroutines to
+	// use to marshal and render the items of each leaf node.  The
+	// output is identical to the serial output; this only makes
+	// large dumps faster.
+	Workers int
+	// FailOnError makes DumpTrees return an error if any tree
+	// could not be dumped, rather than just logging it.
+	FailOnError bool
+
+	Style
+}
+
+// A Style is how DumpTrees and PrintNode format their output.
+type Style struct {
+	// TimeFormat is how timestamps are formatted (after the raw
+	// seconds.nanoseconds value).
+	TimeFormat btrfsprim.TimeFormat
+	// Color is whether to colorize the output with ANSI escape
+	// sequences; without it, the output is plain text, identical
+	// to `btrfs inspect-internal dump-tree`'s.
+	Color bool
+}
+
+// DumpTrees writes out every tree in the filesystem, in the same
+// format as `btrfs inspect-internal dump-tree`.
+//
+// A tree that cannot be dumped (because its root can't be found or
+// read) does not stop the other trees from being dumped; nor does an
+// unreadable node within a tree stop the rest of that tree from being
+// dumped.  Once every tree has been attempted, the trees that could
+// not be dumped are logged along with a summary.  Only if
+// cfg.FailOnError is set is an error returned for them.
+func DumpTrees(ctx context.Context, out io.Writer, fs btrfs.ReadableFS, cfg Config) error {
 	superblock, err := fs.Superblock()
 	if err != nil {
+		if cfg.FailOnError {
+			return err
+		}
 		dlog.Error(ctx, err)
-		return
+		return nil
 	}
 
-	if superblock.RootTree != 0 {
-		textui.Fprintf(out, "root tree\n")
-		printTree(ctx, out, fs, btrfsprim.ROOT_TREE_OBJECTID)
-	}
-	if superblock.ChunkTree != 0 {
-		textui.Fprintf(out, "chunk tree\n")
-		printTree(ctx, out, fs, btrfsprim.CHUNK_TREE_OBJECTID)
-	}
-	if superblock.LogTree != 0 {
-		textui.Fprintf(out, "log root tree\n")
-		printTree(ctx, out, fs, btrfsprim.TREE_LOG_OBJECTID)
+	var stats dumpStats
+	dump := func(name string, treeID btrfsprim.ObjID) {
+		numBadNodes, numPhantomOwners, err := printTree(ctx, out, fs, treeID, cfg)
+		stats.NumPhantomOwners += numPhantomOwners
+		switch {
+		case err != nil:
+			dlog.Errorf(ctx, "%s: %v", name, err)
+			stats.Failed = append(stats.Failed, failedTree{Name: name, Err: err})
+		case numBadNodes > 0:
+			stats.NumDumped++
+			stats.NumPartial++
+		default:
+			stats.NumDumped++
+		}
 	}
-	if superblock.BlockGroupRoot != 0 {
-		textui.Fprintf(out, "block group tree\n")
-		printTree(ctx, out, fs, btrfsprim.BLOCK_GROUP_TREE_OBJECTID)
+
+	if cfg.StartSubvol == 0 {
+		if superblock.RootTree != 0 {
+			textui.Fprintf(out, "root tree\n")
+			dump("root tree", btrfsprim.ROOT_TREE_OBJECTID)
+		}
+		if superblock.ChunkTree != 0 {
+			textui.Fprintf(out, "chunk tree\n")
+			dump("chunk tree", btrfsprim.CHUNK_TREE_OBJECTID)
+		}
+		if superblock.LogTree != 0 {
+			textui.Fprintf(out, "log root tree\n")
+			dump("log root tree", btrfsprim.TREE_LOG_OBJECTID)
+		}
+		if superblock.BlockGroupTree() == btrfsprim.BLOCK_GROUP_TREE_OBJECTID {
+			textui.Fprintf(out, "block group tree\n")
+			dump("block group tree", btrfsprim.BLOCK_GROUP_TREE_OBJECTID)
+		}
 	}
 	rootTree, err := fs.ForrestLookup(ctx, btrfsprim.ROOT_TREE_OBJECTID)
 	if err != nil {
-		dlog.Errorf(ctx, "root tree: %v", err)
+		err = fmt.Errorf("listing the trees in the root tree: %w", err)
+		dlog.Errorf(ctx, "%v", err)
+		stats.Failed = append(stats.Failed, failedTree{Name: "(all trees listed in the root tree)", Err: err})
 	} else {
+		var entries []rootEntry
+		refs := make(map[btrfsprim.ObjID]btrfsprim.ObjID)
 		if err := rootTree.TreeRange(ctx, func(item btrfstree.Item) bool {
-			if item.Key.ItemType != btrfsitem.ROOT_ITEM_KEY {
-				return true
+			switch item.Key.ItemType {
+			case btrfsitem.ROOT_ITEM_KEY:
+				entry := rootEntry{Key: item.Key}
+				if body, ok := item.Body.(*btrfsitem.Root); ok {
+					entry.OK = true
+					entry.UUID = body.UUID
+					entry.ParentUUID = body.ParentUUID
+				}
+				entries = append(entries, entry)
+			case btrfsitem.ROOT_REF_KEY:
+				refs[btrfsprim.ObjID(item.Key.Offset)] = item.Key.ObjectID
+			}
+			return true
+		}); err != nil {
+			// Keep going with the trees that we did find.
+			dlog.Errorf(ctx, "iterating over root tree: %v", err)
+			stats.Failed = append(stats.Failed, failedTree{Name: "(some trees listed in the root tree)", Err: err})
+		}
+		if cfg.FollowRootRefs || cfg.StartSubvol != 0 {
+			entries = orderByLineage(entries, refs, cfg.StartSubvol)
+			if cfg.StartSubvol != 0 && len(entries) == 0 {
+				dlog.Errorf(ctx, "subvolume %v: no such subvolume tree", cfg.StartSubvol)
 			}
+		}
+		for _, entry := range entries {
 			treeName, ok := map[btrfsprim.ObjID]string{
 				btrfsprim.ROOT_TREE_OBJECTID:        "root",
 				btrfsprim.EXTENT_TREE_OBJECTID:      "extent",
@@ -73,20 +171,57 @@ func DumpTrees(ctx context.Context, out io.Writer, fs btrfs.ReadableFS) {
 				btrfsprim.FREE_SPACE_TREE_OBJECTID:  "free space",
 				btrfsprim.MULTIPLE_OBJECTIDS:        "multiple",
 				btrfsprim.BLOCK_GROUP_TREE_OBJECTID: "block group",
-			}[item.Key.ObjectID]
+			}[entry.Key.ObjectID]
 			if !ok {
 				treeName = "file"
 			}
-			textui.Fprintf(out, "%v tree key %v \n", treeName, item.Key.Format(btrfsprim.ROOT_TREE_OBJECTID))
-			printTree(ctx, out, fs, item.Key.ObjectID)
-			return true
-		}); err != nil {
-			dlog.Errorf(ctx, "iterating over root tree: %v", err)
+			textui.Fprintf(out, "%v tree key %v \n", treeName, entry.Key.Format(btrfsprim.ROOT_TREE_OBJECTID))
+			if entry.Note != "" {
+				textui.Fprintf(out, "lineage: %v\n", entry.Note)
+			}
+			dump(fmt.Sprintf("%v tree %v", treeName, entry.Key.ObjectID.Format(btrfsprim.ROOT_TREE_OBJECTID)), entry.Key.ObjectID)
 		}
 	}
 	textui.Fprintf(out, "total bytes %v\n", superblock.TotalBytes)
 	textui.Fprintf(out, "bytes used %v\n", superblock.BytesUsed)
 	textui.Fprintf(out, "uuid %v\n", superblock.FSUUID)
+
+	if err := stats.report(ctx); err != nil && cfg.FailOnError {
+		return err
+	}
+	return nil
+}
+
+type failedTree struct {
+	Name string
+	Err  error
+}
+
+type dumpStats struct {
+	NumDumped  int // including NumPartial
+	NumPartial int // dumped, but with unreadable nodes
+	// NumPhantomOwners is the number of unreadable nodes whose
+	// owner is not a tree that exists (see
+	// btrfstree.PhantomOwnerError).
+	NumPhantomOwners int
+	Failed           []failedTree
+}
+
+func (stats dumpStats) report(ctx context.Context) error {
+	dlog.Infof(ctx, "dumped %v trees (%v of them with unreadable nodes); %v could not be dumped",
+		stats.NumDumped, stats.NumPartial, len(stats.Failed))
+	if stats.NumPhantomOwners > 0 {
+		dlog.Errorf(ctx, "%v unreadable nodes have a phantom owner (an owner that is not a tree that exists); "+
+			"their headers are probably corrupt, rather than the nodes being misplaced",
+			stats.NumPhantomOwners)
+	}
+	if len(stats.Failed) == 0 {
+		return nil
+	}
+	for _, failed := range stats.Failed {
+		dlog.Errorf(ctx, "could not dump %s: %v", failed.Name, failed.Err)
+	}
+	return fmt.Errorf("%v trees could not be dumped", len(stats.Failed))
 }
 
 var nodeHeaderSize = binstruct.StaticSize(btrfstree.NodeHeader{})
@@ -94,297 +229,492 @@ var nodeHeaderSize = binstruct.StaticSize(btrfstree.NodeHeader{})
 // printTree mimics btrfs-progs
 // kernel-shared/print-tree.c:btrfs_print_tree() and
 // kernel-shared/print-tree.c:btrfs_print_leaf()
-func printTree(ctx context.Context, out io.Writer, fs btrfs.ReadableFS, treeID btrfsprim.ObjID) {
+//
+// It returns an error if the tree could not be dumped at all, and
+// otherwise the number of nodes that could not be read (each of which
+// is logged), and how many of those have a phantom owner.
+func printTree(ctx context.Context, out io.Writer, fs btrfs.ReadableFS, treeID btrfsprim.ObjID, cfg Config) (numBadNodes, numPhantomOwners int, err error) {
+	st := cfg.Style
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverIOError(r)
+		}
+	}()
 	var itemOffset uint32
+	var injected string
+	var rendered []renderedItem
 	handlers := btrfstree.TreeWalkHandler{
 		Node: func(path btrfstree.Path, node *btrfstree.Node) {
-			printHeaderInfo(out, node)
+			printHeaderInfo(out, st, node)
 			itemOffset = node.Size - uint32(nodeHeaderSize)
+			injected = ""
+			if btrfsutil.IsInjectedNode(node.Head.Addr) {
+				_, _ = io.WriteString(out, st.paint(textui.ColorYellow, "INJECTED: synthetic node; its items were hand-crafted with --import-items, and are not on disk\n"))
+				injected = " INJECTED"
+			}
+			rendered = nil
+			if cfg.Workers > 1 && len(node.BodyLeaf) > 1 {
+				rendered = renderItems(ctx, st, treeID, node.BodyLeaf, cfg.KeyFilter, cfg.Workers)
+			}
 		},
-		KeyPointer: func(_ btrfstree.Path, item btrfstree.KeyPointer) bool {
-			textui.Fprintf(out, "\tkey %v block %v gen %v\n",
-				item.Key.Format(treeID),
-				item.BlockPtr,
+		KeyPointer: func(path btrfstree.Path, item btrfstree.KeyPointer) bool {
+			kp := path[len(path)-1].(btrfstree.PathKP) //nolint:forcetypeassert // has to be
+			if !cfg.KeyFilter.MayContain(kp.ToMinKey, kp.ToMaxKey) {
+				return false
+			}
+			textui.Fprintf(out, "\tkey %s block %s gen %v\n",
+				st.paint(textui.ColorCyan, item.Key.Format(treeID)),
+				st.paint(textui.ColorBlue, textui.Sprintf("%v", item.BlockPtr)),
 				item.Generation)
 			return true
 		},
 		Item: func(path btrfstree.Path, item btrfstree.Item) {
-			bs, _ := binstruct.Marshal(item.Body)
-			itemSize := uint32(len(bs))
-			itemOffset -= itemSize
-			textui.Fprintf(out, "\titem %v key %v itemoff %v itemsize %v\n",
-				path[len(path)-1].(btrfstree.PathItem).FromSlot, //nolint:forcetypeassert // has to be
-				item.Key.Format(treeID),
-				itemOffset,
-				itemSize)
-			switch body := item.Body.(type) {
-			case *btrfsitem.FreeSpaceHeader:
-				textui.Fprintf(out, "\t\tlocation key %v\n", body.Location.Format(treeID))
-				textui.Fprintf(out, "\t\tcache generation %v entries %v bitmaps %v\n",
-					body.Generation, body.NumEntries, body.NumBitmaps)
-			case *btrfsitem.Inode:
-				textui.Fprintf(out, ""+
-					"\t\tgeneration %v transid %v size %v nbytes %v\n"+
-					"\t\tblock group %v mode %o links %v uid %v gid %v rdev %v\n"+
-					"\t\tsequence %v flags %v\n",
-					body.Generation, body.TransID, body.Size, body.NumBytes,
-					body.BlockGroup, body.Mode, body.NLink, body.UID, body.GID, body.RDev,
-					body.Sequence, body.Flags)
-				textui.Fprintf(out, "\t\tatime %v\n", fmtTime(body.ATime))
-				textui.Fprintf(out, "\t\tctime %v\n", fmtTime(body.CTime))
-				textui.Fprintf(out, "\t\tmtime %v\n", fmtTime(body.MTime))
-				textui.Fprintf(out, "\t\totime %v\n", fmtTime(body.OTime))
-			case *btrfsitem.InodeRefs:
-				for _, ref := range body.Refs {
-					textui.Fprintf(out, "\t\tindex %v namelen %v name: %s\n",
-						ref.Index, ref.NameLen, ref.Name)
-				}
-			// case btrfsitem.INODE_EXTREF_KEY:
-			// 	// TODO
-			case *btrfsitem.DirEntry:
-				textui.Fprintf(out, "\t\tlocation key %v type %v\n",
-					body.Location.Format(treeID), body.Type)
-				textui.Fprintf(out, "\t\ttransid %v data_len %v name_len %v\n",
-					body.TransID, body.DataLen, body.NameLen)
-				textui.Fprintf(out, "\t\tname: %s\n", body.Name)
-				if len(body.Data) > 0 {
-					textui.Fprintf(out, "\t\tdata %s\n", body.Data)
-				}
-			// case btrfsitem.DIR_LOG_INDEX_KEY, btrfsitem.DIR_LOG_ITEM_KEY:
-			// 	// TODO
-			case *btrfsitem.Root:
-				textui.Fprintf(out, "\t\tgeneration %v root_dirid %v bytenr %d byte_limit %v bytes_used %v\n",
-					body.Generation, body.RootDirID, body.ByteNr, body.ByteLimit, body.BytesUsed)
-				textui.Fprintf(out, "\t\tlast_snapshot %v flags %v refs %v\n",
-					body.LastSnapshot, body.Flags, body.Refs)
-				textui.Fprintf(out, "\t\tdrop_progress key %v drop_level %v\n",
-					body.DropProgress.Format(treeID), body.DropLevel)
-				textui.Fprintf(out, "\t\tlevel %v generation_v2 %v\n",
-					body.Level, body.GenerationV2)
-				if body.Generation == body.GenerationV2 {
-					textui.Fprintf(out, "\t\tuuid %v\n", body.UUID)
-					textui.Fprintf(out, "\t\tparent_uuid %v\n", body.ParentUUID)
-					textui.Fprintf(out, "\t\treceived_uuid %v\n", body.ReceivedUUID)
-					textui.Fprintf(out, "\t\tctransid %v otransid %v stransid %v rtransid %v\n",
-						body.CTransID, body.OTransID, body.STransID, body.RTransID)
-					textui.Fprintf(out, "\t\tctime %v\n", fmtTime(body.CTime))
-					textui.Fprintf(out, "\t\totime %v\n", fmtTime(body.OTime))
-					textui.Fprintf(out, "\t\tstime %v\n", fmtTime(body.STime))
-					textui.Fprintf(out, "\t\trtime %v\n", fmtTime(body.RTime))
-				}
-			case *btrfsitem.RootRef:
-				var tag string
-				switch item.Key.ItemType {
-				case btrfsitem.ROOT_REF_KEY:
-					tag = "ref"
-				case btrfsitem.ROOT_BACKREF_KEY:
-					tag = "backref"
-				default:
-					tag = textui.Sprintf("(error: unhandled RootRef item type: %v)", item.Key.ItemType)
-				}
-				textui.Fprintf(out, "\t\troot %v key dirid %v sequence %v name %s\n",
-					tag, body.DirID, body.Sequence, body.Name)
-			case *btrfsitem.Extent:
-				textui.Fprintf(out, "\t\trefs %v gen %v flags %v\n",
-					body.Head.Refs, body.Head.Generation, body.Head.Flags)
-				if body.Head.Flags.Has(btrfsitem.EXTENT_FLAG_TREE_BLOCK) {
-					textui.Fprintf(out, "\t\ttree block key %v level %v\n",
-						body.Info.Key.Format(treeID), body.Info.Level)
-				}
-				printExtentInlineRefs(out, body.Refs)
-			case *btrfsitem.Metadata:
-				textui.Fprintf(out, "\t\trefs %v gen %v flags %v\n",
-					body.Head.Refs, body.Head.Generation, body.Head.Flags)
-				textui.Fprintf(out, "\t\ttree block skinny level %v\n", item.Key.Offset)
-				printExtentInlineRefs(out, body.Refs)
-			// case btrfsitem.EXTENT_DATA_REF_KEY:
-			// 	// TODO
-			// case btrfsitem.SHARED_DATA_REF_KEY:
-			// 	// TODO
-			case *btrfsitem.ExtentCSum:
-				start := btrfsvol.LogicalAddr(item.Key.Offset)
-				textui.Fprintf(out, "\t\trange start %d end %d length %d",
-					start, start.Add(body.Size()), body.Size())
-				sumsPerLine := slices.Max(1, len(btrfssum.CSum{})/body.ChecksumSize/2)
-
-				i := 0
-				_ = body.Walk(ctx, func(pos btrfsvol.LogicalAddr, sum btrfssum.ShortSum) error {
-					if i%sumsPerLine == 0 {
-						textui.Fprintf(out, "\n\t\t")
-					} else {
-						textui.Fprintf(out, " ")
-					}
-					textui.Fprintf(out, "[%d] 0x%x", pos, sum)
-					i++
-					return nil
-				})
-				textui.Fprintf(out, "\n")
-			case *btrfsitem.FileExtent:
-				textui.Fprintf(out, "\t\tgeneration %v type %v\n",
-					body.Generation, body.Type)
-				switch body.Type {
-				case btrfsitem.FILE_EXTENT_INLINE:
-					textui.Fprintf(out, "\t\tinline extent data size %v ram_bytes %v compression %v\n",
-						len(body.BodyInline), body.RAMBytes, body.Compression)
-				case btrfsitem.FILE_EXTENT_PREALLOC:
-					textui.Fprintf(out, "\t\tprealloc data disk byte %v nr %v\n",
-						body.BodyExtent.DiskByteNr,
-						body.BodyExtent.DiskNumBytes)
-					textui.Fprintf(out, "\t\tprealloc data offset %v nr %v\n",
-						body.BodyExtent.Offset,
-						body.BodyExtent.NumBytes)
-				case btrfsitem.FILE_EXTENT_REG:
-					textui.Fprintf(out, "\t\textent data disk byte %d nr %d\n",
-						body.BodyExtent.DiskByteNr,
-						body.BodyExtent.DiskNumBytes)
-					textui.Fprintf(out, "\t\textent data offset %d nr %d ram %v\n",
-						body.BodyExtent.Offset,
-						body.BodyExtent.NumBytes,
-						body.RAMBytes)
-					textui.Fprintf(out, "\t\textent compression %v\n",
-						body.Compression)
-				default:
-					textui.Fprintf(out, "\t\t(error) unknown file extent type %v", body.Type)
-				}
-			case *btrfsitem.BlockGroup:
-				textui.Fprintf(out, "\t\tblock group used %v chunk_objectid %v flags %v\n",
-					body.Used, body.ChunkObjectID, body.Flags)
-			case *btrfsitem.FreeSpaceInfo:
-				textui.Fprintf(out, "\t\tfree space info extent count %v flags %d\n",
-					body.ExtentCount, body.Flags)
-			case *btrfsitem.FreeSpaceBitmap:
-				textui.Fprintf(out, "\t\tfree space bitmap\n")
-			case *btrfsitem.Chunk:
-				textui.Fprintf(out, "\t\tlength %d owner %d stripe_len %v type %v\n",
-					body.Head.Size, body.Head.Owner, body.Head.StripeLen, body.Head.Type)
-				textui.Fprintf(out, "\t\tio_align %v io_width %v sector_size %v\n",
-					body.Head.IOOptimalAlign, body.Head.IOOptimalWidth, body.Head.IOMinSize)
-				textui.Fprintf(out, "\t\tnum_stripes %v sub_stripes %v\n",
-					body.Head.NumStripes, body.Head.SubStripes)
-				for i, stripe := range body.Stripes {
-					textui.Fprintf(out, "\t\t\tstripe %v devid %d offset %d\n",
-						i, stripe.DeviceID, stripe.Offset)
-					textui.Fprintf(out, "\t\t\tdev_uuid %v\n",
-						stripe.DeviceUUID)
-				}
-			case *btrfsitem.Dev:
-				textui.Fprintf(out, ""+
-					"\t\tdevid %d total_bytes %v bytes_used %v\n"+
-					"\t\tio_align %v io_width %v sector_size %v type %v\n"+
-					"\t\tgeneration %v start_offset %v dev_group %v\n"+
-					"\t\tseek_speed %v bandwidth %v\n"+
-					"\t\tuuid %v\n"+
-					"\t\tfsid %v\n",
-					body.DevID, body.NumBytes, body.NumBytesUsed,
-					body.IOOptimalAlign, body.IOOptimalWidth, body.IOMinSize, body.Type,
-					body.Generation, body.StartOffset, body.DevGroup,
-					body.SeekSpeed, body.Bandwidth,
-					body.DevUUID,
-					body.FSUUID)
-			case *btrfsitem.DevExtent:
-				textui.Fprintf(out, ""+
-					"\t\tdev extent chunk_tree %d\n"+
-					"\t\tchunk_objectid %v chunk_offset %d length %d\n"+
-					"\t\tchunk_tree_uuid %v\n",
-					body.ChunkTree, body.ChunkObjectID, body.ChunkOffset, body.Length,
-					body.ChunkTreeUUID)
-			case *btrfsitem.QGroupStatus:
-				textui.Fprintf(out, ""+
-					"\t\tversion %v generation %v flags %v scan %d\n",
-					body.Version, body.Generation, body.Flags, body.RescanProgress)
-			case *btrfsitem.QGroupInfo:
-				textui.Fprintf(out, ""+
-					"\t\tgeneration %v\n"+
-					"\t\treferenced %d referenced_compressed %d\n"+
-					"\t\texclusive %d exclusive_compressed %d\n",
-					body.Generation,
-					body.ReferencedBytes, body.ReferencedBytesCompressed,
-					body.ExclusiveBytes, body.ExclusiveBytesCompressed)
-			case *btrfsitem.QGroupLimit:
-				textui.Fprintf(out, ""+
-					"\t\tflags %x\n"+
-					"\t\tmax_referenced %d max_exclusive %d\n"+
-					"\t\trsv_referenced %d rsv_exclusive %d\n",
-					uint64(body.Flags),
-					body.MaxReferenced, body.MaxExclusive,
-					body.RsvReferenced, body.RsvExclusive)
-			case *btrfsitem.UUIDMap:
-				textui.Fprintf(out, "\t\tsubvol_id %d\n", body.ObjID)
-			// case btrfsitem.STRING_ITEM_KEY:
-			// 	// TODO
-			case *btrfsitem.DevStats:
-				textui.Fprintf(out, "\t\tpersistent item objectid %v offset %v\n",
-					item.Key.ObjectID.Format(treeID), item.Key.Offset)
-				switch item.Key.ObjectID {
-				case btrfsprim.DEV_STATS_OBJECTID:
-					textui.Fprintf(out, "\t\tdevice stats\n")
-					textui.Fprintf(out, "\t\twrite_errs %v read_errs %v flush_errs %v corruption_errs %v generation %v\n",
-						body.Values[btrfsitem.DEV_STAT_WRITE_ERRS],
-						body.Values[btrfsitem.DEV_STAT_READ_ERRS],
-						body.Values[btrfsitem.DEV_STAT_FLUSH_ERRS],
-						body.Values[btrfsitem.DEV_STAT_CORRUPTION_ERRS],
-						body.Values[btrfsitem.DEV_STAT_GENERATION_ERRS])
-				default:
-					textui.Fprintf(out, "\t\tunknown persistent item objectid %v\n", item.Key.ObjectID)
-				}
-			// case btrfsitem.TEMPORARY_ITEM_KEY:
-			// 	// TODO
-			case *btrfsitem.Empty:
-				switch item.Key.ItemType {
-				case btrfsitem.ORPHAN_ITEM_KEY: // 48
-					textui.Fprintf(out, "\t\torphan item\n")
-				case btrfsitem.TREE_BLOCK_REF_KEY: // 176
-					textui.Fprintf(out, "\t\ttree block backref\n")
-				case btrfsitem.SHARED_BLOCK_REF_KEY: // 182
-					textui.Fprintf(out, "\t\tshared block backref\n")
-				case btrfsitem.FREE_SPACE_EXTENT_KEY: // 199
-					textui.Fprintf(out, "\t\tfree space extent\n")
-				case btrfsitem.QGROUP_RELATION_KEY: // 246
-					// do nothing
-				// case btrfsitem.EXTENT_REF_V0_KEY:
-				// 	textui.Fprintf(out, "\t\textent ref v0 (deprecated)\n")
-				// case btrfsitem.CSUM_ITEM_KEY:
-				// 	textui.Fprintf(out, "\t\tcsum item\n")
-				default:
-					textui.Fprintf(out, "\t\t(error) unhandled empty item type: %v\n", item.Key.ItemType)
-				}
-			case *btrfsitem.Error:
-				textui.Fprintf(out, "\t\t(error) error item: %v\n", body.Err)
-			default:
-				textui.Fprintf(out, "\t\t(error) unhandled item type: %T\n", body)
+			slot := path[len(path)-1].(btrfstree.PathItem).FromSlot //nolint:forcetypeassert // has to be
+			var r renderedItem
+			if rendered != nil {
+				r = rendered[slot]
+			} else {
+				r = renderItem(ctx, st, treeID, item, cfg.KeyFilter)
+			}
+			itemOffset -= r.Size
+			if r.Body == nil {
+				return
 			}
+			textui.Fprintf(out, "\titem %v key %s itemoff %v itemsize %v%s\n",
+				slot,
+				st.paint(textui.ColorCyan, item.Key.Format(treeID)),
+				itemOffset,
+				r.Size,
+				injected)
+			_, _ = out.Write(r.Body)
 		},
 	}
 	handlers.BadItem = handlers.Item
+	handlers.BadNode = func(path btrfstree.Path, _ *btrfstree.Node, nodeErr error) bool {
+		if len(path) == 1 {
+			// The root node; nothing of the tree can be
+			// dumped.
+			err = nodeErr
+			return false
+		}
+		numBadNodes++
+		nodeErr = btrfstree.DiagnosePhantomOwner(ctx, fs, nodeErr)
+		if errors.Is(nodeErr, btrfstree.ErrPhantomOwner) {
+			numPhantomOwners++
+			dlog.Errorf(ctx, "tree %v: %v: PHANTOM OWNER: %v", treeID, path, nodeErr)
+			return false
+		}
+		dlog.Errorf(ctx, "tree %v: %v: %v", treeID, path, nodeErr)
+		return false
+	}
 
 	tree, err := fs.ForrestLookup(ctx, treeID)
 	if err != nil {
-		dlog.Errorf(ctx, "tree %v: %v", treeID, err)
-		return
+		return 0, 0, err
 	}
 	tree.TreeWalk(ctx, handlers)
+	return numBadNodes, numPhantomOwners, err
+}
+
+// recoverIOError returns the value `r` that printTree recovered from
+// a panic if it is an error from reading the disk, and re-panics with
+// it otherwise.  Some Forrests (such as btrfsutil.RebuiltForrest,
+// when it reads an item) panic on such errors rather than reporting
+// them through the BadNode callback, and that shouldn't stop the
+// other trees from being dumped; but anything else is a bug.
+func recoverIOError(r any) error {
+	if err, ok := r.(error); ok {
+		var ioErr *btrfstree.IOError
+		if errors.As(err, &ioErr) {
+			return err
+		}
+	}
+	panic(r)
+}
+
+// renderedItem is the part of printing an item that is expensive
+// enough to be worth doing in parallel.
+type renderedItem struct {
+	// Size is the marshaled size of the item body.
+	Size uint32
+	// Body is the rendered item body, or nil if the item does not
+	// match the filter.
+	Body []byte
+}
+
+func renderItem(ctx context.Context, st Style, treeID btrfsprim.ObjID, item btrfstree.Item, filter btrfstree.KeyFilter) renderedItem {
+	bs, _ := binstruct.Marshal(item.Body)
+	ret := renderedItem{
+		Size: uint32(len(bs)),
+	}
+	if filter.Match(item.Key) {
+		var buf bytes.Buffer
+		printItemBody(ctx, &buf, st, treeID, item)
+		ret.Body = buf.Bytes()
+		if ret.Body == nil {
+			ret.Body = []byte{}
+		}
+	}
+	return ret
+}
+
+// renderItems calls renderItem for each item, spread across
+// `workers` goroutines.  The results are indexed by slot, so the
+// caller may emit them in the original order.
+//
+// The item bodies belong to the node, so this waits for all of the
+// workers to finish before returning, so that the node isn't released
+// while they are still in use.
+func renderItems(ctx context.Context, st Style, treeID btrfsprim.ObjID, items []btrfstree.Item, filter btrfstree.KeyFilter, workers int) []renderedItem {
+	ret := make([]renderedItem, len(items))
+	if workers > len(items) {
+		workers = len(items)
+	}
+	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{})
+	for w := 0; w < workers; w++ {
+		w := w
+		grp.Go(fmt.Sprintf("worker-%d", w), func(ctx context.Context) error {
+			for i := w; i < len(items); i += workers {
+				ret[i] = renderItem(ctx, st, treeID, items[i], filter)
+			}
+			return nil
+		})
+	}
+	_ = grp.Wait()
+	return ret
+}
+
+// printItemBody prints the body of an item, in the format of
+// btrfs-progs kernel-shared/print-tree.c:btrfs_print_leaf().
+func printItemBody(ctx context.Context, out io.Writer, st Style, treeID btrfsprim.ObjID, item btrfstree.Item) {
+	switch body := item.Body.(type) {
+	case *btrfsitem.FreeSpaceHeader:
+		textui.Fprintf(out, "\t\tlocation key %v\n", body.Location.Format(treeID))
+		textui.Fprintf(out, "\t\tcache generation %v entries %v bitmaps %v\n",
+			body.Generation, body.NumEntries, body.NumBitmaps)
+	case *btrfsitem.Inode:
+		textui.Fprintf(out, ""+
+			"\t\tgeneration %v transid %v size %v nbytes %v\n"+
+			"\t\tblock group %v mode %o links %v uid %v gid %v rdev %v\n"+
+			"\t\tsequence %v flags %v\n",
+			body.Generation, body.TransID, body.Size, body.NumBytes,
+			body.BlockGroup, body.Mode, body.NLink, body.UID, body.GID, body.RDev,
+			body.Sequence, body.Flags)
+		textui.Fprintf(out, "\t\tatime %v\n", st.fmtTime(body.ATime))
+		textui.Fprintf(out, "\t\tctime %v\n", st.fmtTime(body.CTime))
+		textui.Fprintf(out, "\t\tmtime %v\n", st.fmtTime(body.MTime))
+		textui.Fprintf(out, "\t\totime %v\n", st.fmtTime(body.OTime))
+	case *btrfsitem.InodeRefs:
+		for _, ref := range body.Refs {
+			textui.Fprintf(out, "\t\tindex %v namelen %v name: %s\n",
+				ref.Index, ref.NameLen, ref.Name)
+		}
+	case *btrfsitem.InodeExtRefs:
+		for _, ref := range body.Refs {
+			textui.Fprintf(out, "\t\tindex %v parent %v namelen %v name: %s\n",
+				ref.Index, ref.Parent, ref.NameLen, ref.Name)
+		}
+	case *btrfsitem.DirEntry:
+		textui.Fprintf(out, "\t\tlocation key %v type %v\n",
+			body.Location.Format(treeID), body.Type)
+		textui.Fprintf(out, "\t\ttransid %v data_len %v name_len %v\n",
+			body.TransID, body.DataLen, body.NameLen)
+		textui.Fprintf(out, "\t\tname: %s\n", body.Name)
+		if len(body.Data) > 0 {
+			textui.Fprintf(out, "\t\tdata %s\n", body.Data)
+		}
+	case *btrfsitem.DirLog:
+		// The logged range is [key.offset, end], inclusive.
+		textui.Fprintf(out, "\t\tdir log end %v\n", body.EndOffset)
+		textui.Fprintf(out, "\t\t%s\n", st.paint(textui.ColorYellow,
+			textui.Sprintf("(log tree only: %v range [%v, %v] was modified since the last commit)",
+				item.Key.ItemType, item.Key.Offset, body.EndOffset)))
+	case *btrfsitem.Root:
+		textui.Fprintf(out, "\t\tgeneration %v root_dirid %v bytenr %d byte_limit %v bytes_used %v\n",
+			body.Generation, body.RootDirID, body.ByteNr, body.ByteLimit, body.BytesUsed)
+		textui.Fprintf(out, "\t\tlast_snapshot %v flags %v refs %v\n",
+			body.LastSnapshot, body.Flags, body.Refs)
+		textui.Fprintf(out, "\t\tdrop_progress key %v drop_level %v\n",
+			body.DropProgress.Format(treeID), body.DropLevel)
+		textui.Fprintf(out, "\t\tlevel %v generation_v2 %v\n",
+			body.Level, body.GenerationV2)
+		if body.Generation == body.GenerationV2 {
+			textui.Fprintf(out, "\t\tuuid %v\n", body.UUID)
+			textui.Fprintf(out, "\t\tparent_uuid %v\n", body.ParentUUID)
+			textui.Fprintf(out, "\t\treceived_uuid %v\n", body.ReceivedUUID)
+			textui.Fprintf(out, "\t\tctransid %v otransid %v stransid %v rtransid %v\n",
+				body.CTransID, body.OTransID, body.STransID, body.RTransID)
+			textui.Fprintf(out, "\t\tctime %v\n", st.fmtTime(body.CTime))
+			textui.Fprintf(out, "\t\totime %v\n", st.fmtTime(body.OTime))
+			textui.Fprintf(out, "\t\tstime %v\n", st.fmtTime(body.STime))
+			textui.Fprintf(out, "\t\trtime %v\n", st.fmtTime(body.RTime))
+		}
+	case *btrfsitem.RootRef:
+		var tag string
+		switch item.Key.ItemType {
+		case btrfsitem.ROOT_REF_KEY:
+			tag = "ref"
+		case btrfsitem.ROOT_BACKREF_KEY:
+			tag = "backref"
+		default:
+			tag = st.paint(textui.ColorRed, textui.Sprintf("(error: unhandled RootRef item type: %v)", item.Key.ItemType))
+		}
+		textui.Fprintf(out, "\t\troot %v key dirid %v sequence %v name %s\n",
+			tag, body.DirID, body.Sequence, body.Name)
+	case *btrfsitem.Extent:
+		textui.Fprintf(out, "\t\trefs %v gen %v flags %v\n",
+			body.Head.Refs, body.Head.Generation, body.Head.Flags)
+		if body.Head.Flags.Has(btrfsitem.EXTENT_FLAG_TREE_BLOCK) {
+			textui.Fprintf(out, "\t\ttree block key %v level %v\n",
+				body.Info.Key.Format(treeID), body.Info.Level)
+		}
+		printExtentInlineRefs(out, st, body.Refs)
+	case *btrfsitem.Metadata:
+		textui.Fprintf(out, "\t\trefs %v gen %v flags %v\n",
+			body.Head.Refs, body.Head.Generation, body.Head.Flags)
+		textui.Fprintf(out, "\t\ttree block skinny level %v\n", item.Key.Offset)
+		printExtentInlineRefs(out, st, body.Refs)
+	// case btrfsitem.EXTENT_DATA_REF_KEY:
+	// 	// TODO
+	// case btrfsitem.SHARED_DATA_REF_KEY:
+	// 	// TODO
+	case *btrfsitem.ExtentCSum:
+		start := btrfsvol.LogicalAddr(item.Key.Offset)
+		textui.Fprintf(out, "\t\trange start %d end %d length %d",
+			start, start.Add(body.Size()), body.Size())
+		sumsPerLine := slices.Max(1, len(btrfssum.CSum{})/body.ChecksumSize/2)
+
+		i := 0
+		_ = body.Walk(ctx, func(pos btrfsvol.LogicalAddr, sum btrfssum.ShortSum) error {
+			if i%sumsPerLine == 0 {
+				textui.Fprintf(out, "\n\t\t")
+			} else {
+				textui.Fprintf(out, " ")
+			}
+			textui.Fprintf(out, "[%d] 0x%x", pos, sum)
+			i++
+			return nil
+		})
+		textui.Fprintf(out, "\n")
+	case *btrfsitem.FileExtent:
+		textui.Fprintf(out, "\t\tgeneration %v type %v\n",
+			body.Generation, body.Type)
+		switch body.Type {
+		case btrfsitem.FILE_EXTENT_INLINE:
+			textui.Fprintf(out, "\t\tinline extent data size %v ram_bytes %v compression %v\n",
+				len(body.BodyInline), body.RAMBytes, body.Compression)
+		case btrfsitem.FILE_EXTENT_PREALLOC:
+			textui.Fprintf(out, "\t\tprealloc data disk byte %v nr %v\n",
+				body.BodyExtent.DiskByteNr,
+				body.BodyExtent.DiskNumBytes)
+			textui.Fprintf(out, "\t\tprealloc data offset %v nr %v\n",
+				body.BodyExtent.Offset,
+				body.BodyExtent.NumBytes)
+		case btrfsitem.FILE_EXTENT_REG:
+			textui.Fprintf(out, "\t\textent data disk byte %d nr %d\n",
+				body.BodyExtent.DiskByteNr,
+				body.BodyExtent.DiskNumBytes)
+			textui.Fprintf(out, "\t\textent data offset %d nr %d ram %v\n",
+				body.BodyExtent.Offset,
+				body.BodyExtent.NumBytes,
+				body.RAMBytes)
+			textui.Fprintf(out, "\t\textent compression %v\n",
+				body.Compression)
+		default:
+			st.printError(out, "\t\t(error) unknown file extent type %v", body.Type)
+		}
+	case *btrfsitem.BlockGroup:
+		textui.Fprintf(out, "\t\tblock group used %v chunk_objectid %v flags %v\n",
+			body.Used, body.ChunkObjectID, body.Flags)
+	case *btrfsitem.FreeSpaceInfo:
+		textui.Fprintf(out, "\t\tfree space info extent count %v flags %d\n",
+			body.ExtentCount, body.Flags)
+	case *btrfsitem.FreeSpaceBitmap:
+		textui.Fprintf(out, "\t\tfree space bitmap\n")
+	case *btrfsitem.Chunk:
+		textui.Fprintf(out, "\t\tlength %d owner %d stripe_len %v type %v\n",
+			body.Head.Size, body.Head.Owner, body.Head.StripeLen, body.Head.Type)
+		textui.Fprintf(out, "\t\tio_align %v io_width %v sector_size %v\n",
+			body.Head.IOOptimalAlign, body.Head.IOOptimalWidth, body.Head.IOMinSize)
+		textui.Fprintf(out, "\t\tnum_stripes %v sub_stripes %v\n",
+			body.Head.NumStripes, body.Head.SubStripes)
+		for i, stripe := range body.Stripes {
+			textui.Fprintf(out, "\t\t\tstripe %v devid %d offset %d\n",
+				i, stripe.DeviceID, stripe.Offset)
+			textui.Fprintf(out, "\t\t\tdev_uuid %v\n",
+				stripe.DeviceUUID)
+		}
+	case *btrfsitem.Dev:
+		textui.Fprintf(out, ""+
+			"\t\tdevid %d total_bytes %v bytes_used %v\n"+
+			"\t\tio_align %v io_width %v sector_size %v type %v\n"+
+			"\t\tgeneration %v start_offset %v dev_group %v\n"+
+			"\t\tseek_speed %v bandwidth %v\n"+
+			"\t\tuuid %v\n"+
+			"\t\tfsid %v\n",
+			body.DevID, body.NumBytes, body.NumBytesUsed,
+			body.IOOptimalAlign, body.IOOptimalWidth, body.IOMinSize, body.Type,
+			body.Generation, body.StartOffset, body.DevGroup,
+			body.SeekSpeed, body.Bandwidth,
+			body.DevUUID,
+			body.FSUUID)
+	case *btrfsitem.DevExtent:
+		textui.Fprintf(out, ""+
+			"\t\tdev extent chunk_tree %d\n"+
+			"\t\tchunk_objectid %v chunk_offset %d length %d\n"+
+			"\t\tchunk_tree_uuid %v\n",
+			body.ChunkTree, body.ChunkObjectID, body.ChunkOffset, body.Length,
+			body.ChunkTreeUUID)
+	case *btrfsitem.QGroupStatus:
+		textui.Fprintf(out, ""+
+			"\t\tversion %v generation %v flags %v scan %d\n",
+			body.Version, body.Generation, body.Flags, body.RescanProgress)
+	case *btrfsitem.QGroupInfo:
+		textui.Fprintf(out, ""+
+			"\t\tgeneration %v\n"+
+			"\t\treferenced %d referenced_compressed %d\n"+
+			"\t\texclusive %d exclusive_compressed %d\n",
+			body.Generation,
+			body.ReferencedBytes, body.ReferencedBytesCompressed,
+			body.ExclusiveBytes, body.ExclusiveBytesCompressed)
+	case *btrfsitem.QGroupLimit:
+		textui.Fprintf(out, ""+
+			"\t\tflags %x\n"+
+			"\t\tmax_referenced %d max_exclusive %d\n"+
+			"\t\trsv_referenced %d rsv_exclusive %d\n",
+			uint64(body.Flags),
+			body.MaxReferenced, body.MaxExclusive,
+			body.RsvReferenced, body.RsvExclusive)
+	case *btrfsitem.UUIDMap:
+		textui.Fprintf(out, "\t\tsubvol_id %d\n", body.ObjID)
+	case *btrfsitem.StringItem:
+		textui.Fprintf(out, "\t\titem data %v\n", body)
+	case *btrfsitem.DevStats:
+		textui.Fprintf(out, "\t\tpersistent item objectid %v offset %v\n",
+			item.Key.ObjectID.Format(treeID), item.Key.Offset)
+		switch item.Key.ObjectID {
+		case btrfsprim.DEV_STATS_OBJECTID:
+			textui.Fprintf(out, "\t\tdevice stats\n")
+			textui.Fprintf(out, "\t\twrite_errs %v read_errs %v flush_errs %v corruption_errs %v generation %v\n",
+				body.Value(btrfsitem.DEV_STAT_WRITE_ERRS),
+				body.Value(btrfsitem.DEV_STAT_READ_ERRS),
+				body.Value(btrfsitem.DEV_STAT_FLUSH_ERRS),
+				body.Value(btrfsitem.DEV_STAT_CORRUPTION_ERRS),
+				body.Value(btrfsitem.DEV_STAT_GENERATION_ERRS))
+			if len(body.Values) != btrfsitem.DEV_STAT_VALUES_MAX {
+				textui.Fprintf(out, "\t\t(item has %v values, expected %v)\n",
+					len(body.Values), btrfsitem.DEV_STAT_VALUES_MAX)
+			}
+			for i := btrfsitem.DEV_STAT_VALUES_MAX; i < len(body.Values); i++ {
+				textui.Fprintf(out, "\t\tunknown_stat_%d %v\n", i, body.Values[i])
+			}
+		default:
+			textui.Fprintf(out, "\t\tunknown persistent item objectid %v\n", item.Key.ObjectID)
+			for i, val := range body.Values {
+				textui.Fprintf(out, "\t\tvalue %d %#016x\n", i, uint64(val))
+			}
+		}
+	case *btrfsitem.DevReplace:
+		textui.Fprintf(out, "\t\tdev replace src_devid %v state %v cont_reading_from_srcdev_mode %v\n",
+			body.SrcDevID, body.State, body.ContReadingFromSrcMode)
+		textui.Fprintf(out, "\t\tcursor_left %v cursor_right %v\n",
+			body.CursorLeft, body.CursorRight)
+		textui.Fprintf(out, "\t\ttime_started %v time_stopped %v\n",
+			body.TimeStarted, body.TimeStopped)
+		textui.Fprintf(out, "\t\tnum_write_errors %v num_uncorrectable_read_errors %v\n",
+			body.NumWriteErrors, body.NumUncorrectableReadErrors)
+	case *btrfsitem.Balance:
+		textui.Fprintf(out, "\t\ttemporary item objectid %v offset %v\n",
+			item.Key.ObjectID.Format(treeID), item.Key.Offset)
+		switch item.Key.ObjectID {
+		case btrfsprim.BALANCE_OBJECTID:
+			textui.Fprintf(out, "\t\tbalance status flags %v\n", body.Flags)
+			printBalanceArgs(out, "DATA", body.Data)
+			printBalanceArgs(out, "METADATA", body.Metadata)
+			printBalanceArgs(out, "SYSTEM", body.System)
+		default:
+			textui.Fprintf(out, "\t\tunknown temporary item objectid %v\n", item.Key.ObjectID)
+		}
+	case *btrfsitem.Empty:
+		switch item.Key.ItemType {
+		case btrfsitem.ORPHAN_ITEM_KEY: // 48
+			textui.Fprintf(out, "\t\torphan item\n")
+		case btrfsitem.TREE_BLOCK_REF_KEY: // 176
+			textui.Fprintf(out, "\t\ttree block backref\n")
+		case btrfsitem.SHARED_BLOCK_REF_KEY: // 182
+			textui.Fprintf(out, "\t\tshared block backref\n")
+		case btrfsitem.FREE_SPACE_EXTENT_KEY: // 199
+			textui.Fprintf(out, "\t\tfree space extent\n")
+		case btrfsitem.QGROUP_RELATION_KEY: // 246
+			// do nothing
+		// case btrfsitem.EXTENT_REF_V0_KEY:
+		// 	textui.Fprintf(out, "\t\textent ref v0 (deprecated)\n")
+		// case btrfsitem.CSUM_ITEM_KEY:
+		// 	textui.Fprintf(out, "\t\tcsum item\n")
+		default:
+			st.printError(out, "\t\t(error) unhandled empty item type: %v\n", item.Key.ItemType)
+		}
+	case *btrfsitem.Error:
+		var sizeErr *btrfstree.ItemSizeError
+		if errors.As(body.Err, &sizeErr) {
+			st.printError(out, "\t\t(error) item size mismatch: header says %v bytes, but body re-encodes to %v bytes\n",
+				sizeErr.HeaderSize, sizeErr.BodySize)
+		} else {
+			st.printError(out, "\t\t(error) error item: %v\n", body.Err)
+		}
+	default:
+		st.printError(out, "\t\t(error) unhandled item type: %T\n", body)
+	}
+}
+
+// PrintNode prints a single node, in the same format that DumpTrees
+// uses for each node of a tree.  Since the node is printed without
+// the context of a tree, keys are formatted according to the tree
+// that the node claims to be owned by.
+func PrintNode(ctx context.Context, out io.Writer, st Style, node *btrfstree.Node) {
+	treeID := node.Head.Owner
+	printHeaderInfo(out, st, node)
+	for _, kp := range node.BodyInterior {
+		textui.Fprintf(out, "\tkey %s block %s gen %v\n",
+			st.paint(textui.ColorCyan, kp.Key.Format(treeID)),
+			st.paint(textui.ColorBlue, textui.Sprintf("%v", kp.BlockPtr)),
+			kp.Generation)
+	}
+	itemOffset := node.Size - uint32(nodeHeaderSize)
+	for slot, item := range node.BodyLeaf {
+		bs, _ := binstruct.Marshal(item.Body)
+		itemSize := uint32(len(bs))
+		itemOffset -= itemSize
+		textui.Fprintf(out, "\titem %v key %s itemoff %v itemsize %v\n",
+			slot,
+			st.paint(textui.ColorCyan, item.Key.Format(treeID)),
+			itemOffset,
+			itemSize)
+		printItemBody(ctx, out, st, treeID, item)
+	}
 }
 
 // printHeaderInfo mimics btrfs-progs kernel-shared/print-tree.c:print_header_info()
-func printHeaderInfo(out io.Writer, node *btrfstree.Node) {
-	var typename string
+func printHeaderInfo(out io.Writer, st Style, node *btrfstree.Node) {
+	var typename, line string
 	if node.Head.Level > 0 { // interior node
 		typename = "node"
-		textui.Fprintf(out, "node %v level %v items %v free space %v",
+		line = textui.Sprintf("node %v level %v items %v free space %v",
 			node.Head.Addr,
 			node.Head.Level,
 			node.Head.NumItems,
 			node.MaxItems()-node.Head.NumItems)
 	} else { // leaf node
 		typename = "leaf"
-		textui.Fprintf(out, "leaf %d items %v free space %v",
+		line = textui.Sprintf("leaf %d items %v free space %v",
 			node.Head.Addr,
 			node.Head.NumItems,
 			node.LeafFreeSpace())
 	}
-	textui.Fprintf(out, " generation %v owner %v\n",
+	line += textui.Sprintf(" generation %v owner %v\n",
 		node.Head.Generation,
 		node.Head.Owner)
+	_, _ = io.WriteString(out, st.paint(textui.ColorBold, line))
 
 	textui.Fprintf(out, "%v %d flags %v backref revision %v\n",
 		typename,
@@ -394,7 +724,9 @@ func printHeaderInfo(out io.Writer, node *btrfstree.Node) {
 
 	textui.Fprintf(out, "checksum stored %v\n", node.Head.Checksum.Fmt(node.ChecksumType))
 	if calcSum, err := node.CalculateChecksum(); err != nil {
-		textui.Fprintf(out, "checksum calced %v\n", err)
+		_, _ = io.WriteString(out, st.paint(textui.ColorRed, textui.Sprintf("checksum calced %v\n", err)))
+	} else if calcSum != node.Head.Checksum {
+		_, _ = io.WriteString(out, st.paint(textui.ColorRed, textui.Sprintf("checksum calced %v\n", calcSum.Fmt(node.ChecksumType))))
 	} else {
 		textui.Fprintf(out, "checksum calced %v\n", calcSum.Fmt(node.ChecksumType))
 	}
@@ -404,7 +736,7 @@ func printHeaderInfo(out io.Writer, node *btrfstree.Node) {
 }
 
 // printExtentInlineRefs mimics part of btrfs-progs kernel-shared/print-tree.c:print_extent_item()
-func printExtentInlineRefs(out io.Writer, refs []btrfsitem.ExtentInlineRef) {
+func printExtentInlineRefs(out io.Writer, st Style, refs []btrfsitem.ExtentInlineRef) {
 	for _, ref := range refs {
 		switch subitem := ref.Body.(type) {
 		case nil:
@@ -416,7 +748,7 @@ func printExtentInlineRefs(out io.Writer, refs []btrfsitem.ExtentInlineRef) {
 				textui.Fprintf(out, "\t\tshared block backref parent %v\n",
 					ref.Offset)
 			default:
-				textui.Fprintf(out, "\t\t(error) unexpected empty sub-item type: %v\n", ref.Type)
+				st.printError(out, "\t\t(error) unexpected empty sub-item type: %v\n", ref.Type)
 			}
 		case *btrfsitem.ExtentDataRef:
 			textui.Fprintf(out, "\t\textent data backref root %v objectid %v offset %v count %v\n",
@@ -425,12 +757,38 @@ func printExtentInlineRefs(out io.Writer, refs []btrfsitem.ExtentInlineRef) {
 			textui.Fprintf(out, "\t\tshared data backref parent %v count %v\n",
 				ref.Offset, subitem.Count)
 		default:
-			textui.Fprintf(out, "\t\t(error) unexpected sub-item type: %T\n", subitem)
+			st.printError(out, "\t\t(error) unexpected sub-item type: %T\n", subitem)
 		}
 	}
 }
 
-func fmtTime(t btrfsprim.Time) string {
+// printBalanceArgs mimics part of btrfs-progs kernel-shared/print-tree.c:print_balance_item()
+func printBalanceArgs(out io.Writer, name string, args btrfsitem.BalanceArgs) {
+	textui.Fprintf(out, ""+
+		"\t\t%s\n"+
+		"\t\tprofiles %v devid %v target %v flags %v\n"+
+		"\t\tusage %v pstart %v pend %v vstart %v vend %v\n"+
+		"\t\tlimit %v stripes_min %v stripes_max %v\n",
+		name,
+		args.Profiles, args.DevID, args.Target, args.Flags,
+		args.Usage, args.PStart, args.PEnd, args.VStart, args.VEnd,
+		args.Limit, args.StripesMin, args.StripesMax)
+}
+
+func (st Style) fmtTime(t btrfsprim.Time) string {
 	return textui.Sprintf("%v.%v (%v)",
-		t.Sec, t.NSec, t.ToStd().Format("2006-01-02 15:04:05"))
+		t.Sec, t.NSec, st.TimeFormat.Format(t))
+}
+
+func (st Style) paint(c textui.Color, str string) string {
+	if !st.Color {
+		return str
+	}
+	return c.Paint(str)
+}
+
+// printError prints an "(error)" line of an item body, which stands
+// out in red if Style.Color is enabled.
+func (st Style) printError(out io.Writer, format string, a ...any) {
+	_, _ = io.WriteString(out, st.paint(textui.ColorRed, textui.Sprintf(format, a...)))
 }
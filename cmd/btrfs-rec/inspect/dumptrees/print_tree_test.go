@@ -0,0 +1,163 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package dumptrees
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"syscall"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+func TestRenderItems(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, true)
+
+	var items []btrfstree.Item
+	for i := 0; i < 37; i++ {
+		ino := btrfsprim.ObjID(256 + i)
+		items = append(items,
+			btrfstree.Item{
+				Key:  btrfsprim.Key{ObjectID: ino, ItemType: btrfsitem.INODE_ITEM_KEY},
+				Body: &btrfsitem.Inode{Size: int64(i), NLink: 1},
+			},
+			btrfstree.Item{
+				Key: btrfsprim.Key{ObjectID: ino, ItemType: btrfsitem.INODE_REF_KEY, Offset: 256},
+				Body: &btrfsitem.InodeRefs{Refs: []btrfsitem.InodeRef{{
+					Index: int64(i),
+					Name:  []byte("file"),
+				}}},
+			})
+	}
+	filter, err := btrfstree.ParseKeyFilter("type=INODE_ITEM")
+	require.NoError(t, err)
+
+	for _, filter := range []btrfstree.KeyFilter{{}, filter} {
+		var serial []renderedItem
+		for _, item := range items {
+			serial = append(serial, renderItem(ctx, Style{}, btrfsprim.FS_TREE_OBJECTID, item, filter))
+		}
+		for _, workers := range []int{2, 3, 8, 100} {
+			assert.Equal(t, serial, renderItems(ctx, Style{}, btrfsprim.FS_TREE_OBJECTID, items, filter, workers),
+				"filter=%q workers=%v", filter, workers)
+		}
+	}
+}
+
+func TestPrintNodeColor(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, true)
+	node := &btrfstree.Node{
+		Size: 4096,
+		Head: btrfstree.NodeHeader{
+			Addr:       0x100000,
+			Generation: 42,
+			Owner:      btrfsprim.FS_TREE_OBJECTID,
+			NumItems:   2,
+		},
+		BodyLeaf: []btrfstree.Item{
+			{
+				Key:  btrfsprim.Key{ObjectID: 256, ItemType: btrfsitem.INODE_ITEM_KEY},
+				Body: &btrfsitem.Inode{Size: 1, NLink: 1},
+			},
+			{
+				Key:  btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.INODE_ITEM_KEY},
+				Body: &btrfsitem.Error{Err: fmt.Errorf("oops")},
+			},
+		},
+	}
+
+	var plain, colored bytes.Buffer
+	PrintNode(ctx, &plain, Style{}, node)
+	PrintNode(ctx, &colored, Style{Color: true}, node)
+
+	assert.NotContains(t, plain.String(), "\x1b")
+	assert.Contains(t, colored.String(), "\t\t\x1b[31m(error) error item: oops\x1b[0m\n")
+	assert.Equal(t, plain.String(), regexp.MustCompile("\x1b\\[[0-9;]*m").ReplaceAllString(colored.String(), ""))
+}
+
+// panicTree is a btrfstree.Tree whose TreeWalk panics with `val`.
+type panicTree struct {
+	btrfstree.Tree
+	val any
+}
+
+func (t panicTree) TreeWalk(context.Context, btrfstree.TreeWalkHandler) { panic(t.val) }
+
+type panicFS struct {
+	btrfs.ReadableFS
+	val any
+}
+
+func (fs panicFS) ForrestLookup(context.Context, btrfsprim.ObjID) (btrfstree.Tree, error) {
+	return panicTree{val: fs.val}, nil
+}
+
+func TestPrintTreeRecover(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	// An I/O error, as btrfsutil.RebuiltForrest panics with.
+	ioErr := fmt.Errorf("should not happen: i/o error: %w",
+		&btrfstree.NodeError[btrfsvol.LogicalAddr]{
+			Op:       "btrfstree.ReadNode",
+			NodeAddr: 0x100000,
+			Err:      &btrfstree.IOError{Err: syscall.EIO},
+		})
+	_, _, err := printTree(ctx, io.Discard, panicFS{val: ioErr}, btrfsprim.FS_TREE_OBJECTID, Config{})
+	assert.ErrorIs(t, err, syscall.EIO)
+
+	// Anything else is a bug, and must not be swallowed.
+	for _, val := range []any{
+		"loop",
+		fmt.Errorf("should not happen: index does not contain present item"),
+	} {
+		assert.Panics(t, func() {
+			_, _, _ = printTree(ctx, io.Discard, panicFS{val: val}, btrfsprim.FS_TREE_OBJECTID, Config{})
+		}, "%v", val)
+	}
+}
+
+// missingFS is an FS that has a root tree, but none of whose trees
+// can be found.
+type missingFS struct {
+	btrfs.ReadableFS
+}
+
+func (missingFS) Superblock() (*btrfstree.Superblock, error) {
+	return &btrfstree.Superblock{RootTree: 0x100000}, nil
+}
+
+func (missingFS) ForrestLookup(context.Context, btrfsprim.ObjID) (btrfstree.Tree, error) {
+	return nil, btrfstree.ErrNoTree
+}
+
+func TestDumpTreesFailOnError(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	var out bytes.Buffer
+	assert.NoError(t, DumpTrees(ctx, &out, missingFS{}, Config{}))
+	assert.Contains(t, out.String(), "root tree\n")
+	assert.Contains(t, out.String(), "total bytes ")
+
+	out.Reset()
+	assert.ErrorContains(t, DumpTrees(ctx, &out, missingFS{}, Config{FailOnError: true}),
+		"trees could not be dumped")
+	assert.Contains(t, out.String(), "total bytes ")
+}
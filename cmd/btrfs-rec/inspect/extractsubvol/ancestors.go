@@ -0,0 +1,231 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package extractsubvol
+
+import (
+	"context"
+	"sort"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/slices"
+)
+
+// FilledSuffix is appended to the name of a file to get the name of
+// the sidecar manifest that lists the ranges of that file that could
+// not be read, but that were filled in from an ancestor snapshot.
+const FilledSuffix = ".btrfs-rec-filled"
+
+// An ancestor is a subvolume that the subvolume being extracted was
+// (directly or indirectly) snapshotted from.
+type ancestor struct {
+	TreeID btrfsprim.ObjID
+	// SnapshotGen is the generation of this ancestor that its
+	// child in the chain was snapshotted from.
+	SnapshotGen btrfsprim.Generation
+
+	sv *btrfs.Subvolume
+}
+
+// findAncestors returns the chain of subvolumes that `treeID` was
+// snapshotted from, nearest first, by following the parent UUIDs.
+// Only direct ancestors are returned; sibling snapshots (which may
+// have diverged arbitrarily) are never consulted.
+func findAncestors(ctx context.Context, fs btrfs.ReadableFS, treeID btrfsprim.ObjID, svCfg btrfs.SubvolumeConfig) []ancestor {
+	var ret []ancestor
+	seen := containers.NewSet[btrfsprim.ObjID](treeID)
+	for {
+		tree, err := fs.ForrestLookup(ctx, treeID)
+		if err != nil {
+			dlog.Warnf(ctx, "ancestors: tree %v: %v", treeID, err)
+			return ret
+		}
+		parentID, parentGen, err := tree.TreeParentID(ctx)
+		if err != nil {
+			dlog.Warnf(ctx, "ancestors: tree %v: %v", treeID, err)
+			return ret
+		}
+		if parentID == 0 {
+			return ret
+		}
+		if seen.Has(parentID) {
+			dlog.Warnf(ctx, "ancestors: tree %v: parent %v is already in the chain; ignoring the loop", treeID, parentID)
+			return ret
+		}
+		seen.Insert(parentID)
+		dlog.Infof(ctx, "ancestors: tree %v was snapshotted from tree %v at generation %v", treeID, parentID, parentGen)
+		ret = append(ret, ancestor{
+			TreeID:      parentID,
+			SnapshotGen: parentGen,
+			sv:          btrfs.NewSubvolume(ctx, fs, parentID, svCfg),
+		})
+		treeID = parentID
+	}
+}
+
+// A fill is a range of a file that could not be read, but that was
+// read from an ancestor snapshot instead.
+type fill struct {
+	Beg, End int64
+	TreeID   btrfsprim.ObjID
+	// TransID is the generation of the last change to the file in
+	// the ancestor.
+	TransID btrfsprim.Generation
+	// Modified is whether the file was changed in the ancestor
+	// after the snapshot was taken; if so, the data may not be
+	// what the file had in the subvolume being extracted.
+	Modified bool
+}
+
+// An extentSpan is the part of a FILE_EXTENT that covers [Beg, End)
+// of a file.  DiskByteNr and DataOff identify the data there: the
+// extent's data on disk, and the offset of Beg within the (possibly
+// decompressed) data of that extent.
+type extentSpan struct {
+	Beg, End    int64
+	Type        btrfsitem.FileExtentType
+	Compression btrfsitem.CompressionType
+	DiskByteNr  btrfsvol.LogicalAddr
+	DataOff     int64
+}
+
+// extentSpans returns the spans of the FILE_EXTENTs of `file` that
+// cover [beg, end), in order, with the spans that continue on from
+// each other merged.  It returns false if the range isn't covered
+// exactly once by non-inline extents; the data in such a range can't
+// be pinned to a place on disk.
+func extentSpans(file *btrfs.File, beg, end int64) ([]extentSpan, bool) {
+	var ret []extentSpan
+	pos := beg
+	for _, extent := range file.Extents {
+		extLen, err := extent.Size()
+		if err != nil {
+			return nil, false
+		}
+		extBeg, extEnd := extent.OffsetWithinFile, extent.OffsetWithinFile+extLen
+		if extEnd <= pos || extBeg >= end {
+			continue
+		}
+		if extBeg > pos || extent.Type == btrfsitem.FILE_EXTENT_INLINE {
+			return nil, false
+		}
+		span := extentSpan{
+			Beg:         pos,
+			End:         slices.Min(extEnd, end),
+			Type:        extent.Type,
+			Compression: extent.Compression,
+			DiskByteNr:  extent.BodyExtent.DiskByteNr,
+			DataOff:     pos - extBeg + int64(extent.BodyExtent.Offset),
+		}
+		if span.DiskByteNr == 0 {
+			// A hole; there's no data to identify.
+			span.DataOff = 0
+		}
+		if n := len(ret); n > 0 {
+			last := &ret[n-1]
+			cont := last.Type == span.Type &&
+				last.Compression == span.Compression &&
+				last.DiskByteNr == span.DiskByteNr &&
+				(span.DiskByteNr == 0 || last.DataOff+(last.End-last.Beg) == span.DataOff)
+			if cont {
+				last.End = span.End
+				pos = span.End
+				continue
+			}
+		}
+		ret = append(ret, span)
+		pos = span.End
+	}
+	if pos < end {
+		return nil, false
+	}
+	return ret, true
+}
+
+// sameExtents returns whether [beg, end) of `a` and of `b` are
+// backed by the same data on disk, going by their FILE_EXTENTs.
+func sameExtents(a, b *btrfs.File, beg, end int64) bool {
+	aSpans, ok := extentSpans(a, beg, end)
+	if !ok {
+		return false
+	}
+	bSpans, ok := extentSpans(b, beg, end)
+	if !ok || len(aSpans) != len(bSpans) {
+		return false
+	}
+	for i := range aSpans {
+		if aSpans[i] != bSpans[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fillFromAncestors tries to read len(dat) bytes at `off` of `file`
+// from the ancestor snapshots.  The file must be the same file in the
+// ancestor: the same inode number, created in the same generation;
+// and the ancestor's FILE_EXTENTs for the range must point at the
+// same data on disk as `file`'s do, so that the filled data is
+// what `file` would have read (had the read not failed).  If `file`'s
+// own FILE_EXTENTs for the range are missing, then nothing is known
+// about what the data should be, and the range is not filled.
+// Ancestors in which the file has not been changed since the snapshot
+// are preferred, and then nearer ancestors are preferred.
+func (e *extractor) fillFromAncestors(file *btrfs.File, dat []byte, off int64) (fill, bool) {
+	inode := file.Inode
+	end := off + int64(len(dat))
+	if _, ok := extentSpans(file, off, end); !ok {
+		return fill{}, false
+	}
+	type candidate struct {
+		file *btrfs.File
+		fill fill
+	}
+	var cands []candidate
+	var acquired []*btrfs.Subvolume
+	defer func() {
+		for _, sv := range acquired {
+			sv.ReleaseFile(inode)
+		}
+	}()
+	for _, anc := range e.ancestors {
+		ancFile, err := anc.sv.AcquireFile(inode)
+		if err != nil {
+			continue
+		}
+		acquired = append(acquired, anc.sv)
+		if ancFile.InodeItem == nil || ancFile.InodeItem.Generation != file.InodeItem.Generation || !ancFile.InodeItem.Mode.IsRegular() {
+			continue
+		}
+		if !sameExtents(file, ancFile, off, end) {
+			continue
+		}
+		transID := btrfsprim.Generation(ancFile.InodeItem.TransID)
+		cands = append(cands, candidate{
+			file: ancFile,
+			fill: fill{
+				TreeID:   anc.TreeID,
+				TransID:  transID,
+				Modified: transID > anc.SnapshotGen,
+			},
+		})
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		return !cands[i].fill.Modified && cands[j].fill.Modified
+	})
+	for _, cand := range cands {
+		if n, err := readAt(cand.file, dat, off); err == nil && n == len(dat) {
+			ret := cand.fill
+			ret.Beg, ret.End = off, end
+			return ret, true
+		}
+	}
+	return fill{}, false
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package extractsubvol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+func regExtent(fileOff int64, diskByteNr btrfsvol.LogicalAddr, dataOff, size int64) btrfs.FileExtent {
+	return btrfs.FileExtent{
+		OffsetWithinFile: fileOff,
+		FileExtent: btrfsitem.FileExtent{
+			RAMBytes: size,
+			Type:     btrfsitem.FILE_EXTENT_REG,
+			BodyExtent: btrfsitem.FileExtentExtent{
+				DiskByteNr:   diskByteNr,
+				DiskNumBytes: btrfsvol.AddrDelta(dataOff + size),
+				Offset:       btrfsvol.AddrDelta(dataOff),
+				NumBytes:     size,
+			},
+		},
+	}
+}
+
+func TestSameExtents(t *testing.T) {
+	t.Parallel()
+	// The child's file is a single extent, [0, 0x3000) at 0x100000.
+	child := &btrfs.File{Extents: []btrfs.FileExtent{
+		regExtent(0, 0x100000, 0, 0x3000),
+	}}
+	testcases := map[string]struct {
+		Ancestor []btrfs.FileExtent
+		Beg, End int64
+		Exp      bool
+	}{
+		"same": {
+			Ancestor: []btrfs.FileExtent{regExtent(0, 0x100000, 0, 0x3000)},
+			Beg:      0x1000, End: 0x2000,
+			Exp: true,
+		},
+		"split": {
+			// The same data, but described by two items.
+			Ancestor: []btrfs.FileExtent{
+				regExtent(0, 0x100000, 0, 0x1800),
+				regExtent(0x1800, 0x100000, 0x1800, 0x1800),
+			},
+			Beg: 0x1000, End: 0x2000,
+			Exp: true,
+		},
+		"split-elsewhere": {
+			// The range that's asked about is the same,
+			// even though the rest of the file isn't.
+			Ancestor: []btrfs.FileExtent{
+				regExtent(0, 0x200000, 0, 0x1000),
+				regExtent(0x1000, 0x100000, 0x1000, 0x2000),
+			},
+			Beg: 0x1000, End: 0x2000,
+			Exp: true,
+		},
+		"rewritten": {
+			// The ancestor has the range at a different
+			// place on disk; the file was changed.
+			Ancestor: []btrfs.FileExtent{regExtent(0, 0x200000, 0, 0x3000)},
+			Beg:      0x1000, End: 0x2000,
+			Exp: false,
+		},
+		"shifted": {
+			// The same extent, but a different part of
+			// it.
+			Ancestor: []btrfs.FileExtent{regExtent(0, 0x100000, 0x1000, 0x2000)},
+			Beg:      0x1000, End: 0x2000,
+			Exp: false,
+		},
+		"partly-rewritten": {
+			Ancestor: []btrfs.FileExtent{
+				regExtent(0, 0x100000, 0, 0x1800),
+				regExtent(0x1800, 0x200000, 0, 0x1800),
+			},
+			Beg: 0x1000, End: 0x2000,
+			Exp: false,
+		},
+		"missing": {
+			Ancestor: []btrfs.FileExtent{regExtent(0, 0x100000, 0, 0x1800)},
+			Beg:      0x1000, End: 0x2000,
+			Exp: false,
+		},
+		"inline": {
+			Ancestor: []btrfs.FileExtent{{
+				FileExtent: btrfsitem.FileExtent{
+					RAMBytes:   0x3000,
+					Type:       btrfsitem.FILE_EXTENT_INLINE,
+					BodyInline: make([]byte, 0x3000),
+				},
+			}},
+			Beg: 0x1000, End: 0x2000,
+			Exp: false,
+		},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			ancestor := &btrfs.File{Extents: tc.Ancestor}
+			assert.Equal(t, tc.Exp, sameExtents(child, ancestor, tc.Beg, tc.End))
+			assert.Equal(t, tc.Exp, sameExtents(ancestor, child, tc.Beg, tc.End))
+		})
+	}
+
+	// With the child's own FILE_EXTENTs missing for the range,
+	// nothing matches, not even an identical ancestor.
+	lost := &btrfs.File{Extents: []btrfs.FileExtent{regExtent(0, 0x100000, 0, 0x1000)}}
+	assert.False(t, sameExtents(lost, lost, 0x1000, 0x2000))
+	assert.True(t, sameExtents(lost, lost, 0, 0x1000))
+}
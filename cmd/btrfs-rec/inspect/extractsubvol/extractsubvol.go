@@ -0,0 +1,568 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package extractsubvol is the guts of the `btrfs-rec inspect
+// extract-subvol` command, which writes the contents of a subvolume
+// to a tar archive.
+package extractsubvol
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/datawire/dlib/derror"
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/slices"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// HolesSuffix is appended to the name of a file to get the name of
+// the sidecar manifest that lists the ranges of that file that could
+// not be read (and were written as zeros).
+const HolesSuffix = ".btrfs-rec-holes"
+
+// UnverifiedPAXRecord is the PAX record that is set (to "1") on each
+// regular file in an archive written in carving mode, to mark that
+// none of its contents could be verified against a checksum.
+const UnverifiedPAXRecord = "BTRFS-REC.unverified"
+
+type extractStats struct {
+	Files   int
+	Bytes   int64
+	Holes   int
+	Skipped int
+
+	Links    int // hard links recreated from back-references
+	Dangling int // hard links that could not be recreated
+
+	Filled int // unreadable ranges filled from ancestor snapshots
+}
+
+func (s extractStats) String() string {
+	return textui.Sprintf("extracted %v files (%v), with %v holes (and %v filled from snapshots); skipped %v files; recreated %v lost hardlinks, %v dangling",
+		s.Files, textui.IEC(s.Bytes, "B"), s.Holes, s.Filled, s.Skipped, s.Links, s.Dangling)
+}
+
+type extractor struct {
+	ctx             context.Context //nolint:containedctx // don't have an option while keeping the same API
+	out             *tar.Writer
+	continueOnError bool
+	carve           bool
+
+	// links maps inode numbers to the name they were first
+	// written as, so that hard links may be written as such.
+	links map[btrfsprim.ObjID]string
+	// dirs maps the inode numbers of directories to the name they
+	// were written as, so that hard links that were not found by
+	// walking the tree may be written in to them.
+	dirs map[btrfsprim.ObjID]string
+	// ancestors is the snapshots that unreadable ranges may be
+	// filled from; see fillFromAncestors.
+	ancestors []ancestor
+
+	stats          extractStats
+	progressWriter *textui.Progress[extractStats]
+}
+
+// ExtractSubvol writes the contents of the subvolume `treeID` to
+// `out` as a PAX-format tar stream.
+//
+// Ranges of files that cannot be read are written as zeros, and are
+// listed in a sidecar file (named with HolesSuffix) that immediately
+// follows the file in the archive.  Any other error reading a file
+// aborts the extraction, unless `continueOnError` is set, in which
+// case the file is logged and skipped.
+//
+// Once the directory tree has been walked, the back-references of
+// each file with multiple hard links are checked, and any links that
+// the walk did not find (because the directory entry is lost) are
+// written as hard links, if their parent directory was written.
+// Links that can't be written are logged as dangling.
+//
+// If `carve` is set, file contents are reconstructed purely from the
+// FILE_EXTENT items of the subvolume, reading the extents' disk
+// ranges directly, without consulting the extent tree or the
+// checksum tree (overriding svCfg.NoChecksums).  This is a last
+// resort for when those trees are unrecoverable; since nothing is
+// verified, every regular file in the archive is marked with
+// UnverifiedPAXRecord.
+//
+// If `followParents` is set, then unreadable ranges of a file are
+// read from the same file in the subvolume's ancestor snapshots (the
+// subvolume it was snapshotted from, and that subvolume's, and so
+// on), if they can be read there and the ancestor's FILE_EXTENTs for
+// the range point at the same data on disk; these ranges are listed in a
+// sidecar file (named with FilledSuffix) along with which snapshot
+// they came from.
+func ExtractSubvol(
+	ctx context.Context,
+	out io.Writer,
+	fs btrfs.ReadableFS,
+	treeID btrfsprim.ObjID,
+	svCfg btrfs.SubvolumeConfig,
+	continueOnError bool,
+	carve bool,
+	followParents bool,
+) (err error) {
+	e := &extractor{
+		ctx:             ctx,
+		out:             tar.NewWriter(out),
+		continueOnError: continueOnError,
+		carve:           carve,
+		links:           make(map[btrfsprim.ObjID]string),
+		dirs:            make(map[btrfsprim.ObjID]string),
+		progressWriter:  textui.NewProgress[extractStats](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get()),
+	}
+	e.progressWriter.Set(e.stats)
+	defer e.progressWriter.Done()
+
+	if carve {
+		dlog.Warnf(ctx, "carving: reading file contents directly from FILE_EXTENT items; "+
+			"no checksum verification is possible, so files may silently contain garbage")
+		svCfg.NoChecksums = true
+	}
+	sv := btrfs.NewSubvolume(ctx, fs, treeID, svCfg)
+	if followParents {
+		e.ancestors = findAncestors(ctx, fs, treeID, svCfg)
+		if len(e.ancestors) == 0 {
+			dlog.Warnf(ctx, "tree %v has no ancestor snapshots to fill unreadable ranges from", treeID)
+		}
+	}
+	rootInode, err := sv.GetRootInode()
+	if err != nil {
+		return err
+	}
+	if err := e.entry(".", func() error {
+		return e.dir(sv, ".", rootInode)
+	}); err != nil {
+		return err
+	}
+	for _, inode := range maps.SortedKeys(e.links) {
+		name := e.links[inode]
+		if err := e.entry(name, func() error {
+			return e.lostLinks(sv, name, inode)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := e.out.Close(); err != nil {
+		return err
+	}
+	if e.stats.Skipped > 0 {
+		dlog.Errorf(ctx, "skipped %v files because of errors", e.stats.Skipped)
+	}
+	if e.stats.Dangling > 0 {
+		dlog.Errorf(ctx, "could not recreate %v hardlinks", e.stats.Dangling)
+	}
+	return nil
+}
+
+// entry calls fn, turning panics in to errors, and then dropping the
+// error if .continueOnError is set.
+func (e *extractor) entry(name string, fn func() error) (err error) {
+	defer func() {
+		if _err := derror.PanicToError(recover()); _err != nil {
+			err = _err
+		}
+		if err != nil {
+			var werr *writeError
+			if !e.continueOnError || errors.As(err, &werr) {
+				err = fmt.Errorf("%q: %w", name, err)
+				return
+			}
+			dlog.Errorf(e.ctx, "%q: skipping: %v", name, err)
+			e.stats.Skipped++
+			e.progressWriter.Set(e.stats)
+			err = nil
+		}
+	}()
+	return fn()
+}
+
+// writeError wraps errors writing to the output, which are never
+// skipped by --continue-on-error.
+type writeError struct {
+	Err error
+}
+
+func (e *writeError) Error() string { return e.Err.Error() }
+func (e *writeError) Unwrap() error { return e.Err }
+
+func (e *extractor) writeHeader(hdr *tar.Header) error {
+	if err := e.out.WriteHeader(hdr); err != nil {
+		return &writeError{Err: err}
+	}
+	return nil
+}
+
+func (e *extractor) write(dat []byte) error {
+	if _, err := e.out.Write(dat); err != nil {
+		return &writeError{Err: err}
+	}
+	return nil
+}
+
+func (e *extractor) logErrs(name string, errs derror.MultiError) {
+	if len(errs) > 0 {
+		dlog.Warnf(e.ctx, "%q: %v", name, errs)
+	}
+}
+
+func inodeHeader(typ byte, name string, inode btrfs.FullInode) *tar.Header {
+	hdr := &tar.Header{
+		Typeflag:   typ,
+		Name:       name,
+		Mode:       int64(inode.InodeItem.Mode &^ btrfsitem.ModeFmt),
+		Uid:        int(inode.InodeItem.UID),
+		Gid:        int(inode.InodeItem.GID),
+		ModTime:    inode.InodeItem.MTime.ToStd(),
+		AccessTime: inode.InodeItem.ATime.ToStd(),
+		ChangeTime: inode.InodeItem.CTime.ToStd(),
+		Format:     tar.FormatPAX,
+	}
+	if len(inode.XAttrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(inode.XAttrs))
+		for name, val := range inode.XAttrs {
+			hdr.PAXRecords["SCHILY.xattr."+name] = val
+		}
+	}
+	return hdr
+}
+
+// maybeLink writes a hard link if `inode` has already been written
+// under a different name.
+func (e *extractor) maybeLink(name string, inode btrfs.FullInode) (bool, error) {
+	if inode.InodeItem.NLink <= 1 {
+		return false, nil
+	}
+	tgt, ok := e.links[inode.Inode]
+	if !ok {
+		return false, nil
+	}
+	hdr := inodeHeader(tar.TypeLink, name, inode)
+	hdr.Linkname = tgt
+	hdr.PAXRecords = nil
+	return true, e.writeHeader(hdr)
+}
+
+// writeInodeHeader writes the header for the first name of `inode`,
+// and then records that name for maybeLink.  It is not recorded until
+// the header has been written, so that if writing the entry fails
+// earlier (and the failure is skipped by .continueOnError), later
+// links to the inode are not written as hard links to a member that
+// is not in the archive.
+func (e *extractor) writeInodeHeader(hdr *tar.Header, inode btrfs.FullInode) error {
+	if err := e.writeHeader(hdr); err != nil {
+		return err
+	}
+	if inode.InodeItem.NLink > 1 {
+		e.links[inode.Inode] = hdr.Name
+	}
+	return nil
+}
+
+// lostLinks writes the hard links to `inode` (which was first written
+// as `name`) that were not found by walking the directory tree.
+func (e *extractor) lostLinks(sv *btrfs.Subvolume, name string, inode btrfsprim.ObjID) error {
+	fullInode, err := sv.AcquireFullInode(inode)
+	if err != nil {
+		return err
+	}
+	defer sv.ReleaseFullInode(inode)
+	links, err := sv.InodeLinks(inode)
+	if err != nil {
+		dlog.Warnf(e.ctx, "%q: back-references: %v", name, err)
+	}
+	if len(links) < int(fullInode.InodeItem.NLink) {
+		dlog.Warnf(e.ctx, "%q: inode %v has %v links, but only %v back-references were found",
+			name, inode, fullInode.InodeItem.NLink, len(links))
+	}
+	for _, link := range links {
+		if link.Err == nil && link.InDir {
+			// The walk already found it.
+			continue
+		}
+		if link.Err != nil {
+			dlog.Warnf(e.ctx, "%q: dangling hardlink %q: %v", name, link.Name, link.Err)
+			e.stats.Dangling++
+			e.progressWriter.Set(e.stats)
+			continue
+		}
+		dirName, ok := e.dirs[link.Parent]
+		if !ok {
+			dlog.Warnf(e.ctx, "%q: dangling hardlink %q: parent directory was not extracted", name, link.Path)
+			e.stats.Dangling++
+			e.progressWriter.Set(e.stats)
+			continue
+		}
+		linkName := path.Join(dirName, link.Name)
+		dlog.Infof(e.ctx, "%q: recreating hardlink from back-reference", linkName)
+		hdr := inodeHeader(tar.TypeLink, linkName, *fullInode)
+		hdr.Linkname = name
+		hdr.PAXRecords = nil
+		if err := e.writeHeader(hdr); err != nil {
+			return err
+		}
+		e.stats.Links++
+		e.progressWriter.Set(e.stats)
+	}
+	return nil
+}
+
+func (e *extractor) dir(sv *btrfs.Subvolume, name string, inode btrfsprim.ObjID) error {
+	dir, err := sv.AcquireDir(inode)
+	if err != nil {
+		return err
+	}
+	e.logErrs(name, dir.Errs)
+	childrenByName := dir.ChildrenByName
+	var hdr *tar.Header
+	if dir.InodeItem != nil {
+		hdr = inodeHeader(tar.TypeDir, name+"/", dir.FullInode)
+	}
+	sv.ReleaseDir(inode)
+	if hdr == nil {
+		return fmt.Errorf("directory inode %v: missing INODE_ITEM", inode)
+	}
+	if err := e.writeHeader(hdr); err != nil {
+		return err
+	}
+	e.dirs[inode] = name
+
+	for _, childName := range maps.SortedKeys(childrenByName) {
+		childPath := path.Join(name, childName)
+		if err := e.entry(childPath, func() error {
+			return e.dirEntry(sv, childPath, childrenByName[childName])
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *extractor) dirEntry(sv *btrfs.Subvolume, name string, entry btrfsitem.DirEntry) error {
+	switch entry.Location.ItemType {
+	case btrfsitem.INODE_ITEM_KEY:
+		// handled below
+	case btrfsitem.ROOT_ITEM_KEY:
+		dlog.Warnf(e.ctx, "%q: not descending in to child subvolume %v",
+			name, entry.Location.ObjectID)
+		return nil
+	default:
+		return fmt.Errorf("don't know how to handle a direntry with location.ItemType=%v",
+			entry.Location.ItemType)
+	}
+
+	switch entry.Type {
+	case btrfsitem.FT_DIR:
+		return e.dir(sv, name, entry.Location.ObjectID)
+	case btrfsitem.FT_REG_FILE:
+		return e.regFile(sv, name, entry.Location.ObjectID)
+	case btrfsitem.FT_SYMLINK:
+		return e.symlink(sv, name, entry.Location.ObjectID)
+	case btrfsitem.FT_CHRDEV:
+		return e.special(sv, name, entry.Location.ObjectID, tar.TypeChar)
+	case btrfsitem.FT_BLKDEV:
+		return e.special(sv, name, entry.Location.ObjectID, tar.TypeBlock)
+	case btrfsitem.FT_FIFO:
+		return e.special(sv, name, entry.Location.ObjectID, tar.TypeFifo)
+	case btrfsitem.FT_SOCK:
+		dlog.Warnf(e.ctx, "%q: tar cannot represent sockets; omitting", name)
+		return nil
+	default:
+		return fmt.Errorf("don't know how to handle a fileType=%v", entry.Type)
+	}
+}
+
+func (e *extractor) special(sv *btrfs.Subvolume, name string, inode btrfsprim.ObjID, typ byte) error {
+	fullInode, err := sv.AcquireFullInode(inode)
+	if err != nil {
+		return err
+	}
+	defer sv.ReleaseFullInode(inode)
+	e.logErrs(name, fullInode.Errs)
+	if fullInode.InodeItem == nil {
+		return fmt.Errorf("inode %v: missing INODE_ITEM", inode)
+	}
+	if linked, err := e.maybeLink(name, *fullInode); linked || err != nil {
+		return err
+	}
+	hdr := inodeHeader(typ, name, *fullInode)
+	// Linux "new_decode_dev()".
+	rdev := uint64(fullInode.InodeItem.RDev)
+	hdr.Devmajor = int64((rdev & 0xfff00) >> 8)                    //nolint:gomnd // Linux dev_t encoding.
+	hdr.Devminor = int64((rdev & 0xff) | ((rdev >> 12) & 0xfff00)) //nolint:gomnd // Linux dev_t encoding.
+	if err := e.writeInodeHeader(hdr, *fullInode); err != nil {
+		return err
+	}
+	e.stats.Files++
+	e.progressWriter.Set(e.stats)
+	return nil
+}
+
+func (e *extractor) symlink(sv *btrfs.Subvolume, name string, inode btrfsprim.ObjID) error {
+	file, err := sv.AcquireFile(inode)
+	if err != nil {
+		return err
+	}
+	defer sv.ReleaseFile(inode)
+	e.logErrs(name, file.Errs)
+	if file.InodeItem == nil {
+		return fmt.Errorf("inode %v: missing INODE_ITEM", inode)
+	}
+	if linked, err := e.maybeLink(name, file.FullInode); linked || err != nil {
+		return err
+	}
+	tgt, err := io.ReadAll(io.NewSectionReader(file, 0, file.InodeItem.Size))
+	if err != nil {
+		return fmt.Errorf("read symlink target: %w", err)
+	}
+	hdr := inodeHeader(tar.TypeSymlink, name, file.FullInode)
+	hdr.Linkname = string(tgt)
+	if err := e.writeInodeHeader(hdr, file.FullInode); err != nil {
+		return err
+	}
+	e.stats.Files++
+	e.progressWriter.Set(e.stats)
+	return nil
+}
+
+// readAt is like file.ReadAt, but turns panics in to errors, so that
+// they can be recorded as holes rather than leaving the archive with a
+// partially-written entry.
+func readAt(file *btrfs.File, dat []byte, off int64) (n int, err error) {
+	defer func() {
+		if _err := derror.PanicToError(recover()); _err != nil {
+			err = _err
+		}
+	}()
+	return file.ReadAt(dat, off)
+}
+
+type hole struct {
+	Beg, End int64
+	Err      error
+}
+
+func (e *extractor) regFile(sv *btrfs.Subvolume, name string, inode btrfsprim.ObjID) error {
+	file, err := sv.AcquireFile(inode)
+	if err != nil {
+		return err
+	}
+	defer sv.ReleaseFile(inode)
+	e.logErrs(name, file.Errs)
+	if file.InodeItem == nil {
+		return fmt.Errorf("inode %v: missing INODE_ITEM", inode)
+	}
+	if linked, err := e.maybeLink(name, file.FullInode); linked || err != nil {
+		return err
+	}
+	hdr := inodeHeader(tar.TypeReg, name, file.FullInode)
+	hdr.Size = file.InodeItem.Size
+	if e.carve {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string, 1)
+		}
+		hdr.PAXRecords[UnverifiedPAXRecord] = "1"
+	}
+	if err := e.writeInodeHeader(hdr, file.FullInode); err != nil {
+		return err
+	}
+
+	var holes []hole
+	var fills []fill
+	var buf [btrfssum.BlockSize]byte
+	for off := int64(0); off < hdr.Size; {
+		n := slices.Min(int64(len(buf)), hdr.Size-off)
+		got, err := readAt(file, buf[:n], off)
+		if err != nil && len(e.ancestors) > 0 {
+			if f, ok := e.fillFromAncestors(file, buf[got:n], off+int64(got)); ok {
+				if len(fills) > 0 && fills[len(fills)-1].End == f.Beg && fills[len(fills)-1].TreeID == f.TreeID {
+					fills[len(fills)-1].End = f.End
+				} else {
+					fills = append(fills, f)
+				}
+				err = nil
+			}
+		}
+		if err != nil {
+			for i := got; i < int(n); i++ {
+				buf[i] = 0
+			}
+			beg, end := off+int64(got), off+n
+			if len(holes) > 0 && holes[len(holes)-1].End == beg {
+				holes[len(holes)-1].End = end
+			} else {
+				holes = append(holes, hole{Beg: beg, End: end, Err: err})
+			}
+		}
+		if err := e.write(buf[:n]); err != nil {
+			return err
+		}
+		off += n
+		e.stats.Bytes += n
+		e.progressWriter.Set(e.stats)
+	}
+	e.stats.Files++
+	e.progressWriter.Set(e.stats)
+
+	if len(fills) > 0 {
+		e.stats.Filled += len(fills)
+		e.progressWriter.Set(e.stats)
+		var manifest strings.Builder
+		for _, f := range fills {
+			modified := ""
+			if f.Modified {
+				modified = "\t(modified since the snapshot)"
+				dlog.Warnf(e.ctx, "%q: filled %v-%v from tree %v, which has modified the file since the snapshot (transid %v)",
+					name, f.Beg, f.End, f.TreeID, f.TransID)
+			} else {
+				dlog.Infof(e.ctx, "%q: filled %v-%v from tree %v (transid %v)",
+					name, f.Beg, f.End, f.TreeID, f.TransID)
+			}
+			textui.Fprintf(&manifest, "%v-%v\ttree=%v\ttransid=%v%s\n", f.Beg, f.End, f.TreeID, f.TransID, modified)
+		}
+		if err := e.sidecar(name+FilledSuffix, hdr, manifest.String()); err != nil {
+			return err
+		}
+	}
+
+	if len(holes) == 0 {
+		return nil
+	}
+	dlog.Warnf(e.ctx, "%q: %v unreadable ranges were written as zeros", name, len(holes))
+	e.stats.Holes += len(holes)
+	var manifest strings.Builder
+	for _, hole := range holes {
+		textui.Fprintf(&manifest, "%v-%v\t%v\n", hole.Beg, hole.End, hole.Err)
+	}
+	return e.sidecar(name+HolesSuffix, hdr, manifest.String())
+}
+
+// sidecar writes a read-only manifest file named `name`, for the file
+// whose header is `hdr`.
+func (e *extractor) sidecar(name string, hdr *tar.Header, content string) error {
+	if err := e.writeHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o444, //nolint:gomnd // It's a read-only file.
+		Size:     int64(len(content)),
+		ModTime:  hdr.ModTime,
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		return err
+	}
+	return e.write([]byte(content))
+}
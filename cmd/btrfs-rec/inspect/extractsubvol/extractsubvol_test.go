@@ -0,0 +1,226 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package extractsubvol
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+)
+
+// memTree is a btrfstree.Tree of a sorted list of items.
+type memTree []btrfstree.Item
+
+func (memTree) TreeParentID(context.Context) (btrfsprim.ObjID, btrfsprim.Generation, error) {
+	return 0, 0, nil
+}
+
+func (t memTree) TreeLookup(ctx context.Context, key btrfsprim.Key) (btrfstree.Item, error) {
+	return t.TreeSearch(ctx, btrfstree.SearchExactKey(key))
+}
+
+func (t memTree) TreeSearch(_ context.Context, search btrfstree.TreeSearcher) (btrfstree.Item, error) {
+	for _, item := range t {
+		if search.Search(item.Key, item.BodySize) == 0 {
+			return item, nil
+		}
+	}
+	return btrfstree.Item{}, fmt.Errorf("%v: %w", search, btrfstree.ErrNoItem)
+}
+
+func (t memTree) TreeRange(_ context.Context, handleFn func(btrfstree.Item) bool) error {
+	for _, item := range t {
+		if !handleFn(item) {
+			break
+		}
+	}
+	return nil
+}
+
+func (t memTree) TreeSubrange(_ context.Context, min int, search btrfstree.TreeSearcher, handleFn func(btrfstree.Item) bool) error {
+	cnt := 0
+	for _, item := range t {
+		if search.Search(item.Key, item.BodySize) != 0 {
+			continue
+		}
+		cnt++
+		if !handleFn(item) {
+			break
+		}
+	}
+	if cnt < min {
+		return fmt.Errorf("%v: %w", search, btrfstree.ErrNoItem)
+	}
+	return nil
+}
+
+func (memTree) TreeWalk(context.Context, btrfstree.TreeWalkHandler) {}
+
+// memTreesFS is an FS whose btrees are memTrees.
+type memTreesFS struct {
+	*btrfs.FS
+	trees map[btrfsprim.ObjID]memTree
+}
+
+func (fs memTreesFS) ForrestLookup(_ context.Context, treeID btrfsprim.ObjID) (btrfstree.Tree, error) {
+	tree, ok := fs.trees[treeID]
+	if !ok {
+		return nil, btrfstree.ErrNoTree
+	}
+	return tree, nil
+}
+
+func (memTreesFS) Superblock() (*btrfstree.Superblock, error) {
+	return &btrfstree.Superblock{
+		SectorSize: 4096,
+		NodeSize:   16384,
+	}, nil
+}
+
+const rootDir = btrfsprim.ObjID(256)
+
+func key(objID btrfsprim.ObjID, typ btrfsprim.ItemType, off uint64) btrfsprim.Key {
+	return btrfsprim.Key{ObjectID: objID, ItemType: typ, Offset: off}
+}
+
+// linkedInode returns the items for an inode with a name in the root
+// directory for each of `names`.
+func linkedInode(inode btrfsprim.ObjID, mode btrfsitem.StatMode, typ btrfsitem.FileType, size int64, names ...string) []btrfstree.Item {
+	ret := []btrfstree.Item{
+		{Key: key(inode, btrfsitem.INODE_ITEM_KEY, 0), Body: &btrfsitem.Inode{
+			NLink: int32(len(names)),
+			Mode:  mode | 0o644,
+			Size:  size,
+		}},
+	}
+	var refs []btrfsitem.InodeRef
+	for i, name := range names {
+		refs = append(refs, btrfsitem.InodeRef{Index: int64(i + 2), Name: []byte(name)})
+		ret = append(ret, btrfstree.Item{
+			Key: key(rootDir, btrfsitem.DIR_ITEM_KEY, btrfsitem.NameHash([]byte(name))),
+			Body: &btrfsitem.DirEntry{
+				Location: key(inode, btrfsitem.INODE_ITEM_KEY, 0),
+				Type:     typ,
+				Name:     []byte(name),
+			},
+		})
+	}
+	ret = append(ret, btrfstree.Item{
+		Key:  key(inode, btrfsitem.INODE_REF_KEY, uint64(rootDir)),
+		Body: &btrfsitem.InodeRefs{Refs: refs},
+	})
+	return ret
+}
+
+// extractItems runs ExtractSubvol on an FS_TREE of the root directory
+// and `items`, and returns the headers and contents of the resulting
+// archive.
+func extractItems(t *testing.T, continueOnError bool, items ...btrfstree.Item) ([]*tar.Header, map[string]string, error) {
+	t.Helper()
+	ctx := dlog.NewTestContext(t, false)
+
+	fsTree := memTree{
+		{Key: key(rootDir, btrfsitem.INODE_ITEM_KEY, 0), Body: &btrfsitem.Inode{NLink: 1, Mode: btrfsitem.ModeFmtDir | 0o755}},
+	}
+	fsTree = append(fsTree, items...)
+	sort.SliceStable(fsTree, func(i, j int) bool {
+		return fsTree[i].Key.Compare(fsTree[j].Key) < 0
+	})
+	fs := memTreesFS{
+		FS: new(btrfs.FS),
+		trees: map[btrfsprim.ObjID]memTree{
+			btrfsprim.ROOT_TREE_OBJECTID: {
+				{
+					Key:  key(btrfsprim.FS_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0),
+					Body: &btrfsitem.Root{RootDirID: rootDir},
+				},
+			},
+			btrfsprim.FS_TREE_OBJECTID: fsTree,
+		},
+	}
+
+	var out bytes.Buffer
+	extractErr := ExtractSubvol(ctx, &out, fs, btrfsprim.FS_TREE_OBJECTID, btrfs.SubvolumeConfig{NoChecksums: true},
+		continueOnError, false, false)
+
+	var hdrs []*tar.Header
+	contents := make(map[string]string)
+	rd := tar.NewReader(&out)
+	for {
+		hdr, err := rd.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		dat, err := io.ReadAll(rd)
+		require.NoError(t, err)
+		hdrs = append(hdrs, hdr)
+		contents[hdr.Name] = string(dat)
+	}
+	return hdrs, contents, extractErr
+}
+
+func TestExtractHardlinks(t *testing.T) {
+	t.Parallel()
+	const file = btrfsprim.ObjID(257)
+	items := linkedInode(file, btrfsitem.ModeFmtRegular, btrfsitem.FT_REG_FILE, 5, "a", "b")
+	items = append(items, btrfstree.Item{
+		Key: key(file, btrfsitem.EXTENT_DATA_KEY, 0),
+		Body: &btrfsitem.FileExtent{
+			RAMBytes:   5,
+			Type:       btrfsitem.FILE_EXTENT_INLINE,
+			BodyInline: []byte("hello"),
+		},
+	})
+
+	hdrs, contents, err := extractItems(t, false, items...)
+	require.NoError(t, err)
+	require.Len(t, hdrs, 3)
+	assert.Equal(t, "./", hdrs[0].Name)
+	assert.Equal(t, "a", hdrs[1].Name)
+	assert.Equal(t, byte(tar.TypeReg), hdrs[1].Typeflag)
+	assert.Equal(t, "hello", contents["a"])
+	assert.Equal(t, "b", hdrs[2].Name)
+	assert.Equal(t, byte(tar.TypeLink), hdrs[2].Typeflag)
+	assert.Equal(t, "a", hdrs[2].Linkname)
+}
+
+// TestExtractHardlinkToSkipped checks that if the first name of an
+// inode is skipped by --continue-on-error, the later names are not
+// written as hard links to it.
+func TestExtractHardlinkToSkipped(t *testing.T) {
+	t.Parallel()
+	const symlink = btrfsprim.ObjID(257)
+	// A symlink whose target can't be read, because it has no
+	// FILE_EXTENT.
+	items := linkedInode(symlink, btrfsitem.ModeFmtSymlink, btrfsitem.FT_SYMLINK, 10, "a", "b")
+
+	hdrs, _, err := extractItems(t, true, items...)
+	require.NoError(t, err)
+	for _, hdr := range hdrs {
+		assert.NotEqual(t, byte(tar.TypeLink), hdr.Typeflag,
+			"%q is a hard link to %q, which is not in the archive", hdr.Name, hdr.Linkname)
+	}
+	require.Len(t, hdrs, 1)
+	assert.Equal(t, "./", hdrs[0].Name)
+
+	// Without --continue-on-error, the first failure is fatal.
+	_, _, err = extractItems(t, false, items...)
+	assert.ErrorContains(t, err, `"a": read symlink target`)
+}
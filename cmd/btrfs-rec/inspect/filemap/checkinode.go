@@ -0,0 +1,169 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package filemap
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+type Verdict int
+
+const (
+	// VerdictOK means that the inode's Size and NumBytes agree
+	// with the extent map.
+	VerdictOK Verdict = iota
+	// VerdictTruncated means that the inode claims more data
+	// than the surviving extents hold; some of the file was lost
+	// during recovery.
+	VerdictTruncated
+	// VerdictOverClaimed means that the extents hold more data
+	// than the inode accounts for.
+	VerdictOverClaimed
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictOK:
+		return "ok"
+	case VerdictTruncated:
+		return "TRUNCATED-ON-RECOVERY"
+	case VerdictOverClaimed:
+		return "OVER-CLAIMED"
+	default:
+		return fmt.Sprintf("Verdict(%d)", int(v))
+	}
+}
+
+// An InodeCheck is the result of comparing an inode's Size and
+// NumBytes against its extent map.
+type InodeCheck struct {
+	// From the INODE_ITEM.
+	Size, NumBytes int64
+
+	// From the extent map.  DataEnd is the end of the last
+	// extent, AllocatedBytes is what NumBytes should be (the
+	// bytes of regular and prealloc extents, plus the ram_bytes
+	// of inline extents; but not sparse extents or holes), and
+	// HoleBytes is the size of the gaps between extents within
+	// [0, Size).
+	DataEnd        int64
+	AllocatedBytes int64
+	HoleBytes      int64
+
+	Verdict  Verdict
+	Problems []string
+}
+
+// Check compares an inode's Size and NumBytes against the
+// extent map returned by Map.
+//
+// Holes (both explicit sparse extents and gaps between extents) may
+// legitimately make NumBytes less than Size, so they are not problems
+// on their own; but if NumBytes says that there should be more
+// allocated data than the extents hold, then the holes are taken to
+// be where the lost data was.  Extents may legitimately extend past
+// Size up to the next sector boundary, and prealloc extents may
+// extend past it arbitrarily.
+func Check(ranges []Range, inode btrfsitem.Inode, sectorSize uint32) InodeCheck {
+	ret := InodeCheck{
+		Size:     inode.Size,
+		NumBytes: inode.NumBytes,
+	}
+	var overEOF int64
+	for _, rng := range ranges {
+		switch rng.Kind {
+		case RangeHole:
+			if rng.Beg < ret.Size {
+				ret.HoleBytes += min(rng.End, ret.Size) - rng.Beg
+			}
+		case RangeExtent:
+			ext := rng.Extent
+			if rng.End > ret.DataEnd {
+				ret.DataEnd = rng.End
+			}
+			if ext.Type != btrfsitem.FILE_EXTENT_INLINE && ext.BodyExtent.DiskByteNr == 0 {
+				// sparse
+				continue
+			}
+			ret.AllocatedBytes += rng.End - rng.Beg
+			if ext.Type != btrfsitem.FILE_EXTENT_PREALLOC {
+				if eof := roundUp(ret.Size, int64(sectorSize)); rng.End > eof {
+					overEOF += rng.End - max(rng.Beg, eof)
+				}
+			}
+		}
+	}
+
+	switch {
+	case ret.NumBytes > ret.AllocatedBytes:
+		ret.Verdict = VerdictTruncated
+		ret.Problems = append(ret.Problems, fmt.Sprintf("nbytes=%v but the extents only hold %v bytes (%v missing)",
+			ret.NumBytes, ret.AllocatedBytes, ret.NumBytes-ret.AllocatedBytes))
+		if ret.HoleBytes > 0 {
+			ret.Problems = append(ret.Problems, fmt.Sprintf("%v of holes within size=%v are likely lost data, not sparse regions",
+				textui.IEC(ret.HoleBytes, "B"), ret.Size))
+		}
+	case ret.NumBytes < ret.AllocatedBytes:
+		ret.Verdict = VerdictOverClaimed
+		ret.Problems = append(ret.Problems, fmt.Sprintf("nbytes=%v but the extents hold %v bytes (%v extra)",
+			ret.NumBytes, ret.AllocatedBytes, ret.AllocatedBytes-ret.NumBytes))
+	}
+	if overEOF > 0 {
+		ret.Verdict = VerdictOverClaimed
+		ret.Problems = append(ret.Problems, fmt.Sprintf("%v bytes of non-prealloc extents are mapped past size=%v",
+			overEOF, ret.Size))
+	}
+	return ret
+}
+
+func max(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func roundUp(n, align int64) int64 {
+	if align <= 0 {
+		return n
+	}
+	return ((n + align - 1) / align) * align
+}
+
+// CheckInode writes the result of Check for inode `inode` in
+// subvolume `treeID` to `out`.  File data is not read, so
+// svCfg.NoChecksums is ignored.
+func CheckInode(ctx context.Context, out io.Writer, fs btrfs.ReadableFS, svCfg btrfs.SubvolumeConfig, treeID, inode btrfsprim.ObjID) error {
+	sb, err := fs.Superblock()
+	if err != nil {
+		return err
+	}
+	svCfg.NoChecksums = true
+	sv := btrfs.NewSubvolume(ctx, fs, treeID, svCfg)
+	file, err := sv.AcquireFile(inode)
+	if err != nil {
+		return err
+	}
+	defer sv.ReleaseFile(inode)
+	if file.InodeItem == nil {
+		return fmt.Errorf("inode %v: no INODE_ITEM; nothing to compare against", inode)
+	}
+
+	check := Check(Map(ctx, fs, file), *file.InodeItem, sb.SectorSize)
+	textui.Fprintf(out, "inode %v: size=%v nbytes=%v\n", inode, check.Size, check.NumBytes)
+	textui.Fprintf(out, "extents: end=%v allocated=%v holes=%v\n", check.DataEnd, check.AllocatedBytes, check.HoleBytes)
+	for _, problem := range check.Problems {
+		textui.Fprintf(out, "problem: %s\n", problem)
+	}
+	textui.Fprintf(out, "verdict: %v\n", check.Verdict)
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package filemap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+)
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+	regular := func(beg, end int64) Range {
+		return Range{Beg: beg, End: end, Kind: RangeExtent, Extent: &btrfs.FileExtent{
+			OffsetWithinFile: beg,
+			FileExtent: btrfsitem.FileExtent{
+				Type:       btrfsitem.FILE_EXTENT_REG,
+				BodyExtent: btrfsitem.FileExtentExtent{DiskByteNr: 0x100000, NumBytes: end - beg},
+			},
+		}}
+	}
+	prealloc := func(beg, end int64) Range {
+		rng := regular(beg, end)
+		rng.Extent.Type = btrfsitem.FILE_EXTENT_PREALLOC
+		return rng
+	}
+	sparse := func(beg, end int64) Range {
+		rng := regular(beg, end)
+		rng.Extent.BodyExtent.DiskByteNr = 0
+		return rng
+	}
+	inline := func(size int64) Range {
+		return Range{Beg: 0, End: size, Kind: RangeExtent, Extent: &btrfs.FileExtent{
+			FileExtent: btrfsitem.FileExtent{
+				Type:     btrfsitem.FILE_EXTENT_INLINE,
+				RAMBytes: size,
+			},
+		}}
+	}
+	hole := func(beg, end int64) Range {
+		return Range{Beg: beg, End: end, Kind: RangeHole}
+	}
+
+	type testcase struct {
+		Ranges         []Range
+		Size, NumBytes int64
+		ExpVerdict     Verdict
+		ExpNumProblems int
+		ExpAllocated   int64
+		ExpHoleBytes   int64
+	}
+	testcases := map[string]testcase{
+		"ok": {
+			Ranges: []Range{regular(0, 8192)},
+			Size:   8000, NumBytes: 8192,
+			ExpVerdict: VerdictOK, ExpAllocated: 8192,
+		},
+		"ok-inline": {
+			Ranges: []Range{inline(100)},
+			Size:   100, NumBytes: 100,
+			ExpVerdict: VerdictOK, ExpAllocated: 100,
+		},
+		"ok-sparse": {
+			Ranges: []Range{regular(0, 4096), sparse(4096, 8192), hole(8192, 12288), regular(12288, 16384), hole(16384, 20000)},
+			Size:   20000, NumBytes: 8192,
+			ExpVerdict: VerdictOK, ExpAllocated: 8192, ExpHoleBytes: 4096 + (20000 - 16384),
+		},
+		"ok-prealloc-past-eof": {
+			Ranges: []Range{regular(0, 4096), prealloc(4096, 1<<20)},
+			Size:   100, NumBytes: 1 << 20,
+			ExpVerdict: VerdictOK, ExpAllocated: 1 << 20,
+		},
+		"truncated": {
+			Ranges: []Range{regular(0, 4096), hole(4096, 12288), regular(12288, 16384)},
+			Size:   16384, NumBytes: 16384,
+			ExpVerdict: VerdictTruncated, ExpNumProblems: 2, ExpAllocated: 8192, ExpHoleBytes: 8192,
+		},
+		"truncated-tail": {
+			Ranges: []Range{regular(0, 4096), hole(4096, 16384)},
+			Size:   16384, NumBytes: 16384,
+			ExpVerdict: VerdictTruncated, ExpNumProblems: 2, ExpAllocated: 4096, ExpHoleBytes: 12288,
+		},
+		"over-claimed-nbytes": {
+			Ranges: []Range{regular(0, 16384)},
+			Size:   16384, NumBytes: 4096,
+			ExpVerdict: VerdictOverClaimed, ExpNumProblems: 1, ExpAllocated: 16384,
+		},
+		"over-claimed-past-eof": {
+			Ranges: []Range{regular(0, 16384)},
+			Size:   100, NumBytes: 16384,
+			ExpVerdict: VerdictOverClaimed, ExpNumProblems: 1, ExpAllocated: 16384,
+		},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			check := Check(tc.Ranges, btrfsitem.Inode{Size: tc.Size, NumBytes: tc.NumBytes}, 4096)
+			assert.Equal(t, tc.ExpVerdict, check.Verdict, check.Problems)
+			assert.Len(t, check.Problems, tc.ExpNumProblems, check.Problems)
+			assert.Equal(t, tc.ExpAllocated, check.AllocatedBytes)
+			assert.Equal(t, tc.ExpHoleBytes, check.HoleBytes)
+		})
+	}
+}
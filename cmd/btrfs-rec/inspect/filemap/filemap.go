@@ -0,0 +1,220 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package filemap is the guts of the `btrfs-rec inspect file-map`
+// command, which reconstructs the extent map of a single file and
+// reports which parts of it are damaged, and of the `btrfs-rec
+// inspect check-inode` command, which compares that extent map
+// against the inode's size and nbytes.
+package filemap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+type RangeKind int
+
+const (
+	// RangeExtent is a range covered by exactly one FILE_EXTENT.
+	RangeExtent RangeKind = iota
+	// RangeHole is a range within [0, size) that is not covered
+	// by any FILE_EXTENT.  (On a filesystem with the NO_HOLES
+	// feature, these may be legitimate sparse regions.)
+	RangeHole
+	// RangeOverlap is a range that is covered by more than one
+	// FILE_EXTENT.
+	RangeOverlap
+)
+
+func (k RangeKind) String() string {
+	switch k {
+	case RangeExtent:
+		return "extent"
+	case RangeHole:
+		return "HOLE"
+	case RangeOverlap:
+		return "OVERLAP"
+	default:
+		return fmt.Sprintf("RangeKind(%d)", int(k))
+	}
+}
+
+// A Range is a half-open range [Beg, End) of byte offsets within a
+// file.
+type Range struct {
+	Beg, End int64
+	Kind     RangeKind
+
+	// Extent is set for RangeExtent and RangeOverlap; for
+	// RangeOverlap it is the later of the overlapping extents.
+	Extent *btrfs.FileExtent
+	// MissingExtentItem is set for RangeExtent ranges that
+	// reference an on-disk extent that does not have an
+	// EXTENT_ITEM in the extent tree.
+	MissingExtentItem bool
+	// Err is any error encountered while checking the extent.
+	Err error
+}
+
+// extentEnd returns the end of the range of the file that the extent
+// covers.  Unlike btrfsitem.FileExtent.Size(), this is ram_bytes for
+// inline extents, as inline data may be compressed.
+func extentEnd(ext btrfs.FileExtent) (int64, error) {
+	if ext.Type == btrfsitem.FILE_EXTENT_INLINE {
+		return ext.OffsetWithinFile + ext.RAMBytes, nil
+	}
+	size, err := ext.Size()
+	return ext.OffsetWithinFile + size, err
+}
+
+// Map reconstructs the extent map of a file, returning a sorted list
+// of ranges that tile [0, max(size, end of the last extent)).
+func Map(ctx context.Context, fs btrfs.ReadableFS, file *btrfs.File) []Range {
+	var extentTree btrfstree.Tree
+	extentTreeErr := errors.New("not yet loaded")
+	extentItemOK := make(map[btrfsitem.FileExtentExtent]error)
+	checkExtentItem := func(ext btrfsitem.FileExtentExtent) error {
+		if extentTree == nil {
+			extentTree, extentTreeErr = fs.ForrestLookup(ctx, btrfsprim.EXTENT_TREE_OBJECTID)
+		}
+		if extentTreeErr != nil {
+			return fmt.Errorf("extent tree: %w", extentTreeErr)
+		}
+		key := btrfsitem.FileExtentExtent{DiskByteNr: ext.DiskByteNr, DiskNumBytes: ext.DiskNumBytes}
+		if err, ok := extentItemOK[key]; ok {
+			return err
+		}
+		_, err := extentTree.TreeLookup(ctx, btrfsprim.Key{
+			ObjectID: btrfsprim.ObjID(ext.DiskByteNr),
+			ItemType: btrfsitem.EXTENT_ITEM_KEY,
+			Offset:   uint64(ext.DiskNumBytes),
+		})
+		extentItemOK[key] = err
+		return err
+	}
+
+	var ret []Range
+	var pos int64
+	for i := range file.Extents {
+		ext := &file.Extents[i]
+		beg := ext.OffsetWithinFile
+		end, err := extentEnd(*ext)
+		if err != nil {
+			ret = append(ret, Range{Beg: beg, End: beg, Kind: RangeExtent, Extent: ext, Err: err})
+			continue
+		}
+		if beg > pos {
+			ret = append(ret, Range{Beg: pos, End: beg, Kind: RangeHole})
+		}
+		if beg < pos {
+			ret = append(ret, Range{Beg: beg, End: min(pos, end), Kind: RangeOverlap, Extent: ext})
+			beg = min(pos, end)
+		}
+		if beg < end {
+			rng := Range{Beg: beg, End: end, Kind: RangeExtent, Extent: ext}
+			// DiskByteNr==0 is an explicit sparse hole, which
+			// has no backing extent.
+			if ext.Type != btrfsitem.FILE_EXTENT_INLINE && ext.BodyExtent.DiskByteNr != 0 {
+				if err := checkExtentItem(ext.BodyExtent); err != nil {
+					if errors.Is(err, btrfstree.ErrNoItem) {
+						rng.MissingExtentItem = true
+					} else {
+						rng.Err = err
+					}
+				}
+			}
+			ret = append(ret, rng)
+		}
+		if end > pos {
+			pos = end
+		}
+	}
+	if file.InodeItem != nil && file.InodeItem.Size > pos {
+		ret = append(ret, Range{Beg: pos, End: file.InodeItem.Size, Kind: RangeHole})
+	}
+	return ret
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func fmtOff(off int64) string {
+	return fmt.Sprintf("%#016x", off)
+}
+
+// FileMap writes the extent map of inode `inode` in subvolume
+// `treeID` to `out`, one range per line, followed by a summary.  File
+// data is not read, so svCfg.NoChecksums is ignored.
+func FileMap(ctx context.Context, out io.Writer, fs btrfs.ReadableFS, svCfg btrfs.SubvolumeConfig, treeID, inode btrfsprim.ObjID) error {
+	svCfg.NoChecksums = true
+	sv := btrfs.NewSubvolume(ctx, fs, treeID, svCfg)
+	file, err := sv.AcquireFile(inode)
+	if err != nil {
+		return err
+	}
+	defer sv.ReleaseFile(inode)
+
+	if file.InodeItem == nil {
+		textui.Fprintf(out, "# inode %v: no INODE_ITEM; size unknown\n", inode)
+	} else {
+		textui.Fprintf(out, "# inode %v: size=%v nbytes=%v\n", inode, file.InodeItem.Size, file.InodeItem.NumBytes)
+	}
+
+	var holes, overlaps, missing, errs int
+	var holeBytes int64
+	for _, rng := range Map(ctx, fs, file) {
+		textui.Fprintf(out, "%v-%v %v", fmtOff(rng.Beg), fmtOff(rng.End), rng.Kind)
+		switch rng.Kind {
+		case RangeHole:
+			holes++
+			holeBytes += rng.End - rng.Beg
+		case RangeOverlap:
+			overlaps++
+			textui.Fprintf(out, " with extent@%v", fmtOff(rng.Extent.OffsetWithinFile))
+		case RangeExtent:
+			ext := rng.Extent
+			switch ext.Type {
+			case btrfsitem.FILE_EXTENT_INLINE:
+				textui.Fprintf(out, " inline ram_bytes=%v", ext.RAMBytes)
+			case btrfsitem.FILE_EXTENT_PREALLOC:
+				textui.Fprintf(out, " prealloc disk=%v+%v", ext.BodyExtent.DiskByteNr, ext.BodyExtent.DiskNumBytes)
+			default:
+				if ext.BodyExtent.DiskByteNr == 0 {
+					textui.Fprintf(out, " sparse")
+				} else {
+					textui.Fprintf(out, " regular disk=%v+%v offset=%v",
+						ext.BodyExtent.DiskByteNr, ext.BodyExtent.DiskNumBytes, ext.BodyExtent.Offset)
+				}
+			}
+			if ext.Compression != btrfsitem.COMPRESS_NONE {
+				textui.Fprintf(out, " compression=%v", ext.Compression)
+			}
+			if rng.MissingExtentItem {
+				missing++
+				textui.Fprintf(out, " MISSING-EXTENT-ITEM")
+			}
+		}
+		if rng.Err != nil {
+			errs++
+			textui.Fprintf(out, " error=%q", rng.Err.Error())
+		}
+		textui.Fprintf(out, "\n")
+	}
+	textui.Fprintf(out, "# holes=%v (%v) overlaps=%v missing-extent-items=%v errors=%v\n",
+		holes, textui.IEC(holeBytes, "B"), overlaps, missing, errs)
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package findroot is the guts of the `btrfs-rec inspect find-root`
+// command, which searches the node graph for nodes that may be the
+// root node of a given tree.
+package findroot
+
+import (
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// A Candidate is a node that might be the root of a tree.
+type Candidate struct {
+	btrfsutil.GraphNode
+
+	// PointedToByNodes is the number of nodes (of any tree) that
+	// have a key-pointer to this node.
+	PointedToByNodes int
+	// PointedToBySameTree is whether any of those nodes are owned
+	// by the same tree; if so, then this node is very unlikely to
+	// be a root.
+	PointedToBySameTree bool
+	// PointedToByRoots is the number of ROOT_ITEMs (or superblock
+	// root pointers) that point at this node.
+	PointedToByRoots int
+
+	NumItems int
+}
+
+// FindRoot returns all of the nodes owned by `treeID`, ranked from
+// most to least likely to be the root of the tree: nodes that are not
+// pointed to by any other node in the same tree first, then by
+// highest generation, then by highest level.
+func FindRoot(graph btrfsutil.Graph, treeID btrfsprim.ObjID) []Candidate {
+	var ret []Candidate
+	for _, node := range graph.Nodes {
+		if node.Owner != treeID {
+			continue
+		}
+		cand := Candidate{
+			GraphNode: node,
+			NumItems:  node.NumItems(graph),
+		}
+		for _, edge := range graph.EdgesTo[node.Addr] {
+			if edge.FromNode == 0 {
+				cand.PointedToByRoots++
+				continue
+			}
+			cand.PointedToByNodes++
+			if graph.Nodes[edge.FromNode].Owner == treeID {
+				cand.PointedToBySameTree = true
+			}
+		}
+		ret = append(ret, cand)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		switch {
+		case a.PointedToBySameTree != b.PointedToBySameTree:
+			return !a.PointedToBySameTree
+		case a.Generation != b.Generation:
+			return a.Generation > b.Generation
+		case a.Level != b.Level:
+			return a.Level > b.Level
+		default:
+			return a.Addr < b.Addr
+		}
+	})
+	return ret
+}
+
+// WriteCandidates writes up to `limit` candidates (all of them if
+// limit is <= 0) to `out` as a table.
+func WriteCandidates(out io.Writer, cands []Candidate, limit int) error {
+	if limit > 0 && len(cands) > limit {
+		cands = cands[:limit]
+	}
+	table := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0) //nolint:gomnd // This is what looks nice.
+	textui.Fprintf(table, "laddr\towner\tgeneration\tlevel\titems\tpointed-to-by-nodes\tpointed-to-by-roots\n")
+	for _, cand := range cands {
+		pointedTo := textui.Sprintf("%d", cand.PointedToByNodes)
+		if cand.PointedToBySameTree {
+			pointedTo += " (incl. same tree)"
+		}
+		textui.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			cand.Addr, cand.Owner, cand.Generation, cand.Level, cand.NumItems,
+			pointedTo, cand.PointedToByRoots)
+	}
+	return table.Flush()
+}
+
+// TreeRoots returns the best candidate (the first one) in the format
+// read by the --trees flag.  Only the one candidate is returned,
+// because every root listed for a tree there is added to the tree;
+// listing the runners-up too would merge them all in to one tree.
+func TreeRoots(treeID btrfsprim.ObjID, cands []Candidate) map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr] {
+	roots := make(containers.Set[btrfsvol.LogicalAddr], 1)
+	if len(cands) > 0 {
+		roots.Insert(cands[0].Addr)
+	}
+	return map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]{
+		treeID: roots,
+	}
+}
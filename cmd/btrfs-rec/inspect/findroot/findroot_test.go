@@ -0,0 +1,92 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package findroot_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/findroot"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func TestFindRoot(t *testing.T) {
+	t.Parallel()
+	const (
+		tree  = btrfsprim.FS_TREE_OBJECTID
+		other = btrfsprim.ObjID(257)
+	)
+	graph := btrfsutil.Graph{
+		Nodes:     make(map[btrfsvol.LogicalAddr]btrfsutil.GraphNode),
+		EdgesFrom: make(map[btrfsvol.LogicalAddr][]*btrfsutil.GraphEdge),
+		EdgesTo:   make(map[btrfsvol.LogicalAddr][]*btrfsutil.GraphEdge),
+	}
+	node := func(addr btrfsvol.LogicalAddr, owner btrfsprim.ObjID, gen btrfsprim.Generation, level uint8) {
+		graph.Nodes[addr] = btrfsutil.GraphNode{
+			Addr:       addr,
+			Owner:      owner,
+			Generation: gen,
+			Level:      level,
+		}
+	}
+	edge := func(from, to btrfsvol.LogicalAddr) {
+		e := &btrfsutil.GraphEdge{FromNode: from, ToNode: to}
+		if from == 0 {
+			e.FromRoot = 0x9000
+		}
+		graph.EdgesFrom[from] = append(graph.EdgesFrom[from], e)
+		graph.EdgesTo[to] = append(graph.EdgesTo[to], e)
+	}
+
+	// The current root, referenced by a ROOT_ITEM, and its 2
+	// leaves.
+	node(0x1000, tree, 10, 1)
+	node(0x2000, tree, 10, 0)
+	node(0x3000, tree, 9, 0)
+	edge(0, 0x1000)
+	edge(0x1000, 0x2000)
+	edge(0x1000, 0x3000)
+	// An older root that nothing points to any more.
+	node(0x4000, tree, 8, 0)
+	// A newer node that is only pointed to by another tree (as
+	// happens with snapshots), so it may still be a root.
+	node(0x5000, tree, 12, 0)
+	node(0x6000, other, 12, 1)
+	edge(0x6000, 0x5000)
+
+	cands := findroot.FindRoot(graph, tree)
+	var addrs []btrfsvol.LogicalAddr
+	for _, cand := range cands {
+		addrs = append(addrs, cand.Addr)
+	}
+	assert.Equal(t, []btrfsvol.LogicalAddr{0x5000, 0x1000, 0x4000, 0x2000, 0x3000}, addrs)
+
+	require.Len(t, cands, 5)
+	assert.Equal(t, 1, cands[0].PointedToByNodes)
+	assert.False(t, cands[0].PointedToBySameTree)
+	assert.Equal(t, 1, cands[1].PointedToByRoots)
+	assert.Equal(t, 0, cands[1].PointedToByNodes)
+	assert.Equal(t, 2, cands[1].NumItems)
+	assert.True(t, cands[3].PointedToBySameTree)
+
+	assert.Equal(t,
+		map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]{tree: containers.NewSet[btrfsvol.LogicalAddr](0x5000)},
+		findroot.TreeRoots(tree, cands))
+	assert.Equal(t,
+		map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]{tree: {}},
+		findroot.TreeRoots(tree, nil))
+
+	var out bytes.Buffer
+	require.NoError(t, findroot.WriteCandidates(&out, cands, 2))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Len(t, lines, 3)
+}
@@ -0,0 +1,363 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fsck
+
+import (
+	"context"
+	"errors"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/filemap"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+type reportFunc = func(Severity, string, ...any)
+
+func checkSuperblock(_ context.Context, fs btrfs.ReadableFS, _ Config, report reportFunc) error {
+	sb, err := fs.Superblock()
+	if err != nil {
+		return err
+	}
+	for _, problem := range sb.Validate(nil) {
+		if problem.Fatal {
+			report(SeverityError, "%v", problem)
+		} else {
+			report(SeverityWarning, "suspicious: %v", problem)
+		}
+	}
+	return nil
+}
+
+func checkTrees(ctx context.Context, fs btrfs.ReadableFS, _ Config, report reportFunc) error {
+	var numPhantomOwners int
+	defer func() {
+		if numPhantomOwners > 0 {
+			report(SeverityWarning, "%v of the unreadable nodes have a phantom owner (an owner that is not a tree that exists); "+
+				"their headers are probably corrupt, rather than the nodes being misplaced", numPhantomOwners)
+		}
+	}()
+	btrfsutil.WalkAllTrees(ctx, fs, btrfsutil.WalkAllTreesHandler{
+		BadTree: func(name string, _ btrfsprim.ObjID, err error) {
+			if errors.Is(err, btrfstree.ErrNoTree) {
+				return
+			}
+			report(SeverityError, "%s: %v", name, err)
+		},
+		Tree: btrfstree.TreeWalkHandler{
+			BadNode: func(path btrfstree.Path, _ *btrfstree.Node, err error) bool {
+				err = btrfstree.DiagnosePhantomOwner(ctx, fs, err)
+				if errors.Is(err, btrfstree.ErrPhantomOwner) {
+					numPhantomOwners++
+					report(SeverityError, "%v: phantom owner: %v", path, err)
+					return false
+				}
+				report(SeverityError, "%v: %v", path, err)
+				return false
+			},
+			BadItem: func(path btrfstree.Path, item btrfstree.Item) {
+				if body, ok := item.Body.(*btrfsitem.Error); ok {
+					report(SeverityError, "%v: item %v: %v", path, item.Key, body.Err)
+				} else {
+					report(SeverityError, "%v: item %v: malformed", path, item.Key)
+				}
+			},
+		},
+	})
+	return ctx.Err()
+}
+
+func checkGenerations(ctx context.Context, fs btrfs.ReadableFS, _ Config, report reportFunc) error {
+	btrfsutil.CheckGenerations(ctx, fs, func(inv btrfsutil.GenerationInversion) {
+		report(SeverityError, "%v", inv)
+	})
+	return ctx.Err()
+}
+
+// subvolumes returns the IDs of all of the subvolume trees that have a
+// ROOT_ITEM in the ROOT_TREE, along with their ROOT_ITEMs.
+func subvolumes(ctx context.Context, fs btrfs.ReadableFS) (map[btrfsprim.ObjID]btrfsitem.Root, error) {
+	rootTree, err := fs.ForrestLookup(ctx, btrfsprim.ROOT_TREE_OBJECTID)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[btrfsprim.ObjID]btrfsitem.Root)
+	err = rootTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		if item.Key.ItemType != btrfsitem.ROOT_ITEM_KEY {
+			return true
+		}
+		id := item.Key.ObjectID
+		if id != btrfsprim.FS_TREE_OBJECTID && (id < btrfsprim.FIRST_FREE_OBJECTID || id > btrfsprim.LAST_FREE_OBJECTID) {
+			return true
+		}
+		if body, ok := item.Body.(*btrfsitem.Root); ok {
+			ret[id] = *body
+		}
+		return true
+	})
+	return ret, err
+}
+
+func checkUUIDTree(ctx context.Context, fs btrfs.ReadableFS, _ Config, report reportFunc) error {
+	subvols, err := subvolumes(ctx, fs)
+	if err != nil {
+		return err
+	}
+	uuidTree, err := fs.ForrestLookup(ctx, btrfsprim.UUID_TREE_OBJECTID)
+	if err != nil {
+		if errors.Is(err, btrfstree.ErrNoTree) {
+			report(SeverityWarning, "there is no UUID_TREE; snapshot parents cannot be resolved")
+			return nil
+		}
+		return err
+	}
+	for _, id := range maps.SortedKeys(subvols) {
+		uuid := subvols[id].UUID
+		if uuid == (btrfsprim.UUID{}) {
+			continue
+		}
+		item, err := uuidTree.TreeLookup(ctx, btrfsitem.UUIDToKey(uuid))
+		if err != nil {
+			if errors.Is(err, btrfstree.ErrNoItem) {
+				report(SeverityWarning, "subvolume %v: uuid=%v is not in the UUID_TREE", id, uuid)
+			} else {
+				report(SeverityError, "subvolume %v: uuid=%v: %v", id, uuid, err)
+			}
+			continue
+		}
+		switch body := item.Body.(type) {
+		case *btrfsitem.UUIDMap:
+			if body.ObjID != id {
+				report(SeverityError, "subvolume %v: uuid=%v maps to subvolume %v in the UUID_TREE", id, uuid, body.ObjID)
+			}
+		case *btrfsitem.Error:
+			report(SeverityError, "subvolume %v: uuid=%v: %v", id, uuid, body.Err)
+		}
+	}
+	return nil
+}
+
+func checkFreeSpace(ctx context.Context, fs btrfs.ReadableFS, _ Config, report reportFunc) error {
+	sb, err := fs.Superblock()
+	if err != nil {
+		return err
+	}
+	if !sb.CompatROFlags.Has(btrfstree.FeatureCompatROFreeSpaceTree) {
+		dlog.Infof(ctx, "fsck: free-space: filesystem does not use a FREE_SPACE_TREE; not checking the v1 space cache")
+		return nil
+	}
+	if !sb.CompatROFlags.Has(btrfstree.FeatureCompatROFreeSpaceTreeValid) {
+		report(SeverityWarning, "the FREE_SPACE_TREE is not marked as valid")
+	}
+	bgTree, err := fs.ForrestLookup(ctx, sb.BlockGroupTree())
+	if err != nil {
+		return err
+	}
+	fsTree, err := fs.ForrestLookup(ctx, btrfsprim.FREE_SPACE_TREE_OBJECTID)
+	if err != nil {
+		return err
+	}
+	return bgTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		if item.Key.ItemType != btrfsitem.BLOCK_GROUP_ITEM_KEY {
+			return true
+		}
+		_, err := fsTree.TreeLookup(ctx, btrfsprim.Key{
+			ObjectID: item.Key.ObjectID,
+			ItemType: btrfsitem.FREE_SPACE_INFO_KEY,
+			Offset:   item.Key.Offset,
+		})
+		switch {
+		case errors.Is(err, btrfstree.ErrNoItem):
+			report(SeverityWarning, "block group %v+%v has no FREE_SPACE_INFO",
+				btrfsvol.LogicalAddr(item.Key.ObjectID), btrfsvol.AddrDelta(item.Key.Offset))
+		case err != nil:
+			report(SeverityError, "block group %v+%v: %v",
+				btrfsvol.LogicalAddr(item.Key.ObjectID), btrfsvol.AddrDelta(item.Key.Offset), err)
+		}
+		return ctx.Err() == nil
+	})
+}
+
+func checkInodes(ctx context.Context, fs btrfs.ReadableFS, _ Config, report reportFunc) error {
+	sb, err := fs.Superblock()
+	if err != nil {
+		return err
+	}
+	subvols, err := subvolumes(ctx, fs)
+	if err != nil {
+		return err
+	}
+	for _, treeID := range maps.SortedKeys(subvols) {
+		if err := checkSubvolInodes(ctx, fs, sb.SectorSize, treeID, report); err != nil {
+			report(SeverityError, "subvolume %v: %v", treeID, err)
+		}
+	}
+	return ctx.Err()
+}
+
+func checkSubvolInodes(ctx context.Context, fs btrfs.ReadableFS, sectorSize uint32, treeID btrfsprim.ObjID, report reportFunc) error {
+	tree, err := fs.ForrestLookup(ctx, treeID)
+	if err != nil {
+		return err
+	}
+
+	// Items are sorted by inode number and then item type, so
+	// each inode's INODE_ITEM is seen before its EXTENT_DATA
+	// items, and all of an inode's items are seen together.
+	var cur *btrfs.File
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		file := cur
+		cur = nil
+		if file.InodeItem == nil {
+			if len(file.Extents) > 0 {
+				report(SeverityError, "subvolume %v inode %v: has EXTENT_DATA items but no INODE_ITEM", treeID, file.Inode)
+			}
+			return
+		}
+		if !file.InodeItem.Mode.IsRegular() {
+			return
+		}
+		ranges := filemap.Map(ctx, fs, file)
+		for _, rng := range ranges {
+			switch {
+			case rng.Err != nil:
+				report(SeverityError, "subvolume %v inode %v: extent@%v: %v", treeID, file.Inode, rng.Beg, rng.Err)
+			case rng.Kind == filemap.RangeOverlap:
+				report(SeverityError, "subvolume %v inode %v: extents overlap at [%v, %v)", treeID, file.Inode, rng.Beg, rng.End)
+			case rng.MissingExtentItem:
+				report(SeverityError, "subvolume %v inode %v: extent@%v: disk extent %v+%v has no EXTENT_ITEM",
+					treeID, file.Inode, rng.Beg, rng.Extent.BodyExtent.DiskByteNr, rng.Extent.BodyExtent.DiskNumBytes)
+			}
+		}
+		check := filemap.Check(ranges, *file.InodeItem, sectorSize)
+		switch check.Verdict {
+		case filemap.VerdictTruncated:
+			for _, problem := range check.Problems {
+				report(SeverityError, "subvolume %v inode %v: truncated: %s", treeID, file.Inode, problem)
+			}
+		case filemap.VerdictOverClaimed:
+			for _, problem := range check.Problems {
+				report(SeverityWarning, "subvolume %v inode %v: over-claimed: %s", treeID, file.Inode, problem)
+			}
+		}
+	}
+	err = tree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		if cur != nil && item.Key.ObjectID != cur.Inode {
+			flush()
+		}
+		switch item.Key.ItemType {
+		case btrfsitem.INODE_ITEM_KEY:
+			if body, ok := item.Body.(*btrfsitem.Inode); ok {
+				if cur == nil {
+					cur = &btrfs.File{}
+					cur.Inode = item.Key.ObjectID
+				}
+				inode := *body
+				cur.InodeItem = &inode
+			}
+		case btrfsitem.EXTENT_DATA_KEY:
+			if body, ok := item.Body.(*btrfsitem.FileExtent); ok {
+				if cur == nil {
+					cur = &btrfs.File{}
+					cur.Inode = item.Key.ObjectID
+				}
+				cur.Extents = append(cur.Extents, btrfs.FileExtent{
+					OffsetWithinFile: int64(item.Key.Offset),
+					FileExtent:       *body,
+				})
+			}
+		}
+		return ctx.Err() == nil
+	})
+	flush()
+	return err
+}
+
+func checkCSums(ctx context.Context, fs btrfs.ReadableFS, cfg Config, report reportFunc) error {
+	sb, err := fs.Superblock()
+	if err != nil {
+		return err
+	}
+	csumTreeID := cfg.ChecksumTree
+	if csumTreeID == 0 {
+		csumTreeID = btrfsprim.CSUM_TREE_OBJECTID
+	}
+	csumTree, err := fs.ForrestLookup(ctx, csumTreeID)
+	if err != nil {
+		return err
+	}
+
+	// Coalesce runs of consecutive bad blocks in to a single
+	// finding, as a damaged region is likely to be many blocks.
+	var badBeg, badEnd btrfsvol.LogicalAddr
+	var badErr error
+	flushBad := func() {
+		if badErr != nil {
+			report(SeverityError, "data blocks [%v, %v): %v", badBeg, badEnd, badErr)
+		}
+		badErr = nil
+	}
+	markBad := func(addr btrfsvol.LogicalAddr, err error) {
+		if badErr != nil && addr == badEnd && err.Error() == badErr.Error() {
+			badEnd = addr + btrfssum.BlockSize
+			return
+		}
+		flushBad()
+		badBeg, badEnd, badErr = addr, addr+btrfssum.BlockSize, err
+	}
+
+	// Overlapping EXTENT_CSUM items would have us check a block
+	// more than once.  Rather than remembering every block that
+	// has been checked, rely on the items being visited in key
+	// order (that is, by starting address), and only remember
+	// the contiguous range [checkedBeg, checkedEnd) of the most
+	// recently checked blocks; any already-checked block that an
+	// in-order item covers falls in that range.  (If the tree is
+	// out of order, the worst case is that a block gets checked
+	// twice.)
+	var checkedBeg, checkedEnd btrfsvol.LogicalAddr
+	var block [btrfssum.BlockSize]byte
+	err = csumTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		body, ok := item.Body.(*btrfsitem.ExtentCSum)
+		if !ok {
+			return true
+		}
+		_ = body.Walk(ctx, func(addr btrfsvol.LogicalAddr, expSum btrfssum.ShortSum) error {
+			if checkedBeg <= addr && addr < checkedEnd {
+				return nil
+			}
+			if addr != checkedEnd {
+				checkedBeg = addr
+			}
+			checkedEnd = addr + btrfssum.BlockSize
+			if _, err := fs.ReadAt(block[:], addr); err != nil {
+				markBad(addr, err)
+				return nil
+			}
+			actSum, err := sb.ChecksumType.Sum(block[:])
+			if err != nil {
+				markBad(addr, err)
+				return nil
+			}
+			if actSum != expSum.ToFullSum() {
+				markBad(addr, errors.New("checksum mismatch"))
+			}
+			return nil
+		})
+		return ctx.Err() == nil
+	})
+	flushBad()
+	return err
+}
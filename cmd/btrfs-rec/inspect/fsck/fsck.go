@@ -0,0 +1,199 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package fsck is the guts of the `btrfs-rec inspect fsck` command,
+// which runs all of the read-only consistency checks against a
+// filesystem and produces a single report.
+package fsck
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+type Severity int
+
+const (
+	SeverityNone Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityNone:
+		return "ok"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// A Finding is a single problem found by a check.
+type Finding struct {
+	Check    string
+	Severity Severity
+	Msg      string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%v: [%s] %s", f.Severity, f.Check, f.Msg)
+}
+
+// Config configures Run.
+type Config struct {
+	// Skip is the names of the Checks not to run.
+	Skip containers.Set[string]
+	// ChecksumTree is the ID of the tree that data checksums are
+	// looked up in (see btrfs.SubvolumeConfig.ChecksumTree); if
+	// zero, it is CSUM_TREE_OBJECTID.
+	ChecksumTree btrfsprim.ObjID
+}
+
+// A Check is a single read-only consistency check.
+type Check struct {
+	Name        string
+	Description string
+	Run         func(ctx context.Context, fs btrfs.ReadableFS, cfg Config, report func(Severity, string, ...any)) error
+}
+
+// Checks is the list of checks that Run runs, in the order that they
+// are run.
+var Checks = []Check{
+	{
+		Name:        "superblock",
+		Description: "validate the superblock's fields against each other",
+		Run:         checkSuperblock,
+	},
+	{
+		Name:        "trees",
+		Description: "walk every tree, reporting unreadable trees, nodes, and items",
+		Run:         checkTrees,
+	},
+	{
+		Name:        "generations",
+		Description: "check that no key-pointer points at a node newer than the node containing it",
+		Run:         checkGenerations,
+	},
+	{
+		Name:        "uuid-tree",
+		Description: "check that every subvolume's UUID is in the UUID_TREE",
+		Run:         checkUUIDTree,
+	},
+	{
+		Name:        "free-space",
+		Description: "check that every block group has a FREE_SPACE_INFO in the FREE_SPACE_TREE",
+		Run:         checkFreeSpace,
+	},
+	{
+		Name:        "inodes",
+		Description: "check every regular file's size and nbytes against its extents, and that its extents have EXTENT_ITEMs",
+		Run:         checkInodes,
+	},
+	{
+		Name:        "csums",
+		Description: "read every checksummed data block and verify it (slow)",
+		Run:         checkCSums,
+	},
+}
+
+// CheckNames returns the names of all of the Checks.
+func CheckNames() []string {
+	ret := make([]string, 0, len(Checks))
+	for _, check := range Checks {
+		ret = append(ret, check.Name)
+	}
+	return ret
+}
+
+// Run runs each of the Checks (except for those named in cfg.Skip)
+// against `fs`, writing each finding to `out` as soon as it is found,
+// followed by a summary that lists errors before warnings.  It
+// returns the worst severity found.
+//
+// An error returned by a check itself (rather than a finding) is
+// reported as an error-severity finding, and does not stop the other
+// checks from running.
+func Run(ctx context.Context, out io.Writer, fs btrfs.ReadableFS, cfg Config) Severity {
+	type counts struct {
+		errors, warnings int
+	}
+	perCheck := make(map[string]*counts)
+	var skipped []string
+	worst := SeverityNone
+
+	for _, check := range Checks {
+		if cfg.Skip.Has(check.Name) {
+			skipped = append(skipped, check.Name)
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		cnt := new(counts)
+		perCheck[check.Name] = cnt
+		report := func(sev Severity, format string, args ...any) {
+			switch sev {
+			case SeverityError:
+				cnt.errors++
+			case SeverityWarning:
+				cnt.warnings++
+			}
+			if sev > worst {
+				worst = sev
+			}
+			textui.Fprintf(out, "%v\n", Finding{
+				Check:    check.Name,
+				Severity: sev,
+				Msg:      fmt.Sprintf(format, args...),
+			})
+		}
+		dlog.Infof(ctx, "fsck: running check %q...", check.Name)
+		if err := check.Run(ctx, fs, cfg, report); err != nil {
+			report(SeverityError, "check failed: %v", err)
+		}
+	}
+
+	summarize := func(name string, get func(*counts) int) {
+		var total int
+		var parts []string
+		names := make([]string, 0, len(perCheck))
+		for check := range perCheck {
+			names = append(names, check)
+		}
+		sort.Strings(names)
+		for _, check := range names {
+			if n := get(perCheck[check]); n > 0 {
+				total += n
+				parts = append(parts, fmt.Sprintf("%s: %v", check, n))
+			}
+		}
+		if len(parts) > 0 {
+			textui.Fprintf(out, "  %s: %v (%s)\n", name, total, strings.Join(parts, ", "))
+		} else {
+			textui.Fprintf(out, "  %s: 0\n", name)
+		}
+	}
+	textui.Fprintf(out, "summary:\n")
+	summarize("errors", func(c *counts) int { return c.errors })
+	summarize("warnings", func(c *counts) int { return c.warnings })
+	if len(skipped) > 0 {
+		textui.Fprintf(out, "  skipped: %s\n", strings.Join(skipped, ", "))
+	}
+	textui.Fprintf(out, "result: %v\n", worst)
+	return worst
+}
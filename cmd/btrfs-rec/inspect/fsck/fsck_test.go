@@ -0,0 +1,162 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package fsck
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+//nolint:paralleltest // Can't be parallel because Checks is global.
+func TestRun(t *testing.T) {
+	origChecks := Checks
+	t.Cleanup(func() { Checks = origChecks })
+	Checks = []Check{
+		{Name: "a", Run: func(_ context.Context, _ btrfs.ReadableFS, _ Config, report func(Severity, string, ...any)) error {
+			report(SeverityWarning, "w%d", 1)
+			return nil
+		}},
+		{Name: "b", Run: func(_ context.Context, _ btrfs.ReadableFS, _ Config, report func(Severity, string, ...any)) error {
+			report(SeverityWarning, "w%d", 2)
+			return errors.New("oops")
+		}},
+		{Name: "c", Run: func(_ context.Context, _ btrfs.ReadableFS, _ Config, report func(Severity, string, ...any)) error {
+			report(SeverityError, "should be skipped")
+			return nil
+		}},
+	}
+	ctx := dlog.NewTestContext(t, false)
+
+	var out strings.Builder
+	assert.Equal(t, SeverityError, Run(ctx, &out, nil, Config{Skip: containers.NewSet("c")}))
+	assert.Equal(t, ""+
+		"warning: [a] w1\n"+
+		"warning: [b] w2\n"+
+		"error: [b] check failed: oops\n"+
+		"summary:\n"+
+		"  errors: 1 (b: 1)\n"+
+		"  warnings: 2 (a: 1, b: 1)\n"+
+		"  skipped: c\n"+
+		"result: error\n",
+		out.String())
+
+	out.Reset()
+	assert.Equal(t, SeverityWarning, Run(ctx, &out, nil, Config{Skip: containers.NewSet("b", "c")}))
+	out.Reset()
+	assert.Equal(t, SeverityNone, Run(ctx, &out, nil, Config{Skip: containers.NewSet("a", "b", "c")}))
+}
+
+// csumFS is a ReadableFS with just a checksum tree and data.
+type csumFS struct {
+	btrfs.ReadableFS
+	items []btrfstree.Item
+	data  map[btrfsvol.LogicalAddr][]byte
+	reads map[btrfsvol.LogicalAddr]int
+}
+
+func (*csumFS) Superblock() (*btrfstree.Superblock, error) {
+	return &btrfstree.Superblock{ChecksumType: btrfssum.TYPE_CRC32}, nil
+}
+
+func (fs *csumFS) ForrestLookup(context.Context, btrfsprim.ObjID) (btrfstree.Tree, error) {
+	return csumTree{items: fs.items}, nil
+}
+
+func (fs *csumFS) ReadAt(p []byte, addr btrfsvol.LogicalAddr) (int, error) {
+	fs.reads[addr]++
+	dat, ok := fs.data[addr]
+	if !ok {
+		return 0, errors.New("unmapped")
+	}
+	return copy(p, dat), nil
+}
+
+type csumTree struct {
+	btrfstree.Tree
+	items []btrfstree.Item
+}
+
+func (t csumTree) TreeRange(_ context.Context, fn func(btrfstree.Item) bool) error {
+	for _, item := range t.items {
+		if !fn(item) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestCheckCSums(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	const blk = btrfssum.BlockSize
+	fs := &csumFS{
+		data:  make(map[btrfsvol.LogicalAddr][]byte),
+		reads: make(map[btrfsvol.LogicalAddr]int),
+	}
+	sumOf := func(addr btrfsvol.LogicalAddr) btrfssum.ShortSum {
+		dat := bytes.Repeat([]byte{byte(addr / blk)}, blk)
+		fs.data[addr] = dat
+		sum, err := btrfssum.TYPE_CRC32.Sum(dat)
+		require.NoError(t, err)
+		return btrfssum.ShortSum(sum[:btrfssum.TYPE_CRC32.Size()])
+	}
+	item := func(beg btrfsvol.LogicalAddr, n int) btrfstree.Item {
+		run := btrfssum.SumRun[btrfsvol.LogicalAddr]{
+			ChecksumSize: btrfssum.TYPE_CRC32.Size(),
+			Addr:         beg,
+		}
+		for i := 0; i < n; i++ {
+			run.Sums += sumOf(beg + btrfsvol.LogicalAddr(i)*blk)
+		}
+		return btrfstree.Item{
+			Key: btrfsprim.Key{
+				ObjectID: btrfsprim.EXTENT_CSUM_OBJECTID,
+				ItemType: btrfsitem.EXTENT_CSUM_KEY,
+				Offset:   uint64(beg),
+			},
+			Body: &btrfsitem.ExtentCSum{SumRun: run},
+		}
+	}
+	fs.items = []btrfstree.Item{
+		item(0*blk, 4),
+		item(2*blk, 4), // overlaps the previous item
+		item(3*blk, 1), // contained in the previous item
+		item(10*blk, 2),
+	}
+	// Corrupt block 4 and unmap block 5.
+	fs.data[4*blk] = bytes.Repeat([]byte{0xff}, blk)
+	delete(fs.data, 5*blk)
+
+	var reports []string
+	err := checkCSums(ctx, fs, Config{}, func(sev Severity, format string, args ...any) {
+		reports = append(reports, fmt.Sprintf("%v: "+format, append([]any{sev}, args...)...))
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"error: data blocks [0x0000000000004000, 0x0000000000005000): checksum mismatch",
+		"error: data blocks [0x0000000000005000, 0x0000000000006000): unmapped",
+	}, reports)
+	for _, addr := range []btrfsvol.LogicalAddr{0, blk, 2 * blk, 3 * blk, 4 * blk, 5 * blk, 10 * blk, 11 * blk} {
+		assert.Equal(t, 1, fs.reads[addr], "addr=%v", addr)
+	}
+	assert.Len(t, fs.reads, 8)
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package genhistogram is the guts of the `btrfs-rec inspect
+// gen-histogram` command, which displays the distribution of node
+// generations within a tree.
+package genhistogram
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// GenHistogram walks the tree `treeID`, and returns the histogram of
+// the generations of its nodes.  Bad nodes are logged, and skipped.
+func GenHistogram(ctx context.Context, fs btrfs.ReadableFS, treeID btrfsprim.ObjID) (btrfsutil.GenHistogram, error) {
+	var hist btrfsutil.GenHistogram
+	tree, err := fs.ForrestLookup(ctx, treeID)
+	if err != nil {
+		return hist, err
+	}
+	tree.TreeWalk(ctx, hist.Handler(btrfstree.TreeWalkHandler{
+		BadNode: func(path btrfstree.Path, _ *btrfstree.Node, err error) bool {
+			dlog.Errorf(ctx, "%v: %v", path, err)
+			return false
+		},
+	}))
+	return hist, nil
+}
+
+var sparkRunes = []rune("▁▂▃▄▅▆▇█")
+
+// Sparkline renders the buckets as a single line of block characters,
+// one per bucket, scaled so that the fullest bucket is a full block.
+// Empty buckets are rendered as a space, so that gaps stand out.
+func Sparkline(buckets []btrfsutil.GenBucket) string {
+	maxNodes := 0
+	for _, bucket := range buckets {
+		if bucket.Nodes > maxNodes {
+			maxNodes = bucket.Nodes
+		}
+	}
+	var ret strings.Builder
+	for _, bucket := range buckets {
+		if bucket.Nodes == 0 {
+			ret.WriteRune(' ')
+			continue
+		}
+		ret.WriteRune(sparkRunes[(bucket.Nodes*len(sparkRunes)-1)/maxNodes])
+	}
+	return ret.String()
+}
+
+// WriteText writes a human-readable rendering of the histogram to
+// `out`: a sparkline, one line per bucket, and a warning if the tree
+// mixes very old and very new nodes.
+func WriteText(out io.Writer, treeID btrfsprim.ObjID, hist btrfsutil.GenHistogram, numBuckets int) {
+	lo, hi := hist.Range()
+	textui.Fprintf(out, "tree %v: %v nodes, generations %v-%v\n",
+		treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), hist.Total(), lo, hi)
+	buckets := hist.Buckets(numBuckets)
+	if len(buckets) == 0 {
+		return
+	}
+	textui.Fprintf(out, "[%s]\n", Sparkline(buckets))
+	for _, bucket := range buckets {
+		textui.Fprintf(out, "  gen %v-%v: %v\n", bucket.MinGen, bucket.MaxGen, bucket.Nodes)
+	}
+	if hist.IsMixed() {
+		below, above := hist.LargestGap()
+		textui.Fprintf(out, "WARNING: tree mixes very old and very new nodes: no nodes between generation %v and %v; this may be a sign of partial CoW corruption\n",
+			below, above)
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package listsnapshots is the guts of the `btrfs-rec inspect
+// list-snapshots` command, which maps out which subvolumes are
+// snapshots of which others.
+package listsnapshots
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// A Subvolume is a subvolume tree, along with the snapshots of it.
+type Subvolume struct {
+	ID         btrfsprim.ObjID
+	UUID       btrfsprim.UUID
+	ParentUUID btrfsprim.UUID `json:",omitempty"`
+
+	// ParentID is the subvolume that this is a snapshot of, or 0
+	// if this is not a snapshot or if the parent could not be
+	// recovered.  ParentVia is how ParentID was found.
+	ParentID  btrfsprim.ObjID `json:",omitempty"`
+	ParentVia string          `json:",omitempty"`
+
+	// Generation is the generation of the subvolume's root node;
+	// CreatedGeneration is the generation that the subvolume was
+	// created (or snapshotted) in.
+	Generation        btrfsprim.Generation
+	CreatedGeneration btrfsprim.Generation
+
+	// Orphan is why the parent of a snapshot could not be
+	// recovered; an orphaned snapshot is listed as a root of its
+	// own, rather than under its parent.
+	Orphan string `json:",omitempty"`
+
+	// Err is set if the ROOT_ITEM could not be decoded, in which
+	// case it is not known whether the subvolume is a snapshot.
+	Err string `json:",omitempty"`
+
+	// ApproxShared is an estimate of how much data the snapshot
+	// still shares with its parent; it is nil if the subvolume
+	// has no parent, or if the estimate was not requested or
+	// could not be made.
+	ApproxShared *SharedEstimate `json:",omitempty"`
+
+	Children []*Subvolume `json:",omitempty"`
+}
+
+// A SharedEstimate is an estimate of how much of a snapshot's data
+// is still shared with its parent.  It is approximate: it counts the
+// on-disk size of each data extent that both subvolumes refer to
+// (the extents that have shared backrefs), and so does not account
+// for partial references to an extent, for compression, or for
+// inline file data.
+type SharedEstimate struct {
+	SharedBytes int64
+	TotalBytes  int64
+}
+
+// Percent returns the shared portion of the snapshot's data, as a
+// percentage.
+func (e SharedEstimate) Percent() int64 {
+	if e.TotalBytes == 0 {
+		return 0
+	}
+	return e.SharedBytes * 100 / e.TotalBytes //nolint:gomnd // percent
+}
+
+func (e SharedEstimate) String() string {
+	return textui.Sprintf("~%d%% (approximately %v of %v)",
+		e.Percent(), textui.IEC(e.SharedBytes, "B"), textui.IEC(e.TotalBytes, "B"))
+}
+
+func isSubvol(treeID btrfsprim.ObjID) bool {
+	return treeID == btrfsprim.FS_TREE_OBJECTID ||
+		(treeID >= btrfsprim.FIRST_FREE_OBJECTID && treeID <= btrfsprim.LAST_FREE_OBJECTID)
+}
+
+// ListSnapshots reads every subvolume's ROOT_ITEM, and returns the
+// subvolumes arranged by which is a snapshot of which.  If
+// estimateShared is true, then each snapshot's data extents are
+// compared with its parent's to fill in .ApproxShared; this reads
+// every subvolume, and so is much slower than just the listing.
+func ListSnapshots(ctx context.Context, fs btrfs.ReadableFS, estimateShared bool) ([]*Subvolume, error) {
+	rootTree, err := fs.ForrestLookup(ctx, btrfsprim.ROOT_TREE_OBJECTID)
+	if err != nil {
+		return nil, fmt.Errorf("listing subvolumes: %w", err)
+	}
+	var subvols []*Subvolume
+	seen := make(containers.Set[btrfsprim.ObjID])
+	if err := rootTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		if item.Key.ItemType != btrfsitem.ROOT_ITEM_KEY || !isSubvol(item.Key.ObjectID) || seen.Has(item.Key.ObjectID) {
+			return true
+		}
+		seen.Insert(item.Key.ObjectID)
+		subvol := &Subvolume{
+			ID:                item.Key.ObjectID,
+			CreatedGeneration: btrfsprim.Generation(item.Key.Offset),
+		}
+		switch body := item.Body.(type) {
+		case *btrfsitem.Root:
+			subvol.UUID = body.UUID
+			subvol.ParentUUID = body.ParentUUID
+			subvol.Generation = body.Generation
+			if body.OTransID != 0 {
+				subvol.CreatedGeneration = btrfsprim.Generation(body.OTransID)
+			}
+		case *btrfsitem.Error:
+			subvol.Err = fmt.Sprintf("ROOT_ITEM: %v", body.Err)
+		}
+		subvols = append(subvols, subvol)
+		return true
+	}); err != nil {
+		// Keep going with the subvolumes that we did find.
+		dlog.Errorf(ctx, "iterating over root tree: %v", err)
+	}
+
+	roots := buildLineage(subvols, func(childID btrfsprim.ObjID, parentUUID btrfsprim.UUID) (btrfsprim.ObjID, string, bool) {
+		return lookupParent(ctx, fs, childID, parentUUID)
+	})
+
+	if estimateShared {
+		for _, root := range roots {
+			estimateSharedTree(ctx, fs, root, nil)
+		}
+	}
+
+	return roots, nil
+}
+
+// lookupParent is the fallback for when a snapshot's ParentUUID does
+// not match the UUID in any ROOT_ITEM (perhaps because the parent's
+// ROOT_ITEM is damaged).  With a RebuiltForrest, it uses the
+// forrest's own idea of the tree's parent (which is also what the
+// forrest uses to decide which nodes the trees share); otherwise it
+// looks the UUID up in the UUID_TREE.
+func lookupParent(ctx context.Context, fs btrfs.ReadableFS, childID btrfsprim.ObjID, parentUUID btrfsprim.UUID) (btrfsprim.ObjID, string, bool) {
+	if rfs, ok := fs.(*btrfsutil.RebuiltForrest); ok {
+		tree, err := rfs.RebuiltTree(ctx, childID)
+		if err != nil || tree.Parent == nil {
+			return 0, "", false
+		}
+		if _, ok := tree.RebuiltCOWDistance(tree.Parent.ID); !ok {
+			// The forrest broke an ancestor loop here.
+			return 0, "", false
+		}
+		return tree.Parent.ID, "rebuilt forrest", true
+	}
+	uuidTree, err := fs.ForrestLookup(ctx, btrfsprim.UUID_TREE_OBJECTID)
+	if err != nil {
+		return 0, "", false
+	}
+	item, err := uuidTree.TreeLookup(ctx, btrfsitem.UUIDToKey(parentUUID))
+	if err != nil {
+		return 0, "", false
+	}
+	defer item.Body.Free()
+	body, ok := item.Body.(*btrfsitem.UUIDMap)
+	if !ok {
+		return 0, "", false
+	}
+	return body.ObjID, "UUID_TREE", true
+}
+
+// buildLineage arranges the subvolumes so that each snapshot is
+// listed in its parent's .Children, and returns the subvolumes that
+// have no parent: non-snapshots and orphaned snapshots (which have
+// .Orphan set).  Parents are found by matching the snapshot's
+// ParentUUID against the other subvolumes' UUIDs, and failing that
+// with the `lookup` fallback.  Lineage cycles are broken, and
+// annotated as orphans.
+func buildLineage(subvols []*Subvolume, lookup func(childID btrfsprim.ObjID, parentUUID btrfsprim.UUID) (btrfsprim.ObjID, string, bool)) []*Subvolume {
+	byID := make(map[btrfsprim.ObjID]*Subvolume, len(subvols))
+	byUUID := make(map[btrfsprim.UUID]btrfsprim.ObjID, len(subvols))
+	for _, subvol := range subvols {
+		byID[subvol.ID] = subvol
+		if subvol.UUID != (btrfsprim.UUID{}) {
+			byUUID[subvol.UUID] = subvol.ID
+		}
+	}
+
+	var roots []*Subvolume
+	children := make(map[btrfsprim.ObjID][]btrfsprim.ObjID)
+	for _, subvol := range subvols {
+		if subvol.ParentUUID == (btrfsprim.UUID{}) {
+			roots = append(roots, subvol)
+			continue
+		}
+		parentID, ok := byUUID[subvol.ParentUUID]
+		via := "parent UUID"
+		if !ok && lookup != nil {
+			parentID, via, ok = lookup(subvol.ID, subvol.ParentUUID)
+		}
+		switch {
+		case !ok:
+			subvol.Orphan = fmt.Sprintf("parent UUID %v does not match any subvolume", subvol.ParentUUID)
+		case parentID == subvol.ID:
+			subvol.Orphan = fmt.Sprintf("parent UUID %v is the subvolume's own UUID", subvol.ParentUUID)
+		case !maps.HasKey(byID, parentID):
+			subvol.Orphan = fmt.Sprintf("parent UUID %v is subvolume %v (via %s), which has no ROOT_ITEM",
+				subvol.ParentUUID, parentID, via)
+		default:
+			subvol.ParentID = parentID
+			subvol.ParentVia = via
+			children[parentID] = append(children[parentID], subvol.ID)
+			continue
+		}
+		roots = append(roots, subvol)
+	}
+
+	// Anything that is part of a cycle is not reachable from
+	// roots; break each cycle at its lowest-numbered member.
+	reachable := make(containers.Set[btrfsprim.ObjID])
+	var mark func(btrfsprim.ObjID)
+	mark = func(treeID btrfsprim.ObjID) {
+		if reachable.Has(treeID) {
+			return
+		}
+		reachable.Insert(treeID)
+		for _, child := range children[treeID] {
+			mark(child)
+		}
+	}
+	for _, root := range roots {
+		mark(root.ID)
+	}
+	for _, treeID := range maps.SortedKeys(byID) {
+		subvol := byID[treeID]
+		if reachable.Has(treeID) || subvol.ParentID == 0 {
+			continue
+		}
+		subvol.Orphan = fmt.Sprintf("lineage cycle through parent %v", subvol.ParentID)
+		subvol.ParentID = 0
+		subvol.ParentVia = ""
+		roots = append(roots, subvol)
+		mark(treeID)
+	}
+
+	for _, subvol := range subvols {
+		if subvol.ParentID != 0 {
+			parent := byID[subvol.ParentID]
+			parent.Children = append(parent.Children, subvol)
+		}
+	}
+	return roots
+}
+
+// dataExtents returns the on-disk size of each data extent that a
+// subvolume refers to, keyed by address.
+func dataExtents(ctx context.Context, fs btrfs.ReadableFS, treeID btrfsprim.ObjID) (map[btrfsvol.LogicalAddr]btrfsvol.AddrDelta, error) {
+	tree, err := fs.ForrestLookup(ctx, treeID)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[btrfsvol.LogicalAddr]btrfsvol.AddrDelta)
+	err = tree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		if item.Key.ItemType != btrfsitem.EXTENT_DATA_KEY {
+			return true
+		}
+		body, ok := item.Body.(*btrfsitem.FileExtent)
+		if !ok || body.Type == btrfsitem.FILE_EXTENT_INLINE || body.BodyExtent.DiskByteNr == 0 {
+			return true
+		}
+		ret[body.BodyExtent.DiskByteNr] = body.BodyExtent.DiskNumBytes
+		return true
+	})
+	return ret, err
+}
+
+func estimateShared(child, parent map[btrfsvol.LogicalAddr]btrfsvol.AddrDelta) SharedEstimate {
+	var ret SharedEstimate
+	for addr, size := range child {
+		ret.TotalBytes += int64(size)
+		if _, ok := parent[addr]; ok {
+			ret.SharedBytes += int64(size)
+		}
+	}
+	return ret
+}
+
+// estimateSharedTree fills in .ApproxShared for each snapshot under
+// (and including) subvol.  Only the extents of the current lineage
+// are held in memory at once.
+func estimateSharedTree(ctx context.Context, fs btrfs.ReadableFS, subvol *Subvolume, parentExtents map[btrfsvol.LogicalAddr]btrfsvol.AddrDelta) {
+	if parentExtents == nil && len(subvol.Children) == 0 {
+		return
+	}
+	ctx = dlog.WithField(ctx, "btrfs.inspect.list-snapshots.subvol", subvol.ID)
+	extents, err := dataExtents(ctx, fs, subvol.ID)
+	if err != nil {
+		dlog.Errorf(ctx, "not estimating shared data: %v", err)
+		extents = nil
+	} else if parentExtents != nil {
+		est := estimateShared(extents, parentExtents)
+		subvol.ApproxShared = &est
+	}
+	for _, child := range subvol.Children {
+		if extents == nil {
+			// Still estimate the grandchildren.
+			estimateSharedTree(ctx, fs, child, nil)
+			continue
+		}
+		estimateSharedTree(ctx, fs, child, extents)
+	}
+}
+
+const (
+	tS = "    "
+	tl = "│   "
+	tT = "├── "
+	tL = "└── "
+)
+
+// WriteText writes the subvolumes as a tree, with each snapshot
+// under its parent.
+func WriteText(out io.Writer, roots []*Subvolume) {
+	for _, root := range roots {
+		writeSubvol(out, "", "", root)
+	}
+}
+
+func writeSubvol(out io.Writer, prefix, first string, subvol *Subvolume) {
+	textui.Fprintf(out, "%s%ssubvol %v uuid=%v gen=%v created=%v",
+		prefix, first, subvol.ID, subvol.UUID, subvol.Generation, subvol.CreatedGeneration)
+	if subvol.ParentID != 0 {
+		textui.Fprintf(out, " parent=%v (via %s)", subvol.ParentID, subvol.ParentVia)
+	}
+	if subvol.ApproxShared != nil {
+		textui.Fprintf(out, " shared=%v", *subvol.ApproxShared)
+	}
+	if subvol.Err != "" {
+		textui.Fprintf(out, " err=%q", subvol.Err)
+	}
+	if subvol.Orphan != "" {
+		textui.Fprintf(out, " ORPHAN: %s", subvol.Orphan)
+	}
+	_, _ = io.WriteString(out, "\n")
+	switch first {
+	case tT:
+		prefix += tl
+	case tL:
+		prefix += tS
+	}
+	for i, child := range subvol.Children {
+		if i == len(subvol.Children)-1 {
+			writeSubvol(out, prefix, tL, child)
+		} else {
+			writeSubvol(out, prefix, tT, child)
+		}
+	}
+}
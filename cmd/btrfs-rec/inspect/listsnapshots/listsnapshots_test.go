@@ -0,0 +1,106 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package listsnapshots
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+func TestBuildLineage(t *testing.T) {
+	t.Parallel()
+
+	uuid := func(n byte) btrfsprim.UUID {
+		return btrfsprim.UUID{15: n}
+	}
+	subvol := func(id btrfsprim.ObjID, self, parent byte) *Subvolume {
+		ret := &Subvolume{ID: id}
+		if self != 0 {
+			ret.UUID = uuid(self)
+		}
+		if parent != 0 {
+			ret.ParentUUID = uuid(parent)
+		}
+		return ret
+	}
+	subvols := []*Subvolume{
+		subvol(5, 0, 0),
+		subvol(256, 1, 0),
+		subvol(257, 2, 1),   // snapshot of 256
+		subvol(258, 3, 2),   // snapshot of 257
+		subvol(259, 4, 9),   // parent UUID is unknown: orphan
+		subvol(260, 5, 8),   // parent found by the fallback
+		subvol(261, 6, 7),   // cycle with 262
+		subvol(262, 7, 6),   // cycle with 261
+		subvol(263, 10, 11), // fallback finds a tree with no ROOT_ITEM
+	}
+	lookup := func(_ btrfsprim.ObjID, parentUUID btrfsprim.UUID) (btrfsprim.ObjID, string, bool) {
+		switch parentUUID {
+		case uuid(8):
+			return 256, "test", true
+		case uuid(11):
+			return 300, "test", true
+		}
+		return 0, "", false
+	}
+	roots := buildLineage(subvols, lookup)
+
+	type result struct {
+		ID       btrfsprim.ObjID
+		Parent   btrfsprim.ObjID
+		Orphan   bool
+		Children []btrfsprim.ObjID
+	}
+	var act []result
+	for _, root := range roots {
+		res := result{ID: root.ID, Parent: root.ParentID, Orphan: root.Orphan != ""}
+		for _, child := range root.Children {
+			res.Children = append(res.Children, child.ID)
+		}
+		act = append(act, res)
+	}
+	assert.Equal(t, []result{
+		{ID: 5},
+		{ID: 256, Children: []btrfsprim.ObjID{257, 260}},
+		{ID: 259, Orphan: true},
+		{ID: 263, Orphan: true},
+		{ID: 261, Orphan: true, Children: []btrfsprim.ObjID{262}},
+	}, act)
+	assert.Equal(t, "test", subvols[5].ParentVia)
+	assert.Equal(t, "parent UUID", subvols[2].ParentVia)
+	assert.Equal(t, []*Subvolume{subvols[3]}, subvols[2].Children)
+
+	subvols[2].ApproxShared = &SharedEstimate{SharedBytes: 1, TotalBytes: 4}
+	var out strings.Builder
+	WriteText(&out, roots[1:2])
+	assert.Equal(t, ""+
+		"subvol 256 uuid=00000000-0000-0000-0000-000000000001 gen=0 created=0\n"+
+		"├── subvol 257 uuid=00000000-0000-0000-0000-000000000002 gen=0 created=0 parent=256 (via parent UUID) shared=~25% (approximately 1B of 4B)\n"+
+		"│   └── subvol 258 uuid=00000000-0000-0000-0000-000000000003 gen=0 created=0 parent=257 (via parent UUID)\n"+
+		"└── subvol 260 uuid=00000000-0000-0000-0000-000000000005 gen=0 created=0 parent=256 (via test)\n",
+		out.String())
+}
+
+func TestEstimateShared(t *testing.T) {
+	t.Parallel()
+	child := map[btrfsvol.LogicalAddr]btrfsvol.AddrDelta{
+		0x1000: 0x1000,
+		0x2000: 0x3000,
+		0x8000: 0x4000,
+	}
+	parent := map[btrfsvol.LogicalAddr]btrfsvol.AddrDelta{
+		0x2000: 0x3000,
+		0x9000: 0x1000,
+	}
+	est := estimateShared(child, parent)
+	assert.Equal(t, SharedEstimate{SharedBytes: 0x3000, TotalBytes: 0x8000}, est)
+	assert.Equal(t, int64(37), est.Percent())
+	assert.Equal(t, int64(0), SharedEstimate{}.Percent())
+}
@@ -28,6 +28,7 @@ func LsFiles(
 	ctx context.Context,
 	out io.Writer,
 	fs btrfs.ReadableFS,
+	svCfg btrfs.SubvolumeConfig,
 ) (err error) {
 	defer func() {
 		if _err := derror.PanicToError(recover()); _err != nil {
@@ -40,7 +41,7 @@ func LsFiles(
 		ctx,
 		fs,
 		btrfsprim.FS_TREE_OBJECTID,
-		false,
+		svCfg,
 	))
 
 	return nil
@@ -120,8 +121,23 @@ func fmtInode(inode btrfs.BareInode) string {
 	return ret
 }
 
+// fmtFullInode is like fmtInode, but also includes the inode's
+// xattrs, one per line.  Values are shown quoted and escaped, as
+// many xattrs (such as ACLs and security.capability) are binary.
+func fmtFullInode(inode btrfs.FullInode) string {
+	var ret strings.Builder
+	ret.WriteString(fmtInode(inode.BareInode))
+	for _, name := range maps.SortedKeys(inode.XAttrs) {
+		textui.Fprintf(&ret, "\nxattr %q=%q", name, inode.XAttrs[name])
+		if name == "btrfs.compression" {
+			ret.WriteString(" (compression property)")
+		}
+	}
+	return ret.String()
+}
+
 func printDir(out io.Writer, prefix string, isLast bool, name string, dir *btrfs.Dir) {
-	printText(out, prefix, isLast, name+"/", fmtInode(dir.BareInode))
+	printText(out, prefix, isLast, name+"/", fmtFullInode(dir.FullInode))
 	childrenByName := dir.ChildrenByName
 	subvol := dir.SV
 	subvol.ReleaseDir(dir.Inode)
@@ -228,7 +244,7 @@ func printSymlink(out io.Writer, prefix string, isLast bool, name string, file *
 	printText(out, prefix, isLast, name, textui.Sprintf(
 		"-> %q : %s",
 		tgt,
-		fmtInode(file.BareInode)))
+		fmtFullInode(file.FullInode)))
 }
 
 func printFile(out io.Writer, prefix string, isLast bool, name string, file *btrfs.File) {
@@ -237,19 +253,19 @@ func printFile(out io.Writer, prefix string, isLast bool, name string, file *btr
 			file.Errs = append(file.Errs, err)
 		}
 	}
-	printText(out, prefix, isLast, name, fmtInode(file.BareInode))
+	printText(out, prefix, isLast, name, fmtFullInode(file.FullInode))
 }
 
 func printSocket(out io.Writer, prefix string, isLast bool, name string, file *btrfs.File) {
 	if file.InodeItem != nil && file.InodeItem.Size > 0 {
 		panic(fmt.Errorf("TODO: I don't know how to handle a socket with size>0: %q", name))
 	}
-	printText(out, prefix, isLast, name, fmtInode(file.BareInode))
+	printText(out, prefix, isLast, name, fmtFullInode(file.FullInode))
 }
 
 func printPipe(out io.Writer, prefix string, isLast bool, name string, file *btrfs.File) {
 	if file.InodeItem != nil && file.InodeItem.Size > 0 {
 		panic(fmt.Errorf("TODO: I don't know how to handle a pipe with size>0: %q", name))
 	}
-	printText(out, prefix, isLast, name, fmtInode(file.BareInode))
+	printText(out, prefix, isLast, name, fmtFullInode(file.FullInode))
 }
@@ -16,6 +16,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"git.lukeshu.com/go/typedsync"
 	"github.com/datawire/dlib/dcontext"
@@ -34,7 +35,7 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/slices"
 )
 
-func MountRO(ctx context.Context, fs btrfs.ReadableFS, mountpoint string, noChecksums bool) error {
+func MountRO(ctx context.Context, fs btrfs.ReadableFS, mountpoint string, svCfg btrfs.SubvolumeConfig) error {
 	sb, err := fs.Superblock()
 	if err != nil {
 		return err
@@ -45,7 +46,7 @@ func MountRO(ctx context.Context, fs btrfs.ReadableFS, mountpoint string, noChec
 			ctx,
 			fs,
 			btrfsprim.FS_TREE_OBJECTID,
-			noChecksums,
+			svCfg,
 		),
 		DeviceName: fs.Name(),
 		Mountpoint: mountpoint,
@@ -55,6 +56,10 @@ func MountRO(ctx context.Context, fs btrfs.ReadableFS, mountpoint string, noChec
 	return rootSubvol.Run(ctx)
 }
 
+// unmountRetryInterval is how long to wait between attempts to unmount
+// a busy mountpoint.
+const unmountRetryInterval = 100 * time.Millisecond
+
 func fuseMount(ctx context.Context, mountpoint string, server fuse.Server, cfg *fuse.MountConfig) error {
 	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{
 		// Allow mountHandle.Join() returning to cause the
@@ -63,6 +68,9 @@ func fuseMount(ctx context.Context, mountpoint string, server fuse.Server, cfg *
 	})
 	mounted := uint32(1)
 	grp.Go("unmount", func(ctx context.Context) error {
+		// ctx is canceled by the dgroup signal handling in
+		// main.go on SIGINT/SIGTERM, or if the mount itself
+		// exits.
 		<-ctx.Done()
 		var err error
 		var gotNil bool
@@ -71,7 +79,11 @@ func fuseMount(ctx context.Context, mountpoint string, server fuse.Server, cfg *
 			if _err := fuse.Unmount(mountpoint); _err == nil {
 				gotNil = true
 			} else if !gotNil {
+				if err == nil {
+					dlog.Infof(ctx, "unmount %q: %v; retrying until it is no longer busy", mountpoint, _err)
+				}
 				err = _err
+				time.Sleep(unmountRetryInterval)
 			}
 		}
 		if gotNil {
@@ -124,21 +136,33 @@ type subvolume struct {
 func (sv *subvolume) Run(ctx context.Context) error {
 	sv.grp = dgroup.NewGroup(ctx, dgroup.GroupConfig{})
 	sv.grp.Go("self", func(ctx context.Context) error {
-		cfg := &fuse.MountConfig{
-			FSName:  sv.DeviceName,
-			Subtype: "btrfs",
-
-			ReadOnly: true,
-
-			Options: map[string]string{
-				"allow_other": "",
-			},
-		}
-		return fuseMount(ctx, sv.Mountpoint, fuseutil.NewFileSystemServer(sv), cfg)
+		return fuseMount(ctx, sv.Mountpoint, fuseutil.NewFileSystemServer(sv), sv.mountConfig())
 	})
 	return sv.grp.Wait()
 }
 
+func (sv *subvolume) mountConfig() *fuse.MountConfig {
+	return &fuse.MountConfig{
+		FSName:  sv.DeviceName,
+		Subtype: "btrfs",
+
+		// This is a recovery mount; it must never appear
+		// writable.  ReadOnly makes it an "ro" mount; see also
+		// readonly.go.
+		ReadOnly: true,
+
+		Options: map[string]string{
+			"allow_other": "",
+			// Don't let a corrupt filesystem smuggle in
+			// setuid binaries, device nodes, or
+			// executables.
+			"nosuid": "",
+			"nodev":  "",
+			"noexec": "",
+		},
+	}
+}
+
 func (sv *subvolume) newHandle() fuseops.HandleID {
 	return fuseops.HandleID(atomic.AddUint64(&sv.lastHandle, 1))
 }
@@ -380,7 +404,7 @@ func (sv *subvolume) OpenFile(_ context.Context, op *fuseops.OpenFileOp) error {
 	return nil
 }
 
-func (sv *subvolume) ReadFile(_ context.Context, op *fuseops.ReadFileOp) error {
+func (sv *subvolume) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
 	state, ok := sv.fileHandles.Load(op.Handle)
 	if !ok {
 		return syscall.EBADF
@@ -395,13 +419,23 @@ func (sv *subvolume) ReadFile(_ context.Context, op *fuseops.ReadFileOp) error {
 		op.Data = [][]byte{dat}
 	}
 
-	var err error
-	op.BytesRead, err = state.File.ReadAt(dat, op.Offset)
-	if errors.Is(err, io.EOF) {
-		err = nil
+	n, err := state.File.ReadAt(dat, op.Offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		// Don't return a short read: the kernel takes a short
+		// read to mean EOF, and would zero-fill the rest of
+		// the page cache.  Instead, fail this request with
+		// EIO; if it was a multi-page readahead, the kernel
+		// falls back to reading the pages one at a time, so
+		// only the pages that overlap the unrecoverable range
+		// end up failing, and the rest of the file is still
+		// readable.
+		dlog.Errorf(ctx, "inode %v: read of %v bytes at %v: unrecoverable at %v: %v",
+			op.Inode, len(dat), op.Offset, op.Offset+int64(n), err)
+		return syscall.EIO
 	}
+	op.BytesRead = n
 
-	return err
+	return nil
 }
 
 func (sv *subvolume) ReleaseFileHandle(_ context.Context, op *fuseops.ReleaseFileHandleOp) error {
@@ -0,0 +1,84 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package mount
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+)
+
+// TestReadFileUnrecoverable checks that a read that runs in to an
+// unmappable range fails with EIO rather than returning a short read
+// (which the kernel would take to be EOF), and that the rest of the
+// file can still be read.
+func TestReadFileUnrecoverable(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	// 0-4KiB reads as zeros, 4KiB-8KiB has no extent, and
+	// 8KiB-12KiB reads as zeros.
+	file := &btrfs.File{
+		FullInode: btrfs.FullInode{BareInode: btrfs.BareInode{
+			InodeItem: &btrfsitem.Inode{Size: 12 * 1024},
+		}},
+		Extents: []btrfs.FileExtent{
+			{OffsetWithinFile: 0, FileExtent: btrfsitem.FileExtent{
+				Type:       btrfsitem.FILE_EXTENT_PREALLOC,
+				BodyExtent: btrfsitem.FileExtentExtent{NumBytes: 4 * 1024},
+			}},
+			{OffsetWithinFile: 8 * 1024, FileExtent: btrfsitem.FileExtent{
+				Type:       btrfsitem.FILE_EXTENT_PREALLOC,
+				BodyExtent: btrfsitem.FileExtentExtent{NumBytes: 4 * 1024},
+			}},
+		},
+	}
+	sv := new(subvolume)
+	handle := sv.newHandle()
+	sv.fileHandles.Store(handle, &fileState{File: file})
+
+	type TestCase struct {
+		Offset   int64
+		Size     int64
+		ExpErr   error
+		ExpBytes int
+	}
+	testcases := map[string]TestCase{
+		"before":   {Offset: 0, Size: 4 * 1024, ExpBytes: 4 * 1024},
+		"overlaps": {Offset: 0, Size: 12 * 1024, ExpErr: syscall.EIO},
+		"inside":   {Offset: 4 * 1024, Size: 4 * 1024, ExpErr: syscall.EIO},
+		"after":    {Offset: 8 * 1024, Size: 4 * 1024, ExpBytes: 4 * 1024},
+		"eof":      {Offset: 8 * 1024, Size: 8 * 1024, ExpBytes: 4 * 1024},
+		"past-eof": {Offset: 12 * 1024, Size: 4 * 1024, ExpBytes: 0},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			dst := bytes.Repeat([]byte{0xff}, int(tc.Size))
+			op := &fuseops.ReadFileOp{
+				Handle: handle,
+				Offset: tc.Offset,
+				Size:   tc.Size,
+				Dst:    dst,
+			}
+			err := sv.ReadFile(ctx, op)
+			assert.Equal(t, tc.ExpErr, err)
+			if tc.ExpErr == nil {
+				assert.Equal(t, tc.ExpBytes, op.BytesRead)
+				assert.Equal(t, make([]byte, tc.ExpBytes), dst[:op.BytesRead])
+			}
+		})
+	}
+
+	assert.Equal(t, syscall.EBADF, sv.ReadFile(ctx, &fuseops.ReadFileOp{Handle: handle + 1}))
+}
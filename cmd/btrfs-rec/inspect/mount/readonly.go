@@ -0,0 +1,84 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package mount
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The mount is read-only (MountConfig.ReadOnly has the kernel reject
+// opening a file for writing, and other modifications, with EROFS
+// before they ever reach us).  But in case anything slips through,
+// explicitly answer every modifying operation with EROFS rather than
+// fuseutil.NotImplementedFileSystem's ENOSYS, which tools interpret
+// as "this filesystem is writable, but doesn't support that
+// particular operation".
+
+func (*subvolume) SetInodeAttributes(_ context.Context, _ *fuseops.SetInodeAttributesOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) MkDir(_ context.Context, _ *fuseops.MkDirOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) MkNode(_ context.Context, _ *fuseops.MkNodeOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) CreateFile(_ context.Context, _ *fuseops.CreateFileOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) CreateSymlink(_ context.Context, _ *fuseops.CreateSymlinkOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) CreateLink(_ context.Context, _ *fuseops.CreateLinkOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) Rename(_ context.Context, _ *fuseops.RenameOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) RmDir(_ context.Context, _ *fuseops.RmDirOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) Unlink(_ context.Context, _ *fuseops.UnlinkOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) WriteFile(_ context.Context, _ *fuseops.WriteFileOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) SetXattr(_ context.Context, _ *fuseops.SetXattrOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) RemoveXattr(_ context.Context, _ *fuseops.RemoveXattrOp) error {
+	return syscall.EROFS
+}
+
+func (*subvolume) Fallocate(_ context.Context, _ *fuseops.FallocateOp) error {
+	return syscall.EROFS
+}
+
+// SyncFile and FlushFile have nothing to write back, but they are
+// called when closing/fsync()ing a read-only file, so succeed rather
+// than returning ENOSYS.
+
+func (*subvolume) SyncFile(_ context.Context, _ *fuseops.SyncFileOp) error {
+	return nil
+}
+
+func (*subvolume) FlushFile(_ context.Context, _ *fuseops.FlushFileOp) error {
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package mount
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnly(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	sv := new(subvolume)
+
+	modifying := map[string]func(context.Context) error{
+		"SetInodeAttributes": func(ctx context.Context) error {
+			return sv.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{})
+		},
+		"MkDir":         func(ctx context.Context) error { return sv.MkDir(ctx, &fuseops.MkDirOp{}) },
+		"MkNode":        func(ctx context.Context) error { return sv.MkNode(ctx, &fuseops.MkNodeOp{}) },
+		"CreateFile":    func(ctx context.Context) error { return sv.CreateFile(ctx, &fuseops.CreateFileOp{}) },
+		"CreateSymlink": func(ctx context.Context) error { return sv.CreateSymlink(ctx, &fuseops.CreateSymlinkOp{}) },
+		"CreateLink":    func(ctx context.Context) error { return sv.CreateLink(ctx, &fuseops.CreateLinkOp{}) },
+		"Rename":        func(ctx context.Context) error { return sv.Rename(ctx, &fuseops.RenameOp{}) },
+		"RmDir":         func(ctx context.Context) error { return sv.RmDir(ctx, &fuseops.RmDirOp{}) },
+		"Unlink":        func(ctx context.Context) error { return sv.Unlink(ctx, &fuseops.UnlinkOp{}) },
+		"WriteFile":     func(ctx context.Context) error { return sv.WriteFile(ctx, &fuseops.WriteFileOp{}) },
+		"SetXattr":      func(ctx context.Context) error { return sv.SetXattr(ctx, &fuseops.SetXattrOp{}) },
+		"RemoveXattr":   func(ctx context.Context) error { return sv.RemoveXattr(ctx, &fuseops.RemoveXattrOp{}) },
+		"Fallocate":     func(ctx context.Context) error { return sv.Fallocate(ctx, &fuseops.FallocateOp{}) },
+	}
+	for name, op := range modifying {
+		assert.Equal(t, syscall.EROFS, op(ctx), name)
+	}
+
+	// Closing or fsync()ing a read-only file must still work.
+	assert.NoError(t, sv.SyncFile(ctx, &fuseops.SyncFileOp{}))
+	assert.NoError(t, sv.FlushFile(ctx, &fuseops.FlushFileOp{}))
+
+	cfg := sv.mountConfig()
+	assert.True(t, cfg.ReadOnly)
+	for _, opt := range []string{"nosuid", "nodev", "noexec"} {
+		assert.Contains(t, cfg.Options, opt)
+	}
+}
@@ -19,7 +19,7 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
-var minFuzzyPct = textui.Tunable(0.5)
+var minFuzzyPct = textui.NewTunable("rebuild-mappings.min-fuzzy-pct", 0.5).WithMax(1)
 
 type fuzzyRecord struct {
 	PAddr btrfsvol.QualifiedPhysicalAddr
@@ -101,12 +101,12 @@ func matchBlockGroupSumsFuzzy(ctx context.Context,
 		case 1: // not sure how this can happen, but whatev
 			pct := float64(d-best.Dat[0].N) / float64(d)
 			matchesStr = textui.Sprintf("%v", number.Percent(pct))
-			apply = pct > minFuzzyPct
+			apply = pct > minFuzzyPct.Get()
 		case 2:
 			pct := float64(d-best.Dat[0].N) / float64(d)
 			pct2 := float64(d-best.Dat[1].N) / float64(d)
 			matchesStr = textui.Sprintf("best=%v secondbest=%v", number.Percent(pct), number.Percent(pct2))
-			apply = pct > minFuzzyPct && pct2 < minFuzzyPct
+			apply = pct > minFuzzyPct.Get() && pct2 < minFuzzyPct.Get()
 		}
 		lvl := dlog.LogLevelError
 		if apply {
@@ -0,0 +1,93 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"io"
+	"time"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// estimateTimePerNode is how long Rebuild is assumed to take per
+// node, for Estimate.Duration.  It is a rough figure for a
+// spinning-rust-backed image on a modest machine; the real figure
+// depends heavily on the I/O and cache behavior of the machine, and
+// on how broken the filesystem is.
+var estimateTimePerNode = textui.NewTunable("rebuild-trees.estimate-time-per-node", 2*time.Millisecond)
+
+// An Estimate is a prediction, made from the scan alone (without
+// entering the augment loop), of how much work Rebuild will do.  All
+// of the numbers other than the node counts are approximate.
+type Estimate struct {
+	NumNodes    int
+	NumLeaves   int
+	NumInterior int
+	NumBadNodes int
+	// NumItems is the number of items in all of the leaves; it is
+	// an upper bound on the number of items that Rebuild
+	// processes, as items in leaves that don't get added to any
+	// tree are never processed.
+	NumItems int
+	// Trees is the trees that own at least one node; each of
+	// these may need to be rebuilt.
+	Trees []btrfsprim.ObjID
+	// Duration is NumNodes*TimePerNode.
+	Duration    time.Duration
+	TimePerNode time.Duration
+}
+
+// EstimateRebuild returns an Estimate for rebuilding the trees from
+// the result of ScanDevices.
+func EstimateRebuild(scan ScanDevicesResult) Estimate {
+	ret := Estimate{
+		NumNodes:    len(scan.Graph.Nodes),
+		NumBadNodes: len(scan.Graph.BadNodes),
+		TimePerNode: estimateTimePerNode.Get(),
+	}
+	trees := make(containers.Set[btrfsprim.ObjID])
+	for _, node := range scan.Graph.Nodes {
+		trees.Insert(node.Owner)
+		if node.Level == 0 {
+			ret.NumLeaves++
+			ret.NumItems += len(node.Items)
+		} else {
+			ret.NumInterior++
+		}
+	}
+	ret.Trees = maps.SortedKeys(trees)
+	ret.Duration = time.Duration(ret.NumNodes) * ret.TimePerNode
+	return ret
+}
+
+// WriteTo writes a human-readable description of the estimate,
+// including the assumptions that it makes, to w.
+func (e Estimate) WriteTo(w io.Writer) (int64, error) {
+	n, err := textui.Fprintf(w, ""+
+		"Estimated rebuild-trees work (approximate):\n"+
+		"  nodes:           %d (%d leaves, %d interior; %d unreadable, not counted)\n"+
+		"  items:           ~%d (at most; only items in leaves that are added to a tree are processed)\n"+
+		"  trees:           %d %v\n"+
+		"  time:            ~%v\n"+
+		"Assumptions:\n"+
+		"  - the time is %v per node (set with --tune=%s=DURATION),\n"+
+		"    which varies widely with I/O speed and with how broken the filesystem is;\n"+
+		"  - every tree that owns a node may need to be rebuilt;\n"+
+		"  - the scan has already been done (it is not included in the time).\n",
+		e.NumNodes, e.NumLeaves, e.NumInterior, e.NumBadNodes,
+		e.NumItems,
+		len(e.Trees), e.Trees,
+		e.Duration.Round(time.Second),
+		e.TimePerNode, "rebuild-trees.estimate-time-per-node")
+	return int64(n), err
+}
+
+func (e Estimate) String() string {
+	return textui.Sprintf("%d nodes, ~%d items, %d trees, ~%v",
+		e.NumNodes, e.NumItems, len(e.Trees), e.Duration.Round(time.Second))
+}
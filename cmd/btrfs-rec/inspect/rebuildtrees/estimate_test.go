@@ -0,0 +1,49 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func TestEstimateRebuild(t *testing.T) {
+	t.Parallel()
+	scan := ScanDevicesResult{
+		Graph: btrfsutil.Graph{
+			Nodes: map[btrfsvol.LogicalAddr]btrfsutil.GraphNode{
+				0x1000: {Level: 1, Owner: btrfsprim.FS_TREE_OBJECTID},
+				0x2000: {Level: 0, Owner: btrfsprim.FS_TREE_OBJECTID, Items: make([]btrfsutil.KeyAndSize, 3)},
+				0x3000: {Level: 0, Owner: btrfsprim.ROOT_TREE_OBJECTID, Items: make([]btrfsutil.KeyAndSize, 4)},
+			},
+			BadNodes: map[btrfsvol.LogicalAddr]error{
+				0x4000: errors.New("bad"),
+			},
+		},
+	}
+	est := EstimateRebuild(scan)
+	assert.Equal(t, 3, est.NumNodes)
+	assert.Equal(t, 2, est.NumLeaves)
+	assert.Equal(t, 1, est.NumInterior)
+	assert.Equal(t, 1, est.NumBadNodes)
+	assert.Equal(t, 7, est.NumItems)
+	assert.Equal(t, []btrfsprim.ObjID{btrfsprim.ROOT_TREE_OBJECTID, btrfsprim.FS_TREE_OBJECTID}, est.Trees)
+	assert.Equal(t, 3*est.TimePerNode, est.Duration)
+
+	var out strings.Builder
+	_, err := est.WriteTo(&out)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "approximate")
+	assert.Contains(t, out.String(), "Assumptions:")
+	assert.Contains(t, out.String(), "rebuild-trees.estimate-time-per-node")
+}
@@ -13,7 +13,7 @@ import (
 	"fmt"
 	"runtime"
 	"sort"
-	"time"
+	"sync"
 
 	"github.com/datawire/dlib/dgroup"
 	"github.com/datawire/dlib/dlog"
@@ -46,7 +46,83 @@ func (o keyAndTree) String() string {
 	return fmt.Sprintf("tree=%v key=%v", o.TreeID, o.Key)
 }
 
+// Config configures a Rebuilder.  The zero Config is the default.
+type Config struct {
+	// ItemsPerNodeHint, if non-zero, overrides the average number
+	// of items per node that is estimated from the scanned nodes.
+	// It is only used to size the read-ahead buffer between the
+	// I/O and CPU halves of the settled-item queue (see
+	// itemBufferNodes), and so only affects throughput, not
+	// correctness.  The other steps of the rebuild, and the scan,
+	// do not buffer items and are not affected by it.
+	ItemsPerNodeHint int
+
+	// SortExtentQueue is the strategy used to order the
+	// EXTENT_TREE members of the item queue.  It only affects the
+	// order in which items are processed (and so the number of
+	// cache misses), not the result.
+	SortExtentQueue ExtentQueueSort
+
+	// AugmentBacktrackLimit, if non-zero, enables a search that
+	// improves on the greedy resolution of augments: each cluster
+	// of conflicting candidate nodes (nodes that are connected by
+	// appearing in the same want-lists) of at most this many
+	// nodes is searched exhaustively for the accept-set that
+	// represents the most want-lists.  Larger clusters are left
+	// with the greedy result.
+	AugmentBacktrackLimit int
+
+	// RelocAsTarget, if set, treats nodes owned by
+	// TREE_RELOC_OBJECTID as belonging to the tree that their
+	// reloc tree was relocating (see
+	// btrfsutil.Graph.ReattributeRelocNodes), so that data
+	// stranded in a reloc tree by an interrupted balance isn't
+	// lost.  It is opt-in because which tree a reloc node belongs
+	// to can't always be known.
+	RelocAsTarget bool
+
+	// MinConfidence, if non-zero, is the minimum
+	// ChoiceInfo.Confidence that a candidate root must have to be
+	// added to a tree.  Candidates below it are not added (though
+	// another candidate for the same want-lists may be added
+	// instead), and are instead listed in the Rebuilder's
+	// LowConfidenceReport, so that they may be reviewed and
+	// accepted manually (by adding them to the --trees file).
+	MinConfidence float64
+
+	// PriorityTrees is a list of trees (usually subvolumes that
+	// the user is waiting to recover) that should be rebuilt
+	// before any other trees except for the core trees (see
+	// treePriority).  It only affects the order in which work is
+	// done, not the result.
+	PriorityTrees []btrfsprim.ObjID
+
+	// RootTreeRoot, if non-zero, is the node to use as the root
+	// of the ROOT_TREE, overriding the choice made by
+	// btrfsutil.ChooseRootTreeRoot.
+	RootTreeRoot btrfsvol.LogicalAddr
+
+	// Threads, if positive, is the number of goroutines to use
+	// for the parallel parts of the rebuild (currently, applying
+	// the resolved augments); if zero, runtime.GOMAXPROCS is
+	// used.  Either way, it is clamped to
+	// btrfsutil.RebuiltMaxConcurrency.
+	Threads int
+
+	// ChecksumTree is the ID of the tree that data checksums are
+	// rebuilt in to; if zero, it is CSUM_TREE_OBJECTID.
+	ChecksumTree btrfsprim.ObjID
+
+	// DupKeyReport enables collecting the Rebuilder's
+	// DupKeyReport (see btrfsutil.RebuiltForrest's
+	// RebuiltEnableDupKeyReport).  It is enabled before any roots
+	// or items are added, so that the report covers all of them.
+	DupKeyReport bool
+}
+
 type rebuilder struct {
+	cfg  Config
+	sb   btrfstree.Superblock
 	scan ScanDevicesResult
 
 	rebuilt *btrfsutil.RebuiltForrest
@@ -57,11 +133,88 @@ type rebuilder struct {
 	}
 	treeQueue          containers.Set[btrfsprim.ObjID]
 	retryItemQueue     map[btrfsprim.ObjID]containers.Set[keyAndTree]
+	addedItemMu        sync.Mutex // only needs to be held while applying augments; see applyAugments
 	addedItemQueue     containers.Set[keyAndTree]
 	settledItemQueue   containers.Set[keyAndTree]
 	augmentQueue       map[btrfsprim.ObjID]*treeAugmentQueue
 	numAugments        int
 	numAugmentFailures int
+	lowConfidence      map[keyAndAddr]LowConfidenceCandidate
+	seedRoots          map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]
+	pendingSeeds       map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]
+
+	itemsPerNode int
+}
+
+// defaultItemsPerNode is the average number of items per node to
+// assume if there are no leaf nodes to estimate it from.
+const defaultItemsPerNode = 100
+
+// estimateItemsPerNode returns the average number of items in the
+// leaf nodes of the graph.
+func estimateItemsPerNode(graph btrfsutil.Graph) int {
+	var nodes, items int
+	for _, node := range graph.Nodes {
+		if node.Level == 0 {
+			nodes++
+			items += len(node.Items)
+		}
+	}
+	if items == 0 {
+		return defaultItemsPerNode
+	}
+	return (items + nodes - 1) / nodes
+}
+
+// ExtentQueueSort is a strategy for ordering the EXTENT_TREE members
+// of the settled-item queue; see sortSettledItemQueue and
+// Config.SortExtentQueue.
+//
+// *ExtentQueueSort implements pflag.Value, so that it may be used as
+// a command-line flag.
+type ExtentQueueSort int
+
+const (
+	// ExtentQueueSortMinLA has an entry in the queue for each
+	// backref of an extent, sorted by the tree being
+	// back-referenced (see the long comment in
+	// sortSettledItemQueue for why it's named after MinLA).
+	ExtentQueueSortMinLA ExtentQueueSort = iota
+	// ExtentQueueSortRefCount is like ExtentQueueSortMinLA, but
+	// visits the most-back-referenced trees first, rather than
+	// visiting trees in order of tree ID.
+	ExtentQueueSortRefCount
+	// ExtentQueueSortNone is the usual simple by-key sort, with
+	// no special treatment of the EXTENT_TREE.
+	ExtentQueueSortNone
+)
+
+var extentQueueSortNames = []string{
+	ExtentQueueSortMinLA:    "minla",
+	ExtentQueueSortRefCount: "refcount",
+	ExtentQueueSortNone:     "none",
+}
+
+// Type implements pflag.Value.
+func (*ExtentQueueSort) Type() string { return "strategy" }
+
+// String implements fmt.Stringer and pflag.Value.
+func (s *ExtentQueueSort) String() string {
+	if *s < 0 || int(*s) >= len(extentQueueSortNames) {
+		return fmt.Sprintf("ExtentQueueSort(%d)", int(*s))
+	}
+	return extentQueueSortNames[*s]
+}
+
+// Set implements pflag.Value.
+func (s *ExtentQueueSort) Set(str string) error {
+	for i, name := range extentQueueSortNames {
+		if str == name {
+			*s = ExtentQueueSort(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid strategy %q: must be one of %q", str, extentQueueSortNames)
 }
 
 type treeAugmentQueue struct {
@@ -73,26 +226,135 @@ type treeAugmentQueue struct {
 type Rebuilder interface {
 	Rebuild(context.Context) error
 	ListRoots(context.Context) map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]
+	SetTrustedGeneration(context.Context, btrfsprim.ObjID, btrfsprim.Generation) error
+	InjectItems(context.Context, []btrfsutil.InjectedItem) error
+	SeedRoots(context.Context, map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]) error
+	DupKeyReport() map[btrfsprim.ObjID]map[btrfsprim.Key]btrfsutil.DupKeyConflict
+	LowConfidenceReport(context.Context) []LowConfidenceCandidate
 }
 
-func NewRebuilder(ctx context.Context, fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr) (Rebuilder, error) {
+func NewRebuilder(ctx context.Context, fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr, cfg Config) (Rebuilder, error) {
 	ctx = dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.step", "read-fs-data")
 	scanData, err := ScanDevices(ctx, fs, nodeList) // ScanDevices does its own logging
 	if err != nil {
 		return nil, err
 	}
 
+	sb, err := fs.Superblock()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ChecksumTree == 0 {
+		cfg.ChecksumTree = btrfsprim.CSUM_TREE_OBJECTID
+	}
+
+	if cfg.RelocAsTarget {
+		scanData.Graph.ReattributeRelocNodes(ctx, scanData.Graph.RelocTargets(ctx))
+	}
+
+	if cfg.ChecksumTree != btrfsprim.CSUM_TREE_OBJECTID && !hasCSumItems(scanData.Graph, cfg.ChecksumTree) {
+		return nil, fmt.Errorf("checksum tree %v: no scanned node owned by it contains EXTENT_CSUM items",
+			cfg.ChecksumTree)
+	}
+
 	o := &rebuilder{
+		cfg:  cfg,
+		sb:   *sb,
 		scan: scanData,
+
+		itemsPerNode: cfg.ItemsPerNodeHint,
+	}
+	if o.itemsPerNode <= 0 {
+		o.itemsPerNode = estimateItemsPerNode(scanData.Graph)
+		dlog.Infof(ctx, "estimated %v items per node", o.itemsPerNode)
 	}
 	o.rebuilt = btrfsutil.NewRebuiltForrest(fs, scanData.Graph, forrestCallbacks{o}, false)
+	if cfg.DupKeyReport {
+		o.rebuilt.RebuiltEnableDupKeyReport()
+	}
+	if err := o.setRootTreeRoot(ctx, fs); err != nil {
+		return nil, err
+	}
 	return o, nil
 }
 
+// setRootTreeRoot picks the root of the ROOT_TREE: Config.RootTreeRoot
+// if it is set, or else by cross-referencing the superblock mirrors with
+// the scanned graph.  If no candidate is usable, the superblock's
+// root_tree is left in place, and the rebuild will have to make do.
+func (o *rebuilder) setRootTreeRoot(ctx context.Context, fs *btrfs.FS) error {
+	if o.cfg.RootTreeRoot != 0 {
+		return o.rebuilt.RebuiltSetRootTreeRoot(ctx, o.cfg.RootTreeRoot)
+	}
+	refs, err := fs.Superblocks()
+	if err != nil {
+		return err
+	}
+	var sbs []btrfsutil.NamedSuperblock
+	fname := ""
+	sbi := 0
+	for _, ref := range refs {
+		if ref.File.Name() != fname {
+			fname = ref.File.Name()
+			sbi = 0
+		} else {
+			sbi++
+		}
+		name := fmt.Sprintf("file %q superblock %v", fname, sbi)
+		if err := ref.Data.ValidateChecksum(); err != nil {
+			dlog.Errorf(ctx, "ROOT_TREE root: ignoring %s: %v", name, err)
+			continue
+		}
+		sbs = append(sbs, btrfsutil.NamedSuperblock{
+			Name:       name,
+			Superblock: ref.Data,
+		})
+	}
+	best, err := btrfsutil.ChooseRootTreeRoot(ctx, sbs, o.scan.Graph)
+	if err != nil {
+		dlog.Errorf(ctx, "ROOT_TREE root: %v; using the superblock's root_tree=%v", err, o.sb.RootTree)
+		return nil
+	}
+	if best.Addr == o.sb.RootTree {
+		return nil
+	}
+	return o.rebuilt.RebuiltSetRootTreeRoot(ctx, best.Addr)
+}
+
+// hasCSumItems returns whether any leaf node in the graph that is
+// owned by `treeID` contains an EXTENT_CSUM item.  The tree can't be
+// looked up normally, since it hasn't been rebuilt yet.
+func hasCSumItems(graph btrfsutil.Graph, treeID btrfsprim.ObjID) bool {
+	for _, node := range graph.Nodes {
+		if node.Level != 0 || node.Owner != treeID {
+			continue
+		}
+		for _, item := range node.Items {
+			if item.Key.ItemType == btrfsitem.EXTENT_CSUM_KEY {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (o *rebuilder) ListRoots(ctx context.Context) map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr] {
 	return o.rebuilt.RebuiltListRoots(ctx)
 }
 
+func (o *rebuilder) SetTrustedGeneration(ctx context.Context, treeID btrfsprim.ObjID, gen btrfsprim.Generation) error {
+	return o.rebuilt.RebuiltSetTrustedGeneration(ctx, treeID, gen)
+}
+
+func (o *rebuilder) InjectItems(ctx context.Context, items []btrfsutil.InjectedItem) error {
+	return o.rebuilt.RebuiltInjectItems(ctx, items)
+}
+
+func (o *rebuilder) DupKeyReport() map[btrfsprim.ObjID]map[btrfsprim.Key]btrfsutil.DupKeyConflict {
+	return o.rebuilt.RebuiltDupKeyReport()
+}
+
 func (o *rebuilder) Rebuild(ctx context.Context) error {
 	ctx = dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.step", "rebuild")
 
@@ -107,8 +369,12 @@ func (o *rebuilder) Rebuild(ctx context.Context) error {
 		btrfsprim.ROOT_TREE_OBJECTID,
 		btrfsprim.CHUNK_TREE_OBJECTID,
 		// btrfsprim.TREE_LOG_OBJECTID, // TODO(lukeshu): Special LOG_TREE handling
-		btrfsprim.BLOCK_GROUP_TREE_OBJECTID,
 	)
+	// Without the block-group-tree feature, the block groups are
+	// in the EXTENT_TREE, which is reached via the ROOT_TREE.
+	if o.sb.BlockGroupTree() == btrfsprim.BLOCK_GROUP_TREE_OBJECTID {
+		o.treeQueue.Insert(btrfsprim.BLOCK_GROUP_TREE_OBJECTID)
+	}
 
 	// Run
 	for passNum := 0; len(o.treeQueue) > 0 || len(o.addedItemQueue) > 0 || len(o.settledItemQueue) > 0 || len(o.augmentQueue) > 0; passNum++ {
@@ -137,9 +403,20 @@ func (o *rebuilder) Rebuild(ctx context.Context) error {
 		if err := o.processAugmentQueue(ctx); err != nil {
 			return err
 		}
+		// Apply seeded roots (drain what can be of o.pendingSeeds, fill o.addedItemQueue).
+		if err := o.applySeedRoots(ctx); err != nil {
+			return err
+		}
 		runtime.GC()
 	}
 
+	o.logRootOrigins(ctx)
+
+	hits, misses := o.rebuilt.RebuiltLeafToRootsStats()
+	dlog.Infof(ctx, "leaf-to-roots cache: %v hits, %v misses", hits, misses)
+	hits, misses = o.rebuilt.RebuiltLookupCacheStats()
+	dlog.Infof(ctx, "lookup cache: %v hits, %v misses", hits, misses)
+
 	return nil
 }
 
@@ -147,8 +424,9 @@ func (o *rebuilder) Rebuild(ctx context.Context) error {
 func (o *rebuilder) processTreeQueue(ctx context.Context) error {
 	ctx = dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.substep", "collect-items")
 
-	queue := maps.SortedKeys(o.treeQueue)
+	queue := sortedTreeIDs(o.treeQueue, o.cfg.PriorityTrees)
 	o.treeQueue = make(containers.Set[btrfsprim.ObjID])
+	dlog.Infof(ctx, "tree order: %v", queue)
 
 	// Because trees can be wildly different sizes, it's impossible to have a meaningful
 	// progress percentage here.
@@ -189,7 +467,7 @@ func (o *rebuilder) processAddedItemQueue(ctx context.Context) error {
 
 	var progress settleItemStats
 	progress.D = len(queue)
-	progressWriter := textui.NewProgress[settleItemStats](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second))
+	progressWriter := textui.NewProgress[settleItemStats](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
 	progressWriter.Set(progress)
 	defer progressWriter.Done()
 
@@ -205,7 +483,7 @@ func (o *rebuilder) processAddedItemQueue(ctx context.Context) error {
 		}
 		excPtr, ok := tree.RebuiltAcquirePotentialItems(ctx).Load(key.Key)
 		tree.RebuiltReleasePotentialItems()
-		if ok && tree.RebuiltShouldReplace(incPtr.Node, excPtr.Node) {
+		if ok && tree.RebuiltShouldReplace(ctx, incPtr.Node, excPtr.Node) {
 			wantKey := wantWithTree{
 				TreeID: key.TreeID,
 				Key:    wantFromKey(key.Key),
@@ -253,6 +531,9 @@ func (a itemToVisit) Compare(b itemToVisit) int {
 // sorts those members by the FS trees of the referencing inodes,
 // rather than by the laddr of the extent being referenced.  This
 // greatly reduces the number of .RebuiltAcquireItems() cache-misses.
+//
+// SortExtentQueue selects between this and other strategies, for
+// comparing them.
 func (o *rebuilder) sortSettledItemQueue(ctx context.Context, unorderedQueue containers.Set[keyAndTree]) []itemToVisit {
 	// Like many problems, the trick isn't answering the question,
 	// it's asking the right question.
@@ -327,7 +608,7 @@ func (o *rebuilder) sortSettledItemQueue(ctx context.Context, unorderedQueue con
 	ctx = dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.process.substep", "sort")
 	dlog.Info(ctx, "building ordered queue...")
 
-	dlog.Infof(ctx, "... walking %d items...", len(unorderedQueue))
+	dlog.Infof(ctx, "... walking %d items (--sort-extent-queue=%v)...", len(unorderedQueue), &o.cfg.SortExtentQueue)
 
 	// Don't worry about bailing if there is a failure to get the
 	// EXTENT_TREE; if that fails, then there can't be any items
@@ -344,8 +625,14 @@ func (o *rebuilder) sortSettledItemQueue(ctx context.Context, unorderedQueue con
 		if itemKey.TreeID == btrfsprim.EXTENT_TREE_OBJECTID && (itemKey.ItemType == btrfsprim.EXTENT_ITEM_KEY ||
 			itemKey.ItemType == btrfsprim.METADATA_ITEM_KEY ||
 			itemKey.ItemType == btrfsprim.EXTENT_DATA_REF_KEY) {
+			// Every strategy needs an entry per backref, as
+			// each entry only processes the backref with its
+			// RefNum; they differ in how the entries are sorted.
 			ptr, _ := extentItems.Load(itemKey.Key)
 			for i, treeID := range o.scan.DataBackrefs[ptr] {
+				if o.cfg.SortExtentQueue == ExtentQueueSortNone {
+					treeID = itemKey.TreeID
+				}
 				orderedQueue = append(orderedQueue, itemToVisit{
 					keyAndTree: itemKey,
 					SortTreeID: treeID,
@@ -361,9 +648,24 @@ func (o *rebuilder) sortSettledItemQueue(ctx context.Context, unorderedQueue con
 	}
 
 	dlog.Infof(ctx, "... sorting %d queue entries...", len(orderedQueue))
-	sort.Slice(orderedQueue, func(i, j int) bool {
-		return orderedQueue[i].Compare(orderedQueue[j]) < 0
-	})
+	switch o.cfg.SortExtentQueue {
+	case ExtentQueueSortRefCount:
+		refCounts := make(map[btrfsprim.ObjID]int)
+		for _, entry := range orderedQueue {
+			refCounts[entry.SortTreeID]++
+		}
+		sort.Slice(orderedQueue, func(i, j int) bool {
+			a, b := orderedQueue[i], orderedQueue[j]
+			if d := refCounts[a.SortTreeID] - refCounts[b.SortTreeID]; d != 0 {
+				return d > 0
+			}
+			return a.Compare(b) < 0
+		})
+	default:
+		sort.Slice(orderedQueue, func(i, j int) bool {
+			return orderedQueue[i].Compare(orderedQueue[j]) < 0
+		})
+	}
 
 	dlog.Info(ctx, "... done")
 
@@ -383,6 +685,10 @@ func (s processItemStats) String() string {
 		s.Portion, s.NumAugments, s.NumFailures, s.NumAugmentTrees)
 }
 
+// itemBufferNodes is how many nodes' worth of items
+// processSettledItemQueue reads ahead.
+var itemBufferNodes = textui.NewTunable("rebuild-trees.item-buffer-nodes", 3)
+
 // processSettledItemQueue drains o.settledItemQueue, filling o.augmentQueue and o.treeQueue.
 func (o *rebuilder) processSettledItemQueue(ctx context.Context) error {
 	ctx = dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.substep", "process-items")
@@ -390,9 +696,16 @@ func (o *rebuilder) processSettledItemQueue(ctx context.Context) error {
 	queue := o.sortSettledItemQueue(ctx, o.settledItemQueue)
 	o.settledItemQueue = make(containers.Set[keyAndTree])
 
+	hitsBefore, missesBefore := o.rebuilt.RebuiltItemsCacheStats()
+	defer func() {
+		hits, misses := o.rebuilt.RebuiltItemsCacheStats()
+		dlog.Infof(ctx, "items cache with --sort-extent-queue=%v: %v hits, %v misses",
+			&o.cfg.SortExtentQueue, hits-hitsBefore, misses-missesBefore)
+	}()
+
 	var progress processItemStats
 	progress.D = len(queue)
-	progressWriter := textui.NewProgress[processItemStats](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second))
+	progressWriter := textui.NewProgress[processItemStats](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
 	progressWriter.Set(progress)
 	defer progressWriter.Done()
 
@@ -403,7 +716,7 @@ func (o *rebuilder) processSettledItemQueue(ctx context.Context) error {
 		itemToVisit
 		Body btrfsitem.Item
 	}
-	itemChan := make(chan keyAndBody, textui.Tunable(300)) // average items-per-node≈100; let's have a buffer of ~3 nodes
+	itemChan := make(chan keyAndBody, itemBufferNodes.Get()*o.itemsPerNode)
 	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{})
 	grp.Go("io", func(ctx context.Context) error {
 		defer close(itemChan)
@@ -451,7 +764,7 @@ func (o *rebuilder) processSettledItemQueue(ctx context.Context) error {
 			ctx := dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.process.item", item.keyAndTree)
 			o.curKey.TreeID = item.TreeID
 			o.curKey.Key.Val = item.Key
-			btrfscheck.HandleItem(ctx, graphCallbacks{o}, item.TreeID, btrfstree.Item{
+			btrfscheck.HandleItem(ctx, graphCallbacks{o}, &o.sb, item.TreeID, btrfstree.Item{
 				Key:  item.Key,
 				Body: item.Body,
 			})
@@ -475,40 +788,19 @@ func (o *rebuilder) processAugmentQueue(ctx context.Context) error {
 	ctx = dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.substep", "apply-augments")
 
 	resolvedAugments := make(map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr], len(o.augmentQueue))
-	var progress textui.Portion[int]
-	for _, treeID := range maps.SortedKeys(o.augmentQueue) {
+	for _, treeID := range sortedTreeIDs(o.augmentQueue, o.cfg.PriorityTrees) {
 		if err := ctx.Err(); err != nil {
 			return err
 		}
 		ctx := dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.augment.tree", treeID)
 		resolvedAugments[treeID] = o.resolveTreeAugments(ctx, treeID)
-		progress.D += len(resolvedAugments[treeID])
 	}
 	o.augmentQueue = make(map[btrfsprim.ObjID]*treeAugmentQueue)
 	o.numAugments = 0
 	o.numAugmentFailures = 0
 	runtime.GC()
 
-	progressWriter := textui.NewProgress[textui.Portion[int]](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second))
-	progressWriter.Set(progress)
-	defer progressWriter.Done()
-
-	ctx = dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.substep.progress", &progress)
-	for _, treeID := range maps.SortedKeys(resolvedAugments) {
-		ctx := dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.augment.tree", treeID)
-		for _, nodeAddr := range maps.SortedKeys(resolvedAugments[treeID]) {
-			if err := ctx.Err(); err != nil {
-				return err
-			}
-			// This will call o.AddedItem as nescessary, which
-			// inserts to o.addedItemQueue.
-			discardErr(o.rebuilt.RebuiltTree(ctx, treeID)).RebuiltAddRoot(ctx, nodeAddr)
-			progress.N++
-			progressWriter.Set(progress)
-		}
-	}
-
-	return nil
+	return o.applyAugments(ctx, resolvedAugments)
 }
 
 func (o *rebuilder) enqueueRetry(ifTreeID btrfsprim.ObjID) {
@@ -531,11 +823,6 @@ func (o *rebuilder) resolveTreeAugments(ctx context.Context, treeID btrfsprim.Ob
 	// the items from your return set.  The same item may appear in multiple
 	// of the input lists.
 
-	type ChoiceInfo struct {
-		Count      int
-		Distance   int
-		Generation btrfsprim.Generation
-	}
 	choices := make(map[btrfsvol.LogicalAddr]ChoiceInfo)
 	// o.augmentQueue[treeID].zero is optimized storage for lists
 	// with zero items.  Go ahead and free that memory up.
@@ -570,6 +857,13 @@ func (o *rebuilder) resolveTreeAugments(ctx context.Context, treeID btrfsprim.Ob
 		}
 	}
 
+	markNewest(choices, o.augmentQueue[treeID].multi)
+	rejected := o.rejectLowConfidence(treeID, choices)
+	for _, item := range maps.SortedKeys(rejected) {
+		dlog.Infof(ctx, "not choosing %v: confidence %.3f is below the minimum %v",
+			item, choices[item].Confidence(), o.cfg.MinConfidence)
+	}
+
 	// > Example 1: Given the input lists
 	// >
 	// >     0: [A, B]
@@ -638,6 +932,7 @@ func (o *rebuilder) resolveTreeAugments(ctx context.Context, treeID btrfsprim.Ob
 
 	ret := make(containers.Set[btrfsvol.LogicalAddr])
 	illegal := make(containers.Set[btrfsvol.LogicalAddr]) // cannot-be-accepted and already-accepted
+	illegal.InsertFrom(rejected)
 	accept := func(item btrfsvol.LogicalAddr) {
 		ret.Insert(item)
 		for _, list := range o.augmentQueue[treeID].multi {
@@ -652,6 +947,41 @@ func (o *rebuilder) resolveTreeAugments(ctx context.Context, treeID btrfsprim.Ob
 		}
 	}
 
+	// The greedy pass may leave lists unrepresented that a
+	// different accept-set would have represented; optionally
+	// search for a better one.
+	if o.cfg.AugmentBacktrackLimit > 0 {
+		rank := make(map[btrfsvol.LogicalAddr]int, len(sortedItems))
+		for i, item := range sortedItems {
+			rank[item] = i
+		}
+		lists := make([]containers.Set[btrfsvol.LogicalAddr], 0, len(o.augmentQueue[treeID].single)+len(o.augmentQueue[treeID].multi))
+		for _, choice := range o.augmentQueue[treeID].single {
+			if !rejected.Has(choice) {
+				lists = append(lists, containers.NewSet[btrfsvol.LogicalAddr](choice))
+			}
+		}
+		for _, list := range o.augmentQueue[treeID].multi {
+			if list.HasAny(rejected) {
+				filtered := make(containers.Set[btrfsvol.LogicalAddr], len(list))
+				filtered.InsertFrom(list)
+				filtered.DeleteFrom(rejected)
+				if len(filtered) == 0 {
+					continue
+				}
+				list = filtered
+			}
+			lists = append(lists, list)
+		}
+		var stats backtrackStats
+		ret, stats = backtrackAugments(lists, rank, ret, o.cfg.AugmentBacktrackLimit,
+			func(before, after []btrfsvol.LogicalAddr, numLists, greedyScore, newScore int) {
+				dlog.Infof(ctx, "backtracking: chose %v instead of %v, representing %v instead of %v of %v lists",
+					after, before, newScore, greedyScore, numLists)
+			})
+		logBacktrackStats(ctx, stats)
+	}
+
 	// Log our result
 	wantKeys := append(
 		maps.Keys(o.augmentQueue[treeID].single),
@@ -0,0 +1,189 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/datawire/dlib/dgroup"
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/slices"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// applyWorkers returns how many workers to apply `numFamilies`
+// families of augments with; see Config.Threads.
+func applyWorkers(threads, numFamilies int) int {
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	return slices.Max(1, slices.Min(threads, numFamilies, btrfsutil.RebuiltMaxConcurrency()))
+}
+
+// A stealQueue is a fixed set of work, divided among workers; each
+// worker takes work from the front of its own deque, and once that
+// is empty, steals from the back of the other workers' deques.  So a
+// worker that is stuck on one large piece of work (such as a tree
+// whose index is being rebuilt) doesn't hold up the rest of its
+// share.
+type stealQueue[T any] struct {
+	deques []stealDeque[T]
+}
+
+type stealDeque[T any] struct {
+	mu    sync.Mutex
+	items []T
+}
+
+// newStealQueue deals out `work` (which should be sorted
+// largest-first) round-robin to `workers` deques.
+func newStealQueue[T any](workers int, work []T) *stealQueue[T] {
+	q := &stealQueue[T]{
+		deques: make([]stealDeque[T], workers),
+	}
+	for i, item := range work {
+		d := &q.deques[i%workers]
+		d.items = append(d.items, item)
+	}
+	return q
+}
+
+// Next returns the next piece of work for worker `w`, or false if
+// there is no work left anywhere.
+func (q *stealQueue[T]) Next(w int) (item T, stolen, ok bool) {
+	own := &q.deques[w]
+	own.mu.Lock()
+	if len(own.items) > 0 {
+		item = own.items[0]
+		own.items = own.items[1:]
+		own.mu.Unlock()
+		return item, false, true
+	}
+	own.mu.Unlock()
+	for i := 1; i < len(q.deques); i++ {
+		victim := &q.deques[(w+i)%len(q.deques)]
+		victim.mu.Lock()
+		if n := len(victim.items); n > 0 {
+			item = victim.items[n-1]
+			victim.items = victim.items[:n-1]
+			victim.mu.Unlock()
+			return item, true, true
+		}
+		victim.mu.Unlock()
+	}
+	return item, false, false
+}
+
+// syncPortion is a textui.Portion that is safe to update from
+// multiple goroutines while it is also being logged.
+type syncPortion struct {
+	mu  sync.Mutex
+	val textui.Portion[int]
+}
+
+func (p *syncPortion) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.val.String()
+}
+
+// applyAugments adds each of the resolved augments to its tree.
+//
+// Trees are independent of each other except for within a family
+// (see btrfsutil.RebuiltTreeFamilies), so the families are spread
+// across a pool of Config.Threads workers, that steal families from each
+// other as they run out.  Within a family, the trees and their roots
+// are added in sorted order, just as if it were done serially, so the
+// resulting roots do not depend on the scheduling.
+//
+// Adding a root calls o.AddedItem and o.AddedRoot, which are guarded
+// by o.addedItemMu.
+func (o *rebuilder) applyAugments(ctx context.Context, resolvedAugments map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]) error {
+	// Looking up the trees may call back in to the rebuilder
+	// (o.LookupRoot, o.LookupUUID), which is not safe to do
+	// concurrently, so do it serially before spinning up the
+	// workers.
+	trees := make(map[btrfsprim.ObjID]*btrfsutil.RebuiltTree, len(resolvedAugments))
+	var total int
+	for _, treeID := range sortedTreeIDs(resolvedAugments, o.cfg.PriorityTrees) {
+		if len(resolvedAugments[treeID]) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		o.curKey.TreeID = treeID
+		o.curKey.Key.OK = false
+		tree, err := o.rebuilt.RebuiltTree(ctx, treeID)
+		if err != nil {
+			dlog.Errorf(ctx, "tree %v: cannot apply %v augments: %v", treeID, len(resolvedAugments[treeID]), err)
+			continue
+		}
+		trees[treeID] = tree
+		total += len(resolvedAugments[treeID])
+	}
+
+	families := btrfsutil.RebuiltTreeFamilies(trees)
+	weight := func(family []*btrfsutil.RebuiltTree) int {
+		var n int
+		for _, tree := range family {
+			n += len(resolvedAugments[tree.ID])
+		}
+		return n
+	}
+	sort.SliceStable(families, func(i, j int) bool {
+		return weight(families[i]) > weight(families[j])
+	})
+	workers := applyWorkers(o.cfg.Threads, len(families))
+	queue := newStealQueue(workers, families)
+
+	progress := &syncPortion{val: textui.Portion[int]{D: total}}
+	progressWriter := textui.NewProgress[textui.Portion[int]](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
+	progressWriter.Set(progress.val)
+	defer progressWriter.Done()
+	ctx = dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.substep.progress", progress)
+
+	dlog.Debugf(ctx, "applying augments to %v trees in %v families with %v workers",
+		len(trees), len(families), workers)
+	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{})
+	for w := 0; w < workers; w++ {
+		w := w
+		grp.Go(fmt.Sprintf("worker-%d", w), func(ctx context.Context) error {
+			for {
+				family, stolen, ok := queue.Next(w)
+				if !ok {
+					return nil
+				}
+				if stolen {
+					dlog.Tracef(ctx, "stole family of tree %v", family[0].ID)
+				}
+				for _, tree := range family {
+					ctx := dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.augment.tree", tree.ID)
+					for _, nodeAddr := range maps.SortedKeys(resolvedAugments[tree.ID]) {
+						if err := ctx.Err(); err != nil {
+							return err
+						}
+						tree.RebuiltAddRoot(ctx, nodeAddr)
+						progress.mu.Lock()
+						progress.val.N++
+						progressWriter.Set(progress.val)
+						progress.mu.Unlock()
+					}
+				}
+			}
+		})
+	}
+	return grp.Wait()
+}
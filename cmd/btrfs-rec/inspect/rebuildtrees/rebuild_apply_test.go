@@ -0,0 +1,103 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStealQueue(t *testing.T) {
+	t.Parallel()
+
+	// Serially: a worker takes its own work front-first, then
+	// steals from the back of the others'.
+	q := newStealQueue(2, []int{1, 2, 3, 4, 5})
+	var order []int
+	var steals []bool
+	for {
+		item, stolen, ok := q.Next(0)
+		if !ok {
+			break
+		}
+		order = append(order, item)
+		steals = append(steals, stolen)
+	}
+	assert.Equal(t, []int{1, 3, 5, 4, 2}, order)
+	assert.Equal(t, []bool{false, false, false, true, true}, steals)
+	_, _, ok := q.Next(1)
+	assert.False(t, ok)
+
+	// Concurrently: while worker 0 is stuck on its first piece
+	// of work, the others drain its deque, and every piece of work
+	// is done exactly once.
+	const workers = 4
+	work := make([]int, 100)
+	for i := range work {
+		work[i] = i
+	}
+	q = newStealQueue(workers, work)
+	var mu sync.Mutex
+	var done []int
+	var stolenCnt int
+	stuck := make(chan struct{})
+	var unstick sync.Once
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first := true
+			for {
+				item, stolen, ok := q.Next(w)
+				if !ok {
+					if w != 0 {
+						// Everything else is done; let worker 0 finish.
+						unstick.Do(func() { close(stuck) })
+					}
+					return
+				}
+				if w == 0 && first {
+					<-stuck
+				}
+				first = false
+				mu.Lock()
+				done = append(done, item)
+				if stolen {
+					stolenCnt++
+				}
+				mu.Unlock()
+			}
+		}()
+		if w == 0 {
+			// Make sure that worker 0 has taken its first piece of
+			// work before starting the others.
+			for {
+				q.deques[0].mu.Lock()
+				n := len(q.deques[0].items)
+				q.deques[0].mu.Unlock()
+				if n < len(work)/workers {
+					break
+				}
+			}
+		}
+	}
+	wg.Wait()
+	sort.Ints(done)
+	assert.Equal(t, work, done)
+	assert.GreaterOrEqual(t, stolenCnt, len(work)/workers-1)
+}
+
+func TestApplyWorkers(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, 2, applyWorkers(2, 10))
+	assert.Equal(t, 1, applyWorkers(2, 1))
+	assert.Equal(t, 1, applyWorkers(2, 0))
+	assert.Less(t, applyWorkers(1000, 1000), 1000) // clamped to the cache sizes
+}
@@ -0,0 +1,221 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"context"
+	"sort"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// backtrackMaxSteps bounds the search of a single cluster, in case
+// the cluster's structure defeats the pruning; if it is reached, the
+// best accept-set found so far is used.
+var backtrackMaxSteps = textui.NewTunable("rebuild-trees.backtrack-max-steps", 1<<20)
+
+type backtrackStats struct {
+	NumClusters     int // clusters in which the greedy result left a list unrepresented
+	NumSearched     int // of those, clusters that were small enough to search
+	NumImproved     int // of those, clusters in which the search found a better result
+	NumGaveUp       int // of those searched, clusters whose search hit backtrackMaxSteps
+	ListsRecovered  int // additional lists represented thanks to the search
+	LargestSearched int
+}
+
+// backtrackAugments improves on `greedy`, which is a legal accept-set
+// for `lists` (no list contains more than one accepted item), by
+// exhaustively searching each small cluster of conflicting items for
+// an accept-set that represents more lists.  `rank` gives the greedy
+// preference order of the items (lower is better); among equally-good
+// accept-sets, the one that the greedy algorithm would have chosen is
+// kept.
+func backtrackAugments(
+	lists []containers.Set[btrfsvol.LogicalAddr],
+	rank map[btrfsvol.LogicalAddr]int,
+	greedy containers.Set[btrfsvol.LogicalAddr],
+	limit int,
+	logChange func(before, after []btrfsvol.LogicalAddr, numLists, greedyScore, newScore int),
+) (containers.Set[btrfsvol.LogicalAddr], backtrackStats) {
+	var stats backtrackStats
+
+	// Group the items in to clusters, with union-find.
+	parent := make(map[btrfsvol.LogicalAddr]btrfsvol.LogicalAddr, len(rank))
+	var find func(btrfsvol.LogicalAddr) btrfsvol.LogicalAddr
+	find = func(x btrfsvol.LogicalAddr) btrfsvol.LogicalAddr {
+		p, ok := parent[x]
+		if !ok || p == x {
+			return x
+		}
+		root := find(p)
+		parent[x] = root
+		return root
+	}
+	for _, list := range lists {
+		var first btrfsvol.LogicalAddr
+		for i, item := range maps.SortedKeys(list) {
+			if i == 0 {
+				first = find(item)
+				continue
+			}
+			if root := find(item); root != first {
+				parent[root] = first
+			}
+		}
+	}
+	clusterLists := make(map[btrfsvol.LogicalAddr][]int)
+	for i, list := range lists {
+		root := find(list.TakeOne())
+		clusterLists[root] = append(clusterLists[root], i)
+	}
+
+	ret := make(containers.Set[btrfsvol.LogicalAddr], len(greedy))
+	ret.InsertFrom(greedy)
+	for _, root := range maps.SortedKeys(clusterLists) {
+		listIdxs := clusterLists[root]
+		greedyScore := 0
+		itemSet := make(containers.Set[btrfsvol.LogicalAddr])
+		for _, i := range listIdxs {
+			if lists[i].HasAny(greedy) {
+				greedyScore++
+			}
+			itemSet.InsertFrom(lists[i])
+		}
+		if greedyScore == len(listIdxs) {
+			continue
+		}
+		stats.NumClusters++
+		if len(itemSet) > limit {
+			continue
+		}
+		stats.NumSearched++
+		if len(itemSet) > stats.LargestSearched {
+			stats.LargestSearched = len(itemSet)
+		}
+
+		items := maps.Keys(itemSet)
+		sort.Slice(items, func(i, j int) bool {
+			return rank[items[i]] < rank[items[j]]
+		})
+		best, bestScore, gaveUp := searchCluster(lists, listIdxs, items, greedyScore)
+		if gaveUp {
+			stats.NumGaveUp++
+		}
+		if best == nil {
+			continue
+		}
+		stats.NumImproved++
+		stats.ListsRecovered += bestScore - greedyScore
+		before := maps.SortedKeys(itemSet.Intersection(greedy))
+		for _, item := range items {
+			ret.Delete(item)
+		}
+		ret.InsertFrom(best)
+		if logChange != nil {
+			logChange(before, maps.SortedKeys(best), len(listIdxs), greedyScore, bestScore)
+		}
+	}
+	return ret, stats
+}
+
+// searchCluster does a branch-and-bound search of the accept-sets of
+// `items` (which are sorted by preference) for one that represents
+// more than `minScore` of the lists `listIdxs`.  It returns nil if
+// there is none.
+//
+// Items are tried for inclusion before exclusion, in preference
+// order, so that the first complete accept-set visited is the greedy
+// one, and ties are broken the same way that the greedy algorithm
+// breaks them.
+func searchCluster(
+	lists []containers.Set[btrfsvol.LogicalAddr],
+	listIdxs []int,
+	items []btrfsvol.LogicalAddr,
+	minScore int,
+) (best containers.Set[btrfsvol.LogicalAddr], bestScore int, gaveUp bool) {
+	// itemLists[i] is the (cluster-local) indexes of the lists
+	// that contain items[i]; listMax[l] is the highest index of an
+	// item in list l.
+	itemLists := make([][]int, len(items))
+	listMax := make([]int, len(listIdxs))
+	for l, i := range listIdxs {
+		for j, item := range items {
+			if lists[i].Has(item) {
+				itemLists[j] = append(itemLists[j], l)
+				listMax[l] = j
+			}
+		}
+	}
+
+	bestScore = minScore
+	listCount := make([]int, len(listIdxs))
+	chosen := make([]bool, len(items))
+	steps := 0
+	var search func(j, score int)
+	search = func(j, score int) {
+		steps++
+		if steps > backtrackMaxSteps.Get() {
+			gaveUp = true
+			return
+		}
+		// Bound: every unrepresented list that still has a
+		// candidate might become represented.
+		possible := score
+		for l, cnt := range listCount {
+			if cnt == 0 && listMax[l] >= j {
+				possible++
+			}
+		}
+		if possible <= bestScore {
+			return
+		}
+		if j == len(items) {
+			bestScore = score
+			best = make(containers.Set[btrfsvol.LogicalAddr])
+			for k, c := range chosen {
+				if c {
+					best.Insert(items[k])
+				}
+			}
+			return
+		}
+		legal := true
+		for _, l := range itemLists[j] {
+			if listCount[l] > 0 {
+				legal = false
+				break
+			}
+		}
+		if legal {
+			chosen[j] = true
+			for _, l := range itemLists[j] {
+				listCount[l]++
+			}
+			search(j+1, score+len(itemLists[j]))
+			for _, l := range itemLists[j] {
+				listCount[l]--
+			}
+			chosen[j] = false
+		}
+		search(j+1, score)
+	}
+	search(0, 0)
+	return best, bestScore, gaveUp
+}
+
+func logBacktrackStats(ctx context.Context, stats backtrackStats) {
+	if stats.NumClusters == 0 {
+		return
+	}
+	dlog.Infof(ctx, "backtracking: %v conflicting clusters; searched %v (largest: %v nodes; %v gave up early); "+
+		"improved %v, representing %v more lists than greedy",
+		stats.NumClusters, stats.NumSearched, stats.LargestSearched, stats.NumGaveUp,
+		stats.NumImproved, stats.ListsRecovered)
+}
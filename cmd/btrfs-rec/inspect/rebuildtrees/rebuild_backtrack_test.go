@@ -0,0 +1,69 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func TestBacktrackAugments(t *testing.T) {
+	t.Parallel()
+	const (
+		A btrfsvol.LogicalAddr = 0x1000 * (iota + 1)
+		B
+		C
+		D
+		E
+	)
+	set := containers.NewSet[btrfsvol.LogicalAddr]
+	type testcase struct {
+		Lists    []containers.Set[btrfsvol.LogicalAddr]
+		Greedy   containers.Set[btrfsvol.LogicalAddr]
+		Limit    int
+		Exp      containers.Set[btrfsvol.LogicalAddr]
+		ExpStats backtrackStats
+	}
+	testcases := map[string]testcase{
+		"greedy-is-optimal": {
+			// Example 2 from resolveTreeAugments.
+			Lists:    []containers.Set[btrfsvol.LogicalAddr]{set(A, B), set(A), set(B)},
+			Greedy:   set(A),
+			Limit:    10,
+			Exp:      set(A),
+			ExpStats: backtrackStats{NumClusters: 1, NumSearched: 1, LargestSearched: 2},
+		},
+		"improved": {
+			// Greedy takes A (ranked first), which excludes
+			// both B and C.
+			Lists:    []containers.Set[btrfsvol.LogicalAddr]{set(A, B), set(A, C), set(B), set(C), set(D, E)},
+			Greedy:   set(A, D),
+			Limit:    10,
+			Exp:      set(B, C, D),
+			ExpStats: backtrackStats{NumClusters: 1, NumSearched: 1, NumImproved: 1, ListsRecovered: 2, LargestSearched: 3},
+		},
+		"over-limit": {
+			Lists:    []containers.Set[btrfsvol.LogicalAddr]{set(A, B), set(A, C), set(B), set(C)},
+			Greedy:   set(A),
+			Limit:    2,
+			Exp:      set(A),
+			ExpStats: backtrackStats{NumClusters: 1},
+		},
+	}
+	rank := map[btrfsvol.LogicalAddr]int{A: 0, B: 1, C: 2, D: 3, E: 4}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			act, stats := backtrackAugments(tc.Lists, rank, tc.Greedy, tc.Limit, nil)
+			assert.Equal(t, tc.Exp, act)
+			assert.Equal(t, tc.ExpStats, stats)
+		})
+	}
+}
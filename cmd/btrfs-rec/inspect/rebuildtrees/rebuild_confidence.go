@@ -0,0 +1,160 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"context"
+	"sort"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// A ChoiceInfo is what is known about a candidate root when choosing
+// which candidates to add to a tree.
+type ChoiceInfo struct {
+	// Count is the number of want-lists that the candidate
+	// appears in.
+	Count int
+	// Distance is how many COW-snapshots down the tree is from
+	// the owner of the candidate.
+	Distance int
+	// Generation is the generation of the candidate.
+	Generation btrfsprim.Generation
+	// Newest is whether the candidate has at least as high a
+	// generation as every other candidate that it shares a
+	// want-list with.
+	Newest bool
+}
+
+// Confidence returns a score in the range (0, 1] of how confident we
+// are that the candidate belongs in the tree.  It is the product of
+//
+//   - support:  Count/(Count+1); a candidate that is wanted by a
+//     single list scores 1/2, and the score approaches 1 as more
+//     lists want it.
+//   - distance: 1/(Distance+1); a node owned by the tree itself
+//     scores 1, a node owned by the tree's parent scores 1/2, and so
+//     on.
+//   - recency:  1 if Newest, or 1/2 if not; only the sign of a
+//     generation delta is meaningful, so the magnitude of the
+//     generation doesn't matter.
+func (c ChoiceInfo) Confidence() float64 {
+	support := float64(c.Count) / float64(c.Count+1)
+	distance := 1 / float64(c.Distance+1)
+	recency := 1.0
+	if !c.Newest {
+		recency = 0.5 //nolint:gomnd // See the doc comment.
+	}
+	return support * distance * recency
+}
+
+// A LowConfidenceCandidate is a candidate root that was not added to
+// a tree because its confidence was below Config.MinConfidence.
+type LowConfidenceCandidate struct {
+	TreeID     btrfsprim.ObjID
+	Node       btrfsvol.LogicalAddr
+	ChoiceInfo ChoiceInfo
+	Confidence float64
+	// Wants is the want-lists that the candidate appears in.
+	Wants []string
+}
+
+// markNewest sets .Newest on each of `choices`, given the want-lists
+// that they appear in; lists of a single candidate have no
+// competitors, so they don't need to be given.
+func markNewest(choices map[btrfsvol.LogicalAddr]ChoiceInfo, multi map[want]containers.Set[btrfsvol.LogicalAddr]) {
+	for item, info := range choices {
+		info.Newest = true
+		choices[item] = info
+	}
+	for _, list := range multi {
+		var maxGen btrfsprim.Generation
+		for item := range list {
+			if gen := choices[item].Generation; gen > maxGen {
+				maxGen = gen
+			}
+		}
+		for item := range list {
+			if info := choices[item]; info.Generation < maxGen {
+				info.Newest = false
+				choices[item] = info
+			}
+		}
+	}
+}
+
+// rejectLowConfidence returns the candidates of `choices` whose
+// confidence is below Config.MinConfidence, recording them in
+// o.lowConfidence.
+func (o *rebuilder) rejectLowConfidence(
+	treeID btrfsprim.ObjID,
+	choices map[btrfsvol.LogicalAddr]ChoiceInfo,
+) containers.Set[btrfsvol.LogicalAddr] {
+	rejected := make(containers.Set[btrfsvol.LogicalAddr])
+	if o.cfg.MinConfidence <= 0 {
+		return rejected
+	}
+	queue := o.augmentQueue[treeID]
+	for _, item := range maps.SortedKeys(choices) {
+		info := choices[item]
+		conf := info.Confidence()
+		if conf >= o.cfg.MinConfidence {
+			continue
+		}
+		rejected.Insert(item)
+		var wants []string
+		for wantKey, choice := range queue.single {
+			if choice == item {
+				wants = append(wants, wantKey.String())
+			}
+		}
+		for wantKey, list := range queue.multi {
+			if list.Has(item) {
+				wants = append(wants, wantKey.String())
+			}
+		}
+		sort.Strings(wants)
+		if o.lowConfidence == nil {
+			o.lowConfidence = make(map[keyAndAddr]LowConfidenceCandidate)
+		}
+		o.lowConfidence[keyAndAddr{TreeID: treeID, Node: item}] = LowConfidenceCandidate{
+			TreeID:     treeID,
+			Node:       item,
+			ChoiceInfo: info,
+			Confidence: conf,
+			Wants:      wants,
+		}
+	}
+	return rejected
+}
+
+type keyAndAddr struct {
+	TreeID btrfsprim.ObjID
+	Node   btrfsvol.LogicalAddr
+}
+
+// LowConfidenceReport returns the candidate roots that were not added
+// because of Config.MinConfidence (and that were not later added anyway),
+// sorted by tree and then by node address.
+func (o *rebuilder) LowConfidenceReport(ctx context.Context) []LowConfidenceCandidate {
+	ret := make([]LowConfidenceCandidate, 0, len(o.lowConfidence))
+	roots := o.rebuilt.RebuiltListRoots(ctx)
+	for _, cand := range o.lowConfidence {
+		if roots[cand.TreeID].Has(cand.Node) {
+			continue
+		}
+		ret = append(ret, cand)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].TreeID != ret[j].TreeID {
+			return ret[i].TreeID < ret[j].TreeID
+		}
+		return ret[i].Node < ret[j].Node
+	})
+	return ret
+}
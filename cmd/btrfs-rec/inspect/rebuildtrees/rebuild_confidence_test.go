@@ -0,0 +1,40 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func TestConfidence(t *testing.T) {
+	t.Parallel()
+	const (
+		A btrfsvol.LogicalAddr = 0x1000 * (iota + 1)
+		B
+		C
+	)
+	choices := map[btrfsvol.LogicalAddr]ChoiceInfo{
+		A: {Count: 3, Distance: 0, Generation: 10},
+		B: {Count: 1, Distance: 0, Generation: 5},
+		C: {Count: 1, Distance: 1, Generation: 7},
+	}
+	markNewest(choices, map[want]containers.Set[btrfsvol.LogicalAddr]{
+		{ObjectID: 1}: containers.NewSet[btrfsvol.LogicalAddr](A, B),
+		{ObjectID: 2}: containers.NewSet[btrfsvol.LogicalAddr](B, C),
+	})
+	assert.True(t, choices[A].Newest)
+	assert.False(t, choices[B].Newest)
+	assert.True(t, choices[C].Newest)
+
+	assert.InDelta(t, 0.75, choices[A].Confidence(), 1e-9)
+	assert.InDelta(t, 0.25, choices[B].Confidence(), 1e-9)
+	assert.InDelta(t, 0.25, choices[C].Confidence(), 1e-9)
+	assert.InDelta(t, 1.0, ChoiceInfo{Count: 1 << 30, Newest: true}.Confidence(), 1e-6)
+}
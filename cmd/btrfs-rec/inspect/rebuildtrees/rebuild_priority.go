@@ -0,0 +1,68 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"sort"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+// A priority class; lower classes are rebuilt first.
+const (
+	priorityCore = iota
+	priorityUser
+	priorityInternal
+	prioritySubvol
+)
+
+// treePriority returns which class a tree is rebuilt in:
+//
+//  1. The core trees that everything else is found through: the
+//     ROOT_TREE, the CHUNK_TREE, the BLOCK_GROUP_TREE, and the
+//     UUID_TREE (which resolves snapshot parents).
+//  2. The trees in Config.PriorityTrees.
+//  3. The other internal trees (EXTENT_TREE, CSUM_TREE, ...).
+//  4. Bulk subvolume trees.
+//
+// Dependency constraints don't need to be handled here: the
+// RebuiltForrest always loads a tree's parent before the tree itself,
+// so rebuilding a snapshot early also rebuilds its ancestors early.
+func treePriority(treeID btrfsprim.ObjID, user containers.Set[btrfsprim.ObjID]) int {
+	switch {
+	case treeID == btrfsprim.ROOT_TREE_OBJECTID,
+		treeID == btrfsprim.CHUNK_TREE_OBJECTID,
+		treeID == btrfsprim.BLOCK_GROUP_TREE_OBJECTID,
+		treeID == btrfsprim.UUID_TREE_OBJECTID:
+		return priorityCore
+	case user.Has(treeID):
+		return priorityUser
+	case treeID == btrfsprim.FS_TREE_OBJECTID,
+		treeID >= btrfsprim.FIRST_FREE_OBJECTID && treeID <= btrfsprim.LAST_FREE_OBJECTID:
+		return prioritySubvol
+	default:
+		return priorityInternal
+	}
+}
+
+// sortedTreeIDs returns the keys of a tree-ID-keyed map (or set) in
+// the order that they should be processed: by treePriority (given
+// Config.PriorityTrees), then by tree ID.
+func sortedTreeIDs[V any](m map[btrfsprim.ObjID]V, priorityTrees []btrfsprim.ObjID) []btrfsprim.ObjID {
+	user := containers.NewSet(priorityTrees...)
+	ret := make([]btrfsprim.ObjID, 0, len(m))
+	for treeID := range m {
+		ret = append(ret, treeID)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		pi, pj := treePriority(ret[i], user), treePriority(ret[j], user)
+		if pi != pj {
+			return pi < pj
+		}
+		return ret[i] < ret[j]
+	})
+	return ret
+}
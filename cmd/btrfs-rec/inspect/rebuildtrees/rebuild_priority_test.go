@@ -0,0 +1,48 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func TestSortedTreeIDs(t *testing.T) {
+	t.Parallel()
+
+	queue := containers.NewSet[btrfsprim.ObjID](
+		btrfsprim.FS_TREE_OBJECTID,
+		btrfsprim.EXTENT_TREE_OBJECTID,
+		258,
+		257,
+		btrfsprim.UUID_TREE_OBJECTID,
+		btrfsprim.ROOT_TREE_OBJECTID,
+		btrfsprim.CSUM_TREE_OBJECTID,
+	)
+
+	assert.Equal(t, []btrfsprim.ObjID{
+		btrfsprim.ROOT_TREE_OBJECTID,
+		btrfsprim.UUID_TREE_OBJECTID,
+		btrfsprim.EXTENT_TREE_OBJECTID,
+		btrfsprim.CSUM_TREE_OBJECTID,
+		btrfsprim.FS_TREE_OBJECTID,
+		257,
+		258,
+	}, sortedTreeIDs(queue, nil))
+
+	assert.Equal(t, []btrfsprim.ObjID{
+		btrfsprim.ROOT_TREE_OBJECTID,
+		btrfsprim.UUID_TREE_OBJECTID,
+		258,
+		btrfsprim.EXTENT_TREE_OBJECTID,
+		btrfsprim.CSUM_TREE_OBJECTID,
+		btrfsprim.FS_TREE_OBJECTID,
+		257,
+	}, sortedTreeIDs(queue, []btrfsprim.ObjID{258}))
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// SeedRoots sets roots (as from the output of a previous rebuild,
+// perhaps with some roots added by hand) to add to the trees before
+// the rebuild's own augments, so that manual and automatic recovery
+// compose: the rebuild picks up where `roots` leaves off.
+//
+// Roots are only ever added to a tree, never removed, so a seeded
+// root is never discarded by the automatic logic.  A seeded root is
+// added once its tree can be loaded (which, for a subvolume, may not
+// be until the rebuild has found the subvolume's ROOT_ITEM).
+//
+// It must be called before Rebuild, and returns an error if any of
+// the roots is not a node in the scanned graph.
+func (o *rebuilder) SeedRoots(_ context.Context, roots map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]) error {
+	if o.augmentQueue != nil {
+		return fmt.Errorf("cannot seed roots: the rebuild has already started")
+	}
+	for _, treeID := range maps.SortedKeys(roots) {
+		for _, addr := range maps.SortedKeys(roots[treeID]) {
+			if _, ok := o.scan.Graph.Nodes[addr]; !ok {
+				return fmt.Errorf("cannot seed roots: tree %v: node@%v is not in the scanned graph",
+					treeID, addr)
+			}
+		}
+	}
+	o.seedRoots = make(map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr], len(roots))
+	o.pendingSeeds = make(map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr], len(roots))
+	for treeID, addrs := range roots {
+		o.seedRoots[treeID] = containers.NewSet(maps.Keys(addrs)...)
+		o.pendingSeeds[treeID] = containers.NewSet(maps.Keys(addrs)...)
+	}
+	return nil
+}
+
+// applySeedRoots adds each of o.pendingSeeds to its tree, leaving in
+// o.pendingSeeds the ones whose tree can't be loaded yet.  Adding a
+// root calls o.AddedItem, which inserts to o.addedItemQueue.
+func (o *rebuilder) applySeedRoots(ctx context.Context) error {
+	for _, treeID := range sortedTreeIDs(o.pendingSeeds, o.cfg.PriorityTrees) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ctx := dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.rebuild.seed.tree", treeID)
+		o.curKey.TreeID = treeID
+		o.curKey.Key.OK = false
+		tree, err := o.rebuilt.RebuiltTree(ctx, treeID)
+		if err != nil {
+			dlog.Debugf(ctx, "not yet seeding roots: %v", err)
+			continue
+		}
+		for _, addr := range maps.SortedKeys(o.pendingSeeds[treeID]) {
+			dlog.Infof(ctx, "seeding root node@%v", addr)
+			tree.RebuiltAddRoot(ctx, addr)
+		}
+		delete(o.pendingSeeds, treeID)
+	}
+	return nil
+}
+
+// logRootOrigins logs, for each tree, which of its final roots were
+// seeded by SeedRoots (manual) and which were found by the rebuild
+// (automatic).
+func (o *rebuilder) logRootOrigins(ctx context.Context) {
+	for _, treeID := range maps.SortedKeys(o.pendingSeeds) {
+		dlog.Errorf(ctx, "tree %v: could not seed roots %v: the tree could not be loaded",
+			treeID, maps.SortedKeys(o.pendingSeeds[treeID]))
+	}
+	if o.seedRoots == nil {
+		return
+	}
+	roots := o.rebuilt.RebuiltListRoots(ctx)
+	for _, treeID := range sortedTreeIDs(roots, o.cfg.PriorityTrees) {
+		var manual, auto []btrfsvol.LogicalAddr
+		for _, addr := range maps.SortedKeys(roots[treeID]) {
+			if o.seedRoots[treeID].Has(addr) {
+				manual = append(manual, addr)
+			} else {
+				auto = append(auto, addr)
+			}
+		}
+		dlog.Infof(ctx, "tree %v: %v seeded roots %v; %v auto-discovered roots",
+			treeID, len(manual), manual, len(auto))
+		for _, addr := range auto {
+			dlog.Debugf(ctx, "tree %v: auto-discovered root node@%v", treeID, addr)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func TestSeedRoots(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	newRebuilder := func() *rebuilder {
+		o := new(rebuilder)
+		o.scan.Graph.Nodes = map[btrfsvol.LogicalAddr]btrfsutil.GraphNode{
+			0x1000: {Addr: 0x1000, Owner: 257},
+			0x2000: {Addr: 0x2000, Owner: 257},
+		}
+		return o
+	}
+
+	o := newRebuilder()
+	roots := map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]{
+		257: containers.NewSet[btrfsvol.LogicalAddr](0x1000, 0x2000),
+	}
+	assert.NoError(t, o.SeedRoots(ctx, roots))
+	assert.Equal(t, roots, o.seedRoots)
+	assert.Equal(t, roots, o.pendingSeeds)
+	// The pending seeds are drained as they are applied; that must
+	// not affect the record of what was seeded.
+	delete(o.pendingSeeds[257], 0x1000)
+	assert.True(t, o.seedRoots[257].Has(0x1000))
+
+	// A root that isn't in the graph is rejected.
+	o = newRebuilder()
+	assert.Error(t, o.SeedRoots(ctx, map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]{
+		257: containers.NewSet[btrfsvol.LogicalAddr](0x3000),
+	}))
+	assert.Nil(t, o.seedRoots)
+
+	// Seeding after the rebuild has started is rejected.
+	o = newRebuilder()
+	o.augmentQueue = make(map[btrfsprim.ObjID]*treeAugmentQueue)
+	assert.Error(t, o.SeedRoots(ctx, roots))
+}
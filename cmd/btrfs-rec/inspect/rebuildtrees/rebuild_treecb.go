@@ -23,6 +23,8 @@ var _ btrfsutil.RebuiltForrestExtendedCallbacks = forrestCallbacks{}
 
 // AddedItem implements btrfsutil.RebuiltForrestExtendedCallbacks.
 func (o forrestCallbacks) AddedItem(_ context.Context, tree btrfsprim.ObjID, key btrfsprim.Key) {
+	o.addedItemMu.Lock()
+	defer o.addedItemMu.Unlock()
 	o.addedItemQueue.Insert(keyAndTree{
 		TreeID: tree,
 		Key:    key,
@@ -32,6 +34,8 @@ func (o forrestCallbacks) AddedItem(_ context.Context, tree btrfsprim.ObjID, key
 // AddedRoot implements btrfsutil.RebuiltForrestCallbacks.
 func (o forrestCallbacks) AddedRoot(_ context.Context, tree btrfsprim.ObjID, _ btrfsvol.LogicalAddr) {
 	if retries := o.retryItemQueue[tree]; retries != nil {
+		o.addedItemMu.Lock()
+		defer o.addedItemMu.Unlock()
 		o.addedItemQueue.InsertFrom(retries)
 	}
 }
@@ -17,6 +17,7 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
 	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
 type graphCallbacks struct {
@@ -53,9 +54,9 @@ func (o *rebuilder) _want(ctx context.Context, wantKey wantWithTree) (key btrfsp
 
 	// check if we already have it
 
+	cmp := btrfsprim.CompareObjIDType(tgt.ObjectID, tgt.ItemType)
 	key, _, ok = tree.RebuiltAcquireItems(ctx).Search(func(key btrfsprim.Key, _ btrfsutil.ItemPtr) int {
-		key.Offset = 0
-		return tgt.Compare(key)
+		return cmp(key)
 	})
 	tree.RebuiltReleaseItems()
 	if ok {
@@ -69,10 +70,7 @@ func (o *rebuilder) _want(ctx context.Context, wantKey wantWithTree) (key btrfsp
 	}
 	wants := make(containers.Set[btrfsvol.LogicalAddr])
 	tree.RebuiltAcquirePotentialItems(ctx).Subrange(
-		func(k btrfsprim.Key, _ btrfsutil.ItemPtr) int {
-			k.Offset = 0
-			return tgt.Compare(k)
-		},
+		func(k btrfsprim.Key, _ btrfsutil.ItemPtr) int { return cmp(k) },
 		func(_ btrfsprim.Key, v btrfsutil.ItemPtr) bool {
 			wants.InsertFrom(tree.RebuiltLeafToRoots(ctx, v.Node))
 			return true
@@ -120,8 +118,9 @@ func (o *rebuilder) _wantOff(ctx context.Context, wantKey wantWithTree) (ok bool
 		return false
 	}
 	wants := make(containers.Set[btrfsvol.LogicalAddr])
+	cmp := btrfsprim.CompareExact(tgt)
 	tree.RebuiltAcquirePotentialItems(ctx).Subrange(
-		func(k btrfsprim.Key, _ btrfsutil.ItemPtr) int { return tgt.Compare(k) },
+		func(k btrfsprim.Key, _ btrfsutil.ItemPtr) int { return cmp(k) },
 		func(_ btrfsprim.Key, v btrfsutil.ItemPtr) bool {
 			wants.InsertFrom(tree.RebuiltLeafToRoots(ctx, v.Node))
 			return true
@@ -154,12 +153,10 @@ func (o graphCallbacks) WantDirIndex(ctx context.Context, reason string, treeID
 
 	// check if we already have it
 
+	cmp := btrfsprim.CompareObjIDType(tgt.ObjectID, tgt.ItemType)
 	found := false
 	tree.RebuiltAcquireItems(ctx).Subrange(
-		func(key btrfsprim.Key, _ btrfsutil.ItemPtr) int {
-			key.Offset = 0
-			return tgt.Compare(key)
-		},
+		func(key btrfsprim.Key, _ btrfsutil.ItemPtr) int { return cmp(key) },
 		func(_ btrfsprim.Key, ptr btrfsutil.ItemPtr) bool {
 			if itemName, ok := o.scan.Names[ptr]; ok && bytes.Equal(itemName, name) {
 				found = true
@@ -178,10 +175,7 @@ func (o graphCallbacks) WantDirIndex(ctx context.Context, reason string, treeID
 	}
 	wants := make(containers.Set[btrfsvol.LogicalAddr])
 	tree.RebuiltAcquirePotentialItems(ctx).Subrange(
-		func(key btrfsprim.Key, _ btrfsutil.ItemPtr) int {
-			key.Offset = 0
-			return tgt.Compare(key)
-		},
+		func(key btrfsprim.Key, _ btrfsutil.ItemPtr) int { return cmp(key) },
 		func(_ btrfsprim.Key, ptr btrfsutil.ItemPtr) bool {
 			if itemName, ok := o.scan.Names[ptr]; ok && bytes.Equal(itemName, name) {
 				wants.InsertFrom(tree.RebuiltLeafToRoots(ctx, ptr.Node))
@@ -209,17 +203,9 @@ func (o graphCallbacks) _walkRange(
 		ItemType: typ,
 		Offset:   end - 1,
 	}
+	cmp := btrfsprim.CompareRange(min, max)
 	items.Subrange(
-		func(runKey btrfsprim.Key, _ btrfsutil.ItemPtr) int {
-			switch {
-			case min.Compare(runKey) < 0:
-				return 1
-			case max.Compare(runKey) > 0:
-				return -1
-			default:
-				return 0
-			}
-		},
+		func(runKey btrfsprim.Key, _ btrfsutil.ItemPtr) int { return cmp(runKey) },
 		func(runKey btrfsprim.Key, runPtr btrfsutil.ItemPtr) bool {
 			runSizeAndErr, ok := o.scan.Sizes[runPtr]
 			if !ok {
@@ -257,11 +243,90 @@ func (a gap) Compare(b gap) int {
 	return containers.NativeCompare(a.Beg, b.Beg)
 }
 
+// gapTreePool holds the scratch trees used by _wantRange, which is
+// called for every file and every run of checksums, and so would
+// otherwise be a major source of allocations.
+var gapTreePool = containers.Pool[*containers.RBTree[gap]]{
+	Name: "rebuildtrees.gapTreePool",
+	New: func() *containers.RBTree[gap] {
+		return new(containers.RBTree[gap])
+	},
+}
+
+// gapTreeMaxCap is the largest (in nodes; see RBTree.Cap) that a
+// scratch tree may be and still be returned to gapTreePool, so that
+// one pathological file doesn't pin a huge tree in memory.
+var gapTreeMaxCap = textui.NewTunable("rebuild-trees.gap-tree-max-cap", 1024)
+
+func getGapTree() *containers.RBTree[gap] {
+	gaps, _ := gapTreePool.Get()
+	return gaps
+}
+
+func putGapTree(gaps *containers.RBTree[gap]) {
+	if gaps.Cap() > gapTreeMaxCap.Get() {
+		return
+	}
+	gaps.Clear()
+	gapTreePool.Put(gaps)
+}
+
+// subtractGap removes [runBeg,runEnd) from the set of gaps.
+func subtractGap(gaps *containers.RBTree[gap], runBeg, runEnd uint64) {
+	// Find the first gap that overlaps the run.  This could be
+	// done more simply with .Subrange(), but this is a hot path, and
+	// that would require allocating a list of the nodes.
+	node := gaps.Search(func(gap gap) int {
+		switch {
+		case gap.End <= runBeg:
+			return 1
+		case runEnd <= gap.Beg:
+			return -1
+		default:
+			return 0
+		}
+	})
+	if node == nil {
+		return
+	}
+	for prev := node.Prev(); prev != nil && prev.Value.End > runBeg; prev = node.Prev() {
+		node = prev
+	}
+
+	// Remove all of the overlapping gaps.
+	first, last := node, node
+	for next := last.Next(); next != nil && next.Value.Beg < runEnd; next = last.Next() {
+		last = next
+	}
+	gapsBeg, gapsEnd := first.Value.Beg, last.Value.End
+	gaps.DeleteRange(first, last)
+
+	// Put back the parts of them that are outside of the run.
+	if gapsBeg < runBeg {
+		gaps.Insert(gap{
+			Beg: gapsBeg,
+			End: runBeg,
+		})
+	}
+	if gapsEnd > runEnd {
+		gaps.Insert(gap{
+			Beg: runEnd,
+			End: gapsEnd,
+		})
+	}
+}
+
 func (o graphCallbacks) _wantRange(
 	ctx context.Context, reason string,
 	treeID btrfsprim.ObjID, objID btrfsprim.ObjID, typ btrfsprim.ItemType,
 	beg, end uint64,
 ) {
+	// An empty range wants nothing (and with end == 0, end-1
+	// below would wrap around).
+	if end <= beg {
+		return
+	}
+
 	wantKey := wantWithTree{
 		TreeID: treeID,
 		Key: want{
@@ -283,7 +348,8 @@ func (o graphCallbacks) _wantRange(
 	//
 	// Start with a gap of the whole range, then subtract each run
 	// from it.
-	gaps := new(containers.RBTree[gap])
+	gaps := getGapTree()
+	defer putGapTree(gaps)
 	gaps.Insert(gap{
 		Beg: beg,
 		End: end,
@@ -292,43 +358,8 @@ func (o graphCallbacks) _wantRange(
 		ctx,
 		tree.RebuiltAcquireItems(ctx),
 		treeID, objID, typ, beg, end,
-		func(runKey btrfsprim.Key, _ btrfsutil.ItemPtr, runBeg, runEnd uint64) {
-			var overlappingGaps []*containers.RBNode[gap]
-			gaps.Subrange(
-				func(gap gap) int {
-					switch {
-					case gap.End <= runBeg:
-						return 1
-					case runEnd <= gap.Beg:
-						return -1
-					default:
-						return 0
-					}
-				},
-				func(node *containers.RBNode[gap]) bool {
-					overlappingGaps = append(overlappingGaps, node)
-					return true
-				})
-			if len(overlappingGaps) == 0 {
-				return
-			}
-			gapsBeg := overlappingGaps[0].Value.Beg
-			gapsEnd := overlappingGaps[len(overlappingGaps)-1].Value.End
-			for _, gap := range overlappingGaps {
-				gaps.Delete(gap)
-			}
-			if gapsBeg < runBeg {
-				gaps.Insert(gap{
-					Beg: gapsBeg,
-					End: runBeg,
-				})
-			}
-			if gapsEnd > runEnd {
-				gaps.Insert(gap{
-					Beg: runEnd,
-					End: gapsEnd,
-				})
-			}
+		func(_ btrfsprim.Key, _ btrfsutil.ItemPtr, runBeg, runEnd uint64) {
+			subtractGap(gaps, runBeg, runEnd)
 		})
 	tree.RebuiltReleaseItems()
 
@@ -337,6 +368,22 @@ func (o graphCallbacks) _wantRange(
 		return
 	}
 	potentialItems := tree.RebuiltAcquirePotentialItems(ctx)
+	if !potentialItems.SubrangeHas(
+		btrfsprim.Key{ObjectID: objID, ItemType: typ, Offset: 0},
+		btrfsprim.Key{ObjectID: objID, ItemType: typ, Offset: end - 1},
+	) {
+		// Nothing can fill any of the gaps; skip walking for
+		// each gap, and just log them.
+		gaps.Range(func(rbNode *containers.RBNode[gap]) bool {
+			wantKey.Key.OffsetLow = rbNode.Value.Beg
+			wantKey.Key.OffsetHigh = rbNode.Value.End
+			wantCtx := withWant(ctx, logFieldItemWant, reason, wantKey)
+			o.wantAugment(wantCtx, wantKey, nil)
+			return true
+		})
+		tree.RebuiltReleasePotentialItems()
+		return
+	}
 	gaps.Range(func(rbNode *containers.RBNode[gap]) bool {
 		gap := rbNode.Value
 		last := gap.Beg
@@ -410,7 +457,7 @@ func (o graphCallbacks) WantCSum(ctx context.Context, reason string, inodeTree,
 
 	o._wantRange(
 		ctx, reason,
-		btrfsprim.CSUM_TREE_OBJECTID, btrfsprim.EXTENT_CSUM_OBJECTID, btrfsprim.EXTENT_CSUM_KEY,
+		o.cfg.ChecksumTree, btrfsprim.EXTENT_CSUM_OBJECTID, btrfsprim.EXTENT_CSUM_KEY,
 		uint64(roundDown(beg, btrfssum.BlockSize)), uint64(roundUp(end, btrfssum.BlockSize)))
 }
 
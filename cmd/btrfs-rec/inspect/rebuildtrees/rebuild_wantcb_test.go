@@ -0,0 +1,109 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package rebuildtrees
+
+import (
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func listGaps(gaps *containers.RBTree[gap]) []gap {
+	var ret []gap
+	gaps.Range(func(node *containers.RBNode[gap]) bool {
+		ret = append(ret, node.Value)
+		return true
+	})
+	return ret
+}
+
+func TestSubtractGap(t *testing.T) {
+	t.Parallel()
+	type run struct{ Beg, End uint64 }
+	testcases := map[string]struct {
+		Runs []run
+		Exp  []gap
+	}{
+		"none":     {Runs: nil, Exp: []gap{{0, 100}}},
+		"all":      {Runs: []run{{0, 100}}, Exp: nil},
+		"middle":   {Runs: []run{{40, 60}}, Exp: []gap{{0, 40}, {60, 100}}},
+		"ends":     {Runs: []run{{0, 10}, {90, 100}}, Exp: []gap{{10, 90}}},
+		"outside":  {Runs: []run{{200, 300}}, Exp: []gap{{0, 100}}},
+		"overhang": {Runs: []run{{90, 110}}, Exp: []gap{{0, 90}}},
+		"spanning": {Runs: []run{{10, 20}, {30, 40}, {15, 35}}, Exp: []gap{{0, 10}, {40, 100}}},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			// Run it twice through the same tree, to check
+			// that a re-used tree behaves like a new one.
+			gaps := new(containers.RBTree[gap])
+			for i := 0; i < 2; i++ {
+				gaps.Insert(gap{Beg: 0, End: 100})
+				for _, run := range tc.Runs {
+					subtractGap(gaps, run.Beg, run.End)
+				}
+				assert.Equal(t, tc.Exp, listGaps(gaps))
+				gaps.Clear()
+			}
+		})
+	}
+}
+
+// TestWantRangeEmpty checks that an empty range is wanted without
+// touching the rebuilder at all (in particular, that end == 0 doesn't
+// wrap around to wanting the whole key space).
+func TestWantRangeEmpty(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	o := graphCallbacks{rebuilder: nil}
+	for _, rng := range [][2]uint64{{0, 0}, {4096, 4096}, {8192, 4096}} {
+		assert.NotPanics(t, func() {
+			o._wantRange(ctx, "test", btrfsprim.CSUM_TREE_OBJECTID,
+				btrfsprim.EXTENT_CSUM_OBJECTID, btrfsitem.EXTENT_CSUM_KEY,
+				rng[0], rng[1])
+		}, "range [%v, %v)", rng[0], rng[1])
+	}
+}
+
+// BenchmarkWantRangeGaps measures step 1 of _wantRange (building the
+// list of gaps) for a file with many small extents, with and without
+// re-using the tree.
+func BenchmarkWantRangeGaps(b *testing.B) {
+	const (
+		numRuns = 256
+		runSize = 4096
+	)
+	subtractAll := func(gaps *containers.RBTree[gap]) {
+		gaps.Insert(gap{Beg: 0, End: numRuns * runSize})
+		for i := uint64(0); i < numRuns; i++ {
+			// Leave every 8th run missing, so that there
+			// are some gaps left.
+			if i%8 != 0 {
+				subtractGap(gaps, i*runSize, (i+1)*runSize)
+			}
+		}
+	}
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			subtractAll(new(containers.RBTree[gap]))
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			gaps := getGapTree()
+			subtractAll(gaps)
+			putGapTree(gaps)
+		}
+	})
+}
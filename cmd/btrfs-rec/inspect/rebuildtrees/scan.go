@@ -7,7 +7,6 @@ package rebuildtrees
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"github.com/datawire/dlib/dlog"
 
@@ -76,7 +75,7 @@ func ScanDevices(_ctx context.Context, fs *btrfs.FS, nodeList []btrfsvol.Logical
 	progressWriter := textui.NewProgress[textui.Portion[int]](
 		ctx,
 		dlog.LogLevelInfo,
-		textui.Tunable(1*time.Second))
+		textui.ProgressInterval.Get())
 	progressWriter.Set(stats)
 	for _, laddr := range nodeList {
 		if err := ctx.Err(); err != nil {
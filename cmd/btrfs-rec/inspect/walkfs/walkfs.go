@@ -0,0 +1,300 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package walkfs is the guts of the `btrfs-rec inspect walk-fs`
+// command, which lists every path in a subvolume along with how much
+// of it is recoverable.
+package walkfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/dlib/derror"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/filemap"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+type Status int
+
+const (
+	// StatusOK means that everything about the path is
+	// recoverable.
+	StatusOK Status = iota
+	// StatusPartial means that the path's metadata is
+	// recoverable, but some of its content is not: for a file,
+	// Entry.MissingBytes of its data are lost; for a directory,
+	// some of its entries may be lost.
+	StatusPartial
+	// StatusMetadataOnly means that the path's name is known, but
+	// none of its content (and possibly not even its inode) is
+	// recoverable.
+	StatusMetadataOnly
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusPartial:
+		return "partial"
+	case StatusMetadataOnly:
+		return "metadata-only"
+	default:
+		return fmt.Sprintf("Status(%d)", int(s))
+	}
+}
+
+func (s Status) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// An Entry is the recovery status of a single path.
+type Entry struct {
+	Path         string
+	Subvol       btrfsprim.ObjID
+	Inode        btrfsprim.ObjID
+	Type         string // "subvol", or a lower-cased btrfsitem.FileType
+	Size         int64
+	Status       Status
+	MissingBytes int64    `json:",omitempty"`
+	Errs         []string `json:",omitempty"`
+}
+
+// Walk walks the subvolume `treeID` (and any subvolumes nested within
+// it) depth-first, calling fn for each path as soon as its status is
+// known; directories are reported before their contents, and
+// directory contents are sorted by name.  If fn returns an error, the
+// walk is aborted and that error is returned.
+//
+// Only metadata is read; file data is judged recoverable by its
+// extent map (as with `btrfs-rec inspect check-inode`), not by
+// reading it.
+func Walk(ctx context.Context, fs btrfs.ReadableFS, treeID btrfsprim.ObjID, svCfg btrfs.SubvolumeConfig, fn func(Entry) error) error {
+	w := &walker{ctx: ctx, fs: fs, fn: fn}
+	sb, err := fs.Superblock()
+	if err != nil {
+		return err
+	}
+	w.sectorSize = sb.SectorSize
+	return w.walkSubvol("/", btrfs.NewSubvolume(ctx, fs, treeID, svCfg))
+}
+
+type walker struct {
+	ctx        context.Context //nolint:containedctx // only lives for the duration of Walk
+	fs         btrfs.ReadableFS
+	sectorSize uint32
+	fn         func(Entry) error
+}
+
+func errStrings(errs ...error) []string {
+	var ret []string
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if multi, ok := err.(derror.MultiError); ok { //nolint:errorlint // only flattening the top level
+			for _, err := range multi {
+				ret = append(ret, err.Error())
+			}
+		} else {
+			ret = append(ret, err.Error())
+		}
+	}
+	return ret
+}
+
+func (w *walker) walkSubvol(name string, sv *btrfs.Subvolume) error {
+	entry := Entry{
+		Path:   name,
+		Subvol: sv.TreeID,
+		Type:   "subvol",
+	}
+	rootInode, err := sv.GetRootInode()
+	if err != nil {
+		entry.Status = StatusMetadataOnly
+		entry.Errs = errStrings(err)
+		return w.fn(entry)
+	}
+	entry.Inode = rootInode
+	return w.walkDir(entry, sv)
+}
+
+func (w *walker) walkDir(entry Entry, sv *btrfs.Subvolume) error {
+	dir, err := sv.AcquireDir(entry.Inode)
+	if err != nil {
+		entry.Status = StatusMetadataOnly
+		entry.Errs = errStrings(err)
+		return w.fn(entry)
+	}
+	if dir.InodeItem != nil {
+		entry.Size = dir.InodeItem.Size
+	}
+	if len(dir.Errs) > 0 {
+		entry.Status = StatusPartial
+		entry.Errs = errStrings(dir.Errs)
+	}
+	children := dir.ChildrenByName
+	sv.ReleaseDir(entry.Inode)
+
+	if err := w.fn(entry); err != nil {
+		return err
+	}
+	for _, childName := range maps.SortedKeys(children) {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+		if err := w.walkDirEntry(sv, path.Join(entry.Path, childName), children[childName]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *walker) walkDirEntry(sv *btrfs.Subvolume, name string, dirent btrfsitem.DirEntry) error {
+	entry := Entry{
+		Path:   name,
+		Subvol: sv.TreeID,
+		Inode:  dirent.Location.ObjectID,
+		Type:   strings.ToLower(dirent.Type.String()),
+	}
+	switch {
+	case dirent.Type == btrfsitem.FT_DIR && dirent.Location.ItemType == btrfsitem.ROOT_ITEM_KEY:
+		return w.walkSubvol(name, sv.NewChildSubvolume(dirent.Location.ObjectID))
+	case dirent.Location.ItemType != btrfsitem.INODE_ITEM_KEY:
+		entry.Status = StatusMetadataOnly
+		entry.Errs = []string{fmt.Sprintf("%v with location.ItemType=%v", dirent.Type, dirent.Location.ItemType)}
+		return w.fn(entry)
+	case dirent.Type == btrfsitem.FT_DIR:
+		return w.walkDir(entry, sv)
+	default:
+		w.checkFile(&entry, sv)
+		return w.fn(entry)
+	}
+}
+
+func (w *walker) checkFile(entry *Entry, sv *btrfs.Subvolume) {
+	// Subvolume.AcquireFile panics on some malformed inodes;
+	// that should only affect this one path.
+	defer func() {
+		if err := derror.PanicToError(recover()); err != nil {
+			entry.Status = StatusMetadataOnly
+			entry.Errs = append(entry.Errs, err.Error())
+		}
+	}()
+
+	file, err := sv.AcquireFile(entry.Inode)
+	if err != nil {
+		entry.Status = StatusMetadataOnly
+		entry.Errs = errStrings(err)
+		return
+	}
+	defer sv.ReleaseFile(entry.Inode)
+	entry.Errs = errStrings(file.Errs)
+	if file.InodeItem == nil {
+		entry.Status = StatusMetadataOnly
+		return
+	}
+	entry.Size = file.InodeItem.Size
+
+	switch {
+	case entry.Type == "file":
+		ranges := filemap.Map(w.ctx, w.fs, file)
+		entry.MissingBytes = missingBytes(ranges, filemap.Check(ranges, *file.InodeItem, w.sectorSize))
+		for _, rng := range ranges {
+			if rng.Err != nil {
+				entry.Errs = append(entry.Errs, fmt.Sprintf("extent@%v: %v", rng.Beg, rng.Err))
+			}
+		}
+	case entry.Type == "symlink":
+		if _, err := io.Copy(io.Discard, io.NewSectionReader(file, 0, entry.Size)); err != nil {
+			entry.MissingBytes = entry.Size
+			entry.Errs = append(entry.Errs, err.Error())
+		}
+	}
+
+	switch {
+	case entry.Size > 0 && entry.MissingBytes >= entry.Size:
+		entry.Status = StatusMetadataOnly
+	case entry.MissingBytes > 0 || len(entry.Errs) > 0:
+		entry.Status = StatusPartial
+	default:
+		entry.Status = StatusOK
+	}
+}
+
+// missingBytes returns how many bytes of the file within [0, size)
+// are not recoverable: those in extents that could not be checked,
+// plus, if the inode claims more data than the extents hold, the
+// holes (which are then taken to be where that data was).
+func missingBytes(ranges []filemap.Range, check filemap.InodeCheck) int64 {
+	var ret int64
+	for _, rng := range ranges {
+		if rng.Err != nil && rng.Beg < check.Size {
+			ret += min(rng.End, check.Size) - rng.Beg
+		}
+	}
+	if check.Verdict == filemap.VerdictTruncated {
+		if check.HoleBytes > 0 {
+			ret += check.HoleBytes
+		} else {
+			ret += check.NumBytes - check.AllocatedBytes
+		}
+	}
+	return min(ret, check.Size)
+}
+
+func min(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// NewTableWriter returns a function for use with Walk that writes
+// each Entry to `out` as a line of a human-readable table.  It does
+// not buffer, so columns are of fixed width rather than sized to fit
+// their contents.
+func NewTableWriter(out io.Writer) func(Entry) error {
+	header := true
+	return func(entry Entry) error {
+		if header {
+			if _, err := textui.Fprintf(out, "%-13s %12s %8s %-7s %s\n", "STATUS", "SIZE", "INODE", "TYPE", "PATH"); err != nil {
+				return err
+			}
+			header = false
+		}
+		line := textui.Sprintf("%-13v %12v %8v %-7s %q", entry.Status, entry.Size, entry.Inode, entry.Type, entry.Path)
+		if entry.MissingBytes > 0 {
+			line += textui.Sprintf(" (missing %v)", textui.IEC(entry.MissingBytes, "B"))
+		}
+		if len(entry.Errs) > 0 {
+			line += textui.Sprintf(" err=%q", strings.Join(entry.Errs, "; "))
+		}
+		_, err := io.WriteString(out, line+"\n")
+		return err
+	}
+}
+
+// NewJSONLinesWriter returns a function for use with Walk that writes
+// each Entry to `out` as a line of JSON.
+func NewJSONLinesWriter(out io.Writer) func(Entry) error {
+	enc := lowmemjson.NewEncoder(lowmemjson.NewReEncoder(out, lowmemjson.ReEncoderConfig{
+		AllowMultipleValues:   true,
+		Compact:               true,
+		ForceTrailingNewlines: true,
+	}))
+	return func(entry Entry) error {
+		return enc.Encode(entry)
+	}
+}
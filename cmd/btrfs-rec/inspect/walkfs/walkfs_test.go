@@ -0,0 +1,69 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package walkfs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/filemap"
+)
+
+func TestMissingBytes(t *testing.T) {
+	t.Parallel()
+	type testcase struct {
+		Ranges     []filemap.Range
+		Check      filemap.InodeCheck
+		ExpMissing int64
+	}
+	testcases := map[string]testcase{
+		"ok": {
+			Ranges:     []filemap.Range{{Beg: 0, End: 8192}},
+			Check:      filemap.InodeCheck{Size: 8000, Verdict: filemap.VerdictOK},
+			ExpMissing: 0,
+		},
+		"bad-extent": {
+			Ranges:     []filemap.Range{{Beg: 0, End: 4096}, {Beg: 4096, End: 8192, Err: errors.New("oops")}},
+			Check:      filemap.InodeCheck{Size: 8000, Verdict: filemap.VerdictOK},
+			ExpMissing: 8000 - 4096,
+		},
+		"truncated-holes": {
+			Check:      filemap.InodeCheck{Size: 16384, NumBytes: 16384, AllocatedBytes: 8192, HoleBytes: 8192, Verdict: filemap.VerdictTruncated},
+			ExpMissing: 8192,
+		},
+		"truncated-no-holes": {
+			Check:      filemap.InodeCheck{Size: 16384, NumBytes: 12288, AllocatedBytes: 8192, Verdict: filemap.VerdictTruncated},
+			ExpMissing: 4096,
+		},
+		"clamped": {
+			Ranges:     []filemap.Range{{Beg: 0, End: 4096, Err: errors.New("oops")}},
+			Check:      filemap.InodeCheck{Size: 4096, NumBytes: 8192, AllocatedBytes: 4096, HoleBytes: 4096, Verdict: filemap.VerdictTruncated},
+			ExpMissing: 4096,
+		},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.ExpMissing, missingBytes(tc.Ranges, tc.Check))
+		})
+	}
+}
+
+func TestJSONLinesWriter(t *testing.T) {
+	t.Parallel()
+	var out strings.Builder
+	write := NewJSONLinesWriter(&out)
+	require.NoError(t, write(Entry{Path: "/", Subvol: 5, Inode: 256, Type: "subvol", Size: 10}))
+	require.NoError(t, write(Entry{Path: "/a", Subvol: 5, Inode: 257, Type: "file", Size: 8192, Status: StatusPartial, MissingBytes: 4096}))
+	assert.Equal(t, ""+
+		`{"Path":"/","Subvol":5,"Inode":256,"Type":"subvol","Size":10,"Status":"ok"}`+"\n"+
+		`{"Path":"/a","Subvol":5,"Inode":257,"Type":"file","Size":8192,"Status":"partial","MissingBytes":4096}`+"\n",
+		out.String())
+}
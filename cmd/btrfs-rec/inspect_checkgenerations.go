@@ -0,0 +1,57 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"bufio"
+
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+func init() {
+	inspectors.AddCommand(&cobra.Command{
+		Use:   "check-generations",
+		Short: "Check that no key-pointer points at a node newer than its parent",
+		Long: "" +
+			"In a committed tree, a node's generation is never older than " +
+			"the generation of any node below it, since writing a node " +
+			"rewrites every node on the path up to the root.  This walks " +
+			"every tree and reports each key-pointer whose generation is " +
+			"newer than that of the node containing it, which indicates " +
+			"either corruption or that the wrong node was grafted in.\n" +
+			"\n" +
+			"The exit status is 3 if any such key-pointers were found.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) (err error) {
+			ctx := cmd.Context()
+
+			out := bufio.NewWriter(stdout)
+			defer func() {
+				if _err := out.Flush(); _err != nil && err == nil {
+					err = _err
+				}
+			}()
+
+			var cnt int
+			btrfsutil.CheckGenerations(ctx, fs, func(inv btrfsutil.GenerationInversion) {
+				cnt++
+				textui.Fprintf(out, "%v\n", inv)
+			})
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			textui.Fprintf(out, "%v key-pointers point at newer nodes\n", cnt)
+			if cnt > 0 {
+				exitStatus = 3
+			}
+			return nil
+		}),
+	})
+}
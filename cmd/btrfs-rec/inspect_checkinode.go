@@ -0,0 +1,53 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/filemap"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func init() {
+	var flags struct {
+		treeID btrfsprim.ObjID
+		inode  uint64
+	}
+	cmd := &cobra.Command{
+		Use:   "check-inode",
+		Short: "Check a file's size and nbytes against its extent map",
+		Long: "" +
+			"Reconstruct the extent map of a single file (as 'file-map' " +
+			"does), and compare it against the INODE_ITEM's size and " +
+			"nbytes, to tell whether the file was truncated during " +
+			"recovery (the inode accounts for more data than the " +
+			"surviving extents hold) or is over-claimed (the extents hold " +
+			"more data than the inode accounts for).\n" +
+			"\n" +
+			"Holes legitimately make nbytes less than size, and are only " +
+			"reported as lost data if nbytes says that there should be " +
+			"more data than was found.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) error {
+			return filemap.CheckInode(
+				cmd.Context(),
+				stdout,
+				fs,
+				subvolumeConfig(true),
+				flags.treeID,
+				btrfsprim.ObjID(flags.inode))
+		}),
+	}
+	flags.treeID = btrfsprim.FS_TREE_OBJECTID
+	cmd.Flags().Var(&flags.treeID, "tree",
+		"the tree `ID` of the subvolume containing the file")
+	cmd.Flags().Uint64Var(&flags.inode, "inode", 0,
+		"the inode `number` of the file")
+	noError(cmd.MarkFlagRequired("inode"))
+	inspectors.AddCommand(cmd)
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+func init() {
+	inspectors.AddCommand(&cobra.Command{
+		Use:   "check-truncation",
+		Short: "Check whether the image is missing nodes off of its end",
+		Long: "" +
+			"When an image was truncated, or was captured while the " +
+			"filesystem was growing, the superblock may point at nodes " +
+			"past the end of the image.  This walks every node that is " +
+			"reachable from the superblock's roots, and from each of its " +
+			"backup roots, and reports exactly which nodes map past the " +
+			"end of their device, and which is the newest generation whose " +
+			"nodes are all within bounds.\n" +
+			"\n" +
+			"This is the read-only half of 'btrfs-rec repair " +
+			"truncate-recover'.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithRawFS(nil, func(fs *btrfs.FS, cmd *cobra.Command, _ []string) (err error) {
+			ctx := cmd.Context()
+
+			sets, err := btrfsutil.CheckTruncation(ctx, fs)
+			if err != nil {
+				return err
+			}
+
+			out := bufio.NewWriter(stdout)
+			defer func() {
+				if _err := out.Flush(); _err != nil && err == nil {
+					err = _err
+				}
+			}()
+			writeTruncationReport(out, sets)
+			return nil
+		}),
+	})
+}
+
+// writeTruncationReport writes a human-readable report of the result
+// of btrfsutil.CheckTruncation, and returns the newest RootSet that is
+// entirely in bounds (or nil if there is none).
+func writeTruncationReport(out io.Writer, sets []btrfsutil.RootSet) *btrfsutil.RootSet {
+	var best *btrfsutil.RootSet
+	for i, set := range sets {
+		if set.InBounds() {
+			textui.Fprintf(out, "%v (generation %v): all nodes are within bounds\n", set.Source, set.Generation)
+			if best == nil {
+				best = &sets[i]
+			}
+			continue
+		}
+		textui.Fprintf(out, "%v (generation %v): %v nodes are out of bounds:\n",
+			set.Source, set.Generation, len(set.OutOfBounds))
+		for _, node := range set.OutOfBounds {
+			textui.Fprintf(out, "\t%v\n", node)
+		}
+	}
+	switch {
+	case len(sets) == 0:
+	case best == nil:
+		textui.Fprintf(out, "no generation is entirely within bounds\n")
+	case best == &sets[0]:
+		textui.Fprintf(out, "the image does not appear to be truncated\n")
+	default:
+		textui.Fprintf(out, "newest in-bounds generation is %v (%v), %v generations behind the superblock's %v\n",
+			best.Generation, best.Source, sets[0].Generation.SubClamped(best.Generation), sets[0].Generation)
+	}
+	return best
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"os"
+
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/chunkmap"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+)
+
+func init() {
+	var svgFilename string
+	cmd := &cobra.Command{
+		Use:   "chunk-map",
+		Short: "Display which parts of the logical address space are mapped",
+		Long: "" +
+			"List each chunk of the logical address space, its RAID profile " +
+			"and block group type, and which devices it is mapped to; and " +
+			"list the unmapped gaps between chunks.  This is based on the " +
+			"chunk tree (and the superblock's sys_chunk_array), plus " +
+			"anything given with --mappings.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithRawFS(nil, func(fs *btrfs.FS, cmd *cobra.Command, _ []string) (err error) {
+			out := bufio.NewWriter(stdout)
+			defer func() {
+				if _err := out.Flush(); _err != nil && err == nil {
+					err = _err
+				}
+			}()
+
+			segs := chunkmap.ChunkMap(cmd.Context(), out, fs)
+
+			if svgFilename != "" {
+				fh, err := os.Create(svgFilename)
+				if err != nil {
+					return err
+				}
+				if err := chunkmap.WriteSVG(fh, segs); err != nil {
+					_ = fh.Close()
+					return err
+				}
+				return fh.Close()
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().StringVar(&svgFilename, "svg", "",
+		"also write the map as an image to `map.svg`")
+	noError(cmd.MarkFlagFilename("svg", "svg"))
+
+	inspectors.AddCommand(cmd)
+}
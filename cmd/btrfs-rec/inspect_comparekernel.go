@@ -0,0 +1,61 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/comparekernel"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+func init() {
+	var cfg comparekernel.Config
+	var treeID btrfsprim.ObjID
+	cmd := &cobra.Command{
+		Use:   "compare-with-kernel MOUNTPOINT",
+		Short: "Compare a recovered subvolume against a trusted copy mounted by the kernel",
+		Long: "" +
+			"Walk a subvolume (and the subvolumes nested within it) " +
+			"alongside MOUNTPOINT, a trusted copy of the same subvolume " +
+			"mounted by the real kernel, and report the paths that are " +
+			"missing from either side, that differ in type or size, or " +
+			"whose content (or symlink target) differs.  Ownership, " +
+			"modes, timestamps, and xattrs are not compared.\n" +
+			"\n" +
+			"To keep this tractable on large filesystems, only files up " +
+			"to --content-max-size have their content compared, and " +
+			"--content-sample may be used to compare only a (stable) " +
+			"subset of those; and the comparison stops after " +
+			"--max-divergences divergences.",
+		Args: cliutil.WrapPositionalArgs(cobra.ExactArgs(1)),
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, args []string) error {
+			cfg.Subvolume = subvolumeConfig(false)
+			stats, err := comparekernel.Compare(cmd.Context(), fs, treeID, args[0], cfg,
+				func(d comparekernel.Divergence) error {
+					_, err := textui.Fprintf(stdout, "%v\n", d)
+					return err
+				})
+			if err != nil {
+				return err
+			}
+			_, err = textui.Fprintf(stdout, "%v\n", stats)
+			return err
+		}),
+	}
+	treeID = btrfsprim.FS_TREE_OBJECTID
+	cmd.Flags().Var(&treeID, "tree",
+		"the tree `ID` of the recovered subvolume to compare")
+	cmd.Flags().IntVar(&cfg.MaxDivergences, "max-divergences", 20, //nolint:gomnd // Enough to get the idea.
+		"stop after reporting `N` divergences (0 for no limit)")
+	cmd.Flags().Int64Var(&cfg.ContentMaxSize, "content-max-size", 16*1024*1024, //nolint:gomnd // 16MiB
+		"only compare the content of files up to `BYTES` in size (-1 for no limit)")
+	cmd.Flags().Uint32Var(&cfg.ContentSample, "content-sample", 1,
+		"only compare the content of 1 in every `N` files")
+	inspectors.AddCommand(cmd)
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"text/tabwriter"
+
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+func init() {
+	var cfg btrfsutil.DetectNodeSizeConfig
+	cmd := &cobra.Command{
+		Use:   "detect-node-size",
+		Short: "Infer the node size from the nodes on disk, without trusting the superblock",
+		Long: "" +
+			"Scan the devices for blocks that look like nodes, and for each " +
+			"candidate node size, report how many of them pass checksum " +
+			"validation at that size.  This is useful when the superblock's " +
+			"node_size is garbage, which causes every node read to fail.\n" +
+			"\n" +
+			"The confidence of each candidate is the fraction of " +
+			"node-looking blocks that validate at that size.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithRawFS(nil, func(fs *btrfs.FS, cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+
+			results, err := btrfsutil.DetectNodeSize(ctx, fs, cfg)
+			if err != nil {
+				return err
+			}
+			sb, err := fs.Superblock()
+			if err != nil {
+				return err
+			}
+
+			table := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', tabwriter.AlignRight) //nolint:gomnd // This is what looks nice.
+			textui.Fprintf(table, "node size\tvalidated\tblocks\tconfidence\t\n")
+			for _, result := range results {
+				textui.Fprintf(table, "%v\t%v\t%v\t%.1f%%\t\n",
+					result.NodeSize, result.Validated, result.Blocks, 100*result.Confidence())
+			}
+			if err := table.Flush(); err != nil {
+				return err
+			}
+			if len(results) > 0 && results[0].Validated > 0 {
+				textui.Fprintf(stdout, "inferred node size: %v (superblock says %v)\n",
+					results[0].NodeSize, sb.NodeSize)
+			} else {
+				textui.Fprintf(stdout, "could not infer node size (superblock says %v)\n",
+					sb.NodeSize)
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().IntVar(&cfg.MaxBlocks, "max-blocks", 0,
+		"stop scanning each device after `N` node-looking blocks, for a quick estimate (0 for no limit)")
+	inspectors.AddCommand(cmd)
+}
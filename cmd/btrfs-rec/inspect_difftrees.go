@@ -0,0 +1,97 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/difftrees"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func init() {
+	var flags struct {
+		items    bool
+		maxItems int
+	}
+	cmd := &cobra.Command{
+		Use:   "diff-trees A.json B.json",
+		Short: "Compare two sets of tree roots (output of 'rebuild-trees')",
+		Long: "" +
+			"For each tree, report the roots that are in one of the " +
+			"trees.json files but not the other.  This only reads the two " +
+			"files, and so is quick.\n" +
+			"\n" +
+			"With --items, the filesystem is also read, and each tree whose " +
+			"roots differ is loaded with each set of roots, and the keys of " +
+			"the items that are in one but not the other are reported.",
+		Args: cliutil.WrapPositionalArgs(cobra.ExactArgs(2)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !flags.items {
+				return run(func(cmd *cobra.Command, args []string) error {
+					a, b, err := readDiffTreesRoots(cmd, args)
+					if err != nil {
+						return err
+					}
+					difftrees.DiffRoots(stdout, a, b)
+					return nil
+				})(cmd, args)
+			}
+			return runWithRawFSAndNodeList(func(fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr, cmd *cobra.Command, args []string) error {
+				ctx := cmd.Context()
+				a, b, err := readDiffTreesRoots(cmd, args)
+				if err != nil {
+					return err
+				}
+				differ := difftrees.DiffRoots(stdout, a, b)
+				if len(differ) == 0 {
+					return nil
+				}
+
+				graph, err := readGraph(ctx, fs, nodeList)
+				if err != nil {
+					return err
+				}
+				lax := laxAncestors(cmd, true)
+				var forrests [2]difftrees.Side[*btrfsutil.RebuiltForrest]
+				for i, side := range []difftrees.Side[difftrees.Roots]{a, b} {
+					rfs := btrfsutil.NewRebuiltForrest(fs, graph, nil, lax)
+					if err := applyTrustedGenerations(ctx, rfs.RebuiltSetTrustedGeneration); err != nil {
+						return err
+					}
+					if err := applyImportedItems(ctx, rfs.RebuiltInjectItems); err != nil {
+						return err
+					}
+					rfs.RebuiltAddRoots(ctx, side.Val)
+					forrests[i] = difftrees.Side[*btrfsutil.RebuiltForrest]{Name: side.Name, Val: rfs}
+				}
+				difftrees.DiffItems(ctx, stdout, forrests[0], forrests[1], differ, flags.maxItems)
+				return nil
+			})(cmd, args)
+		},
+	}
+	cmd.Flags().BoolVar(&flags.items, "items", false,
+		"also read the filesystem and compare the items in the trees whose roots differ")
+	cmd.Flags().IntVar(&flags.maxItems, "max-items", 20, //nolint:gomnd // Enough to get the idea.
+		"with --items, print at most `N` keys per tree per side (0 for no limit); the counts are always exact")
+	inspectors.AddCommand(cmd)
+}
+
+func readDiffTreesRoots(cmd *cobra.Command, args []string) (a, b difftrees.Side[difftrees.Roots], err error) {
+	ctx := cmd.Context()
+	a.Name, b.Name = args[0], args[1]
+	a.Val, err = readJSONFile[difftrees.Roots](ctx, a.Name)
+	if err != nil {
+		return a, b, err
+	}
+	b.Val, err = readJSONFile[difftrees.Roots](ctx, b.Name)
+	if err != nil {
+		return a, b, err
+	}
+	return a, b, nil
+}
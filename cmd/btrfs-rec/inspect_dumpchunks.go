@@ -0,0 +1,51 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"bufio"
+
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/dumpchunks"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+)
+
+func init() {
+	inspectors.AddCommand(&cobra.Command{
+		Use:   "dump-chunks",
+		Short: "Print every chunk from the sys_chunk_array and the chunk tree, and check that they agree",
+		Long: "" +
+			"Print every chunk from both the superblock's bootstrap " +
+			"sys_chunk_array and the chunk tree, with each chunk's stripes " +
+			"and the device UUIDs that they map to; and flag chunks that " +
+			"are in one but not the other, chunks that the two disagree " +
+			"about, and stripes whose device UUID doesn't match the " +
+			"device.\n" +
+			"\n" +
+			"Problems with the SYSTEM chunks are flagged as SERIOUS, as " +
+			"those must be self-consistent to even read the chunk tree; " +
+			"this should be checked before trusting the mappings.  The " +
+			"exit status is 3 if there are any serious problems.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithRawFS(nil, func(fs *btrfs.FS, cmd *cobra.Command, _ []string) (err error) {
+			out := bufio.NewWriter(stdout)
+			defer func() {
+				if _err := out.Flush(); _err != nil && err == nil {
+					err = _err
+				}
+			}()
+			numSerious, err := dumpchunks.DumpChunks(cmd.Context(), out, fs)
+			if err != nil {
+				return err
+			}
+			if numSerious > 0 {
+				exitStatus = 3
+			}
+			return nil
+		}),
+	})
+}
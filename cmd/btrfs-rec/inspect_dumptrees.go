@@ -5,8 +5,6 @@
 package main
 
 import (
-	"os"
-
 	"github.com/datawire/ocibuild/pkg/cliutil"
 	"github.com/spf13/cobra"
 
@@ -16,16 +14,63 @@ import (
 )
 
 func init() {
-	inspectors.AddCommand(&cobra.Command{
+	var cfg dumptrees.Config
+	var color textui.ColorMode
+	cmd := &cobra.Command{
 		Use:   "dump-trees",
 		Short: "A clone of `btrfs inspect-internal dump-tree`",
-		Args:  cliutil.WrapPositionalArgs(cobra.NoArgs),
+		Long: "" +
+			"With --follow-root-refs, subvolume trees are dumped in " +
+			"lineage order: each subvolume comes after the subvolume that " +
+			"it is a snapshot of (by parent UUID), or else after the " +
+			"subvolume that contains it (by ROOT_REF).  Lineage that can't " +
+			"be resolved, or that forms a cycle, is annotated rather than " +
+			"causing trees to be skipped.\n" +
+			"\n" +
+			"With --key-filter, only items that match are printed, and " +
+			"subtrees that cannot contain any matching items are not " +
+			"walked.\n" +
+			"\n" +
+			"Trees that can't be dumped don't stop the other trees from " +
+			"being dumped; they are listed at the end.  With " +
+			"--fail-on-error, they also cause a non-zero exit status.\n" +
+			"\n" +
+			"With --workers, the items of each leaf are rendered in " +
+			"parallel; the output is identical, but large dumps are " +
+			"faster.\n" +
+			"\n" +
+			"With --color (by default, if stdout is a terminal), keys, " +
+			"addresses, and node headers are colorized, and errors are " +
+			"shown in red.  With --color=never (or if stdout is not a " +
+			"terminal), the output is plain text.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
 		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) error {
 			const version = "6.3"
-			out := os.Stdout
+			out := stdout
+			cfg.Color = color.Enabled(out)
 			textui.Fprintf(out, "btrfs-progs v%v\n", version)
-			dumptrees.DumpTrees(cmd.Context(), out, fs)
-			return nil
+			return dumptrees.DumpTrees(cmd.Context(), out, fs, cfg)
 		}),
-	})
+	}
+	cmd.Flags().Var(&cfg.TimeFormat, "time-format",
+		"how to format timestamps: 'default', 'default-nano', 'rfc3339', 'rfc3339nano', "+
+			"or a Go time layout; optionally followed by ',utc'")
+	cmd.Flags().BoolVar(&cfg.FollowRootRefs, "follow-root-refs", false,
+		"dump subvolume trees in lineage order (parents before snapshots)")
+	cmd.Flags().Uint64Var((*uint64)(&cfg.StartSubvol), "subvol", 0,
+		"dump only the subvolume tree `ID` and its descendants; implies --follow-root-refs")
+	cmd.Flags().Var(&cfg.KeyFilter, "key-filter",
+		"print only items whose keys match `EXPR`, a comma-separated list of "+
+			"objectid=, type=, and offset= terms, each a value or a MIN-MAX range "+
+			"(e.g. 'objectid=256,type=INODE_ITEM' or 'type=EXTENT_DATA,offset=0-4096')")
+
+	cmd.Flags().BoolVar(&cfg.FailOnError, "fail-on-error", false,
+		"exit with a non-zero status if any tree could not be dumped")
+
+	cmd.Flags().IntVar(&cfg.Workers, "workers", 0,
+		"render the items of each leaf node with `N` goroutines (0 or 1 to render serially)")
+	cmd.Flags().Var(&color, "color",
+		"colorize the output: 'auto' (only if stdout is a terminal), 'always', or 'never'")
+
+	inspectors.AddCommand(cmd)
 }
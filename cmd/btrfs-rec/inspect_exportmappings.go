@@ -0,0 +1,57 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/dlib/dlog"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func init() {
+	inspectors.AddCommand(&cobra.Command{
+		Use:   "export-mappings",
+		Short: "Write the mappings from a healthy chunk tree as JSON",
+		Long: "" +
+			"This is the inverse of --mappings: the chunk/dev-extent " +
+			"mappings are read from the filesystem's CHUNK_TREE (and, " +
+			"for any chunks missing from it, the DEV_TREE), and are " +
+			"printed as JSON on stdout, in a form that can be loaded by " +
+			"the --mappings flag.  This is useful for a sibling image " +
+			"(a snapshot or clone of the same array) whose chunk tree is " +
+			"damaged.\n" +
+			"\n" +
+			"Each mapping includes the UUID of its device, so that when " +
+			"the mappings are loaded with --mappings, they are matched " +
+			"to the devices by UUID rather than by device ID.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithRawFS(nil, func(fs *btrfs.FS, cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+
+			mappings, err := btrfsutil.ExportMappings(ctx, fs)
+			if mappings == nil {
+				return err
+			}
+			// Otherwise, write what we have, and return the
+			// error afterward.
+
+			dlog.Infof(ctx, "Writing %d mappings to stdout...", len(mappings))
+			if err := writeJSONFile(stdout, mappings, lowmemjson.ReEncoderConfig{
+				Indent:                "\t",
+				ForceTrailingNewlines: true,
+				CompactIfUnder:        120, //nolint:gomnd // This is what looks nice.
+			}); err != nil {
+				return err
+			}
+			dlog.Info(ctx, "... done writing")
+
+			return err
+		}),
+	})
+}
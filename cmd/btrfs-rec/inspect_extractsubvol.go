@@ -0,0 +1,109 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/extractsubvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func init() {
+	var flags struct {
+		treeID          btrfsprim.ObjID
+		output          string
+		continueOnError bool
+		carve           bool
+		followParents   bool
+	}
+	cmd := &cobra.Command{
+		Use:   "extract-subvol",
+		Short: "Write the contents of a subvolume to a tar archive",
+		Long: "" +
+			"Write the contents of a subvolume to a (PAX format) tar archive, " +
+			"preserving modes, ownership, timestamps, symlinks, hard links, " +
+			"and xattrs.  Child subvolumes are not descended in to.\n" +
+			"\n" +
+			"Ranges of files that cannot be read are written as zeros, and " +
+			"are listed in a sidecar file named FILENAME" + extractsubvol.HolesSuffix +
+			" that immediately follows the file in the archive.\n" +
+			"\n" +
+			"With --carve, file contents are read directly from the disk " +
+			"ranges named by the subvolume's FILE_EXTENT items, without " +
+			"consulting the extent tree or the checksum tree; this is a last " +
+			"resort for when those trees are unrecoverable.  No checksum " +
+			"verification is possible, so each regular file is marked with " +
+			"the PAX record " + extractsubvol.UnverifiedPAXRecord + "=1.\n" +
+			"\n" +
+			"With --follow-parent-snapshots, ranges of files that cannot be " +
+			"read are instead read from the same file (the same inode, " +
+			"created in the same generation) in the snapshots that the " +
+			"subvolume was snapshotted from, found by following the parent " +
+			"UUIDs; trees that are not ancestors are never consulted.  A " +
+			"range is only filled if the snapshot's FILE_EXTENT items for it " +
+			"point at the same data on disk as the subvolume's do; if the " +
+			"subvolume's FILE_EXTENT items for the range are missing, it is " +
+			"not filled.  " +
+			"Ranges filled this way are listed, along with the tree that they " +
+			"came from and the generation of that tree's copy of the file, in " +
+			"a sidecar file named FILENAME" + extractsubvol.FilledSuffix + ".",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) (err error) {
+			var dst io.Writer
+			if flags.output == "-" {
+				dst = stdout
+			} else {
+				fh, err := os.Create(flags.output)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					if _err := fh.Close(); _err != nil && err == nil {
+						err = _err
+					}
+				}()
+				dst = fh
+			}
+			out := bufio.NewWriter(dst)
+			defer func() {
+				if _err := out.Flush(); _err != nil && err == nil {
+					err = _err
+				}
+			}()
+
+			return extractsubvol.ExtractSubvol(
+				cmd.Context(),
+				out,
+				fs,
+				flags.treeID,
+				subvolumeConfig(false),
+				flags.continueOnError,
+				flags.carve,
+				flags.followParents)
+		}),
+	}
+	flags.treeID = btrfsprim.FS_TREE_OBJECTID
+	cmd.Flags().Var(&flags.treeID, "tree",
+		"the tree `ID` of the subvolume to extract")
+	cmd.Flags().StringVarP(&flags.output, "output", "o", "",
+		"write the archive to `out.tar`, or to stdout if '-'")
+	noError(cmd.MarkFlagFilename("output", "tar"))
+	noError(cmd.MarkFlagRequired("output"))
+	cmd.Flags().BoolVar(&flags.continueOnError, "continue-on-error", false,
+		"log and skip files that cannot be read, rather than aborting")
+	cmd.Flags().BoolVar(&flags.carve, "carve", false,
+		"reconstruct file contents purely from FILE_EXTENT items, without the extent or checksum trees; "+
+			"nothing is verified")
+	cmd.Flags().BoolVar(&flags.followParents, "follow-parent-snapshots", false,
+		"fill unreadable ranges of files from the same file in the snapshots that the subvolume was snapshotted from")
+	inspectors.AddCommand(cmd)
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"bufio"
+
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/filemap"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func init() {
+	var flags struct {
+		treeID btrfsprim.ObjID
+		inode  uint64
+	}
+	cmd := &cobra.Command{
+		Use:   "file-map",
+		Short: "Show the extent map of a file, and which parts of it are damaged",
+		Long: "" +
+			"Reconstruct the extent map of a single file, listing each " +
+			"range of the file and what it is mapped to.  Ranges within " +
+			"the file's size that have no FILE_EXTENT are listed as HOLE, " +
+			"ranges covered by more than one FILE_EXTENT are listed as " +
+			"OVERLAP, and extents whose backing EXTENT_ITEM is missing from " +
+			"the extent tree are marked MISSING-EXTENT-ITEM.\n" +
+			"\n" +
+			"The output is one range per line, suitable for diffing.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) (err error) {
+			out := bufio.NewWriter(stdout)
+			defer func() {
+				if _err := out.Flush(); _err != nil && err == nil {
+					err = _err
+				}
+			}()
+
+			return filemap.FileMap(
+				cmd.Context(),
+				out,
+				fs,
+				subvolumeConfig(true),
+				flags.treeID,
+				btrfsprim.ObjID(flags.inode))
+		}),
+	}
+	flags.treeID = btrfsprim.FS_TREE_OBJECTID
+	cmd.Flags().Var(&flags.treeID, "tree",
+		"the tree `ID` of the subvolume containing the file")
+	cmd.Flags().Uint64Var(&flags.inode, "inode", 0,
+		"the inode `number` of the file")
+	noError(cmd.MarkFlagRequired("inode"))
+	inspectors.AddCommand(cmd)
+}
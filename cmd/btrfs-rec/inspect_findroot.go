@@ -0,0 +1,81 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/findroot"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+func init() {
+	var flags struct {
+		limit  int
+		asJSON bool
+	}
+	cmd := &cobra.Command{
+		Use:   "find-root TREE_ID",
+		Short: "Search for candidate root nodes for a tree",
+		Long: "" +
+			"Search all nodes for nodes owned by TREE_ID, and list them " +
+			"ranked by how likely they are to be the root of the tree: " +
+			"nodes that are not pointed to by any other node in the same " +
+			"tree first, then by highest generation, then by highest " +
+			"level.  This is useful when the ROOT_TREE is too damaged to " +
+			"find a tree's root.\n" +
+			"\n" +
+			"With --json, only the best candidate (the first row of the " +
+			"table) is written, in the format read by --trees; --limit " +
+			"has no effect on it.  Every root that --trees lists for a " +
+			"tree is added to that tree, so listing the runners-up would " +
+			"merge them in to the tree rather than offering a choice.\n" +
+			"\n" +
+			"If no --node-list is given, then a slow sector-by-sector scan " +
+			"will be used to find all nodes.",
+		Args: cliutil.WrapPositionalArgs(cobra.ExactArgs(1)),
+		RunE: runWithRawFSAndNodeList(func(fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr, cmd *cobra.Command, args []string) (err error) {
+			ctx := cmd.Context()
+
+			treeID, err := btrfsprim.ParseObjID(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid TREE_ID: %w", err)
+			}
+
+			graph, err := readGraph(ctx, fs, nodeList)
+			if err != nil {
+				return err
+			}
+			cands := findroot.FindRoot(graph, treeID)
+
+			if flags.asJSON {
+				return writeJSONFile(stdout, findroot.TreeRoots(treeID, cands), lowmemjson.ReEncoderConfig{
+					Indent:                "\t",
+					ForceTrailingNewlines: true,
+				})
+			}
+
+			out := bufio.NewWriter(stdout)
+			defer func() {
+				if _err := out.Flush(); _err != nil && err == nil {
+					err = _err
+				}
+			}()
+			return findroot.WriteCandidates(out, cands, flags.limit)
+		}),
+	}
+	cmd.Flags().IntVar(&flags.limit, "limit", 10,
+		"show at most `N` candidates (0 for all); ignored with --json")
+	cmd.Flags().BoolVar(&flags.asJSON, "json", false,
+		"write the best candidate as JSON, for use with --trees")
+	inspectors.AddCommand(cmd)
+}
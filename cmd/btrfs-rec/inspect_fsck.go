@@ -0,0 +1,74 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/fsck"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func init() {
+	var flags struct {
+		skip []string
+	}
+	var checkHelp strings.Builder
+	for _, check := range fsck.Checks {
+		fmt.Fprintf(&checkHelp, " - %s: %s\n", check.Name, check.Description)
+	}
+	cmd := &cobra.Command{
+		Use:   "fsck",
+		Short: "Run all of the read-only consistency checks",
+		Long: "" +
+			"Run each of the read-only consistency checks against the " +
+			"filesystem, printing each finding as it is found, followed " +
+			"by a summary that lists errors before warnings.\n" +
+			"\n" +
+			"The checks are:\n" +
+			"\n" +
+			checkHelp.String() +
+			"\n" +
+			"Any of them may be skipped with --skip.\n" +
+			"\n" +
+			"The exit status is 0 if nothing was found, 2 if only warnings " +
+			"were found, 3 if errors were found, or 1 if the command " +
+			"itself failed.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		PreRunE: func(cmd *cobra.Command, _ []string) error {
+			known := containers.NewSet(fsck.CheckNames()...)
+			for _, name := range flags.skip {
+				if !known.Has(name) {
+					return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--skip: unknown check %q (valid checks: %s)",
+						name, strings.Join(fsck.CheckNames(), ", ")))
+				}
+			}
+			return nil
+		},
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) error {
+			// Unbuffered, so that findings are streamed as
+			// they are found.
+			worst := fsck.Run(cmd.Context(), stdout, fs, fsck.Config{
+				Skip:         containers.NewSet(flags.skip...),
+				ChecksumTree: globalFlags.checksumTree,
+			})
+			switch worst {
+			case fsck.SeverityWarning:
+				exitStatus = 2
+			case fsck.SeverityError:
+				exitStatus = 3
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().StringSliceVar(&flags.skip, "skip", nil,
+		"skip the named `check`s (comma-separated, or repeat the flag)")
+	inspectors.AddCommand(cmd)
+}
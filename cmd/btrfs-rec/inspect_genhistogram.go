@@ -0,0 +1,74 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"bufio"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/genhistogram"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func init() {
+	var flags struct {
+		tree    btrfsprim.ObjID
+		buckets int
+		asJSON  bool
+	}
+	cmd := &cobra.Command{
+		Use:   "gen-histogram --tree=TREE_ID",
+		Short: "Show the distribution of node generations within a tree",
+		Long: "" +
+			"Walk the tree, and display a histogram of the generations of " +
+			"its nodes, as a sparkline and as a list of buckets.  A tree " +
+			"that mixes very old and very new nodes with nothing in " +
+			"between is highlighted, as this may be a sign of partial CoW " +
+			"corruption.\n" +
+			"\n" +
+			"This works on both raw trees and (with --rebuild) rebuilt " +
+			"trees.\n" +
+			"\n" +
+			"With --json, the buckets are written as JSON instead.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) (err error) {
+			ctx := cmd.Context()
+			treeID := flags.tree
+
+			hist, err := genhistogram.GenHistogram(ctx, fs, treeID)
+			if err != nil {
+				return err
+			}
+
+			if flags.asJSON {
+				return writeJSONFile(stdout, hist.Buckets(flags.buckets), lowmemjson.ReEncoderConfig{
+					Indent:                "\t",
+					ForceTrailingNewlines: true,
+				})
+			}
+
+			out := bufio.NewWriter(stdout)
+			defer func() {
+				if _err := out.Flush(); _err != nil && err == nil {
+					err = _err
+				}
+			}()
+			genhistogram.WriteText(out, treeID, hist, flags.buckets)
+			return nil
+		}),
+	}
+	cmd.Flags().Var(&flags.tree, "tree",
+		"the `ID` of the tree to examine")
+	noError(cmd.MarkFlagRequired("tree"))
+	cmd.Flags().IntVar(&flags.buckets, "buckets", 40,
+		"divide the generation range in to at most `N` buckets")
+	cmd.Flags().BoolVar(&flags.asJSON, "json", false,
+		"write the buckets as JSON")
+	inspectors.AddCommand(cmd)
+}
@@ -5,7 +5,14 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
 	"os"
+	"time"
 
 	"git.lukeshu.com/go/lowmemjson"
 	"github.com/datawire/dlib/dlog"
@@ -13,11 +20,22 @@ import (
 	"github.com/spf13/cobra"
 
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
 func init() {
-	inspectors.AddCommand(&cobra.Command{
+	var flags struct {
+		stream         bool
+		discover       bool
+		discoverReport string
+		resumeScan     string
+		healthReport   string
+	}
+	cmd := &cobra.Command{
 		Use:   "list-nodes",
 		Short: "Scan the filesystem for btree nodes",
 		Long: "" +
@@ -26,18 +44,88 @@ func init() {
 			"trees with `btrfs-rec inspect rebuild-mappings` anyway, you may " +
 			"want to instead use `btrfs-rec inspect rebuild-mappings list-nodes` " +
 			"to take advantage of the sector-by-sector scan that's already " +
-			"performed by `btrfs-rec inspect rebuild-mappings scan`.",
+			"performed by `btrfs-rec inspect rebuild-mappings scan`.\n" +
+			"\n" +
+			"With --stream, node addresses are written as they are " +
+			"discovered, one per line (JSON Lines), rather than as a single " +
+			"JSON array at the end of the scan, so that if the scan is " +
+			"interrupted the nodes found so far are not lost.  (It does " +
+			"not reduce memory use: the addresses found so far are still " +
+			"remembered, so that duplicates are written only once.)  " +
+			"Either format is accepted by --node-list.\n" +
+			"\n" +
+			"With --discover, after the scan, the trees are also walked " +
+			"from the superblock's roots, following key-pointers; any " +
+			"nodes reachable that way are included even if the scan " +
+			"missed them (for instance, because they are in a region " +
+			"that the scan skipped), and any that are referenced but " +
+			"unreadable are logged.  With --discover-report=FILE (which " +
+			"implies --discover), the nodes that were reached that way " +
+			"are also marked as high-confidence in FILE (as JSON), along " +
+			"with the nodes that are referenced but unreadable.\n" +
+			"\n" +
+			"With --resume-scan=FILE, node addresses are streamed (as with " +
+			"--stream) to FILE rather than to stdout, and the scan's " +
+			"progress on each device is periodically recorded in " +
+			"FILE.scan-marker.  If the scan is interrupted, running the " +
+			"same command again picks up where the marker says the scan " +
+			"got to, appending to FILE.  If the marker does not match the " +
+			"devices (they have changed size, or their superblocks have " +
+			"changed), a full scan is done instead.\n" +
+			"\n" +
+			"With --health-report=FILE, every sector that is not part of a " +
+			"node is also checked (using the same read that looks for a " +
+			"node there), and a summary of each device is " +
+			"written to stderr, and in more detail (as JSON) to FILE: the " +
+			"number of bytes scanned and nodes found, the regions that " +
+			"could not be read (distinguishing device I/O errors from the " +
+			"device being shorter than expected, and from errors that say " +
+			"nothing about the data), and the regions that are all zeros " +
+			"(possibly never written, or zeroed by a tool; only the first " +
+			"few thousand are listed, but all are counted).  With " +
+			"--resume-scan, the report only covers the part of each device " +
+			"that was scanned by this run.",
 		Args: cliutil.WrapPositionalArgs(cobra.ExactArgs(1)),
 		RunE: runWithRawFS(nil, func(fs *btrfs.FS, cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
+			if flags.discoverReport != "" {
+				flags.discover = true
+			}
 
-			nodeList, err := btrfsutil.ListNodes(ctx, fs)
-			if err != nil {
-				return err
+			if flags.resumeScan != "" {
+				return listNodesResume(ctx, fs, flags.resumeScan, flags.discover, flags.discoverReport, flags.healthReport)
+			}
+			if flags.stream {
+				return listNodesStream(ctx, fs, stdout, flags.discover, flags.discoverReport, nil, flags.healthReport)
+			}
+
+			var nodeList []btrfsvol.LogicalAddr
+			var err error
+			if flags.healthReport != "" {
+				var health []btrfsutil.DeviceHealth
+				nodeList, health, err = btrfsutil.ListNodesHealth(ctx, fs)
+				if err != nil {
+					return err
+				}
+				if err := writeHealthReport(ctx, flags.healthReport, health); err != nil {
+					return err
+				}
+			} else {
+				nodeList, err = btrfsutil.ListNodes(ctx, fs)
+				if err != nil {
+					return err
+				}
+			}
+			if flags.discover {
+				discovered, err := discoverNodes(ctx, fs, flags.discoverReport)
+				if err != nil {
+					return err
+				}
+				nodeList = btrfsutil.MergeDiscoveredNodes(ctx, nodeList, discovered)
 			}
 
 			dlog.Infof(ctx, "Writing nodes to stdout...")
-			if err := writeJSONFile(os.Stdout, nodeList, lowmemjson.ReEncoderConfig{
+			if err := writeJSONFile(stdout, nodeList, lowmemjson.ReEncoderConfig{
 				Indent:                "\t",
 				ForceTrailingNewlines: true,
 			}); err != nil {
@@ -47,5 +135,268 @@ func init() {
 
 			return nil
 		}),
-	})
+	}
+	cmd.Flags().BoolVar(&flags.stream, "stream", false,
+		"write nodes incrementally as JSON Lines")
+	cmd.Flags().BoolVar(&flags.discover, "discover", false,
+		"also include nodes that are reachable from the superblock's roots")
+	cmd.Flags().StringVar(&flags.discoverReport, "discover-report", "",
+		"like --discover, and also write the high-confidence and referenced-but-unreadable nodes to `file` (as JSON)")
+	noError(cmd.MarkFlagFilename("discover-report"))
+	cmd.Flags().StringVar(&flags.resumeScan, "resume-scan", "",
+		"stream nodes to `file`, resuming an interrupted scan if file.scan-marker is present")
+	noError(cmd.MarkFlagFilename("resume-scan"))
+	cmd.Flags().StringVar(&flags.healthReport, "health-report", "",
+		"write a per-device report of unreadable and all-zero regions to `file` (as JSON), and a summary to stderr")
+	noError(cmd.MarkFlagFilename("health-report"))
+	inspectors.AddCommand(cmd)
+}
+
+// discoverNodes calls btrfsutil.DiscoverNodes, logging the nodes that
+// are referenced but unreadable, and writing the report to
+// `reportFilename` if it is not empty.
+func discoverNodes(ctx context.Context, fs *btrfs.FS, reportFilename string) (btrfsutil.DiscoveredNodes, error) {
+	discovered := btrfsutil.DiscoverNodes(ctx, fs)
+	for _, addr := range maps.SortedKeys(discovered.Unreadable) {
+		dlog.Warnf(ctx, "node@%v is referenced but unreadable: %v", addr, discovered.Unreadable[addr])
+	}
+	if reportFilename != "" {
+		dlog.Infof(ctx, "Writing discover report to %q...", reportFilename)
+		if err := writeJSONReport(reportFilename, discovered.Report()); err != nil {
+			return discovered, err
+		}
+		dlog.Info(ctx, "... done writing")
+	}
+	return discovered, nil
+}
+
+// writeHealthReport writes the health report to `filename` as JSON,
+// and as a table to stderr.
+func writeHealthReport(ctx context.Context, filename string, health []btrfsutil.DeviceHealth) error {
+	if err := btrfsutil.WriteHealthReport(os.Stderr, health); err != nil {
+		return err
+	}
+	dlog.Infof(ctx, "Writing health report to %q...", filename)
+	if err := writeJSONReport(filename, health); err != nil {
+		return err
+	}
+	dlog.Info(ctx, "... done writing")
+	return nil
+}
+
+// writeJSONReport writes `obj` to `filename` as JSON.
+func writeJSONReport(filename string, obj any) error {
+	fh, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONFile(fh, obj, lowmemjson.ReEncoderConfig{
+		Indent:                "\t",
+		CompactIfUnder:        80, //nolint:gomnd // This is what looks nice.
+		ForceTrailingNewlines: true,
+	}); err != nil {
+		_ = fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// A scanCheckpoint is how listNodesStream records its progress, so
+// that an interrupted scan can be resumed.
+type scanCheckpoint struct {
+	progress *btrfsutil.ScanProgress
+	// written is the nodes that are already in the output from an
+	// earlier, interrupted scan.
+	written containers.Set[btrfsvol.LogicalAddr]
+	save    func(btrfsutil.ScanMarker) error
+}
+
+var listNodesFlushInterval = textui.NewTunable("list-nodes.flush-interval", 1*time.Second)
+
+func listNodesStream(ctx context.Context, fs *btrfs.FS, w io.Writer, discover bool, discoverReport string, checkpoint *scanCheckpoint, healthReport string) (err error) {
+	buf := bufio.NewWriter(w)
+	defer func() {
+		if _err := buf.Flush(); err == nil && _err != nil {
+			err = _err
+		}
+	}()
+	flushInterval := listNodesFlushInterval.Get()
+	lastFlush := time.Now()
+	var written containers.Set[btrfsvol.LogicalAddr]
+	var progress *btrfsutil.ScanProgress
+	switch {
+	case checkpoint != nil:
+		written = checkpoint.written
+		progress = checkpoint.progress
+	case discover:
+		written = make(containers.Set[btrfsvol.LogicalAddr])
+	}
+	flush := func() error {
+		if checkpoint == nil {
+			return buf.Flush()
+		}
+		// Take the marker before flushing, so that it only
+		// covers nodes that have been written.
+		marker := progress.Marker()
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+		return checkpoint.save(marker)
+	}
+	handleNode := func(addr btrfsvol.LogicalAddr) error {
+		if written != nil {
+			if written.Has(addr) {
+				return nil
+			}
+			written.Insert(addr)
+		}
+		if err := btrfsutil.WriteNodeListLine(buf, addr); err != nil {
+			return err
+		}
+		if time.Since(lastFlush) > flushInterval {
+			lastFlush = time.Now()
+			return flush()
+		}
+		return nil
+	}
+	var health []btrfsutil.DeviceHealth
+	if healthReport != "" {
+		health, err = btrfsutil.ListNodesStreamHealth(ctx, fs, progress, handleNode)
+	} else {
+		err = btrfsutil.ListNodesStreamResume(ctx, fs, progress, handleNode)
+	}
+	if err != nil {
+		if checkpoint != nil && ctx.Err() != nil {
+			// Save what we can before giving up.
+			if _err := flush(); _err != nil {
+				dlog.Errorf(ctx, "saving scan marker: %v", _err)
+			}
+		}
+		return err
+	}
+	if checkpoint != nil || discover {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	if healthReport != "" {
+		if err := writeHealthReport(ctx, healthReport, health); err != nil {
+			return err
+		}
+	}
+	if !discover {
+		return nil
+	}
+	discovered, err := discoverNodes(ctx, fs, discoverReport)
+	if err != nil {
+		return err
+	}
+	numNew := 0
+	for _, addr := range maps.SortedKeys(discovered.Reachable) {
+		if written.Has(addr) {
+			continue
+		}
+		numNew++
+		if err := btrfsutil.WriteNodeListLine(buf, addr); err != nil {
+			return err
+		}
+	}
+	if numNew > 0 {
+		dlog.Infof(ctx, "discover nodes: %d reachable nodes were missed by the scan", numNew)
+	}
+	return nil
+}
+
+// listNodesResume is `list-nodes --resume-scan=filename`.
+func listNodesResume(ctx context.Context, fs *btrfs.FS, filename string, discover bool, discoverReport string, healthReport string) error {
+	markerFilename := filename + ".scan-marker"
+
+	checkpoint := &scanCheckpoint{
+		written: make(containers.Set[btrfsvol.LogicalAddr]),
+		save: func(marker btrfsutil.ScanMarker) error {
+			return writeScanMarker(markerFilename, marker)
+		},
+	}
+	var fh *os.File
+	if marker, err := readJSONFile[btrfsutil.ScanMarker](ctx, markerFilename); err != nil {
+		if !errors.Is(err, iofs.ErrNotExist) {
+			dlog.Warnf(ctx, "%s: %v; falling back to a full scan", markerFilename, err)
+		}
+	} else if checkpoint.progress, err = btrfsutil.NewScanProgress(fs, &marker); err != nil {
+		dlog.Warnf(ctx, "%s: %v; falling back to a full scan", markerFilename, err)
+	} else if fh, err = openNodeListForAppend(ctx, filename, checkpoint.written); err != nil {
+		dlog.Warnf(ctx, "%s: %v; falling back to a full scan", filename, err)
+		checkpoint.progress = nil
+		checkpoint.written = make(containers.Set[btrfsvol.LogicalAddr])
+	} else {
+		for _, dev := range marker.Devices {
+			dlog.Infof(ctx, "resuming scan of device %v at %v/%v",
+				dev.DevID, dev.Scanned, dev.Size)
+		}
+	}
+	if checkpoint.progress == nil {
+		var err error
+		checkpoint.progress, err = btrfsutil.NewScanProgress(fs, nil)
+		if err != nil {
+			return err
+		}
+		fh, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+		if err != nil {
+			return err
+		}
+	}
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	if err := listNodesStream(ctx, fs, fh, discover, discoverReport, checkpoint, healthReport); err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+// openNodeListForAppend opens a node list that was written by an
+// interrupted `list-nodes --resume-scan`, adding the nodes in it to
+// `written`.  An unterminated trailing record (from an interrupted
+// write) is truncated away, so that appending to the file does not
+// corrupt it.
+func openNodeListForAppend(ctx context.Context, filename string, written containers.Set[btrfsvol.LogicalAddr]) (*os.File, error) {
+	dat, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	dat = dat[:bytes.LastIndexByte(dat, '\n')+1]
+	nodeList, err := btrfsutil.ReadNodeListLines(ctx, bytes.NewReader(dat))
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range nodeList {
+		written.Insert(addr)
+	}
+	if err := os.Truncate(filename, int64(len(dat))); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0o666)
+}
+
+// writeScanMarker writes the marker to a temporary file and renames
+// it in to place, so that an interruption can't leave a partial
+// marker.
+func writeScanMarker(filename string, marker btrfsutil.ScanMarker) error {
+	tmpFilename := filename + ".tmp"
+	fh, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONFile(fh, marker, lowmemjson.ReEncoderConfig{
+		Indent:                "\t",
+		ForceTrailingNewlines: true,
+	}); err != nil {
+		_ = fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
 }
@@ -0,0 +1,85 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/listsnapshots"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+)
+
+func init() {
+	var flags struct {
+		shared bool
+		format string
+	}
+	cmd := &cobra.Command{
+		Use:   "list-snapshots",
+		Short: "Show which subvolumes are snapshots of which others",
+		Long: "" +
+			"List every subvolume, with each snapshot under the subvolume " +
+			"that it is a snapshot of, to help decide which snapshot to " +
+			"recover from.  For each subvolume, the generation of its root " +
+			"node and the generation it was created in are shown.\n" +
+			"\n" +
+			"A snapshot's parent is found by its parent UUID; if that does " +
+			"not match any subvolume's ROOT_ITEM, then it is looked up in " +
+			"the UUID_TREE (or, with --rebuild, the rebuilt forrest's idea of " +
+			"the parent is used).  Snapshots whose parent cannot be " +
+			"recovered are listed as ORPHANs, at the top level.\n" +
+			"\n" +
+			"Unless --shared=false is given, each snapshot's data extents " +
+			"are compared with its parent's to estimate how much data they " +
+			"share.  This is APPROXIMATE: it counts the full on-disk size of " +
+			"each extent that both refer to, regardless of how much of the " +
+			"extent each refers to.  It reads every subvolume, and so is " +
+			"slow on large filesystems.\n" +
+			"\n" +
+			"With --format=json, the output is a list of the top-level " +
+			"subvolumes, each with a list of its \"Children\".",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) (err error) {
+			ctx := cmd.Context()
+
+			switch flags.format {
+			case "text", "json":
+			default:
+				return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--format: invalid format %q: must be one of \"text\" or \"json\"", flags.format))
+			}
+
+			roots, err := listsnapshots.ListSnapshots(ctx, fs, flags.shared)
+			if err != nil {
+				return err
+			}
+
+			if flags.format == "json" {
+				return writeJSONFile(stdout, roots, lowmemjson.ReEncoderConfig{
+					Indent:                "\t",
+					CompactIfUnder:        80, //nolint:gomnd // This is what looks nice.
+					ForceTrailingNewlines: true,
+				})
+			}
+			out := bufio.NewWriter(stdout)
+			defer func() {
+				if _err := out.Flush(); _err != nil && err == nil {
+					err = _err
+				}
+			}()
+			listsnapshots.WriteText(out, roots)
+			return nil
+		}),
+	}
+	cmd.Flags().BoolVar(&flags.shared, "shared", true,
+		"estimate how much data each snapshot shares with its parent")
+	cmd.Flags().StringVar(&flags.format, "format", "text",
+		"output `FORMAT` (\"text\" or \"json\")")
+	inspectors.AddCommand(cmd)
+}
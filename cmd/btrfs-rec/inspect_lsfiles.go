@@ -6,7 +6,6 @@ package main
 
 import (
 	"bufio"
-	"os"
 
 	"github.com/datawire/ocibuild/pkg/cliutil"
 	"github.com/spf13/cobra"
@@ -21,7 +20,7 @@ func init() {
 		Short: "A listing of all files in the filesystem",
 		Args:  cliutil.WrapPositionalArgs(cobra.NoArgs),
 		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) (err error) {
-			out := bufio.NewWriter(os.Stdout)
+			out := bufio.NewWriter(stdout)
 			defer func() {
 				if _err := out.Flush(); _err != nil && err == nil {
 					err = _err
@@ -31,7 +30,8 @@ func init() {
 			return lsfiles.LsFiles(
 				cmd.Context(),
 				out,
-				fs)
+				fs,
+				subvolumeConfig(false))
 		}),
 	})
 }
@@ -5,10 +5,14 @@
 package main
 
 import (
-	"os"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
 	"strconv"
 	"text/tabwriter"
 
+	"git.lukeshu.com/go/lowmemjson"
 	"github.com/datawire/ocibuild/pkg/cliutil"
 	"github.com/spf13/cobra"
 
@@ -24,59 +28,228 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
+// lsTreesTree is the summary of a single tree (or of lost+found)
+// that ls-trees outputs.
+type lsTreesTree struct {
+	// TreeID is zero for lost+found.
+	TreeID btrfsprim.ObjID `json:",omitempty"`
+	Name   string
+	Errors int
+	// Items are keyed by item-type name, so that the JSON output
+	// is readable.
+	Items   map[string]int
+	Total   int
+	ByObjID []lsTreesObjID `json:",omitempty"`
+
+	itemCnt  map[btrfsitem.Type]int
+	objidCnt map[btrfsprim.ObjID]map[btrfsitem.Type]int
+}
+
+// lsTreesObjID is the counts for a single object ID within an
+// lsTreesTree.
+type lsTreesObjID struct {
+	ObjectID btrfsprim.ObjID
+	Items    map[string]int
+}
+
+func newLsTreesTree(treeID btrfsprim.ObjID, name string, byObjID bool) *lsTreesTree {
+	ret := &lsTreesTree{
+		TreeID:  treeID,
+		Name:    name,
+		itemCnt: make(map[btrfsitem.Type]int),
+	}
+	if byObjID {
+		ret.objidCnt = make(map[btrfsprim.ObjID]map[btrfsitem.Type]int)
+	}
+	return ret
+}
+
+func (t *lsTreesTree) count(key btrfsprim.Key) {
+	t.itemCnt[key.ItemType]++
+	t.Total++
+	if t.objidCnt != nil {
+		cnt, ok := t.objidCnt[key.ObjectID]
+		if !ok {
+			cnt = make(map[btrfsitem.Type]int)
+			t.objidCnt[key.ObjectID] = cnt
+		}
+		cnt[key.ItemType]++
+	}
+}
+
+// finish populates the exported fields from the counts.
+func (t *lsTreesTree) finish() {
+	typeNames := func(in map[btrfsitem.Type]int) map[string]int {
+		out := make(map[string]int, len(in))
+		for typ, cnt := range in {
+			out[typ.String()] = cnt
+		}
+		return out
+	}
+	t.Items = typeNames(t.itemCnt)
+	if t.objidCnt != nil {
+		t.ByObjID = make([]lsTreesObjID, 0, len(t.objidCnt))
+		for _, objID := range maps.SortedKeys(t.objidCnt) {
+			t.ByObjID = append(t.ByObjID, lsTreesObjID{
+				ObjectID: objID,
+				Items:    typeNames(t.objidCnt[objID]),
+			})
+		}
+	}
+}
+
+func (t *lsTreesTree) writeText(w io.Writer) {
+	numWidth := len(strconv.Itoa(slices.Max(t.Errors, t.Total)))
+
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0) //nolint:gomnd // This is what looks nice.
+	textui.Fprintf(table, "        errors\t% *s\n", numWidth, strconv.Itoa(t.Errors))
+	for _, typ := range maps.SortedKeys(t.itemCnt) {
+		textui.Fprintf(table, "        %v items\t% *s\n", typ, numWidth, strconv.Itoa(t.itemCnt[typ]))
+	}
+	textui.Fprintf(table, "        total items\t% *s\n", numWidth, strconv.Itoa(t.Total))
+	for _, objID := range maps.SortedKeys(t.objidCnt) {
+		cnt := t.objidCnt[objID]
+		for _, typ := range maps.SortedKeys(cnt) {
+			textui.Fprintf(table, "        objectid=%v %v items\t% *s\n", uint64(objID), typ, numWidth, strconv.Itoa(cnt[typ]))
+		}
+	}
+	_ = table.Flush()
+}
+
+// csvRows returns the rows for the tree in the "--format=csv"
+// output; see the columns in the command's long help.
+func (t *lsTreesTree) csvRows() [][]string {
+	treeID := "lost+found"
+	if t.TreeID != 0 {
+		treeID = strconv.FormatUint(uint64(t.TreeID), 10)
+	}
+	row := func(objID, typ string, cnt int) []string {
+		return []string{treeID, t.Name, objID, typ, strconv.Itoa(cnt)}
+	}
+	rows := [][]string{row("", "errors", t.Errors)}
+	for _, typ := range maps.SortedKeys(t.itemCnt) {
+		rows = append(rows, row("", typ.String(), t.itemCnt[typ]))
+	}
+	rows = append(rows, row("", "total", t.Total))
+	for _, objID := range maps.SortedKeys(t.objidCnt) {
+		cnt := t.objidCnt[objID]
+		for _, typ := range maps.SortedKeys(cnt) {
+			rows = append(rows, row(strconv.FormatUint(uint64(objID), 10), typ.String(), cnt[typ]))
+		}
+	}
+	return rows
+}
+
+// sortLsTrees sorts trees by tree ID (numerically, not as strings),
+// with lost+found (TreeID=0) last.
+func sortLsTrees(trees []*lsTreesTree) {
+	sort.SliceStable(trees, func(i, j int) bool {
+		a, b := trees[i].TreeID, trees[j].TreeID
+		return a != 0 && (b == 0 || a < b)
+	})
+}
+
 func init() {
-	inspectors.AddCommand(&cobra.Command{
+	var flags struct {
+		keyFilter btrfstree.KeyFilter
+		itemTypes []string
+		byObjID   bool
+		format    string
+	}
+	cmd := &cobra.Command{
 		Use:   "ls-trees",
 		Short: "A brief view what types of items are in each tree",
 		Long: "" +
 			"If no --node-list is given, then a slow sector-by-sector scan " +
-			"will be used to find all lost+found nodes.",
+			"will be used to find all lost+found nodes.\n" +
+			"\n" +
+			"With --key-filter, only items that match are counted, and " +
+			"subtrees that cannot contain any matching items are not " +
+			"walked.  With --item-type-filter, only items of the listed " +
+			"types are counted.  With --by-objectid, the counts are also " +
+			"broken down by object ID.\n" +
+			"\n" +
+			"With --format=json, the output is an array of trees, sorted " +
+			"by tree ID, with lost+found (which has no TreeID) last; item " +
+			"counts are keyed by item-type name, and the --by-objectid " +
+			"counts are an array sorted by object ID.  With --format=csv, " +
+			"the rows are in the same order, and have the columns " +
+			"tree_id, tree_name, objectid, item_type, and count; the rows " +
+			"with an empty objectid are the per-tree totals, and the " +
+			"\"errors\" and \"total\" item_types are the tree's error " +
+			"count and total item count.",
 		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
 		RunE: runWithReadableFSAndNodeList(func(fs btrfs.ReadableFS, nodeList []btrfsvol.LogicalAddr, cmd *cobra.Command, _ []string) error {
 			ctx := cmd.Context()
 
-			var treeErrCnt int
-			var treeItemCnt map[btrfsitem.Type]int
-			flush := func() {
-				totalItems := 0
-				for _, cnt := range treeItemCnt {
-					totalItems += cnt
+			switch flags.format {
+			case "text", "json", "csv":
+			default:
+				return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--format: invalid format %q: must be one of \"text\", \"json\", or \"csv\"", flags.format))
+			}
+			var typeFilter containers.Set[btrfsitem.Type]
+			if len(flags.itemTypes) > 0 {
+				typeFilter = make(containers.Set[btrfsitem.Type], len(flags.itemTypes))
+				for _, str := range flags.itemTypes {
+					typ, err := btrfsprim.ParseItemType(str)
+					if err != nil {
+						return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--item-type-filter: %w", err))
+					}
+					typeFilter.Insert(typ)
 				}
-				numWidth := len(strconv.Itoa(slices.Max(treeErrCnt, totalItems)))
+			}
+			match := func(key btrfsprim.Key) bool {
+				return flags.keyFilter.Match(key) &&
+					(typeFilter == nil || typeFilter.Has(key.ItemType))
+			}
 
-				table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0) //nolint:gomnd // This is what looks nice.
-				textui.Fprintf(table, "        errors\t% *s\n", numWidth, strconv.Itoa(treeErrCnt))
-				for _, typ := range maps.SortedKeys(treeItemCnt) {
-					textui.Fprintf(table, "        %v items\t% *s\n", typ, numWidth, strconv.Itoa(treeItemCnt[typ]))
+			var results []*lsTreesTree
+			var tree *lsTreesTree
+			flush := func() {
+				tree.finish()
+				results = append(results, tree)
+				if flags.format == "text" {
+					tree.writeText(stdout)
 				}
-				textui.Fprintf(table, "        total items\t% *s\n", numWidth, strconv.Itoa(totalItems))
-				_ = table.Flush()
 			}
 			visitedNodes := make(containers.Set[btrfsvol.LogicalAddr])
 			btrfsutil.WalkAllTrees(ctx, fs, btrfsutil.WalkAllTreesHandler{
 				PreTree: func(name string, treeID btrfsprim.ObjID) {
-					treeErrCnt = 0
-					treeItemCnt = make(map[btrfsitem.Type]int)
-					textui.Fprintf(os.Stdout, "tree id=%v name=%q\n", treeID, name)
+					tree = newLsTreesTree(treeID, name, flags.byObjID)
+					if flags.format == "text" {
+						textui.Fprintf(stdout, "tree id=%v name=%q\n", treeID, name)
+					}
 				},
 				BadTree: func(_ string, _ btrfsprim.ObjID, _ error) {
-					treeErrCnt++
+					tree.Errors++
 				},
 				Tree: btrfstree.TreeWalkHandler{
 					Node: func(path btrfstree.Path, node *btrfstree.Node) {
 						visitedNodes.Insert(node.Head.Addr)
 					},
+					KeyPointer: func(path btrfstree.Path, _ btrfstree.KeyPointer) bool {
+						kp := path[len(path)-1].(btrfstree.PathKP) //nolint:forcetypeassert // has to be
+						if !flags.keyFilter.MayContain(kp.ToMinKey, kp.ToMaxKey) {
+							// Pruned by the filter, not lost;
+							// don't list it in lost+found.
+							visitedNodes.Insert(kp.ToAddr)
+							return false
+						}
+						return true
+					},
 					BadNode: func(path btrfstree.Path, node *btrfstree.Node, err error) bool {
-						treeErrCnt++
+						tree.Errors++
 						return false
 					},
 					Item: func(_ btrfstree.Path, item btrfstree.Item) {
-						typ := item.Key.ItemType
-						treeItemCnt[typ]++
+						if match(item.Key) {
+							tree.count(item.Key)
+						}
 					},
 					BadItem: func(_ btrfstree.Path, item btrfstree.Item) {
-						typ := item.Key.ItemType
-						treeItemCnt[typ]++
+						if match(item.Key) {
+							tree.count(item.Key)
+						}
 					},
 				},
 				PostTree: func(_ string, _ btrfsprim.ObjID) {
@@ -85,9 +258,10 @@ func init() {
 			})
 
 			{
-				treeErrCnt = 0
-				treeItemCnt = make(map[btrfsitem.Type]int)
-				textui.Fprintf(os.Stdout, "lost+found\n")
+				tree = newLsTreesTree(0, "lost+found", flags.byObjID)
+				if flags.format == "text" {
+					textui.Fprintf(stdout, "lost+found\n")
+				}
 				for _, laddr := range nodeList {
 					if visitedNodes.Has(laddr) {
 						continue
@@ -98,19 +272,52 @@ func init() {
 					})
 					if err != nil {
 						fs.ReleaseNode(node)
-						treeErrCnt++
+						tree.Errors++
 						continue
 					}
 					for _, item := range node.BodyLeaf {
-						typ := item.Key.ItemType
-						treeItemCnt[typ]++
+						if match(item.Key) {
+							tree.count(item.Key)
+						}
 					}
 					fs.ReleaseNode(node)
 				}
 				flush()
 			}
 
+			sortLsTrees(results)
+			switch flags.format {
+			case "json":
+				return writeJSONFile(stdout, results, lowmemjson.ReEncoderConfig{
+					Indent:                "\t",
+					ForceTrailingNewlines: true,
+				})
+			case "csv":
+				out := csv.NewWriter(stdout)
+				if err := out.Write([]string{"tree_id", "tree_name", "objectid", "item_type", "count"}); err != nil {
+					return err
+				}
+				for _, tree := range results {
+					if err := out.WriteAll(tree.csvRows()); err != nil {
+						return err
+					}
+				}
+				out.Flush()
+				return out.Error()
+			}
 			return nil
 		}),
-	})
+	}
+	cmd.Flags().Var(&flags.keyFilter, "key-filter",
+		"count only items whose keys match `EXPR`, a comma-separated list of "+
+			"objectid=, type=, and offset= terms, each a value or a MIN-MAX range "+
+			"(e.g. 'objectid=256,type=INODE_ITEM' or 'type=EXTENT_DATA,offset=0-4096')")
+	cmd.Flags().StringSliceVar(&flags.itemTypes, "item-type-filter", nil,
+		"count only items of the given `TYPES`, a comma-separated list of item-type names or numbers "+
+			"(e.g. 'INODE_ITEM,DIR_ITEM')")
+	cmd.Flags().BoolVar(&flags.byObjID, "by-objectid", false,
+		"also break down the counts by object ID")
+	cmd.Flags().StringVar(&flags.format, "format", "text",
+		"output `FORMAT` (\"text\", \"json\", or \"csv\")")
+	inspectors.AddCommand(cmd)
 }
@@ -0,0 +1,54 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func TestLsTreesJSONOrder(t *testing.T) {
+	t.Parallel()
+	var trees []*lsTreesTree
+	for _, treeID := range []btrfsprim.ObjID{0, 10, 2, 256, 9} {
+		name := "lost+found"
+		if treeID != 0 {
+			name = treeID.String()
+		}
+		tree := newLsTreesTree(treeID, name, true)
+		for _, objID := range []btrfsprim.ObjID{1000, 99, 256} {
+			tree.count(btrfsprim.Key{ObjectID: objID, ItemType: btrfsitem.INODE_ITEM_KEY})
+		}
+		tree.finish()
+		trees = append(trees, tree)
+	}
+	sortLsTrees(trees)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeJSONFile(&buf, trees, lowmemjson.ReEncoderConfig{}))
+	var decoded []struct {
+		TreeID  btrfsprim.ObjID
+		ByObjID []struct{ ObjectID btrfsprim.ObjID }
+	}
+	require.NoError(t, lowmemjson.NewDecoder(&buf).DecodeThenEOF(&decoded))
+
+	var treeIDs []btrfsprim.ObjID
+	for _, tree := range decoded {
+		treeIDs = append(treeIDs, tree.TreeID)
+		var objIDs []btrfsprim.ObjID
+		for _, obj := range tree.ByObjID {
+			objIDs = append(objIDs, obj.ObjectID)
+		}
+		assert.Equal(t, []btrfsprim.ObjID{99, 256, 1000}, objIDs)
+	}
+	assert.Equal(t, []btrfsprim.ObjID{2, 9, 10, 256, 0}, treeIDs)
+}
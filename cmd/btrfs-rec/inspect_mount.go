@@ -17,13 +17,32 @@ func init() {
 	cmd := &cobra.Command{
 		Use:   "mount MOUNTPOINT",
 		Short: "Mount the filesystem read-only",
-		Args:  cliutil.WrapPositionalArgs(cobra.ExactArgs(1)),
+		Long: "" +
+			"Mount the filesystem read-only with FUSE.  Like other " +
+			"'inspect' commands, this honors --rebuild, --trees, " +
+			"--node-list, and --mappings, so a filesystem that has been " +
+			"rebuilt with 'btrfs-rec inspect rebuild-trees' (but not " +
+			"written back to disk) can be mounted and browsed as it would " +
+			"be after the rebuild.  --read-trees is an alias for --trees.\n" +
+			"\n" +
+			"Reads of a file that run in to an unrecoverable range fail " +
+			"with EIO, but only for the pages that overlap that range; the " +
+			"rest of the file is still readable.\n" +
+			"\n" +
+			"The mount is 'ro,nosuid,nodev,noexec', and every operation " +
+			"that would modify it fails with EROFS.  It is unmounted when " +
+			"btrfs-rec receives SIGINT or SIGTERM (retrying for as long as " +
+			"the mountpoint is busy).",
+		Args: cliutil.WrapPositionalArgs(cobra.ExactArgs(1)),
 		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, args []string) error {
-			return mount.MountRO(cmd.Context(), fs, args[0], skipFileSums)
+			return mount.MountRO(cmd.Context(), fs, args[0], subvolumeConfig(skipFileSums))
 		}),
 	}
 	cmd.Flags().BoolVar(&skipFileSums, "skip-filesums", false,
 		"ignore checksum failures on file contents; allow such files to be read")
+	cmd.Flags().StringVar(&globalFlags.treeRoots, "read-trees", "",
+		"alias for --trees: load list of tree roots (output of 'btrfs-rec inspect rebuild-trees') from external JSON file `trees.json`")
+	noError(cmd.MarkFlagFilename("read-trees"))
 
 	inspectors.AddCommand(cmd)
 }
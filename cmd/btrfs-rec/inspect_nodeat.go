@@ -0,0 +1,177 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/dumptrees"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+func init() {
+	var flags struct {
+		laddr string
+		paddr string
+		color textui.ColorMode
+	}
+	cmd := &cobra.Command{
+		Use:   "node-at {--laddr=ADDR|--paddr=DEV:ADDR}",
+		Short: "Dump a single node, even if it is corrupt",
+		Long: "" +
+			"Read the node at the given logical or physical address, and " +
+			"dump its header and all of its key-pointers or items, in the " +
+			"same format as dump-trees.\n" +
+			"\n" +
+			"Unlike dump-trees, the node is dumped even if it fails " +
+			"checksum or other sanity checks; the reasons that it is bad " +
+			"are printed before it.  If the block does not look like a " +
+			"node at all (or cannot be parsed), a hex dump of the raw " +
+			"bytes is printed instead.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithRawFS(nil, func(fs *btrfs.FS, cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+			style := dumptrees.Style{Color: flags.color.Enabled(stdout)}
+			sb, err := fs.Superblock()
+			if err != nil {
+				return err
+			}
+			switch {
+			case (flags.laddr == "") == (flags.paddr == ""):
+				return fmt.Errorf("exactly one of --laddr or --paddr must be given")
+			case flags.laddr != "":
+				laddr, err := strconv.ParseInt(flags.laddr, 0, 64)
+				if err != nil {
+					return fmt.Errorf("--laddr: %w", err)
+				}
+				return dumpNodeAt[btrfsvol.LogicalAddr](ctx, stdout, style, fs, *sb,
+					btrfsvol.LogicalAddr(laddr), containers.OptionalValue(btrfsvol.LogicalAddr(laddr)))
+			default:
+				paddr, err := parseQualifiedPhysicalAddr(flags.paddr)
+				if err != nil {
+					return fmt.Errorf("--paddr: %w", err)
+				}
+				dev, ok := fs.LV.PhysicalVolumes()[paddr.Dev]
+				if !ok {
+					return fmt.Errorf("--paddr: no device with id=%v", paddr.Dev)
+				}
+				var expLAddr containers.Optional[btrfsvol.LogicalAddr]
+				if laddr := fs.LV.UnResolve(paddr); laddr >= 0 {
+					expLAddr = containers.OptionalValue(laddr)
+					textui.Fprintf(stdout, "paddr %v:%v maps to laddr %v\n", paddr.Dev, paddr.Addr, laddr)
+				} else {
+					textui.Fprintf(stdout, "paddr %v:%v is not mapped to any laddr\n", paddr.Dev, paddr.Addr)
+				}
+				return dumpNodeAt[btrfsvol.PhysicalAddr](ctx, stdout, style, dev, *sb,
+					paddr.Addr, expLAddr)
+			}
+		}),
+	}
+	cmd.Flags().StringVar(&flags.laddr, "laddr", "",
+		"dump the node at logical address `ADDR`")
+	cmd.Flags().StringVar(&flags.paddr, "paddr", "",
+		"dump the node at physical address `DEV:ADDR` (device ID and byte offset)")
+	cmd.Flags().Var(&flags.color, "color",
+		"colorize the output: 'auto' (only if stdout is a terminal), 'always', or 'never'")
+	inspectors.AddCommand(cmd)
+}
+
+func parseQualifiedPhysicalAddr(str string) (btrfsvol.QualifiedPhysicalAddr, error) {
+	devStr, addrStr, ok := strings.Cut(str, ":")
+	if !ok {
+		return btrfsvol.QualifiedPhysicalAddr{}, fmt.Errorf("expected DEV:ADDR, got %q", str)
+	}
+	dev, err := strconv.ParseUint(devStr, 0, 64)
+	if err != nil {
+		return btrfsvol.QualifiedPhysicalAddr{}, fmt.Errorf("device ID: %w", err)
+	}
+	addr, err := strconv.ParseInt(addrStr, 0, 64)
+	if err != nil {
+		return btrfsvol.QualifiedPhysicalAddr{}, fmt.Errorf("address: %w", err)
+	}
+	return btrfsvol.QualifiedPhysicalAddr{
+		Dev:  btrfsvol.DeviceID(dev),
+		Addr: btrfsvol.PhysicalAddr(addr),
+	}, nil
+}
+
+// dumpNodeAt reads the node at `addr` and prints it along with
+// everything that is wrong with it.  Only an I/O error reading the
+// block is returned as an error; anything wrong with the contents of
+// the block is printed.
+func dumpNodeAt[Addr ~int64](
+	ctx context.Context, out io.Writer, style dumptrees.Style,
+	src diskio.ReaderAt[Addr], sb btrfstree.Superblock,
+	addr Addr, expLAddr containers.Optional[btrfsvol.LogicalAddr],
+) error {
+	raw := make([]byte, sb.NodeSize)
+	if _, err := src.ReadAt(raw, addr); err != nil {
+		return err
+	}
+
+	// First, get the verdict from a normal read.
+	node, readErr := btrfstree.ReadNodeWithConfig[Addr](src, sb, addr, btrfstree.ReadNodeConfig{
+		StrictItemSizes: globalFlags.strictItemSizes,
+		SalvagePartial:  globalFlags.salvagePartial,
+	})
+	switch {
+	case readErr == nil:
+		// OK
+	case errors.Is(readErr, btrfstree.ErrNotANode):
+		textui.Fprintf(out, "BAD: %v: metadata UUID is %v but the filesystem's is %v\n",
+			readErr, node.Head.MetadataUUID, sb.EffectiveMetadataUUID())
+		node.RawFree()
+		textui.Fprintf(out, "raw bytes:\n%s", hex.Dump(raw))
+		return nil
+	default:
+		textui.Fprintf(out, "BAD: %v\n", readErr)
+		// The body didn't get parsed; re-read it without
+		// verifying the checksum so that it can be dumped
+		// anyway.
+		node.RawFree()
+		var err error
+		node, err = btrfstree.ReadNodeWithConfig[Addr](src, sb, addr, btrfstree.ReadNodeConfig{
+			NoVerifyChecksum: true,
+			StrictItemSizes:  globalFlags.strictItemSizes,
+			SalvagePartial:   globalFlags.salvagePartial,
+		})
+		if err != nil {
+			if node != nil {
+				textui.Fprintf(out, "BAD: %v\n", err)
+				dumptrees.PrintNode(ctx, out, style, node)
+				node.RawFree()
+			}
+			textui.Fprintf(out, "raw bytes:\n%s", hex.Dump(raw))
+			return nil
+		}
+	}
+	defer node.RawFree()
+
+	// Then, check everything that can be checked without the
+	// context of a tree.
+	exp := btrfstree.NodeExpectations{LAddr: expLAddr}
+	if err := exp.Check(node); err != nil {
+		textui.Fprintf(out, "BAD: %v\n", err)
+	} else if readErr == nil {
+		textui.Fprintf(out, "OK\n")
+	}
+
+	dumptrees.PrintNode(ctx, out, style, node)
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/dumptrees"
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+// memLogical is an in-memory image of the logical address space.
+type memLogical []byte
+
+func (m memLogical) ReadAt(p []byte, off btrfsvol.LogicalAddr) (int, error) {
+	return copy(p, m[off:]), nil
+}
+
+func TestParseQualifiedPhysicalAddr(t *testing.T) {
+	t.Parallel()
+	type TestCase struct {
+		Input  string
+		Exp    btrfsvol.QualifiedPhysicalAddr
+		ExpErr string
+	}
+	testcases := map[string]TestCase{
+		"decimal":  {Input: "1:4096", Exp: btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: 4096}},
+		"hex":      {Input: "2:0x1000", Exp: btrfsvol.QualifiedPhysicalAddr{Dev: 2, Addr: 0x1000}},
+		"no-dev":   {Input: "4096", ExpErr: `expected DEV:ADDR, got "4096"`},
+		"bad-dev":  {Input: "x:4096", ExpErr: "device ID"},
+		"bad-addr": {Input: "1:x", ExpErr: "address"},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			addr, err := parseQualifiedPhysicalAddr(tc.Input)
+			if tc.ExpErr != "" {
+				assert.ErrorContains(t, err, tc.ExpErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Exp, addr)
+		})
+	}
+}
+
+//nolint:paralleltest // Can't be parallel because it reads globalFlags.
+func TestDumpNodeAt(t *testing.T) {
+	const (
+		nodeSize = 0x1000
+		laddr    = btrfsvol.LogicalAddr(0x4000)
+	)
+	fsUUID := btrfsprim.UUID{0x01, 0x02, 0x03}
+	sb := btrfstree.Superblock{
+		FSUUID:       fsUUID,
+		NodeSize:     nodeSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+	}
+	mkImage := func() memLogical {
+		img := make(memLogical, 0x8000)
+		builder := &btrfstree.NodeBuilder{
+			Size:         nodeSize,
+			ChecksumType: btrfssum.TYPE_CRC32,
+			Head: btrfstree.NodeHeader{
+				MetadataUUID: fsUUID,
+				Flags:        btrfstree.NodeWritten,
+				BackrefRev:   btrfstree.MixedBackrefRev,
+				Generation:   5,
+				Owner:        btrfsprim.FS_TREE_OBJECTID,
+			},
+			Alloc: func() (btrfsvol.LogicalAddr, error) {
+				return laddr, nil
+			},
+			Emit: func(node *btrfstree.Node) error {
+				bs, err := binstruct.Marshal(*node)
+				copy(img[node.Head.Addr:], bs)
+				return err
+			},
+		}
+		require.NoError(t, builder.Add(btrfstree.Item{
+			Key:  btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.INODE_ITEM_KEY},
+			Body: &btrfsitem.Inode{Generation: 5, NLink: 1},
+		}))
+		_, _, err := builder.Finish()
+		require.NoError(t, err)
+		return img
+	}
+
+	type TestCase struct {
+		Corrupt  func(memLogical)
+		ExpLAddr containers.Optional[btrfsvol.LogicalAddr]
+		ExpFirst string
+		ExpItem  bool
+		ExpRaw   bool
+	}
+	testcases := map[string]TestCase{
+		"good": {
+			ExpLAddr: containers.OptionalValue(laddr),
+			ExpFirst: "OK",
+			ExpItem:  true,
+		},
+		"bad-checksum": {
+			Corrupt:  func(img memLogical) { img[laddr+nodeSize-1] ^= 0xff },
+			ExpLAddr: containers.OptionalValue(laddr),
+			ExpFirst: "BAD: ",
+			ExpItem:  true,
+		},
+		"wrong-laddr": {
+			ExpLAddr: containers.OptionalValue(laddr + nodeSize),
+			ExpFirst: "BAD: ",
+			ExpItem:  true,
+		},
+		"not-a-node": {
+			Corrupt:  func(img memLogical) { img[laddr+0x20] ^= 0xff }, // the metadata UUID
+			ExpLAddr: containers.OptionalValue(laddr),
+			ExpFirst: "BAD: ",
+			ExpRaw:   true,
+		},
+	}
+	for tcName, tc := range testcases {
+		t.Run(tcName, func(t *testing.T) {
+			ctx := dlog.NewTestContext(t, false)
+			img := mkImage()
+			if tc.Corrupt != nil {
+				tc.Corrupt(img)
+			}
+			var out strings.Builder
+			require.NoError(t, dumpNodeAt[btrfsvol.LogicalAddr](ctx, &out, dumptrees.Style{}, img, sb, laddr, tc.ExpLAddr))
+			assert.True(t, strings.HasPrefix(out.String(), tc.ExpFirst), "first line")
+			assert.Equal(t, tc.ExpItem, strings.Contains(out.String(), "INODE_ITEM"), "dumps the item")
+			assert.Equal(t, tc.ExpRaw, strings.Contains(out.String(), "raw bytes:\n"), "dumps raw bytes")
+		})
+	}
+}
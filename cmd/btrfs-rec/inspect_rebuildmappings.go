@@ -6,7 +6,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 
 	"git.lukeshu.com/go/lowmemjson"
 	"github.com/datawire/dlib/dlog"
@@ -51,7 +50,7 @@ func init() {
 			}
 
 			dlog.Infof(ctx, "Writing reconstructed mappings to stdout...")
-			if err := writeJSONFile(os.Stdout, fs.LV.Mappings(), lowmemjson.ReEncoderConfig{
+			if err := writeJSONFile(stdout, fs.LV.Mappings(), lowmemjson.ReEncoderConfig{
 				Indent:                "\t",
 				ForceTrailingNewlines: true,
 				CompactIfUnder:        120, //nolint:gomnd // This is what looks nice.
@@ -82,7 +81,7 @@ func init() {
 			}
 
 			dlog.Info(ctx, "Writing scan results to stdout...")
-			if err := writeJSONFile(os.Stdout, scanResults, lowmemjson.ReEncoderConfig{
+			if err := writeJSONFile(stdout, scanResults, lowmemjson.ReEncoderConfig{
 				Indent:                "\t",
 				ForceTrailingNewlines: true,
 				CompactIfUnder:        16, //nolint:gomnd // This is what looks nice.
@@ -139,7 +138,7 @@ func init() {
 			}
 
 			dlog.Infof(ctx, "Writing reconstructed mappings to stdout...")
-			if err := writeJSONFile(os.Stdout, fs.LV.Mappings(), lowmemjson.ReEncoderConfig{
+			if err := writeJSONFile(stdout, fs.LV.Mappings(), lowmemjson.ReEncoderConfig{
 				Indent:                "\t",
 				ForceTrailingNewlines: true,
 				CompactIfUnder:        120, //nolint:gomnd // This is what looks nice.
@@ -181,7 +180,7 @@ func init() {
 			nodeList := maps.SortedKeys(set)
 
 			dlog.Infof(ctx, "Writing nodes to stdout...")
-			if err := writeJSONFile(os.Stdout, nodeList, lowmemjson.ReEncoderConfig{
+			if err := writeJSONFile(stdout, nodeList, lowmemjson.ReEncoderConfig{
 				Indent:                "\t",
 				ForceTrailingNewlines: true,
 			}); err != nil {
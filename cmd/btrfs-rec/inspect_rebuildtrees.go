@@ -5,8 +5,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"time"
 
 	"git.lukeshu.com/go/lowmemjson"
@@ -16,12 +20,22 @@ import (
 
 	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/rebuildtrees"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
 	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
 func init() {
-	inspectors.AddCommand(&cobra.Command{
+	var dupKeyReport, lowConfidenceReport string
+	var estimate bool
+	var priorityTrees []string
+	var rootTreeRoot string
+	var resumeFromTrees string
+	var cfg rebuildtrees.Config
+	cmd := &cobra.Command{
 		Use: "rebuild-trees",
 		Long: "" +
 			"Rebuild broken btrees based on missing items that are implied " +
@@ -30,22 +44,83 @@ func init() {
 			"with `btrfs-rec inspect rebuild-mappings`.\n" +
 			"\n" +
 			"If no --node-list is given, then a slow sector-by-sector scan " +
-			"will be used to find all nodes.",
+			"will be used to find all nodes.\n" +
+			"\n" +
+			"With --estimate, only the scan is done, and rather than " +
+			"rebuilding the trees, an approximate prediction of how much " +
+			"work the rebuild would be (the number of nodes and items, the " +
+			"trees that might need to be rebuilt, and a rough time based " +
+			"on the number of nodes) is written to stdout, along with the " +
+			"assumptions that the prediction makes.",
 		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
 		RunE: runWithRawFSAndNodeList(func(fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr, cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
 
-			rebuilder, err := rebuildtrees.NewRebuilder(ctx, fs, nodeList)
+			if laxAncestors(cmd, false) {
+				// Lax mode inhibits the AddedItem callbacks that
+				// drive the rebuild, and panics when the rebuild
+				// adds roots to the ROOT_TREE.
+				return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--lax-ancestors is not supported by rebuild-trees"))
+			}
+			if cfg.MinConfidence < 0 || cfg.MinConfidence > 1 {
+				return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--min-confidence must be in the range [0, 1], but is %v",
+					cfg.MinConfidence))
+			}
+			if lowConfidenceReport != "" && cfg.MinConfidence == 0 {
+				return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--low-confidence-report requires --min-confidence"))
+			}
+			cfg.PriorityTrees = nil
+			for _, str := range priorityTrees {
+				treeID, err := btrfsprim.ParseObjID(str)
+				if err != nil {
+					return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--priority-trees: %w", err))
+				}
+				cfg.PriorityTrees = append(cfg.PriorityTrees, treeID)
+			}
+			cfg.RootTreeRoot = 0
+			if rootTreeRoot != "" {
+				laddr, err := strconv.ParseInt(rootTreeRoot, 0, 64)
+				if err != nil {
+					return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--root-tree-root: %w", err))
+				}
+				cfg.RootTreeRoot = btrfsvol.LogicalAddr(laddr)
+			}
+			cfg.ChecksumTree = globalFlags.checksumTree
+			cfg.DupKeyReport = dupKeyReport != ""
+			if estimate {
+				scanData, err := rebuildtrees.ScanDevices(ctx, fs, nodeList)
+				if err != nil {
+					return err
+				}
+				_, err = rebuildtrees.EstimateRebuild(scanData).WriteTo(stdout)
+				return err
+			}
+			rebuilder, err := rebuildtrees.NewRebuilder(ctx, fs, nodeList, cfg)
 			if err != nil {
 				return err
 			}
+			if err := applyTrustedGenerations(ctx, rebuilder.SetTrustedGeneration); err != nil {
+				return err
+			}
+			if err := applyImportedItems(ctx, rebuilder.InjectItems); err != nil {
+				return err
+			}
+			if resumeFromTrees != "" {
+				roots, err := readJSONFile[map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]](ctx, resumeFromTrees)
+				if err != nil {
+					return err
+				}
+				if err := rebuilder.SeedRoots(ctx, roots); err != nil {
+					return err
+				}
+			}
 
 			runtime.GC()
-			time.Sleep(textui.LiveMemUseUpdateInterval) // let the logs reflect that GC right away
+			time.Sleep(textui.LiveMemUseUpdateInterval.Get()) // let the logs reflect that GC right away
 
 			dlog.Info(ctx, "Rebuilding node tree...")
 			rebuildErr := rebuilder.Rebuild(ctx)
-			dst := os.Stdout
+			dst := stdout
 			if rebuildErr != nil {
 				dst = os.Stderr
 				dlog.Errorf(ctx, "rebuild error: %v", rebuildErr)
@@ -63,7 +138,135 @@ func init() {
 			}
 			dlog.Info(ctx, "... done writing")
 
+			if dupKeyReport != "" {
+				if err := writeDupKeyReport(ctx, dupKeyReport, rebuilder.DupKeyReport()); err != nil {
+					if rebuildErr != nil {
+						return rebuildErr
+					}
+					return err
+				}
+			}
+
+			if cfg.MinConfidence > 0 {
+				if err := writeLowConfidenceReport(ctx, lowConfidenceReport, cfg.MinConfidence, rebuilder.LowConfidenceReport(ctx)); err != nil {
+					if rebuildErr != nil {
+						return rebuildErr
+					}
+					return err
+				}
+			}
+
 			return rebuildErr
 		}),
+	}
+	cmd.Flags().IntVar(&cfg.ItemsPerNodeHint, "items-per-node-hint", 0,
+		"size the settled-item read-ahead buffer for an average of `N` items per node "+
+			"(0 to estimate it from the scanned nodes); this only affects performance")
+	cmd.Flags().Var(&cfg.SortExtentQueue, "sort-extent-queue",
+		"how to order the EXTENT_TREE items in the processing queue: 'minla' (sort backrefs by referenced tree), "+
+			"'refcount' (same, but most-referenced trees first), or 'none' (sort by key); "+
+			"this only affects performance")
+	cmd.Flags().IntVar(&cfg.AugmentBacktrackLimit, "augment-backtrack-limit", 0,
+		"when choosing which nodes to add to a tree, improve on the greedy choice by exhaustively searching "+
+			"each cluster of conflicting candidate nodes of at most `N` nodes (0 to only use the greedy choice)")
+	cmd.Flags().BoolVar(&cfg.RelocAsTarget, "reloc-as-target", false,
+		"treat nodes owned by a reloc tree (left behind by an interrupted balance) as owned by the tree "+
+			"that was being relocated; each reattributed node is logged")
+	cmd.Flags().StringVar(&dupKeyReport, "dup-key-report", "",
+		"write a report of every key that appeared in multiple leaves of a tree with differing generations or owners, "+
+			"and which item was selected, to the JSON file `report.json` (uses more memory)")
+	noError(cmd.MarkFlagFilename("dup-key-report", "json"))
+	cmd.Flags().Float64Var(&cfg.MinConfidence, "min-confidence", 0,
+		"don't add a candidate node to a tree if its confidence score (in the range (0, 1], based on how many "+
+			"want-lists it satisfies, its COW distance, and whether it is the newest candidate) is below `N`; "+
+			"such nodes are reported for manual review, and may be accepted by adding them to the --trees file")
+	cmd.Flags().StringVar(&lowConfidenceReport, "low-confidence-report", "",
+		"write the candidate nodes that were rejected by --min-confidence to the JSON file `report.json`, "+
+			"rather than just logging them")
+	noError(cmd.MarkFlagFilename("low-confidence-report", "json"))
+	cmd.Flags().StringSliceVar(&priorityTrees, "priority-trees", nil,
+		"rebuild the trees with these `ID`s (such as the subvolumes that you are waiting on) before any others "+
+			"except for the ROOT, CHUNK, BLOCK_GROUP, and UUID trees, which are always first; "+
+			"other internal trees come next, and then the remaining subvolumes (comma-separated, or repeat the flag); "+
+			"this only affects the order that work is done in, not the result")
+	cmd.Flags().StringVar(&rootTreeRoot, "root-tree-root", "",
+		"use the node at logical address `ADDR` as the root of the ROOT_TREE, rather than choosing one by "+
+			"cross-referencing the superblock mirrors (and their backup roots) with the scanned nodes; "+
+			"the candidates and the reason for the choice are logged")
+	cmd.Flags().StringVar(&resumeFromTrees, "resume-from-trees", "",
+		"seed the rebuild with the tree roots in the JSON file `trees.json` (the output of a previous rebuild-trees, "+
+			"perhaps with roots added by hand, such as from find-root), and continue rebuilding from there; "+
+			"seeded roots are never discarded, and the output includes them; which final roots were seeded "+
+			"and which were auto-discovered is logged")
+	noError(cmd.MarkFlagFilename("resume-from-trees", "json"))
+	cmd.Flags().IntVar(&cfg.Threads, "threads", 0,
+		"use up to `N` goroutines for the parallel parts of the rebuild, such as adding the chosen nodes to "+
+			"many independent trees (0 for GOMAXPROCS; also limited by the btrfsutil.rebuilt-*-cache-size tunables); "+
+			"this only affects performance, not the result")
+	cmd.Flags().BoolVar(&estimate, "estimate", false,
+		"don't rebuild anything; just scan, and print an approximate prediction of how much work the rebuild would be")
+	inspectors.AddCommand(cmd)
+}
+
+// writeDupKeyReport writes the report as a JSON array, sorted by tree
+// and then by key.
+func writeDupKeyReport(ctx context.Context, filename string, report map[btrfsprim.ObjID]map[btrfsprim.Key]btrfsutil.DupKeyConflict) (err error) {
+	var list []btrfsutil.DupKeyConflict
+	for _, treeID := range maps.SortedKeys(report) {
+		conflicts := report[treeID]
+		keys := maps.Keys(conflicts)
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].Compare(keys[j]) < 0
+		})
+		for _, key := range keys {
+			list = append(list, conflicts[key])
+		}
+	}
+	dlog.Infof(ctx, "Writing report of %d duplicate keys to %s...", len(list), filename)
+	fh, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _err := fh.Close(); err == nil && _err != nil {
+			err = _err
+		}
+	}()
+	return writeJSONFile(fh, list, lowmemjson.ReEncoderConfig{
+		Indent:                "\t",
+		CompactIfUnder:        80, //nolint:gomnd // This is what looks nice.
+		ForceTrailingNewlines: true,
+	})
+}
+
+// writeLowConfidenceReport logs the candidates that were rejected by
+// --min-confidence, and if `filename` is non-empty, writes them to it
+// as a JSON array.
+func writeLowConfidenceReport(ctx context.Context, filename string, minConfidence float64, report []rebuildtrees.LowConfidenceCandidate) (err error) {
+	for _, cand := range report {
+		dlog.Infof(ctx, "low-confidence candidate: tree=%v node=%v confidence=%.3f wants=%q",
+			cand.TreeID, cand.Node, cand.Confidence, cand.Wants)
+	}
+	if len(report) > 0 {
+		dlog.Warnf(ctx, "%d candidate nodes were not added because their confidence was below --min-confidence=%v",
+			len(report), minConfidence)
+	}
+	if filename == "" {
+		return nil
+	}
+	dlog.Infof(ctx, "Writing report of %d low-confidence candidates to %s...", len(report), filename)
+	fh, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _err := fh.Close(); err == nil && _err != nil {
+			err = _err
+		}
+	}()
+	return writeJSONFile(fh, report, lowmemjson.ReEncoderConfig{
+		Indent:                "\t",
+		CompactIfUnder:        80, //nolint:gomnd // This is what looks nice.
+		ForceTrailingNewlines: true,
 	})
 }
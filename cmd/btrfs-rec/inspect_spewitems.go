@@ -5,8 +5,6 @@
 package main
 
 import (
-	"os"
-
 	"github.com/datawire/dlib/dlog"
 	"github.com/datawire/ocibuild/pkg/cliutil"
 	"github.com/davecgh/go-spew/spew"
@@ -36,14 +34,14 @@ func init() {
 				},
 				Tree: btrfstree.TreeWalkHandler{
 					Item: func(path btrfstree.Path, item btrfstree.Item) {
-						textui.Fprintf(os.Stdout, "%s = ", path)
+						textui.Fprintf(stdout, "%s = ", path)
 						spew.Dump(item)
-						_, _ = os.Stdout.WriteString("\n")
+						_, _ = stdout.WriteString("\n")
 					},
 					BadItem: func(path btrfstree.Path, item btrfstree.Item) {
-						textui.Fprintf(os.Stdout, "%s = ", path)
+						textui.Fprintf(stdout, "%s = ", path)
 						spew.Dump(item)
-						_, _ = os.Stdout.WriteString("\n")
+						_, _ = stdout.WriteString("\n")
 					},
 				},
 			})
@@ -0,0 +1,102 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+func init() {
+	var flags struct {
+		align int64
+		all   bool
+	}
+	cmd := &cobra.Command{
+		Use:   "superblock-search",
+		Short: "Scan the devices for superblocks anywhere on disk, not just at the standard locations",
+		Long: "" +
+			"Scan each --pv device for the btrfs superblock magic at every " +
+			"--align-byte boundary, and validate each candidate's checksum " +
+			"and fields.  Every plausible superblock is listed with its " +
+			"physical offset, generation, and root pointers.\n" +
+			"\n" +
+			"This can rescue a filesystem whose standard superblock " +
+			"locations are all destroyed, if an older superblock survives " +
+			"elsewhere (for instance, from before a resize, or from a " +
+			"filesystem that started at a different offset).  A hit that is " +
+			"not at a standard location (the MIRROR column is \"-\") " +
+			"may belong to a different filesystem, or to this one at an " +
+			"offset; compare its FSID and generation before copying it " +
+			"over the standard locations.\n" +
+			"\n" +
+			"Unlike most commands, this does not need any of the devices " +
+			"to have a readable superblock.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: run(func(cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+
+			if len(globalFlags.pvs) == 0 {
+				return cliutil.FlagErrorFunc(cmd, fmt.Errorf("must specify 1 or more physical volumes with --pv"))
+			}
+			if flags.align <= 0 || flags.align%512 != 0 {
+				return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--align must be a positive multiple of 512"))
+			}
+
+			table := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0) //nolint:gomnd // This is what looks nice.
+			textui.Fprintf(table, "DEVICE\tOFFSET\tMIRROR\tGENERATION\tFSID\tDEVID\tROOT\tCHUNK_ROOT\tLOG_ROOT\tSTATUS\n")
+			var numPlausible int
+			for _, filename := range globalFlags.pvs {
+				dev, err := openDevice(ctx, filename)
+				if err != nil {
+					return fmt.Errorf("device file %q: %w", filename, err)
+				}
+				err = btrfsutil.SearchSuperblocks(ctx, dev, btrfsvol.PhysicalAddr(flags.align), func(cand btrfsutil.SuperblockCandidate) error {
+					status := "ok"
+					if !cand.Plausible() {
+						dlog.Debugf(ctx, "%s: superblock magic at %v, but: %v", filename, cand.Addr, cand.Err)
+						if !flags.all {
+							return nil
+						}
+						status = cand.Err.Error()
+					} else {
+						numPlausible++
+					}
+					mirror := "-"
+					if cand.Mirror >= 0 {
+						mirror = textui.Sprintf("%v", cand.Mirror)
+					}
+					sb := cand.Superblock
+					textui.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+						filename, cand.Addr, mirror, sb.Generation, sb.FSUUID, sb.DevItem.DevID,
+						sb.RootTree, sb.ChunkTree, sb.LogTree, status)
+					return nil
+				})
+				_ = dev.Close()
+				if err != nil {
+					return fmt.Errorf("device file %q: %w", filename, err)
+				}
+			}
+			if err := table.Flush(); err != nil {
+				return err
+			}
+			textui.Fprintf(stdout, "found %v plausible superblocks\n", numPlausible)
+			return nil
+		}),
+	}
+	cmd.Flags().Int64Var(&flags.align, "align", 512,
+		"check for a superblock at every multiple of `bytes`")
+	cmd.Flags().BoolVar(&flags.all, "all", false,
+		"also list candidates that have the magic but fail validation")
+	inspectors.AddCommand(cmd)
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/walkfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func init() {
+	var flags struct {
+		treeID btrfsprim.ObjID
+		jsonl  bool
+	}
+	cmd := &cobra.Command{
+		Use:   "walk-fs",
+		Short: "List every path in a subvolume with its recovery status",
+		Long: "" +
+			"Walk a subvolume (and the subvolumes nested within it), and " +
+			"for every path print its inode number, type, size, and " +
+			"whether it is fully recoverable ('ok'), is missing some of " +
+			"its content ('partial'), or has nothing but its name and " +
+			"maybe its inode recoverable ('metadata-only').\n" +
+			"\n" +
+			"This is meant for planning a large recovery before running " +
+			"'extract-subvol'; it only reads metadata, judging file data " +
+			"by its extent map (as 'check-inode' does) rather than by " +
+			"reading it.\n" +
+			"\n" +
+			"Output is streamed as the walk proceeds, either as a " +
+			"human-readable table or (with --jsonl) as one JSON object " +
+			"per line.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) error {
+			write := walkfs.NewTableWriter(stdout)
+			if flags.jsonl {
+				write = walkfs.NewJSONLinesWriter(stdout)
+			}
+			return walkfs.Walk(cmd.Context(), fs, flags.treeID, subvolumeConfig(false), write)
+		}),
+	}
+	flags.treeID = btrfsprim.FS_TREE_OBJECTID
+	cmd.Flags().Var(&flags.treeID, "tree",
+		"the tree `ID` of the subvolume to walk")
+	cmd.Flags().BoolVar(&flags.jsonl, "jsonl", false,
+		"write JSON Lines instead of a table")
+	inspectors.AddCommand(cmd)
+}
@@ -10,6 +10,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"text/tabwriter"
 
 	"github.com/datawire/dlib/dgroup"
 	"github.com/datawire/dlib/dlog"
@@ -22,6 +23,7 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
 	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
 	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
 	"git.lukeshu.com/btrfs-progs-ng/lib/profile"
 	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
@@ -34,6 +36,26 @@ var (
 		Args: cliutil.WrapPositionalArgs(cliutil.OnlySubcommands),
 		RunE: cliutil.RunSubcommands,
 	}
+	tunablesCmd = &cobra.Command{
+		Use:   "tunables",
+		Short: "List the tunable performance knobs, and their current values",
+		Long: "" +
+			"Tunables may be overridden with --tune=NAME=VALUE, or with the " +
+			tuneEnvVar + " environment variable (a comma-separated list " +
+			"of NAME=VALUE pairs, which --tune takes precedence over).  " +
+			"Durations are written like \"1s\" or \"500ms\"; every " +
+			"tunable must be greater than 0.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		RunE: run(func(_ *cobra.Command, _ []string) error {
+			table := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0) //nolint:gomnd // This is what looks nice.
+			textui.Fprintf(table, "NAME\tTYPE\tDEFAULT\tVALUE\n")
+			for _, tunable := range textui.Tunables() {
+				textui.Fprintf(table, "%v\t%v\t%v\t%v\n",
+					tunable.Name, tunable.Type, tunable.Default, tunable.Value)
+			}
+			return table.Flush()
+		}),
+	}
 	repairers = &cobra.Command{
 		Use:   "repair {[flags]|SUBCOMMAND}",
 		Short: "Repair a broken btrfs filesystem",
@@ -41,27 +63,71 @@ var (
 		Args: cliutil.WrapPositionalArgs(cliutil.OnlySubcommands),
 		RunE: cliutil.RunSubcommands,
 
-		PersistentPreRunE: func(_ *cobra.Command, _ []string) error {
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
 			globalFlags.openFlag = os.O_RDWR
+			globalFlags.verifyAfterWriteSet = cmd.Flags().Changed("verify-after-write")
 			return nil
 		},
 	}
 )
 
+// tuneEnvVar is the environment variable that tunables are read from,
+// before --tune is applied.
+const tuneEnvVar = "BTRFS_REC_TUNE"
+
 var globalFlags struct {
-	logLevel textui.LogLevelFlag
-	pvs      []string
+	logLevel  textui.LogLevelFlag
+	logFormat textui.LogFormat
+	pvs       []string
+	pvDir     string
+
+	mappings    string
+	nodeList    string
+	graphCache  string
+	rebuild     bool
+	treeRoots   string
+	trustedGens string
+	importItems string
+
+	laxAncestors bool
+
+	noVerifyNodeCSum bool
+	strictItemSizes  bool
+	salvagePartial   bool
+	trustPartial     bool
+	mmap             bool
+	tune             []string
+
+	maxInlineExtent int64
+	checksumTree    btrfsprim.ObjID
 
-	mappings  string
-	nodeList  string
-	rebuild   bool
-	treeRoots string
+	resultsTo string
+	statusTo  string
+
+	verifyAfterWrite    bool
+	verifyAfterWriteSet bool
 
 	stopProfiling profile.StopFunc
 
 	openFlag int
 }
 
+// exitStatus is the status that main() exits with if the command
+// succeeds; commands that report a result through their exit status
+// (such as 'inspect fsck') set it.  A failed command always exits
+// with status 1.
+var exitStatus int
+
+// subvolumeConfig returns the btrfs.SubvolumeConfig for the global
+// flags.
+func subvolumeConfig(noChecksums bool) btrfs.SubvolumeConfig {
+	return btrfs.SubvolumeConfig{
+		NoChecksums:     noChecksums,
+		MaxInlineExtent: globalFlags.maxInlineExtent,
+		ChecksumTree:    globalFlags.checksumTree,
+	}
+}
+
 func noError(err error) {
 	if err != nil {
 		panic(fmt.Errorf("should not happen: %w", err))
@@ -92,19 +158,28 @@ func main() {
 
 	globalFlags.logLevel.Level = dlog.LogLevelInfo
 	argparser.PersistentFlags().Var(&globalFlags.logLevel, "verbosity", "set the verbosity")
+	argparser.PersistentFlags().Var(&globalFlags.logFormat, "log-format",
+		"how to format log lines: 'text', or 'json' (one JSON object per line)")
 
 	argparser.PersistentFlags().StringArrayVar(&globalFlags.pvs, "pv", nil,
 		"open the file `physical_volume` as part of the filesystem")
 	noError(argparser.MarkPersistentFlagFilename("pv"))
+	argparser.PersistentFlags().StringVar(&globalFlags.pvDir, "pv-dir", "",
+		"open every btrfs device file in `directory` as part of the filesystem, assembling them by device ID rather than by order, and skipping any that the chunk tree doesn't recognize (may be combined with --pv)")
+	noError(argparser.MarkPersistentFlagDirname("pv-dir"))
 
 	argparser.PersistentFlags().StringVar(&globalFlags.mappings, "mappings", "",
-		"load chunk/dev-extent/blockgroup data from external JSON file `mappings.json`")
+		"load chunk/dev-extent/blockgroup data (output of 'btrfs-rec inspect rebuild-mappings' or 'btrfs-rec inspect export-mappings') from external JSON file `mappings.json`")
 	noError(argparser.MarkPersistentFlagFilename("mappings"))
 
 	argparser.PersistentFlags().StringVar(&globalFlags.nodeList, "node-list", "",
-		"load node list (output of 'btrfs-recs inspect [rebuild-mappings] list-nodes') from external JSON file `nodes.json`")
+		"load node list (output of 'btrfs-recs inspect [rebuild-mappings] list-nodes') from external JSON or JSON Lines file `nodes.json`")
 	noError(argparser.MarkPersistentFlagFilename("node-list"))
 
+	argparser.PersistentFlags().StringVar(&globalFlags.graphCache, "graph-cache", "",
+		"load the btree node graph from `graph.json.gz` instead of re-reading every node, if it was written for the same devices, node list, and mappings; otherwise read the graph and (re)write the file")
+	noError(argparser.MarkPersistentFlagFilename("graph-cache"))
+
 	argparser.PersistentFlags().BoolVar(&globalFlags.rebuild, "rebuild", false,
 		"attempt to rebuild broken btrees when reading")
 
@@ -112,32 +187,120 @@ func main() {
 		"load list of tree roots (output of 'btrfs-recs inspect rebuild-trees') from external JSON file `trees.json`; implies --rebuild")
 	noError(argparser.MarkPersistentFlagFilename("trees"))
 
+	argparser.PersistentFlags().StringVar(&globalFlags.trustedGens, "trusted-generations", "",
+		"EXPERT: load overrides of trees' trusted generations (output of 'btrfs-rec repair set-generation') from external JSON file `generations.json`; implies --rebuild")
+	noError(argparser.MarkPersistentFlagFilename("trusted-generations"))
+
+	argparser.PersistentFlags().StringVar(&globalFlags.importItems, "import-items", "",
+		"EXPERT: inject hand-crafted items (output of 'btrfs-rec repair import-items') from external JSON file `items.json`; implies --rebuild")
+	noError(argparser.MarkPersistentFlagFilename("import-items"))
+
+	argparser.PersistentFlags().BoolVar(&globalFlags.laxAncestors, "lax-ancestors", false,
+		"when rebuilding trees, whether a broken ancestor (parent subvolume) should be tolerated rather than making the descendant tree fail to load; "+
+			"lax mode gets more trees readable for inspection, but is incompatible with the bookkeeping that 'rebuild-trees' does "+
+			"(default: true, except for 'rebuild-trees', which only supports false)")
+
+	argparser.PersistentFlags().BoolVar(&globalFlags.noVerifyNodeCSum, "no-verify-node-csum", false,
+		"UNSAFE: skip verifying the checksums of btree nodes; faster, but corrupt nodes will be treated as good (only use this on known-good images)")
+
+	argparser.PersistentFlags().BoolVar(&globalFlags.strictItemSizes, "strict-item-sizes", false,
+		"when reading leaf nodes, re-encode each item and treat it as an error item if its size disagrees with the item header; slower, but catches mis-decoded items")
+
+	argparser.PersistentFlags().BoolVar(&globalFlags.salvagePartial, "salvage-partial-nodes", false,
+		"when a node can only be partly read (such as at the end of a truncated image), parse what items or key-pointers can be from the part that was read, rather than discarding the whole node; "+
+			"such a node is still treated as bad, unless --trust-partial-nodes is also given")
+	argparser.PersistentFlags().BoolVar(&globalFlags.trustPartial, "trust-partial-nodes", false,
+		"UNSAFE: when scanning for nodes or reading the node graph (as 'rebuild-trees' does), use partly-read nodes salvaged by --salvage-partial-nodes as if they were good, if there is no good copy")
+
+	argparser.PersistentFlags().BoolVar(&globalFlags.mmap, "mmap", false,
+		"read image files via mmap(2) rather than through a userspace buffer; only affects regular files, and only for commands that do not write")
+
+	argparser.PersistentFlags().Int64Var(&globalFlags.maxInlineExtent, "max-inline-extent", 0,
+		"treat inline file extents larger than `bytes` as corrupt (0 for the most that fits in a node)")
+
+	globalFlags.checksumTree = btrfsprim.CSUM_TREE_OBJECTID
+	argparser.PersistentFlags().Var(&globalFlags.checksumTree, "checksum-tree",
+		"EXPERT: look up data checksums in the tree with `ID` rather than in the CSUM_TREE (such as a rebuilt copy under a temporary ID); "+
+			"the tree must contain EXTENT_CSUM items.  With --rebuild or --trees, it is looked up among the rebuilt trees, "+
+			"and for 'rebuild-trees' it is the tree that checksums are rebuilt in to")
+
+	argparser.PersistentFlags().StringArrayVar(&globalFlags.tune, "tune", nil,
+		"override the tunable performance knob `NAME=VALUE` (may be given multiple times, or as a comma-separated list; "+
+			"see 'btrfs-rec tunables' for the list, and for the "+tuneEnvVar+" environment variable)")
+
+	argparser.PersistentFlags().StringVar(&globalFlags.resultsTo, "results-to", "-",
+		"write the command's results to `dest` instead of stdout; "+
+			"dest is '-' for stdout, 'fd:N' for an inherited file descriptor, 'unix:PATH' for a Unix-domain socket, or a filename "+
+			"(logging and progress always go to stderr)")
+	argparser.PersistentFlags().StringVar(&globalFlags.statusTo, "status-to", "",
+		"when the command exits, write a one-line JSON record of its exit status and error to `dest` (same syntax as --results-to; "+
+			"if it names the same fd or file as --results-to, the record is written after the results, through the same handle); "+
+			"not written for command-line usage errors, which exit with status 2")
+
 	globalFlags.stopProfiling = profile.AddProfileFlags(argparser.PersistentFlags(), "profile.")
 
 	globalFlags.openFlag = os.O_RDONLY
 
 	// Sub-commands
 
+	repairers.PersistentFlags().BoolVar(&globalFlags.verifyAfterWrite, "verify-after-write", false,
+		"after writing, read back every block that was written (bypassing the OS cache) and fail if any did not land correctly "+
+			"(default: true when writing to a block device, false when writing to a regular file)")
+
+	argparser.AddCommand(tunablesCmd)
 	argparser.AddCommand(inspectors)
 	argparser.AddCommand(repairers)
 
 	// Run
 
-	if err := argparser.ExecuteContext(context.Background()); err != nil {
+	cmd, err := argparser.ExecuteContextC(context.Background())
+	status := commandStatus{
+		Command:    cmd.CommandPath(),
+		ExitStatus: exitStatus,
+	}
+	if err != nil {
 		textui.Fprintf(os.Stderr, "%v: error: %v\n", argparser.CommandPath(), err)
-		os.Exit(1)
+		status.ExitStatus = 1
+		status.Error = err.Error()
 	}
+	if globalFlags.statusTo != "" {
+		if err := writeCommandStatus(globalFlags.statusTo, status); err != nil {
+			textui.Fprintf(os.Stderr, "%v: error: --status-to=%q: %v\n", argparser.CommandPath(), globalFlags.statusTo, err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(status.ExitStatus)
 }
 
 func run(runE func(*cobra.Command, []string) error) func(*cobra.Command, []string) error {
 	return func(cmd *cobra.Command, args []string) error {
 		ctx := cmd.Context()
-		logger := textui.NewLogger(os.Stderr, globalFlags.logLevel.Level)
+		logger := textui.NewLoggerWithFormat(os.Stderr, globalFlags.logLevel.Level, globalFlags.logFormat)
 		ctx = dlog.WithLogger(ctx, logger)
 		if globalFlags.logLevel.Level >= dlog.LogLevelDebug {
 			ctx = dlog.WithField(ctx, "mem", new(textui.LiveMemUse))
+			containers.SetPoolDebug(true)
 		}
 		dlog.SetFallbackLogger(logger.WithField("btrfs-progs.THIS_IS_A_BUG", true))
+		if err := textui.SetTunables(os.Getenv(tuneEnvVar)); err != nil {
+			return fmt.Errorf("%s: %w", tuneEnvVar, err)
+		}
+		for _, tune := range globalFlags.tune {
+			if err := textui.SetTunables(tune); err != nil {
+				return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--tune: %w", err))
+			}
+		}
+		if globalFlags.trustPartial && !globalFlags.salvagePartial {
+			return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--trust-partial-nodes requires --salvage-partial-nodes"))
+		}
+		if globalFlags.trustPartial {
+			dlog.Warn(ctx, "--trust-partial-nodes: partly-read nodes will be treated as good; their checksums can NOT be verified")
+		}
+		results, err := openResults(globalFlags.resultsTo, globalFlags.statusTo)
+		if err != nil {
+			return cliutil.FlagErrorFunc(cmd, fmt.Errorf("--results-to=%q: %w", globalFlags.resultsTo, err))
+		}
+		stdout = results
 
 		grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{
 			EnableSignalHandling: true,
@@ -152,6 +315,10 @@ func run(runE func(*cobra.Command, []string) error) func(*cobra.Command, []strin
 			defer func() {
 				maybeSetErr(globalFlags.stopProfiling())
 			}()
+			defer func() {
+				maybeSetErr(closeResults(results))
+			}()
+			defer logPoolReport(ctx)
 			cmd.SetContext(ctx)
 			return runE(cmd, args)
 		})
@@ -159,6 +326,21 @@ func run(runE func(*cobra.Command, []string) error) func(*cobra.Command, []strin
 	}
 }
 
+// logPoolReport logs the counters from the pool instrumentation that
+// is turned on at debug verbosity.  Objects that are outstanding at
+// exit are not necessarily leaks (they may be held by a cache), so
+// they are only logged at debug level; but more Puts than Gets means
+// that something was freed twice, which is always a bug.
+func logPoolReport(ctx context.Context) {
+	for _, stats := range containers.PoolReport() {
+		dlog.Debugf(ctx, "pool %v: gets=%v (news=%v) puts=%v outstanding=%v",
+			stats.Name, stats.Gets, stats.News, stats.Puts, stats.Outstanding())
+		if stats.Outstanding() < 0 {
+			dlog.Errorf(ctx, "pool %v: %v more puts than gets; this is a bug", stats.Name, -stats.Outstanding())
+		}
+	}
+}
+
 func runWithRawFS(
 	overrideInitChunks func(*btrfs.FS, *cobra.Command, []string) error,
 	runE func(*btrfs.FS, *cobra.Command, []string) error,
@@ -172,38 +354,47 @@ func runWithRawFS(
 			}
 		}
 
-		if len(globalFlags.pvs) == 0 && overrideInitChunks == nil {
+		if len(globalFlags.pvs) == 0 && globalFlags.pvDir == "" && overrideInitChunks == nil {
 			// We do this here instead of calling argparser.MarkPersistentFlagRequired("pv") so that
 			// it doesn't interfere with the `help` sub-command.
-			return cliutil.FlagErrorFunc(cmd, fmt.Errorf("must specify 1 or more physical volumes with --pv"))
+			return cliutil.FlagErrorFunc(cmd, fmt.Errorf("must specify 1 or more physical volumes with --pv or --pv-dir"))
 		}
 		fs := new(btrfs.FS)
+		if globalFlags.noVerifyNodeCSum {
+			dlog.Warn(ctx, "--no-verify-node-csum: btree node checksums will NOT be verified; corrupt nodes will be treated as good")
+			fs.NoVerifyNodeChecksums = true
+		}
+		fs.StrictItemSizes = globalFlags.strictItemSizes
+		fs.SalvagePartialNodes = globalFlags.salvagePartial
+		fs.TrustPartialNodes = globalFlags.trustPartial
 		defer func() {
 			maybeSetErr(fs.Close())
 		}()
 		for i, filename := range globalFlags.pvs {
 			dlog.Debugf(ctx, "Adding device file %d/%d %q...", i, len(globalFlags.pvs), filename)
-			osFile, err := os.OpenFile(filename, globalFlags.openFlag, 0)
+			devFile, err := openDevice(ctx, filename)
 			if err != nil {
 				return fmt.Errorf("device file %q: %w", filename, err)
 			}
-			typedFile := &diskio.OSFile[btrfsvol.PhysicalAddr]{
-				File: osFile,
-			}
-			bufFile := diskio.NewBufferedFile[btrfsvol.PhysicalAddr](
-				ctx,
-				typedFile,
-				//nolint:gomnd // False positive: gomnd.ignored-functions=[textui.Tunable] doesn't support type params.
-				textui.Tunable[btrfsvol.PhysicalAddr](16*1024), // block size: 16KiB
-				textui.Tunable(1024),                           // number of blocks to buffer; total of 16MiB
-			)
-			devFile := &btrfs.Device{
-				File: bufFile,
-			}
 			if err := fs.AddDevice(ctx, devFile); err != nil {
+				_ = devFile.Close()
 				return fmt.Errorf("device file %q: %w", filename, err)
 			}
 		}
+		if globalFlags.pvDir != "" {
+			if err := addPVDir(ctx, fs, globalFlags.pvDir); err != nil {
+				return fmt.Errorf("--pv-dir=%q: %w", globalFlags.pvDir, err)
+			}
+		}
+		if report, err := fs.ValidateSuperblock(); err == nil {
+			for _, problem := range report {
+				if problem.Fatal {
+					dlog.Errorf(ctx, "superblock: %v", problem)
+				} else {
+					dlog.Warnf(ctx, "superblock: suspicious: %v", problem)
+				}
+			}
+		}
 		if overrideInitChunks != nil {
 			if err := overrideInitChunks(fs, cmd, args); err != nil {
 				return err
@@ -211,18 +402,23 @@ func runWithRawFS(
 		} else {
 			if err := fs.InitChunks(ctx); err != nil {
 				dlog.Errorf(ctx, "error: InitChunks: %v", err)
+				if fs.CheckChunkRoot(ctx) != nil {
+					dlog.Errorf(ctx, "hint: 'btrfs-rec repair chunk-root' can search for a better chunk root")
+				}
 			}
 		}
 
 		if globalFlags.mappings != "" {
-			mappingsJSON, err := readJSONFile[[]btrfsvol.Mapping](ctx, globalFlags.mappings)
+			mappingsJSON, err := readJSONFile[[]btrfsutil.DevMapping](ctx, globalFlags.mappings)
 			if err != nil {
 				return err
 			}
-			for _, mapping := range mappingsJSON {
-				if err := fs.LV.AddMapping(mapping); err != nil {
-					return err
-				}
+			mappings, err := btrfsutil.ResolveDevMappings(fs, mappingsJSON)
+			if err != nil {
+				return fmt.Errorf("--mappings=%q: %w", globalFlags.mappings, err)
+			}
+			if err := fs.LV.AddMappings(mappings); err != nil {
+				return fmt.Errorf("--mappings=%q: %w", globalFlags.mappings, err)
 			}
 		}
 
@@ -237,7 +433,7 @@ func runWithRawFSAndNodeList(runE func(*btrfs.FS, []btrfsvol.LogicalAddr, *cobra
 		var nodeList []btrfsvol.LogicalAddr
 		var err error
 		if globalFlags.nodeList != "" {
-			nodeList, err = readJSONFile[[]btrfsvol.LogicalAddr](ctx, globalFlags.nodeList)
+			nodeList, err = readNodeListFile(ctx, globalFlags.nodeList)
 		} else {
 			nodeList, err = btrfsutil.ListNodes(ctx, fs)
 		}
@@ -252,15 +448,25 @@ func runWithRawFSAndNodeList(runE func(*btrfs.FS, []btrfsvol.LogicalAddr, *cobra
 func _runWithReadableFS(wantNodeList bool, runE func(btrfs.ReadableFS, []btrfsvol.LogicalAddr, *cobra.Command, []string) error) func(*cobra.Command, []string) error {
 	inner := func(fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr, cmd *cobra.Command, args []string) error {
 		var rfs btrfs.ReadableFS = fs
-		if globalFlags.rebuild || globalFlags.treeRoots != "" {
+		if globalFlags.rebuild || globalFlags.treeRoots != "" || globalFlags.trustedGens != "" || globalFlags.importItems != "" {
 			ctx := cmd.Context()
 
-			graph, err := btrfsutil.ReadGraph(ctx, fs, nodeList)
+			graph, err := readGraph(ctx, fs, nodeList)
 			if err != nil {
 				return err
 			}
 
-			_rfs := btrfsutil.NewRebuiltForrest(fs, graph, nil, true)
+			_rfs := btrfsutil.NewRebuiltForrest(fs, graph, nil, laxAncestors(cmd, true))
+
+			// These must happen before .RebuiltAddRoots(), since
+			// overrides and injected items can only be set on
+			// trees that have not yet been loaded.
+			if err := applyTrustedGenerations(ctx, _rfs.RebuiltSetTrustedGeneration); err != nil {
+				return err
+			}
+			if err := applyImportedItems(ctx, _rfs.RebuiltInjectItems); err != nil {
+				return err
+			}
 
 			if globalFlags.treeRoots != "" {
 				roots, err := readJSONFile[map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]](ctx, globalFlags.treeRoots)
@@ -273,11 +479,17 @@ func _runWithReadableFS(wantNodeList bool, runE func(btrfs.ReadableFS, []btrfsvo
 			rfs = _rfs
 		}
 
+		if globalFlags.checksumTree != btrfsprim.CSUM_TREE_OBJECTID {
+			if err := btrfs.ValidateChecksumTree(cmd.Context(), rfs, globalFlags.checksumTree); err != nil {
+				return fmt.Errorf("--checksum-tree: %w", err)
+			}
+		}
+
 		return runE(rfs, nodeList, cmd, args)
 	}
 
 	return func(cmd *cobra.Command, args []string) error {
-		if wantNodeList || globalFlags.rebuild || globalFlags.treeRoots != "" {
+		if wantNodeList || globalFlags.rebuild || globalFlags.treeRoots != "" || globalFlags.trustedGens != "" || globalFlags.importItems != "" {
 			return runWithRawFSAndNodeList(inner)(cmd, args)
 		}
 		return runWithRawFS(nil, func(fs *btrfs.FS, cmd *cobra.Command, args []string) error {
@@ -286,6 +498,52 @@ func _runWithReadableFS(wantNodeList bool, runE func(btrfs.ReadableFS, []btrfsvo
 	}
 }
 
+// laxAncestors returns the value of the --lax-ancestors flag for the
+// `laxAncestors` argument to btrfsutil.NewRebuiltForrest, using
+// `dflt` if the user did not set the flag; and logs which mode is in
+// use.
+func laxAncestors(cmd *cobra.Command, dflt bool) bool {
+	ret := dflt
+	src := "default for this command"
+	if flag := cmd.Flag("lax-ancestors"); flag != nil && flag.Changed {
+		ret = globalFlags.laxAncestors
+		src = "set by --lax-ancestors"
+	}
+	if ret {
+		dlog.Infof(cmd.Context(), "ancestor trees: lax: a broken ancestor does not prevent reading a tree (%s)", src)
+	} else {
+		dlog.Infof(cmd.Context(), "ancestor trees: strict: a broken ancestor prevents reading a tree (%s)", src)
+	}
+	return ret
+}
+
+func applyTrustedGenerations(ctx context.Context, set func(context.Context, btrfsprim.ObjID, btrfsprim.Generation) error) error {
+	if globalFlags.trustedGens == "" {
+		return nil
+	}
+	gens, err := readJSONFile[map[btrfsprim.ObjID]btrfsprim.Generation](ctx, globalFlags.trustedGens)
+	if err != nil {
+		return err
+	}
+	for _, treeID := range maps.SortedKeys(gens) {
+		if err := set(ctx, treeID, gens[treeID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyImportedItems(ctx context.Context, inject func(context.Context, []btrfsutil.InjectedItem) error) error {
+	if globalFlags.importItems == "" {
+		return nil
+	}
+	items, err := readJSONFile[[]btrfsutil.InjectedItem](ctx, globalFlags.importItems)
+	if err != nil {
+		return err
+	}
+	return inject(ctx, items)
+}
+
 func runWithReadableFSAndNodeList(runE func(btrfs.ReadableFS, []btrfsvol.LogicalAddr, *cobra.Command, []string) error) func(*cobra.Command, []string) error {
 	return _runWithReadableFS(true, runE)
 }
@@ -295,3 +553,77 @@ func runWithReadableFS(runE func(btrfs.ReadableFS, *cobra.Command, []string) err
 		return runE(fs, cmd, args)
 	})
 }
+
+func openDevice(ctx context.Context, filename string) (*btrfs.Device, error) {
+	osFile, err := os.OpenFile(filename, globalFlags.openFlag, 0)
+	if err != nil {
+		return nil, err
+	}
+	file, err := openDeviceFile(ctx, osFile)
+	if err != nil {
+		_ = osFile.Close()
+		return nil, err
+	}
+	return newDevice(file), nil
+}
+
+// newDevice returns a btrfs.Device for `file`, configured by the
+// global flags.
+func newDevice(file diskio.File[btrfsvol.PhysicalAddr]) *btrfs.Device {
+	return &btrfs.Device{
+		File: file,
+
+		NoVerifyNodeChecksums: globalFlags.noVerifyNodeCSum,
+		StrictItemSizes:       globalFlags.strictItemSizes,
+		SalvagePartialNodes:   globalFlags.salvagePartial,
+		TrustPartialNodes:     globalFlags.trustPartial,
+	}
+}
+
+// openDeviceFile wraps osFile for use as a device.  If it returns an
+// error, then the caller is still responsible for closing osFile.
+func openDeviceFile(ctx context.Context, osFile *os.File) (diskio.File[btrfsvol.PhysicalAddr], error) {
+	if globalFlags.mmap {
+		if globalFlags.openFlag != os.O_RDONLY {
+			return nil, fmt.Errorf("--mmap may not be used with commands that write")
+		}
+		mmapFile, err := diskio.NewMmapFile[btrfsvol.PhysicalAddr](osFile)
+		if err == nil {
+			_ = osFile.Close()
+			return mmapFile, nil
+		}
+		dlog.Infof(ctx, "not using mmap for %q, falling back to buffered I/O: %v", osFile.Name(), err)
+	}
+	blockSize := deviceBufferBlockSize.Get()
+	var typedFile diskio.File[btrfsvol.PhysicalAddr] = &diskio.OSFile[btrfsvol.PhysicalAddr]{
+		File: osFile,
+	}
+	if verifyAfterWrite(osFile) {
+		dlog.Infof(ctx, "will verify writes to %q", osFile.Name())
+		typedFile = diskio.NewVerifyingFile[btrfsvol.PhysicalAddr](ctx, typedFile, blockSize)
+	}
+	return diskio.NewBufferedFile[btrfsvol.PhysicalAddr](
+		ctx,
+		typedFile,
+		blockSize,
+		deviceBufferNumBlocks.Get(),
+	), nil
+}
+
+var (
+	deviceBufferBlockSize = textui.NewTunable[btrfsvol.PhysicalAddr]("buffer.block-size", 16*1024) // 16KiB
+	deviceBufferNumBlocks = textui.NewTunable("buffer.num-blocks", 1024)                           // total of 16MiB
+)
+
+// verifyAfterWrite returns whether writes to osFile should be read
+// back and checked; see the --verify-after-write flag.
+func verifyAfterWrite(osFile *os.File) bool {
+	if globalFlags.openFlag == os.O_RDONLY {
+		return false
+	}
+	if globalFlags.verifyAfterWriteSet {
+		return globalFlags.verifyAfterWrite
+	}
+	stat, err := osFile.Stat()
+	return err == nil && stat.Mode()&os.ModeDevice != 0
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func numOpenFDs(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count open file descriptors: %v", err)
+	}
+	return len(fds)
+}
+
+//nolint:paralleltest // Can't be parallel because it sets globalFlags.
+func TestOpenDeviceCloses(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	filename := filepath.Join(t.TempDir(), "dev.img")
+	require.NoError(t, os.WriteFile(filename, make([]byte, 64*1024), 0o600))
+
+	oldOpenFlag, oldMmap := globalFlags.openFlag, globalFlags.mmap
+	t.Cleanup(func() {
+		globalFlags.openFlag, globalFlags.mmap = oldOpenFlag, oldMmap
+	})
+
+	before := numOpenFDs(t)
+
+	// Error path: --mmap with a command that writes.
+	globalFlags.openFlag, globalFlags.mmap = os.O_RDWR, true
+	dev, err := openDevice(ctx, filename)
+	assert.Error(t, err)
+	assert.Nil(t, dev)
+	assert.Equal(t, before, numOpenFDs(t), "file left open after an error")
+
+	// Error path: no such file.
+	_, err = openDevice(ctx, filename+".missing")
+	assert.Error(t, err)
+	assert.Equal(t, before, numOpenFDs(t))
+
+	// Success paths.
+	for _, mmap := range []bool{false, true} {
+		globalFlags.openFlag, globalFlags.mmap = os.O_RDONLY, mmap
+		dev, err := openDevice(ctx, filename)
+		require.NoError(t, err, "mmap=%v", mmap)
+		assert.NoError(t, dev.Close(), "mmap=%v", mmap)
+		assert.Equal(t, before, numOpenFDs(t), "mmap=%v", mmap)
+	}
+}
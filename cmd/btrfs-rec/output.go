@@ -0,0 +1,160 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"git.lukeshu.com/go/lowmemjson"
+)
+
+// stdout is where commands write their results.  It is os.Stdout
+// unless --results-to says otherwise.  Logging and progress always
+// go to os.Stderr, so that a consumer may parse the results without
+// having to filter anything out of them.
+var stdout = os.Stdout
+
+// statusOutput is the --results-to destination, if --status-to names
+// the same destination; see openResults.
+var statusOutput *os.File
+
+// openOutput opens a --results-to or --status-to destination, which
+// is one of:
+//
+//   - "-" for stdout,
+//   - "fd:N" for an already-open file descriptor (such as a pipe
+//     set up by the parent process),
+//   - "unix:PATH" to connect to a Unix-domain stream socket, or
+//   - otherwise, the name of a file to create.
+func openOutput(dest string) (*os.File, error) {
+	switch {
+	case dest == "-":
+		return os.Stdout, nil
+	case strings.HasPrefix(dest, "fd:"):
+		fd, err := strconv.ParseUint(strings.TrimPrefix(dest, "fd:"), 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file descriptor: %w", err)
+		}
+		fh := os.NewFile(uintptr(fd), dest)
+		if _, err := fh.Stat(); err != nil {
+			return nil, err
+		}
+		return fh, nil
+	case strings.HasPrefix(dest, "unix:"):
+		conn, err := net.Dial("unix", strings.TrimPrefix(dest, "unix:"))
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		// Get an *os.File (a dup of the socket), so that
+		// commands don't need to care what stdout is.
+		unixConn, ok := conn.(*net.UnixConn)
+		if !ok {
+			return nil, fmt.Errorf("not a unix socket: %T", conn)
+		}
+		return unixConn.File()
+	default:
+		return os.Create(dest)
+	}
+}
+
+// sameOutput returns whether the --status-to destination `statusTo`
+// is the same as the --results-to destination `resultsTo`, which has
+// already been opened as `results`.
+func sameOutput(resultsTo string, results *os.File, statusTo string) bool {
+	switch {
+	case statusTo == "":
+		return false
+	case statusTo == resultsTo:
+		return true
+	case statusTo == "-":
+		return results == os.Stdout
+	case strings.HasPrefix(statusTo, "fd:"):
+		fd, err := strconv.ParseUint(strings.TrimPrefix(statusTo, "fd:"), 10, 0)
+		return err == nil && uintptr(fd) == results.Fd()
+	case strings.HasPrefix(statusTo, "unix:"):
+		return false
+	default:
+		resultsInfo, err := results.Stat()
+		if err != nil || !resultsInfo.Mode().IsRegular() {
+			return false
+		}
+		statusInfo, err := os.Stat(statusTo)
+		return err == nil && os.SameFile(statusInfo, resultsInfo)
+	}
+}
+
+// openResults opens the --results-to destination.  If --status-to
+// names the same destination, then the results file is kept open
+// (closeResults doesn't close it) so that writeCommandStatus can
+// write the status record after the results, through the same
+// handle; opening it a second time would truncate a file, and the
+// file descriptor of an "fd:N" would already be closed (or worse,
+// re-used for something else).
+func openResults(resultsTo, statusTo string) (*os.File, error) {
+	results, err := openOutput(resultsTo)
+	if err != nil {
+		return nil, err
+	}
+	if sameOutput(resultsTo, results, statusTo) {
+		statusOutput = results
+	}
+	return results, nil
+}
+
+// closeResults closes a file returned by openResults, unless it is
+// still needed by writeCommandStatus.
+func closeResults(results *os.File) error {
+	if results == statusOutput {
+		return nil
+	}
+	return closeOutput(results)
+}
+
+// closeOutput closes a file returned by openOutput, unless it is
+// os.Stdout.
+func closeOutput(fh *os.File) error {
+	if fh == os.Stdout {
+		return nil
+	}
+	return fh.Close()
+}
+
+// A commandStatus is the machine-readable "command complete" record
+// that is written to --status-to when the command exits.
+type commandStatus struct {
+	Command    string
+	ExitStatus int
+	Error      string `json:",omitempty"`
+}
+
+// writeCommandStatus writes the status record to the --status-to
+// destination `dest`.  If `dest` is the same as --results-to (see
+// openResults), then the record is written after the results, through
+// the results' handle.
+func writeCommandStatus(dest string, status commandStatus) (err error) {
+	fh := statusOutput
+	if fh == nil {
+		fh, err = openOutput(dest)
+		if err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if _err := closeOutput(fh); _err != nil && err == nil {
+			err = _err
+		}
+	}()
+	return writeJSONFile(fh, status, lowmemjson.ReEncoderConfig{
+		Compact:               true,
+		ForceTrailingNewlines: true,
+	})
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testResults = "{\"results\":true}\n"
+	testStatus  = "{\"Command\":\"btrfs-rec test\",\"ExitStatus\":0}\n"
+)
+
+// runOutputs mimics what main() and run() do with --results-to and
+// --status-to.
+func runOutputs(t *testing.T, resultsTo, statusTo string) {
+	t.Helper()
+	oldStatusOutput := statusOutput
+	defer func() {
+		statusOutput = oldStatusOutput
+	}()
+
+	results, err := openResults(resultsTo, statusTo)
+	require.NoError(t, err)
+	_, err = results.WriteString(testResults)
+	require.NoError(t, err)
+	require.NoError(t, closeResults(results))
+
+	require.NoError(t, writeCommandStatus(statusTo, commandStatus{Command: "btrfs-rec test"}))
+}
+
+//nolint:paralleltest // Can't be parallel because it sets statusOutput.
+func TestStatusToResultsFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "out.json")
+	require.NoError(t, os.Symlink("out.json", filepath.Join(dir, "link.json")))
+
+	for _, statusTo := range []string{filename, filepath.Join(dir, "link.json")} {
+		runOutputs(t, filename, statusTo)
+		dat, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		assert.Equal(t, testResults+testStatus, string(dat), statusTo)
+	}
+
+	// A different file is still replaced.
+	other := filepath.Join(dir, "status.json")
+	require.NoError(t, os.WriteFile(other, []byte("stale\n"), 0o600))
+	runOutputs(t, filename, other)
+	dat, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, testResults, string(dat))
+	dat, err = os.ReadFile(other)
+	require.NoError(t, err)
+	assert.Equal(t, testStatus, string(dat))
+}
+
+//nolint:paralleltest // Can't be parallel because it sets statusOutput.
+func TestStatusToResultsFD(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "out.json")
+	fh, err := os.Create(filename)
+	require.NoError(t, err)
+	// Hand a dup of the fd to "fd:N", as it will be closed by
+	// the *os.File that openOutput wraps around it.
+	fd, err := syscall.Dup(int(fh.Fd()))
+	require.NoError(t, err)
+	require.NoError(t, fh.Close())
+	dest := fmt.Sprintf("fd:%d", fd)
+
+	runOutputs(t, dest, dest)
+
+	dat, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, testResults+testStatus, string(dat))
+}
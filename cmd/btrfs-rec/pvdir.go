@@ -0,0 +1,194 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// addPVDir adds every btrfs device file in `dir` to `fs`.  Which
+// device is which is determined by the devid in each file's
+// superblock (the same devid that the chunk tree's stripes refer to),
+// not by the filenames or their order.
+//
+// The files are first probed read-only, even if the command writes;
+// see probePVDir.  Only the files that it accepts are then opened the
+// way that --pv files are.
+//
+// It is an error for two files to claim the same devid, or for the
+// files to belong to different filesystems.
+func addPVDir(ctx context.Context, fs *btrfs.FS, dir string) error {
+	cands, err := probePVDir(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if len(cands) == 0 {
+		return fmt.Errorf("no btrfs devices found")
+	}
+
+	for _, devID := range maps.SortedKeys(cands) {
+		cand := cands[devID]
+		dev, err := openDevice(ctx, cand.filename)
+		if err != nil {
+			return fmt.Errorf("device file %q: %w", cand.filename, err)
+		}
+		if sb, err := dev.Superblock(); err == nil && sb.DevItem.DevUUID != cand.devItem.DevUUID {
+			_ = dev.Close()
+			return fmt.Errorf("device file %q: dev_uuid changed from %v to %v since it was probed",
+				cand.filename, cand.devItem.DevUUID, sb.DevItem.DevUUID)
+		}
+		if err := fs.AddDevice(ctx, dev); err != nil {
+			_ = dev.Close()
+			return fmt.Errorf("device file %q: %w", cand.filename, err)
+		}
+		dlog.Infof(ctx, "--pv-dir: devid=%v is %q", devID, cand.filename)
+	}
+	if sb, err := fs.Superblock(); err == nil {
+		if have := uint64(len(fs.LV.PhysicalVolumes())); have != sb.NumDevices {
+			dlog.Warnf(ctx, "--pv-dir: have %v devices, but the superblock says the filesystem has %v",
+				have, sb.NumDevices)
+		}
+	}
+	return nil
+}
+
+// pvCandidate is a file in --pv-dir that probePVDir has accepted.
+type pvCandidate struct {
+	filename string
+	devItem  btrfsitem.Dev // from the file's superblock
+}
+
+// probePVDir opens each file in `dir` read-only, and returns the
+// btrfs devices among them, by devid.
+//
+// A file is only accepted if its superblock's DEV_ITEM has the same
+// dev_uuid and fs_uuid as the chunk tree's DEV_ITEM for that devid, so
+// that a stale image or a copy of another device isn't mistaken for
+// the device.  If the chunk tree can't be read from the probed files,
+// then the superblocks are trusted as-is, with a warning.
+//
+// Files that are not btrfs devices, or that are rejected by the chunk
+// tree, are skipped with a warning.
+func probePVDir(ctx context.Context, dir string) (map[btrfsvol.DeviceID]pvCandidate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	probeFS := new(btrfs.FS)
+	defer func() {
+		_ = probeFS.Close()
+	}()
+	cands := make(map[btrfsvol.DeviceID]pvCandidate)
+	var fsUUID btrfsprim.UUID
+	var fsUUIDFile string
+	for _, entry := range entries {
+		filename := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			dlog.Debugf(ctx, "--pv-dir: skipping %q: is a directory", filename)
+			continue
+		}
+		dev, err := probeDevice(filename)
+		if err != nil {
+			dlog.Warnf(ctx, "--pv-dir: skipping %q: %v", filename, err)
+			continue
+		}
+		sb, err := dev.Superblock()
+		if err != nil {
+			dlog.Warnf(ctx, "--pv-dir: skipping %q: not a btrfs device: %v", filename, err)
+			_ = dev.Close()
+			continue
+		}
+		if fsUUIDFile == "" {
+			fsUUID, fsUUIDFile = sb.FSUUID, filename
+		} else if sb.FSUUID != fsUUID {
+			_ = dev.Close()
+			return nil, fmt.Errorf("files %q and %q belong to different filesystems: fs_uuid=%v != fs_uuid=%v",
+				fsUUIDFile, filename, fsUUID, sb.FSUUID)
+		}
+		devID := sb.DevItem.DevID
+		if other, dup := cands[devID]; dup {
+			_ = dev.Close()
+			return nil, fmt.Errorf("files %q and %q both claim to be devid=%v", other.filename, filename, devID)
+		}
+		if err := probeFS.AddDevice(ctx, dev); err != nil {
+			_ = dev.Close()
+			return nil, fmt.Errorf("device file %q: %w", filename, err)
+		}
+		cands[devID] = pvCandidate{
+			filename: filename,
+			devItem:  sb.DevItem,
+		}
+	}
+	if len(cands) == 0 {
+		return cands, nil
+	}
+
+	devItems, err := readDevItems(ctx, probeFS)
+	if err != nil {
+		dlog.Warnf(ctx, "--pv-dir: trusting the devices' superblocks, because the chunk tree can't be read to check them against: %v", err)
+		return cands, nil
+	}
+	for _, devID := range maps.SortedKeys(cands) {
+		cand := cands[devID]
+		devItem, ok := devItems[devID]
+		switch {
+		case !ok:
+			dlog.Warnf(ctx, "--pv-dir: skipping %q: the chunk tree has no DEV_ITEM for devid=%v",
+				cand.filename, devID)
+			delete(cands, devID)
+		case devItem.DevUUID != cand.devItem.DevUUID || devItem.FSUUID != cand.devItem.FSUUID:
+			dlog.Warnf(ctx, "--pv-dir: skipping %q: it says that devid=%v is dev_uuid=%v fs_uuid=%v, but the chunk tree says dev_uuid=%v fs_uuid=%v",
+				cand.filename, devID, cand.devItem.DevUUID, cand.devItem.FSUUID, devItem.DevUUID, devItem.FSUUID)
+			delete(cands, devID)
+		}
+	}
+	return cands, nil
+}
+
+// probeDevice opens `filename` read-only, regardless of
+// globalFlags.openFlag.
+func probeDevice(filename string) (*btrfs.Device, error) {
+	osFile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newDevice(&diskio.OSFile[btrfsvol.PhysicalAddr]{File: osFile}), nil
+}
+
+// readDevItems returns the DEV_ITEMs in the chunk tree of `fs`, by
+// devid.
+func readDevItems(ctx context.Context, fs *btrfs.FS) (map[btrfsvol.DeviceID]btrfsitem.Dev, error) {
+	chunkTree, err := fs.ForrestLookup(ctx, btrfsprim.CHUNK_TREE_OBJECTID)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[btrfsvol.DeviceID]btrfsitem.Dev)
+	if err := chunkTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		if body, ok := item.Body.(*btrfsitem.Dev); ok && item.Key.ItemType == btrfsitem.DEV_ITEM_KEY {
+			ret[body.DevID] = *body
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("chunk tree has no DEV_ITEMs")
+	}
+	return ret, nil
+}
@@ -0,0 +1,209 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+var (
+	pvTestFSUUID   = btrfsprim.UUID{0xf5}
+	pvTestDevUUID1 = btrfsprim.UUID{0xd1}
+	pvTestDevUUID2 = btrfsprim.UUID{0xd2}
+)
+
+// mkPVImage returns the image of a device with the given superblock
+// DEV_ITEM.  Its SYSTEM chunk is on devid=1, and holds a chunk tree
+// with the given DEV_ITEMs; if `chunkTree` is false, then the chunk
+// tree is left unwritten.  Its superblock says that the filesystem
+// has 2 devices.
+func mkPVImage(t *testing.T, devItem btrfsitem.Dev, chunkTree bool, devItems ...btrfsitem.Dev) []byte {
+	t.Helper()
+	const (
+		nodeSize = 0x4000
+		sysLAddr = btrfsvol.LogicalAddr(0x100000)
+		sysPAddr = btrfsvol.PhysicalAddr(0x40000)
+		size     = 0x10000
+	)
+	sysKey := btrfsprim.Key{ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, ItemType: btrfsitem.CHUNK_ITEM_KEY, Offset: uint64(sysLAddr)}
+	sysChunk := btrfsitem.Chunk{
+		Head: btrfsitem.ChunkHeader{
+			Size:       size,
+			Owner:      btrfsprim.EXTENT_TREE_OBJECTID,
+			Type:       btrfsvol.BLOCK_GROUP_SYSTEM,
+			NumStripes: 1,
+		},
+		Stripes: []btrfsitem.ChunkStripe{{DeviceID: 1, Offset: sysPAddr}},
+	}
+
+	img := make([]byte, 0x60000)
+
+	builder := &btrfstree.NodeBuilder{
+		Size:         nodeSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		Head: btrfstree.NodeHeader{
+			MetadataUUID: pvTestFSUUID,
+			Flags:        btrfstree.NodeWritten,
+			BackrefRev:   btrfstree.MixedBackrefRev,
+			Generation:   6,
+			Owner:        btrfsprim.CHUNK_TREE_OBJECTID,
+		},
+		Alloc: func() (btrfsvol.LogicalAddr, error) {
+			return sysLAddr, nil
+		},
+		Emit: func(node *btrfstree.Node) error {
+			if !chunkTree {
+				return nil
+			}
+			bs, err := binstruct.Marshal(*node)
+			copy(img[sysPAddr+btrfsvol.PhysicalAddr(node.Head.Addr-sysLAddr):], bs)
+			return err
+		},
+	}
+	for _, item := range devItems {
+		item := item
+		require.NoError(t, builder.Add(btrfstree.Item{
+			Key:  btrfsprim.Key{ObjectID: btrfsprim.DEV_ITEMS_OBJECTID, ItemType: btrfsitem.DEV_ITEM_KEY, Offset: uint64(item.DevID)},
+			Body: &item,
+		}))
+	}
+	require.NoError(t, builder.Add(btrfstree.Item{Key: sysKey, Body: &sysChunk}))
+	root, level, err := builder.Finish()
+	require.NoError(t, err)
+
+	devItem.NumBytes = uint64(len(img))
+	sb := btrfstree.Superblock{
+		Self:                btrfs.SuperblockAddrs[0],
+		Magic:               btrfstree.SuperblockMagic,
+		FSUUID:              pvTestFSUUID,
+		Generation:          6,
+		ChunkTree:           root.BlockPtr,
+		ChunkLevel:          level,
+		ChunkRootGeneration: 6,
+		NumDevices:          2, // so that the devices' superblocks agree
+		SectorSize:          0x1000,
+		NodeSize:            nodeSize,
+		LeafSize:            nodeSize,
+		StripeSize:          0x1000,
+		ChecksumType:        btrfssum.TYPE_CRC32,
+		DevItem:             devItem,
+	}
+	dat, err := binstruct.Marshal(btrfstree.SysChunk{Key: sysKey, Chunk: sysChunk})
+	require.NoError(t, err)
+	sb.SysChunkArraySize = uint32(copy(sb.SysChunkArray[:], dat))
+	sb.Checksum, err = sb.CalculateChecksum()
+	require.NoError(t, err)
+	sbBytes, err := binstruct.Marshal(sb)
+	require.NoError(t, err)
+	copy(img[sb.Self:], sbBytes)
+
+	return img
+}
+
+//nolint:paralleltest // Can't be parallel because it sets globalFlags.
+func TestAddPVDir(t *testing.T) {
+	oldOpenFlag, oldMmap := globalFlags.openFlag, globalFlags.mmap
+	t.Cleanup(func() {
+		globalFlags.openFlag, globalFlags.mmap = oldOpenFlag, oldMmap
+	})
+	globalFlags.openFlag, globalFlags.mmap = os.O_RDONLY, false
+
+	dev1 := btrfsitem.Dev{DevID: 1, DevUUID: pvTestDevUUID1, FSUUID: pvTestFSUUID}
+	dev2 := btrfsitem.Dev{DevID: 2, DevUUID: pvTestDevUUID2, FSUUID: pvTestFSUUID}
+	impostor1 := btrfsitem.Dev{DevID: 1, DevUUID: pvTestDevUUID2, FSUUID: pvTestFSUUID}
+	otherFS1 := btrfsitem.Dev{DevID: 1, DevUUID: pvTestDevUUID1, FSUUID: btrfsprim.UUID{0x0f}}
+
+	type testCase struct {
+		Files   map[string][]byte
+		ExpDevs map[btrfsvol.DeviceID]string
+		ExpErr  string
+	}
+	testcases := map[string]testCase{
+		"match": {
+			Files: map[string][]byte{
+				"b":     mkPVImage(t, dev1, true, dev1, dev2),
+				"a":     mkPVImage(t, dev2, true, dev1, dev2),
+				"notes": []byte("not a btrfs device"),
+			},
+			ExpDevs: map[btrfsvol.DeviceID]string{1: "b", 2: "a"},
+		},
+		"wrong-dev-uuid": {
+			Files: map[string][]byte{
+				"a": mkPVImage(t, impostor1, true, dev1),
+			},
+			ExpErr: "no btrfs devices found",
+		},
+		"wrong-fs-uuid": {
+			Files: map[string][]byte{
+				"a": mkPVImage(t, otherFS1, true, dev1),
+			},
+			ExpErr: "no btrfs devices found",
+		},
+		"not-in-chunk-tree": {
+			Files: map[string][]byte{
+				"a": mkPVImage(t, dev1, true, dev1),
+				"b": mkPVImage(t, dev2, true, dev1),
+			},
+			ExpDevs: map[btrfsvol.DeviceID]string{1: "a"},
+		},
+		"unreadable-chunk-tree": {
+			Files: map[string][]byte{
+				"a": mkPVImage(t, impostor1, false, dev1),
+			},
+			ExpDevs: map[btrfsvol.DeviceID]string{1: "a"},
+		},
+		"duplicate": {
+			Files: map[string][]byte{
+				"a": mkPVImage(t, dev1, true, dev1),
+				"b": mkPVImage(t, dev1, true, dev1),
+			},
+			ExpErr: `both claim to be devid=1`,
+		},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			ctx := dlog.NewTestContext(t, false)
+			dir := t.TempDir()
+			for name, dat := range tc.Files {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, name), dat, 0o600))
+			}
+
+			fs := new(btrfs.FS)
+			defer func() {
+				assert.NoError(t, fs.Close())
+			}()
+			err := addPVDir(ctx, fs, dir)
+			if tc.ExpErr != "" {
+				assert.ErrorContains(t, err, tc.ExpErr)
+				assert.Empty(t, fs.LV.PhysicalVolumes())
+				return
+			}
+			require.NoError(t, err)
+			pvs := fs.LV.PhysicalVolumes()
+			assert.Equal(t, maps.SortedKeys(tc.ExpDevs), maps.SortedKeys(pvs))
+			for devID, name := range tc.ExpDevs {
+				if pv, ok := pvs[devID]; ok {
+					assert.Equal(t, filepath.Join(dir, name), pv.Name(), "devid=%v", devID)
+				}
+			}
+		})
+	}
+}
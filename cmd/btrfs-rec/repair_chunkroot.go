@@ -0,0 +1,109 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/cmd/btrfs-rec/inspect/findroot"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+func init() {
+	var flags struct {
+		write bool
+	}
+	cmd := &cobra.Command{
+		Use:   "chunk-root",
+		Short: "Check the superblock's chunk root, and suggest a replacement if it is bad",
+		Long: "" +
+			"Check that the superblock's chunk_root points at a valid root " +
+			"node of the CHUNK_TREE.  If it does not, then search all nodes " +
+			"for the highest-generation CHUNK_TREE node that is not pointed " +
+			"to by any other CHUNK_TREE node, and suggest it as a " +
+			"replacement.  A stale chunk_root is often the only thing " +
+			"keeping a filesystem from being mountable.\n" +
+			"\n" +
+			"This does not modify the filesystem unless --write is given, " +
+			"in which case every superblock on every device is updated to " +
+			"point at the suggested chunk root.\n" +
+			"\n" +
+			"If no --node-list is given, then a slow sector-by-sector scan " +
+			"will be used to find all nodes.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if !flags.write {
+				globalFlags.openFlag = os.O_RDONLY
+			}
+			return nil
+		},
+		RunE: runWithRawFSAndNodeList(func(fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr, cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+
+			var chunkRootErr *btrfs.ChunkRootError
+			if err := fs.CheckChunkRoot(ctx); err == nil {
+				textui.Fprintf(stdout, "superblock chunk_root is OK\n")
+				return nil
+			} else if !errors.As(err, &chunkRootErr) {
+				return err
+			}
+			textui.Fprintf(stdout, "%v\n", chunkRootErr)
+
+			graph, err := readGraph(ctx, fs, nodeList)
+			if err != nil {
+				return err
+			}
+			var best *findroot.Candidate
+			for _, cand := range findroot.FindRoot(graph, btrfsprim.CHUNK_TREE_OBJECTID) {
+				if cand.PointedToBySameTree || cand.Addr == chunkRootErr.Addr {
+					continue
+				}
+				cand := cand
+				best = &cand
+				break
+			}
+			if best == nil {
+				return fmt.Errorf("no replacement chunk root found")
+			}
+			textui.Fprintf(stdout, "suggested chunk_root=%v level=%v generation=%v\n",
+				best.Addr, best.Level, best.Generation)
+
+			if !flags.write {
+				textui.Fprintf(stdout, "not modifying the filesystem; pass --write to update the superblocks\n")
+				return nil
+			}
+			sbs, err := fs.Superblocks()
+			if err != nil {
+				return err
+			}
+			for _, sb := range sbs {
+				sb.Data.ChunkTree = best.Addr
+				sb.Data.ChunkLevel = best.Level
+				sb.Data.ChunkRootGeneration = best.Generation
+				sb.Data.Checksum, err = sb.Data.CalculateChecksum()
+				if err != nil {
+					return err
+				}
+				if err := sb.Write(); err != nil {
+					return fmt.Errorf("file %q: superblock at %v: %w", sb.File.Name(), sb.Addr, err)
+				}
+				dlog.Infof(ctx, "updated superblock at %v in %q", sb.Addr, sb.File.Name())
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().BoolVar(&flags.write, "write", false,
+		"update the superblocks to point at the suggested chunk root")
+	repairers.AddCommand(cmd)
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"os"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func init() {
+	repairers.AddCommand(&cobra.Command{
+		Use:   "import-items ITEMS.json",
+		Short: "EXPERT: Inject hand-crafted items in to rebuilt trees",
+		Long: "" +
+			"When an item that is essential to the rebuild (such as a " +
+			"ROOT_ITEM) cannot be found anywhere on disk, it may be " +
+			"hand-crafted instead.  ITEMS.json is a JSON array of " +
+			"{\"Tree\": TREE_ID, \"Key\": {...}, \"Body\": \"HEX\"} objects, " +
+			"where Body is the hex-encoded on-disk item body.  This command " +
+			"validates that each body decodes as the type given by its key " +
+			"and is exactly the size that that type calls for, and writes a " +
+			"JSON file to stdout that may be passed to --import-items.\n" +
+			"\n" +
+			"Injected items are placed in synthetic nodes that take " +
+			"priority over any on-disk items with the same key, and are " +
+			"marked as INJECTED in `btrfs-rec inspect dump-trees`.\n" +
+			"\n" +
+			"If --import-items is already given, then the new items are " +
+			"merged with the existing ones.\n" +
+			"\n" +
+			"This does not modify the filesystem.\n" +
+			"\n" +
+			"If no --node-list is given, then a slow sector-by-sector scan " +
+			"will be used to find all nodes.",
+		Args: cliutil.WrapPositionalArgs(cobra.ExactArgs(1)),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			globalFlags.openFlag = os.O_RDONLY
+			return nil
+		},
+		RunE: runWithRawFSAndNodeList(func(fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr, cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			var items []btrfsutil.InjectedItem
+			if globalFlags.importItems != "" {
+				var err error
+				items, err = readJSONFile[[]btrfsutil.InjectedItem](ctx, globalFlags.importItems)
+				if err != nil {
+					return err
+				}
+			}
+			newItems, err := readJSONFile[[]btrfsutil.InjectedItem](ctx, args[0])
+			if err != nil {
+				return err
+			}
+			items = append(items, newItems...)
+
+			graph, err := readGraph(ctx, fs, nodeList)
+			if err != nil {
+				return err
+			}
+			forrest := btrfsutil.NewRebuiltForrest(fs, graph, nil, laxAncestors(cmd, true))
+			if err := forrest.RebuiltInjectItems(ctx, items); err != nil {
+				return err
+			}
+
+			return writeJSONFile(stdout, items, lowmemjson.ReEncoderConfig{
+				Indent:                "\t",
+				ForceTrailingNewlines: true,
+			})
+		}),
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"os"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/dlib/dlog"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func init() {
+	var flags struct {
+		all bool
+	}
+	cmd := &cobra.Command{
+		Use:   "rebuild-dev-tree",
+		Short: "Check the DEV_TREE's DEV_EXTENTs against the CHUNK_TREE, and synthesize missing ones",
+		Long: "" +
+			"Every stripe of every chunk in the CHUNK_TREE should have a " +
+			"DEV_EXTENT in the DEV_TREE that points back at the chunk; and " +
+			"every DEV_EXTENT should correspond to a chunk stripe.  This " +
+			"reports any mismatches (dev extents that are not backed by a " +
+			"chunk, chunk stripes with no dev extent, and dev extents that " +
+			"disagree with their chunk) as warnings, and synthesizes " +
+			"DEV_EXTENT items from the chunk stripes to fix them.\n" +
+			"\n" +
+			"The items are written to stdout as a JSON file that may be " +
+			"passed to --import-items.  With --all, items are written for " +
+			"every chunk stripe, not just for the missing or wrong ones.  " +
+			"If --import-items is already given, then any existing items " +
+			"that are not for the DEV_TREE are kept.\n" +
+			"\n" +
+			"This does not modify the filesystem.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			globalFlags.openFlag = os.O_RDONLY
+			return nil
+		},
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+
+			var items []btrfsutil.InjectedItem
+			if globalFlags.importItems != "" {
+				oldItems, err := readJSONFile[[]btrfsutil.InjectedItem](ctx, globalFlags.importItems)
+				if err != nil {
+					return err
+				}
+				for _, item := range oldItems {
+					if item.Tree != btrfsprim.DEV_TREE_OBJECTID {
+						items = append(items, item)
+					}
+				}
+			}
+
+			newItems, problems, err := btrfsutil.RebuildDevTree(ctx, fs, flags.all)
+			if err != nil {
+				return err
+			}
+			for _, problem := range problems {
+				dlog.Warnf(ctx, "%v", problem)
+			}
+			dlog.Infof(ctx, "synthesized %v DEV_TREE items; found %v inconsistencies",
+				len(newItems), len(problems))
+			items = append(items, newItems...)
+
+			return writeJSONFile(stdout, items, lowmemjson.ReEncoderConfig{
+				Indent:                "\t",
+				ForceTrailingNewlines: true,
+			})
+		}),
+	}
+	cmd.Flags().BoolVar(&flags.all, "all", false,
+		"write a DEV_EXTENT for every chunk stripe, not just for the missing or wrong ones")
+	repairers.AddCommand(cmd)
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"os"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/dlib/dlog"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func init() {
+	repairers.AddCommand(&cobra.Command{
+		Use:   "rebuild-extent-tree",
+		Short: "Synthesize the EXTENT_TREE from the other trees' references to extents",
+		Long: "" +
+			"Walk every tree (other than the log trees), and from the " +
+			"FILE_EXTENT items, the key-pointers to tree blocks, and the " +
+			"CHUNK_ITEMs, synthesize the EXTENT_ITEMs (or METADATA_ITEMs), " +
+			"backrefs, and BLOCK_GROUP_ITEMs of a new EXTENT_TREE.  The " +
+			"blocks of the existing EXTENT_TREE are included, but its " +
+			"items are not read.  Extents that are shared between several " +
+			"files or trees get one backref per referrer, and a reference " +
+			"count to match; as in the kernel, blocks that are only " +
+			"reachable through a snapshot of the tree that owns them get " +
+			"the FULL_BACKREF flag, and the things that they point at get " +
+			"SHARED_BLOCK_REFs and SHARED_DATA_REFs to them.\n" +
+			"\n" +
+			"Extents that cannot be attributed to a block group of the " +
+			"right type (or that overlap another extent) are left out, " +
+			"and are logged as warnings.\n" +
+			"\n" +
+			"The items are written to stdout as a JSON file that may be " +
+			"passed to --import-items.  If --import-items is already " +
+			"given, then any existing items that are not for the " +
+			"EXTENT_TREE are kept.\n" +
+			"\n" +
+			"This does not modify the filesystem.\n" +
+			"\n" +
+			"If no --node-list is given, then a slow sector-by-sector scan " +
+			"will be used to find all nodes.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			globalFlags.openFlag = os.O_RDONLY
+			return nil
+		},
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+
+			var items []btrfsutil.InjectedItem
+			if globalFlags.importItems != "" {
+				oldItems, err := readJSONFile[[]btrfsutil.InjectedItem](ctx, globalFlags.importItems)
+				if err != nil {
+					return err
+				}
+				for _, item := range oldItems {
+					if item.Tree != btrfsprim.EXTENT_TREE_OBJECTID {
+						items = append(items, item)
+					}
+				}
+			}
+
+			newItems, problems, err := btrfsutil.RebuildExtentTree(ctx, fs)
+			if err != nil {
+				return err
+			}
+			for _, problem := range problems {
+				dlog.Warnf(ctx, "%v", problem)
+			}
+			dlog.Infof(ctx, "synthesized %v EXTENT_TREE items; %v extents could not be attributed",
+				len(newItems), len(problems))
+			items = append(items, newItems...)
+
+			return writeJSONFile(stdout, items, lowmemjson.ReEncoderConfig{
+				Indent:                "\t",
+				ForceTrailingNewlines: true,
+			})
+		}),
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func init() {
+	repairers.AddCommand(&cobra.Command{
+		Use:   "set-generation TREE_ID GENERATION",
+		Short: "EXPERT: Override the generation that a tree's parent-snapshot is trusted to be at",
+		Long: "" +
+			"When the generation recorded for a snapshot (the offset of its " +
+			"ROOT_ITEM) is itself corrupt, the rebuilder may reject good " +
+			"nodes from the snapshot's parent tree.  This command validates " +
+			"that GENERATION is plausible for the filesystem, and writes a " +
+			"JSON file to stdout that may be passed to --trusted-generations " +
+			"in order to override it.\n" +
+			"\n" +
+			"If --trusted-generations is already given, then the new override " +
+			"is merged with the existing ones.\n" +
+			"\n" +
+			"This does not modify the filesystem.\n" +
+			"\n" +
+			"If no --node-list is given, then a slow sector-by-sector scan " +
+			"will be used to find all nodes.",
+		Args: cliutil.WrapPositionalArgs(cobra.ExactArgs(2)),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			globalFlags.openFlag = os.O_RDONLY
+			return nil
+		},
+		RunE: runWithRawFSAndNodeList(func(fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr, cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			treeID, err := btrfsprim.ParseObjID(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid TREE_ID: %w", err)
+			}
+			gen, err := strconv.ParseUint(args[1], 0, 64)
+			if err != nil {
+				return fmt.Errorf("invalid GENERATION: %w", err)
+			}
+
+			gens := make(map[btrfsprim.ObjID]btrfsprim.Generation)
+			if globalFlags.trustedGens != "" {
+				gens, err = readJSONFile[map[btrfsprim.ObjID]btrfsprim.Generation](ctx, globalFlags.trustedGens)
+				if err != nil {
+					return err
+				}
+			}
+			gens[treeID] = btrfsprim.Generation(gen)
+
+			graph, err := readGraph(ctx, fs, nodeList)
+			if err != nil {
+				return err
+			}
+			forrest := btrfsutil.NewRebuiltForrest(fs, graph, nil, laxAncestors(cmd, true))
+			if err := forrest.RebuiltSetTrustedGeneration(ctx, treeID, btrfsprim.Generation(gen)); err != nil {
+				return err
+			}
+
+			return writeJSONFile(stdout, gens, lowmemjson.ReEncoderConfig{
+				Indent:                "\t",
+				ForceTrailingNewlines: true,
+			})
+		}),
+	})
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+func init() {
+	var flags struct {
+		write bool
+	}
+	cmd := &cobra.Command{
+		Use:   "truncate-recover",
+		Short: "Fall back to a backup root if the image is truncated",
+		Long: "" +
+			"When an image was truncated, or was captured while the " +
+			"filesystem was growing, the superblock may point at nodes " +
+			"past the end of the image.  This runs the same check as " +
+			"'btrfs-rec inspect check-truncation', and if the superblock's " +
+			"own roots are out of bounds, suggests the newest backup root " +
+			"whose nodes are all within bounds.\n" +
+			"\n" +
+			"This does not modify the filesystem unless --write is given, " +
+			"in which case every superblock on every device is updated to " +
+			"use the suggested backup root (and to drop the log tree, " +
+			"which belongs to a newer generation).",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			if !flags.write {
+				globalFlags.openFlag = os.O_RDONLY
+			}
+			return nil
+		},
+		RunE: runWithRawFS(nil, func(fs *btrfs.FS, cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+
+			sets, err := btrfsutil.CheckTruncation(ctx, fs)
+			if err != nil {
+				return err
+			}
+			best := writeTruncationReport(stdout, sets)
+			if best == nil {
+				return fmt.Errorf("no usable generation found")
+			}
+			if best.Backup == nil {
+				return nil
+			}
+
+			if !flags.write {
+				textui.Fprintf(stdout, "not modifying the filesystem; pass --write to update the superblocks\n")
+				return nil
+			}
+			sbs, err := fs.Superblocks()
+			if err != nil {
+				return err
+			}
+			for _, sb := range sbs {
+				sb.Data.Generation = best.Backup.TreeRootGen
+				sb.Data.RootTree = btrfsvol.LogicalAddr(best.Backup.TreeRoot)
+				sb.Data.RootLevel = best.Backup.TreeRootLevel
+				sb.Data.ChunkTree = btrfsvol.LogicalAddr(best.Backup.ChunkRoot)
+				sb.Data.ChunkLevel = best.Backup.ChunkRootLevel
+				sb.Data.ChunkRootGeneration = best.Backup.ChunkRootGen
+				sb.Data.LogTree = 0
+				sb.Data.LogLevel = 0
+				sb.Data.LogRootTransID = 0
+				sb.Data.TotalBytes = best.Backup.TotalBytes
+				sb.Data.BytesUsed = best.Backup.BytesUsed
+				sb.Data.Checksum, err = sb.Data.CalculateChecksum()
+				if err != nil {
+					return err
+				}
+				if err := sb.Write(); err != nil {
+					return fmt.Errorf("file %q: superblock at %v: %w", sb.File.Name(), sb.Addr, err)
+				}
+				dlog.Infof(ctx, "updated superblock at %v in %q", sb.Addr, sb.File.Name())
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().BoolVar(&flags.write, "write", false,
+		"update the superblocks to use the suggested backup root")
+	repairers.AddCommand(cmd)
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/datawire/ocibuild/pkg/cliutil"
+	"github.com/spf13/cobra"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+func init() {
+	var flags struct {
+		output    string
+		chunkSize btrfsvol.AddrDelta
+		skipData  bool
+	}
+	cmd := &cobra.Command{
+		Use:   "write-trees",
+		Short: "Write the (rebuilt) trees out as a fresh filesystem image",
+		Long: "" +
+			"Write every tree (as rebuilt, if --rebuild is given) in to " +
+			"new nodes in a fresh single-device image, along with a " +
+			"regenerated EXTENT_TREE, DEV_TREE, CHUNK_TREE, ROOT_TREE, " +
+			"and superblock, with the aim that the image may be mounted " +
+			"read-only by the kernel.  The image is then re-opened and " +
+			"each tree is read back, to verify that it was written " +
+			"correctly.\n" +
+			"\n" +
+			"Limitations:\n" +
+			"\n" +
+			"  - UNTESTED: whether the kernel will actually mount the " +
+			"image, and whether 'btrfs check' accepts it, has not been " +
+			"tested; the only verification is btrfs-rec reading the " +
+			"image back with its own code.  Run 'btrfs check --readonly' " +
+			"on the image, and mount it read-only, before trusting it.\n" +
+			"\n" +
+			"  - Every chunk in the image has the SINGLE profile, " +
+			"regardless of the profiles of the original filesystem.\n" +
+			"\n" +
+			"  - Data chunks keep their original logical addresses, so " +
+			"FILE_EXTENT and EXTENT_CSUM items are copied unchanged.  " +
+			"Only data extents that are referenced by a copied tree are " +
+			"copied, and with --skip-data none are, leaving the image " +
+			"sparse and its file contents zero.  Data that cannot be " +
+			"read is left as zeros, and will fail checksum verification.\n" +
+			"\n" +
+			"  - Snapshots no longer share tree nodes with each other, " +
+			"so the metadata may be considerably larger than that of the " +
+			"original filesystem.\n" +
+			"\n" +
+			"  - The QUOTA_TREE, the FREE_SPACE_TREE, the " +
+			"BLOCK_GROUP_TREE, log trees, relocation trees, and the v1 " +
+			"free space cache are not carried over, and the superblock " +
+			"flags are adjusted to match; the kernel will rebuild the " +
+			"free space cache if the image is mounted read-write.\n" +
+			"\n" +
+			"  - Filesystems with mixed block groups, the " +
+			"extent-tree-v2 feature, or zoned devices are not " +
+			"supported.\n" +
+			"\n" +
+			"This does not modify the filesystem; the --output file must " +
+			"not already exist.\n" +
+			"\n" +
+			"If no --node-list is given, then a slow sector-by-sector scan " +
+			"will be used to find all nodes.",
+		Args: cliutil.WrapPositionalArgs(cobra.NoArgs),
+		PreRunE: func(_ *cobra.Command, _ []string) error {
+			globalFlags.openFlag = os.O_RDONLY
+			return nil
+		},
+		RunE: runWithReadableFS(func(fs btrfs.ReadableFS, cmd *cobra.Command, _ []string) (err error) {
+			ctx := cmd.Context()
+
+			fh, err := os.OpenFile(flags.output, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if _err := fh.Close(); _err != nil && err == nil {
+					err = _err
+				}
+			}()
+			img := &diskio.OSFile[btrfsvol.PhysicalAddr]{File: fh}
+
+			report, err := btrfsutil.WriteTrees(ctx, fs, img, btrfsutil.WriteTreesConfig{
+				MetadataChunkSize: flags.chunkSize,
+				SkipData:          flags.skipData,
+			})
+			if err != nil {
+				return err
+			}
+			for _, problem := range report.ExtentProblems {
+				dlog.Warnf(ctx, "%v", problem)
+			}
+			if err := fh.Truncate(int64(report.Size)); err != nil {
+				return err
+			}
+			if err := fh.Sync(); err != nil {
+				return err
+			}
+
+			dlog.Info(ctx, "verifying the written image...")
+			if err := btrfsutil.VerifyWrittenTrees(ctx, img, report); err != nil {
+				return fmt.Errorf("verify %q: %w", flags.output, err)
+			}
+
+			textui.Fprintf(stdout, "wrote %q: size=%v generation=%v\n",
+				flags.output, textui.IEC(int64(report.Size), "B"), report.Generation)
+			for _, tree := range report.Trees {
+				textui.Fprintf(stdout, "  tree %v: root=%v level=%v nodes=%v items=%v\n",
+					tree.ID.Format(btrfsprim.ROOT_TREE_OBJECTID), tree.Root, tree.Level, tree.Nodes, tree.Items)
+			}
+			for _, treeID := range maps.SortedKeys(report.Dropped) {
+				textui.Fprintf(stdout, "  dropped tree %v: %v\n",
+					treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), report.Dropped[treeID])
+			}
+			textui.Fprintf(stdout, "skipped items: %v\n", report.SkippedItems)
+			textui.Fprintf(stdout, "unattributed extents: %v\n", len(report.ExtentProblems))
+			textui.Fprintf(stdout, "data copied: %v (%v unreadable ranges)\n",
+				textui.IEC(report.DataBytes, "B"), report.DataErrors)
+			return nil
+		}),
+	}
+	cmd.Flags().StringVarP(&flags.output, "output", "o", "",
+		"write the new image to `out.img`, which must not already exist")
+	noError(cmd.MarkFlagFilename("output", "img"))
+	noError(cmd.MarkFlagRequired("output"))
+	cmd.Flags().Int64Var((*int64)(&flags.chunkSize), "metadata-chunk-size", btrfsutil.DefaultMetadataChunkSize,
+		"allocate METADATA chunks of `size` bytes (a multiple of the node size)")
+	cmd.Flags().BoolVar(&flags.skipData, "skip-data", false,
+		"do not copy any data extents; only write the metadata")
+	repairers.AddCommand(cmd)
+}
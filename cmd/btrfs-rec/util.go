@@ -7,12 +7,18 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"io"
+	iofs "io/fs"
 	"os"
+	"unicode"
 
 	"git.lukeshu.com/go/lowmemjson"
 	"github.com/datawire/dlib/dlog"
 
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
 	"git.lukeshu.com/btrfs-progs-ng/lib/streamio"
 )
 
@@ -47,3 +53,106 @@ func writeJSONFile(w io.Writer, obj any, cfg lowmemjson.ReEncoderConfig) (err er
 	}()
 	return lowmemjson.NewEncoder(lowmemjson.NewReEncoder(buffer, cfg)).Encode(obj)
 }
+
+// readNodeListFile reads a --node-list file, which may either be a
+// JSON array (as written by `btrfs-rec inspect list-nodes`) or JSON
+// Lines (as written by `btrfs-rec inspect list-nodes --stream`).
+func readNodeListFile(ctx context.Context, filename string) ([]btrfsvol.LogicalAddr, error) {
+	isArray, err := isJSONArrayFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if isArray {
+		return readJSONFile[[]btrfsvol.LogicalAddr](ctx, filename)
+	}
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = fh.Close()
+	}()
+	return btrfsutil.ReadNodeListLines(dlog.WithField(ctx, "btrfs.read-json-file", filename), fh)
+}
+
+// isJSONArrayFile returns whether the first non-whitespace character
+// of the file is '['.
+func isJSONArrayFile(filename string) (bool, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = fh.Close()
+	}()
+	buf := bufio.NewReader(fh)
+	for {
+		b, err := buf.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return false, nil
+			}
+			return false, err
+		}
+		if !unicode.IsSpace(rune(b)) {
+			return b == '[', nil
+		}
+	}
+}
+
+// readGraph is btrfsutil.ReadGraph, but if --graph-cache is given,
+// the graph is loaded from that file if it was written for the same
+// devices and node list, and the file is (re)written otherwise.
+func readGraph(ctx context.Context, fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr) (btrfsutil.Graph, error) {
+	filename := globalFlags.graphCache
+	if filename == "" {
+		return btrfsutil.ReadGraph(ctx, fs, nodeList)
+	}
+	key, err := btrfsutil.NewGraphCacheKey(fs, nodeList)
+	if err != nil {
+		return btrfsutil.Graph{}, err
+	}
+	if fh, err := os.Open(filename); err != nil {
+		if !errors.Is(err, iofs.ErrNotExist) {
+			dlog.Warnf(ctx, "--graph-cache=%q: %v; re-reading the graph", filename, err)
+		}
+	} else {
+		graph, err := btrfsutil.ReadGraphCache(ctx, fh, key)
+		_ = fh.Close()
+		if err == nil {
+			return graph, nil
+		}
+		dlog.Warnf(ctx, "--graph-cache=%q: %v; re-reading the graph", filename, err)
+	}
+	graph, err := btrfsutil.ReadGraph(ctx, fs, nodeList)
+	if err != nil {
+		return btrfsutil.Graph{}, err
+	}
+	dlog.Infof(ctx, "Writing graph cache to %q...", filename)
+	if err := writeGraphCache(filename, key, graph); err != nil {
+		dlog.Warnf(ctx, "--graph-cache=%q: %v", filename, err)
+	} else {
+		dlog.Info(ctx, "... done writing")
+	}
+	return graph, nil
+}
+
+// writeGraphCache writes the cache to a temporary file and renames
+// it in to place, so that an interruption can't leave a partial
+// cache.
+func writeGraphCache(filename string, key btrfsutil.GraphCacheKey, graph btrfsutil.Graph) error {
+	tmpFilename := filename + ".tmp"
+	fh, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	if err := btrfsutil.WriteGraphCache(fh, key, graph); err != nil {
+		_ = fh.Close()
+		_ = os.Remove(tmpFilename)
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
@@ -63,3 +63,56 @@ func TestSmoke(t *testing.T) {
 	assert.Equal(t, 0x6F, n)
 	assert.Equal(t, input, output)
 }
+
+func TestOptionalTrailingFields(t *testing.T) {
+	t.Parallel()
+	type Versioned struct {
+		A             uint32 `bin:"off=0x0, siz=0x4"`
+		B             uint16 `bin:"off=0x4, siz=0x2, opt"`
+		C             uint16 `bin:"off=0x6, siz=0x2, opt"`
+		binstruct.End `bin:"off=0x8"`
+	}
+
+	assert.Equal(t, 0x8, binstruct.StaticSize(Versioned{}))
+
+	full := []byte{1, 0, 0, 0, 2, 0, 3, 0}
+
+	var out Versioned
+	n, err := binstruct.Unmarshal(full, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, Versioned{A: 1, B: 2, C: 3}, out)
+
+	// Decoding a shorter version zeroes the absent fields.
+	n, err = binstruct.Unmarshal(full[:6], &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, Versioned{A: 1, B: 2}, out)
+
+	n, err = binstruct.Unmarshal(full[:4], &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, Versioned{A: 1}, out)
+
+	// Required fields are still required, and optional fields
+	// may not be cut off in the middle.
+	_, err = binstruct.Unmarshal(full[:3], &out)
+	assert.Error(t, err)
+	_, err = binstruct.Unmarshal(full[:5], &out)
+	assert.Error(t, err)
+
+	// Marshaling always writes the newest version.
+	bs, err := binstruct.Marshal(Versioned{A: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 0, 0, 0, 0, 0, 0, 0}, bs)
+}
+
+func TestOptionalMustBeTrailing(t *testing.T) {
+	t.Parallel()
+	type Bad struct {
+		A             uint16 `bin:"off=0x0, siz=0x2, opt"`
+		B             uint16 `bin:"off=0x2, siz=0x2"`
+		binstruct.End `bin:"off=0x4"`
+	}
+	assert.Panics(t, func() { _ = binstruct.StaticSize(Bad{}) })
+}
@@ -21,6 +21,10 @@ var endType = reflect.TypeOf(End{})
 
 type tag struct {
 	skip bool
+	// opt marks a trailing field that older versions of the
+	// on-disk struct lack; it and every field after it are only
+	// decoded if the buffer is long enough.
+	opt bool
 
 	off int
 	siz int
@@ -36,6 +40,10 @@ func parseStructTag(str string) (tag, error) {
 		if part == "-" {
 			return tag{skip: true}, nil
 		}
+		if part == "opt" {
+			ret.opt = true
+			continue
+		}
 		keyval := strings.SplitN(part, "=", 2)
 		if len(keyval) != 2 {
 			return tag{}, fmt.Errorf("option is not a key=value pair: %q", part)
@@ -63,9 +71,13 @@ func parseStructTag(str string) (tag, error) {
 }
 
 type structHandler struct {
-	name   string
-	Size   int
-	fields []structField
+	name string
+	Size int
+	// MinSize is the offset of the first "opt" field; buffers
+	// shorter than Size but at least MinSize may still be
+	// unmarshaled, leaving the trailing fields zero.
+	MinSize int
+	fields  []structField
 }
 
 type structField struct {
@@ -75,7 +87,7 @@ type structField struct {
 }
 
 func (sh structHandler) Unmarshal(dat []byte, dst reflect.Value) (int, error) {
-	if err := binutil.NeedNBytes(dat, sh.Size); err != nil {
+	if err := binutil.NeedNBytes(dat, sh.MinSize); err != nil {
 		return 0, fmt.Errorf("struct %q %w", sh.name, err)
 	}
 	var n int
@@ -83,6 +95,16 @@ func (sh structHandler) Unmarshal(dat []byte, dst reflect.Value) (int, error) {
 		if field.skip {
 			continue
 		}
+		if field.opt && n == len(dat) {
+			// An older, shorter version of the struct; zero
+			// the remaining fields.
+			for j := i; j < len(sh.fields); j++ {
+				if !sh.fields[j].skip {
+					dst.Field(j).Set(reflect.Zero(dst.Field(j).Type()))
+				}
+			}
+			break
+		}
 		_n, err := unmarshal(dat[n:], dst.Field(i), field.isUnmarshaler)
 		if err != nil {
 			if _n >= 0 {
@@ -122,6 +144,7 @@ func genStructHandler(structInfo reflect.Type) (structHandler, error) {
 	ret.name = structInfo.String()
 
 	var curOffset, endOffset int
+	minOffset := -1
 	for i := 0; i < structInfo.NumField(); i++ {
 		fieldInfo := structInfo.Field(i)
 
@@ -152,6 +175,18 @@ func genStructHandler(structInfo reflect.Type) (structHandler, error) {
 		if fieldInfo.Type == endType {
 			endOffset = curOffset
 		}
+		switch {
+		case fieldTag.opt && fieldInfo.Type == endType:
+			err := fmt.Errorf("binstruct.End may not be marked opt")
+			return ret, fmt.Errorf("struct %q field %v %q: %w",
+				ret.name, i, fieldInfo.Name, err)
+		case fieldTag.opt && minOffset < 0:
+			minOffset = curOffset
+		case !fieldTag.opt && minOffset >= 0 && fieldInfo.Type != endType:
+			err := fmt.Errorf("non-opt field follows opt field at off=%#x", minOffset)
+			return ret, fmt.Errorf("struct %q field %v %q: %w",
+				ret.name, i, fieldInfo.Name, err)
+		}
 
 		fieldSize, err := staticSize(fieldInfo.Type)
 		if err != nil {
@@ -173,6 +208,10 @@ func genStructHandler(structInfo reflect.Type) (structHandler, error) {
 		})
 	}
 	ret.Size = curOffset
+	ret.MinSize = curOffset
+	if minOffset >= 0 {
+		ret.MinSize = minOffset
+	}
 
 	if ret.Size != endOffset {
 		return ret, fmt.Errorf("struct %q: .Size=%v but endOffset=%v",
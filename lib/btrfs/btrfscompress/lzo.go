@@ -0,0 +1,107 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+// Package btrfscompress contains the decompressors for the
+// compression formats that btrfs uses for file extents.
+package btrfscompress
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MaxCompressedExtentSize is the largest that btrfs makes a
+// compressed extent, both on disk and decompressed
+// (BTRFS_MAX_COMPRESSED).
+const MaxCompressedExtentSize = 128 * 1024
+
+// lzoLen is the size of each of the length headers in btrfs's LZO
+// framing.
+const lzoLen = 4
+
+// DecompressLZO decompresses an LZO-compressed extent, as stored on
+// disk by btrfs (fs/btrfs/lzo.c).
+//
+// btrfs does not store a raw LZO1X stream; the data is framed as:
+//
+//   - a 4-byte little-endian total length of the compressed data
+//     (including this header), followed by
+//   - a sequence of segments, each of which is a 4-byte little-endian
+//     segment length followed by that many bytes of LZO1X stream that
+//     decompress to at most one sector (sectorSize bytes).  A segment
+//     header never straddles a sector boundary; if fewer than 4 bytes
+//     remain in the current sector, those bytes are zero padding, and
+//     the next header starts at the beginning of the next sector.
+//
+// Every segment but the last must decompress to exactly one sector.
+// The result is the concatenation of the decompressed segments,
+// zero-filled up to ramBytes (the extent's ram_bytes, which for a
+// regular extent is sector-aligned); it is an error for the data to
+// decompress to more than ramBytes.
+//
+// The same framing is used for both regular and inline extents.
+func DecompressLZO(src []byte, sectorSize uint32, ramBytes int64) ([]byte, error) {
+	if sectorSize == 0 {
+		return nil, fmt.Errorf("lzo: invalid sector size 0")
+	}
+	if ramBytes < 0 {
+		return nil, fmt.Errorf("lzo: invalid ram_bytes %v", ramBytes)
+	}
+	if len(src) < lzoLen {
+		return nil, fmt.Errorf("lzo: compressed data is too short for a header: %v bytes", len(src))
+	}
+	totalLen := int64(binary.LittleEndian.Uint32(src))
+	if totalLen > int64(len(src)) {
+		return nil, fmt.Errorf("lzo: header total length %v exceeds the compressed extent size %v",
+			totalLen, len(src))
+	}
+	if totalLen < lzoLen {
+		return nil, fmt.Errorf("lzo: header total length %v is too short", totalLen)
+	}
+	src = src[:totalLen]
+	sector := int(sectorSize)
+
+	out := make([]byte, 0, ramBytes)
+	lastSegLen := sector
+	for cur := lzoLen; cur < len(src); {
+		if lastSegLen != sector {
+			return out, fmt.Errorf("lzo: segment at compressed offset %v: previous segment decompressed to %v bytes, not a full sector (%v bytes)",
+				cur, lastSegLen, sector)
+		}
+		if len(src)-cur < lzoLen {
+			return out, fmt.Errorf("lzo: segment header at compressed offset %v: truncated", cur)
+		}
+		segLen := int(binary.LittleEndian.Uint32(src[cur:]))
+		cur += lzoLen
+		if segLen > len(src)-cur {
+			return out, fmt.Errorf("lzo: segment at compressed offset %v: length %v overruns the compressed data",
+				cur-lzoLen, segLen)
+		}
+
+		before := len(out)
+		maxOut := sector
+		if rest := int(ramBytes) - before; rest < maxOut {
+			maxOut = rest
+		}
+		var err error
+		out, err = lzo1xDecompress(out, src[cur:cur+segLen], maxOut)
+		if err != nil {
+			return out, fmt.Errorf("lzo: segment at compressed offset %v: %w", cur-lzoLen, err)
+		}
+		lastSegLen = len(out) - before
+		cur += segLen
+
+		// Skip the padding at the end of the sector, if there
+		// isn't room for another header.
+		if left := sector - cur%sector; left < lzoLen {
+			cur += left
+		}
+	}
+
+	// Zero-fill the tail.
+	for len(out) < int(ramBytes) {
+		out = append(out, 0)
+	}
+	return out, nil
+}
@@ -0,0 +1,196 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfscompress
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	errLZOInputOverrun    = errors.New("lzo1x: input overrun")
+	errLZOOutputOverrun   = errors.New("lzo1x: output overrun")
+	errLZOLookbehind      = errors.New("lzo1x: lookbehind overrun")
+	errLZONoEndOfStream   = errors.New("lzo1x: missing end-of-stream marker")
+	errLZOTrailingGarbage = errors.New("lzo1x: trailing data after end-of-stream marker")
+)
+
+// lzo1xDecompress decompresses a raw LZO1X stream (as produced by
+// lzo1x_1_compress, which is what the kernel uses), appending the
+// result to dst.  The output is not allowed to grow beyond maxOut
+// bytes past the original len(dst).
+//
+// This mirrors the kernel's lzo1x_decompress_safe(), without the
+// "lzo-rle" bitstream-version-1 extension, which btrfs does not use.
+func lzo1xDecompress(dst, src []byte, maxOut int) ([]byte, error) {
+	outBeg := len(dst)
+	ip := 0
+
+	readByte := func() (int, error) {
+		if ip >= len(src) {
+			return 0, errLZOInputOverrun
+		}
+		b := src[ip]
+		ip++
+		return int(b), nil
+	}
+	// readRunLength reads the "zero bytes, then a non-zero byte"
+	// extended run-length encoding, returning base plus the
+	// encoded value.
+	readRunLength := func(base int) (int, error) {
+		zeros := 0
+		for ip < len(src) && src[ip] == 0 {
+			zeros++
+			ip++
+		}
+		b, err := readByte()
+		if err != nil {
+			return 0, err
+		}
+		return base + zeros*255 + b, nil
+	}
+	copyLiterals := func(n int) error {
+		if n > len(src)-ip {
+			return errLZOInputOverrun
+		}
+		if len(dst)-outBeg+n > maxOut {
+			return errLZOOutputOverrun
+		}
+		dst = append(dst, src[ip:ip+n]...)
+		ip += n
+		return nil
+	}
+	copyMatch := func(dist, n int) error {
+		pos := len(dst) - dist
+		if pos < outBeg {
+			return errLZOLookbehind
+		}
+		if len(dst)-outBeg+n > maxOut {
+			return errLZOOutputOverrun
+		}
+		// Byte-by-byte, as the match may overlap with its own
+		// output.
+		for i := 0; i < n; i++ {
+			dst = append(dst, dst[pos+i])
+		}
+		return nil
+	}
+
+	// state is the number of literals that were copied after the
+	// previous instruction (with 4 meaning "4 or more"); it
+	// determines how an instruction byte < 16 is interpreted.
+	state := 0
+
+	if len(src) > 0 && src[0] > 17 {
+		ip++
+		t := int(src[0]) - 17
+		if err := copyLiterals(t); err != nil {
+			return dst, err
+		}
+		if t < 4 {
+			state = t
+		} else {
+			state = 4
+		}
+	}
+
+	for {
+		t, err := readByte()
+		if err != nil {
+			return dst, errLZONoEndOfStream
+		}
+		var dist, length, next int
+		switch {
+		case t < 16 && state == 0:
+			// Literal run.
+			length = t + 3
+			if t == 0 {
+				if length, err = readRunLength(15 + 3); err != nil {
+					return dst, err
+				}
+			}
+			if err := copyLiterals(length); err != nil {
+				return dst, err
+			}
+			state = 4
+			continue
+		case t < 16 && state < 4:
+			// 2-byte match, within 1KiB.
+			b, err := readByte()
+			if err != nil {
+				return dst, err
+			}
+			next = t & 3
+			dist = 1 + (t >> 2) + (b << 2)
+			length = 2
+		case t < 16:
+			// 3-byte match, 2-3KiB back.
+			b, err := readByte()
+			if err != nil {
+				return dst, err
+			}
+			next = t & 3
+			dist = 1 + 0x800 + (t >> 2) + (b << 2)
+			length = 3
+		case t >= 64:
+			// M2: 3-8 byte match, within 2KiB.
+			b, err := readByte()
+			if err != nil {
+				return dst, err
+			}
+			next = t & 3
+			dist = 1 + ((t >> 2) & 7) + (b << 3)
+			length = (t >> 5) + 1
+		case t >= 32:
+			// M3: match within 16KiB.
+			length = (t & 31) + 2
+			if length == 2 {
+				if length, err = readRunLength(31 + 2); err != nil {
+					return dst, err
+				}
+			}
+			if len(src)-ip < 2 {
+				return dst, errLZOInputOverrun
+			}
+			v := int(binary.LittleEndian.Uint16(src[ip:]))
+			ip += 2
+			next = v & 3
+			dist = 1 + (v >> 2)
+		default: // 16 <= t < 32
+			// M4: match 16-48KiB back, or end-of-stream.
+			length = (t & 7) + 2
+			if length == 2 {
+				if length, err = readRunLength(7 + 2); err != nil {
+					return dst, err
+				}
+			}
+			if len(src)-ip < 2 {
+				return dst, errLZOInputOverrun
+			}
+			v := int(binary.LittleEndian.Uint16(src[ip:]))
+			ip += 2
+			next = v & 3
+			dist = ((t & 8) << 11) + (v >> 2)
+			if dist == 0 {
+				if length != 3 {
+					return dst, fmt.Errorf("lzo1x: malformed end-of-stream marker")
+				}
+				if ip != len(src) {
+					return dst, errLZOTrailingGarbage
+				}
+				return dst, nil
+			}
+			dist += 0x4000
+		}
+		if err := copyMatch(dist, length); err != nil {
+			return dst, err
+		}
+		if err := copyLiterals(next); err != nil {
+			return dst, err
+		}
+		state = next
+	}
+}
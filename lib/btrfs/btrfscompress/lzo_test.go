@@ -0,0 +1,192 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfscompress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLZO1XDecompress(t *testing.T) {
+	t.Parallel()
+	src := []byte{
+		0x14, 'a', 'b', 'c', // first-byte literal run of 3
+		0x08, 0x00, // 2-byte match, distance 3
+		0x4A, 0x00, 'X', 'Y', // M2: 3-byte match, distance 3; 2 trailing literals
+		0x04, 0x01, // 2-byte match, distance 6
+		0x01, 'W', 'X', 'Y', 'Z', // literal run of 4
+		0x23, 0x3D, 0x00, '!', // M3: 5-byte match, distance 16; 1 trailing literal
+		0x11, 0x00, 0x00, // end of stream
+	}
+	out, err := lzo1xDecompress(nil, src, 1024)
+	require.NoError(t, err)
+	assert.Equal(t, "abcabcabXYbcWXYZabcab!", string(out))
+
+	_, err = lzo1xDecompress(nil, src, 10)
+	assert.ErrorIs(t, err, errLZOOutputOverrun)
+	_, err = lzo1xDecompress(nil, src[:len(src)-3], 1024)
+	assert.ErrorIs(t, err, errLZONoEndOfStream)
+	_, err = lzo1xDecompress(nil, append(append([]byte(nil), src...), 0), 1024)
+	assert.ErrorIs(t, err, errLZOTrailingGarbage)
+	_, err = lzo1xDecompress(nil, []byte{0x14, 'a', 'b', 'c', 0x0C, 0x00, 0x11, 0x00, 0x00}, 1024)
+	assert.ErrorIs(t, err, errLZOLookbehind)
+}
+
+func le32(n int) []byte {
+	return binary.LittleEndian.AppendUint32(nil, uint32(n))
+}
+
+// testLZOKernelInput returns the data that is compressed in
+// testdata/lzo-10000.bin: runs of 700 bytes that alternate between
+// repeated text (which compresses well) and LCG noise (which
+// doesn't).
+func testLZOKernelInput() []byte {
+	const text = "The quick brown fox jumps over the lazy dog; "
+	ret := make([]byte, 10000)
+	state := uint32(1)
+	for i := range ret {
+		if (i/700)%2 == 0 {
+			ret[i] = text[i%len(text)] + byte(i/3000)
+		} else {
+			state = state*1103515245 + 12345
+			ret[i] = byte(state >> 24)
+		}
+	}
+	return ret
+}
+
+// testLZOKernelExtent returns an extent as written by the kernel, for
+// the sector size of 4KiB.
+//
+// testdata/lzo-10000.bin was not written by a real kernel (there is
+// none to hand that would let us read it back out of an image);
+// it was produced by a C program that is a line-for-line
+// transcription of the kernel's lzo1x_1_compress()
+// (lib/lzo/lzo1x_compress.c) and of the framing done by
+// lzo_compress_folios() and copy_compressed_data_to_page()
+// (fs/btrfs/lzo.c), so that it does not share any bugs with the
+// decoder under test.  It has 3 segments, the 2nd of which straddles
+// a sector boundary.
+func testLZOKernelExtent(t *testing.T) (compressed, decompressed []byte) {
+	t.Helper()
+	compressed, err := os.ReadFile(filepath.Join("testdata", "lzo-10000.bin"))
+	require.NoError(t, err)
+	return compressed, testLZOKernelInput()
+}
+
+// testLZOPaddedExtent is a hand-built 2-sector extent with the sector
+// size of 4KiB, for the case that the kernel output in
+// testLZOKernelExtent doesn't hit: padding at the end of a sector.
+//
+//   - The first segment is a 4062-byte literal run followed by a
+//     34-byte match, decompressing to a full sector.  Its 4086 bytes
+//     of compressed data end 2 bytes short of the sector boundary,
+//     which is too little room for a segment header, so they are
+//     followed by 2 bytes of padding.
+//   - The second (tail) segment is a literal "tail\n", decompressing
+//     to less than a sector.
+func testLZOPaddedExtent() (compressed, decompressed []byte) {
+	lit := make([]byte, 4062)
+	for i := range lit {
+		lit[i] = byte(i*7 + i/251)
+	}
+
+	var seg1 []byte
+	seg1 = append(seg1, 0x00)
+	seg1 = append(seg1, make([]byte, 15)...)
+	seg1 = append(seg1, 219) // 18 + 15*255 + 219 = 4062
+	seg1 = append(seg1, lit...)
+	seg1 = append(seg1, 0x20, 0x01, 0x8C, 0x01) // M3: 33+1=34 bytes, distance 1+(0x018C>>2)=100
+	seg1 = append(seg1, 0x11, 0x00, 0x00)
+
+	seg2 := []byte{17 + 5, 't', 'a', 'i', 'l', '\n', 0x11, 0x00, 0x00}
+
+	var body []byte
+	body = append(body, le32(len(seg1))...)
+	body = append(body, seg1...)
+	body = append(body, 0x00, 0x00) // padding
+	body = append(body, le32(len(seg2))...)
+	body = append(body, seg2...)
+	compressed = append(le32(lzoLen+len(body)), body...)
+
+	decompressed = append(decompressed, lit...)
+	decompressed = append(decompressed, lit[len(lit)-100:][:34]...)
+	decompressed = append(decompressed, "tail\n"...)
+	return compressed, decompressed
+}
+
+func TestDecompressLZO(t *testing.T) {
+	t.Parallel()
+	compressed, decompressed := testLZOKernelExtent(t)
+	require.Len(t, compressed, 5565)
+	require.Len(t, decompressed, 10000)
+
+	t.Run("regular", func(t *testing.T) {
+		t.Parallel()
+		out, err := DecompressLZO(compressed, 4096, 12288)
+		require.NoError(t, err)
+		require.Len(t, out, 12288)
+		assert.Equal(t, decompressed, out[:10000])
+		assert.Equal(t, make([]byte, 12288-10000), out[10000:])
+	})
+	t.Run("disk-padding", func(t *testing.T) {
+		t.Parallel()
+		// The extent on disk is sector-aligned; anything after
+		// the header's total length is ignored.
+		padded := append(append([]byte(nil), compressed...), bytes.Repeat([]byte{0xFF}, 8192-len(compressed))...)
+		out, err := DecompressLZO(padded, 4096, 12288)
+		require.NoError(t, err)
+		assert.Equal(t, decompressed, out[:10000])
+	})
+	t.Run("sector-padding", func(t *testing.T) {
+		t.Parallel()
+		compressed, decompressed := testLZOPaddedExtent()
+		require.Len(t, compressed, 4109)
+		out, err := DecompressLZO(compressed, 4096, 8192)
+		require.NoError(t, err)
+		require.Len(t, out, 8192)
+		assert.Equal(t, decompressed, out[:4096+5])
+		assert.Equal(t, make([]byte, 8192-4096-5), out[4096+5:])
+	})
+	t.Run("inline", func(t *testing.T) {
+		t.Parallel()
+		seg := []byte{17 + 5, 't', 'a', 'i', 'l', '\n', 0x11, 0x00, 0x00}
+		inline := append(append(le32(2*lzoLen+len(seg)), le32(len(seg))...), seg...)
+		out, err := DecompressLZO(inline, 4096, 5)
+		require.NoError(t, err)
+		assert.Equal(t, "tail\n", string(out))
+	})
+	t.Run("ram-bytes-too-small", func(t *testing.T) {
+		t.Parallel()
+		_, err := DecompressLZO(compressed, 4096, 8192)
+		assert.ErrorIs(t, err, errLZOOutputOverrun)
+	})
+	t.Run("short-non-final-segment", func(t *testing.T) {
+		t.Parallel()
+		seg := []byte{17 + 5, 't', 'a', 'i', 'l', '\n', 0x11, 0x00, 0x00}
+		var body []byte
+		body = append(body, le32(len(seg))...)
+		body = append(body, seg...)
+		body = append(body, le32(len(seg))...)
+		body = append(body, seg...)
+		_, err := DecompressLZO(append(le32(lzoLen+len(body)), body...), 4096, 8192)
+		assert.EqualError(t, err, "lzo: segment at compressed offset 17: previous segment decompressed to 5 bytes, not a full sector (4096 bytes)")
+	})
+	t.Run("truncated", func(t *testing.T) {
+		t.Parallel()
+		_, err := DecompressLZO(compressed[:4000], 4096, 12288)
+		assert.EqualError(t, err, "lzo: header total length 5565 exceeds the compressed extent size 4000")
+
+		truncated := append(le32(4000), compressed[lzoLen:4000]...)
+		_, err = DecompressLZO(truncated, 4096, 12288)
+		assert.EqualError(t, err, "lzo: segment at compressed offset 2155: length 2323 overruns the compressed data")
+	})
+}
@@ -0,0 +1,51 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem
+
+import (
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+// A Balance item holds the parameters of an in-progress balance, so
+// that it can be resumed after a remount.
+//
+// Key:
+//
+//	key.objectid = BALANCE_OBJECTID
+//	key.offset   = 0
+type Balance struct { // trivial TEMPORARY_ITEM=248
+	Flags         uint64      `bin:"off=0x0,   siz=0x8"`
+	Data          BalanceArgs `bin:"off=0x8,   siz=0x88"`
+	Metadata      BalanceArgs `bin:"off=0x90,  siz=0x88"`
+	System        BalanceArgs `bin:"off=0x118, siz=0x88"`
+	Reserved      [4]uint64   `bin:"off=0x1a0, siz=0x20"`
+	binstruct.End `bin:"off=0x1c0"`
+}
+
+// BalanceArgs are the filters for one of the block group types in a
+// Balance.
+type BalanceArgs struct {
+	Profiles btrfsvol.BlockGroupFlags `bin:"off=0x0,  siz=0x8"`
+	// Usage is either a single percentage, or (if the
+	// BALANCE_ARGS_USAGE_RANGE flag is set) a min (low 32 bits)
+	// and max (high 32 bits).
+	Usage  uint64                   `bin:"off=0x8,  siz=0x8"`
+	DevID  btrfsvol.DeviceID        `bin:"off=0x10, siz=0x8"`
+	PStart btrfsvol.PhysicalAddr    `bin:"off=0x18, siz=0x8"`
+	PEnd   btrfsvol.PhysicalAddr    `bin:"off=0x20, siz=0x8"`
+	VStart btrfsvol.LogicalAddr     `bin:"off=0x28, siz=0x8"`
+	VEnd   btrfsvol.LogicalAddr     `bin:"off=0x30, siz=0x8"`
+	Target btrfsvol.BlockGroupFlags `bin:"off=0x38, siz=0x8"`
+	Flags  uint64                   `bin:"off=0x40, siz=0x8"`
+	// Limit is either a single count, or (if the
+	// BALANCE_ARGS_LIMIT_RANGE flag is set) a min (low 32 bits)
+	// and max (high 32 bits).
+	Limit         uint64    `bin:"off=0x48, siz=0x8"`
+	StripesMin    uint32    `bin:"off=0x50, siz=0x4"`
+	StripesMax    uint32    `bin:"off=0x54, siz=0x4"`
+	Reserved      [6]uint64 `bin:"off=0x58, siz=0x30"`
+	binstruct.End `bin:"off=0x88"`
+}
@@ -67,7 +67,7 @@ func (chunk Chunk) Mappings(key btrfsprim.Key) []btrfsvol.Mapping {
 	return ret
 }
 
-var chunkStripePool containers.SlicePool[ChunkStripe]
+var chunkStripePool = containers.SlicePool[ChunkStripe]{Name: "btrfsitem.chunkStripePool"}
 
 func (chunk *Chunk) Free() {
 	for i := range chunk.Stripes {
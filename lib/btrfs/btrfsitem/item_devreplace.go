@@ -0,0 +1,80 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem
+
+import (
+	"fmt"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+type DevReplaceState uint64
+
+const (
+	DevReplaceStateNeverStarted DevReplaceState = iota
+	DevReplaceStateStarted
+	DevReplaceStateFinished
+	DevReplaceStateCanceled
+	DevReplaceStateSuspended
+)
+
+var devReplaceStateNames = []string{
+	"NEVER_STARTED",
+	"STARTED",
+	"FINISHED",
+	"CANCELED",
+	"SUSPENDED",
+}
+
+func (s DevReplaceState) String() string {
+	if int(s) < len(devReplaceStateNames) {
+		return devReplaceStateNames[s]
+	}
+	return fmt.Sprintf("DevReplaceState(%d)", uint64(s))
+}
+
+type DevReplaceReadMode uint64
+
+const (
+	DevReplaceReadModeAlways DevReplaceReadMode = iota
+	DevReplaceReadModeAvoid
+)
+
+func (m DevReplaceReadMode) String() string {
+	switch m {
+	case DevReplaceReadModeAlways:
+		return "ALWAYS"
+	case DevReplaceReadModeAvoid:
+		return "AVOID"
+	default:
+		return fmt.Sprintf("DevReplaceReadMode(%d)", uint64(m))
+	}
+}
+
+// A DevReplace item goes in the DEV_TREE and records the state of a
+// `btrfs replace` operation, so that an interrupted replace can be
+// resumed (or can be seen to have been interrupted).
+//
+// Key:
+//
+//	key.objectid = 0
+//	key.offset   = 0
+type DevReplace struct { // trivial DEV_REPLACE=250
+	SrcDevID btrfsvol.DeviceID `bin:"off=0x0, siz=0x8"`
+	// The replace has copied everything below CursorLeft, and is
+	// working on [CursorLeft, CursorRight).
+	CursorLeft             btrfsvol.PhysicalAddr `bin:"off=0x8, siz=0x8"`
+	CursorRight            btrfsvol.PhysicalAddr `bin:"off=0x10, siz=0x8"`
+	ContReadingFromSrcMode DevReplaceReadMode    `bin:"off=0x18, siz=0x8"`
+
+	State       DevReplaceState `bin:"off=0x20, siz=0x8"`
+	TimeStarted uint64          `bin:"off=0x28, siz=0x8"` // seconds since the epoch
+	TimeStopped uint64          `bin:"off=0x30, siz=0x8"` // seconds since the epoch
+
+	NumWriteErrors             int64 `bin:"off=0x38, siz=0x8"`
+	NumUncorrectableReadErrors int64 `bin:"off=0x40, siz=0x8"`
+	binstruct.End              `bin:"off=0x48"`
+}
@@ -85,6 +85,26 @@ func (o DirEntry) MarshalBinary() ([]byte, error) {
 	return dat, nil
 }
 
+// UnmarshalDirEntries decodes an item body that contains one or more
+// DirEntries packed back-to-back.  This is how a DIR_ITEM or
+// XATTR_ITEM stores multiple names whose NameHash collides; since
+// UnmarshalItem only decodes a single DirEntry, it reports such items
+// as an *Error with left-over data, and this may be used on that
+// Error's .Dat to recover all of the entries.
+func UnmarshalDirEntries(dat []byte) ([]DirEntry, error) {
+	var ret []DirEntry
+	for len(dat) > 0 {
+		var entry DirEntry
+		n, err := binstruct.Unmarshal(dat, &entry)
+		if err != nil {
+			return ret, fmt.Errorf("entry %d: %w", len(ret), err)
+		}
+		ret = append(ret, entry)
+		dat = dat[n:]
+	}
+	return ret, nil
+}
+
 type FileType uint8
 
 const (
@@ -0,0 +1,51 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+)
+
+func TestUnmarshalDirEntries(t *testing.T) {
+	t.Parallel()
+	var dat []byte
+	for _, xattr := range []struct{ name, val string }{
+		{"security.selinux", "system_u:object_r:etc_t:s0\x00"},
+		{"user.bin", "\x00\x01\xff"},
+	} {
+		entry := btrfsitem.DirEntry{
+			Type: btrfsitem.FT_XATTR,
+			Name: []byte(xattr.name),
+			Data: []byte(xattr.val),
+		}
+		bs, err := entry.MarshalBinary()
+		require.NoError(t, err)
+		dat = append(dat, bs...)
+	}
+
+	// UnmarshalItem only decodes a single entry...
+	key := btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.XATTR_ITEM_KEY}
+	_, isErr := btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, dat).(*btrfsitem.Error)
+	assert.True(t, isErr)
+
+	// ... but UnmarshalDirEntries decodes them all.
+	entries, err := btrfsitem.UnmarshalDirEntries(dat)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "security.selinux", string(entries[0].Name))
+	assert.Equal(t, "system_u:object_r:etc_t:s0\x00", string(entries[0].Data))
+	assert.Equal(t, "user.bin", string(entries[1].Name))
+	assert.Equal(t, "\x00\x01\xff", string(entries[1].Data))
+
+	_, err = btrfsitem.UnmarshalDirEntries(dat[:len(dat)-1])
+	assert.Error(t, err)
+}
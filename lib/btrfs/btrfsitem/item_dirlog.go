@@ -0,0 +1,35 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem
+
+import (
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+)
+
+// A DirLog item only ever appears in a log tree; it records a range
+// of a directory's DIR_ITEM or DIR_INDEX keyspace that was modified
+// (and fsync()ed) since the last commit, so that log replay knows
+// which entries in that range to delete if they are not also present
+// in the log.  It does not describe any committed directory entries.
+//
+// The range is [key.offset, EndOffset], inclusive on both ends.  For
+// DIR_LOG_ITEM the range is of name hashes; for DIR_LOG_INDEX it is
+// of directory indexes.
+//
+// Key:
+//
+//	key.objectid = inode number of the directory
+//	key.offset   = first hash or index in the range
+type DirLog struct { // trivial DIR_LOG_ITEM=60 DIR_LOG_INDEX=72
+	EndOffset     uint64 `bin:"off=0, siz=8"`
+	binstruct.End `bin:"off=8"`
+}
+
+// Contains returns whether the given DIR_ITEM hash or DIR_INDEX
+// index falls within the logged range that begins at the item key's
+// offset.
+func (o DirLog) Contains(start, x uint64) bool {
+	return start <= x && x <= o.EndOffset
+}
@@ -0,0 +1,33 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+)
+
+func TestDirLog(t *testing.T) {
+	t.Parallel()
+	for _, typ := range []btrfsprim.ItemType{btrfsitem.DIR_LOG_ITEM_KEY, btrfsitem.DIR_LOG_INDEX_KEY} {
+		key := btrfsprim.Key{ObjectID: 256, ItemType: typ, Offset: 2}
+		dat := []byte{5, 0, 0, 0, 0, 0, 0, 0}
+		item := btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, dat)
+		dirLog, ok := item.(*btrfsitem.DirLog)
+		if !assert.True(t, ok, "%v: %T", typ, item) {
+			continue
+		}
+		assert.Equal(t, uint64(5), dirLog.EndOffset)
+		assert.False(t, dirLog.Contains(key.Offset, 1))
+		assert.True(t, dirLog.Contains(key.Offset, 2))
+		assert.True(t, dirLog.Contains(key.Offset, 5), "end is inclusive")
+		assert.False(t, dirLog.Contains(key.Offset, 6))
+	}
+}
@@ -35,7 +35,7 @@ type Extent struct { // complex EXTENT_ITEM=168
 	Refs []ExtentInlineRef
 }
 
-var extentInlineRefPool containers.SlicePool[ExtentInlineRef]
+var extentInlineRefPool = containers.SlicePool[ExtentInlineRef]{Name: "btrfsitem.extentInlineRefPool"}
 
 func (o *Extent) Free() {
 	for i := range o.Refs {
@@ -129,11 +129,25 @@ type ExtentFlags uint64
 const (
 	EXTENT_FLAG_DATA ExtentFlags = 1 << iota
 	EXTENT_FLAG_TREE_BLOCK
+	_
+	_
+	_
+	_
+	_
+	_
+	BLOCK_FLAG_FULL_BACKREF // tree blocks only; the block's children are referenced by SHARED_* refs
 )
 
 var extentFlagNames = []string{
 	"DATA",
 	"TREE_BLOCK",
+	"(1<<2)",
+	"(1<<3)",
+	"(1<<4)",
+	"(1<<5)",
+	"(1<<6)",
+	"(1<<7)",
+	"FULL_BACKREF",
 }
 
 func (f ExtentFlags) Has(req ExtentFlags) bool { return f&req == req }
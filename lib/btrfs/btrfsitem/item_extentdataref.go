@@ -5,6 +5,9 @@
 package btrfsitem
 
 import (
+	"encoding/binary"
+	"hash/crc32"
+
 	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
 )
@@ -14,7 +17,7 @@ import (
 // Key:
 //
 //	key.objectid = laddr of the extent being referenced
-//	key.offset   = crc32c([root,objectid,offset])
+//	key.offset   = ExtentDataRefHash(root, objectid, offset)
 type ExtentDataRef struct { // trivial EXTENT_DATA_REF=178
 	Root          btrfsprim.ObjID `bin:"off=0, siz=8"`  // subvolume tree ID that references this extent
 	ObjectID      btrfsprim.ObjID `bin:"off=8, siz=8"`  // inode number that references this extent within the .Root subvolume
@@ -22,3 +25,19 @@ type ExtentDataRef struct { // trivial EXTENT_DATA_REF=178
 	Count         int32           `bin:"off=24, siz=4"` // reference count
 	binstruct.End `bin:"off=28"`
 }
+
+// ExtentDataRefHash returns the key.offset of the EXTENT_DATA_REF item
+// for an ExtentDataRef with the given root, objectid, and offset.
+func ExtentDataRefHash(root, objectID btrfsprim.ObjID, offset int64) uint64 {
+	table := crc32.MakeTable(crc32.Castagnoli)
+	var buf [16]byte
+
+	binary.LittleEndian.PutUint64(buf[:8], uint64(root))
+	highCRC := ^crc32.Update(0, table, buf[:8])
+
+	binary.LittleEndian.PutUint64(buf[:8], uint64(objectID))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(offset))
+	lowCRC := ^crc32.Update(0, table, buf[:16])
+
+	return (uint64(highCRC) << 31) ^ uint64(lowCRC)
+}
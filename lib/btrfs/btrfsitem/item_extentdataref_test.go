@@ -0,0 +1,43 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func TestExtentDataRefHash(t *testing.T) {
+	t.Parallel()
+	// These were computed with hash_extent_data_ref() and the
+	// table-driven crc32c_le() from btrfs-progs (which are the
+	// same as the kernel's), compiled as C, rather than with Go's
+	// hash/crc32, so that they don't share any bugs with the
+	// implementation under test.
+	testcases := []struct {
+		Root     btrfsprim.ObjID
+		ObjectID btrfsprim.ObjID
+		Offset   int64
+		Hash     uint64
+	}{
+		{5, 257, 0, 1007496934145758698},
+		{5, 258, 0, 1007496934479754521},
+		{256, 257, 4096, 1002667597962309452},
+		{5, 257, -4096, 1007496931873591768},
+		{18446744073709551607, 1, 2, 8850092726326891173},
+		{258, 1000, 1048576, 4960237771857906549},
+		// A collision.
+		{5, 378893, 1007951872, 1007496935355535176},
+		{5, 523821, 1048444928, 1007496935355535176},
+	}
+	for _, tc := range testcases {
+		assert.Equal(t, tc.Hash, btrfsitem.ExtentDataRefHash(tc.Root, tc.ObjectID, tc.Offset),
+			"root=%v objectid=%v offset=%v", tc.Root, tc.ObjectID, tc.Offset)
+	}
+}
@@ -68,6 +68,28 @@ func (o FileExtent) Clone() FileExtent {
 	return o
 }
 
+// FileExtentInlineDataStart is the offset within a FileExtent item
+// at which the data of a FILE_EXTENT_INLINE begins.
+const FileExtentInlineDataStart = 0x15
+
+// MaxInlineExtentSize is an upper bound on both the size of the data
+// in a FILE_EXTENT_INLINE and its RAMBytes.  The real limit depends
+// on the filesystem's node size and sector size, but neither may be
+// larger than this.
+const MaxInlineExtentSize = 64 * 1024
+
+// An InlineExtentError is returned when decoding a FILE_EXTENT_INLINE
+// whose size is implausible.
+type InlineExtentError struct {
+	RAMBytes  int64
+	InlineLen int
+}
+
+func (e *InlineExtentError) Error() string {
+	return fmt.Sprintf("implausible inline extent: ram_bytes=%v inline_len=%v (max %v)",
+		e.RAMBytes, e.InlineLen, MaxInlineExtentSize)
+}
+
 func (o *FileExtent) UnmarshalBinary(dat []byte) (int, error) {
 	n, err := binstruct.UnmarshalWithoutInterface(dat, o)
 	if err != nil {
@@ -75,6 +97,12 @@ func (o *FileExtent) UnmarshalBinary(dat []byte) (int, error) {
 	}
 	switch o.Type {
 	case FILE_EXTENT_INLINE:
+		if o.RAMBytes < 0 || o.RAMBytes > MaxInlineExtentSize || len(dat)-n > MaxInlineExtentSize {
+			return n, &InlineExtentError{
+				RAMBytes:  o.RAMBytes,
+				InlineLen: len(dat) - n,
+			}
+		}
 		o.BodyInline = cloneBytes(dat[n:])
 		n += len(o.BodyInline)
 	case FILE_EXTENT_REG, FILE_EXTENT_PREALLOC:
@@ -126,6 +154,10 @@ var fileExtentTypeNames = []string{
 func (o FileExtent) Size() (int64, error) {
 	switch o.Type {
 	case FILE_EXTENT_INLINE:
+		if o.Compression != COMPRESS_NONE {
+			// The inline data is compressed.
+			return o.RAMBytes, nil
+		}
 		return int64(len(o.BodyInline)), nil
 	case FILE_EXTENT_REG, FILE_EXTENT_PREALLOC:
 		return o.BodyExtent.NumBytes, nil
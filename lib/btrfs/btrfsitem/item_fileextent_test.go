@@ -0,0 +1,64 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+)
+
+func TestFileExtentInlineBounds(t *testing.T) {
+	t.Parallel()
+	key := btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.EXTENT_DATA_KEY}
+
+	mk := func(ramBytes int64, data string) []byte {
+		dat := make([]byte, btrfsitem.FileExtentInlineDataStart)
+		binary.LittleEndian.PutUint64(dat[0x8:], uint64(ramBytes))
+		dat[0x14] = byte(btrfsitem.FILE_EXTENT_INLINE)
+		return append(dat, data...)
+	}
+
+	item := btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, mk(5, "hello"))
+	require.IsType(t, &btrfsitem.FileExtent{}, item)
+	assert.Equal(t, "hello", string(item.(*btrfsitem.FileExtent).BodyInline))
+
+	for _, ramBytes := range []int64{-1, btrfsitem.MaxInlineExtentSize + 1, 1 << 62} {
+		item := btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, mk(ramBytes, "hello"))
+		require.IsType(t, &btrfsitem.Error{}, item, "ram_bytes=%v", ramBytes)
+		var typed *btrfsitem.InlineExtentError
+		assert.True(t, errors.As(item.(*btrfsitem.Error).Err, &typed), "ram_bytes=%v", ramBytes)
+	}
+}
+
+func FuzzFileExtent(f *testing.F) {
+	key := btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.EXTENT_DATA_KEY}
+
+	f.Add(make([]byte, btrfsitem.FileExtentInlineDataStart))
+	f.Add(make([]byte, btrfsitem.FileExtentInlineDataStart+0x20))
+
+	f.Fuzz(func(t *testing.T, inDat []byte) {
+		item := btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, inDat)
+		switch item := item.(type) {
+		case *btrfsitem.FileExtent:
+			if item.Type == btrfsitem.FILE_EXTENT_INLINE {
+				require.LessOrEqual(t, item.RAMBytes, int64(btrfsitem.MaxInlineExtentSize))
+				require.GreaterOrEqual(t, item.RAMBytes, int64(0))
+				require.LessOrEqual(t, len(item.BodyInline), btrfsitem.MaxInlineExtentSize)
+			}
+		case *btrfsitem.Error:
+			// OK
+		default:
+			t.Fatalf("unexpected item type %T", item)
+		}
+	})
+}
@@ -26,7 +26,7 @@ type InodeRefs struct { // complex INODE_REF=12
 	Refs []InodeRef
 }
 
-var inodeRefPool containers.SlicePool[InodeRef]
+var inodeRefPool = containers.SlicePool[InodeRef]{Name: "btrfsitem.inodeRefPool"}
 
 func (o *InodeRefs) Free() {
 	for i := range o.Refs {
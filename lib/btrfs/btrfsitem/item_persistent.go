@@ -5,7 +5,10 @@
 package btrfsitem
 
 import (
-	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"encoding/binary"
+	"fmt"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
 )
 
 const (
@@ -17,7 +20,64 @@ const (
 	DEV_STAT_VALUES_MAX
 )
 
-type DevStats struct { // trivial PERSISTENT_ITEM=249
-	Values        [DEV_STAT_VALUES_MAX]int64 `bin:"off=0, siz=40"`
-	binstruct.End `bin:"off=40"`
+// A DevStats is a PERSISTENT_ITEM; the only persistent item that
+// Linux knows about is the per-device error counters.
+//
+// Key:
+//
+//	key.objectid = DEV_STATS_OBJECTID
+//	key.offset   = device ID
+//
+// The item is an array of int64 counters, indexed by DEV_STAT_*.  An
+// item written by an older kernel may have fewer than
+// DEV_STAT_VALUES_MAX counters, and an item written by a newer kernel
+// may have more; so always go through .Value() rather than indexing
+// .Values directly.
+type DevStats struct { // complex PERSISTENT_ITEM=249
+	Values []int64
+}
+
+var devStatsValuePool = containers.SlicePool[int64]{Name: "btrfsitem.devStatsValuePool"}
+
+// Value returns the counter at index `idx` (one of DEV_STAT_*), or 0
+// if the item is too short to have that counter (as Linux does).
+func (o DevStats) Value(idx int) int64 {
+	if idx < 0 || idx >= len(o.Values) {
+		return 0
+	}
+	return o.Values[idx]
+}
+
+func (o *DevStats) Free() {
+	devStatsValuePool.Put(o.Values)
+	*o = DevStats{}
+	devStatsPool.Put(o)
+}
+
+func (o DevStats) Clone() DevStats {
+	ret := o
+	ret.Values = devStatsValuePool.Get(len(o.Values))
+	copy(ret.Values, o.Values)
+	return ret
+}
+
+func (o *DevStats) UnmarshalBinary(dat []byte) (int, error) {
+	const valueSize = 8
+	if len(dat)%valueSize != 0 {
+		return 0, fmt.Errorf("size %v is not a multiple of %v", len(dat), valueSize)
+	}
+	o.Values = devStatsValuePool.Get(len(dat) / valueSize)
+	for i := range o.Values {
+		o.Values[i] = int64(binary.LittleEndian.Uint64(dat[i*valueSize:]))
+	}
+	return len(dat), nil
+}
+
+func (o DevStats) MarshalBinary() ([]byte, error) {
+	const valueSize = 8
+	dat := make([]byte, len(o.Values)*valueSize)
+	for i, val := range o.Values {
+		binary.LittleEndian.PutUint64(dat[i*valueSize:], uint64(val))
+	}
+	return dat, nil
 }
@@ -0,0 +1,89 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+)
+
+func TestDevStats(t *testing.T) {
+	t.Parallel()
+	values := func(vals ...uint64) []byte {
+		dat := make([]byte, 8*len(vals))
+		for i, val := range vals {
+			binary.LittleEndian.PutUint64(dat[i*8:], val)
+		}
+		return dat
+	}
+	type TestCase struct {
+		In      []byte
+		OK      bool
+		NumVals int
+		Read    int64 // .Value(DEV_STAT_READ_ERRS)
+		Gen     int64 // .Value(DEV_STAT_GENERATION_ERRS)
+	}
+	testcases := map[string]TestCase{
+		"normal":    {In: values(1, 2, 3, 4, 5), OK: true, NumVals: 5, Read: 2, Gen: 5},
+		"short":     {In: values(1, 2), OK: true, NumVals: 2, Read: 2, Gen: 0},
+		"long":      {In: values(1, 2, 3, 4, 5, 6), OK: true, NumVals: 6, Read: 2, Gen: 5},
+		"empty":     {In: nil, OK: true, NumVals: 0},
+		"malformed": {In: []byte{1, 2, 3}, OK: false},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			key := btrfsprim.Key{ObjectID: btrfsprim.DEV_STATS_OBJECTID, ItemType: btrfsitem.PERSISTENT_ITEM_KEY, Offset: 1}
+			item := btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, tc.In)
+			stats, ok := item.(*btrfsitem.DevStats)
+			if !tc.OK {
+				assert.False(t, ok, "%T", item)
+				return
+			}
+			require.True(t, ok, "%T", item)
+			assert.Len(t, stats.Values, tc.NumVals)
+			assert.Equal(t, tc.Read, stats.Value(btrfsitem.DEV_STAT_READ_ERRS))
+			assert.Equal(t, tc.Gen, stats.Value(btrfsitem.DEV_STAT_GENERATION_ERRS))
+			assert.Equal(t, int64(0), stats.Value(-1))
+			assert.Equal(t, int64(0), stats.Value(100))
+			dat, err := binstruct.Marshal(item)
+			assert.NoError(t, err)
+			assert.Equal(t, len(tc.In), len(dat))
+		})
+	}
+}
+
+func TestDevReplace(t *testing.T) {
+	t.Parallel()
+	in := btrfsitem.DevReplace{
+		SrcDevID:                   2,
+		CursorLeft:                 0x100000,
+		CursorRight:                0x200000,
+		ContReadingFromSrcMode:     btrfsitem.DevReplaceReadModeAvoid,
+		State:                      btrfsitem.DevReplaceStateSuspended,
+		TimeStarted:                1600000000,
+		NumUncorrectableReadErrors: 3,
+	}
+	dat, err := binstruct.Marshal(in)
+	require.NoError(t, err)
+	assert.Len(t, dat, 0x48)
+	key := btrfsprim.Key{ItemType: btrfsitem.DEV_REPLACE_KEY}
+	item := btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, dat)
+	out, ok := item.(*btrfsitem.DevReplace)
+	require.True(t, ok, "%T", item)
+	assert.Equal(t, in, *out)
+	assert.Equal(t, "SUSPENDED", out.State.String())
+	assert.Equal(t, "AVOID", out.ContReadingFromSrcMode.String())
+	assert.Equal(t, "DevReplaceState(9)", btrfsitem.DevReplaceState(9).String())
+}
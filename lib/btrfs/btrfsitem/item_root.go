@@ -27,6 +27,12 @@ import (
 // root.ParentUUID tree, *if* the node.Head.Generation is
 // less-than-or-equal-to the root's key.offset.  The "or-equal-to"
 // part of that might be surprising, which is why I called it out.
+//
+// Root items written by old kernels end after Level; the fields from
+// GenerationV2 onward are left zero when reading such an item.  Even
+// when present, those fields are only valid if GenerationV2 ==
+// Generation (an old kernel may have updated Generation without
+// updating them).
 type Root struct { // trivial ROOT_ITEM=132
 	Inode         Inode                `bin:"off=0x000, siz=0xa0"` // ???
 	Generation    btrfsprim.Generation `bin:"off=0x0a0, siz=0x08"`
@@ -40,20 +46,20 @@ type Root struct { // trivial ROOT_ITEM=132
 	DropProgress  btrfsprim.Key        `bin:"off=0x0dc, siz=0x11"`
 	DropLevel     uint8                `bin:"off=0x0ed, siz=0x01"`
 	Level         uint8                `bin:"off=0x0ee, siz=0x01"`
-	GenerationV2  btrfsprim.Generation `bin:"off=0x0ef, siz=0x08"`
-	UUID          btrfsprim.UUID       `bin:"off=0x0f7, siz=0x10"`
-	ParentUUID    btrfsprim.UUID       `bin:"off=0x107, siz=0x10"`
-	ReceivedUUID  btrfsprim.UUID       `bin:"off=0x117, siz=0x10"`
-	CTransID      int64                `bin:"off=0x127, siz=0x08"`
-	OTransID      int64                `bin:"off=0x12f, siz=0x08"`
-	STransID      int64                `bin:"off=0x137, siz=0x08"`
-	RTransID      int64                `bin:"off=0x13f, siz=0x08"`
-	CTime         btrfsprim.Time       `bin:"off=0x147, siz=0x0c"`
-	OTime         btrfsprim.Time       `bin:"off=0x153, siz=0x0c"`
-	STime         btrfsprim.Time       `bin:"off=0x15f, siz=0x0c"`
-	RTime         btrfsprim.Time       `bin:"off=0x16b, siz=0x0c"`
-	GlobalTreeID  btrfsprim.ObjID      `bin:"off=0x177, siz=0x08"` // ???
-	Reserved      [7]int64             `bin:"off=0x17f, siz=0x38"`
+	GenerationV2  btrfsprim.Generation `bin:"off=0x0ef, siz=0x08, opt"`
+	UUID          btrfsprim.UUID       `bin:"off=0x0f7, siz=0x10, opt"`
+	ParentUUID    btrfsprim.UUID       `bin:"off=0x107, siz=0x10, opt"`
+	ReceivedUUID  btrfsprim.UUID       `bin:"off=0x117, siz=0x10, opt"`
+	CTransID      int64                `bin:"off=0x127, siz=0x08, opt"`
+	OTransID      int64                `bin:"off=0x12f, siz=0x08, opt"`
+	STransID      int64                `bin:"off=0x137, siz=0x08, opt"`
+	RTransID      int64                `bin:"off=0x13f, siz=0x08, opt"`
+	CTime         btrfsprim.Time       `bin:"off=0x147, siz=0x0c, opt"`
+	OTime         btrfsprim.Time       `bin:"off=0x153, siz=0x0c, opt"`
+	STime         btrfsprim.Time       `bin:"off=0x15f, siz=0x0c, opt"`
+	RTime         btrfsprim.Time       `bin:"off=0x16b, siz=0x0c, opt"`
+	GlobalTreeID  btrfsprim.ObjID      `bin:"off=0x177, siz=0x08, opt"` // ???
+	Reserved      [7]int64             `bin:"off=0x17f, siz=0x38, opt"`
 	binstruct.End `bin:"off=0x1b7"`
 }
 
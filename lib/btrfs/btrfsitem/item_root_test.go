@@ -0,0 +1,58 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+)
+
+func TestRootVersions(t *testing.T) {
+	t.Parallel()
+	in := btrfsitem.Root{
+		Generation:   10,
+		RootDirID:    256,
+		ByteNr:       0x1000,
+		Refs:         1,
+		Level:        2,
+		GenerationV2: 10,
+		UUID:         btrfsprim.UUID{0xde, 0xad, 0xbe, 0xef},
+		CTransID:     7,
+	}
+	dat, err := binstruct.Marshal(in)
+	require.NoError(t, err)
+	require.Len(t, dat, 0x1b7)
+
+	key := btrfsprim.Key{ObjectID: 256, ItemType: btrfsitem.ROOT_ITEM_KEY}
+
+	// New (v2) layout: everything is populated.
+	item := btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, dat)
+	root, ok := item.(*btrfsitem.Root)
+	require.True(t, ok, "%T: %v", item, item)
+	assert.Equal(t, in, *root)
+
+	// Old layout: ends after Level.
+	item = btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, dat[:0xef])
+	root, ok = item.(*btrfsitem.Root)
+	require.True(t, ok, "%T: %v", item, item)
+	assert.Equal(t, btrfsprim.Generation(10), root.Generation)
+	assert.Equal(t, btrfsprim.ObjID(256), root.RootDirID)
+	assert.Equal(t, uint8(2), root.Level)
+	assert.Equal(t, btrfsprim.Generation(0), root.GenerationV2)
+	assert.Equal(t, btrfsprim.UUID{}, root.UUID)
+	assert.Equal(t, int64(0), root.CTransID)
+
+	// Truncated within the required fields.
+	item = btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, dat[:0xee])
+	_, ok = item.(*btrfsitem.Error)
+	assert.True(t, ok, "%T", item)
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// A StringItem is an arbitrary string of bytes; the kernel doesn't
+// write them, but debugging tools may.  The length of the string is
+// the size of the item; there is no length field.
+//
+// Key:
+//
+//	key.objectid = arbitrary
+//	key.offset   = arbitrary
+type StringItem struct { // complex STRING_ITEM=253
+	Data []byte
+}
+
+func (o *StringItem) Free() {
+	bytePool.Put(o.Data)
+	*o = StringItem{}
+	stringItemPool.Put(o)
+}
+
+func (o StringItem) Clone() StringItem {
+	o.Data = cloneBytes(o.Data)
+	return o
+}
+
+func (o *StringItem) UnmarshalBinary(dat []byte) (int, error) {
+	o.Data = cloneBytes(dat)
+	return len(dat), nil
+}
+
+func (o StringItem) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), o.Data...), nil
+}
+
+// String returns the data as a string if it is valid UTF-8 with no
+// control characters; otherwise it returns it as a quoted Go string
+// literal, so that it is safe to print to a terminal.
+func (o StringItem) String() string {
+	if utf8.Valid(o.Data) {
+		str := string(o.Data)
+		if strconv.CanBackquote(str) {
+			return str
+		}
+	}
+	return strconv.Quote(string(o.Data))
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsitem_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+)
+
+func TestStringItem(t *testing.T) {
+	t.Parallel()
+	type TestCase struct {
+		In  string
+		Out string
+	}
+	testcases := map[string]TestCase{
+		"empty":   {In: "", Out: ""},
+		"plain":   {In: "my-array", Out: "my-array"},
+		"unicode": {In: "données", Out: "données"},
+		"control": {In: "a\x1b[2Jb", Out: `"a\x1b[2Jb"`},
+		"newline": {In: "a\nb", Out: `"a\nb"`},
+		"invalid": {In: "a\xffb", Out: `"a\xffb"`},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			key := btrfsprim.Key{ObjectID: 1, ItemType: btrfsitem.STRING_ITEM_KEY}
+			item := btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, []byte(tc.In))
+			str, ok := item.(*btrfsitem.StringItem)
+			if !assert.True(t, ok, "%T", item) {
+				return
+			}
+			assert.Equal(t, tc.Out, str.String())
+			dat, err := binstruct.Marshal(item)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.In, string(dat))
+		})
+	}
+}
+
+func TestBalanceSize(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, 0x1c0, binstruct.StaticSize(btrfsitem.Balance{}))
+	assert.Equal(t, 0x88, binstruct.StaticSize(btrfsitem.BalanceArgs{}))
+}
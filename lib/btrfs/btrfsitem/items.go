@@ -27,25 +27,45 @@ type Item interface {
 	CloneItem() Item
 }
 
+// An Error is an item that could not be parsed.  Its .Dat is its own
+// copy of the raw item body (it does not alias the buffer that the
+// node was read in to, which is recycled once the node has been
+// parsed), and so it is safe to retain for as long as the Error
+// itself.
 type Error struct {
 	Dat []byte
 	Err error
 }
 
+// NewError returns an Error item for the raw item body `dat`, copying
+// `dat`.
+func NewError(dat []byte, err error) *Error {
+	ret, _ := errorPool.Get()
+	*ret = Error{
+		Dat: cloneBytes(dat),
+		Err: err,
+	}
+	return ret
+}
+
 var errorPool = &typedsync.Pool[*Error]{New: func() *Error { return new(Error) }}
 
 func (*Error) isItem() {}
 
 func (o *Error) Free() {
+	bytePool.Put(o.Dat)
 	*o = Error{}
 	errorPool.Put(o)
 }
 
-func (o Error) Clone() Error { return o }
+func (o Error) Clone() Error {
+	o.Dat = cloneBytes(o.Dat)
+	return o
+}
 
 func (o *Error) CloneItem() Item {
 	ret, _ := errorPool.Get()
-	*ret = *o
+	*ret = o.Clone()
 	return ret
 }
 
@@ -54,7 +74,7 @@ func (o Error) MarshalBinary() ([]byte, error) {
 }
 
 func (o *Error) UnmarshalBinary(dat []byte) (int, error) {
-	o.Dat = dat
+	o.Dat = cloneBytes(dat)
 	return len(dat), nil
 }
 
@@ -63,30 +83,24 @@ func (o *Error) UnmarshalBinary(dat []byte) (int, error) {
 //
 // If there is an error, rather than returning a separate error value,
 // return an Error item.
+//
+// The returned item never aliases `dat` (any bytes that it needs are
+// copied out), so `dat` may be reused once this returns; callers
+// such as btrfstree.ReadNode rely on this to recycle node buffers.
 func UnmarshalItem(key btrfsprim.Key, csumType btrfssum.CSumType, dat []byte) Item {
 	var gotyp reflect.Type
 	if key.ItemType == UNTYPED_KEY {
 		var ok bool
 		gotyp, ok = untypedObjID2gotype[key.ObjectID]
 		if !ok {
-			ret, _ := errorPool.Get()
-			*ret = Error{
-				Dat: dat,
-				Err: fmt.Errorf("btrfsitem.UnmarshalItem({ItemType:%v, ObjectID:%v}, dat): unknown object ID for untyped item",
-					key.ItemType, key.ObjectID),
-			}
-			return ret
+			return NewError(dat, fmt.Errorf("btrfsitem.UnmarshalItem({ItemType:%v, ObjectID:%v}, dat): unknown object ID for untyped item",
+				key.ItemType, key.ObjectID))
 		}
 	} else {
 		var ok bool
 		gotyp, ok = keytype2gotype[key.ItemType]
 		if !ok {
-			ret, _ := errorPool.Get()
-			*ret = Error{
-				Dat: dat,
-				Err: fmt.Errorf("btrfsitem.UnmarshalItem({ItemType:%v}, dat): unknown item type", key.ItemType),
-			}
-			return ret
+			return NewError(dat, fmt.Errorf("btrfsitem.UnmarshalItem({ItemType:%v}, dat): unknown item type", key.ItemType))
 		}
 	}
 	ptr, _ := gotype2pool[gotyp].Get()
@@ -97,27 +111,17 @@ func UnmarshalItem(key btrfsprim.Key, csumType btrfssum.CSumType, dat []byte) It
 	n, err := binstruct.Unmarshal(dat, ptr)
 	if err != nil {
 		ptr.Free()
-		ret, _ := errorPool.Get()
-		*ret = Error{
-			Dat: dat,
-			Err: fmt.Errorf("btrfsitem.UnmarshalItem({ItemType:%v}, dat): %w", key.ItemType, err),
-		}
-		return ret
+		return NewError(dat, fmt.Errorf("btrfsitem.UnmarshalItem({ItemType:%v}, dat): %w", key.ItemType, err))
 	}
 	if n < len(dat) {
 		ptr.Free()
-		ret, _ := errorPool.Get()
-		*ret = Error{
-			Dat: dat,
-			Err: fmt.Errorf("btrfsitem.UnmarshalItem({ItemType:%v}, dat): left over data: got %v bytes but only consumed %v",
-				key.ItemType, len(dat), n),
-		}
-		return ret
+		return NewError(dat, fmt.Errorf("btrfsitem.UnmarshalItem({ItemType:%v}, dat): left over data: got %v bytes but only consumed %v",
+			key.ItemType, len(dat), n))
 	}
 	return ptr
 }
 
-var bytePool containers.SlicePool[byte]
+var bytePool = containers.SlicePool[byte]{Name: "btrfsitem.bytePool"}
 
 func cloneBytes(in []byte) []byte {
 	out := bytePool.Get(len(in))
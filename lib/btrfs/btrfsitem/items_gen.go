@@ -15,8 +15,11 @@ const (
 	CHUNK_ITEM_KEY           = btrfsprim.CHUNK_ITEM_KEY
 	DEV_EXTENT_KEY           = btrfsprim.DEV_EXTENT_KEY
 	DEV_ITEM_KEY             = btrfsprim.DEV_ITEM_KEY
+	DEV_REPLACE_KEY          = btrfsprim.DEV_REPLACE_KEY
 	DIR_INDEX_KEY            = btrfsprim.DIR_INDEX_KEY
 	DIR_ITEM_KEY             = btrfsprim.DIR_ITEM_KEY
+	DIR_LOG_INDEX_KEY        = btrfsprim.DIR_LOG_INDEX_KEY
+	DIR_LOG_ITEM_KEY         = btrfsprim.DIR_LOG_ITEM_KEY
 	EXTENT_CSUM_KEY          = btrfsprim.EXTENT_CSUM_KEY
 	EXTENT_DATA_KEY          = btrfsprim.EXTENT_DATA_KEY
 	EXTENT_DATA_REF_KEY      = btrfsprim.EXTENT_DATA_REF_KEY
@@ -24,6 +27,7 @@ const (
 	FREE_SPACE_BITMAP_KEY    = btrfsprim.FREE_SPACE_BITMAP_KEY
 	FREE_SPACE_EXTENT_KEY    = btrfsprim.FREE_SPACE_EXTENT_KEY
 	FREE_SPACE_INFO_KEY      = btrfsprim.FREE_SPACE_INFO_KEY
+	INODE_EXTREF_KEY         = btrfsprim.INODE_EXTREF_KEY
 	INODE_ITEM_KEY           = btrfsprim.INODE_ITEM_KEY
 	INODE_REF_KEY            = btrfsprim.INODE_REF_KEY
 	METADATA_ITEM_KEY        = btrfsprim.METADATA_ITEM_KEY
@@ -38,6 +42,8 @@ const (
 	ROOT_REF_KEY             = btrfsprim.ROOT_REF_KEY
 	SHARED_BLOCK_REF_KEY     = btrfsprim.SHARED_BLOCK_REF_KEY
 	SHARED_DATA_REF_KEY      = btrfsprim.SHARED_DATA_REF_KEY
+	STRING_ITEM_KEY          = btrfsprim.STRING_ITEM_KEY
+	TEMPORARY_ITEM_KEY       = btrfsprim.TEMPORARY_ITEM_KEY
 	TREE_BLOCK_REF_KEY       = btrfsprim.TREE_BLOCK_REF_KEY
 	UNTYPED_KEY              = btrfsprim.UNTYPED_KEY
 	UUID_RECEIVED_SUBVOL_KEY = btrfsprim.UUID_RECEIVED_SUBVOL_KEY
@@ -46,12 +52,15 @@ const (
 )
 
 var (
+	balanceType         = reflect.TypeOf(Balance{})
 	blockGroupType      = reflect.TypeOf(BlockGroup{})
 	chunkType           = reflect.TypeOf(Chunk{})
 	devType             = reflect.TypeOf(Dev{})
 	devExtentType       = reflect.TypeOf(DevExtent{})
+	devReplaceType      = reflect.TypeOf(DevReplace{})
 	devStatsType        = reflect.TypeOf(DevStats{})
 	dirEntryType        = reflect.TypeOf(DirEntry{})
+	dirLogType          = reflect.TypeOf(DirLog{})
 	emptyType           = reflect.TypeOf(Empty{})
 	extentType          = reflect.TypeOf(Extent{})
 	extentCSumType      = reflect.TypeOf(ExtentCSum{})
@@ -61,6 +70,7 @@ var (
 	freeSpaceHeaderType = reflect.TypeOf(FreeSpaceHeader{})
 	freeSpaceInfoType   = reflect.TypeOf(FreeSpaceInfo{})
 	inodeType           = reflect.TypeOf(Inode{})
+	inodeExtRefsType    = reflect.TypeOf(InodeExtRefs{})
 	inodeRefsType       = reflect.TypeOf(InodeRefs{})
 	metadataType        = reflect.TypeOf(Metadata{})
 	qGroupInfoType      = reflect.TypeOf(QGroupInfo{})
@@ -69,6 +79,7 @@ var (
 	rootType            = reflect.TypeOf(Root{})
 	rootRefType         = reflect.TypeOf(RootRef{})
 	sharedDataRefType   = reflect.TypeOf(SharedDataRef{})
+	stringItemType      = reflect.TypeOf(StringItem{})
 	uuidMapType         = reflect.TypeOf(UUIDMap{})
 )
 
@@ -78,8 +89,11 @@ var keytype2gotype = map[Type]reflect.Type{
 	CHUNK_ITEM_KEY:           chunkType,
 	DEV_EXTENT_KEY:           devExtentType,
 	DEV_ITEM_KEY:             devType,
+	DEV_REPLACE_KEY:          devReplaceType,
 	DIR_INDEX_KEY:            dirEntryType,
 	DIR_ITEM_KEY:             dirEntryType,
+	DIR_LOG_INDEX_KEY:        dirLogType,
+	DIR_LOG_ITEM_KEY:         dirLogType,
 	EXTENT_CSUM_KEY:          extentCSumType,
 	EXTENT_DATA_KEY:          fileExtentType,
 	EXTENT_DATA_REF_KEY:      extentDataRefType,
@@ -87,6 +101,7 @@ var keytype2gotype = map[Type]reflect.Type{
 	FREE_SPACE_BITMAP_KEY:    freeSpaceBitmapType,
 	FREE_SPACE_EXTENT_KEY:    emptyType,
 	FREE_SPACE_INFO_KEY:      freeSpaceInfoType,
+	INODE_EXTREF_KEY:         inodeExtRefsType,
 	INODE_ITEM_KEY:           inodeType,
 	INODE_REF_KEY:            inodeRefsType,
 	METADATA_ITEM_KEY:        metadataType,
@@ -101,6 +116,8 @@ var keytype2gotype = map[Type]reflect.Type{
 	ROOT_REF_KEY:             rootRefType,
 	SHARED_BLOCK_REF_KEY:     emptyType,
 	SHARED_DATA_REF_KEY:      sharedDataRefType,
+	STRING_ITEM_KEY:          stringItemType,
+	TEMPORARY_ITEM_KEY:       balanceType,
 	TREE_BLOCK_REF_KEY:       emptyType,
 	UUID_RECEIVED_SUBVOL_KEY: uuidMapType,
 	UUID_SUBVOL_KEY:          uuidMapType,
@@ -114,12 +131,15 @@ var untypedObjID2gotype = map[btrfsprim.ObjID]reflect.Type{
 
 // Pools.
 var (
+	balancePool         = typedsync.Pool[Item]{New: func() Item { return new(Balance) }}
 	blockGroupPool      = typedsync.Pool[Item]{New: func() Item { return new(BlockGroup) }}
 	chunkPool           = typedsync.Pool[Item]{New: func() Item { return new(Chunk) }}
 	devPool             = typedsync.Pool[Item]{New: func() Item { return new(Dev) }}
 	devExtentPool       = typedsync.Pool[Item]{New: func() Item { return new(DevExtent) }}
+	devReplacePool      = typedsync.Pool[Item]{New: func() Item { return new(DevReplace) }}
 	devStatsPool        = typedsync.Pool[Item]{New: func() Item { return new(DevStats) }}
 	dirEntryPool        = typedsync.Pool[Item]{New: func() Item { return new(DirEntry) }}
+	dirLogPool          = typedsync.Pool[Item]{New: func() Item { return new(DirLog) }}
 	emptyPool           = typedsync.Pool[Item]{New: func() Item { return new(Empty) }}
 	extentPool          = typedsync.Pool[Item]{New: func() Item { return new(Extent) }}
 	extentCSumPool      = typedsync.Pool[Item]{New: func() Item { return new(ExtentCSum) }}
@@ -129,6 +149,7 @@ var (
 	freeSpaceHeaderPool = typedsync.Pool[Item]{New: func() Item { return new(FreeSpaceHeader) }}
 	freeSpaceInfoPool   = typedsync.Pool[Item]{New: func() Item { return new(FreeSpaceInfo) }}
 	inodePool           = typedsync.Pool[Item]{New: func() Item { return new(Inode) }}
+	inodeExtRefsPool    = typedsync.Pool[Item]{New: func() Item { return new(InodeExtRefs) }}
 	inodeRefsPool       = typedsync.Pool[Item]{New: func() Item { return new(InodeRefs) }}
 	metadataPool        = typedsync.Pool[Item]{New: func() Item { return new(Metadata) }}
 	qGroupInfoPool      = typedsync.Pool[Item]{New: func() Item { return new(QGroupInfo) }}
@@ -137,17 +158,21 @@ var (
 	rootPool            = typedsync.Pool[Item]{New: func() Item { return new(Root) }}
 	rootRefPool         = typedsync.Pool[Item]{New: func() Item { return new(RootRef) }}
 	sharedDataRefPool   = typedsync.Pool[Item]{New: func() Item { return new(SharedDataRef) }}
+	stringItemPool      = typedsync.Pool[Item]{New: func() Item { return new(StringItem) }}
 	uuidMapPool         = typedsync.Pool[Item]{New: func() Item { return new(UUIDMap) }}
 )
 
 // gotype2pool is used by UnmarshalItem.
 var gotype2pool = map[reflect.Type]*typedsync.Pool[Item]{
+	balanceType:         &balancePool,
 	blockGroupType:      &blockGroupPool,
 	chunkType:           &chunkPool,
 	devType:             &devPool,
 	devExtentType:       &devExtentPool,
+	devReplaceType:      &devReplacePool,
 	devStatsType:        &devStatsPool,
 	dirEntryType:        &dirEntryPool,
+	dirLogType:          &dirLogPool,
 	emptyType:           &emptyPool,
 	extentType:          &extentPool,
 	extentCSumType:      &extentCSumPool,
@@ -157,6 +182,7 @@ var gotype2pool = map[reflect.Type]*typedsync.Pool[Item]{
 	freeSpaceHeaderType: &freeSpaceHeaderPool,
 	freeSpaceInfoType:   &freeSpaceInfoPool,
 	inodeType:           &inodePool,
+	inodeExtRefsType:    &inodeExtRefsPool,
 	inodeRefsType:       &inodeRefsPool,
 	metadataType:        &metadataPool,
 	qGroupInfoType:      &qGroupInfoPool,
@@ -165,16 +191,20 @@ var gotype2pool = map[reflect.Type]*typedsync.Pool[Item]{
 	rootType:            &rootPool,
 	rootRefType:         &rootRefPool,
 	sharedDataRefType:   &sharedDataRefPool,
+	stringItemType:      &stringItemPool,
 	uuidMapType:         &uuidMapPool,
 }
 
 // isItem implements Item.
+func (*Balance) isItem()         {}
 func (*BlockGroup) isItem()      {}
 func (*Chunk) isItem()           {}
 func (*Dev) isItem()             {}
 func (*DevExtent) isItem()       {}
+func (*DevReplace) isItem()      {}
 func (*DevStats) isItem()        {}
 func (*DirEntry) isItem()        {}
+func (*DirLog) isItem()          {}
 func (*Empty) isItem()           {}
 func (*Extent) isItem()          {}
 func (*ExtentCSum) isItem()      {}
@@ -184,6 +214,7 @@ func (*FreeSpaceBitmap) isItem() {}
 func (*FreeSpaceHeader) isItem() {}
 func (*FreeSpaceInfo) isItem()   {}
 func (*Inode) isItem()           {}
+func (*InodeExtRefs) isItem()    {}
 func (*InodeRefs) isItem()       {}
 func (*Metadata) isItem()        {}
 func (*QGroupInfo) isItem()      {}
@@ -192,13 +223,16 @@ func (*QGroupStatus) isItem()    {}
 func (*Root) isItem()            {}
 func (*RootRef) isItem()         {}
 func (*SharedDataRef) isItem()   {}
+func (*StringItem) isItem()      {}
 func (*UUIDMap) isItem()         {}
 
 // Free implements Item.
+func (o *Balance) Free()         { *o = Balance{}; balancePool.Put(o) }
 func (o *BlockGroup) Free()      { *o = BlockGroup{}; blockGroupPool.Put(o) }
 func (o *Dev) Free()             { *o = Dev{}; devPool.Put(o) }
 func (o *DevExtent) Free()       { *o = DevExtent{}; devExtentPool.Put(o) }
-func (o *DevStats) Free()        { *o = DevStats{}; devStatsPool.Put(o) }
+func (o *DevReplace) Free()      { *o = DevReplace{}; devReplacePool.Put(o) }
+func (o *DirLog) Free()          { *o = DirLog{}; dirLogPool.Put(o) }
 func (o *Empty) Free()           { *o = Empty{}; emptyPool.Put(o) }
 func (o *ExtentCSum) Free()      { *o = ExtentCSum{}; extentCSumPool.Put(o) }
 func (o *ExtentDataRef) Free()   { *o = ExtentDataRef{}; extentDataRefPool.Put(o) }
@@ -213,10 +247,12 @@ func (o *SharedDataRef) Free()   { *o = SharedDataRef{}; sharedDataRefPool.Put(o
 func (o *UUIDMap) Free()         { *o = UUIDMap{}; uuidMapPool.Put(o) }
 
 // Clone is a handy method.
+func (o Balance) Clone() Balance                 { return o }
 func (o BlockGroup) Clone() BlockGroup           { return o }
 func (o Dev) Clone() Dev                         { return o }
 func (o DevExtent) Clone() DevExtent             { return o }
-func (o DevStats) Clone() DevStats               { return o }
+func (o DevReplace) Clone() DevReplace           { return o }
+func (o DirLog) Clone() DirLog                   { return o }
 func (o Empty) Clone() Empty                     { return o }
 func (o ExtentCSum) Clone() ExtentCSum           { return o }
 func (o ExtentDataRef) Clone() ExtentDataRef     { return o }
@@ -231,6 +267,11 @@ func (o SharedDataRef) Clone() SharedDataRef     { return o }
 func (o UUIDMap) Clone() UUIDMap                 { return o }
 
 // CloneItem implements Item.
+func (o *Balance) CloneItem() Item {
+	ret, _ := balancePool.Get()
+	*(ret.(*Balance)) = o.Clone()
+	return ret
+}
 func (o *BlockGroup) CloneItem() Item {
 	ret, _ := blockGroupPool.Get()
 	*(ret.(*BlockGroup)) = o.Clone()
@@ -243,6 +284,11 @@ func (o *DevExtent) CloneItem() Item {
 	*(ret.(*DevExtent)) = o.Clone()
 	return ret
 }
+func (o *DevReplace) CloneItem() Item {
+	ret, _ := devReplacePool.Get()
+	*(ret.(*DevReplace)) = o.Clone()
+	return ret
+}
 func (o *DevStats) CloneItem() Item {
 	ret, _ := devStatsPool.Get()
 	*(ret.(*DevStats)) = o.Clone()
@@ -253,6 +299,11 @@ func (o *DirEntry) CloneItem() Item {
 	*(ret.(*DirEntry)) = o.Clone()
 	return ret
 }
+func (o *DirLog) CloneItem() Item {
+	ret, _ := dirLogPool.Get()
+	*(ret.(*DirLog)) = o.Clone()
+	return ret
+}
 func (o *Empty) CloneItem() Item { ret, _ := emptyPool.Get(); *(ret.(*Empty)) = o.Clone(); return ret }
 func (o *Extent) CloneItem() Item {
 	ret, _ := extentPool.Get()
@@ -290,6 +341,11 @@ func (o *FreeSpaceInfo) CloneItem() Item {
 	return ret
 }
 func (o *Inode) CloneItem() Item { ret, _ := inodePool.Get(); *(ret.(*Inode)) = o.Clone(); return ret }
+func (o *InodeExtRefs) CloneItem() Item {
+	ret, _ := inodeExtRefsPool.Get()
+	*(ret.(*InodeExtRefs)) = o.Clone()
+	return ret
+}
 func (o *InodeRefs) CloneItem() Item {
 	ret, _ := inodeRefsPool.Get()
 	*(ret.(*InodeRefs)) = o.Clone()
@@ -326,6 +382,11 @@ func (o *SharedDataRef) CloneItem() Item {
 	*(ret.(*SharedDataRef)) = o.Clone()
 	return ret
 }
+func (o *StringItem) CloneItem() Item {
+	ret, _ := stringItemPool.Get()
+	*(ret.(*StringItem)) = o.Clone()
+	return ret
+}
 func (o *UUIDMap) CloneItem() Item {
 	ret, _ := uuidMapPool.Get()
 	*(ret.(*UUIDMap)) = o.Clone()
@@ -334,12 +395,15 @@ func (o *UUIDMap) CloneItem() Item {
 
 // Item type assertions.
 var (
+	_ Item = (*Balance)(nil)
 	_ Item = (*BlockGroup)(nil)
 	_ Item = (*Chunk)(nil)
 	_ Item = (*Dev)(nil)
 	_ Item = (*DevExtent)(nil)
+	_ Item = (*DevReplace)(nil)
 	_ Item = (*DevStats)(nil)
 	_ Item = (*DirEntry)(nil)
+	_ Item = (*DirLog)(nil)
 	_ Item = (*Empty)(nil)
 	_ Item = (*Extent)(nil)
 	_ Item = (*ExtentCSum)(nil)
@@ -349,6 +413,7 @@ var (
 	_ Item = (*FreeSpaceHeader)(nil)
 	_ Item = (*FreeSpaceInfo)(nil)
 	_ Item = (*Inode)(nil)
+	_ Item = (*InodeExtRefs)(nil)
 	_ Item = (*InodeRefs)(nil)
 	_ Item = (*Metadata)(nil)
 	_ Item = (*QGroupInfo)(nil)
@@ -357,17 +422,21 @@ var (
 	_ Item = (*Root)(nil)
 	_ Item = (*RootRef)(nil)
 	_ Item = (*SharedDataRef)(nil)
+	_ Item = (*StringItem)(nil)
 	_ Item = (*UUIDMap)(nil)
 )
 
 // Clone type assertions.
 var (
+	_ interface{ Clone() Balance }         = Balance{}
 	_ interface{ Clone() BlockGroup }      = BlockGroup{}
 	_ interface{ Clone() Chunk }           = Chunk{}
 	_ interface{ Clone() Dev }             = Dev{}
 	_ interface{ Clone() DevExtent }       = DevExtent{}
+	_ interface{ Clone() DevReplace }      = DevReplace{}
 	_ interface{ Clone() DevStats }        = DevStats{}
 	_ interface{ Clone() DirEntry }        = DirEntry{}
+	_ interface{ Clone() DirLog }          = DirLog{}
 	_ interface{ Clone() Empty }           = Empty{}
 	_ interface{ Clone() Extent }          = Extent{}
 	_ interface{ Clone() ExtentCSum }      = ExtentCSum{}
@@ -377,6 +446,7 @@ var (
 	_ interface{ Clone() FreeSpaceHeader } = FreeSpaceHeader{}
 	_ interface{ Clone() FreeSpaceInfo }   = FreeSpaceInfo{}
 	_ interface{ Clone() Inode }           = Inode{}
+	_ interface{ Clone() InodeExtRefs }    = InodeExtRefs{}
 	_ interface{ Clone() InodeRefs }       = InodeRefs{}
 	_ interface{ Clone() Metadata }        = Metadata{}
 	_ interface{ Clone() QGroupInfo }      = QGroupInfo{}
@@ -385,5 +455,6 @@ var (
 	_ interface{ Clone() Root }            = Root{}
 	_ interface{ Clone() RootRef }         = RootRef{}
 	_ interface{ Clone() SharedDataRef }   = SharedDataRef{}
+	_ interface{ Clone() StringItem }      = StringItem{}
 	_ interface{ Clone() UUIDMap }         = UUIDMap{}
 )
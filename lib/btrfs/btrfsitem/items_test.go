@@ -1,10 +1,11 @@
-// Copyright (C) 2022  Luke Shumaker <lukeshu@lukeshu.com>
+// Copyright (C) 2022-2023  Luke Shumaker <lukeshu@lukeshu.com>
 //
 // SPDX-License-Identifier: GPL-2.0-or-later
 
 package btrfsitem_test
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -63,3 +64,64 @@ func FuzzRoundTrip(f *testing.F) {
 		require.Equal(t, string(itemInDat), string(itemOutDat), "binstruct.Marshal(item)")
 	})
 }
+
+// FuzzRetainItem checks that an item never aliases the buffer that it
+// was unmarshaled from (which btrfstree.ReadNode recycles as soon as
+// the node is parsed), and that a clone of an item stays intact after
+// the original is freed and the pooled memory that it returns is
+// re-used.
+func FuzzRetainItem(f *testing.F) {
+	keySize := binstruct.StaticSize(btrfsprim.Key{})
+
+	addSeed := func(key btrfsprim.Key, body any) {
+		keyDat, err := binstruct.Marshal(key)
+		require.NoError(f, err)
+		bodyDat, ok := body.([]byte)
+		if !ok {
+			bodyDat, err = binstruct.Marshal(body)
+			require.NoError(f, err)
+		}
+		f.Add(append(keyDat, bodyDat...))
+	}
+	addSeed(btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.DIR_ITEM_KEY},
+		btrfsitem.DirEntry{Type: btrfsitem.FT_REG_FILE, Name: []byte("file")})
+	addSeed(btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.XATTR_ITEM_KEY},
+		btrfsitem.DirEntry{Type: btrfsitem.FT_XATTR, Name: []byte("user.x"), Data: []byte("value")})
+	addSeed(btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.INODE_REF_KEY, Offset: 256},
+		btrfsitem.InodeRef{Index: 2, Name: []byte("file")})
+	addSeed(btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.EXTENT_DATA_KEY},
+		btrfsitem.FileExtent{Type: btrfsitem.FILE_EXTENT_INLINE, RAMBytes: 5, BodyInline: []byte("hello")})
+	addSeed(btrfsprim.Key{ObjectID: 257, ItemType: 2}, // unknown item type
+		[]byte("raw bytes"))
+
+	f.Fuzz(func(t *testing.T, inDat []byte) {
+		if len(inDat) < keySize {
+			t.Skip()
+		}
+		var key btrfsprim.Key
+		_, err := binstruct.Unmarshal(inDat[:keySize], &key)
+		require.NoError(t, err)
+		dat := bytes.Clone(inDat[keySize:])
+
+		item := btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, dat)
+		exp, _ := binstruct.Marshal(item)
+		exp = bytes.Clone(exp) // Error.MarshalBinary returns its own .Dat
+
+		// Overwrite the buffer, as recycling it would.
+		for i := range dat {
+			dat[i] = 0xAA
+		}
+		got, _ := binstruct.Marshal(item)
+		require.Equal(t, exp, got, "item aliases the buffer it was unmarshaled from")
+
+		// Free the original, and churn the pools.
+		clone := item.CloneItem()
+		item.Free()
+		for i := 0; i < 4; i++ {
+			btrfsitem.UnmarshalItem(key, btrfssum.TYPE_CRC32, dat).Free()
+		}
+		got, _ = binstruct.Marshal(clone)
+		require.Equal(t, exp, got, "clone shares memory with the freed original")
+		clone.Free()
+	})
+}
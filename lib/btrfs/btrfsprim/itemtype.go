@@ -14,8 +14,11 @@ const (
 	CHUNK_ITEM_KEY           ItemType = 228
 	DEV_EXTENT_KEY           ItemType = 204
 	DEV_ITEM_KEY             ItemType = 216
+	DEV_REPLACE_KEY          ItemType = 250
 	DIR_INDEX_KEY            ItemType = 96
 	DIR_ITEM_KEY             ItemType = 84
+	DIR_LOG_INDEX_KEY        ItemType = 72
+	DIR_LOG_ITEM_KEY         ItemType = 60
 	EXTENT_CSUM_KEY          ItemType = 128
 	EXTENT_DATA_KEY          ItemType = 108
 	EXTENT_DATA_REF_KEY      ItemType = 178
@@ -23,6 +26,7 @@ const (
 	FREE_SPACE_BITMAP_KEY    ItemType = 200
 	FREE_SPACE_EXTENT_KEY    ItemType = 199
 	FREE_SPACE_INFO_KEY      ItemType = 198
+	INODE_EXTREF_KEY         ItemType = 13
 	INODE_ITEM_KEY           ItemType = 1
 	INODE_REF_KEY            ItemType = 12
 	METADATA_ITEM_KEY        ItemType = 169
@@ -37,6 +41,8 @@ const (
 	ROOT_REF_KEY             ItemType = 156
 	SHARED_BLOCK_REF_KEY     ItemType = 182
 	SHARED_DATA_REF_KEY      ItemType = 184
+	STRING_ITEM_KEY          ItemType = 253
+	TEMPORARY_ITEM_KEY       ItemType = 248
 	TREE_BLOCK_REF_KEY       ItemType = 176
 	UNTYPED_KEY              ItemType = 0
 	UUID_RECEIVED_SUBVOL_KEY ItemType = 252
@@ -56,10 +62,16 @@ func (t ItemType) String() string {
 		return "DEV_EXTENT"
 	case DEV_ITEM_KEY:
 		return "DEV_ITEM"
+	case DEV_REPLACE_KEY:
+		return "DEV_REPLACE"
 	case DIR_INDEX_KEY:
 		return "DIR_INDEX"
 	case DIR_ITEM_KEY:
 		return "DIR_ITEM"
+	case DIR_LOG_INDEX_KEY:
+		return "DIR_LOG_INDEX"
+	case DIR_LOG_ITEM_KEY:
+		return "DIR_LOG_ITEM"
 	case EXTENT_CSUM_KEY:
 		return "EXTENT_CSUM"
 	case EXTENT_DATA_KEY:
@@ -74,6 +86,8 @@ func (t ItemType) String() string {
 		return "FREE_SPACE_EXTENT"
 	case FREE_SPACE_INFO_KEY:
 		return "FREE_SPACE_INFO"
+	case INODE_EXTREF_KEY:
+		return "INODE_EXTREF"
 	case INODE_ITEM_KEY:
 		return "INODE_ITEM"
 	case INODE_REF_KEY:
@@ -102,6 +116,10 @@ func (t ItemType) String() string {
 		return "SHARED_BLOCK_REF"
 	case SHARED_DATA_REF_KEY:
 		return "SHARED_DATA_REF"
+	case STRING_ITEM_KEY:
+		return "STRING_ITEM"
+	case TEMPORARY_ITEM_KEY:
+		return "TEMPORARY_ITEM"
 	case TREE_BLOCK_REF_KEY:
 		return "TREE_BLOCK_REF"
 	case UNTYPED_KEY:
@@ -0,0 +1,46 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsprim
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseItemType is the inverse of ItemType.String: it accepts either
+// a number (in any base accepted by strconv.ParseUint with base=0),
+// or a name as returned by .String(), such as "INODE_ITEM".  Names
+// are case-insensitive, and may have a "_KEY" suffix.
+func ParseItemType(str string) (ItemType, error) {
+	if str == "" {
+		return 0, fmt.Errorf("missing item type")
+	}
+	if v, err := strconv.ParseUint(str, 0, 8); err == nil {
+		return ItemType(v), nil
+	}
+	name := strings.TrimSuffix(strings.ToUpper(str), "_KEY")
+	for i := 0; i <= math.MaxUint8; i++ {
+		typ := ItemType(i)
+		if typ.String() == name {
+			return typ, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown item type %q", str)
+}
+
+// Type implements pflag.Value.
+func (*ItemType) Type() string { return "itemtype" }
+
+// Set implements pflag.Value; see ParseItemType for the syntax.
+func (t *ItemType) Set(str string) error {
+	v, err := ParseItemType(str)
+	if err != nil {
+		return err
+	}
+	*t = v
+	return nil
+}
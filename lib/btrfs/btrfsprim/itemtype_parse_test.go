@@ -0,0 +1,46 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsprim_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func TestParseItemType(t *testing.T) {
+	t.Parallel()
+	type TestCase struct {
+		Input  string
+		Output btrfsprim.ItemType
+		Err    string
+	}
+	testcases := map[string]TestCase{
+		"decimal": {Input: "84", Output: btrfsprim.DIR_ITEM_KEY},
+		"hex":     {Input: "0x54", Output: btrfsprim.DIR_ITEM_KEY},
+		"name":    {Input: "INODE_ITEM", Output: btrfsprim.INODE_ITEM_KEY},
+		"lower":   {Input: "extent_data", Output: btrfsprim.EXTENT_DATA_KEY},
+		"suffix":  {Input: "ROOT_REF_KEY", Output: btrfsprim.ROOT_REF_KEY},
+		"empty":   {Input: "", Err: `missing item type`},
+		"unknown": {Input: "FOO_ITEM", Err: `unknown item type "FOO_ITEM"`},
+		"range":   {Input: "256", Err: `unknown item type "256"`},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			var act btrfsprim.ItemType
+			err := act.Set(tc.Input)
+			if tc.Err != "" {
+				assert.EqualError(t, err, tc.Err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Output, act)
+		})
+	}
+}
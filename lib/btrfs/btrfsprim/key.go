@@ -26,6 +26,25 @@ const MaxOffset uint64 = math.MaxUint64
 //
 // The formatting of the key mimics print-tree.c:btrfs_print_key().
 func (key Key) Format(tree ObjID) string {
+	// Like btrfs_print_key(), qgroup keys are formatted according
+	// to their item type, regardless of which tree they appear in.
+	switch key.ItemType {
+	case QGROUP_RELATION_KEY:
+		return fmt.Sprintf("(%v %v %v)",
+			fmtQGroupID(uint64(key.ObjectID)),
+			key.ItemType,
+			fmtQGroupID(key.Offset))
+	case QGROUP_INFO_KEY, QGROUP_LIMIT_KEY:
+		return fmt.Sprintf("(%v %v %v)",
+			key.ObjectID.Format(0),
+			key.ItemType,
+			fmtQGroupID(key.Offset))
+	case QGROUP_STATUS_KEY:
+		return fmt.Sprintf("(%v %v %v)",
+			key.ObjectID.Format(0),
+			key.ItemType,
+			key.Offset)
+	}
 	switch tree {
 	case UUID_TREE_OBJECTID:
 		return fmt.Sprintf("(%v %v %#08x)",
@@ -101,3 +120,51 @@ func (a Key) Compare(b Key) int {
 }
 
 var _ containers.Ordered[Key] = Key{}
+
+// The Compare* functions return comparators for binary-searching
+// through keys with the .Search() and .Subrange() methods of
+// containers.RBTree and containers.SortedMap.  Following the
+// convention of those methods, a comparator returns 0 for a key that
+// matches, <0 for a key that is after the matching keys ("go left"),
+// and >0 for a key that is before the matching keys ("go right").
+
+// CompareExact returns a comparator that matches only the key `tgt`.
+func CompareExact(tgt Key) func(Key) int {
+	return func(key Key) int {
+		return tgt.Compare(key)
+	}
+}
+
+// CompareObjIDType returns a comparator that matches keys with the
+// given ObjectID and ItemType, with any Offset.
+func CompareObjIDType(objID ObjID, typ ItemType) func(Key) int {
+	return func(key Key) int {
+		if d := containers.NativeCompare(objID, key.ObjectID); d != 0 {
+			return d
+		}
+		return containers.NativeCompare(typ, key.ItemType)
+	}
+}
+
+// CompareObjID returns a comparator that matches keys with the given
+// ObjectID, with any ItemType and Offset.
+func CompareObjID(objID ObjID) func(Key) int {
+	return func(key Key) int {
+		return containers.NativeCompare(objID, key.ObjectID)
+	}
+}
+
+// CompareRange returns a comparator that matches keys in the
+// inclusive range [min, max].
+func CompareRange(min, max Key) func(Key) int {
+	return func(key Key) int {
+		switch {
+		case min.Compare(key) > 0:
+			return 1
+		case max.Compare(key) < 0:
+			return -1
+		default:
+			return 0
+		}
+	}
+}
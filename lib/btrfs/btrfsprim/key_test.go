@@ -8,6 +8,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
 )
 
 func k(objID ObjID, typ ItemType, offset uint64) Key {
@@ -57,3 +59,91 @@ func TestKey(t *testing.T) {
 	mmEq(t, k(18446744073709551615, 0, 0), k(18446744073709551614, 255, 18446744073709551615))
 	mmEq(t, k(0, 0, 0), k(0, 0, 0))
 }
+
+func TestKeyFormatQGroup(t *testing.T) {
+	t.Parallel()
+	// Expected strings are from `btrfs inspect-internal dump-tree`
+	// of a filesystem with quotas enabled.
+	const level1 = 1 << 48
+	for _, tree := range []ObjID{QUOTA_TREE_OBJECTID, 0} {
+		assert.Equal(t, "(0 QGROUP_STATUS 0)", k(0, QGROUP_STATUS_KEY, 0).Format(tree))
+		assert.Equal(t, "(0 QGROUP_INFO 0/5)", k(0, QGROUP_INFO_KEY, 5).Format(tree))
+		assert.Equal(t, "(0 QGROUP_INFO 1/100)", k(0, QGROUP_INFO_KEY, level1|100).Format(tree))
+		assert.Equal(t, "(0 QGROUP_LIMIT 0/256)", k(0, QGROUP_LIMIT_KEY, 256).Format(tree))
+		assert.Equal(t, "(0/5 QGROUP_RELATION 1/100)", k(5, QGROUP_RELATION_KEY, level1|100).Format(tree))
+		assert.Equal(t, "(1/100 QGROUP_RELATION 0/5)", k(level1|100, QGROUP_RELATION_KEY, 5).Format(tree))
+	}
+}
+
+func TestKeyComparators(t *testing.T) {
+	t.Parallel()
+	keys := []Key{
+		k(255, INODE_ITEM_KEY, 0),
+		k(256, INODE_ITEM_KEY, 0),
+		k(256, INODE_REF_KEY, 256),
+		k(256, EXTENT_DATA_KEY, 0),
+		k(256, EXTENT_DATA_KEY, 4096),
+		k(256, EXTENT_DATA_KEY, 8192),
+		k(257, INODE_ITEM_KEY, 0),
+	}
+	type testcase struct {
+		Cmp     func(Key) int
+		ExpSign []int // for each of `keys`
+	}
+	testcases := map[string]testcase{
+		"exact": {
+			Cmp:     CompareExact(k(256, EXTENT_DATA_KEY, 4096)),
+			ExpSign: []int{1, 1, 1, 1, 0, -1, -1},
+		},
+		"exact-missing": {
+			Cmp:     CompareExact(k(256, EXTENT_DATA_KEY, 100)),
+			ExpSign: []int{1, 1, 1, 1, -1, -1, -1},
+		},
+		"objid-type": {
+			Cmp:     CompareObjIDType(256, EXTENT_DATA_KEY),
+			ExpSign: []int{1, 1, 1, 0, 0, 0, -1},
+		},
+		"objid": {
+			Cmp:     CompareObjID(256),
+			ExpSign: []int{1, 0, 0, 0, 0, 0, -1},
+		},
+		"range": {
+			Cmp:     CompareRange(k(256, EXTENT_DATA_KEY, 1), k(256, EXTENT_DATA_KEY, 8191)),
+			ExpSign: []int{1, 1, 1, 1, 0, -1, -1},
+		},
+	}
+	sign := func(x int) int {
+		switch {
+		case x < 0:
+			return -1
+		case x > 0:
+			return 1
+		default:
+			return 0
+		}
+	}
+	var m containers.SortedMap[Key, struct{}]
+	for _, key := range keys {
+		m.Store(key, struct{}{})
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			var expMatches, actMatches []Key
+			for i, key := range keys {
+				assert.Equal(t, tc.ExpSign[i], sign(tc.Cmp(key)), "key %v", key)
+				if tc.ExpSign[i] == 0 {
+					expMatches = append(expMatches, key)
+				}
+			}
+			m.Subrange(
+				func(key Key, _ struct{}) int { return tc.Cmp(key) },
+				func(key Key, _ struct{}) bool {
+					actMatches = append(actMatches, key)
+					return true
+				})
+			assert.Equal(t, expMatches, actMatches)
+		})
+	}
+}
@@ -7,6 +7,8 @@
 package btrfsprim
 
 import (
+	"math"
+	"strings"
 	"time"
 
 	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
@@ -14,12 +16,159 @@ import (
 
 type Generation uint64
 
+// MaxGeneration is the largest Generation.
+const MaxGeneration = Generation(math.MaxUint64)
+
+// Known returns whether the generation is known.  btrfs never writes
+// generation 0 (the first transaction is generation 1), so a zero
+// Generation means that it is unknown (or corrupt).
+func (gen Generation) Known() bool {
+	return gen != 0
+}
+
+// AddClamped returns gen+n, or MaxGeneration if that would overflow.
+func (gen Generation) AddClamped(n Generation) Generation {
+	if gen > MaxGeneration-n {
+		return MaxGeneration
+	}
+	return gen + n
+}
+
+// SubClamped returns gen-n, or 0 if that would underflow.  It may be
+// used both to step back n generations, and (with n being another
+// generation) to get how many generations older n is than gen.
+func (gen Generation) SubClamped(n Generation) Generation {
+	if n > gen {
+		return 0
+	}
+	return gen - n
+}
+
+// CompareKnown returns -1, 0, or 1 if gen is older than, the same
+// as, or newer than other.  If either generation is unknown (see
+// .Known()), then ok is false, as the order is not known.
+func (gen Generation) CompareKnown(other Generation) (cmp int, ok bool) {
+	switch {
+	case !gen.Known() || !other.Known():
+		return 0, false
+	case gen < other:
+		return -1, true
+	case gen > other:
+		return 1, true
+	default:
+		return 0, true
+	}
+}
+
 type Time struct {
 	Sec           int64  `bin:"off=0x0, siz=0x8"` // Number of seconds since 1970-01-01T00:00:00Z.
 	NSec          uint32 `bin:"off=0x8, siz=0x4"` // Number of nanoseconds since the beginning of the second.
 	binstruct.End `bin:"off=0xc"`
 }
 
+const (
+	// unixToInternal is the number of seconds between the zero
+	// time.Time (year 1) and the Unix epoch (year 1970).
+	unixToInternal int64 = (1969*365 + 1969/4 - 1969/100 + 1969/400) * 24 * 60 * 60
+	// maxStdSec is the largest Unix time that a time.Time can
+	// represent; time.Unix silently overflows past it.
+	maxStdSec = math.MaxInt64 - unixToInternal
+)
+
+// ToStd converts a btrfs Time to a Go time.Time.  Times that are too
+// far in the future for a time.Time to represent (which can only
+// happen on a corrupt filesystem) are clamped to the maximum
+// time.Time, rather than overflowing.
 func (t Time) ToStd() time.Time {
-	return time.Unix(t.Sec, int64(t.NSec))
+	sec, nsec := t.Sec, int64(t.NSec)
+	if nsec >= int64(time.Second) {
+		// Corrupt; normalize it ourselves so that time.Unix
+		// can't overflow while doing so.
+		carry := nsec / int64(time.Second)
+		nsec %= int64(time.Second)
+		if sec > maxStdSec-carry {
+			return time.Unix(maxStdSec, int64(time.Second)-1)
+		}
+		sec += carry
+	}
+	if sec > maxStdSec {
+		return time.Unix(maxStdSec, int64(time.Second)-1)
+	}
+	return time.Unix(sec, nsec)
+}
+
+// TimeFormat describes how to format a Time as a human-readable
+// string.  The zero TimeFormat is equivalent to TimeFormatDefault.
+//
+// *TimeFormat implements pflag.Value, so that it may be used as a
+// command-line flag; see .Set() for the syntax.
+type TimeFormat struct {
+	Layout string // as for time.Time.Format; "" means TimeFormatDefault.Layout
+	UTC    bool   // whether to use UTC rather than the local timezone
+}
+
+var (
+	TimeFormatDefault     = TimeFormat{Layout: "2006-01-02 15:04:05"}
+	TimeFormatDefaultNano = TimeFormat{Layout: "2006-01-02 15:04:05.000000000"}
+	TimeFormatRFC3339     = TimeFormat{Layout: time.RFC3339}
+	TimeFormatRFC3339Nano = TimeFormat{Layout: time.RFC3339Nano}
+)
+
+var timeFormatNames = map[string]string{
+	"default":      TimeFormatDefault.Layout,
+	"default-nano": TimeFormatDefaultNano.Layout,
+	"rfc3339":      TimeFormatRFC3339.Layout,
+	"rfc3339nano":  TimeFormatRFC3339Nano.Layout,
+}
+
+// Format formats a Time according to the TimeFormat.
+func (f TimeFormat) Format(t Time) string {
+	layout := f.Layout
+	if layout == "" {
+		layout = TimeFormatDefault.Layout
+	}
+	std := t.ToStd()
+	if f.UTC {
+		std = std.UTC()
+	}
+	return std.Format(layout)
+}
+
+// Type implements pflag.Value.
+func (*TimeFormat) Type() string { return "timeformat" }
+
+// Set implements pflag.Value.  It accepts either the name of a
+// preset ("default", "default-nano", "rfc3339", or "rfc3339nano") or
+// a custom time.Time.Format layout, optionally followed by ",utc".
+func (f *TimeFormat) Set(str string) error {
+	layout, utc := str, false
+	if strings.HasSuffix(layout, ",utc") {
+		layout, utc = strings.TrimSuffix(layout, ",utc"), true
+	}
+	if preset, ok := timeFormatNames[layout]; ok {
+		layout = preset
+	}
+	*f = TimeFormat{
+		Layout: layout,
+		UTC:    utc,
+	}
+	return nil
+}
+
+// String implements fmt.Stringer (and pflag.Value).
+func (f *TimeFormat) String() string {
+	layout := f.Layout
+	if layout == "" {
+		layout = TimeFormatDefault.Layout
+	}
+	for name, preset := range timeFormatNames {
+		if layout == preset {
+			layout = name
+			break
+		}
+	}
+	if f.UTC {
+		layout += ",utc"
+	}
+	return layout
 }
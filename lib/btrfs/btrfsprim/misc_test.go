@@ -0,0 +1,107 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsprim_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func TestTimeToStd(t *testing.T) {
+	t.Parallel()
+	type TestCase struct {
+		Input  btrfsprim.Time
+		Output time.Time
+	}
+	maxStd := time.Unix(math.MaxInt64-62135596800, 999999999)
+	testcases := map[string]TestCase{
+		"epoch":    {Input: btrfsprim.Time{}, Output: time.Unix(0, 0)},
+		"normal":   {Input: btrfsprim.Time{Sec: 1672531200, NSec: 5}, Output: time.Unix(1672531200, 5)},
+		"negative": {Input: btrfsprim.Time{Sec: -1}, Output: time.Unix(-1, 0)},
+		"min":      {Input: btrfsprim.Time{Sec: math.MinInt64}, Output: time.Unix(math.MinInt64, 0)},
+		"max":      {Input: btrfsprim.Time{Sec: math.MaxInt64, NSec: 999999999}, Output: maxStd},
+		"bad-nsec": {Input: btrfsprim.Time{Sec: 1, NSec: 2500000000}, Output: time.Unix(3, 500000000)},
+		"max-nsec": {Input: btrfsprim.Time{Sec: math.MaxInt64 - 62135596800, NSec: math.MaxUint32}, Output: maxStd},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			act := tc.Input.ToStd()
+			assert.True(t, tc.Output.Equal(act), "expected %v, got %v", tc.Output, act)
+		})
+	}
+	// Monotonic: the clamped max must not have wrapped around.
+	assert.True(t, btrfsprim.Time{Sec: math.MaxInt64}.ToStd().After(btrfsprim.Time{Sec: 1 << 40}.ToStd()))
+}
+
+func TestTimeFormat(t *testing.T) {
+	t.Parallel()
+	in := btrfsprim.Time{Sec: 1672531200, NSec: 123456789} // 2023-01-01T00:00:00Z
+	type TestCase struct {
+		Flag   string
+		Output string
+	}
+	testcases := map[string]TestCase{
+		"default":      {Flag: "default,utc", Output: "2023-01-01 00:00:00"},
+		"default-nano": {Flag: "default-nano,utc", Output: "2023-01-01 00:00:00.123456789"},
+		"rfc3339":      {Flag: "rfc3339,utc", Output: "2023-01-01T00:00:00Z"},
+		"rfc3339nano":  {Flag: "rfc3339nano,utc", Output: "2023-01-01T00:00:00.123456789Z"},
+		"custom":       {Flag: "2006/01/02,utc", Output: "2023/01/01"},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			var f btrfsprim.TimeFormat
+			assert.NoError(t, f.Set(tc.Flag))
+			assert.Equal(t, tc.Output, f.Format(in))
+			assert.Equal(t, tc.Flag, f.String())
+		})
+	}
+	var zero btrfsprim.TimeFormat
+	assert.Equal(t, "default", zero.String())
+}
+
+func TestGeneration(t *testing.T) {
+	t.Parallel()
+	const maxGen = btrfsprim.MaxGeneration
+
+	assert.False(t, btrfsprim.Generation(0).Known())
+	assert.True(t, btrfsprim.Generation(1).Known())
+	assert.True(t, maxGen.Known())
+
+	assert.Equal(t, btrfsprim.Generation(5), btrfsprim.Generation(2).AddClamped(3))
+	assert.Equal(t, maxGen, (maxGen - 1).AddClamped(1))
+	assert.Equal(t, maxGen, maxGen.AddClamped(1))
+	assert.Equal(t, maxGen, btrfsprim.Generation(2).AddClamped(maxGen))
+
+	assert.Equal(t, btrfsprim.Generation(2), btrfsprim.Generation(5).SubClamped(3))
+	assert.Equal(t, btrfsprim.Generation(0), btrfsprim.Generation(5).SubClamped(5))
+	assert.Equal(t, btrfsprim.Generation(0), btrfsprim.Generation(5).SubClamped(6))
+	assert.Equal(t, btrfsprim.Generation(0), btrfsprim.Generation(0).SubClamped(1))
+	assert.Equal(t, btrfsprim.Generation(0), btrfsprim.Generation(1).SubClamped(maxGen))
+	assert.Equal(t, maxGen-1, maxGen.SubClamped(1))
+
+	type cmpResult struct {
+		Cmp int
+		OK  bool
+	}
+	cmp := func(a, b btrfsprim.Generation) cmpResult {
+		c, ok := a.CompareKnown(b)
+		return cmpResult{c, ok}
+	}
+	assert.Equal(t, cmpResult{-1, true}, cmp(1, 2))
+	assert.Equal(t, cmpResult{1, true}, cmp(maxGen, 1))
+	assert.Equal(t, cmpResult{0, true}, cmp(maxGen, maxGen))
+	assert.Equal(t, cmpResult{0, false}, cmp(0, 1))
+	assert.Equal(t, cmpResult{0, false}, cmp(maxGen, 0))
+	assert.Equal(t, cmpResult{0, false}, cmp(0, 0))
+}
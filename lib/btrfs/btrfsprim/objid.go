@@ -7,6 +7,9 @@ package btrfsprim
 import (
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 type ObjID uint64
@@ -103,10 +106,7 @@ func (id ObjID) Format(tree ObjID) string {
 		if id == 0 {
 			return "0"
 		}
-		//nolint:gomnd // The left 48 bits are the "qgroup level", and the right 16 bits are the subvolume ID.
-		return fmt.Sprintf("%d/%d",
-			uint64(id)>>48,
-			uint64(id)&((1<<48)-1))
+		return fmtQGroupID(uint64(id))
 	case UUID_TREE_OBJECTID:
 		return fmt.Sprintf("%#016x", uint64(id))
 	case CHUNK_TREE_OBJECTID:
@@ -128,6 +128,66 @@ func (id ObjID) Format(tree ObjID) string {
 	}
 }
 
+// fmtQGroupID formats a qgroup ID as "level/subvolid", mimicking
+// btrfs-progs.  The left 16 bits are the "qgroup level", and the right
+// 48 bits are the subvolume ID.
+func fmtQGroupID(id uint64) string {
+	//nolint:gomnd // See above.
+	return fmt.Sprintf("%d/%d",
+		id>>48,
+		id&((1<<48)-1))
+}
+
 func (id ObjID) String() string {
 	return id.Format(0)
 }
+
+// ParseObjID is the inverse of ObjID.String: it accepts either a
+// number (in any base accepted by strconv.ParseUint with base=0, or
+// negative for the IDs near the top of the range, as btrfs-progs
+// prints them), or a name as returned by .String(), such as
+// "FS_TREE" or "TREE_LOG".  Names are case-insensitive, and may have
+// an "_OBJECTID" suffix.
+func ParseObjID(str string) (ObjID, error) {
+	if str == "" {
+		return 0, fmt.Errorf("missing object ID")
+	}
+	if v, err := strconv.ParseUint(str, 0, 64); err == nil {
+		return ObjID(v), nil
+	}
+	if v, err := strconv.ParseInt(str, 0, 64); err == nil {
+		return ObjID(v), nil
+	}
+	name := strings.ToUpper(str)
+	name = strings.TrimSuffix(name, "_OBJECTIDS") // MULTIPLE_OBJECTIDS
+	name = strings.TrimSuffix(name, "_OBJECTID")
+	for _, names := range []map[ObjID]string{objidCommonNames, objidRootTreeNames} {
+		for id, idName := range names {
+			if idName == name {
+				return id, nil
+			}
+		}
+	}
+	var valid []string
+	for _, names := range []map[ObjID]string{objidCommonNames, objidRootTreeNames} {
+		for _, idName := range names {
+			valid = append(valid, idName)
+		}
+	}
+	sort.Strings(valid)
+	return 0, fmt.Errorf("unknown object ID %q; must be a number or one of: %s",
+		str, strings.Join(valid, ", "))
+}
+
+// Type implements pflag.Value.
+func (*ObjID) Type() string { return "objid" }
+
+// Set implements pflag.Value; see ParseObjID for the syntax.
+func (id *ObjID) Set(str string) error {
+	v, err := ParseObjID(str)
+	if err != nil {
+		return err
+	}
+	*id = v
+	return nil
+}
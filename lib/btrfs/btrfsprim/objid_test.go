@@ -0,0 +1,75 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsprim_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+func TestParseObjID(t *testing.T) {
+	t.Parallel()
+	type TestCase struct {
+		Input  string
+		Output btrfsprim.ObjID
+		Err    string
+	}
+	testcases := map[string]TestCase{
+		"decimal":     {Input: "257", Output: 257},
+		"hex":         {Input: "0x101", Output: 257},
+		"negative":    {Input: "-6", Output: btrfsprim.TREE_LOG_OBJECTID},
+		"name":        {Input: "FS_TREE", Output: btrfsprim.FS_TREE_OBJECTID},
+		"lower":       {Input: "csum_tree", Output: btrfsprim.CSUM_TREE_OBJECTID},
+		"suffix":      {Input: "TREE_LOG_OBJECTID", Output: btrfsprim.TREE_LOG_OBJECTID},
+		"suffix-plur": {Input: "multiple_objectids", Output: btrfsprim.MULTIPLE_OBJECTIDS},
+		"empty":       {Input: "", Err: `missing object ID`},
+		"unknown":     {Input: "FOO_TREE", Err: `unknown object ID "FOO_TREE"; must be a number or one of: BALANCE, BLOCK_GROUP_TREE, `},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			var act btrfsprim.ObjID
+			err := act.Set(tc.Input)
+			if tc.Err != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.Err)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Output, act)
+		})
+	}
+}
+
+// TestParseObjIDRoundTrip checks that every name that ObjID.String
+// produces is parsed back to the same ObjID.
+func TestParseObjIDRoundTrip(t *testing.T) {
+	t.Parallel()
+	for _, id := range []btrfsprim.ObjID{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 255, 256, 257,
+		btrfsprim.BALANCE_OBJECTID,
+		btrfsprim.ORPHAN_OBJECTID,
+		btrfsprim.TREE_LOG_OBJECTID,
+		btrfsprim.TREE_LOG_FIXUP_OBJECTID,
+		btrfsprim.TREE_RELOC_OBJECTID,
+		btrfsprim.DATA_RELOC_TREE_OBJECTID,
+		btrfsprim.EXTENT_CSUM_OBJECTID,
+		btrfsprim.FREE_SPACE_OBJECTID,
+		btrfsprim.FREE_INO_OBJECTID,
+		btrfsprim.MULTIPLE_OBJECTIDS,
+		btrfsprim.LAST_FREE_OBJECTID,
+		btrfsprim.MAX_OBJECTID,
+	} {
+		act, err := btrfsprim.ParseObjID(id.String())
+		if assert.NoError(t, err, id.String()) {
+			assert.Equal(t, id, act, id.String())
+		}
+	}
+}
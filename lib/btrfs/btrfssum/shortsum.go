@@ -11,7 +11,6 @@ import (
 	"git.lukeshu.com/go/lowmemjson"
 
 	"git.lukeshu.com/btrfs-progs-ng/lib/jsonutil"
-	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
 type ShortSum string
@@ -28,7 +27,7 @@ func (sum ShortSum) ToFullSum() CSum {
 }
 
 func (sum ShortSum) EncodeJSON(w io.Writer) error {
-	return jsonutil.EncodeSplitHexString(w, sum, textui.Tunable(80))
+	return jsonutil.EncodeSplitHexString(w, sum, jsonutil.HexLineWidth.Get())
 }
 
 func (sum *ShortSum) DecodeJSON(r io.RuneScanner) error {
@@ -5,9 +5,45 @@
 package btrfstree
 
 import (
+	"errors"
+	"fmt"
 	iofs "io/fs"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
 )
 
+// ErrEmptyNode is the error that NodeExpectations.Check reports for a
+// node that claims to have no items.  Such a node parses fine, but is
+// never valid in a tree; tree walks report it (to
+// TreeWalkHandler.BadNode) and skip it, rather than assuming that
+// every node has a first item.
+var ErrEmptyNode = errors.New("has no items")
+
+// A TreeError is an error reading a node of a tree, along with the
+// path to that node.  The RawTree TreeSearch, TreeRange, and
+// TreeSubrange methods report nodes that could not be read (or that
+// did not meet their NodeExpectations, such as an ErrEmptyNode) as
+// TreeErrors, possibly wrapped or within a derror.MultiError.
+type TreeError struct {
+	Path Path
+	Err  error
+}
+
+func (e *TreeError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Path, e.Err)
+}
+
+func (e *TreeError) Unwrap() error { return e.Err }
+
+// newTreeError returns a *TreeError with a copy of `path`, since the
+// walk re-uses the backing array of the path it passes to callbacks.
+func newTreeError(path Path, err error) *TreeError {
+	return &TreeError{
+		Path: append(Path(nil), path...),
+		Err:  err,
+	}
+}
+
 // For both ErrNoItem and ErrNoTree, `errors.Is(err,
 // io/fs.ErrNotExist)` returns true.
 var (
@@ -30,3 +66,42 @@ func (e *notExistError) Error() string {
 func (*notExistError) Is(target error) bool {
 	return target == iofs.ErrNotExist
 }
+
+// An OwnerError is returned by CheckOwner when a node's owner is not
+// acceptable in the tree that it was read as part of.
+type OwnerError struct {
+	Tree  btrfsprim.ObjID // the tree that the node was read as part of
+	Owner btrfsprim.ObjID // the node's claimed owner
+	Err   error
+}
+
+func (e *OwnerError) Error() string { return e.Err.Error() }
+func (e *OwnerError) Unwrap() error { return e.Err }
+
+// ErrPhantomOwner is matched (with errors.Is) by a
+// *PhantomOwnerError.
+var ErrPhantomOwner = errors.New("phantom owner")
+
+// A PhantomOwnerError is returned by DiagnosePhantomOwner when a
+// node's owner is not just the wrong tree, but is not a tree at all:
+// it is neither one of the well-known internal trees, nor a subvolume
+// that has a ROOT_ITEM in the ROOT_TREE.  This strongly suggests that
+// the node's header is corrupt, rather than that a valid node is out
+// of place.
+type PhantomOwnerError struct {
+	Tree  btrfsprim.ObjID // the tree that the node was read as part of
+	Owner btrfsprim.ObjID // the node's claimed owner
+	Err   error           // the error that was diagnosed
+}
+
+func (e *PhantomOwnerError) Error() string {
+	return fmt.Sprintf("owner=%v is not acceptable in tree %v, and is not a tree that exists "+
+		"(phantom owner; the node header is probably corrupt): %v",
+		e.Owner, e.Tree.Format(btrfsprim.ROOT_TREE_OBJECTID), e.Err)
+}
+
+func (e *PhantomOwnerError) Unwrap() error { return e.Err }
+
+func (*PhantomOwnerError) Is(target error) bool {
+	return target == ErrPhantomOwner
+}
@@ -63,6 +63,12 @@ func LookupTreeRoot(ctx context.Context, forrest Forrest, sb Superblock, treeID
 			Generation: sb.Generation, // XXX: same generation as ROOT_TREE?
 		}, nil
 	case btrfsprim.BLOCK_GROUP_TREE_OBJECTID:
+		if sb.BlockGroupTree() != btrfsprim.BLOCK_GROUP_TREE_OBJECTID {
+			// Without the block-group-tree feature, the
+			// superblock's BlockGroupRoot is meaningless;
+			// treat the tree as empty.
+			return &TreeRoot{ID: treeID}, nil
+		}
 		return &TreeRoot{
 			ID:         treeID,
 			RootNode:   sb.BlockGroupRoot,
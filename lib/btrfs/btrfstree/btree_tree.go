@@ -200,7 +200,7 @@ func (tree *RawTree) TreeSearch(ctx context.Context, searcher TreeSearcher) (Ite
 			}
 		},
 		BadNode: func(path Path, _ *Node, err error) bool {
-			setErr(fmt.Errorf("%v: %w", path, err))
+			setErr(newTreeError(path, err))
 			return false
 		},
 		KeyPointer: func(_ Path, kp KeyPointer) bool {
@@ -223,7 +223,7 @@ func (tree *RawTree) TreeRange(ctx context.Context, handleFn func(Item) bool) er
 
 	tree.TreeWalk(ctx, TreeWalkHandler{
 		BadNode: func(path Path, _ *Node, err error) bool {
-			errs = append(errs, fmt.Errorf("%v: %w", path, err))
+			errs = append(errs, newTreeError(path, err))
 			return false
 		},
 		Item: func(_ Path, item Item) {
@@ -265,7 +265,7 @@ func (tree *RawTree) TreeSubrange(ctx context.Context, min int, searcher TreeSea
 			minKP = kp.Key
 		},
 		BadNode: func(path Path, _ *Node, err error) bool {
-			errs = append(errs, fmt.Errorf("%v: %w", path, err))
+			errs = append(errs, newTreeError(path, err))
 			return false
 		},
 		KeyPointer: func(_ Path, kp KeyPointer) bool {
@@ -0,0 +1,204 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfstree_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/datawire/dlib/derror"
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+type mockNodeSource struct {
+	sb    btrfstree.Superblock
+	nodes map[btrfsvol.LogicalAddr]*btrfstree.Node
+}
+
+func (src *mockNodeSource) Superblock() (*btrfstree.Superblock, error) {
+	return &src.sb, nil
+}
+
+func (src *mockNodeSource) AcquireNode(_ context.Context, addr btrfsvol.LogicalAddr, exp btrfstree.NodeExpectations) (*btrfstree.Node, error) {
+	node, ok := src.nodes[addr]
+	if !ok {
+		return nil, fmt.Errorf("no node at %v", addr)
+	}
+	if err := exp.Check(node); err != nil {
+		return node, fmt.Errorf("node@%v: %w", addr, err)
+	}
+	return node, nil
+}
+
+func (*mockNodeSource) ReleaseNode(*btrfstree.Node) {}
+
+func TestTreeEmptyNode(t *testing.T) {
+	t.Parallel()
+
+	const gen = 10
+	leaf := func(addr btrfsvol.LogicalAddr, objIDs ...btrfsprim.ObjID) *btrfstree.Node {
+		node := &btrfstree.Node{
+			Head: btrfstree.NodeHeader{
+				Addr:       addr,
+				Generation: gen,
+				Owner:      btrfsprim.ROOT_TREE_OBJECTID,
+				NumItems:   uint32(len(objIDs)),
+			},
+		}
+		for _, objID := range objIDs {
+			node.BodyLeaf = append(node.BodyLeaf, btrfstree.Item{
+				Key:  btrfsprim.Key{ObjectID: objID, ItemType: btrfsprim.ORPHAN_ITEM_KEY},
+				Body: &btrfsitem.Empty{},
+			})
+		}
+		return node
+	}
+	interior := func(addr btrfsvol.LogicalAddr, kps ...btrfstree.KeyPointer) *btrfstree.Node {
+		return &btrfstree.Node{
+			Head: btrfstree.NodeHeader{
+				Addr:       addr,
+				Generation: gen,
+				Owner:      btrfsprim.ROOT_TREE_OBJECTID,
+				NumItems:   uint32(len(kps)),
+				Level:      1,
+			},
+			BodyInterior: kps,
+		}
+	}
+	kp := func(objID btrfsprim.ObjID, addr btrfsvol.LogicalAddr) btrfstree.KeyPointer {
+		return btrfstree.KeyPointer{
+			Key:        btrfsprim.Key{ObjectID: objID, ItemType: btrfsprim.ORPHAN_ITEM_KEY},
+			BlockPtr:   addr,
+			Generation: gen,
+		}
+	}
+
+	testcases := map[string]struct {
+		Root    btrfsvol.LogicalAddr
+		Level   uint8
+		Nodes   []*btrfstree.Node
+		Items   []btrfsprim.ObjID
+		ErrAddr btrfsvol.LogicalAddr
+	}{
+		"empty-leaf-root": {
+			Root:    0x1000,
+			Nodes:   []*btrfstree.Node{leaf(0x1000)},
+			ErrAddr: 0x1000,
+		},
+		"empty-interior-root": {
+			Root:    0x1000,
+			Level:   1,
+			Nodes:   []*btrfstree.Node{interior(0x1000)},
+			ErrAddr: 0x1000,
+		},
+		"empty-leaf-child": {
+			Root:  0x1000,
+			Level: 1,
+			Nodes: []*btrfstree.Node{
+				interior(0x1000, kp(256, 0x2000), kp(300, 0x3000), kp(400, 0x4000)),
+				leaf(0x2000, 256, 257),
+				leaf(0x3000),
+				leaf(0x4000, 400, 401),
+			},
+			Items:   []btrfsprim.ObjID{256, 257, 400, 401},
+			ErrAddr: 0x3000,
+		},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			ctx := dlog.NewTestContext(t, false)
+			src := &mockNodeSource{
+				sb: btrfstree.Superblock{
+					Generation: gen,
+					RootTree:   tc.Root,
+					RootLevel:  tc.Level,
+				},
+				nodes: make(map[btrfsvol.LogicalAddr]*btrfstree.Node),
+			}
+			for _, node := range tc.Nodes {
+				src.nodes[node.Head.Addr] = node
+			}
+			tree, err := btrfstree.RawForrest{NodeSource: src}.RawTree(ctx, btrfsprim.ROOT_TREE_OBJECTID)
+			require.NoError(t, err)
+
+			// TreeWalk
+			var badNodes []btrfsvol.LogicalAddr
+			var walked []btrfsprim.ObjID
+			tree.TreeWalk(ctx, btrfstree.TreeWalkHandler{
+				BadNode: func(_ btrfstree.Path, node *btrfstree.Node, err error) bool {
+					assert.ErrorIs(t, err, btrfstree.ErrEmptyNode)
+					badNodes = append(badNodes, node.Head.Addr)
+					return true
+				},
+				Item: func(_ btrfstree.Path, item btrfstree.Item) {
+					walked = append(walked, item.Key.ObjectID)
+				},
+			})
+			assert.Equal(t, []btrfsvol.LogicalAddr{tc.ErrAddr}, badNodes)
+			assert.Equal(t, tc.Items, walked)
+
+			// requireTreeError asserts that `err` is (or, if
+			// it is a derror.MultiError, contains) a
+			// *btrfstree.TreeError for the empty node.
+			requireTreeError := func(t *testing.T, err error) {
+				t.Helper()
+				var treeErr *btrfstree.TreeError
+				var multi derror.MultiError
+				if errors.As(err, &multi) {
+					for _, err := range multi {
+						if errors.As(err, &treeErr) {
+							break
+						}
+					}
+				}
+				if treeErr == nil {
+					require.ErrorAs(t, err, &treeErr)
+				}
+				assert.ErrorIs(t, treeErr, btrfstree.ErrEmptyNode)
+				addr, _, ok := treeErr.Path.NodeExpectations(ctx)
+				require.True(t, ok)
+				assert.Equal(t, tc.ErrAddr, addr)
+			}
+
+			// TreeRange
+			var ranged []btrfsprim.ObjID
+			err = tree.TreeRange(ctx, func(item btrfstree.Item) bool {
+				ranged = append(ranged, item.Key.ObjectID)
+				return true
+			})
+			requireTreeError(t, err)
+			assert.Equal(t, tc.Items, ranged)
+
+			// TreeSearch, both for an item that exists and
+			// for one that would be in the empty node.
+			for _, objID := range append(tc.Items, 300) {
+				item, err := tree.TreeSearch(ctx, btrfstree.SearchObject(objID))
+				if objID == 300 || len(tc.Items) == 0 {
+					requireTreeError(t, err)
+				} else {
+					assert.NoError(t, err, objID)
+					assert.Equal(t, objID, item.Key.ObjectID)
+				}
+			}
+
+			// TreeSubrange
+			err = tree.TreeSubrange(ctx, 1, btrfstree.SearchObject(300), func(btrfstree.Item) bool {
+				return true
+			})
+			requireTreeError(t, err)
+		})
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfstree
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+type keyFilterRange struct {
+	Set      bool
+	Min, Max uint64
+}
+
+func (r keyFilterRange) has(v uint64) bool {
+	return !r.Set || (r.Min <= v && v <= r.Max)
+}
+
+func (r keyFilterRange) overlaps(min, max uint64) bool {
+	return !r.Set || (r.Min <= max && min <= r.Max)
+}
+
+func (r keyFilterRange) bounds(fullMax uint64) (uint64, uint64) {
+	if !r.Set {
+		return 0, fullMax
+	}
+	return r.Min, r.Max
+}
+
+// A KeyFilter is a predicate on keys, parsed from a simple
+// expression such as "objectid=256,type=INODE_ITEM" or
+// "type=EXTENT_DATA,offset=0-4096".
+//
+// The expression is a comma-separated list of FIELD=VALUE terms, all
+// of which must match.  FIELD is one of "objectid", "type", or
+// "offset".  VALUE is either a single value, or a "MIN-MAX" range
+// (inclusive), either end of which may be omitted.  Numbers may be in
+// decimal, or in hex with a "0x" prefix; item types may also be given
+// by name (such as "INODE_ITEM" or "INODE_ITEM_KEY").
+//
+// The zero KeyFilter matches every key.
+//
+// KeyFilter implements pflag.Value, so that it may be used directly
+// as a command-line flag.
+type KeyFilter struct {
+	expr     string
+	objectID keyFilterRange
+	itemType keyFilterRange
+	offset   keyFilterRange
+}
+
+var _ TreeSearcher = KeyFilter{}
+
+// ParseKeyFilter parses a KeyFilter expression; see the KeyFilter
+// documentation for the syntax.
+func ParseKeyFilter(expr string) (KeyFilter, error) {
+	var ret KeyFilter
+	if err := ret.Set(expr); err != nil {
+		return KeyFilter{}, err
+	}
+	return ret, nil
+}
+
+// IsZero returns whether the filter matches every key.
+func (f KeyFilter) IsZero() bool {
+	return !f.objectID.Set && !f.itemType.Set && !f.offset.Set
+}
+
+// Type implements pflag.Value.
+func (KeyFilter) Type() string { return "keyfilter" }
+
+// String implements fmt.Stringer, pflag.Value, and TreeSearcher.
+func (f KeyFilter) String() string { return f.expr }
+
+// Set implements pflag.Value.
+func (f *KeyFilter) Set(expr string) error {
+	var ret KeyFilter
+	ret.expr = expr
+	for _, term := range strings.Split(expr, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		field, val, ok := strings.Cut(term, "=")
+		if !ok {
+			return fmt.Errorf("key filter %q: term %q: expected FIELD=VALUE", expr, term)
+		}
+		field = strings.ToLower(strings.TrimSpace(field))
+		var dst *keyFilterRange
+		var parse func(string) (uint64, error)
+		var fullMax uint64
+		switch field {
+		case "objectid", "objid":
+			dst, parse, fullMax = &ret.objectID, parseKeyFilterNum, math.MaxUint64
+		case "type", "itemtype":
+			dst, parse, fullMax = &ret.itemType, parseKeyFilterType, math.MaxUint8
+		case "offset":
+			dst, parse, fullMax = &ret.offset, parseKeyFilterNum, math.MaxUint64
+		default:
+			return fmt.Errorf("key filter %q: term %q: unknown field %q (expected one of \"objectid\", \"type\", or \"offset\")",
+				expr, term, field)
+		}
+		if dst.Set {
+			return fmt.Errorf("key filter %q: field %q given more than once", expr, field)
+		}
+		rng, err := parseKeyFilterRange(strings.TrimSpace(val), parse, fullMax)
+		if err != nil {
+			return fmt.Errorf("key filter %q: term %q: %w", expr, term, err)
+		}
+		*dst = rng
+	}
+	*f = ret
+	return nil
+}
+
+func parseKeyFilterRange(val string, parse func(string) (uint64, error), fullMax uint64) (keyFilterRange, error) {
+	ret := keyFilterRange{Set: true}
+	minStr, maxStr, isRange := strings.Cut(val, "-")
+	if !isRange {
+		v, err := parse(val)
+		if err != nil {
+			return keyFilterRange{}, err
+		}
+		ret.Min, ret.Max = v, v
+		return ret, nil
+	}
+	ret.Max = fullMax
+	if minStr = strings.TrimSpace(minStr); minStr != "" {
+		v, err := parse(minStr)
+		if err != nil {
+			return keyFilterRange{}, err
+		}
+		ret.Min = v
+	}
+	if maxStr = strings.TrimSpace(maxStr); maxStr != "" {
+		v, err := parse(maxStr)
+		if err != nil {
+			return keyFilterRange{}, err
+		}
+		ret.Max = v
+	}
+	if ret.Min > ret.Max {
+		return keyFilterRange{}, fmt.Errorf("range %q is empty: %v > %v", val, ret.Min, ret.Max)
+	}
+	return ret, nil
+}
+
+func parseKeyFilterNum(str string) (uint64, error) {
+	if str == "" {
+		return 0, fmt.Errorf("missing value")
+	}
+	v, err := strconv.ParseUint(str, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", str)
+	}
+	return v, nil
+}
+
+func parseKeyFilterType(str string) (uint64, error) {
+	if str == "" {
+		return 0, fmt.Errorf("missing value")
+	}
+	typ, err := btrfsprim.ParseItemType(str)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(typ), nil
+}
+
+// Match returns whether the key matches the filter.
+func (f KeyFilter) Match(key btrfsprim.Key) bool {
+	return f.objectID.has(uint64(key.ObjectID)) &&
+		f.itemType.has(uint64(key.ItemType)) &&
+		f.offset.has(key.Offset)
+}
+
+// MayContain returns whether any key in the inclusive range [min,
+// max] might match the filter.  It is conservative: it may return
+// true even if no key in the range matches, but it never returns
+// false if one does.  This is useful for deciding whether to descend
+// in to the subtree behind a key-pointer.
+func (f KeyFilter) MayContain(min, max btrfsprim.Key) bool {
+	if !f.objectID.overlaps(uint64(min.ObjectID), uint64(max.ObjectID)) {
+		return false
+	}
+	if min.ObjectID != max.ObjectID {
+		return true
+	}
+	if !f.itemType.overlaps(uint64(min.ItemType), uint64(max.ItemType)) {
+		return false
+	}
+	if min.ItemType != max.ItemType {
+		return true
+	}
+	return f.offset.overlaps(min.Offset, max.Offset)
+}
+
+// MinKey returns the smallest key that matches the filter.
+func (f KeyFilter) MinKey() btrfsprim.Key {
+	objID, _ := f.objectID.bounds(math.MaxUint64)
+	typ, _ := f.itemType.bounds(math.MaxUint8)
+	off, _ := f.offset.bounds(math.MaxUint64)
+	return btrfsprim.Key{ObjectID: btrfsprim.ObjID(objID), ItemType: btrfsprim.ItemType(typ), Offset: off}
+}
+
+// MaxKey returns the largest key that matches the filter.
+func (f KeyFilter) MaxKey() btrfsprim.Key {
+	_, objID := f.objectID.bounds(math.MaxUint64)
+	_, typ := f.itemType.bounds(math.MaxUint8)
+	_, off := f.offset.bounds(math.MaxUint64)
+	return btrfsprim.Key{ObjectID: btrfsprim.ObjID(objID), ItemType: btrfsprim.ItemType(typ), Offset: off}
+}
+
+// Search implements TreeSearcher, searching for the contiguous range
+// of keys [f.MinKey(), f.MaxKey()].  Not every key in that range
+// necessarily matches the filter (for example, with
+// "objectid=256-257,type=INODE_ITEM", the range includes 256's
+// DIR_ITEMs), so items found with it should still be checked with
+// .Match.
+func (f KeyFilter) Search(key btrfsprim.Key, _ uint32) int {
+	if min := f.MinKey(); key.Compare(min) < 0 {
+		return 1
+	}
+	if max := f.MaxKey(); key.Compare(max) > 0 {
+		return -1
+	}
+	return 0
+}
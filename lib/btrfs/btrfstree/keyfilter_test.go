@@ -0,0 +1,61 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfstree_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+)
+
+func TestKeyFilter(t *testing.T) {
+	t.Parallel()
+	k := func(objID btrfsprim.ObjID, typ btrfsprim.ItemType, off uint64) btrfsprim.Key {
+		return btrfsprim.Key{ObjectID: objID, ItemType: typ, Offset: off}
+	}
+
+	var zero btrfstree.KeyFilter
+	assert.True(t, zero.IsZero())
+	assert.True(t, zero.Match(k(1, 2, 3)))
+
+	filter, err := btrfstree.ParseKeyFilter("objectid=256-0x101, type=inode_item")
+	require.NoError(t, err)
+	assert.True(t, filter.Match(k(256, btrfsprim.INODE_ITEM_KEY, 0)))
+	assert.True(t, filter.Match(k(257, btrfsprim.INODE_ITEM_KEY, 0)))
+	assert.False(t, filter.Match(k(258, btrfsprim.INODE_ITEM_KEY, 0)))
+	assert.False(t, filter.Match(k(256, btrfsprim.DIR_ITEM_KEY, 0)))
+	assert.Equal(t, k(256, btrfsprim.INODE_ITEM_KEY, 0), filter.MinKey())
+	assert.Equal(t, k(257, btrfsprim.INODE_ITEM_KEY, btrfsprim.MaxOffset), filter.MaxKey())
+
+	assert.True(t, filter.MayContain(k(200, 0, 0), k(300, 0, 0)))
+	assert.False(t, filter.MayContain(k(258, 0, 0), k(300, 0, 0)))
+	assert.False(t, filter.MayContain(k(256, btrfsprim.DIR_ITEM_KEY, 0), k(256, btrfsprim.DIR_INDEX_KEY, 5)))
+	assert.True(t, filter.MayContain(k(256, btrfsprim.UNTYPED_KEY, 0), k(256, btrfsprim.DIR_INDEX_KEY, 5)))
+
+	assert.Equal(t, 1, filter.Search(k(255, btrfsprim.INODE_ITEM_KEY, 0), 0))
+	assert.Equal(t, 0, filter.Search(k(256, btrfsprim.DIR_ITEM_KEY, 0), 0))
+	assert.Equal(t, -1, filter.Search(k(257, btrfsprim.DIR_ITEM_KEY, 0), 0))
+
+	filter, err = btrfstree.ParseKeyFilter("type=108,offset=4096-")
+	require.NoError(t, err)
+	assert.True(t, filter.Match(k(5, btrfsprim.EXTENT_DATA_KEY, 8192)))
+	assert.False(t, filter.Match(k(5, btrfsprim.EXTENT_DATA_KEY, 0)))
+
+	for _, bad := range []string{
+		"objectid",
+		"color=red",
+		"objectid=banana",
+		"type=NOT_AN_ITEM",
+		"offset=10-5",
+		"offset=1,offset=2",
+	} {
+		_, err := btrfstree.ParseKeyFilter(bad)
+		assert.Error(t, err, bad)
+	}
+}
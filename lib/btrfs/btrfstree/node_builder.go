@@ -0,0 +1,190 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfstree
+
+import (
+	"fmt"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+// A NodeBuilder packs a key-sorted stream of items in to a tree of
+// nodes: leaf nodes are filled until the next item would not fit in
+// the LeafFreeSpace, interior nodes are filled until MaxItems, and
+// each filled node is finalized (given an address, a header, and a
+// checksum) and handed to Emit as soon as it is full, so that the
+// whole tree never needs to be in memory at once.
+//
+// Nodes are emitted bottom-up; a node is always emitted before the
+// interior node that points at it, and the root is emitted last.
+type NodeBuilder struct {
+	// Some context from the parent filesystem.
+	Size         uint32            // superblock.NodeSize
+	ChecksumType btrfssum.CSumType // superblock.ChecksumType
+
+	// Head is the template for the header of every emitted node;
+	// the builder fills in .Addr, .Level, .NumItems, and
+	// .Checksum.  The .Generation is also used as the generation
+	// of the key-pointers to the emitted nodes.
+	Head NodeHeader
+
+	// Alloc returns the logical address that the next emitted
+	// node will be written at.
+	Alloc func() (btrfsvol.LogicalAddr, error)
+	// Emit is called with each finalized node.  The node is not
+	// retained by the builder after Emit returns.
+	Emit func(*Node) error
+
+	levels   []*Node // levels[0] is the current leaf
+	emitted  []int   // number of nodes emitted at each level
+	leafUsed uint32  // what levels[0].LeafFreeSpace() would subtract, without re-marshaling
+	lastKey  *btrfsprim.Key
+}
+
+func (b *NodeBuilder) newNode(level int) *Node {
+	node := &Node{
+		Size:         b.Size,
+		ChecksumType: b.ChecksumType,
+		Head:         b.Head,
+	}
+	node.Head.Level = uint8(level)
+	return node
+}
+
+func (b *NodeBuilder) pending(level int) *Node {
+	for len(b.levels) <= level {
+		b.levels = append(b.levels, b.newNode(len(b.levels)))
+		b.emitted = append(b.emitted, 0)
+	}
+	return b.levels[level]
+}
+
+func (b *NodeBuilder) numItems(level int) int {
+	node := b.pending(level)
+	if level > 0 {
+		return len(node.BodyInterior)
+	}
+	return len(node.BodyLeaf)
+}
+
+// Add appends an item to the tree.  Items must be added in strictly
+// increasing key order.
+func (b *NodeBuilder) Add(item Item) error {
+	if b.lastKey != nil && item.Key.Compare(*b.lastKey) <= 0 {
+		return fmt.Errorf("NodeBuilder.Add: key %v is not greater than previous key %v",
+			item.Key, *b.lastKey)
+	}
+	bodyBuf, err := binstruct.Marshal(item.Body)
+	if err != nil {
+		return fmt.Errorf("NodeBuilder.Add: key %v: body: %w", item.Key, err)
+	}
+	need := uint32(itemHeaderSize + len(bodyBuf))
+	if maxNeed := b.Size - uint32(nodeHeaderSize); need > maxNeed {
+		return fmt.Errorf("NodeBuilder.Add: key %v: item needs %v bytes, but a leaf only has room for %v",
+			item.Key, need, maxNeed)
+	}
+
+	leaf := b.pending(0)
+	if b.Size-uint32(nodeHeaderSize)-b.leafUsed < need {
+		if err := b.flush(0); err != nil {
+			return err
+		}
+		leaf = b.pending(0)
+	}
+	item.BodySize = uint32(len(bodyBuf))
+	leaf.BodyLeaf = append(leaf.BodyLeaf, item)
+	b.leafUsed += need
+	key := item.Key
+	b.lastKey = &key
+	return nil
+}
+
+// finalize emits the pending node at `level`, and returns a pointer
+// to it.
+func (b *NodeBuilder) finalize(level int) (KeyPointer, error) {
+	node := b.pending(level)
+	b.levels[level] = b.newNode(level)
+	if level == 0 {
+		b.leafUsed = 0
+	}
+
+	addr, err := b.Alloc()
+	if err != nil {
+		return KeyPointer{}, fmt.Errorf("NodeBuilder: level %v: alloc: %w", level, err)
+	}
+	node.Head.Addr = addr
+	if level > 0 {
+		node.Head.NumItems = uint32(len(node.BodyInterior))
+	} else {
+		node.Head.NumItems = uint32(len(node.BodyLeaf))
+	}
+	node.Head.Checksum, err = node.CalculateChecksum()
+	if err != nil {
+		return KeyPointer{}, fmt.Errorf("NodeBuilder: node@%v: %w", addr, err)
+	}
+	minKey, _ := node.MinItem()
+	if err := b.Emit(node); err != nil {
+		return KeyPointer{}, fmt.Errorf("NodeBuilder: node@%v: %w", addr, err)
+	}
+	b.emitted[level]++
+	return KeyPointer{
+		Key:        minKey,
+		BlockPtr:   addr,
+		Generation: node.Head.Generation,
+	}, nil
+}
+
+// flush emits the pending node at `level` and adds a pointer to it to
+// the next level up.
+func (b *NodeBuilder) flush(level int) error {
+	kp, err := b.finalize(level)
+	if err != nil {
+		return err
+	}
+	parentLevel := level + 1
+	if parentLevel > MaxLevel {
+		return fmt.Errorf("NodeBuilder: tree would be deeper than the maximum level %v", MaxLevel)
+	}
+	parent := b.pending(parentLevel)
+	if uint32(len(parent.BodyInterior)) >= parent.MaxItems() {
+		if err := b.flush(parentLevel); err != nil {
+			return err
+		}
+		parent = b.pending(parentLevel)
+	}
+	parent.BodyInterior = append(parent.BodyInterior, kp)
+	return nil
+}
+
+// Finish emits all of the remaining pending nodes, and returns a
+// pointer to the root node along with the root's level.  An empty
+// tree is a single empty leaf.
+//
+// The NodeBuilder must not be used after calling Finish.
+func (b *NodeBuilder) Finish() (KeyPointer, uint8, error) {
+	for level := 0; ; level++ {
+		b.pending(level)
+		if b.emitted[level] == 0 {
+			// Everything at this level fits in a single
+			// node; it is the root.
+			kp, err := b.finalize(level)
+			return kp, uint8(level), err
+		}
+		if b.numItems(level) > 0 {
+			if err := b.flush(level); err != nil {
+				return KeyPointer{}, 0, err
+			}
+		}
+		if b.emitted[level] == 1 && b.numItems(level+1) == 1 && b.emitted[level+1] == 0 {
+			// This level is a single node that has already
+			// been emitted; it is the root, and does not need
+			// a parent.
+			return b.levels[level+1].BodyInterior[0], uint8(level), nil
+		}
+	}
+}
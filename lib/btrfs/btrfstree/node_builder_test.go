@@ -0,0 +1,156 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfstree_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+func buildTree(t *testing.T, numItems int) (root btrfstree.KeyPointer, level uint8, nodes map[btrfsvol.LogicalAddr][]byte, items []btrfstree.Item) {
+	t.Helper()
+	nodes = make(map[btrfsvol.LogicalAddr][]byte)
+	nextAddr := btrfsvol.LogicalAddr(0x10000)
+	builder := &btrfstree.NodeBuilder{
+		Size:         4096,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		Head: btrfstree.NodeHeader{
+			Flags:      btrfstree.NodeWritten,
+			BackrefRev: btrfstree.MixedBackrefRev,
+			Generation: 42,
+			Owner:      btrfsprim.FS_TREE_OBJECTID,
+		},
+		Alloc: func() (btrfsvol.LogicalAddr, error) {
+			addr := nextAddr
+			nextAddr += 4096
+			return addr, nil
+		},
+		Emit: func(node *btrfstree.Node) error {
+			bs, err := binstruct.Marshal(*node)
+			if err != nil {
+				return err
+			}
+			nodes[node.Head.Addr] = bs
+			return nil
+		},
+	}
+	for i := 0; i < numItems; i++ {
+		item := btrfstree.Item{
+			Key: btrfsprim.Key{
+				ObjectID: btrfsprim.ObjID(256 + i),
+				ItemType: btrfsitem.INODE_ITEM_KEY,
+			},
+			Body: &btrfsitem.Inode{
+				Generation: 42,
+				Size:       int64(i),
+				NLink:      1,
+			},
+		}
+		require.NoError(t, builder.Add(item))
+		items = append(items, item)
+	}
+	root, level, err := builder.Finish()
+	require.NoError(t, err)
+	return root, level, nodes, items
+}
+
+func TestNodeBuilder(t *testing.T) {
+	t.Parallel()
+	itemSize := uint32(binstruct.StaticSize(btrfstree.ItemHeader{}) + binstruct.StaticSize(btrfsitem.Inode{}))
+	testcases := map[string]struct {
+		NumItems  int
+		NumNodes  int
+		RootLevel uint8
+	}{
+		"empty":       {NumItems: 0, NumNodes: 1, RootLevel: 0},
+		"single-leaf": {NumItems: 10, NumNodes: 1, RootLevel: 0},
+		"full-leaf":   {NumItems: 21, NumNodes: 1, RootLevel: 0},
+		"two-leaves":  {NumItems: 22, NumNodes: 3, RootLevel: 1},
+		"three-level": {NumItems: 3000, NumNodes: 143 + 2 + 1, RootLevel: 2},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			root, level, nodes, items := buildTree(t, tc.NumItems)
+			assert.Equal(t, tc.RootLevel, level)
+			assert.Len(t, nodes, tc.NumNodes)
+
+			var gotKeys []btrfsprim.Key
+			var walk func(kp btrfstree.KeyPointer, level uint8, isLast bool)
+			walk = func(kp btrfstree.KeyPointer, level uint8, isLast bool) {
+				bs, ok := nodes[kp.BlockPtr]
+				require.True(t, ok, "no node at %v", kp.BlockPtr)
+				node := btrfstree.Node{ChecksumType: btrfssum.TYPE_CRC32}
+				_, err := binstruct.Unmarshal(bs, &node)
+				require.NoError(t, err)
+
+				// header and checksum
+				assert.NoError(t, node.ValidateChecksum())
+				assert.Equal(t, kp.BlockPtr, node.Head.Addr)
+				assert.Equal(t, level, node.Head.Level)
+				assert.Equal(t, btrfsprim.Generation(42), node.Head.Generation)
+				assert.Equal(t, kp.Generation, node.Head.Generation)
+				if minKey, ok := node.MinItem(); ok {
+					assert.Equal(t, kp.Key, minKey)
+				}
+
+				// round-trip
+				bs2, err := binstruct.Marshal(node)
+				require.NoError(t, err)
+				assert.Equal(t, bs, bs2)
+
+				if level > 0 {
+					for i, child := range node.BodyInterior {
+						walk(child, level-1, isLast && i == len(node.BodyInterior)-1)
+					}
+					return
+				}
+				if !isLast {
+					assert.Less(t, node.LeafFreeSpace(), itemSize, "non-final leaf is not full")
+				}
+				for _, item := range node.BodyLeaf {
+					gotKeys = append(gotKeys, item.Key)
+				}
+			}
+			walk(root, level, true)
+
+			expKeys := make([]btrfsprim.Key, 0, len(items))
+			for _, item := range items {
+				expKeys = append(expKeys, item.Key)
+			}
+			if len(expKeys) == 0 {
+				expKeys = nil
+			}
+			assert.Equal(t, expKeys, gotKeys)
+		})
+	}
+}
+
+func TestNodeBuilderErrors(t *testing.T) {
+	t.Parallel()
+	builder := &btrfstree.NodeBuilder{
+		Size:         4096,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		Alloc:        func() (btrfsvol.LogicalAddr, error) { return 0, fmt.Errorf("should not be called") },
+		Emit:         func(*btrfstree.Node) error { return fmt.Errorf("should not be called") },
+	}
+	key := btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.INODE_ITEM_KEY}
+	require.NoError(t, builder.Add(btrfstree.Item{Key: key, Body: &btrfsitem.Inode{}}))
+	assert.EqualError(t, builder.Add(btrfstree.Item{Key: key, Body: &btrfsitem.Inode{}}),
+		"NodeBuilder.Add: key (257 INODE_ITEM 0) is not greater than previous key (257 INODE_ITEM 0)")
+	assert.EqualError(t, builder.Add(btrfstree.Item{Key: key.Pp(), Body: &btrfsitem.Error{Dat: make([]byte, 4096)}}),
+		"NodeBuilder.Add: key (257 INODE_ITEM 1): item needs 4121 bytes, but a leaf only has room for 3995")
+}
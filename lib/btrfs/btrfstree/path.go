@@ -6,9 +6,12 @@ package btrfstree
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/datawire/dlib/derror"
+
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
 	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
@@ -134,9 +137,98 @@ func (path Path) String() string {
 	return ret.String()
 }
 
+// CheckOwner returns an *OwnerError if it is not permissible for a
+// node with the given owner and generation to be in the tree `treeID`
+// (that is, if the node is neither owned by the tree, nor shared with
+// it from one of its ancestors at or before the generation that it
+// was snapshotted).
+//
+// CheckOwner only looks up `treeID` and its ancestors, never the
+// owner; see DiagnosePhantomOwner for that.
 func CheckOwner(
 	ctx context.Context, forrest Forrest, treeID btrfsprim.ObjID,
 	ownerToCheck btrfsprim.ObjID, genToCheck btrfsprim.Generation,
+) error {
+	if err := checkOwner(ctx, forrest, treeID, ownerToCheck, genToCheck); err != nil {
+		return &OwnerError{
+			Tree:  treeID,
+			Owner: ownerToCheck,
+			Err:   err,
+		}
+	}
+	return nil
+}
+
+// DiagnosePhantomOwner returns a *PhantomOwnerError wrapping `err`
+// if `err` (an error from reading a node) includes an *OwnerError
+// whose owner is not a tree that exists (see IsPhantomOwner);
+// otherwise it returns `err` unchanged.
+//
+// Looking the owner up in the forrest may be expensive, and may have
+// side effects (a RebuiltForrest will try to build the owner's
+// tree), so this is for diagnosing errors that are being reported,
+// not for use while reading the trees.
+func DiagnosePhantomOwner(ctx context.Context, forrest Forrest, err error) error {
+	ownerErr := findOwnerError(err)
+	if ownerErr == nil || !IsPhantomOwner(ctx, forrest, ownerErr.Owner) {
+		return err
+	}
+	return &PhantomOwnerError{
+		Tree:  ownerErr.Tree,
+		Owner: ownerErr.Owner,
+		Err:   err,
+	}
+}
+
+func findOwnerError(err error) *OwnerError {
+	var ownerErr *OwnerError
+	if errors.As(err, &ownerErr) {
+		return ownerErr
+	}
+	// derror.MultiError doesn't support errors.As.
+	var multi derror.MultiError
+	if errors.As(err, &multi) {
+		for _, err := range multi {
+			if ownerErr := findOwnerError(err); ownerErr != nil {
+				return ownerErr
+			}
+		}
+	}
+	return nil
+}
+
+// IsPhantomOwner returns whether `owner` is not a tree that exists:
+// neither one of the well-known trees that may own nodes, nor a
+// subvolume (or other tree) that the forrest can find a root for.  It
+// only looks the tree up if the ID is in the range that subvolume IDs
+// are allocated from, so it is cheap for well-known IDs.
+func IsPhantomOwner(ctx context.Context, forrest Forrest, owner btrfsprim.ObjID) bool {
+	switch owner {
+	case btrfsprim.ROOT_TREE_OBJECTID,
+		btrfsprim.EXTENT_TREE_OBJECTID,
+		btrfsprim.CHUNK_TREE_OBJECTID,
+		btrfsprim.DEV_TREE_OBJECTID,
+		btrfsprim.FS_TREE_OBJECTID,
+		btrfsprim.CSUM_TREE_OBJECTID,
+		btrfsprim.QUOTA_TREE_OBJECTID,
+		btrfsprim.UUID_TREE_OBJECTID,
+		btrfsprim.FREE_SPACE_TREE_OBJECTID,
+		btrfsprim.BLOCK_GROUP_TREE_OBJECTID,
+		btrfsprim.TREE_LOG_OBJECTID,
+		btrfsprim.TREE_RELOC_OBJECTID,
+		btrfsprim.DATA_RELOC_TREE_OBJECTID:
+		return false
+	}
+	if owner < btrfsprim.FIRST_FREE_OBJECTID || owner > btrfsprim.LAST_FREE_OBJECTID {
+		return true
+	}
+	_, err := forrest.ForrestLookup(ctx, owner)
+	return errors.Is(err, ErrNoTree)
+}
+
+func checkOwner(
+	ctx context.Context, forrest Forrest, treeID btrfsprim.ObjID,
+	ownerToCheck btrfsprim.ObjID, genToCheck btrfsprim.Generation,
 ) error {
 	var stack []btrfsprim.ObjID
 	for {
@@ -166,7 +258,7 @@ func CheckOwner(
 			return fmt.Errorf("owner=%v is not acceptable in this tree",
 				ownerToCheck)
 		}
-		if genToCheck > parentGen {
+		if cmp, ok := genToCheck.CompareKnown(parentGen); !ok || cmp > 0 {
 			return fmt.Errorf("claimed owner=%v might be acceptable in this tree (if generation<=%v) but not with claimed generation=%v",
 				ownerToCheck, parentGen, genToCheck)
 		}
@@ -0,0 +1,111 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfstree_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/datawire/dlib/derror"
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+type parentOnlyTree struct {
+	btrfstree.Tree
+	parentID  btrfsprim.ObjID
+	parentGen btrfsprim.Generation
+}
+
+func (t parentOnlyTree) TreeParentID(context.Context) (btrfsprim.ObjID, btrfsprim.Generation, error) {
+	return t.parentID, t.parentGen, nil
+}
+
+// parentOnlyForrest is a Forrest of parentOnlyTrees, that records
+// which trees were looked up.
+type parentOnlyForrest struct {
+	trees  map[btrfsprim.ObjID]parentOnlyTree
+	looked map[btrfsprim.ObjID]bool
+}
+
+func (f parentOnlyForrest) ForrestLookup(_ context.Context, treeID btrfsprim.ObjID) (btrfstree.Tree, error) {
+	f.looked[treeID] = true
+	tree, ok := f.trees[treeID]
+	if !ok {
+		return nil, btrfstree.ErrNoTree
+	}
+	return tree, nil
+}
+
+func TestCheckOwnerPhantom(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	forrest := parentOnlyForrest{
+		trees: map[btrfsprim.ObjID]parentOnlyTree{
+			btrfsprim.FS_TREE_OBJECTID: {},
+			256:                        {},
+			257:                        {parentID: 256, parentGen: 100},
+		},
+		looked: make(map[btrfsprim.ObjID]bool),
+	}
+	checkOwner := func(treeID, owner btrfsprim.ObjID, gen btrfsprim.Generation) error {
+		t.Helper()
+		err := btrfstree.CheckOwner(ctx, forrest, treeID, owner, gen)
+		// CheckOwner itself never diagnoses phantom owners.
+		assert.False(t, errors.Is(err, btrfstree.ErrPhantomOwner))
+		if err != nil {
+			var ownerErr *btrfstree.OwnerError
+			if assert.True(t, errors.As(err, &ownerErr)) {
+				assert.Equal(t, treeID, ownerErr.Tree)
+				assert.Equal(t, owner, ownerErr.Owner)
+			}
+		}
+		// Wrap the error the way that reading a node does.
+		return &btrfstree.NodeError[btrfsvol.LogicalAddr]{
+			Op: "btrfstree.ReadNode", NodeAddr: 0x1000,
+			Err: derror.MultiError{btrfstree.ErrEmptyNode, err},
+		}
+	}
+
+	// OK.
+	assert.NoError(t, btrfstree.CheckOwner(ctx, forrest, 257, 257, 200))
+	assert.NoError(t, btrfstree.CheckOwner(ctx, forrest, 257, 256, 50))
+
+	// Wrong, but a real tree: misplaced, not phantom.
+	err := btrfstree.DiagnosePhantomOwner(ctx, forrest, checkOwner(257, 256, 150))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, btrfstree.ErrPhantomOwner))
+	err = btrfstree.DiagnosePhantomOwner(ctx, forrest, checkOwner(257, btrfsprim.EXTENT_TREE_OBJECTID, 50))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, btrfstree.ErrPhantomOwner))
+
+	// A subvolume ID with no ROOT_ITEM.  Checking the owner
+	// doesn't look it up; only diagnosing the error does.
+	err = checkOwner(257, 300, 50)
+	assert.False(t, forrest.looked[300])
+	err = btrfstree.DiagnosePhantomOwner(ctx, forrest, err)
+	assert.True(t, forrest.looked[300])
+	assert.True(t, errors.Is(err, btrfstree.ErrPhantomOwner))
+	assert.True(t, errors.Is(err, btrfstree.ErrEmptyNode))
+	var phantom *btrfstree.PhantomOwnerError
+	if assert.True(t, errors.As(err, &phantom)) {
+		assert.Equal(t, btrfsprim.ObjID(257), phantom.Tree)
+		assert.Equal(t, btrfsprim.ObjID(300), phantom.Owner)
+	}
+
+	// Not even in the range that tree IDs come from.
+	err = btrfstree.DiagnosePhantomOwner(ctx, forrest, checkOwner(257, 0x1234_5678_9abc, 50))
+	assert.True(t, errors.Is(err, btrfstree.ErrPhantomOwner))
+	err = btrfstree.DiagnosePhantomOwner(ctx, forrest, checkOwner(257, 100, 50))
+	assert.True(t, errors.Is(err, btrfstree.ErrPhantomOwner))
+
+	// Errors that aren't about the owner are left alone.
+	assert.Equal(t, btrfstree.ErrEmptyNode, btrfstree.DiagnosePhantomOwner(ctx, forrest, btrfstree.ErrEmptyNode))
+}
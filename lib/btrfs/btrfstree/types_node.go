@@ -9,8 +9,6 @@ import (
 	"errors"
 	"fmt"
 
-	"git.lukeshu.com/go/typedsync"
-
 	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
@@ -91,6 +89,11 @@ type Node struct {
 	BodyLeaf     []Item       // for leave nodes
 
 	Padding []byte
+
+	// Partial is set if only the beginning of the node could be
+	// read, and the body is what could be salvaged from that; see
+	// ReadNodeConfig.SalvagePartial.
+	Partial bool
 }
 
 type NodeHeader struct {
@@ -300,6 +303,61 @@ type Item struct {
 	Body     btrfsitem.Item
 }
 
+// CheckBodySize returns an *ItemSizeError if re-encoding the item's
+// body gives a different number of bytes than BodySize (the DataSize
+// from the item's header).
+func (item Item) CheckBodySize() error {
+	dat, err := binstruct.Marshal(item.Body)
+	if err != nil {
+		return fmt.Errorf("item %v: re-encode body: %w", item.Key, err)
+	}
+	if len(dat) != int(item.BodySize) {
+		return &ItemSizeError{
+			Key:        item.Key,
+			HeaderSize: item.BodySize,
+			BodySize:   len(dat),
+		}
+	}
+	return nil
+}
+
+// An ItemSizeError is returned by Item.CheckBodySize when an item's
+// decoded body does not agree with the size in the item's header;
+// this means either that the body was decoded wrong, or that the
+// header is lying about it.
+type ItemSizeError struct {
+	Key        btrfsprim.Key
+	HeaderSize uint32
+	BodySize   int
+}
+
+func (e *ItemSizeError) Error() string {
+	return fmt.Sprintf("item %v: body size disagrees with header: header says %v bytes, but body re-encodes to %v bytes",
+		e.Key, e.HeaderSize, e.BodySize)
+}
+
+// checkItemSizes is the ReadNodeConfig.StrictItemSizes part of
+// reading a node that has been successfully parsed from nodeBuf.
+func (node *Node) checkItemSizes(nodeBuf []byte) {
+	bodyBuf := nodeBuf[nodeHeaderSize:]
+	for i := range node.BodyLeaf {
+		item := &node.BodyLeaf[i]
+		if _, isErr := item.Body.(*btrfsitem.Error); isErr {
+			continue
+		}
+		if err := item.CheckBodySize(); err != nil {
+			var itemHead ItemHeader
+			if _, _err := binstruct.Unmarshal(bodyBuf[i*itemHeaderSize:], &itemHead); _err != nil {
+				// The node parsed, so this can't fail.
+				panic(fmt.Errorf("should not happen: %w", _err))
+			}
+			dataBuf := bodyBuf[itemHead.DataOffset : itemHead.DataOffset+itemHead.DataSize]
+			item.Body.Free()
+			item.Body = btrfsitem.NewError(dataBuf, err)
+		}
+	}
+}
+
 type ItemHeader struct {
 	Key           btrfsprim.Key `bin:"off=0x0, siz=0x11"`
 	DataOffset    uint32        `bin:"off=0x11, siz=0x4"` // [ignored-when-writing] relative to the end of the header (0x65)
@@ -420,9 +478,10 @@ func (e *IOError) Error() string { return "i/o error: " + e.Err.Error() }
 func (e *IOError) Unwrap() error { return e.Err }
 
 var (
-	bytePool containers.SlicePool[byte]
-	itemPool containers.SlicePool[Item]
-	nodePool = typedsync.Pool[*Node]{
+	bytePool = containers.SlicePool[byte]{Name: "btrfstree.bytePool"}
+	itemPool = containers.SlicePool[Item]{Name: "btrfstree.itemPool"}
+	nodePool = containers.Pool[*Node]{
+		Name: "btrfstree.nodePool",
 		New: func() *Node {
 			return new(Node)
 		},
@@ -452,6 +511,51 @@ func (node *Node) RawFree() {
 // *NodeError[Addr].  Notable errors that may be inside of the
 // NodeError are ErrNotANode and *IOError.
 func ReadNode[Addr ~int64](fs diskio.ReaderAt[Addr], sb Superblock, addr Addr) (*Node, error) {
+	return ReadNodeWithConfig(fs, sb, addr, ReadNodeConfig{})
+}
+
+// ReadNodeNoChecksum is like ReadNode, but skips verifying the node's
+// checksum, which is a significant portion of the CPU cost of reading
+// a node.  The MetadataUUID check is still performed, so
+// obviously-not-a-node blocks are still rejected; but a corrupt node
+// will be parsed as if it were good.  This is only appropriate for
+// images that are trusted to be free of corruption.
+func ReadNodeNoChecksum[Addr ~int64](fs diskio.ReaderAt[Addr], sb Superblock, addr Addr) (*Node, error) {
+	return ReadNodeWithConfig(fs, sb, addr, ReadNodeConfig{NoVerifyChecksum: true})
+}
+
+// ReadNodeConfig is the options for ReadNodeWithConfig.  The zero
+// value is the same as ReadNode.
+type ReadNodeConfig struct {
+	// NoVerifyChecksum skips verifying the node's checksum; see
+	// ReadNodeNoChecksum.
+	NoVerifyChecksum bool
+
+	// StrictItemSizes causes each item of a leaf node to have its
+	// body re-encoded and checked with Item.CheckBodySize; an item
+	// that fails the check has its body replaced by a
+	// *btrfsitem.Error wrapping the *ItemSizeError.  It is off by
+	// default, as it costs an encode of every item that is read.
+	StrictItemSizes bool
+
+	// SalvagePartial turns on salvaging nodes that could only be
+	// partially read (such as a node at the very end of a
+	// truncated image, or a node whose tail is unreadable).  When
+	// on, as many key-pointers or items as can be are parsed out
+	// of the part of the node that was read, and that node (with
+	// .Partial set) is returned along with an error that wraps
+	// both ErrPartialNode and the *IOError.  When off, such a
+	// node is simply an *IOError.
+	//
+	// Because the node's checksum cannot be verified, and because
+	// the node is returned with an error, a salvaged node is
+	// never treated as good; it is for callers that inspect bad
+	// nodes, or that explicitly opt in to trusting partial nodes.
+	SalvagePartial bool
+}
+
+// ReadNodeWithConfig is ReadNode, but with the options in `cfg`.
+func ReadNodeWithConfig[Addr ~int64](fs diskio.ReaderAt[Addr], sb Superblock, addr Addr, cfg ReadNodeConfig) (*Node, error) {
 	if int(sb.NodeSize) < nodeHeaderSize {
 		return nil, &NodeError[Addr]{
 			Op: "btrfstree.ReadNode", NodeAddr: addr,
@@ -460,7 +564,12 @@ func ReadNode[Addr ~int64](fs diskio.ReaderAt[Addr], sb Superblock, addr Addr) (
 		}
 	}
 	nodeBuf := bytePool.Get(int(sb.NodeSize))
-	if _, err := fs.ReadAt(nodeBuf, addr); err != nil {
+	if n, err := fs.ReadAt(nodeBuf, addr); err != nil {
+		if cfg.SalvagePartial && n >= nodeHeaderSize {
+			node, err := readPartialNode(nodeBuf[:n], sb, err)
+			bytePool.Put(nodeBuf)
+			return node, &NodeError[Addr]{Op: "btrfstree.ReadNode", NodeAddr: addr, Err: err}
+		}
 		bytePool.Put(nodeBuf)
 		return nil, &NodeError[Addr]{Op: "btrfstree.ReadNode", NodeAddr: addr, Err: &IOError{Err: err}}
 	}
@@ -484,18 +593,20 @@ func ReadNode[Addr ~int64](fs diskio.ReaderAt[Addr], sb Superblock, addr Addr) (
 		return node, &NodeError[Addr]{Op: "btrfstree.ReadNode", NodeAddr: addr, Err: ErrNotANode}
 	}
 
-	stored := node.Head.Checksum
-	calced, err := node.ChecksumType.Sum(nodeBuf[csumSize:])
-	if err != nil {
-		bytePool.Put(nodeBuf)
-		return node, &NodeError[Addr]{Op: "btrfstree.ReadNode", NodeAddr: addr, Err: err}
-	}
-	if stored != calced {
-		bytePool.Put(nodeBuf)
-		return node, &NodeError[Addr]{
-			Op: "btrfstree.ReadNode", NodeAddr: addr,
-			Err: fmt.Errorf("looks like a node but is corrupt: checksum mismatch: stored=%v calculated=%v",
-				stored, calced),
+	if !cfg.NoVerifyChecksum {
+		stored := node.Head.Checksum
+		calced, err := node.ChecksumType.Sum(nodeBuf[csumSize:])
+		if err != nil {
+			bytePool.Put(nodeBuf)
+			return node, &NodeError[Addr]{Op: "btrfstree.ReadNode", NodeAddr: addr, Err: err}
+		}
+		if stored != calced {
+			bytePool.Put(nodeBuf)
+			return node, &NodeError[Addr]{
+				Op: "btrfstree.ReadNode", NodeAddr: addr,
+				Err: fmt.Errorf("looks like a node but is corrupt: checksum mismatch: stored=%v calculated=%v",
+					stored, calced),
+			}
 		}
 	}
 
@@ -515,6 +626,10 @@ func ReadNode[Addr ~int64](fs diskio.ReaderAt[Addr], sb Superblock, addr Addr) (
 		return node, &NodeError[Addr]{Op: "btrfstree.ReadNode", NodeAddr: addr, Err: err}
 	}
 
+	if cfg.StrictItemSizes {
+		node.checkItemSizes(nodeBuf)
+	}
+
 	bytePool.Put(nodeBuf)
 
 	// return
@@ -0,0 +1,119 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfstree
+
+import (
+	"errors"
+	"fmt"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+)
+
+// ErrPartialNode is wrapped by the error that ReadNodeWithConfig
+// returns (along with a non-nil node that has .Partial set) for a node
+// of which only the beginning could be read; see
+// ReadNodeConfig.SalvagePartial.
+var ErrPartialNode = errors.New("node was only partially read")
+
+// unmarshalPartial is like UnmarshalBinary, but for a node of which
+// only the first len(nodeBuf) bytes could be read; node.Size must
+// already be set to the full size of the node.  Decoding stops at the
+// first key-pointer or item header that is not entirely within
+// nodeBuf, or that is not consistent with the ones before it.  A leaf
+// item whose header was read but whose body was not is kept, with a
+// *btrfsitem.Error body.
+func (node *Node) unmarshalPartial(nodeBuf []byte) error {
+	*node = Node{
+		Size:         node.Size,
+		ChecksumType: node.ChecksumType,
+		Partial:      true,
+	}
+	if len(nodeBuf) < nodeHeaderSize {
+		return fmt.Errorf("only read %v bytes, which is not enough for the %v-byte header",
+			len(nodeBuf), nodeHeaderSize)
+	}
+	if _, err := binstruct.Unmarshal(nodeBuf, &node.Head); err != nil {
+		return err
+	}
+	bodyBuf := nodeBuf[nodeHeaderSize:]
+	numItems := int(node.Head.NumItems)
+	if maxItems := int(node.MaxItems()); numItems > maxItems {
+		numItems = maxItems
+	}
+
+	if node.Head.Level > 0 {
+		node.BodyInterior = make([]KeyPointer, 0, numItems)
+		for i := 0; i < numItems; i++ {
+			off := i * keyPointerSize
+			if off+keyPointerSize > len(bodyBuf) {
+				break
+			}
+			var kp KeyPointer
+			if _, err := binstruct.Unmarshal(bodyBuf[off:], &kp); err != nil {
+				break
+			}
+			node.BodyInterior = append(node.BodyInterior, kp)
+		}
+		return nil
+	}
+
+	node.BodyLeaf = itemPool.Get(numItems)
+	tail := int(node.Size) - nodeHeaderSize
+	cnt := 0
+	for ; cnt < numItems; cnt++ {
+		head := cnt * itemHeaderSize
+		if head+itemHeaderSize > len(bodyBuf) {
+			break
+		}
+		var itemHead ItemHeader
+		if _, err := binstruct.Unmarshal(bodyBuf[head:], &itemHead); err != nil {
+			break
+		}
+		dataOff := int(itemHead.DataOffset)
+		dataSize := int(itemHead.DataSize)
+		if dataOff < head+itemHeaderSize || dataOff+dataSize != tail {
+			break
+		}
+		tail = dataOff
+
+		item := Item{
+			Key:      itemHead.Key,
+			BodySize: itemHead.DataSize,
+		}
+		if dataOff+dataSize <= len(bodyBuf) {
+			item.Body = btrfsitem.UnmarshalItem(itemHead.Key, node.ChecksumType, bodyBuf[dataOff:dataOff+dataSize])
+		} else {
+			item.Body = btrfsitem.NewError(nil, fmt.Errorf("item %v: body: %w", cnt, ErrPartialNode))
+		}
+		node.BodyLeaf[cnt] = item
+	}
+	node.BodyLeaf = node.BodyLeaf[:cnt]
+	return nil
+}
+
+// readPartialNode is the part of readNode that handles a node of
+// which only nodeBuf could be read, failing with readErr.  The
+// checksum can't be verified, but the MetadataUUID check is still
+// performed, so that a partially read block that is not a node is
+// still rejected.
+func readPartialNode(nodeBuf []byte, sb Superblock, readErr error) (*Node, error) {
+	node, _ := nodePool.Get()
+	node.Size = sb.NodeSize
+	node.ChecksumType = sb.ChecksumType
+	if _, err := binstruct.Unmarshal(nodeBuf, &node.Head); err != nil {
+		node.RawFree()
+		return nil, &IOError{Err: readErr}
+	}
+	if node.Head.MetadataUUID != sb.EffectiveMetadataUUID() {
+		return node, ErrNotANode
+	}
+	if err := node.unmarshalPartial(nodeBuf); err != nil {
+		node.RawFree()
+		return nil, &IOError{Err: readErr}
+	}
+	return node, fmt.Errorf("%w: only read %v of %v bytes: %w",
+		ErrPartialNode, len(nodeBuf), sb.NodeSize, &IOError{Err: readErr})
+}
@@ -5,13 +5,22 @@
 package btrfstree_test
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
 )
 
 func FuzzRoundTripNode(f *testing.F) {
@@ -32,3 +41,170 @@ func FuzzRoundTripNode(f *testing.F) {
 		}
 	})
 }
+
+func TestItemCheckBodySize(t *testing.T) {
+	t.Parallel()
+	key := btrfsprim.Key{ObjectID: 256, ItemType: btrfsitem.INODE_ITEM_KEY}
+	inodeSize := uint32(binstruct.StaticSize(btrfsitem.Inode{}))
+
+	assert.NoError(t, btrfstree.Item{Key: key, BodySize: inodeSize, Body: &btrfsitem.Inode{}}.CheckBodySize())
+
+	err := btrfstree.Item{Key: key, BodySize: inodeSize + 8, Body: &btrfsitem.Inode{}}.CheckBodySize()
+	var sizeErr *btrfstree.ItemSizeError
+	require.True(t, errors.As(err, &sizeErr), "err=%v", err)
+	assert.Equal(t, &btrfstree.ItemSizeError{Key: key, HeaderSize: inodeSize + 8, BodySize: int(inodeSize)}, sizeErr)
+}
+
+func TestStrictItemSizes(t *testing.T) {
+	t.Parallel()
+	_, _, nodes, items := buildTree(t, 10)
+	require.Len(t, nodes, 1)
+
+	for addr, dat := range nodes {
+		img := make(truncatedImage, int(addr)+len(dat))
+		copy(img[addr:], dat)
+		sb := btrfstree.Superblock{
+			NodeSize:     uint32(len(dat)),
+			ChecksumType: btrfssum.TYPE_CRC32,
+		}
+		node, err := btrfstree.ReadNodeWithConfig[btrfsvol.LogicalAddr](img, sb, addr, btrfstree.ReadNodeConfig{
+			StrictItemSizes: true,
+		})
+		require.NoError(t, err)
+		require.Len(t, node.BodyLeaf, len(items))
+		for i, item := range node.BodyLeaf {
+			assert.IsType(t, &btrfsitem.Inode{}, item.Body, "item %v", i)
+		}
+		node.RawFree()
+	}
+}
+
+type truncatedImage []byte
+
+func (img truncatedImage) ReadAt(p []byte, off btrfsvol.LogicalAddr) (int, error) {
+	if int(off) >= len(img) {
+		return 0, io.EOF
+	}
+	n := copy(p, img[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestSalvagePartialNodes(t *testing.T) {
+	t.Parallel()
+	_, _, nodes, items := buildTree(t, 10)
+	require.Len(t, nodes, 1)
+	var addr btrfsvol.LogicalAddr
+	var dat []byte
+	for nodeAddr, nodeDat := range nodes {
+		addr, dat = nodeAddr, nodeDat
+	}
+	sb := btrfstree.Superblock{
+		NodeSize:     uint32(len(dat)),
+		ChecksumType: btrfssum.TYPE_CRC32,
+	}
+	// Item bodies are packed at the end of the node, in reverse
+	// order; cut off all of the first 2 items' bodies, and part of
+	// the 3rd's.
+	bodySize := binstruct.StaticSize(btrfsitem.Inode{})
+	img := make(truncatedImage, int(addr)+len(dat)-(2*bodySize+10))
+	copy(img[addr:], dat)
+
+	node, err := btrfstree.ReadNode[btrfsvol.LogicalAddr](img, sb, addr)
+	assert.Nil(t, node)
+	var ioErr *btrfstree.IOError
+	assert.True(t, errors.As(err, &ioErr), "err=%v", err)
+	assert.False(t, errors.Is(err, btrfstree.ErrPartialNode), "err=%v", err)
+
+	cfg := btrfstree.ReadNodeConfig{SalvagePartial: true}
+	node, err = btrfstree.ReadNodeWithConfig[btrfsvol.LogicalAddr](img, sb, addr, cfg)
+	assert.True(t, errors.Is(err, btrfstree.ErrPartialNode), "err=%v", err)
+	assert.True(t, errors.As(err, &ioErr), "err=%v", err)
+	require.NotNil(t, node)
+	assert.True(t, node.Partial)
+	require.Len(t, node.BodyLeaf, len(items))
+	for i, item := range node.BodyLeaf {
+		assert.Equal(t, items[i].Key, item.Key, "item %v", i)
+		if i < 3 {
+			assert.IsType(t, &btrfsitem.Error{}, item.Body, "item %v", i)
+		} else {
+			assert.Equal(t, items[i].Body, item.Body, "item %v", i)
+		}
+	}
+	node.RawFree()
+
+	// Cutting in to the item headers drops the items whose
+	// headers are missing.
+	headSize := binstruct.StaticSize(btrfstree.NodeHeader{})
+	itemHeadSize := binstruct.StaticSize(btrfstree.ItemHeader{})
+	img = img[:int(addr)+headSize+4*itemHeadSize+5]
+	node, err = btrfstree.ReadNodeWithConfig[btrfsvol.LogicalAddr](img, sb, addr, cfg)
+	assert.True(t, errors.Is(err, btrfstree.ErrPartialNode), "err=%v", err)
+	require.NotNil(t, node)
+	assert.Len(t, node.BodyLeaf, 4)
+	node.RawFree()
+}
+
+// TestRetainedErrorItem checks that an Error item's raw bytes (which
+// are used to salvage what can be salvaged from a malformed item) stay
+// intact after the buffer that the node was read in to has been
+// recycled and overwritten.  Run it with -race: the junk reads happen
+// concurrently with reading the retained bytes.
+//
+//nolint:paralleltest // Can't be parallel because SetPoolDebug is global.
+func TestRetainedErrorItem(t *testing.T) {
+	// Pool debugging makes the pools hand back the most recently
+	// freed buffers deterministically.
+	containers.SetPoolDebug(true)
+	t.Cleanup(func() { containers.SetPoolDebug(false) })
+
+	_, _, nodes, _ := buildTree(t, 10)
+	require.Len(t, nodes, 1)
+	var addr btrfsvol.LogicalAddr
+	var dat []byte
+	for nodeAddr, nodeDat := range nodes {
+		addr, dat = nodeAddr, nodeDat
+	}
+	sb := btrfstree.Superblock{
+		NodeSize:     uint32(len(dat)),
+		ChecksumType: btrfssum.TYPE_CRC32,
+	}
+	// Give the first item an unknown item type, so that it is
+	// parsed as an Error item.
+	dat = bytes.Clone(dat)
+	dat[binstruct.StaticSize(btrfstree.NodeHeader{})+8] = 2
+	img := make(truncatedImage, int(addr)+len(dat))
+	copy(img[addr:], dat)
+
+	junk := make(truncatedImage, int(addr)+len(dat))
+	for i := range junk {
+		junk[i] = 0xAA
+	}
+
+	node, err := btrfstree.ReadNodeNoChecksum[btrfsvol.LogicalAddr](img, sb, addr)
+	require.NoError(t, err)
+	require.IsType(t, &btrfsitem.Error{}, node.BodyLeaf[0].Body)
+	exp := bytes.Clone(node.BodyLeaf[0].Body.(*btrfsitem.Error).Dat) //nolint:forcetypeassert // checked above
+	clone := node.BodyLeaf[0].Body.CloneItem()
+	node.RawFree()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				junkNode, _ := btrfstree.ReadNode[btrfsvol.LogicalAddr](junk, sb, addr)
+				junkNode.RawFree()
+			}
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		assert.Equal(t, exp, clone.(*btrfsitem.Error).Dat) //nolint:forcetypeassert // checked above
+	}
+	wg.Wait()
+	assert.Equal(t, exp, clone.(*btrfsitem.Error).Dat) //nolint:forcetypeassert // checked above
+	clone.Free()
+}
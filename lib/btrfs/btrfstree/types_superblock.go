@@ -42,7 +42,7 @@ type Superblock struct {
 
 	ChunkRootGeneration btrfsprim.Generation `bin:"off=0xa4, siz=0x8"`
 	CompatFlags         uint64               `bin:"off=0xac, siz=0x8"` // compat_flags
-	CompatROFlags       uint64               `bin:"off=0xb4, siz=0x8"` // compat_ro_flags - only implementations that support the flags can write to the filesystem
+	CompatROFlags       CompatROFlags        `bin:"off=0xb4, siz=0x8"` // compat_ro_flags - only implementations that support the flags can write to the filesystem
 	IncompatFlags       IncompatFlags        `bin:"off=0xbc, siz=0x8"` // incompat_flags - only implementations that support the flags can use the filesystem
 	ChecksumType        btrfssum.CSumType    `bin:"off=0xc4, siz=0x2"`
 
@@ -114,6 +114,17 @@ func (sb Superblock) EffectiveMetadataUUID() btrfsprim.UUID {
 	return sb.MetadataUUID
 }
 
+// BlockGroupTree returns the ID of the tree that BLOCK_GROUP_ITEMs
+// live in: the BLOCK_GROUP_TREE if the filesystem has the
+// block-group-tree feature, or else (the legacy layout) the
+// EXTENT_TREE.
+func (sb Superblock) BlockGroupTree() btrfsprim.ObjID {
+	if sb.CompatROFlags.Has(FeatureCompatROBlockGroupTree) {
+		return btrfsprim.BLOCK_GROUP_TREE_OBJECTID
+	}
+	return btrfsprim.EXTENT_TREE_OBJECTID
+}
+
 type SysChunk struct {
 	Key   btrfsprim.Key
 	Chunk btrfsitem.Chunk
@@ -196,6 +207,27 @@ type RootBackup struct {
 	binstruct.End `bin:"off=0xa8"`
 }
 
+type CompatROFlags uint64
+
+const (
+	FeatureCompatROFreeSpaceTree CompatROFlags = 1 << iota
+	FeatureCompatROFreeSpaceTreeValid
+	FeatureCompatROVerity
+	FeatureCompatROBlockGroupTree
+)
+
+var compatROFlagNames = []string{
+	"FeatureCompatROFreeSpaceTree",
+	"FeatureCompatROFreeSpaceTreeValid",
+	"FeatureCompatROVerity",
+	"FeatureCompatROBlockGroupTree",
+}
+
+func (f CompatROFlags) Has(req CompatROFlags) bool { return f&req == req }
+func (f CompatROFlags) String() string {
+	return fmtutil.BitfieldString(f, compatROFlagNames, fmtutil.HexLower)
+}
+
 type IncompatFlags uint64
 
 const (
@@ -0,0 +1,216 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfstree
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+// SuperblockMagic is the value of Superblock.Magic.
+var SuperblockMagic = [8]byte{'_', 'B', 'H', 'R', 'f', 'S', '_', 'M'}
+
+const (
+	minNodeSize = 4 * 1024
+	maxNodeSize = 64 * 1024
+)
+
+// A SuperblockProblem is a single implausible value found by
+// Superblock.Validate.
+type SuperblockProblem struct {
+	// Field is the name of the Superblock field that the problem
+	// is with.
+	Field string
+	// Fatal is whether the superblock cannot be used as-is; if
+	// false, then the value is suspicious, but recovery may
+	// proceed with a warning.
+	Fatal bool
+	Msg   string
+}
+
+func (p SuperblockProblem) Error() string {
+	return p.Field + ": " + p.Msg
+}
+
+// A SuperblockReport is the list of problems found by
+// Superblock.Validate.  An empty report means that no problems were
+// found.
+type SuperblockReport []SuperblockProblem
+
+// HasFatal returns whether any of the problems in the report are
+// fatal.
+func (r SuperblockReport) HasFatal() bool {
+	for _, p := range r {
+		if p.Fatal {
+			return true
+		}
+	}
+	return false
+}
+
+// Err returns an error describing all of the fatal problems in the
+// report, or nil if there are none.
+func (r SuperblockReport) Err() error {
+	var msgs []string
+	for _, p := range r {
+		if p.Fatal {
+			msgs = append(msgs, p.Error())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("superblock: %s", strings.Join(msgs, "; "))
+}
+
+func (r *SuperblockReport) add(fatal bool, field, format string, args ...any) {
+	*r = append(*r, SuperblockProblem{
+		Field: field,
+		Fatal: fatal,
+		Msg:   fmt.Sprintf(format, args...),
+	})
+}
+
+// Validate sanity-checks the superblock's fields against each other,
+// and against the sizes of the devices that make up the filesystem
+// (which may be nil, or may be missing devices, in which case the
+// checks that need them are skipped).
+//
+// This does not check the superblock's checksum; use
+// .ValidateChecksum() for that.
+func (sb Superblock) Validate(devSizes map[btrfsvol.DeviceID]btrfsvol.PhysicalAddr) SuperblockReport {
+	var r SuperblockReport
+
+	if sb.Magic != SuperblockMagic {
+		r.add(true, "Magic", "is %q, not %q", sb.Magic[:], SuperblockMagic[:])
+	}
+	if sb.ChecksumType > btrfssum.TYPE_BLAKE2 {
+		r.add(true, "ChecksumType", "unknown checksum type %v", sb.ChecksumType)
+	}
+
+	// Sizes
+
+	sizesOK := true
+	if sb.SectorSize == 0 || bits.OnesCount32(sb.SectorSize) != 1 {
+		r.add(true, "SectorSize", "%v is not a power of two", sb.SectorSize)
+		sizesOK = false
+	} else if sb.SectorSize < minNodeSize || sb.SectorSize > maxNodeSize {
+		r.add(false, "SectorSize", "%v is outside of the usual range [%v, %v]", sb.SectorSize, minNodeSize, maxNodeSize)
+	}
+	if sb.NodeSize == 0 || bits.OnesCount32(sb.NodeSize) != 1 {
+		r.add(true, "NodeSize", "%v is not a power of two", sb.NodeSize)
+		sizesOK = false
+	} else if sb.NodeSize < sb.SectorSize || sb.NodeSize > maxNodeSize {
+		r.add(true, "NodeSize", "%v is outside of the valid range [SectorSize=%v, %v]", sb.NodeSize, sb.SectorSize, maxNodeSize)
+	}
+	if sb.LeafSize != sb.NodeSize {
+		r.add(false, "LeafSize", "%v does not match NodeSize=%v", sb.LeafSize, sb.NodeSize)
+	}
+
+	// Usage
+
+	if sb.BytesUsed > sb.TotalBytes {
+		r.add(false, "BytesUsed", "%v is greater than TotalBytes=%v", sb.BytesUsed, sb.TotalBytes)
+	}
+	if sizesOK && sb.BytesUsed < 6*uint64(sb.NodeSize) {
+		// A fresh filesystem has at least 6 trees, each with
+		// at least one node.
+		r.add(false, "BytesUsed", "%v is less than 6*NodeSize=%v", sb.BytesUsed, 6*uint64(sb.NodeSize))
+	}
+
+	// Roots
+
+	for _, root := range []struct {
+		Name     string
+		Addr     btrfsvol.LogicalAddr
+		Level    uint8
+		Optional bool
+	}{
+		{"RootTree", sb.RootTree, sb.RootLevel, false},
+		{"ChunkTree", sb.ChunkTree, sb.ChunkLevel, false},
+		{"LogTree", sb.LogTree, sb.LogLevel, true},
+		{"BlockGroupRoot", sb.BlockGroupRoot, sb.BlockGroupRootLevel, true},
+	} {
+		if root.Addr == 0 {
+			if !root.Optional {
+				r.add(true, root.Name, "is not set")
+			}
+			continue
+		}
+		if sizesOK && root.Addr%btrfsvol.LogicalAddr(sb.SectorSize) != 0 {
+			r.add(!root.Optional, root.Name, "%v is not aligned to SectorSize=%v", root.Addr, sb.SectorSize)
+		}
+		if root.Level > MaxLevel {
+			r.add(!root.Optional, root.Name, "level %v is greater than the maximum level %v", root.Level, MaxLevel)
+		}
+	}
+	switch hasBGTree := sb.CompatROFlags.Has(FeatureCompatROBlockGroupTree); {
+	case hasBGTree && sb.BlockGroupRoot == 0:
+		r.add(true, "BlockGroupRoot", "is not set, but the filesystem has the block-group-tree feature")
+	case !hasBGTree && sb.BlockGroupRoot != 0:
+		r.add(false, "BlockGroupRoot", "%v is set, but the filesystem does not have the block-group-tree feature (and so it will be ignored)",
+			sb.BlockGroupRoot)
+	}
+	if sb.ChunkRootGeneration > sb.Generation {
+		r.add(false, "ChunkRootGeneration", "%v is newer than Generation=%v", sb.ChunkRootGeneration, sb.Generation)
+	}
+
+	// Chunks
+
+	if sb.SysChunkArraySize > uint32(len(sb.SysChunkArray)) {
+		r.add(true, "SysChunkArraySize", "%v is greater than the maximum %v", sb.SysChunkArraySize, len(sb.SysChunkArray))
+	} else if syschunks, err := sb.ParseSysChunkArray(); err != nil {
+		r.add(true, "SysChunkArray", "%v", err)
+	} else {
+		chunkTreeMapped := false
+		for _, chunk := range syschunks {
+			beg := btrfsvol.LogicalAddr(chunk.Key.Offset)
+			end := beg.Add(chunk.Chunk.Head.Size)
+			if sb.ChunkTree >= beg && sb.ChunkTree < end {
+				chunkTreeMapped = true
+			}
+			for _, stripe := range chunk.Chunk.Stripes {
+				devSize, ok := devSizes[stripe.DeviceID]
+				if !ok {
+					continue
+				}
+				if stripeEnd := stripe.Offset.Add(chunk.Chunk.Head.Size); stripeEnd > devSize {
+					r.add(false, "SysChunkArray", "chunk %v-%v: stripe on device %v ends at %v, beyond the end of the device at %v",
+						beg, end, stripe.DeviceID, stripeEnd, devSize)
+				}
+			}
+		}
+		if sb.ChunkTree != 0 && !chunkTreeMapped {
+			r.add(true, "ChunkTree", "%v is not in any of the chunks in SysChunkArray", sb.ChunkTree)
+		}
+	}
+
+	// Devices
+
+	if sb.NumDevices == 0 {
+		r.add(true, "NumDevices", "is 0")
+	} else if devSizes != nil && uint64(len(devSizes)) != sb.NumDevices {
+		r.add(false, "NumDevices", "is %v, but %v devices were given", sb.NumDevices, len(devSizes))
+	}
+	if devSize, ok := devSizes[sb.DevItem.DevID]; ok && btrfsvol.PhysicalAddr(sb.DevItem.NumBytes) > devSize {
+		r.add(false, "DevItem.NumBytes", "%v is greater than the size of device %v (%v); the image may be truncated",
+			sb.DevItem.NumBytes, sb.DevItem.DevID, devSize)
+	}
+	if devSizes != nil && uint64(len(devSizes)) == sb.NumDevices {
+		var total uint64
+		for _, devSize := range devSizes {
+			total += uint64(devSize)
+		}
+		if sb.TotalBytes > total {
+			r.add(false, "TotalBytes", "%v is greater than the total size of all devices (%v)", sb.TotalBytes, total)
+		}
+	}
+
+	return r
+}
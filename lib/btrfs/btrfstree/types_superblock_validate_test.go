@@ -0,0 +1,143 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfstree_test
+
+import (
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+func TestSuperblockValidate(t *testing.T) {
+	t.Parallel()
+
+	mkSB := func(t *testing.T) btrfstree.Superblock {
+		t.Helper()
+		sb := btrfstree.Superblock{
+			Magic:      btrfstree.SuperblockMagic,
+			Generation: 100,
+			RootTree:   0x1d00000,
+			ChunkTree:  0x1504000,
+			TotalBytes: 1 << 30,
+			BytesUsed:  1 << 20,
+			NumDevices: 1,
+			SectorSize: 4096,
+			NodeSize:   16384,
+			LeafSize:   16384,
+			DevItem: btrfsitem.Dev{
+				DevID:    1,
+				NumBytes: 1 << 30,
+			},
+		}
+		dat, err := binstruct.Marshal(btrfstree.SysChunk{
+			Key: btrfsprim.Key{
+				ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID,
+				ItemType: btrfsitem.CHUNK_ITEM_KEY,
+				Offset:   0x1500000,
+			},
+			Chunk: btrfsitem.Chunk{
+				Head: btrfsitem.ChunkHeader{
+					Size:       0x800000,
+					NumStripes: 1,
+				},
+				Stripes: []btrfsitem.ChunkStripe{{DeviceID: 1, Offset: 0x1500000}},
+			},
+		})
+		require.NoError(t, err)
+		sb.SysChunkArraySize = uint32(copy(sb.SysChunkArray[:], dat))
+		return sb
+	}
+	devSizes := map[btrfsvol.DeviceID]btrfsvol.PhysicalAddr{1: 1 << 30}
+
+	sb := mkSB(t)
+	assert.Empty(t, sb.Validate(devSizes))
+	assert.Empty(t, sb.Validate(nil))
+
+	// Suspicious, but usable.
+	sb = mkSB(t)
+	sb.BytesUsed = sb.TotalBytes + 1
+	report := sb.Validate(devSizes)
+	assert.False(t, report.HasFatal())
+	assert.NoError(t, report.Err())
+	assert.Equal(t, []string{"BytesUsed"}, fields(report))
+
+	sb = mkSB(t)
+	report = sb.Validate(map[btrfsvol.DeviceID]btrfsvol.PhysicalAddr{1: 0x1000000})
+	assert.False(t, report.HasFatal())
+	assert.Equal(t, []string{"SysChunkArray", "DevItem.NumBytes", "TotalBytes"}, fields(report))
+
+	sb = mkSB(t)
+	sb.BlockGroupRoot = 0x1d04000
+	report = sb.Validate(devSizes)
+	assert.False(t, report.HasFatal())
+	assert.Equal(t, []string{"BlockGroupRoot"}, fields(report))
+	sb.CompatROFlags |= btrfstree.FeatureCompatROBlockGroupTree
+	assert.Empty(t, sb.Validate(devSizes))
+
+	// Fatal.
+	sb = mkSB(t)
+	sb.NodeSize = 16383
+	sb.LeafSize = 16383
+	report = sb.Validate(devSizes)
+	assert.True(t, report.HasFatal())
+	assert.EqualError(t, report.Err(), "superblock: NodeSize: 16383 is not a power of two")
+
+	sb = mkSB(t)
+	sb.ChunkTree = 0x2000000
+	report = sb.Validate(devSizes)
+	assert.True(t, report.HasFatal())
+	assert.Equal(t, []string{"ChunkTree"}, fields(report))
+
+	sb = mkSB(t)
+	sb.CompatROFlags |= btrfstree.FeatureCompatROBlockGroupTree
+	report = sb.Validate(devSizes)
+	assert.True(t, report.HasFatal())
+	assert.Equal(t, []string{"BlockGroupRoot"}, fields(report))
+}
+
+func TestBlockGroupTree(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, true)
+
+	// Legacy layout: the block groups are in the EXTENT_TREE, and
+	// BlockGroupRoot is ignored even if it has garbage in it.
+	sb := btrfstree.Superblock{
+		BlockGroupRoot:           0x1d04000,
+		BlockGroupRootLevel:      1,
+		BlockGroupRootGeneration: 100,
+	}
+	assert.Equal(t, btrfsprim.EXTENT_TREE_OBJECTID, sb.BlockGroupTree())
+	root, err := btrfstree.LookupTreeRoot(ctx, nil, sb, btrfsprim.BLOCK_GROUP_TREE_OBJECTID)
+	require.NoError(t, err)
+	assert.Equal(t, &btrfstree.TreeRoot{ID: btrfsprim.BLOCK_GROUP_TREE_OBJECTID}, root)
+
+	// block-group-tree layout.
+	sb.CompatROFlags |= btrfstree.FeatureCompatROBlockGroupTree
+	assert.Equal(t, btrfsprim.BLOCK_GROUP_TREE_OBJECTID, sb.BlockGroupTree())
+	root, err = btrfstree.LookupTreeRoot(ctx, nil, sb, btrfsprim.BLOCK_GROUP_TREE_OBJECTID)
+	require.NoError(t, err)
+	assert.Equal(t, &btrfstree.TreeRoot{
+		ID:         btrfsprim.BLOCK_GROUP_TREE_OBJECTID,
+		RootNode:   0x1d04000,
+		Level:      1,
+		Generation: 100,
+	}, root)
+}
+
+func fields(report btrfstree.SuperblockReport) []string {
+	var ret []string
+	for _, problem := range report {
+		ret = append(ret, problem.Field)
+	}
+	return ret
+}
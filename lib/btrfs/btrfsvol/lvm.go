@@ -65,11 +65,15 @@ func (lv *LogicalVolume[PhysicalVolume]) Size() LogicalAddr {
 	return lastChunk.Value.LAddr.Add(lastChunk.Value.Size)
 }
 
+// Close closes every physical volume, even if closing one of them
+// fails.  The errors from each are returned as a derror.MultiError,
+// in order of device ID.
 func (lv *LogicalVolume[PhysicalVolume]) Close() error {
 	var errs derror.MultiError
-	for _, dev := range lv.id2pv {
-		if err := dev.Close(); err != nil && err == nil {
-			errs = append(errs, err)
+	for _, id := range maps.SortedKeys(lv.id2pv) {
+		dev := lv.id2pv[id]
+		if err := dev.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("device %v (%q): %w", id, dev.Name(), err))
 		}
 	}
 	if errs != nil {
@@ -118,6 +122,21 @@ func (lv *LogicalVolume[PhysicalVolume]) AddMapping(m Mapping) error {
 	return lv.addMapping(m, false)
 }
 
+// AddMappings validates and normalizes the list of mappings with
+// NormalizeMappings, and then adds each of them with AddMapping.
+func (lv *LogicalVolume[PhysicalVolume]) AddMappings(ms []Mapping) error {
+	ms, err := NormalizeMappings(ms)
+	if err != nil {
+		return fmt.Errorf("(%p).AddMappings: %w", lv, err)
+	}
+	for _, m := range ms {
+		if err := lv.AddMapping(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (lv *LogicalVolume[PhysicalVolume]) addMapping(m Mapping, dryRun bool) error {
 	lv.init()
 	// sanity check
@@ -144,7 +163,7 @@ func (lv *LogicalVolume[PhysicalVolume]) addMapping(m Mapping, dryRun bool) erro
 	var err error
 	newChunk, err = newChunk.union(logicalOverlaps...)
 	if err != nil {
-		return fmt.Errorf("(%p).AddMapping: %w", lv, err)
+		return fmt.Errorf("(%p).AddMapping: %v: conflicts with existing chunk(s) %v: %w", lv, m, logicalOverlaps, err)
 	}
 
 	// physical2logical
@@ -162,7 +181,7 @@ func (lv *LogicalVolume[PhysicalVolume]) addMapping(m Mapping, dryRun bool) erro
 	})
 	newExt, err = newExt.union(physicalOverlaps...)
 	if err != nil {
-		return fmt.Errorf("(%p).AddMapping: %w", lv, err)
+		return fmt.Errorf("(%p).AddMapping: %v: conflicts with existing dev extent(s) %v: %w", lv, m, physicalOverlaps, err)
 	}
 
 	if newChunk.Flags != newExt.Flags {
@@ -176,8 +195,8 @@ func (lv *LogicalVolume[PhysicalVolume]) addMapping(m Mapping, dryRun bool) erro
 	case len(physicalOverlaps) < numOverlappingStripes:
 		// .Flags = DUP or RAID{X}
 		if newChunk.Flags.OK && newChunk.Flags.Val&BLOCK_GROUP_RAID_MASK == 0 {
-			return fmt.Errorf("multiple stripes but flags=%v does not allow multiple stripes",
-				newChunk.Flags.Val)
+			return fmt.Errorf("(%p).AddMapping: %v: multiple stripes but flags=%v does not allow multiple stripes",
+				lv, m, newChunk.Flags.Val)
 		}
 	case len(physicalOverlaps) > numOverlappingStripes:
 		// This should not happen because calling .AddMapping
@@ -358,8 +377,13 @@ func (lv *LogicalVolume[PhysicalVolume]) maybeShortReadAt(dat []byte, laddr Logi
 		if !first {
 			buf = make([]byte, len(buf))
 		}
-		if _, err := dev.ReadAt(buf, paddr.Addr); err != nil {
-			return 0, fmt.Errorf("read device=%v paddr=%v: %w", paddr.Dev, paddr.Addr, err)
+		if n, err := dev.ReadAt(buf, paddr.Addr); err != nil {
+			if !first {
+				// What we have in dat hasn't been
+				// checked against this stripe.
+				n = 0
+			}
+			return n, fmt.Errorf("read device=%v paddr=%v: %w", paddr.Dev, paddr.Addr, err)
 		}
 		if !first && !bytes.Equal(dat, buf) {
 			return 0, fmt.Errorf("inconsistent stripes at laddr=%v len=%v", laddr, len(dat))
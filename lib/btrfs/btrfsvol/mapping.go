@@ -0,0 +1,181 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsvol
+
+import (
+	"fmt"
+	"sort"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func (m Mapping) String() string {
+	return fmt.Sprintf("laddr=%v size=%v paddr=%v:%v", m.LAddr, m.Size, m.PAddr.Dev, m.PAddr.Addr)
+}
+
+// mappingGroup is a set of Mappings that all map the same logical
+// range; that is, the stripes of a single chunk.
+type mappingGroup struct {
+	LAddr      LogicalAddr
+	Size       AddrDelta
+	SizeLocked bool
+	Flags      containers.Optional[BlockGroupFlags]
+
+	// Stripes is sorted by QualifiedPhysicalAddr.Compare.
+	Stripes []QualifiedPhysicalAddr
+
+	// For error messages, the indexes (in the input list) of the
+	// first mapping in the group, of the mapping that set the
+	// flags, and of the first mapping for each stripe.
+	Idx        int
+	FlagsIdx   int
+	StripesIdx map[QualifiedPhysicalAddr]int
+}
+
+func (g mappingGroup) End() LogicalAddr { return g.LAddr.Add(g.Size) }
+
+// NormalizeMappings validates a list of mappings, such as one read
+// from a `--mappings` JSON file, and returns it in normal form.
+//
+// Unlike LogicalVolume.AddMapping (which merges overlapping mappings,
+// as is useful when piecing together mappings from fragmentary
+// evidence), this is strict: the list must describe a consistent set
+// of chunks.  Mappings that share the exact same logical range are
+// taken to be the stripes of a single mirrored (DUP or RAID) chunk;
+// any other logical overlap, any physical overlap, or any
+// disagreement about a chunk's flags is an error that identifies the
+// conflicting entries by their index in the list.
+//
+// In the returned list, exact duplicates have been removed; adjacent
+// chunks that have the same flags, the same number of stripes, and
+// whose stripes are all physically contiguous, have been coalesced;
+// and the mappings are sorted by logical address and then by
+// physical address, so that the same set of mappings always results
+// in the same list.
+func NormalizeMappings(in []Mapping) ([]Mapping, error) {
+	describe := func(i int) string {
+		return fmt.Sprintf("mapping #%d (%v)", i, in[i])
+	}
+
+	// Group the mappings by logical range.
+	type lrange struct {
+		LAddr LogicalAddr
+		Size  AddrDelta
+	}
+	groupIdx := make(map[lrange]int)
+	var groups []mappingGroup
+	for i, m := range in {
+		if m.Size <= 0 {
+			return nil, fmt.Errorf("%s: size must be positive", describe(i))
+		}
+		key := lrange{LAddr: m.LAddr, Size: m.Size}
+		gi, ok := groupIdx[key]
+		if !ok {
+			gi = len(groups)
+			groupIdx[key] = gi
+			groups = append(groups, mappingGroup{
+				LAddr:      m.LAddr,
+				Size:       m.Size,
+				Idx:        i,
+				StripesIdx: make(map[QualifiedPhysicalAddr]int),
+			})
+		}
+		g := &groups[gi]
+		if m.Flags.OK {
+			if g.Flags.OK && g.Flags != m.Flags {
+				return nil, fmt.Errorf("%s and %s: stripes of the same chunk have mismatched flags: %v != %v",
+					describe(g.FlagsIdx), describe(i), g.Flags.Val, m.Flags.Val)
+			}
+			g.Flags, g.FlagsIdx = m.Flags, i
+		}
+		g.SizeLocked = g.SizeLocked || m.SizeLocked
+		if _, dup := g.StripesIdx[m.PAddr]; dup {
+			continue
+		}
+		g.StripesIdx[m.PAddr] = i
+		g.Stripes = append(g.Stripes, m.PAddr)
+	}
+	for gi := range groups {
+		g := &groups[gi]
+		sort.Slice(g.Stripes, func(i, j int) bool {
+			return g.Stripes[i].Compare(g.Stripes[j]) < 0
+		})
+		if len(g.Stripes) > 1 && g.Flags.OK && g.Flags.Val&BLOCK_GROUP_RAID_MASK == 0 {
+			return nil, fmt.Errorf("%s: chunk has %d stripes, but flags=%v does not allow multiple stripes",
+				describe(g.Idx), len(g.Stripes), g.Flags.Val)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].LAddr < groups[j].LAddr
+	})
+
+	// Check for logical overlap between chunks.
+	for i := 1; i < len(groups); i++ {
+		if prev := groups[i-1]; prev.End() > groups[i].LAddr {
+			return nil, fmt.Errorf("%s and %s: logical ranges overlap, but are not the same range (as mirror stripes would be)",
+				describe(prev.Idx), describe(groups[i].Idx))
+		}
+	}
+
+	// Check for physical overlap between stripes.
+	type devext struct {
+		PAddr QualifiedPhysicalAddr
+		Size  AddrDelta
+		Idx   int
+	}
+	var exts []devext
+	for _, g := range groups {
+		for _, stripe := range g.Stripes {
+			exts = append(exts, devext{PAddr: stripe, Size: g.Size, Idx: g.StripesIdx[stripe]})
+		}
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		return exts[i].PAddr.Compare(exts[j].PAddr) < 0
+	})
+	for i := 1; i < len(exts); i++ {
+		prev := exts[i-1]
+		if prev.PAddr.Dev == exts[i].PAddr.Dev && prev.PAddr.Addr.Add(prev.Size) > exts[i].PAddr.Addr {
+			return nil, fmt.Errorf("%s and %s: physical ranges overlap",
+				describe(prev.Idx), describe(exts[i].Idx))
+		}
+	}
+
+	// Coalesce adjacent chunks.
+	var coalesced []mappingGroup
+	for _, g := range groups {
+		if n := len(coalesced); n > 0 && canCoalesce(coalesced[n-1], g) {
+			coalesced[n-1].Size += g.Size
+			continue
+		}
+		coalesced = append(coalesced, g)
+	}
+
+	// Flatten.
+	var out []Mapping
+	for _, g := range coalesced {
+		for _, stripe := range g.Stripes {
+			out = append(out, Mapping{
+				LAddr:      g.LAddr,
+				PAddr:      stripe,
+				Size:       g.Size,
+				SizeLocked: g.SizeLocked,
+				Flags:      g.Flags,
+			})
+		}
+	}
+	return out, nil
+}
+
+func canCoalesce(a, b mappingGroup) bool {
+	if a.SizeLocked || b.SizeLocked || a.End() != b.LAddr || a.Flags != b.Flags || len(a.Stripes) != len(b.Stripes) {
+		return false
+	}
+	for i := range a.Stripes {
+		if a.Stripes[i].Add(a.Size) != b.Stripes[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsvol_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+type nullPV struct{}
+
+func (nullPV) Name() string                                           { return "null" }
+func (nullPV) Size() btrfsvol.PhysicalAddr                            { return 1 << 40 }
+func (nullPV) Close() error                                           { return nil }
+func (nullPV) ReadAt(p []byte, _ btrfsvol.PhysicalAddr) (int, error)  { return len(p), nil }
+func (nullPV) WriteAt(p []byte, _ btrfsvol.PhysicalAddr) (int, error) { return len(p), nil }
+
+func TestNormalizeMappings(t *testing.T) {
+	t.Parallel()
+	m := func(laddr btrfsvol.LogicalAddr, dev btrfsvol.DeviceID, paddr btrfsvol.PhysicalAddr, size btrfsvol.AddrDelta, flags btrfsvol.BlockGroupFlags) btrfsvol.Mapping {
+		ret := btrfsvol.Mapping{
+			LAddr: laddr,
+			PAddr: btrfsvol.QualifiedPhysicalAddr{Dev: dev, Addr: paddr},
+			Size:  size,
+		}
+		if flags != 0 {
+			ret.Flags = containers.OptionalValue(flags)
+		}
+		return ret
+	}
+	const (
+		raid1 = btrfsvol.BLOCK_GROUP_METADATA | btrfsvol.BLOCK_GROUP_RAID1
+		dup   = btrfsvol.BLOCK_GROUP_METADATA | btrfsvol.BLOCK_GROUP_DUP
+		data  = btrfsvol.BLOCK_GROUP_DATA
+	)
+
+	type TestCase struct {
+		Input  []btrfsvol.Mapping
+		Output []btrfsvol.Mapping
+		ErrStr string
+	}
+	testcases := map[string]TestCase{
+		"raid1": {
+			Input: []btrfsvol.Mapping{
+				m(0x100000, 2, 0x5000000, 0x100000, raid1),
+				m(0x100000, 1, 0x1000000, 0x100000, raid1),
+			},
+			Output: []btrfsvol.Mapping{
+				m(0x100000, 1, 0x1000000, 0x100000, raid1),
+				m(0x100000, 2, 0x5000000, 0x100000, raid1),
+			},
+		},
+		"dup": {
+			Input: []btrfsvol.Mapping{
+				m(0x100000, 1, 0x3000000, 0x100000, dup),
+				m(0x100000, 1, 0x1000000, 0x100000, dup),
+				m(0x100000, 1, 0x1000000, 0x100000, dup),
+			},
+			Output: []btrfsvol.Mapping{
+				m(0x100000, 1, 0x1000000, 0x100000, dup),
+				m(0x100000, 1, 0x3000000, 0x100000, dup),
+			},
+		},
+		"coalesce-raid1": {
+			Input: []btrfsvol.Mapping{
+				m(0x200000, 1, 0x1100000, 0x100000, raid1),
+				m(0x200000, 2, 0x5100000, 0x100000, raid1),
+				m(0x100000, 1, 0x1000000, 0x100000, raid1),
+				m(0x100000, 2, 0x5000000, 0x100000, raid1),
+			},
+			Output: []btrfsvol.Mapping{
+				m(0x100000, 1, 0x1000000, 0x200000, raid1),
+				m(0x100000, 2, 0x5000000, 0x200000, raid1),
+			},
+		},
+		"no-coalesce-discontiguous": {
+			Input: []btrfsvol.Mapping{
+				m(0x100000, 1, 0x1000000, 0x100000, data),
+				m(0x200000, 1, 0x3000000, 0x100000, data),
+			},
+			Output: []btrfsvol.Mapping{
+				m(0x100000, 1, 0x1000000, 0x100000, data),
+				m(0x200000, 1, 0x3000000, 0x100000, data),
+			},
+		},
+		"logical-overlap": {
+			Input: []btrfsvol.Mapping{
+				m(0x100000, 1, 0x1000000, 0x100000, data),
+				m(0x180000, 1, 0x3000000, 0x100000, data),
+			},
+			ErrStr: `mapping #0 (laddr=0x0000000000100000 size=0x0000000000100000 paddr=1:0x0000000001000000) and mapping #1 (laddr=0x0000000000180000 size=0x0000000000100000 paddr=1:0x0000000003000000): logical ranges overlap, but are not the same range (as mirror stripes would be)`,
+		},
+		"physical-overlap": {
+			Input: []btrfsvol.Mapping{
+				m(0x100000, 1, 0x1000000, 0x100000, data),
+				m(0x300000, 1, 0x1080000, 0x100000, data),
+			},
+			ErrStr: `mapping #0 (laddr=0x0000000000100000 size=0x0000000000100000 paddr=1:0x0000000001000000) and mapping #1 (laddr=0x0000000000300000 size=0x0000000000100000 paddr=1:0x0000000001080000): physical ranges overlap`,
+		},
+		"flags-mismatch": {
+			Input: []btrfsvol.Mapping{
+				m(0x100000, 1, 0x1000000, 0x100000, raid1),
+				m(0x100000, 2, 0x1000000, 0x100000, dup),
+			},
+			ErrStr: `mapping #0 (laddr=0x0000000000100000 size=0x0000000000100000 paddr=1:0x0000000001000000) and mapping #1 (laddr=0x0000000000100000 size=0x0000000000100000 paddr=2:0x0000000001000000): stripes of the same chunk have mismatched flags: METADATA|RAID1 != METADATA|DUP`,
+		},
+		"single-with-stripes": {
+			Input: []btrfsvol.Mapping{
+				m(0x100000, 1, 0x1000000, 0x100000, data),
+				m(0x100000, 2, 0x1000000, 0x100000, data),
+			},
+			ErrStr: `mapping #0 (laddr=0x0000000000100000 size=0x0000000000100000 paddr=1:0x0000000001000000): chunk has 2 stripes, but flags=DATA|single does not allow multiple stripes`,
+		},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			out, err := btrfsvol.NormalizeMappings(tc.Input)
+			if tc.ErrStr != "" {
+				assert.EqualError(t, err, tc.ErrStr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.Output, out)
+		})
+	}
+}
+
+func TestAddMappingsMirrored(t *testing.T) {
+	t.Parallel()
+	const raid1 = btrfsvol.BLOCK_GROUP_METADATA | btrfsvol.BLOCK_GROUP_RAID1
+	mappings := []btrfsvol.Mapping{
+		{
+			LAddr: 0x100000,
+			PAddr: btrfsvol.QualifiedPhysicalAddr{Dev: 2, Addr: 0x5000000},
+			Size:  0x100000,
+			Flags: containers.OptionalValue(raid1),
+		},
+		{
+			LAddr: 0x100000,
+			PAddr: btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: 0x1000000},
+			Size:  0x100000,
+			Flags: containers.OptionalValue(raid1),
+		},
+	}
+
+	var lv btrfsvol.LogicalVolume[nullPV]
+	require.NoError(t, lv.AddPhysicalVolume(1, nullPV{}))
+	require.NoError(t, lv.AddPhysicalVolume(2, nullPV{}))
+	require.NoError(t, lv.AddMappings(mappings))
+
+	paddrs, maxlen := lv.Resolve(0x100010)
+	assert.Equal(t, btrfsvol.AddrDelta(0xffff0), maxlen)
+	assert.Equal(t, containers.NewSet[btrfsvol.QualifiedPhysicalAddr](
+		btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: 0x1000010},
+		btrfsvol.QualifiedPhysicalAddr{Dev: 2, Addr: 0x5000010},
+	), paddrs)
+
+	// The lowest stripe is chosen, regardless of the order that
+	// the mappings were given in.
+	_, paddr := lv.ResolveAny(0x100000, 1)
+	assert.Equal(t, btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: 0x1000000}, paddr)
+
+	assert.Equal(t, btrfsvol.LogicalAddr(0x100010), lv.UnResolve(btrfsvol.QualifiedPhysicalAddr{Dev: 2, Addr: 0x5000010}))
+}
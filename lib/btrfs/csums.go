@@ -20,7 +20,7 @@ import (
 // dat doesn't escape to the heap in .ReadAt(dat, …), but the compiler
 // can't figure that out, so we use a Pool for our byte arrays, since
 // the compiler won't let us allocate them on the stack.
-var blockPool containers.SlicePool[byte]
+var blockPool = containers.SlicePool[byte]{Name: "btrfs.blockPool"}
 
 func ChecksumLogical(fs diskio.File[btrfsvol.LogicalAddr], alg btrfssum.CSumType, laddr btrfsvol.LogicalAddr) (btrfssum.CSum, error) {
 	dat := blockPool.Get(btrfssum.BlockSize)
@@ -48,8 +48,32 @@ func ChecksumQualifiedPhysical(fs *FS, alg btrfssum.CSumType, paddr btrfsvol.Qua
 	return ChecksumPhysical(dev, alg, paddr.Addr)
 }
 
-func LookupCSum(ctx context.Context, fs btrfstree.Forrest, alg btrfssum.CSumType, laddr btrfsvol.LogicalAddr) (btrfssum.SumRun[btrfsvol.LogicalAddr], error) {
-	csumTree, err := fs.ForrestLookup(ctx, btrfsprim.CSUM_TREE_OBJECTID)
+// ValidateChecksumTree checks that the tree `treeID` exists in `fs`
+// and contains at least one EXTENT_CSUM item, so that a typo'd
+// SubvolumeConfig.ChecksumTree doesn't silently make every data block
+// look un-checksummed.
+func ValidateChecksumTree(ctx context.Context, fs btrfstree.Forrest, treeID btrfsprim.ObjID) error {
+	csumTree, err := fs.ForrestLookup(ctx, treeID)
+	if err != nil {
+		return fmt.Errorf("checksum tree %v: %w", treeID, err)
+	}
+	var found bool
+	if err := csumTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		found = item.Key.ItemType == btrfsitem.EXTENT_CSUM_KEY
+		return !found
+	}); err != nil && !found {
+		return fmt.Errorf("checksum tree %v: %w", treeID, err)
+	}
+	if !found {
+		return fmt.Errorf("checksum tree %v: contains no EXTENT_CSUM items", treeID)
+	}
+	return nil
+}
+
+// LookupCSum returns the run of checksums in the tree `treeID` (normally
+// CSUM_TREE_OBJECTID) that contains the checksum for `laddr`.
+func LookupCSum(ctx context.Context, fs btrfstree.Forrest, treeID btrfsprim.ObjID, alg btrfssum.CSumType, laddr btrfsvol.LogicalAddr) (btrfssum.SumRun[btrfsvol.LogicalAddr], error) {
+	csumTree, err := fs.ForrestLookup(ctx, treeID)
 	if err != nil {
 		return btrfssum.SumRun[btrfsvol.LogicalAddr]{}, err
 	}
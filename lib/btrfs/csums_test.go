@@ -0,0 +1,105 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+// TestChecksumTree checks that SubvolumeConfig.ChecksumTree causes
+// file data to be verified against a tree other than the CSUM_TREE.
+func TestChecksumTree(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	const (
+		blk       = btrfssum.BlockSize
+		laddr     = btrfsvol.LogicalAddr(0x100000)
+		altTree   = btrfsprim.ObjID(300)
+		emptyTree = btrfsprim.ObjID(301)
+	)
+	dat := bytes.Repeat([]byte{'D'}, blk)
+	sum, err := btrfssum.TYPE_CRC32.Sum(dat)
+	require.NoError(t, err)
+	badSum := sum
+	badSum[0] ^= 0xff
+	csumTree := func(sum btrfssum.CSum) memTree {
+		return memTree{{
+			Key:      btrfsprim.Key{ObjectID: btrfsprim.EXTENT_CSUM_OBJECTID, ItemType: btrfsitem.EXTENT_CSUM_KEY, Offset: uint64(laddr)},
+			BodySize: 4,
+			Body: &btrfsitem.ExtentCSum{SumRun: btrfssum.SumRun[btrfsvol.LogicalAddr]{
+				ChecksumSize: 4,
+				Addr:         laddr,
+				Sums:         btrfssum.ShortSum(sum[:4]),
+			}},
+		}}
+	}
+	fs := memTreesFS{
+		FS: dataFS(t, ctx, laddr, dat),
+		trees: map[btrfsprim.ObjID]memTree{
+			// The normal CSUM_TREE is stale.
+			btrfsprim.CSUM_TREE_OBJECTID: csumTree(badSum),
+			altTree:                      csumTree(sum),
+			emptyTree:                    {},
+		},
+	}
+
+	assert.NoError(t, btrfs.ValidateChecksumTree(ctx, fs, altTree))
+	assert.ErrorIs(t, btrfs.ValidateChecksumTree(ctx, fs, 302), btrfstree.ErrNoTree)
+	assert.ErrorContains(t, btrfs.ValidateChecksumTree(ctx, fs, emptyTree), "contains no EXTENT_CSUM items")
+
+	type TestCase struct {
+		ChecksumTree btrfsprim.ObjID
+		ExpErr       string
+	}
+	testcases := map[string]TestCase{
+		"default":   {ExpErr: "!= expected sum"},
+		"csum-tree": {ChecksumTree: btrfsprim.CSUM_TREE_OBJECTID, ExpErr: "!= expected sum"},
+		"alt-tree":  {ChecksumTree: altTree},
+		"no-tree":   {ChecksumTree: 302, ExpErr: "checksum@"},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			sv := btrfs.NewSubvolume(ctx, fs, btrfsprim.FS_TREE_OBJECTID, btrfs.SubvolumeConfig{
+				ChecksumTree: tc.ChecksumTree,
+			})
+			file := &btrfs.File{
+				Extents: []btrfs.FileExtent{{FileExtent: btrfsitem.FileExtent{
+					Type: btrfsitem.FILE_EXTENT_REG,
+					BodyExtent: btrfsitem.FileExtentExtent{
+						DiskByteNr:   laddr,
+						DiskNumBytes: blk,
+						NumBytes:     blk,
+					},
+				}}},
+				SV: sv,
+			}
+			file.InodeItem = &btrfsitem.Inode{Size: blk, NumBytes: blk}
+
+			act := make([]byte, blk)
+			_, err := file.ReadAt(act, 0)
+			if tc.ExpErr != "" {
+				assert.ErrorContains(t, err, tc.ExpErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, dat, act)
+		})
+	}
+}
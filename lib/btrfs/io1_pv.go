@@ -18,6 +18,26 @@ import (
 type Device struct {
 	diskio.File[btrfsvol.PhysicalAddr]
 
+	// NoVerifyNodeChecksums causes nodes read directly from the
+	// device (such as when scanning for nodes) to be read with
+	// btrfstree.ReadNodeNoChecksum instead of
+	// btrfstree.ReadNode.
+	NoVerifyNodeChecksums bool
+	// StrictItemSizes causes nodes read directly from the device
+	// to be read with btrfstree.ReadNodeConfig.StrictItemSizes.
+	StrictItemSizes bool
+	// SalvagePartialNodes causes nodes read directly from the
+	// device to be read with
+	// btrfstree.ReadNodeConfig.SalvagePartial.
+	SalvagePartialNodes bool
+	// TrustPartialNodes causes those who scan the device for
+	// nodes (such as btrfsutil.ScanDevices) to use nodes salvaged
+	// by SalvagePartialNodes as if they were good.  Such a node is
+	// missing some of its items or key-pointers, and its checksum
+	// has not been verified, so this should only be turned on at
+	// the user's explicit request.
+	TrustPartialNodes bool
+
 	cacheSuperblocks []*diskio.Ref[btrfsvol.PhysicalAddr, btrfstree.Superblock]
 	cacheSuperblock  *btrfstree.Superblock
 }
@@ -32,6 +52,23 @@ var SuperblockAddrs = []btrfsvol.PhysicalAddr{
 
 var SuperblockSize = btrfsvol.PhysicalAddr(binstruct.StaticSize(btrfstree.Superblock{}))
 
+// ReadNode reads the node at the given physical address, honoring
+// dev.NoVerifyNodeChecksums, dev.StrictItemSizes, and
+// dev.SalvagePartialNodes.
+func (dev *Device) ReadNode(sb btrfstree.Superblock, addr btrfsvol.PhysicalAddr) (*btrfstree.Node, error) {
+	return btrfstree.ReadNodeWithConfig[btrfsvol.PhysicalAddr](dev, sb, addr, dev.ReadNodeConfig())
+}
+
+// ReadNodeConfig returns the btrfstree.ReadNodeConfig that ReadNode
+// uses, for callers that read nodes from the device some other way.
+func (dev *Device) ReadNodeConfig() btrfstree.ReadNodeConfig {
+	return btrfstree.ReadNodeConfig{
+		NoVerifyChecksum: dev.NoVerifyNodeChecksums,
+		StrictItemSizes:  dev.StrictItemSizes,
+		SalvagePartial:   dev.SalvagePartialNodes,
+	}
+}
+
 func (dev *Device) Superblocks() ([]*diskio.Ref[btrfsvol.PhysicalAddr, btrfstree.Superblock], error) {
 	if dev.cacheSuperblocks != nil {
 		return dev.cacheSuperblocks, nil
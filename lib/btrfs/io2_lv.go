@@ -25,6 +25,25 @@ type FS struct {
 	// implementing special things like fsck.
 	LV btrfsvol.LogicalVolume[*Device]
 
+	// NoVerifyNodeChecksums causes nodes to be read with
+	// btrfstree.ReadNodeNoChecksum instead of
+	// btrfstree.ReadNode.
+	NoVerifyNodeChecksums bool
+	// StrictItemSizes causes nodes to be read with
+	// btrfstree.ReadNodeConfig.StrictItemSizes.
+	StrictItemSizes bool
+	// SalvagePartialNodes causes nodes to be read with
+	// btrfstree.ReadNodeConfig.SalvagePartial.
+	SalvagePartialNodes bool
+	// TrustPartialNodes causes nodes salvaged by
+	// SalvagePartialNodes to be used as if they were good (by
+	// .AcquireNode(), by .ReadNodeCopies(), and so by
+	// btrfsutil.ReadGraph), if there is no good copy of the node.
+	// Such a node is missing some of its items or key-pointers,
+	// and its checksum has not been verified, so this should only
+	// be turned on at the user's explicit request.
+	TrustPartialNodes bool
+
 	cacheSuperblocks []*diskio.Ref[btrfsvol.PhysicalAddr, btrfstree.Superblock]
 	cacheSuperblock  *btrfstree.Superblock
 
@@ -122,8 +141,12 @@ func (fs *FS) Superblock() (*btrfstree.Superblock, error) {
 		if i > 0 {
 			// FIXME(lukeshu): This is probably wrong, but
 			// lots of my multi-device code is probably
-			// wrong.
-			if !sb.Data.Equal(sbs[0].Data) {
+			// wrong.  At least don't compare the
+			// DevItem, which describes the device that
+			// the superblock is on.
+			a, b := sb.Data, sbs[0].Data
+			a.DevItem, b.DevItem = btrfsitem.Dev{}, btrfsitem.Dev{}
+			if !a.Equal(b) {
 				return nil, fmt.Errorf("file %q superblock %v and file %q superblock %v disagree",
 					sbs[0].File.Name(), 0,
 					sb.File.Name(), sbi)
@@ -135,6 +158,21 @@ func (fs *FS) Superblock() (*btrfstree.Superblock, error) {
 	return &sbs[0].Data, nil
 }
 
+// ValidateSuperblock sanity-checks the superblock against itself and
+// against the sizes of the devices that have been added to the FS.
+// See btrfstree.Superblock.Validate.
+func (fs *FS) ValidateSuperblock() (btrfstree.SuperblockReport, error) {
+	sb, err := fs.Superblock()
+	if err != nil {
+		return nil, err
+	}
+	devSizes := make(map[btrfsvol.DeviceID]btrfsvol.PhysicalAddr)
+	for devID, dev := range fs.LV.PhysicalVolumes() {
+		devSizes[devID] = dev.Size()
+	}
+	return sb.Validate(devSizes), nil
+}
+
 func (fs *FS) ReInit(ctx context.Context) error {
 	fs.LV.ClearMappings()
 	for _, dev := range fs.LV.PhysicalVolumes() {
@@ -164,13 +202,99 @@ func (fs *FS) initDev(sb btrfstree.Superblock) error {
 	return nil
 }
 
-func (fs *FS) InitChunks(ctx context.Context) error {
-	chunkTree, err := fs.ForrestLookup(ctx, btrfsprim.CHUNK_TREE_OBJECTID)
+// A ChunkRootError is returned by CheckChunkRoot when the
+// superblock's chunk_root does not point at a plausible root node for
+// the CHUNK_TREE.
+type ChunkRootError struct {
+	Addr       btrfsvol.LogicalAddr
+	Level      uint8
+	Generation btrfsprim.Generation
+	Err        error
+}
+
+func (e *ChunkRootError) Error() string {
+	return fmt.Sprintf("superblock chunk_root=%v (level=%v generation=%v) is not a valid CHUNK_TREE root: %v",
+		e.Addr, e.Level, e.Generation, e.Err)
+}
+
+func (e *ChunkRootError) Unwrap() error { return e.Err }
+
+// CheckChunkRoot reads the node that the superblock's chunk_root
+// points at, and checks that it is a valid node owned by the
+// CHUNK_TREE, with the level and generation that the superblock says
+// it should have.  A stale or garbage chunk_root is a common reason
+// for a filesystem to be unmountable.  If the check fails, a
+// *ChunkRootError is returned.
+func (fs *FS) CheckChunkRoot(ctx context.Context) error {
+	sb, err := fs.Superblock()
 	if err != nil {
 		return err
 	}
+	if _, err := fs.readChunkRoot(ctx, *sb, true); err != nil {
+		return &ChunkRootError{
+			Addr:       sb.ChunkTree,
+			Level:      sb.ChunkLevel,
+			Generation: sb.ChunkRootGeneration,
+			Err:        err,
+		}
+	}
+	return nil
+}
+
+// readChunkRoot reads the node that the superblock's chunk_root points
+// at, and returns its generation.  If checkGen is false, the node's
+// generation is not checked against the superblock's
+// chunk_root_generation.
+func (fs *FS) readChunkRoot(ctx context.Context, sb btrfstree.Superblock, checkGen bool) (btrfsprim.Generation, error) {
+	exp := btrfstree.NodeExpectations{
+		LAddr: containers.OptionalValue(sb.ChunkTree),
+		Level: containers.OptionalValue(sb.ChunkLevel),
+		Owner: func(owner btrfsprim.ObjID, _ btrfsprim.Generation) error {
+			if owner != btrfsprim.CHUNK_TREE_OBJECTID {
+				return fmt.Errorf("expected owner=%v but claims to have owner=%v",
+					btrfsprim.CHUNK_TREE_OBJECTID, owner)
+			}
+			return nil
+		},
+	}
+	if checkGen {
+		exp.Generation = containers.OptionalValue(sb.ChunkRootGeneration)
+	}
+	node, err := fs.AcquireNode(ctx, sb.ChunkTree, exp)
+	if err != nil {
+		return 0, err
+	}
+	defer fs.ReleaseNode(node)
+	return node.Head.Generation, nil
+}
 
+// InitChunks reads the CHUNK_TREE, adding each of its chunks to the
+// logical volume.
+//
+// If the superblock's chunk_root_generation disagrees with the
+// generation of the chunk_root node, but the node is otherwise a valid
+// CHUNK_TREE root, then that is logged as a warning, and the node is
+// used anyway.
+func (fs *FS) InitChunks(ctx context.Context) error {
 	var errs derror.MultiError
+
+	sb, err := fs.Superblock()
+	if err != nil {
+		return err
+	}
+	chunkTree, err := fs.RawTree(ctx, btrfsprim.CHUNK_TREE_OBJECTID)
+	if err != nil {
+		return err
+	}
+	if err := fs.CheckChunkRoot(ctx); err != nil {
+		if gen, genErr := fs.readChunkRoot(ctx, *sb, false); genErr == nil {
+			dlog.Warnf(ctx, "%v; using the node's generation=%v", err, gen)
+			chunkTree.Generation = gen
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
 	if err := chunkTree.TreeRange(ctx, func(item btrfstree.Item) bool {
 		if item.Key.ItemType != btrfsitem.CHUNK_ITEM_KEY {
 			return true
@@ -201,8 +325,14 @@ func (fs *FS) InitChunks(ctx context.Context) error {
 	return nil
 }
 
+// Close closes every device (see LogicalVolume.Close), and drops the
+// FS's caches, even if closing a device fails.
 func (fs *FS) Close() error {
-	return fs.LV.Close()
+	err := fs.LV.Close()
+	fs.cacheSuperblocks = nil
+	fs.cacheSuperblock = nil
+	fs.cacheNodes = nil
+	return err
 }
 
 var _ io.Closer = (*FS)(nil)
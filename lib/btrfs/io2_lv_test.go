@@ -0,0 +1,159 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfs_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/datawire/dlib/derror"
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+// closeFile is a memFile that records whether it has been closed,
+// and fails to close if .err is set.
+type closeFile struct {
+	memFile
+	closed bool
+	err    error
+}
+
+func (f *closeFile) Close() error {
+	f.closed = true
+	return f.err
+}
+
+func TestFSClose(t *testing.T) {
+	t.Parallel()
+	errFlaky := errors.New("flaky close")
+	files := []*closeFile{
+		{memFile: make(memFile, 0)},
+		{memFile: make(memFile, 0), err: errFlaky},
+		{memFile: make(memFile, 0)},
+		{memFile: make(memFile, 0), err: errFlaky},
+	}
+	fs := new(btrfs.FS)
+	for i, file := range files {
+		require.NoError(t, fs.LV.AddPhysicalVolume(btrfsvol.DeviceID(i+1), &btrfs.Device{File: file}))
+	}
+
+	err := fs.Close()
+	require.Error(t, err)
+	assert.ErrorIs(t, err, errFlaky)
+	var multi derror.MultiError
+	require.ErrorAs(t, err, &multi)
+	assert.Len(t, multi, 2)
+	assert.Contains(t, multi[0].Error(), "device 2")
+	assert.Contains(t, multi[1].Error(), "device 4")
+	for i, file := range files {
+		assert.True(t, file.closed, "device %v", i+1)
+	}
+}
+
+// TestInitChunksGenerationMismatch checks that InitChunks still reads
+// the CHUNK_TREE if the superblock's chunk_root_generation disagrees
+// with the chunk_root node, as happens if the superblock is a
+// transaction behind or ahead of the node.
+func TestInitChunksGenerationMismatch(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	const (
+		nodeSize = 0x4000
+		sysLAddr = btrfsvol.LogicalAddr(0x100000)
+		sysPAddr = btrfsvol.PhysicalAddr(0x40000)
+		datLAddr = btrfsvol.LogicalAddr(0x200000)
+		datPAddr = btrfsvol.PhysicalAddr(0x60000)
+		size     = 0x10000
+	)
+	fsUUID := btrfsprim.UUID{0x01, 0x02, 0x03}
+	mkChunk := func(paddr btrfsvol.PhysicalAddr, flags btrfsvol.BlockGroupFlags) btrfsitem.Chunk {
+		return btrfsitem.Chunk{
+			Head: btrfsitem.ChunkHeader{
+				Size:       size,
+				Owner:      btrfsprim.EXTENT_TREE_OBJECTID,
+				Type:       flags,
+				NumStripes: 1,
+			},
+			Stripes: []btrfsitem.ChunkStripe{{DeviceID: 1, Offset: paddr}},
+		}
+	}
+	sysKey := btrfsprim.Key{ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, ItemType: btrfsitem.CHUNK_ITEM_KEY, Offset: uint64(sysLAddr)}
+	datKey := btrfsprim.Key{ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, ItemType: btrfsitem.CHUNK_ITEM_KEY, Offset: uint64(datLAddr)}
+	sysChunk := mkChunk(sysPAddr, btrfsvol.BLOCK_GROUP_SYSTEM)
+	datChunk := mkChunk(datPAddr, btrfsvol.BLOCK_GROUP_DATA)
+
+	img := make(memFile, 0x80000)
+
+	builder := &btrfstree.NodeBuilder{
+		Size:         nodeSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		Head: btrfstree.NodeHeader{
+			MetadataUUID: fsUUID,
+			Flags:        btrfstree.NodeWritten,
+			BackrefRev:   btrfstree.MixedBackrefRev,
+			Generation:   7,
+			Owner:        btrfsprim.CHUNK_TREE_OBJECTID,
+		},
+		Alloc: func() (btrfsvol.LogicalAddr, error) {
+			return sysLAddr, nil
+		},
+		Emit: func(node *btrfstree.Node) error {
+			bs, err := binstruct.Marshal(*node)
+			copy(img[sysPAddr+btrfsvol.PhysicalAddr(node.Head.Addr-sysLAddr):], bs)
+			return err
+		},
+	}
+	require.NoError(t, builder.Add(btrfstree.Item{Key: sysKey, Body: &sysChunk}))
+	require.NoError(t, builder.Add(btrfstree.Item{Key: datKey, Body: &datChunk}))
+	root, level, err := builder.Finish()
+	require.NoError(t, err)
+	require.Equal(t, sysLAddr, root.BlockPtr)
+
+	sb := btrfstree.Superblock{
+		Self:                btrfs.SuperblockAddrs[0],
+		Magic:               btrfstree.SuperblockMagic,
+		FSUUID:              fsUUID,
+		Generation:          6,
+		ChunkTree:           root.BlockPtr,
+		ChunkLevel:          level,
+		ChunkRootGeneration: 6, // but the node says 7
+		NumDevices:          1,
+		SectorSize:          0x1000,
+		NodeSize:            nodeSize,
+		LeafSize:            nodeSize,
+		StripeSize:          0x1000,
+		ChecksumType:        btrfssum.TYPE_CRC32,
+		DevItem:             btrfsitem.Dev{DevID: 1, NumBytes: uint64(len(img))},
+	}
+	dat, err := binstruct.Marshal(btrfstree.SysChunk{Key: sysKey, Chunk: sysChunk})
+	require.NoError(t, err)
+	sb.SysChunkArraySize = uint32(copy(sb.SysChunkArray[:], dat))
+	sb.Checksum, err = sb.CalculateChecksum()
+	require.NoError(t, err)
+	sbBytes, err := binstruct.Marshal(sb)
+	require.NoError(t, err)
+	copy(img[sb.Self:], sbBytes)
+
+	fs := new(btrfs.FS)
+	require.NoError(t, fs.AddDevice(ctx, &btrfs.Device{File: img}))
+
+	var chunkRootErr *btrfs.ChunkRootError
+	require.ErrorAs(t, fs.CheckChunkRoot(ctx), &chunkRootErr)
+
+	require.NoError(t, fs.InitChunks(ctx))
+	paddrs, _ := fs.LV.Resolve(datLAddr)
+	assert.True(t, paddrs.Has(btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: datPAddr}))
+}
@@ -6,12 +6,18 @@ package btrfs
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/datawire/dlib/dlog"
 
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
 	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
 	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
 	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
@@ -24,11 +30,13 @@ type nodeCacheEntry struct {
 	err  error
 }
 
+var nodeCacheSize = textui.NewTunable("btrfs.node-cache-size", 4*(btrfstree.MaxLevel+1))
+
 // AcquireNode implements btrfstree.NodeSource.
 func (fs *FS) AcquireNode(ctx context.Context, addr btrfsvol.LogicalAddr, exp btrfstree.NodeExpectations) (*btrfstree.Node, error) {
 	if fs.cacheNodes == nil {
 		fs.cacheNodes = containers.NewARCache[btrfsvol.LogicalAddr, nodeCacheEntry](
-			textui.Tunable(4*(btrfstree.MaxLevel+1)),
+			nodeCacheSize.Get(),
 			containers.SourceFunc[btrfsvol.LogicalAddr, nodeCacheEntry](fs.readNode),
 		)
 	}
@@ -58,7 +66,7 @@ func (fs *FS) ReleaseNode(node *btrfstree.Node) {
 	fs.cacheNodes.Release(node.Head.Addr)
 }
 
-func (fs *FS) readNode(_ context.Context, addr btrfsvol.LogicalAddr, nodeEntry *nodeCacheEntry) {
+func (fs *FS) readNode(ctx context.Context, addr btrfsvol.LogicalAddr, nodeEntry *nodeCacheEntry) {
 	nodeEntry.node.RawFree()
 	nodeEntry.node = nil
 
@@ -68,7 +76,150 @@ func (fs *FS) readNode(_ context.Context, addr btrfsvol.LogicalAddr, nodeEntry *
 		return
 	}
 
-	nodeEntry.node, nodeEntry.err = btrfstree.ReadNode[btrfsvol.LogicalAddr](fs, *sb, addr)
+	node, err := btrfstree.ReadNodeWithConfig[btrfsvol.LogicalAddr](fs, *sb, addr, btrfstree.ReadNodeConfig{
+		NoVerifyChecksum: fs.NoVerifyNodeChecksums,
+		StrictItemSizes:  fs.StrictItemSizes,
+		SalvagePartial:   fs.SalvagePartialNodes,
+	})
+
+	// Reading through fs.LV fails if the mirror copies of the node
+	// aren't identical; if that's the case, then use the same copy
+	// that ReadNodeCopies (and so btrfsutil.ReadGraph) picks.
+	if err != nil {
+		if paddrs, _ := fs.LV.Resolve(addr); len(paddrs) > 1 {
+			copyNode, copies, copyErr := fs.ReadNodeCopies(ctx, *sb, addr)
+			if copyErr == nil {
+				dlog.Debugf(ctx, "node@%v: %v; using the copy at %v", addr, err, copies.Good)
+				node.RawFree()
+				node, err = copyNode, nil
+			}
+		}
+	}
+
+	if err != nil && fs.TrustPartialNodes && errors.Is(err, btrfstree.ErrPartialNode) {
+		dlog.Warnf(ctx, "using partially-read node: %v", err)
+		err = nil
+	}
+
+	// .AcquireNode() doesn't hand out a node that came with an
+	// error, so don't hold on to it.
+	if err != nil {
+		node.RawFree()
+		node = nil
+	}
+	nodeEntry.node, nodeEntry.err = node, err
+}
+
+// NodeCopies describes the physical copies of a node that were read
+// by ReadNodeCopies.
+type NodeCopies struct {
+	// Good is the addresses of the copies that were chosen.
+	Good []btrfsvol.QualifiedPhysicalAddr
+	// NumBad is the number of copies that failed to validate.
+	NumBad int
+	// NumStale is the number of copies that validated but have an
+	// older generation than the chosen copy.
+	NumStale int
+}
+
+// ReadNodeCopies reads every physical copy of the node at `laddr`
+// (there is more than one if the node is in a DUP or mirrored chunk),
+// and returns the copy with the newest generation among those that
+// validate.  This is unlike reading the node through fs.LV, which
+// fails if the copies are not byte-for-byte identical.
+//
+// Copies are de-duplicated by logical address and generation: all of
+// the good copies of that generation are returned as sources of the
+// node.
+//
+// If fs.TrustPartialNodes is set, then a copy that could only be
+// partially read (btrfstree.ErrPartialNode) is returned if there is no
+// good copy.
+func (fs *FS) ReadNodeCopies(ctx context.Context, sb btrfstree.Superblock, laddr btrfsvol.LogicalAddr) (*btrfstree.Node, NodeCopies, error) {
+	var ret NodeCopies
+	paddrs, _ := fs.LV.Resolve(laddr)
+	if len(paddrs) == 0 {
+		return nil, ret, fmt.Errorf("node@%v: %w", laddr, btrfsvol.ErrCouldNotMap)
+	}
+	devs := fs.LV.PhysicalVolumes()
+	exp := btrfstree.NodeExpectations{
+		LAddr: containers.OptionalValue(laddr),
+	}
+
+	var best *btrfstree.Node
+	var partial *btrfstree.Node
+	var partialPAddr btrfsvol.QualifiedPhysicalAddr
+	var firstErr error
+	sortedPAddrs := maps.Keys(paddrs)
+	sort.Slice(sortedPAddrs, func(i, j int) bool {
+		return sortedPAddrs[i].Compare(sortedPAddrs[j]) < 0
+	})
+	for _, paddr := range sortedPAddrs {
+		node, err := func() (*btrfstree.Node, error) {
+			dev, ok := devs[paddr.Dev]
+			if !ok {
+				return nil, fmt.Errorf("device=%v does not exist", paddr.Dev)
+			}
+			node, err := btrfstree.ReadNodeWithConfig[btrfsvol.PhysicalAddr](dev, sb, paddr.Addr, btrfstree.ReadNodeConfig{
+				NoVerifyChecksum: fs.NoVerifyNodeChecksums || dev.NoVerifyNodeChecksums,
+				StrictItemSizes:  fs.StrictItemSizes || dev.StrictItemSizes,
+				SalvagePartial:   fs.SalvagePartialNodes || dev.SalvagePartialNodes,
+			})
+			if err != nil {
+				return node, err
+			}
+			return node, exp.Check(node)
+		}()
+		if err != nil && fs.TrustPartialNodes && partial == nil && errors.Is(err, btrfstree.ErrPartialNode) && exp.Check(node) == nil {
+			dlog.Debugf(ctx, "node@%v: copy at %v: %v", laddr, paddr, err)
+			partial, partialPAddr = node, paddr
+			ret.NumBad++
+			if firstErr == nil {
+				firstErr = fmt.Errorf("node@%v: copy at %v: %w", laddr, paddr, err)
+			}
+			continue
+		}
+		if err != nil {
+			node.RawFree()
+			dlog.Debugf(ctx, "node@%v: copy at %v: %v", laddr, paddr, err)
+			ret.NumBad++
+			if firstErr == nil {
+				firstErr = fmt.Errorf("node@%v: copy at %v: %w", laddr, paddr, err)
+			}
+			continue
+		}
+		switch {
+		case best == nil || node.Head.Generation > best.Head.Generation:
+			if best != nil {
+				dlog.Debugf(ctx, "node@%v: copies at %v are stale (generation=%v < %v)",
+					laddr, ret.Good, best.Head.Generation, node.Head.Generation)
+				ret.NumStale += len(ret.Good)
+				best.RawFree()
+			}
+			best = node
+			ret.Good = []btrfsvol.QualifiedPhysicalAddr{paddr}
+		case node.Head.Generation == best.Head.Generation:
+			ret.Good = append(ret.Good, paddr)
+			node.RawFree()
+		default:
+			dlog.Debugf(ctx, "node@%v: copy at %v is stale (generation=%v < %v)",
+				laddr, paddr, node.Head.Generation, best.Head.Generation)
+			ret.NumStale++
+			node.RawFree()
+		}
+	}
+	if best == nil && partial != nil {
+		dlog.Warnf(ctx, "node@%v: no good copies; using the partially-read copy at %v: %v",
+			laddr, partialPAddr, firstErr)
+		ret.NumBad--
+		ret.Good = []btrfsvol.QualifiedPhysicalAddr{partialPAddr}
+		return partial, ret, nil
+	}
+	partial.RawFree()
+	if best == nil {
+		return nil, ret, firstErr
+	}
+	return best, ret, nil
 }
 
 var _ btrfstree.NodeSource = (*FS)(nil)
@@ -11,9 +11,12 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"sync"
 
 	"github.com/datawire/dlib/derror"
 
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfscompress"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
@@ -25,6 +28,18 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
+var (
+	nodeHeaderSize = binstruct.StaticSize(btrfstree.NodeHeader{})
+	itemHeaderSize = binstruct.StaticSize(btrfstree.ItemHeader{})
+)
+
+func (cfg SubvolumeConfig) maxInlineExtent(sb *btrfstree.Superblock) int64 {
+	if cfg.MaxInlineExtent != 0 {
+		return cfg.MaxInlineExtent
+	}
+	return int64(sb.NodeSize) - int64(nodeHeaderSize+itemHeaderSize+btrfsitem.FileExtentInlineDataStart)
+}
+
 type BareInode struct {
 	Inode     btrfsprim.ObjID
 	InodeItem *btrfsitem.Inode
@@ -59,13 +74,46 @@ type File struct {
 	FullInode
 	Extents []FileExtent
 	SV      *Subvolume
+
+	// decompressed is the most recently decompressed extent
+	// (decompressedIdx is its index in to .Extents, plus 1), as
+	// reading any part of a compressed extent means decompressing
+	// the whole thing.
+	decompressedMu  sync.Mutex
+	decompressedIdx int
+	decompressed    []byte
+}
+
+// SubvolumeConfig configures how a Subvolume reads files.
+type SubvolumeConfig struct {
+	// NoChecksums, if set, skips verifying file data against
+	// the checksum tree.
+	NoChecksums bool
+	// MaxInlineExtent, if non-zero, overrides the maximum size
+	// (of both the data and the RAMBytes) of an inline file
+	// extent that a File will read; larger inline extents are
+	// treated as corrupt.  If zero, the maximum is the most
+	// inline data that fits in a single node.
+	MaxInlineExtent int64
+	// ChecksumTree is the ID of the tree that data checksums are
+	// looked up in.  If zero, it is CSUM_TREE_OBJECTID, but an
+	// expert may point it at another tree (such as a rebuilt copy
+	// under a temporary ID).
+	ChecksumTree btrfsprim.ObjID
+}
+
+func (cfg SubvolumeConfig) checksumTree() btrfsprim.ObjID {
+	if cfg.ChecksumTree == 0 {
+		return btrfsprim.CSUM_TREE_OBJECTID
+	}
+	return cfg.ChecksumTree
 }
 
 type Subvolume struct {
-	ctx         context.Context //nolint:containedctx // don't have an option while keeping the same API
-	fs          ReadableFS
-	TreeID      btrfsprim.ObjID
-	noChecksums bool
+	ctx    context.Context //nolint:containedctx // don't have an option while keeping the same API
+	fs     ReadableFS
+	TreeID btrfsprim.ObjID
+	cfg    SubvolumeConfig
 
 	rootErr  error
 	rootInfo btrfstree.TreeRoot
@@ -77,17 +125,23 @@ type Subvolume struct {
 	fileCache      containers.Cache[btrfsprim.ObjID, File]
 }
 
+var (
+	inodeCacheSize = textui.NewTunable("btrfs.inode-cache-size", 128)
+	dirCacheSize   = textui.NewTunable("btrfs.dir-cache-size", 128)
+	fileCacheSize  = textui.NewTunable("btrfs.file-cache-size", 128)
+)
+
 func NewSubvolume(
 	ctx context.Context,
 	fs ReadableFS,
 	treeID btrfsprim.ObjID,
-	noChecksums bool,
+	cfg SubvolumeConfig,
 ) *Subvolume {
 	sv := &Subvolume{
-		ctx:         ctx,
-		fs:          fs,
-		TreeID:      treeID,
-		noChecksums: noChecksums,
+		ctx:    ctx,
+		fs:     fs,
+		TreeID: treeID,
+		cfg:    cfg,
 	}
 
 	tree, err := sv.fs.ForrestLookup(ctx, sv.TreeID)
@@ -100,20 +154,20 @@ func NewSubvolume(
 	sv.rootInfo = *rootInfo
 	sv.tree = tree
 
-	sv.bareInodeCache = containers.NewARCache[btrfsprim.ObjID, BareInode](textui.Tunable(128),
+	sv.bareInodeCache = containers.NewARCache[btrfsprim.ObjID, BareInode](inodeCacheSize.Get(),
 		containers.SourceFunc[btrfsprim.ObjID, BareInode](sv.loadBareInode))
-	sv.fullInodeCache = containers.NewARCache[btrfsprim.ObjID, FullInode](textui.Tunable(128),
+	sv.fullInodeCache = containers.NewARCache[btrfsprim.ObjID, FullInode](inodeCacheSize.Get(),
 		containers.SourceFunc[btrfsprim.ObjID, FullInode](sv.loadFullInode))
-	sv.dirCache = containers.NewARCache[btrfsprim.ObjID, Dir](textui.Tunable(128),
+	sv.dirCache = containers.NewARCache[btrfsprim.ObjID, Dir](dirCacheSize.Get(),
 		containers.SourceFunc[btrfsprim.ObjID, Dir](sv.loadDir))
-	sv.fileCache = containers.NewARCache[btrfsprim.ObjID, File](textui.Tunable(128),
+	sv.fileCache = containers.NewARCache[btrfsprim.ObjID, File](fileCacheSize.Get(),
 		containers.SourceFunc[btrfsprim.ObjID, File](sv.loadFile))
 
 	return sv
 }
 
 func (sv *Subvolume) NewChildSubvolume(childID btrfsprim.ObjID) *Subvolume {
-	return NewSubvolume(sv.ctx, sv.fs, childID, sv.noChecksums)
+	return NewSubvolume(sv.ctx, sv.fs, childID, sv.cfg)
 }
 
 func (sv *Subvolume) GetRootInode() (btrfsprim.ObjID, error) {
@@ -201,7 +255,20 @@ func (sv *Subvolume) loadFullInode(ctx context.Context, inode btrfsprim.ObjID, v
 			case *btrfsitem.DirEntry:
 				val.XAttrs[string(itemBody.Name)] = string(itemBody.Data)
 			case *btrfsitem.Error:
-				val.Errs = append(val.Errs, fmt.Errorf("malformed XATTR_ITEM: %w", itemBody.Err))
+				// Multiple xattrs whose names have the
+				// same hash get packed in to one item.
+				entries, err := btrfsitem.UnmarshalDirEntries(itemBody.Dat)
+				if err != nil || len(entries) < 2 {
+					val.Errs = append(val.Errs, fmt.Errorf("malformed XATTR_ITEM: %w", itemBody.Err))
+				}
+				for _, entry := range entries {
+					if btrfsitem.NameHash(entry.Name) != uint64(item.Key.Offset) {
+						val.Errs = append(val.Errs, fmt.Errorf("XATTR_ITEM %v: name %q does not match the hash in the key",
+							item.Key, entry.Name))
+						continue
+					}
+					val.XAttrs[string(entry.Name)] = string(entry.Data)
+				}
 			default:
 				panic(fmt.Errorf("should not happen: XATTR_ITEM has unexpected item type: %T", itemBody))
 			}
@@ -267,6 +334,34 @@ func (sv *Subvolume) loadDir(_ context.Context, inode btrfsprim.ObjID, dir *Dir)
 			default:
 				panic(fmt.Errorf("should not happen: INODE_REF has unexpected item type: %T", body))
 			}
+		case btrfsitem.INODE_EXTREF_KEY:
+			switch body := item.Body.(type) {
+			case *btrfsitem.InodeExtRefs:
+				if len(body.Refs) != 1 {
+					dir.Errs = append(dir.Errs, fmt.Errorf("INODE_EXTREF item with %d entries on a directory",
+						len(body.Refs)))
+					continue
+				}
+				ref := InodeRef{
+					Inode: body.Refs[0].Parent,
+					InodeRef: btrfsitem.InodeRef{
+						Index:   body.Refs[0].Index,
+						NameLen: body.Refs[0].NameLen,
+						Name:    body.Refs[0].Name,
+					},
+				}
+				if dir.DotDot != nil {
+					if !reflect.DeepEqual(ref, *dir.DotDot) {
+						dir.Errs = append(dir.Errs, fmt.Errorf("multiple INODE_REF/INODE_EXTREF items on a directory"))
+					}
+					continue
+				}
+				dir.DotDot = &ref
+			case *btrfsitem.Error:
+				dir.Errs = append(dir.Errs, fmt.Errorf("malformed INODE_EXTREF: %w", body.Err))
+			default:
+				panic(fmt.Errorf("should not happen: INODE_EXTREF has unexpected item type: %T", body))
+			}
 		case btrfsitem.DIR_ITEM_KEY:
 			switch entry := item.Body.(type) {
 			case *btrfsitem.DirEntry:
@@ -356,6 +451,122 @@ func (dir *Dir) AbsPath() (string, error) {
 	return filepath.Join(parentName, string(dir.DotDot.Name)), nil
 }
 
+// A Link is one of the names that an inode is linked as, according
+// to the inode's INODE_REF and INODE_EXTREF back-references.
+type Link struct {
+	Parent btrfsprim.ObjID // inode number of the parent directory
+	Index  int64           // index of the entry within the parent directory
+	Name   string
+
+	// Path is the absolute path of the link within the subvolume,
+	// or "" if Err is set.
+	Path string
+	// InDir is whether the parent directory has an entry for the
+	// link; if not, then a walk of the directory tree will not
+	// find this link.
+	InDir bool
+	// Err is non-nil if the link is dangling: if the parent
+	// directory is unrecoverable or is not reachable from the
+	// root of the subvolume, or if the parent directory's entry
+	// of that name is for a different inode.
+	Err error
+}
+
+// InodeLinks returns every link to an inode, as recorded by the
+// inode's back-references, sorted by parent directory and index.
+//
+// A walk of the directory tree might only surface some of the links
+// of an inode with NLink > 1 (if some of the directory entries are
+// lost; see Link.InDir); this is how to find the full set of
+// hardlinks.  Dangling
+// links are included, with .Err set; the returned error is only for
+// back-references that could not be read at all.
+func (sv *Subvolume) InodeLinks(inode btrfsprim.ObjID) ([]Link, error) {
+	fullInode, err := sv.AcquireFullInode(inode)
+	if err != nil {
+		return nil, err
+	}
+	var links []Link
+	var errs derror.MultiError
+	for _, item := range fullInode.OtherItems {
+		switch item.Key.ItemType {
+		case btrfsitem.INODE_REF_KEY:
+			switch body := item.Body.(type) {
+			case *btrfsitem.InodeRefs:
+				for _, ref := range body.Refs {
+					links = append(links, Link{
+						Parent: btrfsprim.ObjID(item.Key.Offset),
+						Index:  ref.Index,
+						Name:   string(ref.Name),
+					})
+				}
+			case *btrfsitem.Error:
+				errs = append(errs, fmt.Errorf("malformed INODE_REF: %w", body.Err))
+			default:
+				panic(fmt.Errorf("should not happen: INODE_REF has unexpected item type: %T", body))
+			}
+		case btrfsitem.INODE_EXTREF_KEY:
+			switch body := item.Body.(type) {
+			case *btrfsitem.InodeExtRefs:
+				for _, ref := range body.Refs {
+					if hash := btrfsitem.ExtRefHash(ref.Parent, ref.Name); hash != item.Key.Offset {
+						errs = append(errs, fmt.Errorf("extref crc32c mismatch: key=%#x crc32c(%v, %q)=%#x",
+							item.Key.Offset, ref.Parent, ref.Name, hash))
+						continue
+					}
+					links = append(links, Link{
+						Parent: ref.Parent,
+						Index:  ref.Index,
+						Name:   string(ref.Name),
+					})
+				}
+			case *btrfsitem.Error:
+				errs = append(errs, fmt.Errorf("malformed INODE_EXTREF: %w", body.Err))
+			default:
+				panic(fmt.Errorf("should not happen: INODE_EXTREF has unexpected item type: %T", body))
+			}
+		}
+	}
+	sv.ReleaseFullInode(inode)
+
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Parent != links[j].Parent {
+			return links[i].Parent < links[j].Parent
+		}
+		return links[i].Index < links[j].Index
+	})
+	for i := range links {
+		sv.resolveLink(inode, &links[i])
+	}
+
+	if len(errs) > 0 {
+		return links, errs
+	}
+	return links, nil
+}
+
+func (sv *Subvolume) resolveLink(inode btrfsprim.ObjID, link *Link) {
+	dir, err := sv.AcquireDir(link.Parent)
+	if err != nil {
+		link.Err = fmt.Errorf("parent directory %v: %w", link.Parent, err)
+		return
+	}
+	defer sv.ReleaseDir(link.Parent)
+	dirPath, err := dir.AbsPath()
+	if err != nil {
+		link.Err = fmt.Errorf("parent directory %v: %w", link.Parent, err)
+		return
+	}
+	entry, ok := dir.ChildrenByName[link.Name]
+	if ok && entry.Location.ObjectID != inode {
+		link.Err = fmt.Errorf("parent directory %v: entry %q is for inode %v, not inode %v",
+			link.Parent, link.Name, entry.Location.ObjectID, inode)
+		return
+	}
+	link.Path = filepath.Join(dirPath, link.Name)
+	link.InDir = ok
+}
+
 func (sv *Subvolume) AcquireFile(inode btrfsprim.ObjID) (*File, error) {
 	val := sv.fileCache.Acquire(sv.ctx, inode)
 	if val.Inode == 0 {
@@ -382,11 +593,23 @@ func (sv *Subvolume) loadFile(_ context.Context, inode btrfsprim.ObjID, file *Fi
 
 	for _, item := range file.OtherItems {
 		switch item.Key.ItemType {
-		case btrfsitem.INODE_REF_KEY:
-			// TODO
+		case btrfsitem.INODE_REF_KEY, btrfsitem.INODE_EXTREF_KEY:
+			// See .InodeLinks().
 		case btrfsitem.EXTENT_DATA_KEY:
 			switch itemBody := item.Body.(type) {
 			case *btrfsitem.FileExtent:
+				if itemBody.Type == btrfsitem.FILE_EXTENT_INLINE {
+					sb, err := sv.fs.Superblock()
+					if err != nil {
+						file.Errs = append(file.Errs, err)
+						continue
+					}
+					if limit := sv.cfg.maxInlineExtent(sb); int64(len(itemBody.BodyInline)) > limit || itemBody.RAMBytes > limit {
+						file.Errs = append(file.Errs, fmt.Errorf("inline extent %v: ram_bytes=%v inline_len=%v exceeds the maximum inline extent size %v",
+							item.Key.Offset, itemBody.RAMBytes, len(itemBody.BodyInline), limit))
+						continue
+					}
+				}
 				file.Extents = append(file.Extents, FileExtent{
 					OffsetWithinFile: int64(item.Key.Offset),
 					FileExtent:       *itemBody,
@@ -453,10 +676,25 @@ func (file *File) ReadAt(dat []byte, off int64) (int, error) {
 }
 
 func (file *File) maybeShortReadAt(dat []byte, off int64) (int, error) {
-	for _, extent := range file.Extents {
+	// A PREALLOC extent is allocated but unwritten; it reads as
+	// zeros, and the disk contents of it are stale and must not
+	// be returned.  Normally a write in to a PREALLOC extent
+	// splits it, so that the extents still tile the file; but if
+	// a (corrupt) file has a regular extent overlapping a
+	// PREALLOC extent, then the regular extent's data wins for
+	// the overlapping range.
+	var prealloc bool
+	var preallocEnd int64
+	for i, extent := range file.Extents {
 		extBeg := extent.OffsetWithinFile
 		if extBeg > off {
-			break
+			if !prealloc || extBeg >= preallocEnd {
+				break
+			}
+			if extent.Type != btrfsitem.FILE_EXTENT_PREALLOC {
+				preallocEnd = extBeg
+			}
+			continue
 		}
 		extLen, err := extent.Size()
 		if err != nil {
@@ -468,20 +706,36 @@ func (file *File) maybeShortReadAt(dat []byte, off int64) (int, error) {
 		}
 		offsetWithinExt := off - extent.OffsetWithinFile
 		readSize := slices.Min(int64(len(dat)), extLen-offsetWithinExt, btrfssum.BlockSize)
+		if extent.Type != btrfsitem.FILE_EXTENT_PREALLOC && extent.Compression != btrfsitem.COMPRESS_NONE {
+			decompressed, err := file.decompressExtent(i)
+			if err != nil {
+				return 0, fmt.Errorf("read: extent at %v: %w", extent.OffsetWithinFile, err)
+			}
+			beg := offsetWithinExt
+			if extent.Type == btrfsitem.FILE_EXTENT_REG {
+				beg += int64(extent.BodyExtent.Offset)
+			}
+			if beg+readSize > int64(len(decompressed)) {
+				return 0, fmt.Errorf("read: extent at %v: position %v is past the decompressed size %v",
+					extent.OffsetWithinFile, beg+readSize, len(decompressed))
+			}
+			return copy(dat, decompressed[beg:beg+readSize]), nil
+		}
 		switch extent.Type {
+		case btrfsitem.FILE_EXTENT_PREALLOC:
+			if !prealloc || extEnd > preallocEnd {
+				prealloc = true
+				preallocEnd = extEnd
+			}
 		case btrfsitem.FILE_EXTENT_INLINE:
 			return copy(dat, extent.BodyInline[offsetWithinExt:offsetWithinExt+readSize]), nil
-		case btrfsitem.FILE_EXTENT_REG, btrfsitem.FILE_EXTENT_PREALLOC:
-			sb, err := file.SV.fs.Superblock()
-			if err != nil {
-				return 0, err
-			}
+		case btrfsitem.FILE_EXTENT_REG:
 			beg := extent.BodyExtent.DiskByteNr.
 				Add(extent.BodyExtent.Offset).
 				Add(btrfsvol.AddrDelta(offsetWithinExt))
-			var block [btrfssum.BlockSize]byte
 			blockBeg := (beg / btrfssum.BlockSize) * btrfssum.BlockSize
-			n, err := file.SV.fs.ReadAt(block[:], blockBeg)
+			var block [btrfssum.BlockSize]byte
+			n, err := file.readBlock(&block, blockBeg)
 			if n > int(beg-blockBeg) {
 				n = copy(dat[:readSize], block[beg-blockBeg:])
 			} else {
@@ -490,35 +744,111 @@ func (file *File) maybeShortReadAt(dat []byte, off int64) (int, error) {
 			if err != nil {
 				return 0, err
 			}
-			if !file.SV.noChecksums {
-				sumRun, err := LookupCSum(file.SV.ctx, file.SV.fs, sb.ChecksumType, blockBeg)
-				if err != nil {
-					return 0, fmt.Errorf("checksum@%v: %w", blockBeg, err)
-				}
-				_expSum, ok := sumRun.SumForAddr(blockBeg)
-				if !ok {
-					panic(fmt.Errorf("run from LookupCSum(fs, typ, %v) did not contain %v: %#v",
-						blockBeg, blockBeg, sumRun))
-				}
-				expSum := _expSum.ToFullSum()
-
-				actSum, err := sb.ChecksumType.Sum(block[:])
-				if err != nil {
-					return 0, fmt.Errorf("checksum@%v: %w", blockBeg, err)
-				}
-
-				if actSum != expSum {
-					return 0, fmt.Errorf("checksum@%v: actual sum %v != expected sum %v",
-						blockBeg, actSum, expSum)
-				}
-			}
 			return n, nil
 		}
 	}
+	if prealloc {
+		n := int(slices.Min(int64(len(dat)), preallocEnd-off))
+		for i := range dat[:n] {
+			dat[i] = 0
+		}
+		return n, nil
+	}
 	if file.InodeItem != nil && off >= file.InodeItem.Size {
 		return 0, io.EOF
 	}
 	return 0, fmt.Errorf("read: could not map position %v", off)
 }
 
+// readBlock reads the data block at `blockBeg` in to `block`,
+// verifying it against the checksum tree (unless the Subvolume is
+// configured with NoChecksums).
+func (file *File) readBlock(block *[btrfssum.BlockSize]byte, blockBeg btrfsvol.LogicalAddr) (int, error) {
+	sb, err := file.SV.fs.Superblock()
+	if err != nil {
+		return 0, err
+	}
+	n, err := file.SV.fs.ReadAt(block[:], blockBeg)
+	if err != nil {
+		return n, err
+	}
+	if !file.SV.cfg.NoChecksums {
+		sumRun, err := LookupCSum(file.SV.ctx, file.SV.fs, file.SV.cfg.checksumTree(), sb.ChecksumType, blockBeg)
+		if err != nil {
+			return 0, fmt.Errorf("checksum@%v: %w", blockBeg, err)
+		}
+		_expSum, ok := sumRun.SumForAddr(blockBeg)
+		if !ok {
+			panic(fmt.Errorf("run from LookupCSum(fs, typ, %v) did not contain %v: %#v",
+				blockBeg, blockBeg, sumRun))
+		}
+		expSum := _expSum.ToFullSum()
+
+		actSum, err := sb.ChecksumType.Sum(block[:])
+		if err != nil {
+			return 0, fmt.Errorf("checksum@%v: %w", blockBeg, err)
+		}
+
+		if actSum != expSum {
+			return 0, fmt.Errorf("checksum@%v: actual sum %v != expected sum %v",
+				blockBeg, actSum, expSum)
+		}
+	}
+	return n, nil
+}
+
+// decompressExtent returns the decompressed contents (all RAMBytes
+// of them) of the compressed extent file.Extents[idx].  For a regular
+// extent, the compressed data on disk is checksummed, not the
+// decompressed data.
+func (file *File) decompressExtent(idx int) ([]byte, error) {
+	file.decompressedMu.Lock()
+	defer file.decompressedMu.Unlock()
+	if file.decompressedIdx == idx+1 {
+		return file.decompressed, nil
+	}
+
+	extent := file.Extents[idx]
+	if extent.Compression != btrfsitem.COMPRESS_LZO {
+		return nil, fmt.Errorf("%v compression is not supported", extent.Compression)
+	}
+	sb, err := file.SV.fs.Superblock()
+	if err != nil {
+		return nil, err
+	}
+
+	var compressed []byte
+	switch extent.Type {
+	case btrfsitem.FILE_EXTENT_INLINE:
+		compressed = extent.BodyInline
+	case btrfsitem.FILE_EXTENT_REG:
+		if extent.BodyExtent.DiskNumBytes <= 0 || extent.BodyExtent.DiskNumBytes > btrfscompress.MaxCompressedExtentSize {
+			return nil, fmt.Errorf("implausible compressed size %v", extent.BodyExtent.DiskNumBytes)
+		}
+		compressed = make([]byte, 0, extent.BodyExtent.DiskNumBytes)
+		var block [btrfssum.BlockSize]byte
+		for pos := btrfsvol.AddrDelta(0); pos < extent.BodyExtent.DiskNumBytes; pos += btrfssum.BlockSize {
+			n, err := file.readBlock(&block, extent.BodyExtent.DiskByteNr.Add(pos))
+			compressed = append(compressed, block[:n]...)
+			if err != nil {
+				return nil, err
+			}
+		}
+		compressed = compressed[:slices.Min(len(compressed), int(extent.BodyExtent.DiskNumBytes))]
+	default:
+		return nil, fmt.Errorf("unknown file extent type %v", extent.Type)
+	}
+	if extent.RAMBytes > btrfscompress.MaxCompressedExtentSize {
+		return nil, fmt.Errorf("implausible ram_bytes %v", extent.RAMBytes)
+	}
+
+	decompressed, err := btrfscompress.DecompressLZO(compressed, sb.SectorSize, extent.RAMBytes)
+	if err != nil {
+		return nil, err
+	}
+	file.decompressedIdx = idx + 1
+	file.decompressed = decompressed
+	return decompressed, nil
+}
+
 var _ io.ReaderAt = (*File)(nil)
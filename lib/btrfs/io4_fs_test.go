@@ -0,0 +1,443 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+type memFile []byte
+
+func (memFile) Name() string                  { return "mem" }
+func (f memFile) Size() btrfsvol.PhysicalAddr { return btrfsvol.PhysicalAddr(len(f)) }
+func (memFile) Close() error                  { return nil }
+func (f memFile) ReadAt(p []byte, off btrfsvol.PhysicalAddr) (int, error) {
+	return copy(p, f[off:]), nil
+}
+
+func (f memFile) WriteAt(p []byte, off btrfsvol.PhysicalAddr) (int, error) {
+	return copy(f[off:], p), nil
+}
+
+// noTreesFS is an FS with no btrees, for testing reading file
+// contents without needing a subvolume to look the file up in.
+type noTreesFS struct {
+	*btrfs.FS
+}
+
+func (noTreesFS) ForrestLookup(context.Context, btrfsprim.ObjID) (btrfstree.Tree, error) {
+	return nil, btrfstree.ErrNoTree
+}
+
+// dataSubvolume returns a Subvolume (with no trees, and with
+// checksums turned off) of dataFS.
+func dataSubvolume(t *testing.T, ctx context.Context, laddr btrfsvol.LogicalAddr, dat []byte) *btrfs.Subvolume {
+	t.Helper()
+	fs := dataFS(t, ctx, laddr, dat)
+	return btrfs.NewSubvolume(ctx, noTreesFS{fs}, btrfsprim.FS_TREE_OBJECTID, btrfs.SubvolumeConfig{NoChecksums: true})
+}
+
+// dataFS returns a single-device filesystem with a single data chunk
+// at logical address `laddr`, with `dat` written to the start of the
+// chunk.
+func dataFS(t *testing.T, ctx context.Context, laddr btrfsvol.LogicalAddr, dat []byte) *btrfs.FS {
+	t.Helper()
+	const (
+		blk   = btrfssum.BlockSize
+		paddr = btrfsvol.PhysicalAddr(0x40000)
+	)
+	img := make(memFile, 0x80000)
+	sb := btrfstree.Superblock{
+		Self:         btrfs.SuperblockAddrs[0],
+		Magic:        btrfstree.SuperblockMagic,
+		NumDevices:   1,
+		SectorSize:   blk,
+		NodeSize:     4 * blk,
+		LeafSize:     4 * blk,
+		StripeSize:   blk,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		DevItem:      btrfsitem.Dev{DevID: 1},
+	}
+	var err error
+	sb.Checksum, err = sb.CalculateChecksum()
+	require.NoError(t, err)
+	sbBytes, err := binstruct.Marshal(sb)
+	require.NoError(t, err)
+	copy(img[sb.Self:], sbBytes)
+	copy(img[paddr:], dat)
+
+	fs := new(btrfs.FS)
+	require.NoError(t, fs.AddDevice(ctx, &btrfs.Device{File: img}))
+	require.NoError(t, fs.LV.AddMapping(btrfsvol.Mapping{
+		LAddr:      laddr,
+		PAddr:      btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: paddr},
+		Size:       0x10000,
+		SizeLocked: true,
+	}))
+	return fs
+}
+
+// TestFilePrealloc checks that PREALLOC extents read as zeros rather
+// than as the stale contents of the disk, both when a write in to a
+// PREALLOC extent split it (the normal case), and when a regular
+// extent overlaps a PREALLOC extent.
+func TestFilePrealloc(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	const (
+		blk   = btrfssum.BlockSize
+		laddr = btrfsvol.LogicalAddr(0x100000)
+	)
+
+	// The disk extent is 3 blocks; only the middle block has
+	// been written, the rest is stale garbage.
+	dat := bytes.Repeat([]byte{0xaa}, 3*blk)
+	copy(dat[blk:], bytes.Repeat([]byte{'R'}, blk))
+	sv := dataSubvolume(t, ctx, laddr, dat)
+
+	extent := func(fileOff int64, typ btrfsitem.FileExtentType, diskOff, size int64) btrfs.FileExtent {
+		return btrfs.FileExtent{
+			OffsetWithinFile: fileOff,
+			FileExtent: btrfsitem.FileExtent{
+				Type: typ,
+				BodyExtent: btrfsitem.FileExtentExtent{
+					DiskByteNr:   laddr,
+					DiskNumBytes: 3 * blk,
+					Offset:       btrfsvol.AddrDelta(diskOff),
+					NumBytes:     size,
+				},
+			},
+		}
+	}
+	const (
+		prealloc = btrfsitem.FILE_EXTENT_PREALLOC
+		reg      = btrfsitem.FILE_EXTENT_REG
+	)
+	testcases := map[string][]btrfs.FileExtent{
+		"split": {
+			extent(0, prealloc, 0, blk),
+			extent(blk, reg, blk, blk),
+			extent(2*blk, prealloc, 2*blk, blk),
+		},
+		"overlap": {
+			extent(0, prealloc, 0, 3*blk),
+			extent(blk, reg, blk, blk),
+		},
+	}
+	exp := append(append(make([]byte, blk), bytes.Repeat([]byte{'R'}, blk)...), make([]byte, blk)...)
+	for tcName, extents := range testcases {
+		extents := extents
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			file := &btrfs.File{
+				Extents: extents,
+				SV:      sv,
+			}
+			file.InodeItem = &btrfsitem.Inode{Size: 3 * blk, NumBytes: 3 * blk}
+
+			act := make([]byte, 3*blk)
+			n, err := file.ReadAt(act, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, 3*blk, n)
+			assert.Equal(t, exp, act)
+
+			// Reads that straddle the boundaries.
+			for _, off := range []int64{blk - 10, 2*blk - 10} {
+				act := make([]byte, 20)
+				n, err := file.ReadAt(act, off)
+				assert.NoError(t, err)
+				assert.Equal(t, 20, n)
+				assert.Equal(t, exp[off:off+20], act, "off=%v", off)
+			}
+		})
+	}
+}
+
+// memTree is a btrfstree.Tree of a sorted list of items.
+type memTree []btrfstree.Item
+
+func (memTree) TreeParentID(context.Context) (btrfsprim.ObjID, btrfsprim.Generation, error) {
+	return 0, 0, nil
+}
+
+func (t memTree) TreeLookup(ctx context.Context, key btrfsprim.Key) (btrfstree.Item, error) {
+	return t.TreeSearch(ctx, btrfstree.SearchExactKey(key))
+}
+
+func (t memTree) TreeSearch(_ context.Context, search btrfstree.TreeSearcher) (btrfstree.Item, error) {
+	for _, item := range t {
+		if search.Search(item.Key, item.BodySize) == 0 {
+			return item, nil
+		}
+	}
+	return btrfstree.Item{}, fmt.Errorf("%v: %w", search, btrfstree.ErrNoItem)
+}
+
+func (t memTree) TreeRange(_ context.Context, handleFn func(btrfstree.Item) bool) error {
+	for _, item := range t {
+		if !handleFn(item) {
+			break
+		}
+	}
+	return nil
+}
+
+func (t memTree) TreeSubrange(_ context.Context, min int, search btrfstree.TreeSearcher, handleFn func(btrfstree.Item) bool) error {
+	cnt := 0
+	for _, item := range t {
+		if search.Search(item.Key, item.BodySize) != 0 {
+			continue
+		}
+		cnt++
+		if !handleFn(item) {
+			break
+		}
+	}
+	if cnt < min {
+		return fmt.Errorf("%v: %w", search, btrfstree.ErrNoItem)
+	}
+	return nil
+}
+
+func (memTree) TreeWalk(context.Context, btrfstree.TreeWalkHandler) {}
+
+// memTreesFS is an FS whose btrees are memTrees.
+type memTreesFS struct {
+	*btrfs.FS
+	trees map[btrfsprim.ObjID]memTree
+}
+
+func (fs memTreesFS) ForrestLookup(_ context.Context, treeID btrfsprim.ObjID) (btrfstree.Tree, error) {
+	tree, ok := fs.trees[treeID]
+	if !ok {
+		return nil, btrfstree.ErrNoTree
+	}
+	return tree, nil
+}
+
+func (memTreesFS) Superblock() (*btrfstree.Superblock, error) {
+	return &btrfstree.Superblock{}, nil
+}
+
+// TestInodeLinks checks that InodeLinks finds every link to a file:
+// links that a walk of the directory tree finds, links whose
+// directory entry is lost, and dangling links whose parent directory
+// is lost.
+func TestInodeLinks(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	const (
+		root = btrfsprim.ObjID(256)
+		file = btrfsprim.ObjID(257)
+		dir  = btrfsprim.ObjID(258)
+		lost = btrfsprim.ObjID(259)
+	)
+	key := func(objID btrfsprim.ObjID, typ btrfsprim.ItemType, off uint64) btrfsprim.Key {
+		return btrfsprim.Key{ObjectID: objID, ItemType: typ, Offset: off}
+	}
+	dirEntry := func(parent btrfsprim.ObjID, name string, child btrfsprim.ObjID, typ btrfsitem.FileType) btrfstree.Item {
+		return btrfstree.Item{
+			Key: key(parent, btrfsitem.DIR_ITEM_KEY, btrfsitem.NameHash([]byte(name))),
+			Body: &btrfsitem.DirEntry{
+				Location: key(child, btrfsitem.INODE_ITEM_KEY, 0),
+				Type:     typ,
+				Name:     []byte(name),
+			},
+		}
+	}
+	fsTree := memTree{
+		{Key: key(root, btrfsitem.INODE_ITEM_KEY, 0), Body: &btrfsitem.Inode{NLink: 1, Mode: btrfsitem.ModeFmtDir}},
+		dirEntry(root, "a", file, btrfsitem.FT_REG_FILE),
+		dirEntry(root, "d", dir, btrfsitem.FT_DIR),
+		{Key: key(file, btrfsitem.INODE_ITEM_KEY, 0), Body: &btrfsitem.Inode{NLink: 4, Mode: btrfsitem.ModeFmtRegular}},
+		{Key: key(file, btrfsitem.INODE_REF_KEY, uint64(root)), Body: &btrfsitem.InodeRefs{Refs: []btrfsitem.InodeRef{
+			{Index: 2, Name: []byte("a")},
+		}}},
+		{Key: key(file, btrfsitem.INODE_REF_KEY, uint64(dir)), Body: &btrfsitem.InodeRefs{Refs: []btrfsitem.InodeRef{
+			{Index: 2, Name: []byte("b")},
+		}}},
+		{Key: key(file, btrfsitem.INODE_EXTREF_KEY, btrfsitem.ExtRefHash(dir, []byte("c"))), Body: &btrfsitem.InodeExtRefs{Refs: []btrfsitem.InodeExtRef{
+			{Parent: dir, Index: 3, Name: []byte("c")},
+		}}},
+		{Key: key(file, btrfsitem.INODE_EXTREF_KEY, btrfsitem.ExtRefHash(lost, []byte("e"))), Body: &btrfsitem.InodeExtRefs{Refs: []btrfsitem.InodeExtRef{
+			{Parent: lost, Index: 2, Name: []byte("e")},
+		}}},
+		{Key: key(dir, btrfsitem.INODE_ITEM_KEY, 0), Body: &btrfsitem.Inode{NLink: 1, Mode: btrfsitem.ModeFmtDir}},
+		{Key: key(dir, btrfsitem.INODE_REF_KEY, uint64(root)), Body: &btrfsitem.InodeRefs{Refs: []btrfsitem.InodeRef{
+			{Index: 3, Name: []byte("d")},
+		}}},
+		dirEntry(dir, "b", file, btrfsitem.FT_REG_FILE),
+	}
+	rootTree := memTree{
+		{
+			Key:  key(btrfsprim.FS_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0),
+			Body: &btrfsitem.Root{RootDirID: root},
+		},
+	}
+	sv := btrfs.NewSubvolume(ctx, memTreesFS{
+		FS: new(btrfs.FS),
+		trees: map[btrfsprim.ObjID]memTree{
+			btrfsprim.ROOT_TREE_OBJECTID: rootTree,
+			btrfsprim.FS_TREE_OBJECTID:   fsTree,
+		},
+	}, btrfsprim.FS_TREE_OBJECTID, btrfs.SubvolumeConfig{NoChecksums: true})
+
+	links, err := sv.InodeLinks(file)
+	require.NoError(t, err)
+	require.Len(t, links, 4)
+
+	assert.Equal(t, btrfs.Link{Parent: root, Index: 2, Name: "a", Path: "/a", InDir: true}, links[0])
+	assert.Equal(t, btrfs.Link{Parent: dir, Index: 2, Name: "b", Path: "/d/b", InDir: true}, links[1])
+	assert.Equal(t, btrfs.Link{Parent: dir, Index: 3, Name: "c", Path: "/d/c", InDir: false}, links[2])
+	assert.Equal(t, lost, links[3].Parent)
+	assert.Equal(t, "", links[3].Path)
+	assert.Error(t, links[3].Err)
+}
+
+// TestFileCompressed checks that LZO-compressed extents are
+// decompressed, and that other compressed extents are reported as
+// errors, rather than read as if the compressed bytes were the file
+// contents.
+func TestFileCompressed(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	const (
+		blk   = btrfssum.BlockSize
+		laddr = btrfsvol.LogicalAddr(0x100000)
+	)
+
+	// See testLZOKernelExtent in ../btrfscompress/lzo_test.go;
+	// this is the same 10000 bytes, compressed in to 5565.
+	compressed, err := os.ReadFile(filepath.Join("btrfscompress", "testdata", "lzo-10000.bin"))
+	require.NoError(t, err)
+	require.Len(t, compressed, 5565)
+	sv := dataSubvolume(t, ctx, laddr, compressed)
+
+	t.Run("unsupported", func(t *testing.T) {
+		t.Parallel()
+		for _, typ := range []btrfsitem.FileExtentType{btrfsitem.FILE_EXTENT_INLINE, btrfsitem.FILE_EXTENT_REG} {
+			file := &btrfs.File{
+				Extents: []btrfs.FileExtent{{
+					FileExtent: btrfsitem.FileExtent{
+						RAMBytes:    blk,
+						Compression: btrfsitem.COMPRESS_ZSTD,
+						Type:        typ,
+						BodyInline:  []byte("compressed"),
+						BodyExtent: btrfsitem.FileExtentExtent{
+							DiskByteNr:   laddr,
+							DiskNumBytes: blk,
+							NumBytes:     blk,
+						},
+					},
+				}},
+				SV: sv,
+			}
+			file.InodeItem = &btrfsitem.Inode{Size: blk}
+			n, err := file.ReadAt(make([]byte, 10), 0)
+			assert.Equal(t, 0, n, "type=%v", typ)
+			assert.ErrorContains(t, err, "compression is not supported", "type=%v", typ)
+		}
+	})
+	t.Run("lzo-inline", func(t *testing.T) {
+		t.Parallel()
+		seg := []byte{17 + 5, 't', 'a', 'i', 'l', '\n', 0x11, 0x00, 0x00}
+		inline := binary.LittleEndian.AppendUint32(nil, uint32(8+len(seg)))
+		inline = binary.LittleEndian.AppendUint32(inline, uint32(len(seg)))
+		inline = append(inline, seg...)
+		file := &btrfs.File{
+			Extents: []btrfs.FileExtent{{
+				FileExtent: btrfsitem.FileExtent{
+					RAMBytes:    5,
+					Compression: btrfsitem.COMPRESS_LZO,
+					Type:        btrfsitem.FILE_EXTENT_INLINE,
+					BodyInline:  inline,
+				},
+			}},
+			SV: sv,
+		}
+		file.InodeItem = &btrfsitem.Inode{Size: 5}
+		act := make([]byte, 5)
+		n, err := file.ReadAt(act, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+		assert.Equal(t, "tail\n", string(act))
+	})
+	t.Run("lzo-regular", func(t *testing.T) {
+		t.Parallel()
+		// Two file extents referencing different parts of the
+		// same compressed extent (as after a partial
+		// overwrite), the 2nd one ending at EOF.
+		extent := func(fileOff int64, diskOff btrfsvol.AddrDelta, size int64) btrfs.FileExtent {
+			return btrfs.FileExtent{
+				OffsetWithinFile: fileOff,
+				FileExtent: btrfsitem.FileExtent{
+					RAMBytes:    3 * blk,
+					Compression: btrfsitem.COMPRESS_LZO,
+					Type:        btrfsitem.FILE_EXTENT_REG,
+					BodyExtent: btrfsitem.FileExtentExtent{
+						DiskByteNr:   laddr,
+						DiskNumBytes: 2 * blk,
+						Offset:       diskOff,
+						NumBytes:     size,
+					},
+				},
+			}
+		}
+		file := &btrfs.File{
+			Extents: []btrfs.FileExtent{
+				extent(0, 0, blk),
+				extent(blk, 2*blk, 10000-2*blk),
+			},
+			SV: sv,
+		}
+		file.InodeItem = &btrfsitem.Inode{Size: 10000 - blk}
+
+		exp := append(append([]byte(nil), testLZOKernelInput()[:blk]...), testLZOKernelInput()[2*blk:]...)
+		act := make([]byte, len(exp))
+		n, err := file.ReadAt(act, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, len(exp), n)
+		assert.Equal(t, exp, act)
+	})
+}
+
+// testLZOKernelInput is the uncompressed contents of
+// btrfscompress/testdata/lzo-10000.bin; it is a copy of the function
+// of the same name in ../btrfscompress/lzo_test.go.
+func testLZOKernelInput() []byte {
+	const text = "The quick brown fox jumps over the lazy dog; "
+	ret := make([]byte, 10000)
+	state := uint32(1)
+	for i := range ret {
+		if (i/700)%2 == 0 {
+			ret[i] = text[i%len(text)] + byte(i/3000)
+		} else {
+			state = state*1103515245 + 12345
+			ret[i] = byte(state >> 24)
+		}
+	}
+	return ret
+}
@@ -29,16 +29,25 @@ type GraphCallbacks interface {
 // for a given item type would be a no-op.
 func HandleItemWouldBeNoOp(typ btrfsprim.ItemType) bool {
 	switch typ {
-	case // btrfsitem.Dev
+	case // btrfsitem.Balance
+		btrfsprim.TEMPORARY_ITEM_KEY,
+		// btrfsitem.Dev
 		btrfsprim.DEV_ITEM_KEY,
+		// btrfsitem.DevReplace
+		btrfsprim.DEV_REPLACE_KEY,
 		// btrfsitem.DevStats
 		btrfsprim.PERSISTENT_ITEM_KEY,
+		// btrfsitem.DirLog
+		btrfsprim.DIR_LOG_ITEM_KEY,
+		btrfsprim.DIR_LOG_INDEX_KEY,
 		// btrfsitem.Empty
 		btrfsprim.ORPHAN_ITEM_KEY,
 		btrfsprim.TREE_BLOCK_REF_KEY,
 		btrfsprim.SHARED_BLOCK_REF_KEY,
 		btrfsprim.FREE_SPACE_EXTENT_KEY,
 		btrfsprim.QGROUP_RELATION_KEY,
+		// btrfsitem.StringItem
+		btrfsprim.STRING_ITEM_KEY,
 		// btrfsite.ExtentCSum
 		btrfsprim.EXTENT_CSUM_KEY:
 		return true
@@ -47,11 +56,19 @@ func HandleItemWouldBeNoOp(typ btrfsprim.ItemType) bool {
 	}
 }
 
-func HandleItem(ctx context.Context, o GraphCallbacks, treeID btrfsprim.ObjID, item btrfstree.Item) {
+// HandleItem calls the appropriate GraphCallbacks for the
+// relationships that an item has with other items.  The superblock is
+// needed for the few relationships that depend on the filesystem's
+// features, such as which tree BLOCK_GROUP_ITEMs live in.
+func HandleItem(ctx context.Context, o GraphCallbacks, sb *btrfstree.Superblock, treeID btrfsprim.ObjID, item btrfstree.Item) {
 	// Notionally, just express the relationships shown in
 	// https://btrfs.wiki.kernel.org/index.php/File:References.png (from the page
 	// https://btrfs.wiki.kernel.org/index.php/Data_Structures )
 	switch body := item.Body.(type) {
+	case *btrfsitem.Balance:
+		// nothing
+	case *btrfsitem.DirLog:
+		// nothing; only meaningful during log replay
 	case *btrfsitem.BlockGroup:
 		o.Want(ctx, "Chunk",
 			btrfsprim.CHUNK_TREE_OBJECTID,
@@ -75,6 +92,8 @@ func HandleItem(ctx context.Context, o GraphCallbacks, treeID btrfsprim.ObjID, i
 			body.ChunkObjectID,
 			btrfsitem.CHUNK_ITEM_KEY,
 			uint64(body.ChunkOffset))
+	case *btrfsitem.DevReplace:
+		// nothing
 	case *btrfsitem.DevStats:
 		// nothing
 	case *btrfsitem.DirEntry:
@@ -225,7 +244,7 @@ func HandleItem(ctx context.Context, o GraphCallbacks, treeID btrfsprim.ObjID, i
 			treeID, item.Key.ObjectID, body.Size)
 		if body.BlockGroup != 0 {
 			o.Want(ctx, "BlockGroup",
-				btrfsprim.EXTENT_TREE_OBJECTID,
+				sb.BlockGroupTree(),
 				body.BlockGroup,
 				btrfsitem.BLOCK_GROUP_ITEM_KEY)
 		}
@@ -252,6 +271,29 @@ func HandleItem(ctx context.Context, o GraphCallbacks, treeID btrfsprim.ObjID, i
 				btrfsitem.DIR_INDEX_KEY,
 				uint64(ref.Index))
 		}
+	case *btrfsitem.InodeExtRefs:
+		o.WantOff(ctx, "child Inode",
+			treeID,
+			item.Key.ObjectID,
+			btrfsitem.INODE_ITEM_KEY,
+			0)
+		for _, ref := range body.Refs {
+			o.WantOff(ctx, "parent Inode",
+				treeID,
+				ref.Parent,
+				btrfsitem.INODE_ITEM_KEY,
+				0)
+			o.WantOff(ctx, "DIR_ITEM",
+				treeID,
+				ref.Parent,
+				btrfsitem.DIR_ITEM_KEY,
+				btrfsitem.NameHash(ref.Name))
+			o.WantOff(ctx, "DIR_INDEX",
+				treeID,
+				ref.Parent,
+				btrfsitem.DIR_INDEX_KEY,
+				uint64(ref.Index))
+		}
 	case *btrfsitem.Metadata:
 		for i, ref := range body.Refs {
 			switch refBody := ref.Body.(type) {
@@ -354,6 +396,8 @@ func HandleItem(ctx context.Context, o GraphCallbacks, treeID btrfsprim.ObjID, i
 			btrfsprim.EXTENT_TREE_OBJECTID,
 			item.Key.ObjectID,
 			btrfsitem.EXTENT_ITEM_KEY)
+	case *btrfsitem.StringItem:
+		// nothing
 	case *btrfsitem.UUIDMap:
 		o.Want(ctx, "subvolume Root",
 			btrfsprim.ROOT_TREE_OBJECTID,
@@ -0,0 +1,254 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// A DevExtentProblem is an inconsistency between the DEV_TREE's
+// DEV_EXTENT items and the CHUNK_TREE's chunk stripes.
+type DevExtentProblem struct {
+	Addr btrfsvol.QualifiedPhysicalAddr
+	Size btrfsvol.AddrDelta
+	Msg  string
+}
+
+func (p DevExtentProblem) String() string {
+	return fmt.Sprintf("dev extent dev=%v [%v,%v): %s", p.Addr.Dev, p.Addr.Addr, p.Addr.Addr.Add(p.Size), p.Msg)
+}
+
+// chunkStripeLen returns the number of bytes that each stripe of a
+// chunk occupies on its device.
+func chunkStripeLen(chunk btrfsitem.Chunk) btrfsvol.AddrDelta {
+	numStripes := len(chunk.Stripes)
+	dataStripes := 1
+	switch {
+	case chunk.Head.Type.Has(btrfsvol.BLOCK_GROUP_RAID0):
+		dataStripes = numStripes
+	case chunk.Head.Type.Has(btrfsvol.BLOCK_GROUP_RAID10):
+		if chunk.Head.SubStripes > 0 {
+			dataStripes = numStripes / int(chunk.Head.SubStripes)
+		}
+	case chunk.Head.Type.Has(btrfsvol.BLOCK_GROUP_RAID5):
+		dataStripes = numStripes - 1
+	case chunk.Head.Type.Has(btrfsvol.BLOCK_GROUP_RAID6):
+		dataStripes = numStripes - 2 //nolint:gomnd // RAID6 has 2 parity stripes.
+	}
+	if dataStripes < 1 {
+		dataStripes = 1
+	}
+	return chunk.Head.Size / btrfsvol.AddrDelta(dataStripes)
+}
+
+func sortedPAddrs[V any](m map[btrfsvol.QualifiedPhysicalAddr]V) []btrfsvol.QualifiedPhysicalAddr {
+	ret := maps.Keys(m)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Compare(ret[j]) < 0
+	})
+	return ret
+}
+
+// A DevTreeBuilder checks the DEV_EXTENT items of a DEV_TREE against
+// the stripes of the chunks in the CHUNK_TREE, and synthesizes the
+// DEV_EXTENT items that are missing or that disagree with the chunks.
+//
+// The CHUNK_TREE is taken to be authoritative: every chunk stripe
+// should have exactly one DEV_EXTENT that points back at the chunk,
+// and every DEV_EXTENT should correspond to a chunk stripe.
+type DevTreeBuilder struct {
+	// ChunkTreeUUID is the UUID to put in synthesized
+	// DEV_EXTENTs.
+	ChunkTreeUUID btrfsprim.UUID
+	// All is whether to synthesize DEV_EXTENTs for every chunk
+	// stripe, rather than just for the ones that are missing or
+	// wrong.
+	All bool
+
+	expected map[btrfsvol.QualifiedPhysicalAddr]btrfsitem.DevExtent
+	existing map[btrfsvol.QualifiedPhysicalAddr]btrfsitem.DevExtent
+	problems []DevExtentProblem
+}
+
+// NewDevTreeBuilder returns a new, empty DevTreeBuilder.
+func NewDevTreeBuilder() *DevTreeBuilder {
+	return &DevTreeBuilder{
+		expected: make(map[btrfsvol.QualifiedPhysicalAddr]btrfsitem.DevExtent),
+		existing: make(map[btrfsvol.QualifiedPhysicalAddr]btrfsitem.DevExtent),
+	}
+}
+
+// AddChunk records a CHUNK_ITEM from the CHUNK_TREE.
+func (b *DevTreeBuilder) AddChunk(key btrfsprim.Key, chunk btrfsitem.Chunk) {
+	laddr := btrfsvol.LogicalAddr(key.Offset)
+	length := chunkStripeLen(chunk)
+	for _, stripe := range chunk.Stripes {
+		paddr := btrfsvol.QualifiedPhysicalAddr{Dev: stripe.DeviceID, Addr: stripe.Offset}
+		if other, conflict := b.expected[paddr]; conflict {
+			b.problems = append(b.problems, DevExtentProblem{
+				Addr: paddr,
+				Size: length,
+				Msg: fmt.Sprintf("claimed by both the chunk at laddr=%v and the chunk at laddr=%v",
+					other.ChunkOffset, laddr),
+			})
+			continue
+		}
+		b.expected[paddr] = btrfsitem.DevExtent{
+			ChunkTree:     btrfsprim.CHUNK_TREE_OBJECTID,
+			ChunkObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID,
+			ChunkOffset:   laddr,
+			Length:        length,
+		}
+	}
+}
+
+// AddDevExtent records a DEV_EXTENT item from the DEV_TREE.
+func (b *DevTreeBuilder) AddDevExtent(key btrfsprim.Key, devext btrfsitem.DevExtent) {
+	paddr := btrfsvol.QualifiedPhysicalAddr{
+		Dev:  btrfsvol.DeviceID(key.ObjectID),
+		Addr: btrfsvol.PhysicalAddr(key.Offset),
+	}
+	b.existing[paddr] = devext
+}
+
+// Items returns the synthesized DEV_TREE items (sorted by key), and
+// all of the inconsistencies that were found.  DEV_EXTENTs that are
+// not backed by a chunk stripe are reported, but (as injected items
+// can only add or replace items) are not removed.
+func (b *DevTreeBuilder) Items() ([]InjectedItem, []DevExtentProblem, error) {
+	problems := append([]DevExtentProblem(nil), b.problems...)
+
+	var items []InjectedItem
+	for _, paddr := range sortedPAddrs(b.expected) {
+		want := b.expected[paddr]
+		want.ChunkTreeUUID = b.ChunkTreeUUID
+		have, ok := b.existing[paddr]
+		switch {
+		case !ok:
+			problems = append(problems, DevExtentProblem{
+				Addr: paddr,
+				Size: want.Length,
+				Msg:  fmt.Sprintf("stripe of the chunk at laddr=%v has no DEV_EXTENT", want.ChunkOffset),
+			})
+		case have.ChunkOffset != want.ChunkOffset || have.Length != want.Length:
+			problems = append(problems, DevExtentProblem{
+				Addr: paddr,
+				Size: have.Length,
+				Msg: fmt.Sprintf("DEV_EXTENT says laddr=%v length=%v, but the chunk stripe says laddr=%v length=%v",
+					have.ChunkOffset, have.Length, want.ChunkOffset, want.Length),
+			})
+		default:
+			if !b.All {
+				continue
+			}
+		}
+		dat, err := binstruct.Marshal(want)
+		if err != nil {
+			return nil, nil, fmt.Errorf("dev extent dev=%v paddr=%v: %w", paddr.Dev, paddr.Addr, err)
+		}
+		items = append(items, InjectedItem{
+			Tree: btrfsprim.DEV_TREE_OBJECTID,
+			Key: btrfsprim.Key{
+				ObjectID: btrfsprim.ObjID(paddr.Dev),
+				ItemType: btrfsprim.DEV_EXTENT_KEY,
+				Offset:   uint64(paddr.Addr),
+			},
+			Body: hex.EncodeToString(dat),
+		})
+	}
+	for _, paddr := range sortedPAddrs(b.existing) {
+		if _, ok := b.expected[paddr]; ok {
+			continue
+		}
+		have := b.existing[paddr]
+		problems = append(problems, DevExtentProblem{
+			Addr: paddr,
+			Size: have.Length,
+			Msg:  fmt.Sprintf("DEV_EXTENT (laddr=%v) is not backed by any chunk stripe", have.ChunkOffset),
+		})
+	}
+
+	// Also check that no two chunk stripes overlap on a device.
+	var prev btrfsvol.QualifiedPhysicalAddr
+	var prevLen btrfsvol.AddrDelta
+	for i, paddr := range sortedPAddrs(b.expected) {
+		if i > 0 && paddr.Dev == prev.Dev && prev.Addr.Add(prevLen) > paddr.Addr {
+			problems = append(problems, DevExtentProblem{
+				Addr: paddr,
+				Size: b.expected[paddr].Length,
+				Msg:  fmt.Sprintf("chunk stripe overlaps the chunk stripe at paddr=%v", prev.Addr),
+			})
+		}
+		prev, prevLen = paddr, b.expected[paddr].Length
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Addr.Compare(problems[j].Addr) < 0
+	})
+	return items, problems, nil
+}
+
+// RebuildDevTree reads the CHUNK_TREE and the DEV_TREE, and checks
+// them against each other with a DevTreeBuilder.  The items are in
+// the format read by RebuiltForrest.RebuiltInjectItems.
+//
+// If `all` is true, then items are returned for every chunk stripe,
+// not just the ones that are missing or wrong in the DEV_TREE.
+func RebuildDevTree(ctx context.Context, fs btrfs.ReadableFS, all bool) ([]InjectedItem, []DevExtentProblem, error) {
+	builder := NewDevTreeBuilder()
+	builder.All = all
+
+	for _, treeID := range []btrfsprim.ObjID{btrfsprim.CHUNK_TREE_OBJECTID, btrfsprim.DEV_TREE_OBJECTID} {
+		tree, err := fs.ForrestLookup(ctx, treeID)
+		if err != nil {
+			if treeID == btrfsprim.CHUNK_TREE_OBJECTID {
+				return nil, nil, fmt.Errorf("tree %v: %w", treeID, err)
+			}
+			dlog.Errorf(ctx, "tree %v: %v", treeID, err)
+			continue
+		}
+		tree.TreeWalk(ctx, btrfstree.TreeWalkHandler{
+			Node: func(_ btrfstree.Path, node *btrfstree.Node) {
+				if treeID == btrfsprim.CHUNK_TREE_OBJECTID && builder.ChunkTreeUUID == (btrfsprim.UUID{}) {
+					builder.ChunkTreeUUID = node.Head.ChunkTreeUUID
+				}
+			},
+			BadNode: func(path btrfstree.Path, _ *btrfstree.Node, err error) bool {
+				dlog.Errorf(ctx, "tree %v: %v: %v", treeID, path, err)
+				return false
+			},
+			Item: func(_ btrfstree.Path, item btrfstree.Item) {
+				switch body := item.Body.(type) {
+				case *btrfsitem.Chunk:
+					if treeID == btrfsprim.CHUNK_TREE_OBJECTID {
+						builder.AddChunk(item.Key, *body)
+					}
+				case *btrfsitem.DevExtent:
+					if treeID == btrfsprim.DEV_TREE_OBJECTID {
+						builder.AddDevExtent(item.Key, *body)
+					}
+				}
+			},
+		})
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	return builder.Items()
+}
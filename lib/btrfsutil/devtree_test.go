@@ -0,0 +1,91 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func TestDevTreeBuilder(t *testing.T) {
+	t.Parallel()
+
+	chunkKey := func(laddr btrfsvol.LogicalAddr) btrfsprim.Key {
+		return btrfsprim.Key{ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, ItemType: btrfsitem.CHUNK_ITEM_KEY, Offset: uint64(laddr)}
+	}
+	devExtKey := func(dev btrfsvol.DeviceID, paddr btrfsvol.PhysicalAddr) btrfsprim.Key {
+		return btrfsprim.Key{ObjectID: btrfsprim.ObjID(dev), ItemType: btrfsitem.DEV_EXTENT_KEY, Offset: uint64(paddr)}
+	}
+
+	b := btrfsutil.NewDevTreeBuilder()
+	// DUP chunk: two stripes on dev 1, each the full size.
+	b.AddChunk(chunkKey(0x100000), btrfsitem.Chunk{
+		Head: btrfsitem.ChunkHeader{Size: 0x10000, Type: btrfsvol.BLOCK_GROUP_METADATA | btrfsvol.BLOCK_GROUP_DUP},
+		Stripes: []btrfsitem.ChunkStripe{
+			{DeviceID: 1, Offset: 0x200000},
+			{DeviceID: 1, Offset: 0x210000},
+		},
+	})
+	// RAID0 chunk: two stripes, each half the size.
+	b.AddChunk(chunkKey(0x400000), btrfsitem.Chunk{
+		Head: btrfsitem.ChunkHeader{Size: 0x20000, Type: btrfsvol.BLOCK_GROUP_DATA | btrfsvol.BLOCK_GROUP_RAID0},
+		Stripes: []btrfsitem.ChunkStripe{
+			{DeviceID: 1, Offset: 0x300000},
+			{DeviceID: 2, Offset: 0x300000},
+		},
+	})
+	// Correct.
+	b.AddDevExtent(devExtKey(1, 0x200000), btrfsitem.DevExtent{ChunkOffset: 0x100000, Length: 0x10000})
+	// Wrong length.
+	b.AddDevExtent(devExtKey(1, 0x210000), btrfsitem.DevExtent{ChunkOffset: 0x100000, Length: 0x20000})
+	// (1, 0x300000) is missing.
+	b.AddDevExtent(devExtKey(2, 0x300000), btrfsitem.DevExtent{ChunkOffset: 0x400000, Length: 0x10000})
+	// Not backed by a chunk.
+	b.AddDevExtent(devExtKey(2, 0x900000), btrfsitem.DevExtent{ChunkOffset: 0x800000, Length: 0x10000})
+
+	items, problems, err := b.Items()
+	require.NoError(t, err)
+
+	var problemAddrs []btrfsvol.QualifiedPhysicalAddr
+	for _, problem := range problems {
+		problemAddrs = append(problemAddrs, problem.Addr)
+	}
+	assert.Equal(t, []btrfsvol.QualifiedPhysicalAddr{
+		{Dev: 1, Addr: 0x210000},
+		{Dev: 1, Addr: 0x300000},
+		{Dev: 2, Addr: 0x900000},
+	}, problemAddrs)
+
+	var keys []btrfsprim.Key
+	for _, item := range items {
+		assert.Equal(t, btrfsprim.DEV_TREE_OBJECTID, item.Tree)
+		decoded, err := item.Decode(btrfssum.TYPE_CRC32)
+		require.NoError(t, err)
+		body, ok := decoded.Body.(*btrfsitem.DevExtent)
+		require.True(t, ok)
+		if item.Key.Offset == 0x300000 {
+			assert.Equal(t, btrfsvol.LogicalAddr(0x400000), body.ChunkOffset)
+		}
+		assert.Equal(t, btrfsvol.AddrDelta(0x10000), body.Length)
+		keys = append(keys, item.Key)
+	}
+	assert.Equal(t, []btrfsprim.Key{
+		devExtKey(1, 0x210000),
+		devExtKey(1, 0x300000),
+	}, keys)
+
+	b.All = true
+	items, _, err = b.Items()
+	require.NoError(t, err)
+	assert.Len(t, items, 4)
+}
@@ -0,0 +1,121 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// DiscoveredNodes is the result of DiscoverNodes.
+type DiscoveredNodes struct {
+	// Reachable is the nodes that are reachable from the
+	// superblock's roots by following key-pointers, and that
+	// passed validation; these are high-confidence nodes, whether
+	// or not a scan found them.
+	Reachable containers.Set[btrfsvol.LogicalAddr]
+	// Unreadable is the nodes that are referenced by a root or
+	// key-pointer, but that could not be read or did not pass
+	// validation (for instance, because they are in an unmapped
+	// or damaged region).
+	Unreadable map[btrfsvol.LogicalAddr]error
+}
+
+// DiscoverReport is DiscoveredNodes in a form suitable for writing
+// out as JSON, marking which nodes are high-confidence.
+type DiscoverReport struct {
+	// HighConfidence is the sorted list of reachable nodes.
+	HighConfidence []btrfsvol.LogicalAddr
+	// Unreadable is the sorted list of nodes that are referenced
+	// but unreadable.
+	Unreadable []DiscoverUnreadable
+}
+
+type DiscoverUnreadable struct {
+	Addr btrfsvol.LogicalAddr
+	Err  string
+}
+
+// Report returns the DiscoverReport for the discovered nodes.
+func (d DiscoveredNodes) Report() DiscoverReport {
+	ret := DiscoverReport{
+		HighConfidence: maps.SortedKeys(d.Reachable),
+		Unreadable:     make([]DiscoverUnreadable, 0, len(d.Unreadable)),
+	}
+	for _, addr := range maps.SortedKeys(d.Unreadable) {
+		ret.Unreadable = append(ret.Unreadable, DiscoverUnreadable{
+			Addr: addr,
+			Err:  d.Unreadable[addr].Error(),
+		})
+	}
+	return ret
+}
+
+// DiscoverNodes enumerates the nodes of every tree that is reachable
+// from the superblock, following key-pointers from the roots.  This
+// complements ListNodes' sector-by-sector scan: it is much faster,
+// and finds nodes in regions that the scan skipped, but it can't find
+// nodes that have been lost from the trees.
+//
+// A subtree that is shared between several trees (as with
+// snapshots) is only walked once.
+func DiscoverNodes(ctx context.Context, fs btrfs.ReadableFS) DiscoveredNodes {
+	ret := DiscoveredNodes{
+		Reachable:  make(containers.Set[btrfsvol.LogicalAddr]),
+		Unreadable: make(map[btrfsvol.LogicalAddr]error),
+	}
+	seen := func(addr btrfsvol.LogicalAddr) bool {
+		_, unreadable := ret.Unreadable[addr]
+		return unreadable || ret.Reachable.Has(addr)
+	}
+	WalkAllTrees(ctx, fs, WalkAllTreesHandler{
+		BadTree: func(name string, _ btrfsprim.ObjID, err error) {
+			dlog.Debugf(ctx, "discover nodes: %s: %v", name, err)
+		},
+		Tree: btrfstree.TreeWalkHandler{
+			Node: func(_ btrfstree.Path, node *btrfstree.Node) {
+				ret.Reachable.Insert(node.Head.Addr)
+			},
+			BadNode: func(path btrfstree.Path, _ *btrfstree.Node, err error) bool {
+				if addr, _, ok := path.NodeExpectations(ctx); ok {
+					ret.Unreadable[addr] = err
+				}
+				return false
+			},
+			KeyPointer: func(_ btrfstree.Path, kp btrfstree.KeyPointer) bool {
+				return !seen(kp.BlockPtr)
+			},
+		},
+	})
+	dlog.Infof(ctx, "discover nodes: found %d reachable nodes and %d referenced-but-unreadable nodes",
+		len(ret.Reachable), len(ret.Unreadable))
+	return ret
+}
+
+// MergeDiscoveredNodes merges the nodes found by DiscoverNodes in to
+// a sorted node list as returned by ListNodes, returning the new
+// sorted node list.  It logs how the two sources compare.
+func MergeDiscoveredNodes(ctx context.Context, nodeList []btrfsvol.LogicalAddr, discovered DiscoveredNodes) []btrfsvol.LogicalAddr {
+	set := containers.NewSet(nodeList...)
+	numNew := 0
+	for addr := range discovered.Reachable {
+		if !set.Has(addr) {
+			set.Insert(addr)
+			numNew++
+		}
+	}
+	if numNew > 0 {
+		dlog.Infof(ctx, "discover nodes: %d reachable nodes were missed by the scan", numNew)
+	}
+	return maps.SortedKeys(set)
+}
@@ -0,0 +1,114 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+// TestDiscoverNodes builds an image whose root tree is a single
+// leaf, with a ROOT_ITEM for a tree whose root is in an unmapped
+// region, and checks that the leaf is found as reachable and the
+// other tree's root as unreadable (and that the report marks them as
+// such); and that the leaf is merged in to a node list that lacks it.
+func TestDiscoverNodes(t *testing.T) {
+	t.Parallel()
+	const (
+		nodeSize  = 4096
+		rootAddr  = btrfsvol.LogicalAddr(0x100000)
+		paddr     = btrfsvol.PhysicalAddr(0x20000)
+		lostAddr  = btrfsvol.LogicalAddr(0x900000)
+		otherAddr = btrfsvol.LogicalAddr(0x500000)
+	)
+	fsUUID := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000003")
+	ctx := dlog.NewTestContext(t, false)
+
+	img := make(memFile, 0x40000)
+	builder := &btrfstree.NodeBuilder{
+		Size:         nodeSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		Head: btrfstree.NodeHeader{
+			MetadataUUID: fsUUID,
+			Flags:        btrfstree.NodeWritten,
+			BackrefRev:   btrfstree.MixedBackrefRev,
+			Generation:   42,
+			Owner:        btrfsprim.ROOT_TREE_OBJECTID,
+		},
+		Alloc: func() (btrfsvol.LogicalAddr, error) { return rootAddr, nil },
+		Emit: func(node *btrfstree.Node) error {
+			bs, err := binstruct.Marshal(*node)
+			copy(img[paddr:], bs)
+			return err
+		},
+	}
+	require.NoError(t, builder.Add(btrfstree.Item{
+		Key: btrfsprim.Key{ObjectID: btrfsprim.FS_TREE_OBJECTID, ItemType: btrfsitem.ROOT_ITEM_KEY},
+		Body: &btrfsitem.Root{
+			Generation: 42,
+			ByteNr:     lostAddr,
+		},
+	}))
+	_, _, err := builder.Finish()
+	require.NoError(t, err)
+
+	sb := btrfstree.Superblock{
+		FSUUID:       fsUUID,
+		Self:         btrfs.SuperblockAddrs[0],
+		Magic:        [8]byte{'_', 'B', 'H', 'R', 'f', 'S', '_', 'M'},
+		Generation:   42,
+		RootTree:     rootAddr,
+		NumDevices:   1,
+		SectorSize:   btrfssum.BlockSize,
+		NodeSize:     nodeSize,
+		LeafSize:     nodeSize,
+		StripeSize:   btrfssum.BlockSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		DevItem:      btrfsitem.Dev{DevID: 1},
+	}
+	sb.Checksum, err = sb.CalculateChecksum()
+	require.NoError(t, err)
+	sbBytes, err := binstruct.Marshal(sb)
+	require.NoError(t, err)
+	copy(img[sb.Self:], sbBytes)
+
+	fs := new(btrfs.FS)
+	require.NoError(t, fs.AddDevice(ctx, &btrfs.Device{File: img}))
+	require.NoError(t, fs.LV.AddMapping(btrfsvol.Mapping{
+		LAddr:      rootAddr,
+		PAddr:      btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: paddr},
+		Size:       0x10000,
+		SizeLocked: true,
+		Flags:      containers.OptionalValue(btrfsvol.BLOCK_GROUP_METADATA),
+	}))
+
+	discovered := btrfsutil.DiscoverNodes(ctx, fs)
+	assert.Equal(t, containers.NewSet(rootAddr), discovered.Reachable)
+	assert.Len(t, discovered.Unreadable, 1)
+	assert.Contains(t, discovered.Unreadable, lostAddr)
+
+	report := discovered.Report()
+	assert.Equal(t, []btrfsvol.LogicalAddr{rootAddr}, report.HighConfidence)
+	require.Len(t, report.Unreadable, 1)
+	assert.Equal(t, lostAddr, report.Unreadable[0].Addr)
+	assert.Equal(t, discovered.Unreadable[lostAddr].Error(), report.Unreadable[0].Err)
+
+	assert.Equal(t,
+		[]btrfsvol.LogicalAddr{rootAddr, otherAddr},
+		btrfsutil.MergeDiscoveredNodes(ctx, []btrfsvol.LogicalAddr{otherAddr}, discovered))
+}
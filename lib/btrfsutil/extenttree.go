@@ -0,0 +1,703 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+var itemHeaderSize = binstruct.StaticSize(btrfstree.ItemHeader{})
+
+// An ExtentProblem is an extent that an ExtentTreeBuilder could not
+// attribute to a block group, and so left out of the synthesized
+// EXTENT_TREE.
+type ExtentProblem struct {
+	Addr btrfsvol.LogicalAddr
+	Size btrfsvol.AddrDelta
+	Msg  string
+}
+
+func (p ExtentProblem) String() string {
+	return fmt.Sprintf("extent [%v,%v): %s", p.Addr, p.Addr.Add(p.Size), p.Msg)
+}
+
+type extentDataRefKey struct {
+	Root     btrfsprim.ObjID
+	ObjectID btrfsprim.ObjID
+	Offset   int64
+}
+
+type dataExtent struct {
+	Size       btrfsvol.AddrDelta
+	Generation btrfsprim.Generation
+	Refs       map[extentDataRefKey]int32
+	SharedRefs map[btrfsvol.LogicalAddr]int32
+}
+
+type treeBlock struct {
+	Generation  btrfsprim.Generation
+	Level       uint8
+	FirstKey    btrfsprim.Key
+	FullBackref bool
+	Refs        containers.Set[btrfsprim.ObjID]
+	SharedRefs  containers.Set[btrfsvol.LogicalAddr]
+}
+
+type extentChunk struct {
+	Addr  btrfsvol.LogicalAddr
+	Size  btrfsvol.AddrDelta
+	Flags btrfsvol.BlockGroupFlags
+	Used  int64
+}
+
+// An ExtentTreeBuilder synthesizes the items of an EXTENT_TREE from
+// the things that reference extents--file extents, key-pointers to
+// tree blocks, and chunks--for when the EXTENT_TREE itself has been
+// lost.
+//
+// Data extents get an EXTENT_ITEM with one EXTENT_DATA_REF per
+// distinct (root, inode, offset) that refers to them, counted once
+// per FILE_EXTENT item, and one SHARED_DATA_REF per distinct leaf
+// (with the FULL_BACKREF flag) that refers to them; tree blocks get
+// an EXTENT_ITEM or METADATA_ITEM with one TREE_BLOCK_REF per
+// distinct tree that points at them, and one SHARED_BLOCK_REF per
+// distinct node (with the FULL_BACKREF flag) that points at them.
+// As many backrefs as fit are inlined in to the EXTENT_ITEM or
+// METADATA_ITEM, and the rest are separate items.
+type ExtentTreeBuilder struct {
+	// SkinnyMetadata is whether to describe tree blocks with
+	// METADATA_ITEMs rather than EXTENT_ITEMs.
+	SkinnyMetadata bool
+	// NodeSize is the size of each tree block.
+	NodeSize uint32
+	// BlockGroups is whether to also synthesize BLOCK_GROUP_ITEMs.
+	BlockGroups bool
+	// MaxExtentItemSize is the largest that an EXTENT_ITEM or
+	// METADATA_ITEM may be before further backrefs are split out
+	// in to separate items.
+	MaxExtentItemSize int
+
+	dataExtents map[btrfsvol.LogicalAddr]*dataExtent
+	treeBlocks  map[btrfsvol.LogicalAddr]*treeBlock
+	chunks      map[btrfsvol.LogicalAddr]*extentChunk
+	problems    []ExtentProblem
+}
+
+// NewExtentTreeBuilder returns an ExtentTreeBuilder configured for
+// the filesystem described by `sb`.
+func NewExtentTreeBuilder(sb btrfstree.Superblock) *ExtentTreeBuilder {
+	return &ExtentTreeBuilder{
+		SkinnyMetadata: sb.IncompatFlags.Has(btrfstree.FeatureIncompatSkinnyMetadata),
+		NodeSize:       sb.NodeSize,
+		BlockGroups:    sb.BlockGroupTree() == btrfsprim.EXTENT_TREE_OBJECTID,
+		// BTRFS_MAX_EXTENT_ITEM_SIZE
+		MaxExtentItemSize: (int(sb.NodeSize)-nodeHeaderSize)/16 - itemHeaderSize, //nolint:gomnd // Same as the kernel.
+
+		dataExtents: make(map[btrfsvol.LogicalAddr]*dataExtent),
+		treeBlocks:  make(map[btrfsvol.LogicalAddr]*treeBlock),
+		chunks:      make(map[btrfsvol.LogicalAddr]*extentChunk),
+	}
+}
+
+// AddChunk records a CHUNK_ITEM, so that the extents within it may be
+// attributed to its block group.
+func (b *ExtentTreeBuilder) AddChunk(key btrfsprim.Key, chunk btrfsitem.Chunk) {
+	addr := btrfsvol.LogicalAddr(key.Offset)
+	if _, dup := b.chunks[addr]; dup {
+		return
+	}
+	b.chunks[addr] = &extentChunk{
+		Addr:  addr,
+		Size:  chunk.Head.Size,
+		Flags: chunk.Head.Type,
+	}
+}
+
+// dataExtent returns the record for the extent that `fe` refers to,
+// or nil if `fe` does not refer to an extent, or disagrees with an
+// earlier FILE_EXTENT about the extent's size.  `who` describes the
+// referrer, for the problem report.
+func (b *ExtentTreeBuilder) dataExtent(fe btrfsitem.FileExtent, who string) *dataExtent {
+	if fe.Type == btrfsitem.FILE_EXTENT_INLINE || fe.BodyExtent.DiskByteNr == 0 {
+		return nil
+	}
+	addr := fe.BodyExtent.DiskByteNr
+	ext, ok := b.dataExtents[addr]
+	if !ok {
+		ext = &dataExtent{
+			Size:       fe.BodyExtent.DiskNumBytes,
+			Refs:       make(map[extentDataRefKey]int32),
+			SharedRefs: make(map[btrfsvol.LogicalAddr]int32),
+		}
+		b.dataExtents[addr] = ext
+	}
+	if ext.Size != fe.BodyExtent.DiskNumBytes {
+		b.problems = append(b.problems, ExtentProblem{
+			Addr: addr,
+			Size: fe.BodyExtent.DiskNumBytes,
+			Msg:  fmt.Sprintf("referenced by %s with a different size than the %v seen earlier", who, ext.Size),
+		})
+		return nil
+	}
+	if fe.Generation > ext.Generation {
+		ext.Generation = fe.Generation
+	}
+	return ext
+}
+
+// AddFileExtent records a FILE_EXTENT item in the tree `root`, as an
+// EXTENT_DATA_REF.  Inline extents and holes do not refer to any
+// extent, and are ignored.
+func (b *ExtentTreeBuilder) AddFileExtent(root btrfsprim.ObjID, key btrfsprim.Key, fe btrfsitem.FileExtent) {
+	ext := b.dataExtent(fe, fmt.Sprintf("tree %v inode %v at offset %v", root, key.ObjectID, key.Offset))
+	if ext == nil {
+		return
+	}
+	ext.Refs[extentDataRefKey{
+		Root:     root,
+		ObjectID: key.ObjectID,
+		Offset:   int64(key.Offset) - int64(fe.BodyExtent.Offset),
+	}]++
+}
+
+// AddSharedFileExtent records a FILE_EXTENT item in the leaf at
+// `parent`, as a SHARED_DATA_REF; see SetFullBackref.  Inline
+// extents and holes do not refer to any extent, and are ignored.
+func (b *ExtentTreeBuilder) AddSharedFileExtent(parent btrfsvol.LogicalAddr, key btrfsprim.Key, fe btrfsitem.FileExtent) {
+	ext := b.dataExtent(fe, fmt.Sprintf("leaf %v inode %v at offset %v", parent, key.ObjectID, key.Offset))
+	if ext == nil {
+		return
+	}
+	ext.SharedRefs[parent]++
+}
+
+// treeBlock returns the record for the tree block at `addr`; the
+// other arguments describe the block, as seen from the key-pointer to
+// it (or from the block itself, for a tree's root).
+func (b *ExtentTreeBuilder) treeBlock(addr btrfsvol.LogicalAddr, gen btrfsprim.Generation, level uint8, firstKey btrfsprim.Key) *treeBlock {
+	blk, ok := b.treeBlocks[addr]
+	if !ok {
+		blk = &treeBlock{
+			Generation: gen,
+			Level:      level,
+			FirstKey:   firstKey,
+			Refs:       make(containers.Set[btrfsprim.ObjID]),
+			SharedRefs: make(containers.Set[btrfsvol.LogicalAddr]),
+		}
+		b.treeBlocks[addr] = blk
+	}
+	return blk
+}
+
+// AddTreeBlock records that the tree `root` points at the tree block
+// at `addr`, as a TREE_BLOCK_REF; the other arguments describe the
+// block, as seen from the key-pointer to it (or from the block
+// itself, for a tree's root).
+func (b *ExtentTreeBuilder) AddTreeBlock(addr btrfsvol.LogicalAddr, gen btrfsprim.Generation, level uint8, firstKey btrfsprim.Key, root btrfsprim.ObjID) {
+	b.treeBlock(addr, gen, level, firstKey).Refs.Insert(root)
+}
+
+// AddSharedTreeBlock records that the node at `parent` points at the
+// tree block at `addr`, as a SHARED_BLOCK_REF; see SetFullBackref.
+// The other arguments are as for AddTreeBlock.
+func (b *ExtentTreeBuilder) AddSharedTreeBlock(addr btrfsvol.LogicalAddr, gen btrfsprim.Generation, level uint8, firstKey btrfsprim.Key, parent btrfsvol.LogicalAddr) {
+	b.treeBlock(addr, gen, level, firstKey).SharedRefs.Insert(parent)
+}
+
+// SetFullBackref records that the tree block at `addr` (which must
+// already have been added) has the FULL_BACKREF flag: that the tree
+// blocks and data extents that it points at refer back to it with
+// SHARED_BLOCK_REFs and SHARED_DATA_REFs, rather than with
+// TREE_BLOCK_REFs and EXTENT_DATA_REFs naming a tree.
+func (b *ExtentTreeBuilder) SetFullBackref(addr btrfsvol.LogicalAddr) {
+	if blk, ok := b.treeBlocks[addr]; ok {
+		blk.FullBackref = true
+	}
+}
+
+// Clone returns a deep copy of the builder, so that more chunks and
+// extents may be added to the copy without affecting the original.
+func (b *ExtentTreeBuilder) Clone() *ExtentTreeBuilder {
+	ret := *b
+	ret.dataExtents = make(map[btrfsvol.LogicalAddr]*dataExtent, len(b.dataExtents))
+	for addr, ext := range b.dataExtents {
+		extCopy := *ext
+		extCopy.Refs = make(map[extentDataRefKey]int32, len(ext.Refs))
+		for key, cnt := range ext.Refs {
+			extCopy.Refs[key] = cnt
+		}
+		extCopy.SharedRefs = make(map[btrfsvol.LogicalAddr]int32, len(ext.SharedRefs))
+		for parent, cnt := range ext.SharedRefs {
+			extCopy.SharedRefs[parent] = cnt
+		}
+		ret.dataExtents[addr] = &extCopy
+	}
+	ret.treeBlocks = make(map[btrfsvol.LogicalAddr]*treeBlock, len(b.treeBlocks))
+	for addr, blk := range b.treeBlocks {
+		blkCopy := *blk
+		blkCopy.Refs = make(containers.Set[btrfsprim.ObjID], len(blk.Refs))
+		blkCopy.Refs.InsertFrom(blk.Refs)
+		blkCopy.SharedRefs = make(containers.Set[btrfsvol.LogicalAddr], len(blk.SharedRefs))
+		blkCopy.SharedRefs.InsertFrom(blk.SharedRefs)
+		ret.treeBlocks[addr] = &blkCopy
+	}
+	ret.chunks = make(map[btrfsvol.LogicalAddr]*extentChunk, len(b.chunks))
+	for addr, chunk := range b.chunks {
+		chunkCopy := *chunk
+		ret.chunks[addr] = &chunkCopy
+	}
+	ret.problems = append([]ExtentProblem(nil), b.problems...)
+	return &ret
+}
+
+type extentSpan struct {
+	Addr btrfsvol.LogicalAddr
+	Size btrfsvol.AddrDelta
+}
+
+const (
+	extentHeaderSize  = 24 // binstruct.StaticSize(btrfsitem.ExtentHeader{})
+	treeBlockInfoSize = 18 // binstruct.StaticSize(btrfsitem.TreeBlockInfo{})
+)
+
+// An extentBackref is a backref that may either be inlined in to an
+// EXTENT_ITEM or METADATA_ITEM, or be an item of its own.
+type extentBackref struct {
+	Type btrfsitem.Type
+	// Offset is the key.offset of the backref as a separate item:
+	// the tree ID, the parent node, or (for EXTENT_DATA_REF) the
+	// hash.
+	Offset uint64
+	// Body is nil for TREE_BLOCK_REF and SHARED_BLOCK_REF.
+	Body btrfsitem.Item
+}
+
+func (ref extentBackref) inline() btrfsitem.ExtentInlineRef {
+	ret := btrfsitem.ExtentInlineRef{
+		Type: ref.Type,
+		Body: ref.Body,
+	}
+	if ref.Type != btrfsitem.EXTENT_DATA_REF_KEY {
+		ret.Offset = ref.Offset
+	}
+	return ret
+}
+
+func (ref extentBackref) inlineSize() int {
+	switch ref.Type {
+	case btrfsitem.EXTENT_DATA_REF_KEY:
+		return 1 + 28 // type + ExtentDataRef
+	case btrfsitem.SHARED_DATA_REF_KEY:
+		return 1 + 8 + 4 // type + offset + SharedDataRef
+	default:
+		return 1 + 8 // type + offset
+	}
+}
+
+// sortExtentBackrefs sorts backrefs in to the order that the kernel
+// (lookup_inline_extent_backref) expects inline backrefs to be in:
+// ascending by type, and then descending by offset (or by hash, for
+// EXTENT_DATA_REFs).  The kernel gives up on an inline lookup as soon
+// as it passes where the backref would be, so any other order would
+// make backrefs impossible to find.
+func sortExtentBackrefs(refs []extentBackref) {
+	sort.Slice(refs, func(i, j int) bool {
+		a, b := refs[i], refs[j]
+		switch {
+		case a.Type != b.Type:
+			return a.Type < b.Type
+		case a.Offset != b.Offset:
+			return a.Offset > b.Offset
+		}
+		// Only EXTENT_DATA_REFs can have equal offsets (on a
+		// hash collision); order those deterministically.
+		aRef, aOK := a.Body.(*btrfsitem.ExtentDataRef)
+		bRef, bOK := b.Body.(*btrfsitem.ExtentDataRef)
+		if !aOK || !bOK {
+			return false
+		}
+		switch {
+		case aRef.Root != bRef.Root:
+			return aRef.Root < bRef.Root
+		case aRef.ObjectID != bRef.ObjectID:
+			return aRef.ObjectID < bRef.ObjectID
+		default:
+			return aRef.Offset < bRef.Offset
+		}
+	})
+}
+
+// Items returns the synthesized EXTENT_TREE items (sorted by key), and
+// the extents that could not be attributed to a block group (or that
+// overlap an extent that could be) and so were left out.
+func (b *ExtentTreeBuilder) Items() ([]InjectedItem, []ExtentProblem, error) {
+	problems := append([]ExtentProblem(nil), b.problems...)
+
+	chunks := containers.IntervalTree[containers.NativeOrdered[btrfsvol.LogicalAddr], *extentChunk]{
+		MinFn: func(c *extentChunk) containers.NativeOrdered[btrfsvol.LogicalAddr] {
+			return containers.NativeOrdered[btrfsvol.LogicalAddr]{Val: c.Addr}
+		},
+		MaxFn: func(c *extentChunk) containers.NativeOrdered[btrfsvol.LogicalAddr] {
+			return containers.NativeOrdered[btrfsvol.LogicalAddr]{Val: c.Addr.Add(c.Size - 1)}
+		},
+	}
+	for _, chunk := range b.chunks {
+		chunk.Used = 0
+		if chunk.Size > 0 {
+			chunks.Insert(chunk)
+		}
+	}
+	accepted := containers.IntervalTree[containers.NativeOrdered[btrfsvol.LogicalAddr], extentSpan]{
+		MinFn: func(s extentSpan) containers.NativeOrdered[btrfsvol.LogicalAddr] {
+			return containers.NativeOrdered[btrfsvol.LogicalAddr]{Val: s.Addr}
+		},
+		MaxFn: func(s extentSpan) containers.NativeOrdered[btrfsvol.LogicalAddr] {
+			return containers.NativeOrdered[btrfsvol.LogicalAddr]{Val: s.Addr.Add(s.Size - 1)}
+		},
+	}
+	// attribute returns whether the extent is entirely within a
+	// single block group of the right type, and does not overlap
+	// any other extent.
+	attribute := func(addr btrfsvol.LogicalAddr, size btrfsvol.AddrDelta, want btrfsvol.BlockGroupFlags) bool {
+		span := extentSpan{Addr: addr, Size: size}
+		if size <= 0 {
+			problems = append(problems, ExtentProblem{Addr: addr, Size: size, Msg: "has a non-positive size"})
+			return false
+		}
+		min := containers.NativeOrdered[btrfsvol.LogicalAddr]{Val: addr}
+		max := containers.NativeOrdered[btrfsvol.LogicalAddr]{Val: addr.Add(size - 1)}
+		in := chunks.Overlaps(min, max)
+		switch {
+		case len(in) == 0:
+			problems = append(problems, ExtentProblem{Addr: addr, Size: size, Msg: "is not in any chunk"})
+			return false
+		case len(in) > 1 || in[0].Addr > addr || in[0].Addr.Add(in[0].Size) < addr.Add(size):
+			problems = append(problems, ExtentProblem{Addr: addr, Size: size, Msg: "straddles a chunk boundary"})
+			return false
+		case in[0].Flags&want == 0:
+			problems = append(problems, ExtentProblem{Addr: addr, Size: size,
+				Msg: fmt.Sprintf("is in a %v chunk, but should be in a %v chunk", in[0].Flags, want)})
+			return false
+		}
+		if others := accepted.Overlaps(min, max); len(others) > 0 {
+			problems = append(problems, ExtentProblem{Addr: addr, Size: size,
+				Msg: fmt.Sprintf("overlaps the extent [%v,%v)", others[0].Addr, others[0].Addr.Add(others[0].Size))})
+			return false
+		}
+		accepted.Insert(span)
+		in[0].Used += int64(size)
+		return true
+	}
+
+	var items []InjectedItem
+	add := func(key btrfsprim.Key, body any) error {
+		dat, err := binstruct.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("key %v: %w", key, err)
+		}
+		items = append(items, InjectedItem{
+			Tree: btrfsprim.EXTENT_TREE_OBJECTID,
+			Key:  key,
+			Body: hex.EncodeToString(dat),
+		})
+		return nil
+	}
+	// addExtent adds the EXTENT_ITEM or METADATA_ITEM `key` (as
+	// returned by `mkBody`), with as many of the `refs` inlined
+	// in to it as fit after `headSize` bytes, and the rest of
+	// them as separate items.
+	addExtent := func(key btrfsprim.Key, headSize int, refs []extentBackref, mkBody func([]btrfsitem.ExtentInlineRef) any) error {
+		sortExtentBackrefs(refs)
+		var inline []btrfsitem.ExtentInlineRef
+		size := headSize
+		for len(refs) > 0 && (size+refs[0].inlineSize() <= b.MaxExtentItemSize || len(inline) == 0) {
+			inline = append(inline, refs[0].inline())
+			size += refs[0].inlineSize()
+			refs = refs[1:]
+		}
+		if err := add(key, mkBody(inline)); err != nil {
+			return err
+		}
+		usedOffsets := make(containers.Set[uint64], len(refs))
+		for _, ref := range refs {
+			offset := ref.Offset
+			// On an EXTENT_DATA_REF hash collision, the
+			// kernel (insert_extent_data_ref) probes for
+			// the next free key.offset, and when looking a
+			// ref up it scans forward from the hash.
+			for ref.Type == btrfsitem.EXTENT_DATA_REF_KEY && usedOffsets.Has(offset) {
+				offset++
+			}
+			usedOffsets.Insert(offset)
+			var body any = ref.Body
+			if body == nil {
+				body = btrfsitem.Empty{}
+			}
+			if err := add(btrfsprim.Key{
+				ObjectID: key.ObjectID,
+				ItemType: ref.Type,
+				Offset:   offset,
+			}, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Tree blocks go first, so that if a data extent overlaps a
+	// tree block it is the data extent that gets reported.
+	for _, addr := range maps.SortedKeys(b.treeBlocks) {
+		blk := b.treeBlocks[addr]
+		if !attribute(addr, btrfsvol.AddrDelta(b.NodeSize), btrfsvol.BLOCK_GROUP_METADATA|btrfsvol.BLOCK_GROUP_SYSTEM) {
+			continue
+		}
+		head := btrfsitem.ExtentHeader{
+			Refs:       int64(len(blk.Refs) + len(blk.SharedRefs)),
+			Generation: blk.Generation,
+			Flags:      btrfsitem.EXTENT_FLAG_TREE_BLOCK,
+		}
+		if blk.FullBackref {
+			head.Flags |= btrfsitem.BLOCK_FLAG_FULL_BACKREF
+		}
+		refs := make([]extentBackref, 0, len(blk.Refs)+len(blk.SharedRefs))
+		for root := range blk.Refs {
+			refs = append(refs, extentBackref{Type: btrfsitem.TREE_BLOCK_REF_KEY, Offset: uint64(root)})
+		}
+		for parent := range blk.SharedRefs {
+			refs = append(refs, extentBackref{Type: btrfsitem.SHARED_BLOCK_REF_KEY, Offset: uint64(parent)})
+		}
+		var err error
+		if b.SkinnyMetadata {
+			err = addExtent(btrfsprim.Key{
+				ObjectID: btrfsprim.ObjID(addr),
+				ItemType: btrfsitem.METADATA_ITEM_KEY,
+				Offset:   uint64(blk.Level),
+			}, extentHeaderSize, refs, func(inline []btrfsitem.ExtentInlineRef) any {
+				return btrfsitem.Metadata{Head: head, Refs: inline}
+			})
+		} else {
+			err = addExtent(btrfsprim.Key{
+				ObjectID: btrfsprim.ObjID(addr),
+				ItemType: btrfsitem.EXTENT_ITEM_KEY,
+				Offset:   uint64(b.NodeSize),
+			}, extentHeaderSize+treeBlockInfoSize, refs, func(inline []btrfsitem.ExtentInlineRef) any {
+				return btrfsitem.Extent{
+					Head: head,
+					Info: btrfsitem.TreeBlockInfo{Key: blk.FirstKey, Level: blk.Level},
+					Refs: inline,
+				}
+			})
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, addr := range maps.SortedKeys(b.dataExtents) {
+		ext := b.dataExtents[addr]
+		if !attribute(addr, ext.Size, btrfsvol.BLOCK_GROUP_DATA) {
+			continue
+		}
+		refs := make([]extentBackref, 0, len(ext.Refs)+len(ext.SharedRefs))
+		var total int64
+		for key, count := range ext.Refs {
+			refs = append(refs, extentBackref{
+				Type:   btrfsitem.EXTENT_DATA_REF_KEY,
+				Offset: btrfsitem.ExtentDataRefHash(key.Root, key.ObjectID, key.Offset),
+				Body: &btrfsitem.ExtentDataRef{
+					Root:     key.Root,
+					ObjectID: key.ObjectID,
+					Offset:   key.Offset,
+					Count:    count,
+				},
+			})
+			total += int64(count)
+		}
+		for parent, count := range ext.SharedRefs {
+			refs = append(refs, extentBackref{
+				Type:   btrfsitem.SHARED_DATA_REF_KEY,
+				Offset: uint64(parent),
+				Body:   &btrfsitem.SharedDataRef{Count: count},
+			})
+			total += int64(count)
+		}
+		head := btrfsitem.ExtentHeader{
+			Refs:       total,
+			Generation: ext.Generation,
+			Flags:      btrfsitem.EXTENT_FLAG_DATA,
+		}
+		if err := addExtent(btrfsprim.Key{
+			ObjectID: btrfsprim.ObjID(addr),
+			ItemType: btrfsitem.EXTENT_ITEM_KEY,
+			Offset:   uint64(ext.Size),
+		}, extentHeaderSize, refs, func(inline []btrfsitem.ExtentInlineRef) any {
+			return btrfsitem.Extent{Head: head, Refs: inline}
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if b.BlockGroups {
+		for _, addr := range maps.SortedKeys(b.chunks) {
+			chunk := b.chunks[addr]
+			if err := add(btrfsprim.Key{
+				ObjectID: btrfsprim.ObjID(addr),
+				ItemType: btrfsitem.BLOCK_GROUP_ITEM_KEY,
+				Offset:   uint64(chunk.Size),
+			}, btrfsitem.BlockGroup{
+				Used:          chunk.Used,
+				ChunkObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID,
+				Flags:         chunk.Flags,
+			}); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key.Compare(items[j].Key) < 0
+	})
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Addr < problems[j].Addr
+	})
+	return items, problems, nil
+}
+
+// RebuildExtentTree walks every tree in the filesystem (except for
+// the log trees, whose blocks the EXTENT_TREE does not track), and
+// synthesizes the items of a new EXTENT_TREE with an
+// ExtentTreeBuilder.  Only the tree blocks of the existing EXTENT_TREE
+// are counted, not its items.  Trees that cannot be walked are logged
+// as errors.  The items are in the format read by
+// RebuiltForrest.RebuiltInjectItems.
+//
+// A subtree that is shared between several trees is only descended
+// in to once, so that the file extents within it are only counted
+// once.  As in `btrfs check`, a block gets the FULL_BACKREF flag (and
+// the things that it points at get SHARED_* backrefs to it) if it is
+// not the root of the tree that it is reached from, and either it is
+// owned by a different tree or it has the RELOC flag.  Because a
+// snapshot always has a larger tree ID than the tree that it is a
+// snapshot of, and trees are walked in the order of their ROOT_ITEMs,
+// a block that is still reachable from its owner is reached from its
+// owner first.
+func RebuildExtentTree(ctx context.Context, fs btrfs.ReadableFS) ([]InjectedItem, []ExtentProblem, error) {
+	sb, err := fs.Superblock()
+	if err != nil {
+		return nil, nil, err
+	}
+	builder := NewExtentTreeBuilder(*sb)
+
+	type nodeInfo struct {
+		Owner       btrfsprim.ObjID
+		FullBackref bool
+	}
+	visited := make(map[btrfsvol.LogicalAddr]nodeInfo)
+	// parent returns the address of the node that contains the
+	// last element of the path.
+	parent := func(path btrfstree.Path) btrfsvol.LogicalAddr {
+		switch elem := path[len(path)-2].(type) {
+		case btrfstree.PathRoot:
+			return elem.ToAddr
+		case btrfstree.PathKP:
+			return elem.ToAddr
+		default:
+			panic(fmt.Errorf("should not happen: unexpected PathElem type: %T", elem))
+		}
+	}
+	var (
+		curTree   btrfsprim.ObjID
+		skipTree  bool
+		skipItems bool
+		skipLeaf  bool
+	)
+	WalkAllTrees(ctx, fs, WalkAllTreesHandler{
+		PreTree: func(_ string, treeID btrfsprim.ObjID) {
+			curTree = treeID
+			skipTree = treeID == btrfsprim.TREE_LOG_OBJECTID ||
+				treeID == btrfsprim.TREE_LOG_FIXUP_OBJECTID
+			skipItems = treeID == btrfsprim.EXTENT_TREE_OBJECTID
+		},
+		BadTree: func(name string, _ btrfsprim.ObjID, err error) {
+			dlog.Errorf(ctx, "%s: %v", name, err)
+		},
+		Tree: btrfstree.TreeWalkHandler{
+			Node: func(path btrfstree.Path, node *btrfstree.Node) {
+				if skipTree {
+					return
+				}
+				addr := node.Head.Addr
+				_, skipLeaf = visited[addr]
+				if skipLeaf {
+					return
+				}
+				info := nodeInfo{
+					Owner: node.Head.Owner,
+					FullBackref: len(path) > 1 &&
+						(node.Head.Flags.Has(btrfstree.NodeReloc) || node.Head.Owner != curTree),
+				}
+				visited[addr] = info
+				if len(path) == 1 {
+					firstKey, _ := node.MinItem()
+					builder.AddTreeBlock(addr, node.Head.Generation, node.Head.Level, firstKey, curTree)
+				}
+				if info.FullBackref {
+					builder.SetFullBackref(addr)
+				}
+			},
+			KeyPointer: func(path btrfstree.Path, _ btrfstree.KeyPointer) bool {
+				if skipTree {
+					return false
+				}
+				kp := path[len(path)-1].(btrfstree.PathKP)
+				parentAddr := parent(path)
+				if from := visited[parentAddr]; from.FullBackref {
+					builder.AddSharedTreeBlock(kp.ToAddr, kp.ToGeneration, kp.ToLevel, kp.ToMinKey, parentAddr)
+				} else {
+					builder.AddTreeBlock(kp.ToAddr, kp.ToGeneration, kp.ToLevel, kp.ToMinKey, from.Owner)
+				}
+				_, seen := visited[kp.ToAddr]
+				return !seen
+			},
+			Item: func(path btrfstree.Path, item btrfstree.Item) {
+				if skipTree || skipItems || skipLeaf {
+					return
+				}
+				switch body := item.Body.(type) {
+				case *btrfsitem.FileExtent:
+					leafAddr := parent(path)
+					if leaf := visited[leafAddr]; leaf.FullBackref {
+						builder.AddSharedFileExtent(leafAddr, item.Key, *body)
+					} else {
+						builder.AddFileExtent(leaf.Owner, item.Key, *body)
+					}
+				case *btrfsitem.Chunk:
+					if curTree == btrfsprim.CHUNK_TREE_OBJECTID {
+						builder.AddChunk(item.Key, *body)
+					}
+				}
+			},
+		},
+	})
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+
+	return builder.Items()
+}
@@ -0,0 +1,464 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func TestExtentTreeBuilder(t *testing.T) {
+	t.Parallel()
+
+	b := btrfsutil.NewExtentTreeBuilder(btrfstree.Superblock{
+		NodeSize:      16384,
+		IncompatFlags: btrfstree.FeatureIncompatSkinnyMetadata,
+	})
+	b.AddChunk(btrfsprim.Key{ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, ItemType: btrfsitem.CHUNK_ITEM_KEY, Offset: 0x100000},
+		btrfsitem.Chunk{Head: btrfsitem.ChunkHeader{Size: 0x100000, Type: btrfsvol.BLOCK_GROUP_DATA}})
+	b.AddChunk(btrfsprim.Key{ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, ItemType: btrfsitem.CHUNK_ITEM_KEY, Offset: 0x200000},
+		btrfsitem.Chunk{Head: btrfsitem.ChunkHeader{Size: 0x100000, Type: btrfsvol.BLOCK_GROUP_METADATA}})
+
+	fileExtent := func(addr btrfsvol.LogicalAddr, offset btrfsvol.AddrDelta) btrfsitem.FileExtent {
+		return btrfsitem.FileExtent{
+			Generation: 7,
+			Type:       btrfsitem.FILE_EXTENT_REG,
+			BodyExtent: btrfsitem.FileExtentExtent{
+				DiskByteNr:   addr,
+				DiskNumBytes: 0x2000,
+				Offset:       offset,
+				NumBytes:     0x1000,
+			},
+		}
+	}
+	key := func(ino btrfsprim.ObjID, off uint64) btrfsprim.Key {
+		return btrfsprim.Key{ObjectID: ino, ItemType: btrfsitem.EXTENT_DATA_KEY, Offset: off}
+	}
+	// Shared between two subvolumes (a reflink or a snapshot)...
+	b.AddFileExtent(5, key(257, 0), fileExtent(0x100000, 0))
+	b.AddFileExtent(256, key(300, 0), fileExtent(0x100000, 0))
+	// ...and referenced twice by the same file, at the same
+	// extent-relative offset.
+	b.AddFileExtent(5, key(257, 0x1000), fileExtent(0x100000, 0x1000))
+	// Not in any chunk.
+	b.AddFileExtent(5, key(258, 0), fileExtent(0x900000, 0))
+	// Tree block shared between two trees.
+	b.AddTreeBlock(0x200000, 6, 0, btrfsprim.Key{}, 5)
+	b.AddTreeBlock(0x200000, 6, 0, btrfsprim.Key{}, 256)
+	// Tree block in a data chunk.
+	b.AddTreeBlock(0x140000, 6, 0, btrfsprim.Key{}, 5)
+
+	items, problems, err := b.Items()
+	require.NoError(t, err)
+
+	require.Len(t, problems, 2)
+	assert.Equal(t, btrfsvol.LogicalAddr(0x140000), problems[0].Addr)
+	assert.Equal(t, btrfsvol.LogicalAddr(0x900000), problems[1].Addr)
+
+	bodies := make(map[btrfsprim.Key]btrfsitem.Item)
+	for _, item := range items {
+		assert.Equal(t, btrfsprim.EXTENT_TREE_OBJECTID, item.Tree)
+		decoded, err := item.Decode(btrfssum.TYPE_CRC32)
+		require.NoError(t, err)
+		bodies[item.Key] = decoded.Body
+	}
+	require.Len(t, bodies, 4)
+
+	data, ok := bodies[btrfsprim.Key{ObjectID: 0x100000, ItemType: btrfsitem.EXTENT_ITEM_KEY, Offset: 0x2000}].(*btrfsitem.Extent)
+	require.True(t, ok)
+	assert.Equal(t, int64(3), data.Head.Refs)
+	assert.Equal(t, btrfsprim.Generation(7), data.Head.Generation)
+	assert.Equal(t, btrfsitem.EXTENT_FLAG_DATA, data.Head.Flags)
+	counts := make(map[btrfsprim.ObjID]int32)
+	for _, ref := range data.Refs {
+		body, ok := ref.Body.(*btrfsitem.ExtentDataRef)
+		require.True(t, ok)
+		counts[body.Root] += body.Count
+	}
+	assert.Equal(t, map[btrfsprim.ObjID]int32{5: 2, 256: 1}, counts)
+
+	meta, ok := bodies[btrfsprim.Key{ObjectID: 0x200000, ItemType: btrfsitem.METADATA_ITEM_KEY, Offset: 0}].(*btrfsitem.Metadata)
+	require.True(t, ok)
+	assert.Equal(t, int64(2), meta.Head.Refs)
+	// Descending, as the kernel expects.
+	assert.Equal(t, []btrfsitem.ExtentInlineRef{
+		{Type: btrfsitem.TREE_BLOCK_REF_KEY, Offset: 256},
+		{Type: btrfsitem.TREE_BLOCK_REF_KEY, Offset: 5},
+	}, meta.Refs)
+
+	dataBG, ok := bodies[btrfsprim.Key{ObjectID: 0x100000, ItemType: btrfsitem.BLOCK_GROUP_ITEM_KEY, Offset: 0x100000}].(*btrfsitem.BlockGroup)
+	require.True(t, ok)
+	assert.Equal(t, int64(0x2000), dataBG.Used)
+	metaBG, ok := bodies[btrfsprim.Key{ObjectID: 0x200000, ItemType: btrfsitem.BLOCK_GROUP_ITEM_KEY, Offset: 0x100000}].(*btrfsitem.BlockGroup)
+	require.True(t, ok)
+	assert.Equal(t, int64(16384), metaBG.Used)
+
+	// With the block-group-tree feature, the BLOCK_GROUP_ITEMs
+	// don't go in the EXTENT_TREE.
+	b = btrfsutil.NewExtentTreeBuilder(btrfstree.Superblock{
+		NodeSize:      16384,
+		IncompatFlags: btrfstree.FeatureIncompatSkinnyMetadata,
+		CompatROFlags: btrfstree.FeatureCompatROBlockGroupTree,
+	})
+	b.AddChunk(btrfsprim.Key{ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, ItemType: btrfsitem.CHUNK_ITEM_KEY, Offset: 0x200000},
+		btrfsitem.Chunk{Head: btrfsitem.ChunkHeader{Size: 0x100000, Type: btrfsvol.BLOCK_GROUP_METADATA}})
+	b.AddTreeBlock(0x200000, 6, 0, btrfsprim.Key{}, 5)
+	items, problems, err = b.Items()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	require.Len(t, items, 1)
+	assert.Equal(t, btrfsitem.METADATA_ITEM_KEY, items[0].Key.ItemType)
+}
+
+func TestExtentTreeBuilderBackrefs(t *testing.T) {
+	t.Parallel()
+
+	b := btrfsutil.NewExtentTreeBuilder(btrfstree.Superblock{
+		NodeSize:      16384,
+		IncompatFlags: btrfstree.FeatureIncompatSkinnyMetadata,
+	})
+	// Room for only one inline EXTENT_DATA_REF.
+	b.MaxExtentItemSize = 24 + 29
+	b.AddChunk(btrfsprim.Key{ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, ItemType: btrfsitem.CHUNK_ITEM_KEY, Offset: 0x100000},
+		btrfsitem.Chunk{Head: btrfsitem.ChunkHeader{Size: 0x100000, Type: btrfsvol.BLOCK_GROUP_DATA}})
+	b.AddChunk(btrfsprim.Key{ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, ItemType: btrfsitem.CHUNK_ITEM_KEY, Offset: 0x200000},
+		btrfsitem.Chunk{Head: btrfsitem.ChunkHeader{Size: 0x100000, Type: btrfsvol.BLOCK_GROUP_METADATA}})
+
+	fe := btrfsitem.FileExtent{
+		Generation: 7,
+		Type:       btrfsitem.FILE_EXTENT_REG,
+		BodyExtent: btrfsitem.FileExtentExtent{
+			DiskByteNr:   0x100000,
+			DiskNumBytes: 0x1000,
+			NumBytes:     0x1000,
+		},
+	}
+	key := func(ino btrfsprim.ObjID, off uint64) btrfsprim.Key {
+		return btrfsprim.Key{ObjectID: ino, ItemType: btrfsitem.EXTENT_DATA_KEY, Offset: off}
+	}
+	// The largest hash, so it is the one that gets inlined.
+	b.AddFileExtent(258, key(1000, 0x100000), fe)
+	// These two have the same hash (see TestExtentDataRefHash).
+	b.AddFileExtent(5, key(523821, 1048444928), fe)
+	b.AddFileExtent(5, key(378893, 1007951872), fe)
+	b.AddFileExtent(5, key(257, 0), fe)
+	// Two references from a leaf with FULL_BACKREF.
+	b.AddSharedFileExtent(0x210000, key(300, 0), fe)
+	b.AddSharedFileExtent(0x210000, key(300, 0x1000), fe)
+
+	b.AddTreeBlock(0x200000, 6, 1, btrfsprim.Key{}, 5)
+	b.AddSharedTreeBlock(0x200000, 6, 1, btrfsprim.Key{}, 0x220000)
+	b.SetFullBackref(0x200000)
+
+	items, problems, err := b.Items()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+	bodies := make(map[btrfsprim.Key]btrfsitem.Item)
+	for _, item := range items {
+		decoded, err := item.Decode(btrfssum.TYPE_CRC32)
+		require.NoError(t, err)
+		bodies[item.Key] = decoded.Body
+	}
+
+	const collision = 1007496935355535176
+	dataKey := func(typ btrfsprim.ItemType, off uint64) btrfsprim.Key {
+		return btrfsprim.Key{ObjectID: 0x100000, ItemType: typ, Offset: off}
+	}
+	assert.Equal(t, map[btrfsprim.Key]btrfsitem.Item{
+		dataKey(btrfsitem.EXTENT_ITEM_KEY, 0x1000): &btrfsitem.Extent{
+			Head: btrfsitem.ExtentHeader{Refs: 6, Generation: 7, Flags: btrfsitem.EXTENT_FLAG_DATA},
+			Refs: []btrfsitem.ExtentInlineRef{{
+				Type: btrfsitem.EXTENT_DATA_REF_KEY,
+				Body: &btrfsitem.ExtentDataRef{Root: 258, ObjectID: 1000, Offset: 0x100000, Count: 1},
+			}},
+		},
+		// The collision is resolved by probing the next offset,
+		// as the kernel does.
+		dataKey(btrfsitem.EXTENT_DATA_REF_KEY, collision): &btrfsitem.ExtentDataRef{
+			Root: 5, ObjectID: 378893, Offset: 1007951872, Count: 1,
+		},
+		dataKey(btrfsitem.EXTENT_DATA_REF_KEY, collision+1): &btrfsitem.ExtentDataRef{
+			Root: 5, ObjectID: 523821, Offset: 1048444928, Count: 1,
+		},
+		dataKey(btrfsitem.EXTENT_DATA_REF_KEY, 1007496934145758698): &btrfsitem.ExtentDataRef{
+			Root: 5, ObjectID: 257, Offset: 0, Count: 1,
+		},
+		dataKey(btrfsitem.SHARED_DATA_REF_KEY, 0x210000): &btrfsitem.SharedDataRef{Count: 2},
+		{ObjectID: 0x200000, ItemType: btrfsitem.METADATA_ITEM_KEY, Offset: 1}: &btrfsitem.Metadata{
+			Head: btrfsitem.ExtentHeader{
+				Refs:       2,
+				Generation: 6,
+				Flags:      btrfsitem.EXTENT_FLAG_TREE_BLOCK | btrfsitem.BLOCK_FLAG_FULL_BACKREF,
+			},
+			Refs: []btrfsitem.ExtentInlineRef{
+				{Type: btrfsitem.TREE_BLOCK_REF_KEY, Offset: 5},
+				{Type: btrfsitem.SHARED_BLOCK_REF_KEY, Offset: 0x220000},
+			},
+		},
+		{ObjectID: 0x100000, ItemType: btrfsitem.BLOCK_GROUP_ITEM_KEY, Offset: 0x100000}: &btrfsitem.BlockGroup{
+			Used: 0x1000, ChunkObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, Flags: btrfsvol.BLOCK_GROUP_DATA,
+		},
+		{ObjectID: 0x200000, ItemType: btrfsitem.BLOCK_GROUP_ITEM_KEY, Offset: 0x100000}: &btrfsitem.BlockGroup{
+			Used: 16384, ChunkObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, Flags: btrfsvol.BLOCK_GROUP_METADATA,
+		},
+	}, bodies)
+}
+
+// TestRebuildExtentTree walks an on-disk filesystem in which the
+// subvolume 256 is a snapshot of the FS_TREE, taken after the leaf at
+// 0x204000 was written and before the FS_TREE COWed the leaf at
+// 0x206000 in to the leaf at 0x205000.
+func TestRebuildExtentTree(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	const (
+		nodeSize = 0x1000
+		sysAddr  = btrfsvol.LogicalAddr(0x100000)
+		metaAddr = btrfsvol.LogicalAddr(0x200000)
+		dataAddr = btrfsvol.LogicalAddr(0x300000)
+		size     = 0x100000
+
+		rootTreeAddr   = metaAddr + 0x0000
+		extentTreeAddr = metaAddr + 0x1000
+		uuidTreeAddr   = metaAddr + 0x2000
+		fsRootAddr     = metaAddr + 0x3000 // owner=5
+		sharedLeafAddr = metaAddr + 0x4000 // owner=5, in both trees
+		newLeafAddr    = metaAddr + 0x5000 // owner=5, in the FS_TREE only
+		oldLeafAddr    = metaAddr + 0x6000 // owner=5, in the snapshot only
+		snapRootAddr   = metaAddr + 0x7000 // owner=256
+	)
+	fsUUID := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000007")
+	fsTreeUUID := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000005")
+	img := make(memFile, dataAddr+size)
+
+	writeNode := func(addr btrfsvol.LogicalAddr, owner btrfsprim.ObjID, gen btrfsprim.Generation, kps []btrfstree.KeyPointer, items []btrfstree.Item) {
+		node := btrfstree.Node{
+			Size:         nodeSize,
+			ChecksumType: btrfssum.TYPE_CRC32,
+			Head: btrfstree.NodeHeader{
+				MetadataUUID: fsUUID,
+				Addr:         addr,
+				Flags:        btrfstree.NodeWritten,
+				BackrefRev:   btrfstree.MixedBackrefRev,
+				Generation:   gen,
+				Owner:        owner,
+			},
+			BodyInterior: kps,
+			BodyLeaf:     items,
+		}
+		if len(kps) > 0 {
+			node.Head.Level = 1
+			node.Head.NumItems = uint32(len(kps))
+		} else {
+			node.Head.NumItems = uint32(len(items))
+		}
+		var err error
+		node.Head.Checksum, err = node.CalculateChecksum()
+		require.NoError(t, err)
+		dat, err := binstruct.Marshal(node)
+		require.NoError(t, err)
+		copy(img[addr:], dat) // laddr=paddr
+	}
+	key := func(objID btrfsprim.ObjID, typ btrfsprim.ItemType, off uint64) btrfsprim.Key {
+		return btrfsprim.Key{ObjectID: objID, ItemType: typ, Offset: off}
+	}
+	chunk := func(addr btrfsvol.LogicalAddr, typ btrfsvol.BlockGroupFlags) btrfsitem.Chunk {
+		return btrfsitem.Chunk{
+			Head: btrfsitem.ChunkHeader{
+				Size:       size,
+				Owner:      btrfsprim.EXTENT_TREE_OBJECTID,
+				Type:       typ,
+				NumStripes: 1,
+			},
+			Stripes: []btrfsitem.ChunkStripe{{DeviceID: 1, Offset: btrfsvol.PhysicalAddr(addr)}},
+		}
+	}
+	fileExtent := func(ino btrfsprim.ObjID, off uint64, addr btrfsvol.LogicalAddr) btrfstree.Item {
+		return btrfstree.Item{
+			Key: key(ino, btrfsitem.EXTENT_DATA_KEY, off),
+			Body: &btrfsitem.FileExtent{
+				Generation: 5,
+				RAMBytes:   0x1000,
+				Type:       btrfsitem.FILE_EXTENT_REG,
+				BodyExtent: btrfsitem.FileExtentExtent{
+					DiskByteNr:   addr,
+					DiskNumBytes: 0x1000,
+					NumBytes:     0x1000,
+				},
+			},
+		}
+	}
+
+	sysChunk := chunk(sysAddr, btrfsvol.BLOCK_GROUP_SYSTEM)
+	metaChunk := chunk(metaAddr, btrfsvol.BLOCK_GROUP_METADATA)
+	dataChunk := chunk(dataAddr, btrfsvol.BLOCK_GROUP_DATA)
+	writeNode(sysAddr, btrfsprim.CHUNK_TREE_OBJECTID, 20, nil, []btrfstree.Item{
+		{Key: key(btrfsprim.FIRST_CHUNK_TREE_OBJECTID, btrfsitem.CHUNK_ITEM_KEY, uint64(sysAddr)), Body: &sysChunk},
+		{Key: key(btrfsprim.FIRST_CHUNK_TREE_OBJECTID, btrfsitem.CHUNK_ITEM_KEY, uint64(metaAddr)), Body: &metaChunk},
+		{Key: key(btrfsprim.FIRST_CHUNK_TREE_OBJECTID, btrfsitem.CHUNK_ITEM_KEY, uint64(dataAddr)), Body: &dataChunk},
+	})
+	writeNode(rootTreeAddr, btrfsprim.ROOT_TREE_OBJECTID, 20, nil, []btrfstree.Item{
+		{Key: key(btrfsprim.EXTENT_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0), Body: &btrfsitem.Root{
+			Generation: 20, ByteNr: extentTreeAddr, Refs: 1,
+		}},
+		{Key: key(btrfsprim.FS_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0), Body: &btrfsitem.Root{
+			Generation: 20, GenerationV2: 20, ByteNr: fsRootAddr, Level: 1, Refs: 1,
+			RootDirID: btrfsprim.FIRST_FREE_OBJECTID, UUID: fsTreeUUID,
+		}},
+		{Key: key(btrfsprim.UUID_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0), Body: &btrfsitem.Root{
+			Generation: 20, ByteNr: uuidTreeAddr, Refs: 1,
+		}},
+		{Key: key(256, btrfsitem.ROOT_ITEM_KEY, 10), Body: &btrfsitem.Root{
+			Generation: 11, GenerationV2: 11, ByteNr: snapRootAddr, Level: 1, Refs: 1,
+			RootDirID: btrfsprim.FIRST_FREE_OBJECTID, ParentUUID: fsTreeUUID,
+		}},
+	})
+	// The old EXTENT_TREE's blocks are counted, but its items are
+	// not.
+	writeNode(extentTreeAddr, btrfsprim.EXTENT_TREE_OBJECTID, 20, nil, []btrfstree.Item{
+		{Key: key(btrfsprim.ObjID(dataAddr+0x8000), btrfsitem.EXTENT_ITEM_KEY, 0x1000), Body: &btrfsitem.Extent{
+			Head: btrfsitem.ExtentHeader{Refs: 1, Generation: 3, Flags: btrfsitem.EXTENT_FLAG_DATA},
+		}},
+	})
+	writeNode(uuidTreeAddr, btrfsprim.UUID_TREE_OBJECTID, 20, nil, []btrfstree.Item{
+		{Key: btrfsitem.UUIDToKey(fsTreeUUID), Body: &btrfsitem.UUIDMap{ObjID: btrfsprim.FS_TREE_OBJECTID}},
+	})
+	writeNode(sharedLeafAddr, btrfsprim.FS_TREE_OBJECTID, 8, nil, []btrfstree.Item{
+		fileExtent(257, 0, dataAddr),
+	})
+	writeNode(newLeafAddr, btrfsprim.FS_TREE_OBJECTID, 20, nil, []btrfstree.Item{
+		fileExtent(258, 0, dataAddr+0x1000),
+	})
+	writeNode(oldLeafAddr, btrfsprim.FS_TREE_OBJECTID, 9, nil, []btrfstree.Item{
+		fileExtent(258, 0, dataAddr+0x2000),
+		fileExtent(258, 0x1000, dataAddr+0x2000),
+	})
+	writeNode(fsRootAddr, btrfsprim.FS_TREE_OBJECTID, 20, []btrfstree.KeyPointer{
+		{Key: key(257, btrfsitem.EXTENT_DATA_KEY, 0), BlockPtr: sharedLeafAddr, Generation: 8},
+		{Key: key(258, btrfsitem.EXTENT_DATA_KEY, 0), BlockPtr: newLeafAddr, Generation: 20},
+	}, nil)
+	writeNode(snapRootAddr, 256, 11, []btrfstree.KeyPointer{
+		{Key: key(257, btrfsitem.EXTENT_DATA_KEY, 0), BlockPtr: sharedLeafAddr, Generation: 8},
+		{Key: key(258, btrfsitem.EXTENT_DATA_KEY, 0), BlockPtr: oldLeafAddr, Generation: 9},
+	}, nil)
+
+	sb := btrfstree.Superblock{
+		Self:                btrfs.SuperblockAddrs[0],
+		FSUUID:              fsUUID,
+		Magic:               btrfstree.SuperblockMagic,
+		Generation:          20,
+		RootTree:            rootTreeAddr,
+		ChunkTree:           sysAddr,
+		ChunkRootGeneration: 20,
+		NumDevices:          1,
+		SectorSize:          0x1000,
+		NodeSize:            nodeSize,
+		LeafSize:            nodeSize,
+		StripeSize:          0x1000,
+		ChecksumType:        btrfssum.TYPE_CRC32,
+		IncompatFlags:       btrfstree.FeatureIncompatSkinnyMetadata,
+		DevItem:             btrfsitem.Dev{DevID: 1, NumBytes: uint64(len(img))},
+	}
+	dat, err := binstruct.Marshal(btrfstree.SysChunk{
+		Key:   key(btrfsprim.FIRST_CHUNK_TREE_OBJECTID, btrfsitem.CHUNK_ITEM_KEY, uint64(sysAddr)),
+		Chunk: sysChunk,
+	})
+	require.NoError(t, err)
+	sb.SysChunkArraySize = uint32(copy(sb.SysChunkArray[:], dat))
+	sb.Checksum, err = sb.CalculateChecksum()
+	require.NoError(t, err)
+	dat, err = binstruct.Marshal(sb)
+	require.NoError(t, err)
+	copy(img[sb.Self:], dat)
+
+	fs := new(btrfs.FS)
+	require.NoError(t, fs.AddDevice(ctx, &btrfs.Device{File: img}))
+	require.NoError(t, fs.InitChunks(ctx))
+
+	items, problems, err := btrfsutil.RebuildExtentTree(ctx, fs)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	bodies := make(map[btrfsprim.Key]btrfsitem.Item)
+	for _, item := range items {
+		decoded, err := item.Decode(btrfssum.TYPE_CRC32)
+		require.NoError(t, err)
+		bodies[item.Key] = decoded.Body
+	}
+	treeBlock := func(owner btrfsprim.ObjID, gen btrfsprim.Generation, refs ...btrfsitem.ExtentInlineRef) *btrfsitem.Metadata {
+		return &btrfsitem.Metadata{
+			Head: btrfsitem.ExtentHeader{Refs: int64(len(refs)), Generation: gen, Flags: btrfsitem.EXTENT_FLAG_TREE_BLOCK},
+			Refs: refs,
+		}
+	}
+	treeRef := func(root btrfsprim.ObjID) btrfsitem.ExtentInlineRef {
+		return btrfsitem.ExtentInlineRef{Type: btrfsitem.TREE_BLOCK_REF_KEY, Offset: uint64(root)}
+	}
+	metaKey := func(addr btrfsvol.LogicalAddr, level uint64) btrfsprim.Key {
+		return key(btrfsprim.ObjID(addr), btrfsitem.METADATA_ITEM_KEY, level)
+	}
+	oldLeaf := treeBlock(btrfsprim.FS_TREE_OBJECTID, 9, treeRef(256))
+	oldLeaf.Head.Flags |= btrfsitem.BLOCK_FLAG_FULL_BACKREF
+	assert.Equal(t, map[btrfsprim.Key]btrfsitem.Item{
+		metaKey(sysAddr, 0):        treeBlock(btrfsprim.CHUNK_TREE_OBJECTID, 20, treeRef(btrfsprim.CHUNK_TREE_OBJECTID)),
+		metaKey(rootTreeAddr, 0):   treeBlock(btrfsprim.ROOT_TREE_OBJECTID, 20, treeRef(btrfsprim.ROOT_TREE_OBJECTID)),
+		metaKey(extentTreeAddr, 0): treeBlock(btrfsprim.EXTENT_TREE_OBJECTID, 20, treeRef(btrfsprim.EXTENT_TREE_OBJECTID)),
+		metaKey(uuidTreeAddr, 0):   treeBlock(btrfsprim.UUID_TREE_OBJECTID, 20, treeRef(btrfsprim.UUID_TREE_OBJECTID)),
+		metaKey(fsRootAddr, 1):     treeBlock(btrfsprim.FS_TREE_OBJECTID, 20, treeRef(btrfsprim.FS_TREE_OBJECTID)),
+		metaKey(sharedLeafAddr, 0): treeBlock(btrfsprim.FS_TREE_OBJECTID, 8, treeRef(256), treeRef(btrfsprim.FS_TREE_OBJECTID)),
+		metaKey(newLeafAddr, 0):    treeBlock(btrfsprim.FS_TREE_OBJECTID, 20, treeRef(btrfsprim.FS_TREE_OBJECTID)),
+		metaKey(oldLeafAddr, 0):    oldLeaf,
+		metaKey(snapRootAddr, 1):   treeBlock(256, 11, treeRef(256)),
+
+		// The shared leaf is only counted once.
+		key(btrfsprim.ObjID(dataAddr), btrfsitem.EXTENT_ITEM_KEY, 0x1000): &btrfsitem.Extent{
+			Head: btrfsitem.ExtentHeader{Refs: 1, Generation: 5, Flags: btrfsitem.EXTENT_FLAG_DATA},
+			Refs: []btrfsitem.ExtentInlineRef{{
+				Type: btrfsitem.EXTENT_DATA_REF_KEY,
+				Body: &btrfsitem.ExtentDataRef{Root: btrfsprim.FS_TREE_OBJECTID, ObjectID: 257, Count: 1},
+			}},
+		},
+		key(btrfsprim.ObjID(dataAddr+0x1000), btrfsitem.EXTENT_ITEM_KEY, 0x1000): &btrfsitem.Extent{
+			Head: btrfsitem.ExtentHeader{Refs: 1, Generation: 5, Flags: btrfsitem.EXTENT_FLAG_DATA},
+			Refs: []btrfsitem.ExtentInlineRef{{
+				Type: btrfsitem.EXTENT_DATA_REF_KEY,
+				Body: &btrfsitem.ExtentDataRef{Root: btrfsprim.FS_TREE_OBJECTID, ObjectID: 258, Count: 1},
+			}},
+		},
+		// The old leaf has FULL_BACKREF, so its file extents
+		// refer back to it rather than to a tree.
+		key(btrfsprim.ObjID(dataAddr+0x2000), btrfsitem.EXTENT_ITEM_KEY, 0x1000): &btrfsitem.Extent{
+			Head: btrfsitem.ExtentHeader{Refs: 2, Generation: 5, Flags: btrfsitem.EXTENT_FLAG_DATA},
+			Refs: []btrfsitem.ExtentInlineRef{{
+				Type:   btrfsitem.SHARED_DATA_REF_KEY,
+				Offset: uint64(oldLeafAddr),
+				Body:   &btrfsitem.SharedDataRef{Count: 2},
+			}},
+		},
+
+		key(btrfsprim.ObjID(sysAddr), btrfsitem.BLOCK_GROUP_ITEM_KEY, size): &btrfsitem.BlockGroup{
+			Used: nodeSize, ChunkObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, Flags: btrfsvol.BLOCK_GROUP_SYSTEM,
+		},
+		key(btrfsprim.ObjID(metaAddr), btrfsitem.BLOCK_GROUP_ITEM_KEY, size): &btrfsitem.BlockGroup{
+			Used: 8 * nodeSize, ChunkObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, Flags: btrfsvol.BLOCK_GROUP_METADATA,
+		},
+		key(btrfsprim.ObjID(dataAddr), btrfsitem.BLOCK_GROUP_ITEM_KEY, size): &btrfsitem.BlockGroup{
+			Used: 3 * 0x1000, ChunkObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID, Flags: btrfsvol.BLOCK_GROUP_DATA,
+		},
+	}, bodies)
+}
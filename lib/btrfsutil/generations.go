@@ -0,0 +1,111 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// A GenerationInversion is a key-pointer that claims that its child
+// node is newer than the node containing the key-pointer.  In a
+// committed tree a child is never newer than its parent (COW
+// rewrites every node on the path up to the root), so this indicates
+// either corruption or that the wrong node was grafted in.
+type GenerationInversion struct {
+	Tree      btrfsprim.ObjID
+	Parent    btrfsvol.LogicalAddr
+	ParentGen btrfsprim.Generation
+	Slot      int
+	Child     btrfsvol.LogicalAddr
+	ChildGen  btrfsprim.Generation
+}
+
+func (inv GenerationInversion) String() string {
+	return fmt.Sprintf("tree %v: node@%v (generation %v) slot %v points at node@%v with newer generation %v",
+		inv.Tree, inv.Parent, inv.ParentGen, inv.Slot, inv.Child, inv.ChildGen)
+}
+
+// NodeGenerationInversions returns the key-pointers in an interior
+// node whose generation is newer than the node's own generation.
+func NodeGenerationInversions(treeID btrfsprim.ObjID, node *btrfstree.Node) []GenerationInversion {
+	var ret []GenerationInversion
+	for i, kp := range node.BodyInterior {
+		if kp.Generation > node.Head.Generation {
+			ret = append(ret, GenerationInversion{
+				Tree:      treeID,
+				Parent:    node.Head.Addr,
+				ParentGen: node.Head.Generation,
+				Slot:      i,
+				Child:     kp.BlockPtr,
+				ChildGen:  kp.Generation,
+			})
+		}
+	}
+	return ret
+}
+
+// checkGenerationsMaxSeen bounds how many interior nodes
+// CheckGenerations remembers having checked.
+var checkGenerationsMaxSeen = textui.NewTunable("btrfsutil.check-generations-max-seen", 1<<20)
+
+// CheckGenerations walks every tree in the filesystem, calling `fn`
+// for each GenerationInversion.  Unreadable nodes are skipped; they
+// are reported by other checks.
+//
+// Only interior nodes can have inversions, so CheckGenerations does
+// not read leaves (except for those of the ROOT_TREE, which are
+// needed to find the other trees).  An interior node that is shared
+// between several trees (as with snapshots) is only checked the
+// first time that it is seen; but to bound memory use, at most
+// btrfsutil.check-generations-max-seen interior nodes are
+// remembered, and past that, shared subtrees are re-checked (and
+// their inversions reported again) each time that they are seen.
+func CheckGenerations(ctx context.Context, fs btrfs.ReadableFS, fn func(GenerationInversion)) {
+	var treeID btrfsprim.ObjID
+	maxSeen := checkGenerationsMaxSeen.Get()
+	seen := make(containers.Set[btrfsvol.LogicalAddr])
+	var seenFull bool
+	WalkAllTrees(ctx, fs, WalkAllTreesHandler{
+		PreTree: func(_ string, id btrfsprim.ObjID) {
+			treeID = id
+		},
+		Tree: btrfstree.TreeWalkHandler{
+			Node: func(_ btrfstree.Path, node *btrfstree.Node) {
+				if node.Head.Level == 0 || seen.Has(node.Head.Addr) {
+					return
+				}
+				switch {
+				case len(seen) < maxSeen:
+					seen.Insert(node.Head.Addr)
+				case !seenFull:
+					dlog.Infof(ctx, "remembered %v interior nodes; shared subtrees will now be re-checked (see btrfsutil.check-generations-max-seen)",
+						maxSeen)
+					seenFull = true
+				}
+				for _, inv := range NodeGenerationInversions(treeID, node) {
+					fn(inv)
+				}
+			},
+			KeyPointer: func(path btrfstree.Path, kp btrfstree.KeyPointer) bool {
+				if elem, ok := path[len(path)-1].(btrfstree.PathKP); ok && elem.ToLevel == 0 && treeID != btrfsprim.ROOT_TREE_OBJECTID {
+					return false
+				}
+				// Don't re-walk subtrees that we've already
+				// checked via another tree.
+				return !seen.Has(kp.BlockPtr)
+			},
+		},
+	})
+}
@@ -0,0 +1,175 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func TestNodeGenerationInversions(t *testing.T) {
+	t.Parallel()
+	node := &btrfstree.Node{
+		Head: btrfstree.NodeHeader{
+			Addr:       0x10000,
+			Generation: 20,
+			Owner:      btrfsprim.FS_TREE_OBJECTID,
+			Level:      1,
+		},
+		BodyInterior: []btrfstree.KeyPointer{
+			{Key: btrfsprim.Key{ObjectID: 256}, BlockPtr: 0x20000, Generation: 19},
+			{Key: btrfsprim.Key{ObjectID: 300}, BlockPtr: 0x30000, Generation: 20},
+			{Key: btrfsprim.Key{ObjectID: 400}, BlockPtr: 0x40000, Generation: 21},
+		},
+	}
+	invs := btrfsutil.NodeGenerationInversions(btrfsprim.FS_TREE_OBJECTID, node)
+	assert.Equal(t, []btrfsutil.GenerationInversion{
+		{
+			Tree:      btrfsprim.FS_TREE_OBJECTID,
+			Parent:    0x10000,
+			ParentGen: 20,
+			Slot:      2,
+			Child:     0x40000,
+			ChildGen:  21,
+		},
+	}, invs)
+	assert.Equal(t, "tree FS_TREE: node@0x0000000000010000 (generation 20) slot 2 points at node@0x0000000000040000 with newer generation 21",
+		invs[0].String())
+
+	// Leaves have no key-pointers.
+	assert.Empty(t, btrfsutil.NodeGenerationInversions(btrfsprim.FS_TREE_OBJECTID, &btrfstree.Node{
+		Head: btrfstree.NodeHeader{Generation: 1},
+	}))
+}
+
+// nodeFS is a btrfs.ReadableFS made of in-memory nodes, which counts
+// how many times each node is read.
+type nodeFS struct {
+	sb    btrfstree.Superblock
+	nodes map[btrfsvol.LogicalAddr]*btrfstree.Node
+	reads map[btrfsvol.LogicalAddr]int
+}
+
+func (*nodeFS) Name() string { return "mem" }
+
+func (fs *nodeFS) ForrestLookup(ctx context.Context, treeID btrfsprim.ObjID) (btrfstree.Tree, error) {
+	return btrfstree.RawForrest{NodeSource: fs}.ForrestLookup(ctx, treeID)
+}
+
+func (fs *nodeFS) Superblock() (*btrfstree.Superblock, error) { return &fs.sb, nil }
+
+func (fs *nodeFS) AcquireNode(_ context.Context, addr btrfsvol.LogicalAddr, exp btrfstree.NodeExpectations) (*btrfstree.Node, error) {
+	fs.reads[addr]++
+	node, ok := fs.nodes[addr]
+	if !ok {
+		return nil, fmt.Errorf("no node at %v", addr)
+	}
+	if err := exp.Check(node); err != nil {
+		return node, fmt.Errorf("node@%v: %w", addr, err)
+	}
+	return node, nil
+}
+
+func (*nodeFS) ReleaseNode(*btrfstree.Node) {}
+
+func (*nodeFS) ReadAt([]byte, btrfsvol.LogicalAddr) (int, error) {
+	return 0, errors.New("no data")
+}
+
+func TestCheckGenerations(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	node := func(addr btrfsvol.LogicalAddr, owner btrfsprim.ObjID, gen btrfsprim.Generation, level uint8) *btrfstree.Node {
+		return &btrfstree.Node{
+			Head: btrfstree.NodeHeader{
+				Addr:       addr,
+				Owner:      owner,
+				Generation: gen,
+				Level:      level,
+			},
+		}
+	}
+	key := func(objID btrfsprim.ObjID) btrfsprim.Key {
+		return btrfsprim.Key{ObjectID: objID, ItemType: btrfsitem.INODE_ITEM_KEY}
+	}
+	kp := func(objID btrfsprim.ObjID, addr btrfsvol.LogicalAddr, gen btrfsprim.Generation) btrfstree.KeyPointer {
+		return btrfstree.KeyPointer{Key: key(objID), BlockPtr: addr, Generation: gen}
+	}
+	rootItem := func(treeID btrfsprim.ObjID, addr btrfsvol.LogicalAddr, gen btrfsprim.Generation, level uint8) btrfstree.Item {
+		return btrfstree.Item{
+			Key: btrfsprim.Key{ObjectID: treeID, ItemType: btrfsitem.ROOT_ITEM_KEY},
+			Body: &btrfsitem.Root{
+				ByteNr:     addr,
+				Generation: gen,
+				Level:      level,
+			},
+		}
+	}
+
+	// The ROOT_TREE has FS_TREE and a snapshot of it (tree
+	// 256).  FS_TREE's root 0x10000 has an inverted key-pointer,
+	// and is shared in to the snapshot by the snapshot's root
+	// 0x20000.
+	rootTree := node(0x1000, btrfsprim.ROOT_TREE_OBJECTID, 12, 0)
+	rootTree.BodyLeaf = []btrfstree.Item{
+		rootItem(btrfsprim.FS_TREE_OBJECTID, 0x10000, 10, 1),
+		rootItem(256, 0x20000, 12, 2),
+	}
+	rootTree.Head.NumItems = 2
+	fsRoot := node(0x10000, btrfsprim.FS_TREE_OBJECTID, 10, 1)
+	fsRoot.BodyInterior = []btrfstree.KeyPointer{kp(256, 0x11000, 9), kp(300, 0x12000, 11)}
+	fsRoot.Head.NumItems = 2
+	snapRoot := node(0x20000, 256, 12, 2)
+	snapRoot.BodyInterior = []btrfstree.KeyPointer{kp(256, 0x10000, 10)}
+	snapRoot.Head.NumItems = 1
+	leafA := node(0x11000, btrfsprim.FS_TREE_OBJECTID, 9, 0)
+	leafA.BodyLeaf = []btrfstree.Item{{Key: key(256), Body: &btrfsitem.Empty{}}}
+	leafA.Head.NumItems = 1
+	leafB := node(0x12000, btrfsprim.FS_TREE_OBJECTID, 11, 0)
+	leafB.BodyLeaf = []btrfstree.Item{{Key: key(300), Body: &btrfsitem.Empty{}}}
+	leafB.Head.NumItems = 1
+
+	fs := &nodeFS{
+		sb: btrfstree.Superblock{
+			Generation: 12,
+			RootTree:   0x1000,
+		},
+		nodes: make(map[btrfsvol.LogicalAddr]*btrfstree.Node),
+		reads: make(map[btrfsvol.LogicalAddr]int),
+	}
+	for _, n := range []*btrfstree.Node{rootTree, fsRoot, snapRoot, leafA, leafB} {
+		fs.nodes[n.Head.Addr] = n
+	}
+
+	var invs []btrfsutil.GenerationInversion
+	btrfsutil.CheckGenerations(ctx, fs, func(inv btrfsutil.GenerationInversion) {
+		invs = append(invs, inv)
+	})
+	assert.Equal(t, []btrfsutil.GenerationInversion{{
+		Tree:      btrfsprim.FS_TREE_OBJECTID,
+		Parent:    0x10000,
+		ParentGen: 10,
+		Slot:      1,
+		Child:     0x12000,
+		ChildGen:  11,
+	}}, invs)
+	// The shared interior node is only read once, and leaves
+	// (other than the ROOT_TREE's) are not read at all.
+	assert.Equal(t, 1, fs.reads[0x10000])
+	assert.Equal(t, 0, fs.reads[0x11000])
+	assert.Equal(t, 0, fs.reads[0x12000])
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/slices"
+)
+
+// A GenHistogram collects the distribution of the generations of
+// the nodes in a tree.  The zero value is an empty histogram, ready
+// for use.
+type GenHistogram struct {
+	// Nodes is the number of nodes seen at each generation.
+	Nodes map[btrfsprim.Generation]int
+}
+
+// A GenBucket is a single bar of a GenHistogram.
+type GenBucket struct {
+	MinGen btrfsprim.Generation // inclusive
+	MaxGen btrfsprim.Generation // inclusive
+	Nodes  int
+}
+
+// Add records a node at generation `gen`.
+func (h *GenHistogram) Add(gen btrfsprim.Generation) {
+	if h.Nodes == nil {
+		h.Nodes = make(map[btrfsprim.Generation]int)
+	}
+	h.Nodes[gen]++
+}
+
+// Handler returns a copy of `inner` that also records the generation
+// of each good node that is walked in to the histogram (bad nodes are
+// not recorded, as their generation can't be trusted).  This works
+// with both raw and rebuilt trees.
+func (h *GenHistogram) Handler(inner btrfstree.TreeWalkHandler) btrfstree.TreeWalkHandler {
+	origNode := inner.Node
+	inner.Node = func(path btrfstree.Path, node *btrfstree.Node) {
+		h.Add(node.Head.Generation)
+		if origNode != nil {
+			origNode(path, node)
+		}
+	}
+	return inner
+}
+
+// Total returns the total number of nodes in the histogram.
+func (h GenHistogram) Total() int {
+	total := 0
+	for _, n := range h.Nodes {
+		total += n
+	}
+	return total
+}
+
+// Range returns the lowest and highest generations in the histogram,
+// or (0, 0) if it is empty.
+func (h GenHistogram) Range() (lo, hi btrfsprim.Generation) {
+	for i, gen := range maps.SortedKeys(h.Nodes) {
+		if i == 0 {
+			lo = gen
+		}
+		hi = gen
+	}
+	return lo, hi
+}
+
+// Buckets divides the generation range of the histogram in to at
+// most `n` equal-width buckets.  It returns nil if the histogram is
+// empty.
+func (h GenHistogram) Buckets(n int) []GenBucket {
+	if len(h.Nodes) == 0 || n < 1 {
+		return nil
+	}
+	lo, hi := h.Range()
+	// If the histogram covers every generation, then the span is
+	// 1 more than fits in a uint64; clamp it, and let the last
+	// bucket absorb the extra generation.
+	span := uint64(hi.SubClamped(lo).AddClamped(1))
+	if uint64(n) > span {
+		n = int(span)
+	}
+	// These are ceil(span/n) and ceil(span/width), written so
+	// that they can't overflow.
+	width := (span-1)/uint64(n) + 1
+	n = int((span-1)/width + 1)
+
+	ret := make([]GenBucket, n)
+	for i := range ret {
+		ret[i].MinGen = lo + btrfsprim.Generation(uint64(i)*width)
+		ret[i].MaxGen = ret[i].MinGen.AddClamped(btrfsprim.Generation(width - 1))
+	}
+	ret[n-1].MaxGen = hi
+	for gen, cnt := range h.Nodes {
+		ret[slices.Min(uint64(gen-lo)/width, uint64(n-1))].Nodes += cnt
+	}
+	return ret
+}
+
+// LargestGap returns the widest range of generations between the
+// lowest and highest generations that contains no nodes, as the
+// generations of the nodes on either side of it.  It returns (0, 0)
+// if there are fewer than 2 distinct generations.
+func (h GenHistogram) LargestGap() (below, above btrfsprim.Generation) {
+	gens := maps.SortedKeys(h.Nodes)
+	for i := 1; i < len(gens); i++ {
+		if gens[i]-gens[i-1] > above-below {
+			below, above = gens[i-1], gens[i]
+		}
+	}
+	return below, above
+}
+
+// IsMixed returns whether the tree mixes very old and very new nodes,
+// with nothing in between: that is, whether there is a gap with no
+// nodes that makes up more than half of the histogram's generation
+// range.  Because CoW only rewrites the nodes along the path to a
+// change, some of this is normal, but a large gap can be a sign of
+// partial CoW corruption (for example, new interior nodes pointing
+// to stale leaves).
+func (h GenHistogram) IsMixed() bool {
+	lo, hi := h.Range()
+	below, above := h.LargestGap()
+	// This is (above-below)*2 > hi-lo, but without overflowing.
+	return hi > lo && above-below > (hi-lo)/2
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func TestGenHistogram(t *testing.T) {
+	t.Parallel()
+
+	var hist btrfsutil.GenHistogram
+	assert.Nil(t, hist.Buckets(4))
+	assert.False(t, hist.IsMixed())
+
+	for _, gen := range []btrfsprim.Generation{10, 11, 11, 12, 13, 14, 17} {
+		hist.Add(gen)
+	}
+	assert.Equal(t, 7, hist.Total())
+	assert.Equal(t, []btrfsutil.GenBucket{
+		{MinGen: 10, MaxGen: 11, Nodes: 3},
+		{MinGen: 12, MaxGen: 13, Nodes: 2},
+		{MinGen: 14, MaxGen: 15, Nodes: 1},
+		{MinGen: 16, MaxGen: 17, Nodes: 1},
+	}, hist.Buckets(4))
+	assert.Len(t, hist.Buckets(100), 8)
+	assert.False(t, hist.IsMixed())
+
+	hist.Add(100)
+	below, above := hist.LargestGap()
+	assert.Equal(t, btrfsprim.Generation(17), below)
+	assert.Equal(t, btrfsprim.Generation(100), above)
+	assert.True(t, hist.IsMixed())
+}
+
+func TestGenHistogramBoundaries(t *testing.T) {
+	t.Parallel()
+
+	// Covering every generation, the span doesn't fit in a
+	// uint64.
+	var hist btrfsutil.GenHistogram
+	hist.Add(0)
+	hist.Add(btrfsprim.MaxGeneration)
+	buckets := hist.Buckets(1)
+	assert.Equal(t, []btrfsutil.GenBucket{
+		{MinGen: 0, MaxGen: btrfsprim.MaxGeneration, Nodes: 2},
+	}, buckets)
+	buckets = hist.Buckets(2)
+	assert.Len(t, buckets, 2)
+	assert.Equal(t, 1, buckets[0].Nodes)
+	assert.Equal(t, 1, buckets[1].Nodes)
+	assert.Equal(t, btrfsprim.MaxGeneration, buckets[1].MaxGen)
+	assert.True(t, hist.IsMixed())
+
+	// Nor may the ends of buckets near the top of the range.
+	hist = btrfsutil.GenHistogram{}
+	hist.Add(btrfsprim.MaxGeneration - 4)
+	hist.Add(btrfsprim.MaxGeneration - 1)
+	hist.Add(btrfsprim.MaxGeneration)
+	assert.Equal(t, []btrfsutil.GenBucket{
+		{MinGen: btrfsprim.MaxGeneration - 4, MaxGen: btrfsprim.MaxGeneration - 2, Nodes: 1},
+		{MinGen: btrfsprim.MaxGeneration - 1, MaxGen: btrfsprim.MaxGeneration, Nodes: 2},
+	}, hist.Buckets(2))
+	assert.Len(t, hist.Buckets(100), 5)
+
+	// A gap of more than half of a huge range must not overflow
+	// to look small.
+	hist = btrfsutil.GenHistogram{}
+	hist.Add(1)
+	hist.Add(2)
+	hist.Add(btrfsprim.MaxGeneration)
+	assert.True(t, hist.IsMixed())
+	hist.Add(btrfsprim.MaxGeneration / 3)
+	hist.Add(btrfsprim.MaxGeneration / 3 * 2)
+	assert.False(t, hist.IsMixed())
+}
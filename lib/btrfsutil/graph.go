@@ -8,7 +8,6 @@ import (
 	"context"
 	"fmt"
 	"reflect"
-	"time"
 
 	"github.com/datawire/dlib/derror"
 	"github.com/datawire/dlib/dlog"
@@ -102,7 +101,7 @@ func (n GraphNode) CheckExpectations(g Graph, exp btrfstree.NodeExpectations) er
 		}
 	}
 	if n.NumItems(g) == 0 {
-		errs = append(errs, fmt.Errorf("has no items"))
+		errs = append(errs, btrfstree.ErrEmptyNode)
 	} else {
 		if minItem := n.MinItem(g); exp.MinItem.OK && exp.MinItem.Val.Compare(minItem) > 0 {
 			errs = append(errs, fmt.Errorf("expected minItem>=%v but node has minItem=%v",
@@ -160,6 +159,21 @@ type Graph struct {
 	BadNodes  map[btrfsvol.LogicalAddr]error
 	EdgesFrom map[btrfsvol.LogicalAddr][]*GraphEdge
 	EdgesTo   map[btrfsvol.LogicalAddr][]*GraphEdge
+
+	// NodeSources is, for each node in Nodes that was read by
+	// ReadGraph, the physical copies of that node that were read
+	// and found to be good; there is more than one for nodes in
+	// DUP or mirrored chunks.  Copies that failed to validate, or
+	// that hold an older generation of the node (a stale
+	// mirror), are not included.
+	NodeSources map[btrfsvol.LogicalAddr][]btrfsvol.QualifiedPhysicalAddr
+
+	// RelocNodes is the nodes that claim to be owned by
+	// TREE_RELOC_OBJECTID, but whose .Owner in Nodes (and whose
+	// outgoing edges' .FromTree) have been rewritten by
+	// .ReattributeRelocNodes() to be the tree that was being
+	// relocated.
+	RelocNodes containers.Set[btrfsvol.LogicalAddr]
 }
 
 func (g Graph) insertEdge(ptr *GraphEdge) {
@@ -202,6 +216,8 @@ func NewGraph(ctx context.Context, sb btrfstree.Superblock) Graph {
 		BadNodes:  make(map[btrfsvol.LogicalAddr]error),
 		EdgesFrom: make(map[btrfsvol.LogicalAddr][]*GraphEdge),
 		EdgesTo:   make(map[btrfsvol.LogicalAddr][]*GraphEdge),
+
+		NodeSources: make(map[btrfsvol.LogicalAddr][]btrfsvol.QualifiedPhysicalAddr),
 	}
 
 	// These 4 trees are mentioned directly in the superblock, so
@@ -273,7 +289,7 @@ func (g Graph) FinalCheck(ctx context.Context, fs btrfstree.NodeSource) error {
 
 		var stats textui.Portion[int]
 		stats.D = len(g.EdgesTo)
-		progressWriter := textui.NewProgress[textui.Portion[int]](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second))
+		progressWriter := textui.NewProgress[textui.Portion[int]](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
 		progressWriter.Set(stats)
 
 		for laddr := range g.EdgesTo {
@@ -300,7 +316,7 @@ func (g Graph) FinalCheck(ctx context.Context, fs btrfstree.NodeSource) error {
 
 		var stats textui.Portion[int]
 		stats.D = len(g.Nodes)
-		progressWriter := textui.NewProgress[textui.Portion[int]](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second))
+		progressWriter := textui.NewProgress[textui.Portion[int]](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
 		progressWriter.Set(stats)
 
 		visited := make(containers.Set[btrfsvol.LogicalAddr], len(g.Nodes))
@@ -362,23 +378,24 @@ func ReadGraph(_ctx context.Context, fs *btrfs.FS, nodeList []btrfsvol.LogicalAd
 	progressWriter := textui.NewProgress[textui.Portion[int]](
 		ctx,
 		dlog.LogLevelInfo,
-		textui.Tunable(1*time.Second))
+		textui.ProgressInterval.Get())
 	progressWriter.Set(stats)
+	var numBadCopies, numStaleCopies int
 	for _, laddr := range nodeList {
 		if err := ctx.Err(); err != nil {
 			progressWriter.Done()
 			return Graph{}, err
 		}
-		node, err := fs.AcquireNode(ctx, laddr, btrfstree.NodeExpectations{
-			LAddr: containers.OptionalValue(laddr),
-		})
+		node, copies, err := fs.ReadNodeCopies(ctx, *sb, laddr)
 		if err != nil {
-			fs.ReleaseNode(node)
 			progressWriter.Done()
 			return Graph{}, err
 		}
 		graph.InsertNode(node)
-		fs.ReleaseNode(node)
+		node.RawFree()
+		graph.NodeSources[laddr] = copies.Good
+		numBadCopies += copies.NumBad
+		numStaleCopies += copies.NumStale
 		stats.N++
 		progressWriter.Set(stats)
 	}
@@ -386,6 +403,9 @@ func ReadGraph(_ctx context.Context, fs *btrfs.FS, nodeList []btrfsvol.LogicalAd
 		panic("should not happen")
 	}
 	progressWriter.Done()
+	if numBadCopies > 0 || numStaleCopies > 0 {
+		dlog.Warnf(ctx, "ignored %v bad and %v stale mirror copies of nodes", numBadCopies, numStaleCopies)
+	}
 	dlog.Info(ctx, "... done reading node data")
 
 	// check ///////////////////////////////////////////////////////////////////////
@@ -0,0 +1,330 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/slices"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// graphCacheVersion is bumped whenever the format of the graph cache,
+// or what ReadGraph puts in a Graph, changes.
+const graphCacheVersion = 2
+
+// graphCacheSamples is how many of the listed nodes NewGraphCacheKey
+// reads the headers of, in order to notice a device that has been
+// written to without its superblock changing.
+var graphCacheSamples = textui.NewTunable("btrfsutil.graph-cache-samples", 256)
+
+// ErrStaleGraphCache is returned (wrapped) by ReadGraphCache if the
+// cache was not written for the same inputs that it is being read
+// for.
+var ErrStaleGraphCache = errors.New("graph cache is stale")
+
+// A GraphCacheKey identifies everything that ReadGraph's result
+// depends on, so that a cached Graph is only used if it would be
+// identical to re-reading it.
+type GraphCacheKey struct {
+	Version int
+	// Devices identifies the devices by the same fingerprint
+	// (size and superblock checksum) that is used by a
+	// ScanMarker; Scanned is always zero.
+	Devices []DevScanMarker
+	// NodeList and Mappings are SHA-256 hashes of the node list
+	// passed to ReadGraph and of the chunk mappings that were
+	// used to read the nodes.
+	NodeList string
+	Mappings string
+	// NodeSample is a SHA-256 hash of the headers (which include
+	// the checksum of the rest of the node) of every copy of an
+	// evenly spaced sample of the listed nodes.  It catches
+	// nodes being rewritten without the superblock changing
+	// (such as by a tool that writes nodes but not superblocks,
+	// or by a device that is being written to while it is
+	// scanned); being a sample, it is not guaranteed to.
+	NodeSample string
+
+	NoVerifyNodeChecksums bool
+	StrictItemSizes       bool
+	TrustPartialNodes     bool
+}
+
+// NewGraphCacheKey returns the GraphCacheKey for calling ReadGraph
+// on `fs` and `nodeList`.
+func NewGraphCacheKey(fs *btrfs.FS, nodeList []btrfsvol.LogicalAddr) (GraphCacheKey, error) {
+	progress, err := NewScanProgress(fs, nil)
+	if err != nil {
+		return GraphCacheKey{}, err
+	}
+
+	sortedNodes := append([]btrfsvol.LogicalAddr(nil), nodeList...)
+	slices.Sort(sortedNodes)
+	nodeHash := sha256.New()
+	for _, addr := range sortedNodes {
+		if err := WriteNodeListLine(nodeHash, addr); err != nil {
+			return GraphCacheKey{}, err
+		}
+	}
+
+	mappingHash := sha256.New()
+	for _, mapping := range fs.LV.Mappings() {
+		if _, err := fmt.Fprintf(mappingHash, "%v\n", mapping); err != nil {
+			return GraphCacheKey{}, err
+		}
+	}
+
+	sampleHash := sha256.New()
+	devs := fs.LV.PhysicalVolumes()
+	head := make([]byte, nodeHeaderSize)
+	numSamples := slices.Min(graphCacheSamples.Get(), len(sortedNodes))
+	for i := 0; i < numSamples; i++ {
+		laddr := sortedNodes[i*len(sortedNodes)/numSamples]
+		paddrs, _ := fs.LV.Resolve(laddr)
+		sortedPAddrs := maps.Keys(paddrs)
+		sort.Slice(sortedPAddrs, func(i, j int) bool {
+			return sortedPAddrs[i].Compare(sortedPAddrs[j]) < 0
+		})
+		for _, paddr := range sortedPAddrs {
+			dev, ok := devs[paddr.Dev]
+			if !ok {
+				continue
+			}
+			// Don't include the error text; all that
+			// matters is whether it is readable.
+			if _, err := dev.ReadAt(head, paddr.Addr); err != nil {
+				_, err = fmt.Fprintf(sampleHash, "%v: unreadable\n", paddr)
+				if err != nil {
+					return GraphCacheKey{}, err
+				}
+				continue
+			}
+			if _, err := fmt.Fprintf(sampleHash, "%v: %x\n", paddr, head); err != nil {
+				return GraphCacheKey{}, err
+			}
+		}
+	}
+
+	return GraphCacheKey{
+		Version:    graphCacheVersion,
+		Devices:    progress.Marker().Devices,
+		NodeList:   fmt.Sprintf("%x", nodeHash.Sum(nil)),
+		Mappings:   fmt.Sprintf("%x", mappingHash.Sum(nil)),
+		NodeSample: fmt.Sprintf("%x", sampleHash.Sum(nil)),
+
+		NoVerifyNodeChecksums: fs.NoVerifyNodeChecksums,
+		StrictItemSizes:       fs.StrictItemSizes,
+		TrustPartialNodes:     fs.TrustPartialNodes,
+	}, nil
+}
+
+// check returns a descriptive error wrapping ErrStaleGraphCache if a
+// cache written with key `k` may not be used for inputs with key
+// `cur`.
+func (k GraphCacheKey) check(cur GraphCacheKey) error {
+	switch {
+	case k.Version != cur.Version:
+		return fmt.Errorf("%w: cache has format version %v, but the current version is %v",
+			ErrStaleGraphCache, k.Version, cur.Version)
+	case len(k.Devices) != len(cur.Devices):
+		return fmt.Errorf("%w: cache is for %d devices, but the filesystem has %d",
+			ErrStaleGraphCache, len(k.Devices), len(cur.Devices))
+	}
+	for i := range k.Devices {
+		if k.Devices[i] != cur.Devices[i] {
+			return fmt.Errorf("%w: device %v: the device has changed since the cache was written",
+				ErrStaleGraphCache, cur.Devices[i].DevID)
+		}
+	}
+	switch {
+	case k.NodeList != cur.NodeList:
+		return fmt.Errorf("%w: cache was written for a different node list", ErrStaleGraphCache)
+	case k.Mappings != cur.Mappings:
+		return fmt.Errorf("%w: cache was written with different chunk mappings", ErrStaleGraphCache)
+	case k.NodeSample != cur.NodeSample:
+		return fmt.Errorf("%w: nodes have changed since the cache was written", ErrStaleGraphCache)
+	case k.NoVerifyNodeChecksums != cur.NoVerifyNodeChecksums:
+		return fmt.Errorf("%w: cache was written with NoVerifyNodeChecksums=%v",
+			ErrStaleGraphCache, k.NoVerifyNodeChecksums)
+	case k.StrictItemSizes != cur.StrictItemSizes:
+		return fmt.Errorf("%w: cache was written with StrictItemSizes=%v",
+			ErrStaleGraphCache, k.StrictItemSizes)
+	case k.TrustPartialNodes != cur.TrustPartialNodes:
+		return fmt.Errorf("%w: cache was written with TrustPartialNodes=%v",
+			ErrStaleGraphCache, k.TrustPartialNodes)
+	}
+	return nil
+}
+
+// graphCacheFile is the on-disk form of a Graph; in the file it is
+// preceded by the GraphCacheKey, so that a stale cache can be refused
+// without decoding all of it.  Edges are stored once, and EdgesFrom
+// and EdgesTo refer to them by index, so that the sharing of
+// *GraphEdge pointers (and the order of each list) is preserved.
+type graphCacheFile struct {
+	Nodes       []GraphNode
+	BadNodes    []graphCacheBadNode
+	Edges       []GraphEdge
+	EdgesFrom   []graphCacheEdgeList
+	EdgesTo     []graphCacheEdgeList
+	NodeSources []graphCacheNodeSources
+}
+
+type graphCacheBadNode struct {
+	Addr btrfsvol.LogicalAddr
+	Err  string
+}
+
+type graphCacheEdgeList struct {
+	Addr  btrfsvol.LogicalAddr
+	Edges []int
+}
+
+type graphCacheNodeSources struct {
+	Addr    btrfsvol.LogicalAddr
+	Sources []btrfsvol.QualifiedPhysicalAddr
+}
+
+// WriteGraphCache writes a gzip-compressed copy of `g` (as returned
+// by ReadGraph) to `w`, tagged with `key`.  Errors in g.BadNodes are
+// only preserved as strings.
+func WriteGraphCache(w io.Writer, key GraphCacheKey, g Graph) error {
+	var dat graphCacheFile
+	for _, addr := range maps.SortedKeys(g.Nodes) {
+		dat.Nodes = append(dat.Nodes, g.Nodes[addr])
+	}
+	for _, addr := range maps.SortedKeys(g.BadNodes) {
+		dat.BadNodes = append(dat.BadNodes, graphCacheBadNode{
+			Addr: addr,
+			Err:  g.BadNodes[addr].Error(),
+		})
+	}
+	edgeIdx := make(map[*GraphEdge]int)
+	encodeEdges := func(lists map[btrfsvol.LogicalAddr][]*GraphEdge) []graphCacheEdgeList {
+		var ret []graphCacheEdgeList
+		for _, addr := range maps.SortedKeys(lists) {
+			list := graphCacheEdgeList{
+				Addr:  addr,
+				Edges: make([]int, 0, len(lists[addr])),
+			}
+			for _, edge := range lists[addr] {
+				idx, ok := edgeIdx[edge]
+				if !ok {
+					idx = len(dat.Edges)
+					edgeIdx[edge] = idx
+					dat.Edges = append(dat.Edges, *edge)
+				}
+				list.Edges = append(list.Edges, idx)
+			}
+			ret = append(ret, list)
+		}
+		return ret
+	}
+	dat.EdgesFrom = encodeEdges(g.EdgesFrom)
+	dat.EdgesTo = encodeEdges(g.EdgesTo)
+	for _, addr := range maps.SortedKeys(g.NodeSources) {
+		dat.NodeSources = append(dat.NodeSources, graphCacheNodeSources{
+			Addr:    addr,
+			Sources: g.NodeSources[addr],
+		})
+	}
+
+	gz := gzip.NewWriter(w)
+	buf := bufio.NewWriter(gz)
+	enc := lowmemjson.NewEncoder(buf)
+	if err := enc.Encode(key); err != nil {
+		return err
+	}
+	if err := enc.Encode(dat); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadGraphCache reads a Graph that was written by WriteGraphCache.
+// If the cache was written for a key other than `key`, then an error
+// wrapping ErrStaleGraphCache is returned.
+func ReadGraphCache(ctx context.Context, r io.Reader, key GraphCacheKey) (Graph, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return Graph{}, err
+	}
+	dec := lowmemjson.NewDecoder(bufio.NewReader(gz))
+	var datKey GraphCacheKey
+	if err := dec.Decode(&datKey); err != nil {
+		return Graph{}, err
+	}
+	if err := datKey.check(key); err != nil {
+		return Graph{}, err
+	}
+	var dat graphCacheFile
+	if err := dec.DecodeThenEOF(&dat); err != nil {
+		return Graph{}, err
+	}
+	if err := gz.Close(); err != nil {
+		return Graph{}, err
+	}
+
+	g := Graph{
+		Nodes:       make(map[btrfsvol.LogicalAddr]GraphNode, len(dat.Nodes)),
+		BadNodes:    make(map[btrfsvol.LogicalAddr]error, len(dat.BadNodes)),
+		EdgesFrom:   make(map[btrfsvol.LogicalAddr][]*GraphEdge, len(dat.EdgesFrom)),
+		EdgesTo:     make(map[btrfsvol.LogicalAddr][]*GraphEdge, len(dat.EdgesTo)),
+		NodeSources: make(map[btrfsvol.LogicalAddr][]btrfsvol.QualifiedPhysicalAddr, len(dat.NodeSources)),
+	}
+	for _, node := range dat.Nodes {
+		g.Nodes[node.Addr] = node
+	}
+	for _, bad := range dat.BadNodes {
+		g.BadNodes[bad.Addr] = errors.New(bad.Err)
+	}
+	edges := make([]*GraphEdge, len(dat.Edges))
+	for i := range dat.Edges {
+		edges[i] = &dat.Edges[i]
+	}
+	decodeEdges := func(lists []graphCacheEdgeList, dst map[btrfsvol.LogicalAddr][]*GraphEdge) error {
+		for _, list := range lists {
+			ptrs := make([]*GraphEdge, 0, len(list.Edges))
+			for _, idx := range list.Edges {
+				if idx < 0 || idx >= len(edges) {
+					return fmt.Errorf("graph cache: node@%v: invalid edge index %v", list.Addr, idx)
+				}
+				ptrs = append(ptrs, edges[idx])
+			}
+			dst[list.Addr] = ptrs
+		}
+		return nil
+	}
+	if err := decodeEdges(dat.EdgesFrom, g.EdgesFrom); err != nil {
+		return Graph{}, err
+	}
+	if err := decodeEdges(dat.EdgesTo, g.EdgesTo); err != nil {
+		return Graph{}, err
+	}
+	for _, src := range dat.NodeSources {
+		g.NodeSources[src.Addr] = src.Sources
+	}
+
+	dlog.Infof(ctx, "loaded graph from cache: %v nodes, %v bad nodes, %v edges",
+		len(g.Nodes), len(g.BadNodes), len(dat.Edges))
+	return g, nil
+}
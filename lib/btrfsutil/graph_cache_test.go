@@ -0,0 +1,84 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func TestGraphCache(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	key := btrfsprim.Key{ObjectID: 256, ItemType: btrfsitem.INODE_ITEM_KEY}
+	graph := btrfsutil.Graph{
+		Nodes:       make(map[btrfsvol.LogicalAddr]btrfsutil.GraphNode),
+		BadNodes:    make(map[btrfsvol.LogicalAddr]error),
+		EdgesFrom:   make(map[btrfsvol.LogicalAddr][]*btrfsutil.GraphEdge),
+		EdgesTo:     make(map[btrfsvol.LogicalAddr][]*btrfsutil.GraphEdge),
+		NodeSources: make(map[btrfsvol.LogicalAddr][]btrfsvol.QualifiedPhysicalAddr),
+	}
+	graph.InsertNode(&btrfstree.Node{
+		Head: btrfstree.NodeHeader{Addr: 0x1000, Level: 1, Generation: 100, Owner: 5},
+		BodyInterior: []btrfstree.KeyPointer{
+			{Key: key, BlockPtr: 0x2000, Generation: 100},
+			{Key: key, BlockPtr: 0x3000, Generation: 100},
+		},
+	})
+	graph.InsertNode(&btrfstree.Node{
+		Head:     btrfstree.NodeHeader{Addr: 0x2000, Level: 0, Generation: 100, Owner: 5},
+		BodyLeaf: []btrfstree.Item{{Key: key, Body: &btrfsitem.Empty{}}},
+	})
+	graph.BadNodes[0x3000] = errors.New("bad checksum")
+	graph.NodeSources[0x2000] = []btrfsvol.QualifiedPhysicalAddr{{Dev: 1, Addr: 0x2000}, {Dev: 1, Addr: 0x9000}}
+
+	cacheKey := btrfsutil.GraphCacheKey{
+		Version:  1,
+		Devices:  []btrfsutil.DevScanMarker{{DevID: 1, Size: 0x10000}},
+		NodeList: "aaaa",
+		Mappings: "bbbb",
+	}
+	var buf bytes.Buffer
+	require.NoError(t, btrfsutil.WriteGraphCache(&buf, cacheKey, graph))
+
+	loaded, err := btrfsutil.ReadGraphCache(ctx, bytes.NewReader(buf.Bytes()), cacheKey)
+	require.NoError(t, err)
+	assert.Equal(t, graph.Nodes, loaded.Nodes)
+	assert.Equal(t, graph.EdgesFrom, loaded.EdgesFrom)
+	assert.Equal(t, graph.EdgesTo, loaded.EdgesTo)
+	assert.Equal(t, graph.NodeSources, loaded.NodeSources)
+	assert.EqualError(t, loaded.BadNodes[0x3000], "bad checksum")
+	assert.Contains(t, loaded.Nodes, btrfsvol.LogicalAddr(0x2000))
+	assert.NotContains(t, loaded.Nodes, btrfsvol.LogicalAddr(0x3000))
+	// Edges are shared between EdgesFrom and EdgesTo.
+	assert.Same(t, loaded.EdgesFrom[0x1000][0], loaded.EdgesTo[0x2000][0])
+
+	stale := map[string]func(*btrfsutil.GraphCacheKey){
+		"version":   func(k *btrfsutil.GraphCacheKey) { k.Version++ },
+		"device":    func(k *btrfsutil.GraphCacheKey) { k.Devices = []btrfsutil.DevScanMarker{{DevID: 1, Size: 0x20000}} },
+		"node-list": func(k *btrfsutil.GraphCacheKey) { k.NodeList = "cccc" },
+		"mappings":  func(k *btrfsutil.GraphCacheKey) { k.Mappings = "cccc" },
+		"sample":    func(k *btrfsutil.GraphCacheKey) { k.NodeSample = "cccc" },
+		"strict":    func(k *btrfsutil.GraphCacheKey) { k.StrictItemSizes = !k.StrictItemSizes },
+	}
+	for name, mutate := range stale {
+		curKey := cacheKey
+		mutate(&curKey)
+		_, err := btrfsutil.ReadGraphCache(ctx, bytes.NewReader(buf.Bytes()), curKey)
+		assert.ErrorIs(t, err, btrfsutil.ErrStaleGraphCache, name)
+	}
+}
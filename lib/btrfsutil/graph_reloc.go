@@ -0,0 +1,90 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// RelocTargets returns, for each node that is owned by
+// TREE_RELOC_OBJECTID and is reachable from a reloc tree's root, the
+// ID of the tree that that reloc tree was relocating (the .Offset of
+// the reloc tree's ROOT_ITEM key).
+//
+// A node that is reachable from the reloc trees of more than one tree
+// is ambiguous, and is left out of the result.
+func (g Graph) RelocTargets(ctx context.Context) map[btrfsvol.LogicalAddr]btrfsprim.ObjID {
+	targets := make(map[btrfsvol.LogicalAddr]containers.Set[btrfsprim.ObjID])
+	for _, node := range maps.SortedKeys(g.Nodes) {
+		for _, kp := range g.EdgesTo[node] {
+			if kp.FromRoot == 0 || kp.FromTree != btrfsprim.TREE_RELOC_OBJECTID {
+				continue
+			}
+			key := g.Nodes[kp.FromRoot].Items[kp.FromSlot].Key
+			if key.ItemType != btrfsprim.ROOT_ITEM_KEY {
+				continue
+			}
+			g.markRelocTarget(targets, node, btrfsprim.ObjID(key.Offset))
+		}
+	}
+
+	ret := make(map[btrfsvol.LogicalAddr]btrfsprim.ObjID, len(targets))
+	for _, node := range maps.SortedKeys(targets) {
+		if len(targets[node]) > 1 {
+			dlog.Warnf(ctx, "not reattributing node@%v: it is in the reloc trees of multiple trees: %v",
+				node, maps.SortedKeys(targets[node]))
+			continue
+		}
+		ret[node] = targets[node].TakeOne()
+	}
+	return ret
+}
+
+func (g Graph) markRelocTarget(targets map[btrfsvol.LogicalAddr]containers.Set[btrfsprim.ObjID], node btrfsvol.LogicalAddr, target btrfsprim.ObjID) {
+	nodeInfo, ok := g.Nodes[node]
+	if !ok || nodeInfo.Owner != btrfsprim.TREE_RELOC_OBJECTID || targets[node].Has(target) {
+		return
+	}
+	if targets[node] == nil {
+		targets[node] = make(containers.Set[btrfsprim.ObjID])
+	}
+	targets[node].Insert(target)
+	for _, kp := range g.EdgesFrom[node] {
+		g.markRelocTarget(targets, kp.ToNode, target)
+	}
+}
+
+// ReattributeRelocNodes rewrites the owner of each of the nodes in
+// `targets` (as returned by .RelocTargets()) from TREE_RELOC_OBJECTID
+// to the tree that it was relocating, so that data that was stranded
+// in a reloc tree by an interrupted balance can be recovered in to
+// that tree.  The reattributed nodes are recorded in .RelocNodes.
+func (g *Graph) ReattributeRelocNodes(ctx context.Context, targets map[btrfsvol.LogicalAddr]btrfsprim.ObjID) {
+	if g.RelocNodes == nil {
+		g.RelocNodes = make(containers.Set[btrfsvol.LogicalAddr], len(targets))
+	}
+	for _, node := range maps.SortedKeys(targets) {
+		nodeInfo, ok := g.Nodes[node]
+		if !ok || nodeInfo.Owner != btrfsprim.TREE_RELOC_OBJECTID {
+			continue
+		}
+		target := targets[node]
+		dlog.Infof(ctx, "reattributing node@%v from tree %v to tree %v",
+			node, btrfsprim.TREE_RELOC_OBJECTID.Format(btrfsprim.ROOT_TREE_OBJECTID), target.Format(btrfsprim.ROOT_TREE_OBJECTID))
+		nodeInfo.Owner = target
+		g.Nodes[node] = nodeInfo
+		for _, kp := range g.EdgesFrom[node] {
+			kp.FromTree = target
+		}
+		g.RelocNodes.Insert(node)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+func TestReattributeRelocNodes(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	const reloc = btrfsprim.TREE_RELOC_OBJECTID
+	key := btrfsprim.Key{ObjectID: 256, ItemType: btrfsitem.INODE_ITEM_KEY}
+	leaf := func(addr btrfsvol.LogicalAddr, owner btrfsprim.ObjID) *btrfstree.Node {
+		return &btrfstree.Node{
+			Head: btrfstree.NodeHeader{Addr: addr, Level: 0, Generation: 100, Owner: owner},
+			BodyLeaf: []btrfstree.Item{
+				{Key: key, Body: &btrfsitem.Empty{}},
+			},
+		}
+	}
+	interior := func(addr btrfsvol.LogicalAddr, owner btrfsprim.ObjID, children ...btrfsvol.LogicalAddr) *btrfstree.Node {
+		node := &btrfstree.Node{
+			Head: btrfstree.NodeHeader{Addr: addr, Level: 1, Generation: 100, Owner: owner},
+		}
+		for _, child := range children {
+			node.BodyInterior = append(node.BodyInterior, btrfstree.KeyPointer{Key: key, BlockPtr: child, Generation: 100})
+		}
+		return node
+	}
+
+	graph := btrfsutil.Graph{
+		Nodes:     make(map[btrfsvol.LogicalAddr]btrfsutil.GraphNode),
+		BadNodes:  make(map[btrfsvol.LogicalAddr]error),
+		EdgesFrom: make(map[btrfsvol.LogicalAddr][]*btrfsutil.GraphEdge),
+		EdgesTo:   make(map[btrfsvol.LogicalAddr][]*btrfsutil.GraphEdge),
+	}
+	// The ROOT_TREE has the reloc roots for tree 5 and tree 257.
+	graph.InsertNode(&btrfstree.Node{
+		Head: btrfstree.NodeHeader{Addr: 0x1000, Level: 0, Generation: 100, Owner: btrfsprim.ROOT_TREE_OBJECTID},
+		BodyLeaf: []btrfstree.Item{
+			{
+				Key:  btrfsprim.Key{ObjectID: reloc, ItemType: btrfsitem.ROOT_ITEM_KEY, Offset: 5},
+				Body: &btrfsitem.Root{ByteNr: 0x2000, Level: 1, Generation: 100},
+			},
+			{
+				Key:  btrfsprim.Key{ObjectID: reloc, ItemType: btrfsitem.ROOT_ITEM_KEY, Offset: 257},
+				Body: &btrfsitem.Root{ByteNr: 0x5000, Level: 1, Generation: 100},
+			},
+		},
+	})
+	// Tree 5's reloc tree has its own leaf (0x3000), one of tree
+	// 5's own leaves (0x4000), and a leaf that is shared with tree
+	// 257's reloc tree (0x6000).
+	graph.InsertNode(interior(0x2000, reloc, 0x3000, 0x4000, 0x6000))
+	graph.InsertNode(leaf(0x3000, reloc))
+	graph.InsertNode(leaf(0x4000, 5))
+	graph.InsertNode(interior(0x5000, reloc, 0x6000))
+	graph.InsertNode(leaf(0x6000, reloc))
+	// An orphaned reloc node can't be attributed at all.
+	graph.InsertNode(leaf(0x7000, reloc))
+
+	targets := graph.RelocTargets(ctx)
+	assert.Equal(t, map[btrfsvol.LogicalAddr]btrfsprim.ObjID{
+		0x2000: 5,
+		0x3000: 5,
+		0x5000: 257,
+	}, targets)
+
+	graph.ReattributeRelocNodes(ctx, targets)
+	assert.Equal(t, containers.NewSet[btrfsvol.LogicalAddr](0x2000, 0x3000, 0x5000), graph.RelocNodes)
+	assert.Equal(t, btrfsprim.ObjID(5), graph.Nodes[0x2000].Owner)
+	assert.Equal(t, btrfsprim.ObjID(5), graph.Nodes[0x3000].Owner)
+	assert.Equal(t, btrfsprim.ObjID(5), graph.Nodes[0x4000].Owner)
+	assert.Equal(t, btrfsprim.ObjID(257), graph.Nodes[0x5000].Owner)
+	assert.Equal(t, reloc, graph.Nodes[0x6000].Owner)
+	assert.Equal(t, reloc, graph.Nodes[0x7000].Owner)
+	for _, kp := range graph.EdgesFrom[0x2000] {
+		assert.Equal(t, btrfsprim.ObjID(5), kp.FromTree)
+	}
+	for _, kp := range graph.EdgesFrom[0x5000] {
+		assert.Equal(t, btrfsprim.ObjID(257), kp.FromTree)
+	}
+}
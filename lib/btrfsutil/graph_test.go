@@ -0,0 +1,318 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+type memFile []byte
+
+func (memFile) Name() string                  { return "mem" }
+func (f memFile) Size() btrfsvol.PhysicalAddr { return btrfsvol.PhysicalAddr(len(f)) }
+func (memFile) Close() error                  { return nil }
+func (f memFile) ReadAt(p []byte, off btrfsvol.PhysicalAddr) (int, error) {
+	if int(off) >= len(f) {
+		return 0, io.EOF
+	}
+	n := copy(p, f[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f memFile) WriteAt(p []byte, off btrfsvol.PhysicalAddr) (int, error) {
+	return copy(f[off:], p), nil
+}
+
+// TestReadGraphDUP builds a single-device image with a DUP metadata
+// chunk, and checks that the copies of a node in that chunk are
+// de-duplicated, with a bad or stale copy being passed over in favor
+// of the good one, both by ReadGraph and by fs.AcquireNode.
+func TestReadGraphDUP(t *testing.T) {
+	t.Parallel()
+
+	const (
+		nodeSize = 4096
+		laddr    = btrfsvol.LogicalAddr(0x100000)
+		paddrA   = btrfsvol.PhysicalAddr(0x20000)
+		paddrB   = btrfsvol.PhysicalAddr(0x30000)
+	)
+	fsUUID := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000001")
+
+	buildNode := func(t *testing.T, gen btrfsprim.Generation) []byte {
+		t.Helper()
+		var ret []byte
+		builder := &btrfstree.NodeBuilder{
+			Size:         nodeSize,
+			ChecksumType: btrfssum.TYPE_CRC32,
+			Head: btrfstree.NodeHeader{
+				MetadataUUID: fsUUID,
+				Flags:        btrfstree.NodeWritten,
+				BackrefRev:   btrfstree.MixedBackrefRev,
+				Generation:   gen,
+				Owner:        btrfsprim.ROOT_TREE_OBJECTID,
+			},
+			Alloc: func() (btrfsvol.LogicalAddr, error) { return laddr, nil },
+			Emit: func(node *btrfstree.Node) error {
+				var err error
+				ret, err = binstruct.Marshal(*node)
+				return err
+			},
+		}
+		require.NoError(t, builder.Add(btrfstree.Item{
+			Key:  btrfsprim.Key{ObjectID: 1, ItemType: btrfsitem.ORPHAN_ITEM_KEY},
+			Body: &btrfsitem.Empty{},
+		}))
+		_, _, err := builder.Finish()
+		require.NoError(t, err)
+		return ret
+	}
+
+	buildFS := func(t *testing.T, copyA, copyB []byte) *btrfs.FS {
+		t.Helper()
+		img := make(memFile, 0x40000)
+		sb := btrfstree.Superblock{
+			FSUUID:       fsUUID,
+			Self:         btrfs.SuperblockAddrs[0],
+			Magic:        [8]byte{'_', 'B', 'H', 'R', 'f', 'S', '_', 'M'},
+			Generation:   42,
+			RootTree:     laddr,
+			NumDevices:   1,
+			SectorSize:   btrfssum.BlockSize,
+			NodeSize:     nodeSize,
+			LeafSize:     nodeSize,
+			StripeSize:   btrfssum.BlockSize,
+			ChecksumType: btrfssum.TYPE_CRC32,
+			DevItem:      btrfsitem.Dev{DevID: 1},
+		}
+		var err error
+		sb.Checksum, err = sb.CalculateChecksum()
+		require.NoError(t, err)
+		sbBytes, err := binstruct.Marshal(sb)
+		require.NoError(t, err)
+		copy(img[sb.Self:], sbBytes)
+		copy(img[paddrA:], copyA)
+		copy(img[paddrB:], copyB)
+
+		fs := new(btrfs.FS)
+		require.NoError(t, fs.AddDevice(dlog.NewTestContext(t, false), &btrfs.Device{File: img}))
+		for _, paddr := range []btrfsvol.PhysicalAddr{paddrA, paddrB} {
+			require.NoError(t, fs.LV.AddMapping(btrfsvol.Mapping{
+				LAddr:      laddr,
+				PAddr:      btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: paddr},
+				Size:       0x10000,
+				SizeLocked: true,
+				Flags:      containers.OptionalValue(btrfsvol.BLOCK_GROUP_METADATA | btrfsvol.BLOCK_GROUP_DUP),
+			}))
+		}
+		return fs
+	}
+
+	good := buildNode(t, 42)
+	bad := append([]byte(nil), good...)
+	bad[nodeSize-1] ^= 0xff
+	stale := buildNode(t, 41)
+
+	qA := btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: paddrA}
+	qB := btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: paddrB}
+	testcases := map[string]struct {
+		CopyA, CopyB []byte
+		NoVerify     bool
+		ExpSources   []btrfsvol.QualifiedPhysicalAddr
+	}{
+		"identical": {CopyA: good, CopyB: good, ExpSources: []btrfsvol.QualifiedPhysicalAddr{qA, qB}},
+		"bad-a":     {CopyA: bad, CopyB: good, ExpSources: []btrfsvol.QualifiedPhysicalAddr{qB}},
+		"bad-b":     {CopyA: good, CopyB: bad, ExpSources: []btrfsvol.QualifiedPhysicalAddr{qA}},
+		"stale-a":   {CopyA: stale, CopyB: good, ExpSources: []btrfsvol.QualifiedPhysicalAddr{qB}},
+		"stale-b":   {CopyA: good, CopyB: stale, ExpSources: []btrfsvol.QualifiedPhysicalAddr{qA}},
+
+		"noverify-bad-a": {CopyA: bad, CopyB: good, NoVerify: true, ExpSources: []btrfsvol.QualifiedPhysicalAddr{qA, qB}},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			ctx := dlog.NewTestContext(t, false)
+			fs := buildFS(t, tc.CopyA, tc.CopyB)
+			fs.NoVerifyNodeChecksums = tc.NoVerify
+
+			nodeList, err := btrfsutil.ListNodes(ctx, fs)
+			require.NoError(t, err)
+			assert.Equal(t, []btrfsvol.LogicalAddr{laddr}, nodeList)
+
+			graph, err := btrfsutil.ReadGraph(ctx, fs, nodeList)
+			require.NoError(t, err)
+			assert.Len(t, graph.Nodes, 1)
+			assert.Equal(t, btrfsprim.Generation(42), graph.Nodes[laddr].Generation)
+			assert.Equal(t, tc.ExpSources, graph.NodeSources[laddr])
+
+			node, err := fs.AcquireNode(ctx, laddr, btrfstree.NodeExpectations{
+				LAddr: containers.OptionalValue(laddr),
+			})
+			require.NoError(t, err)
+			assert.Equal(t, btrfsprim.Generation(42), node.Head.Generation)
+			fs.ReleaseNode(node)
+		})
+	}
+
+	// Rewriting a node (without touching the superblock) must
+	// make a graph cache stale.
+	t.Run("cache-key", func(t *testing.T) {
+		t.Parallel()
+		ctx := dlog.NewTestContext(t, false)
+		nodeList := []btrfsvol.LogicalAddr{laddr}
+
+		fs := buildFS(t, good, good)
+		key, err := btrfsutil.NewGraphCacheKey(fs, nodeList)
+		require.NoError(t, err)
+		graph, err := btrfsutil.ReadGraph(ctx, fs, nodeList)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, btrfsutil.WriteGraphCache(&buf, key, graph))
+
+		sameKey, err := btrfsutil.NewGraphCacheKey(buildFS(t, good, good), nodeList)
+		require.NoError(t, err)
+		_, err = btrfsutil.ReadGraphCache(ctx, bytes.NewReader(buf.Bytes()), sameKey)
+		assert.NoError(t, err)
+
+		newKey, err := btrfsutil.NewGraphCacheKey(buildFS(t, good, stale), nodeList)
+		require.NoError(t, err)
+		_, err = btrfsutil.ReadGraphCache(ctx, bytes.NewReader(buf.Bytes()), newKey)
+		assert.ErrorIs(t, err, btrfsutil.ErrStaleGraphCache)
+	})
+}
+
+// TestTrustPartialNodes checks that a node at the end of a truncated
+// image can be used all the way through to reading items from a
+// RebuiltForrest, if (and only if) the FS is told to trust partial
+// nodes.
+func TestTrustPartialNodes(t *testing.T) {
+	t.Parallel()
+
+	const (
+		nodeSize = 4096
+		laddr    = btrfsvol.LogicalAddr(0x100000)
+		paddr    = btrfsvol.PhysicalAddr(0x20000)
+	)
+	fsUUID := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000002")
+	keys := []btrfsprim.Key{
+		{ObjectID: 1, ItemType: btrfsitem.ORPHAN_ITEM_KEY},
+		{ObjectID: 2, ItemType: btrfsitem.ORPHAN_ITEM_KEY},
+	}
+
+	var nodeDat []byte
+	builder := &btrfstree.NodeBuilder{
+		Size:         nodeSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		Head: btrfstree.NodeHeader{
+			MetadataUUID: fsUUID,
+			Flags:        btrfstree.NodeWritten,
+			BackrefRev:   btrfstree.MixedBackrefRev,
+			Generation:   42,
+			Owner:        btrfsprim.ROOT_TREE_OBJECTID,
+		},
+		Alloc: func() (btrfsvol.LogicalAddr, error) { return laddr, nil },
+		Emit: func(node *btrfstree.Node) error {
+			var err error
+			nodeDat, err = binstruct.Marshal(*node)
+			return err
+		},
+	}
+	for _, key := range keys {
+		require.NoError(t, builder.Add(btrfstree.Item{Key: key, Body: &btrfsitem.Empty{}}))
+	}
+	_, _, err := builder.Finish()
+	require.NoError(t, err)
+
+	buildFS := func(t *testing.T, trust bool) *btrfs.FS {
+		t.Helper()
+		// Cut the image off partway through the node.
+		img := make(memFile, int(paddr)+nodeSize/8)
+		sb := btrfstree.Superblock{
+			FSUUID:       fsUUID,
+			Self:         btrfs.SuperblockAddrs[0],
+			Magic:        [8]byte{'_', 'B', 'H', 'R', 'f', 'S', '_', 'M'},
+			Generation:   42,
+			RootTree:     laddr,
+			NumDevices:   1,
+			SectorSize:   btrfssum.BlockSize,
+			NodeSize:     nodeSize,
+			LeafSize:     nodeSize,
+			StripeSize:   btrfssum.BlockSize,
+			ChecksumType: btrfssum.TYPE_CRC32,
+			DevItem:      btrfsitem.Dev{DevID: 1},
+		}
+		sb.Checksum, err = sb.CalculateChecksum()
+		require.NoError(t, err)
+		sbBytes, err := binstruct.Marshal(sb)
+		require.NoError(t, err)
+		copy(img[sb.Self:], sbBytes)
+		copy(img[paddr:], nodeDat)
+
+		fs := &btrfs.FS{
+			SalvagePartialNodes: true,
+			TrustPartialNodes:   trust,
+		}
+		require.NoError(t, fs.AddDevice(dlog.NewTestContext(t, false), &btrfs.Device{File: img}))
+		require.NoError(t, fs.LV.AddMapping(btrfsvol.Mapping{
+			LAddr:      laddr,
+			PAddr:      btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: paddr},
+			Size:       nodeSize,
+			SizeLocked: true,
+			Flags:      containers.OptionalValue(btrfsvol.BLOCK_GROUP_METADATA),
+		}))
+		return fs
+	}
+	nodeList := []btrfsvol.LogicalAddr{laddr}
+
+	t.Run("untrusted", func(t *testing.T) {
+		t.Parallel()
+		ctx := dlog.NewTestContext(t, false)
+		fs := buildFS(t, false)
+		_, err := btrfsutil.ReadGraph(ctx, fs, nodeList)
+		assert.ErrorIs(t, err, btrfstree.ErrPartialNode)
+		_, err = fs.AcquireNode(ctx, laddr, btrfstree.NodeExpectations{})
+		assert.ErrorIs(t, err, btrfstree.ErrPartialNode)
+	})
+
+	t.Run("trusted", func(t *testing.T) {
+		t.Parallel()
+		ctx := dlog.NewTestContext(t, false)
+		fs := buildFS(t, true)
+		graph, err := btrfsutil.ReadGraph(ctx, fs, nodeList)
+		require.NoError(t, err)
+		require.Contains(t, graph.Nodes, laddr)
+
+		rfs := btrfsutil.NewRebuiltForrest(fs, graph, nil, false)
+		tree, err := rfs.RebuiltTree(ctx, btrfsprim.ROOT_TREE_OBJECTID)
+		require.NoError(t, err)
+		for _, key := range keys {
+			item, err := tree.TreeLookup(ctx, key)
+			require.NoError(t, err, key)
+			assert.Equal(t, key, item.Key)
+			// The items' bodies live at the end of the
+			// node, which is the part that is missing.
+			assert.IsType(t, &btrfsitem.Error{}, item.Body)
+		}
+	})
+}
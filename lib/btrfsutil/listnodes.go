@@ -52,14 +52,32 @@ func (s *nodeLister) ScanDone(_ context.Context) (containers.Set[btrfsvol.Logica
 	return s.nodes, nil
 }
 
+// ListNodes scans every device for nodes, and returns the sorted
+// list of their logical addresses.  A node that is found at several
+// physical addresses (because it is in a DUP or mirrored chunk) is
+// listed only once; ReadGraph chooses between the copies.
 func ListNodes(ctx context.Context, fs *btrfs.FS) ([]btrfsvol.LogicalAddr, error) {
 	perDev, err := ScanDevices[nodeListStats, containers.Set[btrfsvol.LogicalAddr]](ctx, fs, newNodeLister)
 	if err != nil {
 		return nil, err
 	}
+	return mergeNodeLists(perDev), nil
+}
+
+// ListNodesHealth is like ListNodes, but also returns a DeviceHealth
+// for each device; see ScanDevicesHealth.
+func ListNodesHealth(ctx context.Context, fs *btrfs.FS) ([]btrfsvol.LogicalAddr, []DeviceHealth, error) {
+	perDev, health, err := ScanDevicesHealth[nodeListStats, containers.Set[btrfsvol.LogicalAddr]](ctx, fs, nil, newNodeLister)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mergeNodeLists(perDev), health, nil
+}
+
+func mergeNodeLists(perDev map[btrfsvol.DeviceID]containers.Set[btrfsvol.LogicalAddr]) []btrfsvol.LogicalAddr {
 	set := make(containers.Set[btrfsvol.LogicalAddr])
 	for _, devSet := range perDev {
 		set.InsertFrom(devSet)
 	}
-	return maps.SortedKeys(set), nil
+	return maps.SortedKeys(set)
 }
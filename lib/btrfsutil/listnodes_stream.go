@@ -0,0 +1,159 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// ListNodesStream is like ListNodes, but rather than returning the
+// list once the scan is complete, it calls fn for each node address
+// as soon as it is discovered.  Addresses are de-duplicated (the same
+// node may be found on several devices, or twice on one device), but
+// are not sorted.  Calls to fn are serialized; if fn returns an error,
+// the scan is aborted.
+//
+// De-duplicating means remembering every address found so far, so
+// memory use still grows with the number of nodes, just as with
+// ListNodes; what streaming saves is having to wait for the end of
+// the scan.
+func ListNodesStream(ctx context.Context, fs *btrfs.FS, fn func(btrfsvol.LogicalAddr) error) error {
+	return ListNodesStreamResume(ctx, fs, nil, fn)
+}
+
+// ListNodesStreamResume is like ListNodesStream, but resumes the scan
+// from (and updates) `progress`; see ScanDevicesResume.  If fn saves
+// progress.Marker() along with the addresses that it has been passed
+// so far, then a later scan may be resumed from that marker without
+// missing any nodes.
+func ListNodesStreamResume(ctx context.Context, fs *btrfs.FS, progress *ScanProgress, fn func(btrfsvol.LogicalAddr) error) error {
+	_, err := listNodesStream(ctx, fs, progress, false, fn)
+	return err
+}
+
+// ListNodesStreamHealth is like ListNodesStreamResume, but also
+// returns a DeviceHealth for each device; see ScanDevicesHealth.
+func ListNodesStreamHealth(ctx context.Context, fs *btrfs.FS, progress *ScanProgress, fn func(btrfsvol.LogicalAddr) error) ([]DeviceHealth, error) {
+	return listNodesStream(ctx, fs, progress, true, fn)
+}
+
+func listNodesStream(ctx context.Context, fs *btrfs.FS, progress *ScanProgress, checkHealth bool, fn func(btrfsvol.LogicalAddr) error) ([]DeviceHealth, error) {
+	stream := &nodeStream{
+		seen: make(containers.Set[btrfsvol.LogicalAddr]),
+		fn:   fn,
+	}
+	_, health, err := scanDevices[nodeListStats, struct{}](ctx, fs, progress, checkHealth, func(context.Context, btrfstree.Superblock, btrfsvol.PhysicalAddr, int) DeviceScanner[nodeListStats, struct{}] {
+		return &streamNodeLister{stream: stream}
+	})
+	return health, err
+}
+
+type nodeStream struct {
+	mu   sync.Mutex
+	seen containers.Set[btrfsvol.LogicalAddr]
+	fn   func(btrfsvol.LogicalAddr) error
+}
+
+func (s *nodeStream) add(addr btrfsvol.LogicalAddr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen.Has(addr) {
+		return nil
+	}
+	s.seen.Insert(addr)
+	return s.fn(addr)
+}
+
+type streamNodeLister struct {
+	stream   *nodeStream
+	numNodes int
+}
+
+var _ DeviceScanner[nodeListStats, struct{}] = (*streamNodeLister)(nil)
+
+func (s *streamNodeLister) ScanStats() nodeListStats {
+	return nodeListStats{numNodes: s.numNodes}
+}
+
+func (*streamNodeLister) ScanSector(context.Context, *btrfs.Device, btrfsvol.PhysicalAddr) error {
+	return nil
+}
+
+func (s *streamNodeLister) ScanNode(_ context.Context, _ btrfsvol.PhysicalAddr, node *btrfstree.Node) error {
+	s.numNodes++
+	return s.stream.add(node.Head.Addr)
+}
+
+func (*streamNodeLister) ScanDone(context.Context) (struct{}, error) {
+	return struct{}{}, nil
+}
+
+// WriteNodeListLine writes a single node address as a JSON Lines
+// record.  The record is written with a single call to w.Write, so
+// that if w is unbuffered, an interrupted write can truncate at most
+// that one record.  If w is a *bufio.Writer that doesn't have room
+// for the whole record, it is flushed first, so that the buffer is
+// only ever flushed at a record boundary (a bufio.Writer would
+// otherwise fill the buffer with the first part of the record and
+// flush that).
+func WriteNodeListLine(w io.Writer, addr btrfsvol.LogicalAddr) error {
+	var buf [24]byte
+	line := append(strconv.AppendInt(buf[:0], int64(addr), 10), '\n')
+	if bw, ok := w.(*bufio.Writer); ok && bw.Available() < len(line) {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(line)
+	return err
+}
+
+// ReadNodeListLines reads a JSON Lines node list as written by
+// WriteNodeListLine, and returns the sorted, de-duplicated list of
+// addresses.  A trailing record that is not terminated by a newline
+// is assumed to be the result of an interrupted write, and is
+// discarded with a warning.
+func ReadNodeListLines(ctx context.Context, r io.Reader) ([]btrfsvol.LogicalAddr, error) {
+	set := make(containers.Set[btrfsvol.LogicalAddr])
+	buf := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, err := buf.ReadBytes('\n')
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			if len(bytes.TrimSpace(line)) > 0 {
+				dlog.Warnf(ctx, "node list: line %d: discarding unterminated trailing record %q (was the scan interrupted?)",
+					lineNum, line)
+			}
+			break
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		addr, err := strconv.ParseInt(string(line), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("node list: line %d: %w", lineNum, err)
+		}
+		set.Insert(btrfsvol.LogicalAddr(addr))
+	}
+	return maps.SortedKeys(set), nil
+}
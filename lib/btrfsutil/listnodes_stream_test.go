@@ -0,0 +1,71 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+func TestNodeListLines(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	for _, addr := range []btrfsvol.LogicalAddr{0x8000, 0x4000, 0x8000, 0x10000} {
+		require.NoError(t, WriteNodeListLine(&buf, addr))
+	}
+	assert.Equal(t, "32768\n16384\n32768\n65536\n", buf.String())
+
+	ctx := dlog.NewTestContext(t, true)
+	list, err := ReadNodeListLines(ctx, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, []btrfsvol.LogicalAddr{0x4000, 0x8000, 0x10000}, list)
+
+	// An interrupted write leaves a partial trailing record.
+	list, err = ReadNodeListLines(dlog.NewTestContext(t, false), strings.NewReader("16384\n32768\n655"))
+	require.NoError(t, err)
+	assert.Equal(t, []btrfsvol.LogicalAddr{0x4000, 0x8000}, list)
+
+	_, err = ReadNodeListLines(ctx, strings.NewReader("16384\nbogus\n"))
+	assert.Error(t, err)
+}
+
+// recordingWriter records the arguments of each call to Write.
+type recordingWriter struct {
+	writes []string
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestNodeListLinesBuffered(t *testing.T) {
+	t.Parallel()
+	var rec recordingWriter
+	// A buffer size that records don't evenly divide, so that
+	// without the early flush, a record would straddle a flush.
+	buf := bufio.NewWriterSize(&rec, 20)
+	for addr := btrfsvol.LogicalAddr(0x4000); addr < 0x40000; addr += 0x4000 {
+		require.NoError(t, WriteNodeListLine(buf, addr))
+	}
+	require.NoError(t, buf.Flush())
+	require.Greater(t, len(rec.writes), 1)
+	var all strings.Builder
+	for _, write := range rec.writes {
+		assert.True(t, strings.HasSuffix(write, "\n"), "flushed a partial record: %q", write)
+		all.WriteString(write)
+	}
+	list, err := ReadNodeListLines(dlog.NewTestContext(t, false), strings.NewReader(all.String()))
+	require.NoError(t, err)
+	assert.Len(t, list, 15)
+}
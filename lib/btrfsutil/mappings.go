@@ -0,0 +1,141 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/datawire/dlib/derror"
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+// A DevMapping is a btrfsvol.Mapping along with the UUID of the
+// device that the mapping's physical address is on.  Encoded as
+// JSON, a list of DevMappings is a superset of a list of
+// btrfsvol.Mappings (as used by `--mappings`), so either may be read
+// as the other.
+type DevMapping struct {
+	btrfsvol.Mapping
+	DevUUID btrfsprim.UUID
+}
+
+// ExportMappings derives the logical-to-physical mappings of the
+// filesystem from its CHUNK_TREE, falling back to the DEV_TREE's
+// DEV_EXTENT items for any chunk that is missing from the
+// CHUNK_TREE.  The result is normalized with
+// btrfsvol.NormalizeMappings.
+//
+// Problems reading the trees are returned as an error, but only
+// after everything that could be read has been; the returned
+// mappings are useful even if there is an error.
+func ExportMappings(ctx context.Context, fs *btrfs.FS) ([]DevMapping, error) {
+	var errs derror.MultiError
+
+	devUUIDs := make(map[btrfsvol.DeviceID]btrfsprim.UUID)
+	for devID, dev := range fs.LV.PhysicalVolumes() {
+		sb, err := dev.Superblock()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("device %v: %w", devID, err))
+			continue
+		}
+		devUUIDs[devID] = sb.DevItem.DevUUID
+	}
+
+	var mappings []btrfsvol.Mapping
+	chunkAddrs := make(containers.Set[btrfsvol.LogicalAddr])
+
+	if chunkTree, err := fs.ForrestLookup(ctx, btrfsprim.CHUNK_TREE_OBJECTID); err != nil {
+		errs = append(errs, err)
+	} else if err := chunkTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		switch body := item.Body.(type) {
+		case *btrfsitem.Dev:
+			devUUIDs[body.DevID] = body.DevUUID
+		case *btrfsitem.Chunk:
+			for _, stripe := range body.Stripes {
+				devUUIDs[stripe.DeviceID] = stripe.DeviceUUID
+			}
+			mappings = append(mappings, body.Mappings(item.Key)...)
+			chunkAddrs.Insert(btrfsvol.LogicalAddr(item.Key.Offset))
+		case *btrfsitem.Error:
+			errs = append(errs, fmt.Errorf("chunk tree: item %v: %w", item.Key, body.Err))
+		}
+		return true
+	}); err != nil {
+		errs = append(errs, fmt.Errorf("chunk tree: %w", err))
+	}
+
+	if devTree, err := fs.ForrestLookup(ctx, btrfsprim.DEV_TREE_OBJECTID); err != nil {
+		errs = append(errs, err)
+	} else if err := devTree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		switch body := item.Body.(type) {
+		case *btrfsitem.DevExtent:
+			if !chunkAddrs.Has(body.ChunkOffset) {
+				dlog.Infof(ctx, "chunk %v is missing from the chunk tree; using the dev extent at %v",
+					body.ChunkOffset, item.Key)
+				mappings = append(mappings, body.Mapping(item.Key))
+			}
+		case *btrfsitem.Error:
+			if item.Key.ItemType == btrfsitem.DEV_EXTENT_KEY {
+				errs = append(errs, fmt.Errorf("dev tree: item %v: %w", item.Key, body.Err))
+			}
+		}
+		return true
+	}); err != nil {
+		errs = append(errs, fmt.Errorf("dev tree: %w", err))
+	}
+
+	mappings, err := btrfsvol.NormalizeMappings(mappings)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]DevMapping, 0, len(mappings))
+	for _, mapping := range mappings {
+		ret = append(ret, DevMapping{
+			Mapping: mapping,
+			DevUUID: devUUIDs[mapping.PAddr.Dev],
+		})
+	}
+	if len(errs) > 0 {
+		return ret, errs
+	}
+	return ret, nil
+}
+
+// ResolveDevMappings converts DevMappings in to plain
+// btrfsvol.Mappings for the filesystem `fs`.  Each mapping whose
+// DevUUID matches one of the devices in `fs` is pointed at that
+// device, even if the device has a different ID in `fs` than it did
+// in the filesystem that the mappings came from.  Mappings with a
+// zero DevUUID, or a DevUUID that does not match any device, are
+// used as-is.
+func ResolveDevMappings(fs *btrfs.FS, in []DevMapping) ([]btrfsvol.Mapping, error) {
+	devIDs := make(map[btrfsprim.UUID]btrfsvol.DeviceID)
+	for devID, dev := range fs.LV.PhysicalVolumes() {
+		sb, err := dev.Superblock()
+		if err != nil {
+			return nil, fmt.Errorf("device %v: %w", devID, err)
+		}
+		devIDs[sb.DevItem.DevUUID] = devID
+	}
+
+	ret := make([]btrfsvol.Mapping, 0, len(in))
+	for _, mapping := range in {
+		if mapping.DevUUID != (btrfsprim.UUID{}) {
+			if devID, ok := devIDs[mapping.DevUUID]; ok {
+				mapping.PAddr.Dev = devID
+			}
+		}
+		ret = append(ret, mapping.Mapping)
+	}
+	return ret, nil
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+// TestDevMappingJSON checks that the output of ExportMappings can be
+// read as plain btrfsvol.Mappings, and that plain btrfsvol.Mappings
+// can be read as DevMappings.
+func TestDevMappingJSON(t *testing.T) {
+	t.Parallel()
+	mapping := btrfsvol.Mapping{
+		LAddr:      0x100000,
+		PAddr:      btrfsvol.QualifiedPhysicalAddr{Dev: 2, Addr: 0x200000},
+		Size:       0x10000,
+		SizeLocked: true,
+		Flags:      containers.OptionalValue(btrfsvol.BLOCK_GROUP_METADATA | btrfsvol.BLOCK_GROUP_DUP),
+	}
+	devMapping := btrfsutil.DevMapping{
+		Mapping: mapping,
+		DevUUID: btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000002"),
+	}
+	encode := func(t *testing.T, obj any) string {
+		t.Helper()
+		var buf bytes.Buffer
+		require.NoError(t, lowmemjson.NewEncoder(&buf).Encode(obj))
+		return buf.String()
+	}
+
+	var asPlain []btrfsvol.Mapping
+	require.NoError(t, lowmemjson.NewDecoder(strings.NewReader(encode(t, []btrfsutil.DevMapping{devMapping}))).DecodeThenEOF(&asPlain))
+	assert.Equal(t, []btrfsvol.Mapping{mapping}, asPlain)
+
+	var asDev []btrfsutil.DevMapping
+	require.NoError(t, lowmemjson.NewDecoder(strings.NewReader(encode(t, []btrfsvol.Mapping{mapping}))).DecodeThenEOF(&asDev))
+	assert.Equal(t, []btrfsutil.DevMapping{{Mapping: mapping}}, asDev)
+}
@@ -0,0 +1,207 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+	"sort"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/slices"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// NodeSizeCandidates is the list of node sizes that DetectNodeSize
+// probes, by default.
+var NodeSizeCandidates = []uint32{
+	4 * 1024,
+	8 * 1024,
+	16 * 1024,
+	32 * 1024,
+	64 * 1024,
+}
+
+var nodeHeaderSize = binstruct.StaticSize(btrfstree.NodeHeader{})
+
+// DetectNodeSizeConfig configures DetectNodeSize.
+type DetectNodeSizeConfig struct {
+	// Sizes is the list of node sizes to probe; if empty,
+	// NodeSizeCandidates is used.
+	Sizes []uint32
+	// MaxBlocks, if non-zero, stops scanning each device after
+	// this many node-looking blocks have been found, in order to
+	// get a quick estimate.
+	MaxBlocks int
+}
+
+// A NodeSizeResult is how well a candidate node size fits the nodes
+// found on disk.
+type NodeSizeResult struct {
+	NodeSize uint32
+	// Blocks is the number of node-looking blocks (blocks whose
+	// header has the filesystem's metadata UUID) found.
+	Blocks int
+	// Validated is the number of those blocks whose checksum
+	// validates when using this node size.
+	Validated int
+}
+
+// Confidence is the fraction of node-looking blocks that validate
+// when using this node size.
+func (r NodeSizeResult) Confidence() float64 {
+	if r.Blocks == 0 {
+		return 0
+	}
+	return float64(r.Validated) / float64(r.Blocks)
+}
+
+// detectNodeSizeWindow is how much DetectNodeSize reads from the
+// device at once; nodes that lie within it are checked without
+// re-reading them.
+var detectNodeSizeWindow = textui.NewTunable("btrfsutil.detect-node-size-window", 1<<20)
+
+type nodeSizeStats struct {
+	portion textui.Portion[btrfsvol.PhysicalAddr]
+	blocks  int
+}
+
+func (s nodeSizeStats) String() string {
+	return textui.Sprintf("scanned %v (found: %v node-looking blocks)",
+		s.portion, s.blocks)
+}
+
+// DetectNodeSize infers the node size of the filesystem, without
+// trusting Superblock.NodeSize, by scanning the devices for blocks
+// that look like nodes, and checking which candidate node size makes
+// the most of them pass checksum validation.
+//
+// The results are sorted best-first.
+func DetectNodeSize(ctx context.Context, fs *btrfs.FS, cfg DetectNodeSizeConfig) ([]NodeSizeResult, error) {
+	sizes := cfg.Sizes
+	if len(sizes) == 0 {
+		sizes = NodeSizeCandidates
+	}
+	results := make(map[uint32]*NodeSizeResult, len(sizes))
+	for _, size := range sizes {
+		results[size] = &NodeSizeResult{NodeSize: size}
+	}
+
+	devs := fs.LV.PhysicalVolumes()
+	for _, devID := range maps.SortedKeys(devs) {
+		if err := detectNodeSizeOneDevice(ctx, devs[devID], cfg.MaxBlocks, sizes, results); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make([]NodeSizeResult, 0, len(results))
+	for _, size := range sizes {
+		ret = append(ret, *results[size])
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Validated > ret[j].Validated
+	})
+	return ret, nil
+}
+
+func detectNodeSizeOneDevice(ctx context.Context, dev *btrfs.Device, maxBlocks int, sizes []uint32, results map[uint32]*NodeSizeResult) error {
+	ctx = dlog.WithField(ctx, "btrfs.util.detect-node-size.dev", dev.Name())
+
+	sb, err := dev.Superblock()
+	if err != nil {
+		return err
+	}
+	metadataUUID := sb.EffectiveMetadataUUID()
+	numBytes := dev.Size()
+
+	var maxSize uint32
+	for _, size := range sizes {
+		if size > maxSize {
+			maxSize = size
+		}
+	}
+	// Read the device a window at a time, rather than reading
+	// maxSize bytes at every sector; otherwise each byte would be
+	// read maxSize/BlockSize times.
+	win := make([]byte, slices.Max(detectNodeSizeWindow.Get(), int(maxSize)))
+	var winBeg, winEnd btrfsvol.PhysicalAddr
+
+	progressWriter := textui.NewProgress[nodeSizeStats](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
+	var stats nodeSizeStats
+	stats.portion.D = numBytes
+
+	for pos := btrfsvol.PhysicalAddr(0); pos+btrfsvol.PhysicalAddr(nodeHeaderSize) <= numBytes; pos += btrfssum.BlockSize {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if maxBlocks > 0 && stats.blocks >= maxBlocks {
+			break
+		}
+		stats.portion.N = pos
+		progressWriter.Set(stats)
+
+		isSuperblock := false
+		for _, sbAddr := range btrfs.SuperblockAddrs {
+			if sbAddr <= pos && pos < sbAddr+sbSize {
+				isSuperblock = true
+				break
+			}
+		}
+		if isSuperblock {
+			continue
+		}
+
+		if pos+btrfsvol.PhysicalAddr(maxSize) > winEnd && winEnd < numBytes {
+			n, _ := dev.ReadAt(win, pos)
+			winBeg, winEnd = pos, pos+btrfsvol.PhysicalAddr(n)
+		}
+		if pos >= winEnd {
+			continue
+		}
+		buf := win[pos-winBeg : slices.Min(winEnd-winBeg, pos-winBeg+btrfsvol.PhysicalAddr(maxSize))]
+		n := len(buf)
+		if n < nodeHeaderSize {
+			continue
+		}
+		var head btrfstree.NodeHeader
+		if _, err := binstruct.Unmarshal(buf[:nodeHeaderSize], &head); err != nil {
+			continue
+		}
+		if head.MetadataUUID != metadataUUID {
+			continue
+		}
+		stats.blocks++
+
+		var skip uint32
+		for _, size := range sizes {
+			results[size].Blocks++
+			if int(size) > n {
+				continue
+			}
+			calced, err := sb.ChecksumType.Sum(buf[binstruct.StaticSize(btrfssum.CSum{}):size])
+			if err != nil {
+				return err
+			}
+			if calced == head.Checksum {
+				results[size].Validated++
+				skip = size
+			}
+		}
+		if skip > btrfssum.BlockSize {
+			pos += btrfsvol.PhysicalAddr(skip - btrfssum.BlockSize)
+		}
+	}
+
+	stats.portion.N = numBytes
+	progressWriter.Set(stats)
+	progressWriter.Done()
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+// countingFile is a memFile that counts how many bytes are read from
+// it.
+type countingFile struct {
+	memFile
+	bytesRead *int
+}
+
+func (f countingFile) ReadAt(p []byte, off btrfsvol.PhysicalAddr) (int, error) {
+	n, err := f.memFile.ReadAt(p, off)
+	*f.bytesRead += n
+	return n, err
+}
+
+const (
+	detectNodeSizeImgSize = btrfsvol.PhysicalAddr(4 << 20)
+	detectNodeSizeNodes   = 40
+)
+
+// mkDetectNodeSizeFS returns an FS with an image of 16KiB nodes
+// (whose superblock claims 4KiB nodes), that counts the bytes read
+// from it in to `bytesRead`.
+func mkDetectNodeSizeFS(t *testing.T, bytesRead *int) *btrfs.FS {
+	t.Helper()
+	const (
+		nodeSize = 16 * 1024
+		numNodes = detectNodeSizeNodes
+		imgSize  = detectNodeSizeImgSize
+		paddr0   = btrfsvol.PhysicalAddr(1 << 20)
+	)
+	fsUUID := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000006")
+	ctx := dlog.NewTestContext(t, false)
+
+	img := countingFile{
+		memFile:   make(memFile, imgSize),
+		bytesRead: bytesRead,
+	}
+	nextAddr := btrfsvol.LogicalAddr(paddr0)
+	emitted := 0
+	builder := &btrfstree.NodeBuilder{
+		Size:         nodeSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		Head: btrfstree.NodeHeader{
+			MetadataUUID: fsUUID,
+			Flags:        btrfstree.NodeWritten,
+			BackrefRev:   btrfstree.MixedBackrefRev,
+			Generation:   42,
+			Owner:        btrfsprim.FS_TREE_OBJECTID,
+		},
+		Alloc: func() (btrfsvol.LogicalAddr, error) {
+			addr := nextAddr
+			nextAddr += nodeSize
+			return addr, nil
+		},
+		Emit: func(node *btrfstree.Node) error {
+			bs, err := binstruct.Marshal(*node)
+			copy(img.memFile[node.Head.Addr:], bs)
+			emitted++
+			return err
+		},
+	}
+	for ino := btrfsprim.ObjID(0); emitted < numNodes; ino++ {
+		require.NoError(t, builder.Add(btrfstree.Item{
+			Key:  btrfsprim.Key{ObjectID: btrfsprim.FIRST_FREE_OBJECTID + ino, ItemType: btrfsitem.INODE_ITEM_KEY},
+			Body: &btrfsitem.Inode{Generation: 42, NLink: 1},
+		}))
+	}
+	_, _, err := builder.Finish()
+	require.NoError(t, err)
+
+	sb := btrfstree.Superblock{
+		FSUUID:       fsUUID,
+		Self:         btrfs.SuperblockAddrs[0],
+		Magic:        btrfstree.SuperblockMagic,
+		Generation:   42,
+		NumDevices:   1,
+		SectorSize:   btrfssum.BlockSize,
+		NodeSize:     btrfssum.BlockSize,
+		LeafSize:     btrfssum.BlockSize,
+		StripeSize:   btrfssum.BlockSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		DevItem:      btrfsitem.Dev{DevID: 1},
+	}
+	sb.Checksum, err = sb.CalculateChecksum()
+	require.NoError(t, err)
+	sbBytes, err := binstruct.Marshal(sb)
+	require.NoError(t, err)
+	copy(img.memFile[sb.Self:], sbBytes)
+
+	fs := new(btrfs.FS)
+	require.NoError(t, fs.AddDevice(ctx, &btrfs.Device{File: img}))
+	*bytesRead = 0
+	return fs
+}
+
+// TestDetectNodeSize checks that DetectNodeSize picks 16KiB for
+// mkDetectNodeSizeFS, reading each byte of the image about once.
+func TestDetectNodeSize(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	var bytesRead int
+	fs := mkDetectNodeSizeFS(t, &bytesRead)
+
+	results, err := btrfsutil.DetectNodeSize(ctx, fs, btrfsutil.DetectNodeSizeConfig{})
+	require.NoError(t, err)
+	require.Len(t, results, len(btrfsutil.NodeSizeCandidates))
+	assert.Equal(t, uint32(16*1024), results[0].NodeSize)
+	assert.GreaterOrEqual(t, results[0].Blocks, detectNodeSizeNodes)
+	assert.Equal(t, results[0].Blocks, results[0].Validated)
+	assert.Equal(t, 1.0, results[0].Confidence())
+	for _, result := range results[1:] {
+		assert.Zero(t, result.Validated, "node size %v", result.NodeSize)
+	}
+
+	// Each byte is read about once, not once per sector that
+	// overlaps it.
+	assert.Less(t, bytesRead, 2*int(detectNodeSizeImgSize))
+}
+
+// TestDetectNodeSizeConfig checks that DetectNodeSizeConfig.Sizes
+// and .MaxBlocks are obeyed.
+func TestDetectNodeSizeConfig(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	var bytesRead int
+	fs := mkDetectNodeSizeFS(t, &bytesRead)
+
+	results, err := btrfsutil.DetectNodeSize(ctx, fs, btrfsutil.DetectNodeSizeConfig{
+		Sizes:     []uint32{8 * 1024, 16 * 1024},
+		MaxBlocks: 5,
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, uint32(16*1024), results[0].NodeSize)
+	assert.Equal(t, 5, results[0].Blocks)
+	assert.Equal(t, 5, results[0].Validated)
+	assert.Equal(t, uint32(8*1024), results[1].NodeSize)
+	assert.Zero(t, results[1].Validated)
+
+	// It stopped early.
+	assert.Less(t, bytesRead, int(detectNodeSizeImgSize))
+}
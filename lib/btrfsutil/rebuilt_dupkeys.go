@@ -0,0 +1,139 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+)
+
+// A DupKeyCandidate is one of several items in a tree that have the
+// same key.
+type DupKeyCandidate struct {
+	Ptr        ItemPtr
+	Owner      btrfsprim.ObjID
+	Generation btrfsprim.Generation
+}
+
+// A DupKeyConflict is a key that appears in more than one leaf of a
+// tree, along with which of the candidate items
+// RebuiltTree.RebuiltShouldReplace selected.
+type DupKeyConflict struct {
+	Tree       btrfsprim.ObjID
+	Key        btrfsprim.Key
+	Candidates []DupKeyCandidate
+	Selected   ItemPtr
+}
+
+// differs returns whether the candidates disagree about owner or
+// generation; if they agree, the conflict isn't evidence of anything
+// interesting about the tree's COW history.
+func (c DupKeyConflict) differs() bool {
+	for _, cand := range c.Candidates[1:] {
+		if cand.Owner != c.Candidates[0].Owner || cand.Generation != c.Candidates[0].Generation {
+			return true
+		}
+	}
+	return false
+}
+
+// RebuiltEnableDupKeyReport enables collecting the report returned by
+// .RebuiltDupKeyReport().  It is off by default because it uses
+// memory proportional to the number of duplicated keys.  It should be
+// called before any trees are accessed; duplicates in trees whose
+// items have already been indexed are not reported.
+func (ts *RebuiltForrest) RebuiltEnableDupKeyReport() {
+	ts.dupKeysMu.Lock()
+	defer ts.dupKeysMu.Unlock()
+	if ts.dupKeys == nil {
+		ts.dupKeys = make(map[btrfsprim.ObjID]map[btrfsprim.Key]DupKeyConflict)
+	}
+}
+
+// RebuiltDupKeyReport returns, for each tree and key, the keys that
+// appear in multiple leaves of the tree with differing generations or
+// owners, along with which item was selected.  Only items that are in
+// the tree (not items that could be added to the tree with
+// .RebuiltAddRoot()) are considered.
+//
+// It returns nil if .RebuiltEnableDupKeyReport() has not been called.
+func (ts *RebuiltForrest) RebuiltDupKeyReport() map[btrfsprim.ObjID]map[btrfsprim.Key]DupKeyConflict {
+	ts.dupKeysMu.Lock()
+	defer ts.dupKeysMu.Unlock()
+	if ts.dupKeys == nil {
+		return nil
+	}
+	ret := make(map[btrfsprim.ObjID]map[btrfsprim.Key]DupKeyConflict)
+	for treeID, conflicts := range ts.dupKeys {
+		for key, conflict := range conflicts {
+			if !conflict.differs() {
+				continue
+			}
+			if ret[treeID] == nil {
+				ret[treeID] = make(map[btrfsprim.Key]DupKeyConflict)
+			}
+			ret[treeID][key] = conflict
+		}
+	}
+	return ret
+}
+
+func (ts *RebuiltForrest) dupKeysEnabled() bool {
+	ts.dupKeysMu.Lock()
+	defer ts.dupKeysMu.Unlock()
+	return ts.dupKeys != nil
+}
+
+func (ts *RebuiltForrest) dupKeyCandidate(ptr ItemPtr) DupKeyCandidate {
+	node := ts.graph.Nodes[ptr.Node]
+	return DupKeyCandidate{
+		Ptr:        ptr,
+		Owner:      node.Owner,
+		Generation: node.Generation,
+	}
+}
+
+// setDupKeys replaces the recorded conflicts for a tree, as when the
+// tree's item index is rebuilt from scratch.
+func (ts *RebuiltForrest) setDupKeys(treeID btrfsprim.ObjID, conflicts map[btrfsprim.Key]DupKeyConflict) {
+	ts.dupKeysMu.Lock()
+	defer ts.dupKeysMu.Unlock()
+	if ts.dupKeys == nil {
+		return
+	}
+	ts.dupKeys[treeID] = conflicts
+}
+
+// A rebuiltDupKey is an item at NewPtr that was found for a key that
+// the tree already had an item at OldPtr for, as when the tree's item
+// index is updated incrementally.
+type rebuiltDupKey struct {
+	Key      btrfsprim.Key
+	OldPtr   ItemPtr
+	NewPtr   ItemPtr
+	Selected ItemPtr
+}
+
+// addDupKey records a dup for a tree.
+func (ts *RebuiltForrest) addDupKey(treeID btrfsprim.ObjID, dup rebuiltDupKey) {
+	ts.dupKeysMu.Lock()
+	defer ts.dupKeysMu.Unlock()
+	if ts.dupKeys == nil {
+		return
+	}
+	if ts.dupKeys[treeID] == nil {
+		ts.dupKeys[treeID] = make(map[btrfsprim.Key]DupKeyConflict)
+	}
+	conflict, ok := ts.dupKeys[treeID][dup.Key]
+	if !ok {
+		conflict = DupKeyConflict{
+			Tree:       treeID,
+			Key:        dup.Key,
+			Candidates: []DupKeyCandidate{ts.dupKeyCandidate(dup.OldPtr)},
+		}
+	}
+	conflict.Candidates = append(conflict.Candidates, ts.dupKeyCandidate(dup.NewPtr))
+	conflict.Selected = dup.Selected
+	ts.dupKeys[treeID][dup.Key] = conflict
+}
@@ -8,7 +8,9 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 
+	"github.com/datawire/dlib/dgroup"
 	"github.com/datawire/dlib/dlog"
 
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
@@ -18,6 +20,7 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
 	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
 	"git.lukeshu.com/btrfs-progs-ng/lib/slices"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
 // RebuiltForrest is an abstraction for rebuilding and accessing
@@ -66,6 +69,25 @@ type RebuiltForrest struct {
 	commitTreesOnce sync.Once
 	treesCommitted  bool // must hold .treesMu to access
 	treesCommitter  btrfsprim.ObjID
+	trustedGens     map[btrfsprim.ObjID]btrfsprim.Generation // must hold .treesMu to access
+	rootTreeRoot    btrfsvol.LogicalAddr                     // must hold .treesMu to access; 0 for the superblock's
+	injectedRoots   map[btrfsprim.ObjID]btrfsvol.LogicalAddr // must hold .treesMu to access
+	injectedNodes   map[btrfsvol.LogicalAddr]*btrfstree.Node // read-only once .injectedRoots is non-empty
+
+	dupNodesMu sync.Mutex
+	dupNodes   containers.Set[[2]btrfsvol.LogicalAddr] // must hold .dupNodesMu to access
+
+	dupKeysMu sync.Mutex
+	dupKeys   map[btrfsprim.ObjID]map[btrfsprim.Key]DupKeyConflict // nil unless enabled; must hold .dupKeysMu to access
+
+	leafToRootsHits   atomic.Int64
+	leafToRootsMisses atomic.Int64
+
+	itemsAcquires atomic.Int64
+	itemsLoads    atomic.Int64
+
+	lookupAcquires atomic.Int64
+	lookupLoads    atomic.Int64
 
 	rebuiltSharedCache
 }
@@ -135,6 +157,17 @@ func (ts *RebuiltForrest) commitTrees(ctx context.Context, treeID btrfsprim.ObjI
 func (ts *RebuiltForrest) RebuiltTree(ctx context.Context, treeID btrfsprim.ObjID) (*RebuiltTree, error) {
 	ctx = ts.treesMu.Lock(ctx)
 	defer ts.treesMu.Unlock()
+	tree, err := ts.lookupTree(ctx, treeID)
+	if err != nil {
+		return nil, err
+	}
+	tree.initRoots(ctx)
+	return tree, nil
+}
+
+// lookupTree is like .RebuiltTree(), but does not add the tree's
+// initial roots.  It must be called with .treesMu held.
+func (ts *RebuiltForrest) lookupTree(ctx context.Context, treeID btrfsprim.ObjID) (*RebuiltTree, error) {
 	ts.rebuildTree(ctx, treeID, nil)
 	tree := ts.trees[treeID]
 	if tree.ancestorLoop && tree.rootErr == nil && tree.ancestorRoot == 0 {
@@ -154,7 +187,6 @@ func (ts *RebuiltForrest) RebuiltTree(ctx context.Context, treeID btrfsprim.ObjI
 	if tree.rootErr != nil {
 		return nil, tree.rootErr
 	}
-	tree.initRoots(ctx)
 	return tree, nil
 }
 
@@ -191,6 +223,9 @@ func (ts *RebuiltForrest) rebuildTree(ctx context.Context, treeID btrfsprim.ObjI
 	case btrfsprim.ROOT_TREE_OBJECTID:
 		sb, _ := ts.Superblock()
 		ts.trees[treeID].Root = sb.RootTree
+		if ts.rootTreeRoot != 0 {
+			ts.trees[treeID].Root = ts.rootTreeRoot
+		}
 	case btrfsprim.CHUNK_TREE_OBJECTID:
 		sb, _ := ts.Superblock()
 		ts.trees[treeID].Root = sb.ChunkTree
@@ -199,7 +234,9 @@ func (ts *RebuiltForrest) rebuildTree(ctx context.Context, treeID btrfsprim.ObjI
 		ts.trees[treeID].Root = sb.LogTree
 	case btrfsprim.BLOCK_GROUP_TREE_OBJECTID:
 		sb, _ := ts.Superblock()
-		ts.trees[treeID].Root = sb.BlockGroupRoot
+		if sb.BlockGroupTree() == btrfsprim.BLOCK_GROUP_TREE_OBJECTID {
+			ts.trees[treeID].Root = sb.BlockGroupRoot
+		}
 	default:
 		rootOff, rootItem, err := ts.cb.LookupRoot(ctx, treeID)
 		if err != nil {
@@ -209,6 +246,14 @@ func (ts *RebuiltForrest) rebuildTree(ctx context.Context, treeID btrfsprim.ObjI
 		}
 		ts.trees[treeID].Root = rootItem.ByteNr
 		ts.trees[treeID].UUID = rootItem.UUID
+		if gen, ok := ts.trustedGens[treeID]; ok {
+			if rootItem.ParentUUID == (btrfsprim.UUID{}) {
+				dlog.Warnf(ctx, "trusted generation override %v is being ignored because the tree has no parent", gen)
+			} else {
+				dlog.Warnf(ctx, "OVERRIDE: trusting generation %v instead of root item offset %v", gen, rootOff)
+				rootOff = gen
+			}
+		}
 		if rootItem.ParentUUID != (btrfsprim.UUID{}) {
 			ts.trees[treeID].ParentGen = rootOff
 			parentID, err := ts.cb.LookupUUID(ctx, rootItem.ParentUUID)
@@ -247,8 +292,47 @@ func (ts *RebuiltForrest) flushNegativeCache(ctx context.Context) {
 	}
 }
 
+// invalidateGraph discards everything that the loaded trees have
+// derived from ts.graph; it must be called (with ts.treesMu held)
+// whenever ts.graph changes.
+func (ts *RebuiltForrest) invalidateGraph() {
+	for _, treeID := range maps.SortedKeys(ts.trees) {
+		tree := ts.trees[treeID]
+		tree.mu.Lock()
+		tree.incItemsSeed = nil
+		tree.incItemsSeedDups = nil
+		ts.nodeIndex.Delete(treeID)
+		tree.invalidateItems()
+		tree.mu.Unlock()
+	}
+}
+
+// warnDupNodes logs (once per pair of nodes) that two nodes tied
+// in RebuiltTree.RebuiltShouldReplace.
+func (ts *RebuiltForrest) warnDupNodes(ctx context.Context, treeID btrfsprim.ObjID, a, b btrfsvol.LogicalAddr) {
+	pair := [2]btrfsvol.LogicalAddr{a, b}
+	if b < a {
+		pair = [2]btrfsvol.LogicalAddr{b, a}
+	}
+	ts.dupNodesMu.Lock()
+	defer ts.dupNodesMu.Unlock()
+	if ts.dupNodes.Has(pair) {
+		return
+	}
+	if ts.dupNodes == nil {
+		ts.dupNodes = make(containers.Set[[2]btrfsvol.LogicalAddr])
+	}
+	ts.dupNodes.Insert(pair)
+	dlog.Warnf(ctx, "dup nodes in tree=%v with same COW distance and generation: %v=%v ; %v=%v ; preferring node@%v",
+		treeID,
+		pair[0], ts.graph.Nodes[pair[0]],
+		pair[1], ts.graph.Nodes[pair[1]],
+		pair[0])
+}
+
 // RebuiltListRoots returns a listing of all initialized trees and
-// their root nodes.
+// their root nodes.  Synthetic nodes holding injected items (see
+// .RebuiltInjectItems()) are not included.
 //
 // Do not mutate the set of roots for a tree; it is a pointer to the
 // RebuiltForrest's internal set!
@@ -257,19 +341,123 @@ func (ts *RebuiltForrest) RebuiltListRoots(ctx context.Context) map[btrfsprim.Ob
 	defer ts.treesMu.Unlock()
 	ret := make(map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr])
 	for treeID, tree := range ts.trees {
-		if len(tree.Roots) > 0 {
-			ret[treeID] = tree.Roots
+		roots := tree.Roots
+		if injected, ok := ts.injectedRoots[treeID]; ok && roots.Has(injected) {
+			roots = make(containers.Set[btrfsvol.LogicalAddr], len(tree.Roots)-1)
+			for root := range tree.Roots {
+				if root != injected {
+					roots.Insert(root)
+				}
+			}
+		}
+		if len(roots) > 0 {
+			ret[treeID] = roots
 		}
 	}
 	return ret
 }
 
+// RebuiltSetTrustedGeneration overrides the generation (normally
+// the offset of the tree's ROOT_ITEM) at which a tree is considered
+// to have been snapshotted from its parent; this affects which of the
+// parent's nodes are permitted to be in the tree.  This is an escape
+// hatch for when that generation is itself corrupt.
+//
+// It must be called before the tree is first accessed (including via
+// .RebuiltAddRoots()), and returns an error if it is not, or if the
+// generation is implausible: zero, or newer than any node in the
+// graph.
+func (ts *RebuiltForrest) RebuiltSetTrustedGeneration(ctx context.Context, treeID btrfsprim.ObjID, gen btrfsprim.Generation) error {
+	ctx = ts.treesMu.Lock(ctx)
+	defer ts.treesMu.Unlock()
+
+	if maps.HasKey(ts.trees, treeID) {
+		return fmt.Errorf("tree %s: cannot override generation: tree has already been loaded",
+			treeID.Format(btrfsprim.ROOT_TREE_OBJECTID))
+	}
+	if !gen.Known() {
+		return fmt.Errorf("tree %s: cannot override generation: generation 0 is not plausible",
+			treeID.Format(btrfsprim.ROOT_TREE_OBJECTID))
+	}
+	var maxGen btrfsprim.Generation
+	for _, node := range ts.graph.Nodes {
+		if node.Generation > maxGen {
+			maxGen = node.Generation
+		}
+	}
+	if gen > maxGen {
+		return fmt.Errorf("tree %s: cannot override generation: generation %v is not plausible: the newest node is only generation %v",
+			treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), gen, maxGen)
+	}
+
+	if ts.trustedGens == nil {
+		ts.trustedGens = make(map[btrfsprim.ObjID]btrfsprim.Generation)
+	}
+	ts.trustedGens[treeID] = gen
+	dlog.Warnf(ctx, "OVERRIDE: tree %s: trusting generation %v (expert override; nodes that would normally be rejected may be accepted)",
+		treeID.Format(btrfsprim.ROOT_TREE_OBJECTID), gen)
+	return nil
+}
+
+// RebuiltSetRootTreeRoot overrides the root node of the ROOT_TREE,
+// which is normally the superblock's root_tree; see
+// ChooseRootTreeRoot.
+//
+// It must be called before the ROOT_TREE is first accessed, and
+// returns an error if it is not, or if the graph has no node at
+// `addr` that is owned by the ROOT_TREE.
+func (ts *RebuiltForrest) RebuiltSetRootTreeRoot(ctx context.Context, addr btrfsvol.LogicalAddr) error {
+	ctx = ts.treesMu.Lock(ctx)
+	defer ts.treesMu.Unlock()
+
+	if maps.HasKey(ts.trees, btrfsprim.ROOT_TREE_OBJECTID) {
+		return fmt.Errorf("cannot override ROOT_TREE root: tree has already been loaded")
+	}
+	node, ok := ts.graph.Nodes[addr]
+	if !ok {
+		return fmt.Errorf("cannot override ROOT_TREE root: no node@%v in the graph", addr)
+	}
+	if node.Owner != btrfsprim.ROOT_TREE_OBJECTID {
+		return fmt.Errorf("cannot override ROOT_TREE root: node@%v is owned by %v, not the ROOT_TREE",
+			addr, node.Owner)
+	}
+
+	ts.rootTreeRoot = addr
+	if sb, err := ts.Superblock(); err == nil && sb.RootTree != addr {
+		dlog.Warnf(ctx, "OVERRIDE: using node@%v (generation %v) as the ROOT_TREE root instead of the superblock's node@%v",
+			addr, node.Generation, sb.RootTree)
+	}
+	return nil
+}
+
+// rebuiltAddRootsConcurrency is how many families of trees (see
+// RebuiltTreeFamilies) RebuiltAddRoots works on at once.  It is
+// clamped to RebuiltMaxConcurrency.
+var rebuiltAddRootsConcurrency = textui.NewTunable("btrfsutil.rebuilt-add-roots-concurrency", 4)
+
+// RebuiltMaxConcurrency returns the most trees that may usefully be
+// augmented (with RebuiltTree.RebuiltAddRoot) at once: the sizes of
+// the per-tree caches, as each goroutine augmenting a tree may hold
+// an entry in each of them.
+func RebuiltMaxConcurrency() int {
+	return slices.Min(
+		rebuiltNodeIndexCacheSize.Get(),
+		rebuiltItemsCacheSize.Get(),
+		rebuiltErrorsCacheSize.Get())
+}
+
 // RebuiltAddRoots takes a listing of the root nodes for trees (as
 // returned by RebuiltListRoots), and augments the trees to include
 // them.
+//
+// The ROOT_TREE and UUID_TREE are augmented first; then the other
+// trees are augmented concurrently, one goroutine per family of
+// related trees (a tree's index depends on its ancestors' roots, so
+// a family must be augmented in order, by one goroutine).  So, if the
+// RebuiltForrest has callbacks, they must be safe to call from
+// multiple goroutines at once.
 func (ts *RebuiltForrest) RebuiltAddRoots(ctx context.Context, roots map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]) {
-	ctx = ts.treesMu.Lock(ctx)
-	defer ts.treesMu.Unlock()
+	lockedCtx := ts.treesMu.Lock(ctx)
 
 	essentialTrees := []btrfsprim.ObjID{
 		btrfsprim.ROOT_TREE_OBJECTID,
@@ -281,29 +469,106 @@ func (ts *RebuiltForrest) RebuiltAddRoots(ctx context.Context, roots map[btrfspr
 		if !ok {
 			continue
 		}
-		tree, err := ts.RebuiltTree(ctx, treeID)
+		tree, err := ts.RebuiltTree(lockedCtx, treeID)
 		if err != nil {
 			dlog.Errorf(ctx, "RebuiltForrest.RebuiltAddRoots: cannot load essential tree %v: %v", treeID, err)
+			ts.treesMu.Unlock()
 			return
 		}
 		for _, root := range maps.SortedKeys(treeRoots) {
-			tree.RebuiltAddRoot(ctx, root)
+			tree.RebuiltAddRoot(lockedCtx, root)
 		}
 	}
 
+	// Looking up the trees mutates ts.trees, so do it serially
+	// before spinning up the workers.
+	trees := make(map[btrfsprim.ObjID]*RebuiltTree, len(roots))
 	for _, treeID := range maps.SortedKeys(roots) {
 		if slices.Contains(treeID, essentialTrees) {
 			continue
 		}
-		tree, err := ts.RebuiltTree(ctx, treeID)
+		tree, err := ts.lookupTree(lockedCtx, treeID)
 		if err != nil {
 			dlog.Errorf(ctx, "RebuiltForrest.RebuiltAddRoots: cannot load non-essential tree %v: %v", treeID, err)
 			continue
 		}
-		for _, root := range maps.SortedKeys(roots[treeID]) {
-			tree.RebuiltAddRoot(ctx, root)
+		trees[treeID] = tree
+	}
+	ts.treesMu.Unlock()
+
+	families := RebuiltTreeFamilies(trees)
+	queue := make(chan []*RebuiltTree, len(families))
+	for _, family := range families {
+		queue <- family
+	}
+	close(queue)
+	workers := slices.Min(
+		rebuiltAddRootsConcurrency.Get(),
+		len(families),
+		RebuiltMaxConcurrency())
+	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{})
+	for w := 0; w < workers; w++ {
+		grp.Go(fmt.Sprintf("worker-%d", w), func(ctx context.Context) error {
+			for family := range queue {
+				for _, tree := range family {
+					tree.initRoots(ctx)
+					for _, root := range maps.SortedKeys(roots[tree.ID]) {
+						tree.RebuiltAddRoot(ctx, root)
+					}
+				}
+			}
+			return nil
+		})
+	}
+	if err := grp.Wait(); err != nil {
+		dlog.Errorf(ctx, "RebuiltForrest.RebuiltAddRoots: %v", err)
+	}
+}
+
+// RebuiltTreeFamilies groups trees in to families, where a family is
+// the trees that are related by a chain of .Parent pointers.  Each
+// family is sorted by tree ID, and the families are sorted by their
+// first tree ID.
+//
+// A tree's index depends on its ancestors' roots, so the trees in a
+// family must be augmented in order, by one goroutine; but separate
+// families may be augmented concurrently.
+func RebuiltTreeFamilies(trees map[btrfsprim.ObjID]*RebuiltTree) [][]*RebuiltTree {
+	parent := make(map[btrfsprim.ObjID]btrfsprim.ObjID)
+	var find func(btrfsprim.ObjID) btrfsprim.ObjID
+	find = func(x btrfsprim.ObjID) btrfsprim.ObjID {
+		p, ok := parent[x]
+		if !ok || p == x {
+			return x
+		}
+		root := find(p)
+		parent[x] = root
+		return root
+	}
+	for _, tree := range trees {
+		seen := make(containers.Set[btrfsprim.ObjID])
+		for ancestor := tree; ancestor.Parent != nil && !seen.Has(ancestor.ID); ancestor = ancestor.Parent {
+			seen.Insert(ancestor.ID)
+			if a, b := find(ancestor.ID), find(ancestor.Parent.ID); a != b {
+				parent[a] = b
+			}
 		}
 	}
+
+	byRoot := make(map[btrfsprim.ObjID][]*RebuiltTree)
+	var rootOrder []btrfsprim.ObjID
+	for _, treeID := range maps.SortedKeys(trees) {
+		root := find(treeID)
+		if !maps.HasKey(byRoot, root) {
+			rootOrder = append(rootOrder, root)
+		}
+		byRoot[root] = append(byRoot[root], trees[treeID])
+	}
+	ret := make([][]*RebuiltTree, 0, len(rootOrder))
+	for _, root := range rootOrder {
+		ret = append(ret, byRoot[root])
+	}
+	return ret
 }
 
 // btrfs.ReadableFS interface //////////////////////////////////////////////////////////////////////////////////////////
@@ -330,11 +595,19 @@ func (ts *RebuiltForrest) Superblock() (*btrfstree.Superblock, error) {
 
 // AcquireNode implements btrfstree.NodeSource (and btrfs.ReadableFS).
 func (ts *RebuiltForrest) AcquireNode(ctx context.Context, addr btrfsvol.LogicalAddr, exp btrfstree.NodeExpectations) (*btrfstree.Node, error) {
+	if IsInjectedNode(addr) {
+		if node, ok := ts.injectedNodes[addr]; ok {
+			return node, nil
+		}
+	}
 	return ts.inner.AcquireNode(ctx, addr, exp)
 }
 
 // ReleaseNode implements btrfstree.NodeSource (and btrfs.ReadableFS).
 func (ts *RebuiltForrest) ReleaseNode(node *btrfstree.Node) {
+	if node != nil && IsInjectedNode(node.Head.Addr) {
+		return
+	}
 	ts.inner.ReleaseNode(node)
 }
 
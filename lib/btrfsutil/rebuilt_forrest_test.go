@@ -6,6 +6,8 @@ package btrfsutil
 
 import (
 	"context"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/datawire/dlib/dlog"
@@ -15,6 +17,8 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
 )
 
 type rebuiltForrestCallbacks struct {
@@ -25,11 +29,15 @@ type rebuiltForrestCallbacks struct {
 }
 
 func (cbs rebuiltForrestCallbacks) AddedItem(ctx context.Context, tree btrfsprim.ObjID, key btrfsprim.Key) {
-	cbs.addedItem(ctx, tree, key)
+	if cbs.addedItem != nil {
+		cbs.addedItem(ctx, tree, key)
+	}
 }
 
 func (cbs rebuiltForrestCallbacks) AddedRoot(ctx context.Context, tree btrfsprim.ObjID, root btrfsvol.LogicalAddr) {
-	cbs.addedRoot(ctx, tree, root)
+	if cbs.addedRoot != nil {
+		cbs.addedRoot(ctx, tree, root)
+	}
 }
 
 func (cbs rebuiltForrestCallbacks) LookupRoot(ctx context.Context, tree btrfsprim.ObjID) (offset btrfsprim.Generation, item btrfsitem.Root, err error) {
@@ -40,6 +48,43 @@ func (cbs rebuiltForrestCallbacks) LookupUUID(ctx context.Context, uuid btrfspri
 	return cbs.lookupUUID(ctx, uuid)
 }
 
+// mockTreeRoot is a ROOT_ITEM for mockCallbacks.
+type mockTreeRoot struct {
+	ID         btrfsprim.ObjID
+	UUID       btrfsprim.UUID
+	ParentUUID btrfsprim.UUID
+	ParentGen  btrfsprim.Generation
+}
+
+// mockCallbacks returns callbacks for a forrest that has ROOT_ITEMs
+// (all with generation 2000) for each of `roots`, and no other items.
+// The addedItem and addedRoot callbacks are left nil (do nothing), and
+// may be set by the caller.
+func mockCallbacks(roots ...mockTreeRoot) rebuiltForrestCallbacks {
+	return rebuiltForrestCallbacks{
+		lookupRoot: func(_ context.Context, tree btrfsprim.ObjID) (offset btrfsprim.Generation, item btrfsitem.Root, err error) {
+			for _, root := range roots {
+				if root.ID == tree {
+					return root.ParentGen, btrfsitem.Root{
+						Generation: 2000,
+						UUID:       root.UUID,
+						ParentUUID: root.ParentUUID,
+					}, nil
+				}
+			}
+			return 0, btrfsitem.Root{}, btrfstree.ErrNoItem
+		},
+		lookupUUID: func(_ context.Context, uuid btrfsprim.UUID) (id btrfsprim.ObjID, err error) {
+			for _, root := range roots {
+				if root.UUID == uuid {
+					return root.ID, nil
+				}
+			}
+			return 0, btrfstree.ErrNoItem
+		},
+	}
+}
+
 func TestRebuiltTreeCycles(t *testing.T) {
 	t.Parallel()
 
@@ -238,3 +283,494 @@ func TestRebuiltTreeParentErr(t *testing.T) {
 		assert.NotNil(t, tree)
 	})
 }
+
+func TestRebuiltTreeTrustedGeneration(t *testing.T) {
+	t.Parallel()
+
+	ctx := dlog.NewTestContext(t, true)
+
+	cbs := mockCallbacks(
+		mockTreeRoot{
+			ID:         305,
+			UUID:       btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005"),
+			ParentUUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000004"),
+			ParentGen:  1004,
+		},
+		mockTreeRoot{
+			ID:   304,
+			UUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000004"),
+		},
+	)
+	graph := Graph{
+		Nodes: map[btrfsvol.LogicalAddr]GraphNode{
+			0x1000: {Owner: 304, Generation: 1500},
+			0x2000: {Owner: 305, Generation: 2000},
+		},
+	}
+
+	rfs := NewRebuiltForrest(nil, graph, cbs, false)
+	assert.EqualError(t, rfs.RebuiltSetTrustedGeneration(ctx, 305, 0),
+		`tree 305: cannot override generation: generation 0 is not plausible`)
+	assert.EqualError(t, rfs.RebuiltSetTrustedGeneration(ctx, 305, 9999),
+		`tree 305: cannot override generation: generation 9999 is not plausible: the newest node is only generation 2000`)
+	assert.NoError(t, rfs.RebuiltSetTrustedGeneration(ctx, 305, 1500))
+
+	tree, err := rfs.RebuiltTree(ctx, 305)
+	assert.NoError(t, err)
+	assert.Equal(t, btrfsprim.Generation(1500), tree.ParentGen)
+	assert.True(t, tree.isOwnerOK(304, 1500))
+	assert.False(t, tree.isOwnerOK(304, 1501))
+
+	assert.EqualError(t, rfs.RebuiltSetTrustedGeneration(ctx, 305, 1600),
+		`tree 305: cannot override generation: tree has already been loaded`)
+}
+
+func TestRebuiltTreeIsOwnerOKBoundaries(t *testing.T) {
+	t.Parallel()
+
+	parent := &RebuiltTree{ID: 304}
+	tree := &RebuiltTree{ID: 305, Parent: parent, ParentGen: btrfsprim.MaxGeneration}
+	assert.True(t, tree.isOwnerOK(305, 0))
+	assert.True(t, tree.isOwnerOK(304, 1))
+	assert.True(t, tree.isOwnerOK(304, btrfsprim.MaxGeneration))
+	// A node with an unknown generation can't be shown to
+	// predate the snapshot.
+	assert.False(t, tree.isOwnerOK(304, 0))
+
+	// With an unknown snapshot generation, nothing can be shown
+	// to predate it.
+	tree = &RebuiltTree{ID: 305, Parent: parent, ParentGen: 0}
+	assert.True(t, tree.isOwnerOK(305, 1))
+	assert.False(t, tree.isOwnerOK(304, 0))
+	assert.False(t, tree.isOwnerOK(304, 1))
+}
+
+func TestRebuiltTreeShouldReplaceTie(t *testing.T) {
+	t.Parallel()
+
+	ctx := dlog.NewTestContext(t, true)
+
+	cbs := mockCallbacks(mockTreeRoot{
+		ID:   305,
+		UUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005"),
+	})
+	graph := Graph{
+		Nodes: map[btrfsvol.LogicalAddr]GraphNode{
+			0x1000: {Owner: 305, Generation: 1500},
+			0x2000: {Owner: 305, Generation: 1500},
+			0x3000: {Owner: 305, Generation: 1600},
+		},
+	}
+
+	rfs := NewRebuiltForrest(nil, graph, cbs, false)
+	tree, err := rfs.RebuiltTree(ctx, 305)
+	assert.NoError(t, err)
+
+	// Tie; lower address wins, regardless of order.
+	assert.NotPanics(t, func() {
+		assert.False(t, tree.RebuiltShouldReplace(ctx, 0x1000, 0x2000))
+		assert.True(t, tree.RebuiltShouldReplace(ctx, 0x2000, 0x1000))
+		assert.False(t, tree.RebuiltShouldReplace(ctx, 0x1000, 0x1000))
+	})
+	// Generation still takes priority over address.
+	assert.True(t, tree.RebuiltShouldReplace(ctx, 0x1000, 0x3000))
+	assert.False(t, tree.RebuiltShouldReplace(ctx, 0x3000, 0x1000))
+}
+
+func TestRebuiltLeafToRootsShared(t *testing.T) {
+	t.Parallel()
+
+	ctx := dlog.NewTestContext(t, true)
+
+	cbs := mockCallbacks(
+		mockTreeRoot{
+			ID:   305,
+			UUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005"),
+		},
+		// Two snapshots of 305.
+		mockTreeRoot{
+			ID:         306,
+			UUID:       btrfsprim.UUID{15: 0x32},
+			ParentUUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005"),
+			ParentGen:  1500,
+		},
+		mockTreeRoot{
+			ID:         307,
+			UUID:       btrfsprim.UUID{15: 0x33},
+			ParentUUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005"),
+			ParentGen:  1500,
+		},
+	)
+	leafKey := btrfsprim.Key{ObjectID: 256, ItemType: btrfsitem.INODE_ITEM_KEY}
+	edge := &GraphEdge{
+		FromNode:     0x2000,
+		FromTree:     305,
+		ToNode:       0x1000,
+		ToLevel:      0,
+		ToKey:        leafKey,
+		ToGeneration: 1000,
+	}
+	graph := Graph{
+		Nodes: map[btrfsvol.LogicalAddr]GraphNode{
+			0x1000: {Addr: 0x1000, Level: 0, Owner: 305, Generation: 1000, Items: []KeyAndSize{{Key: leafKey}}},
+			0x2000: {Addr: 0x2000, Level: 1, Owner: 305, Generation: 1000},
+		},
+		EdgesFrom: map[btrfsvol.LogicalAddr][]*GraphEdge{0x2000: {edge}},
+		EdgesTo:   map[btrfsvol.LogicalAddr][]*GraphEdge{0x1000: {edge}},
+	}
+
+	rfs := NewRebuiltForrest(nil, graph, cbs, false)
+	for _, treeID := range []btrfsprim.ObjID{306, 307, 306} {
+		tree, err := rfs.RebuiltTree(ctx, treeID)
+		assert.NoError(t, err)
+		assert.Equal(t, []btrfsvol.LogicalAddr{0x2000}, maps.SortedKeys(tree.RebuiltLeafToRoots(ctx, 0x1000)))
+	}
+	hits, misses := rfs.RebuiltLeafToRootsStats()
+	assert.Equal(t, int64(2), hits)
+	assert.Equal(t, int64(1), misses)
+}
+
+func TestRebuiltItemsCacheStats(t *testing.T) {
+	t.Parallel()
+
+	ctx := dlog.NewTestContext(t, true)
+
+	cbs := mockCallbacks(mockTreeRoot{
+		ID:   305,
+		UUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005"),
+	})
+	rfs := NewRebuiltForrest(nil, Graph{}, cbs, false)
+	tree, err := rfs.RebuiltTree(ctx, 305)
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		tree.RebuiltAcquireItems(ctx)
+		tree.RebuiltReleaseItems()
+	}
+	tree.RebuiltAcquirePotentialItems(ctx)
+	tree.RebuiltReleasePotentialItems()
+
+	hits, misses := rfs.RebuiltItemsCacheStats()
+	assert.Equal(t, int64(2), hits)
+	assert.Equal(t, int64(2), misses)
+}
+
+// TestRebuiltItemsCacheStatsConcurrent checks that concurrent
+// acquisitions that all wait on the same load count as exactly 1
+// miss.
+func TestRebuiltItemsCacheStatsConcurrent(t *testing.T) {
+	t.Parallel()
+
+	ctx := dlog.NewTestContext(t, true)
+
+	cbs := mockCallbacks(mockTreeRoot{
+		ID:   305,
+		UUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005"),
+	})
+	rfs := NewRebuiltForrest(nil, Graph{}, cbs, false)
+	tree, err := rfs.RebuiltTree(ctx, 305)
+	assert.NoError(t, err)
+
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tree.RebuiltAcquireItems(ctx)
+			tree.RebuiltReleaseItems()
+		}()
+	}
+	wg.Wait()
+
+	hits, misses := rfs.RebuiltItemsCacheStats()
+	assert.Equal(t, int64(n-1), hits)
+	assert.Equal(t, int64(1), misses)
+}
+
+func TestRebuiltInjectItems(t *testing.T) {
+	t.Parallel()
+
+	ctx := dlog.NewTestContext(t, true)
+
+	cbs := mockCallbacks(mockTreeRoot{
+		ID:   305,
+		UUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005"),
+	})
+	graph := Graph{
+		Nodes: map[btrfsvol.LogicalAddr]GraphNode{
+			0x1000: {Owner: 305, Generation: 2000},
+		},
+		EdgesFrom: make(map[btrfsvol.LogicalAddr][]*GraphEdge),
+		EdgesTo:   make(map[btrfsvol.LogicalAddr][]*GraphEdge),
+	}
+	key := btrfsprim.Key{ObjectID: 256, ItemType: btrfsitem.INODE_ITEM_KEY}
+	inode := strings.Repeat("00", 0xa0)
+
+	rfs := NewRebuiltForrest(nil, graph, cbs, false)
+
+	// Size contradicts the item type.
+	assert.Error(t, rfs.RebuiltInjectItems(ctx, []InjectedItem{
+		{Tree: 305, Key: key, Body: inode + "00"},
+	}))
+	assert.Error(t, rfs.RebuiltInjectItems(ctx, []InjectedItem{
+		{Tree: 305, Key: key, Body: inode[2:]},
+	}))
+	// Duplicate keys.
+	assert.EqualError(t, rfs.RebuiltInjectItems(ctx, []InjectedItem{
+		{Tree: 305, Key: key, Body: inode},
+		{Tree: 305, Key: key, Body: inode},
+	}), `tree 305: cannot inject items: duplicate key (256 INODE_ITEM 0)`)
+
+	assert.NoError(t, rfs.RebuiltInjectItems(ctx, []InjectedItem{
+		{Tree: 305, Key: key, Body: inode},
+	}))
+
+	tree, err := rfs.RebuiltTree(ctx, 305)
+	assert.NoError(t, err)
+	item, err := tree.TreeLookup(ctx, key)
+	assert.NoError(t, err)
+	assert.IsType(t, &btrfsitem.Inode{}, item.Body)
+	assert.Empty(t, rfs.RebuiltListRoots(ctx))
+
+	assert.EqualError(t, rfs.RebuiltInjectItems(ctx, []InjectedItem{
+		{Tree: 305, Key: btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.INODE_ITEM_KEY}, Body: inode},
+	}), `tree 305: cannot inject items: tree has already been loaded`)
+}
+
+func TestRebuiltTreeFamilies(t *testing.T) {
+	t.Parallel()
+	base := &RebuiltTree{ID: 305}
+	snapA := &RebuiltTree{ID: 306, Parent: base}
+	snapB := &RebuiltTree{ID: 307, Parent: snapA}
+	other := &RebuiltTree{ID: 310}
+	loopA := &RebuiltTree{ID: 320}
+	loopB := &RebuiltTree{ID: 321, Parent: loopA}
+	loopA.Parent = loopB
+
+	families := RebuiltTreeFamilies(map[btrfsprim.ObjID]*RebuiltTree{
+		// `base` is deliberately left out; 306 and 307
+		// must still be grouped together through it.
+		306: snapA,
+		307: snapB,
+		310: other,
+		320: loopA,
+		321: loopB,
+	})
+	var ids [][]btrfsprim.ObjID
+	for _, family := range families {
+		var familyIDs []btrfsprim.ObjID
+		for _, tree := range family {
+			familyIDs = append(familyIDs, tree.ID)
+		}
+		ids = append(ids, familyIDs)
+	}
+	assert.Equal(t, [][]btrfsprim.ObjID{{306, 307}, {310}, {320, 321}}, ids)
+}
+
+func TestRebuiltAddRoots(t *testing.T) {
+	t.Parallel()
+
+	ctx := dlog.NewTestContext(t, true)
+
+	baseUUID := btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005")
+	var addedItemsMu sync.Mutex
+	addedItems := make(map[btrfsprim.ObjID]int)
+	cbs := mockCallbacks(
+		mockTreeRoot{ID: 305, UUID: baseUUID},
+		mockTreeRoot{ID: 306, UUID: btrfsprim.UUID{15: 0x32}, ParentUUID: baseUUID, ParentGen: 1500},
+		mockTreeRoot{ID: 310, UUID: btrfsprim.UUID{15: 0x36}},
+		mockTreeRoot{ID: 311, UUID: btrfsprim.UUID{15: 0x37}},
+		mockTreeRoot{ID: 312, UUID: btrfsprim.UUID{15: 0x38}},
+	)
+	cbs.addedItem = func(ctx context.Context, tree btrfsprim.ObjID, key btrfsprim.Key) {
+		addedItemsMu.Lock()
+		addedItems[tree]++
+		addedItemsMu.Unlock()
+	}
+
+	// One leaf per tree, each with a single item.
+	graph := Graph{
+		Nodes:     make(map[btrfsvol.LogicalAddr]GraphNode),
+		EdgesFrom: make(map[btrfsvol.LogicalAddr][]*GraphEdge),
+		EdgesTo:   make(map[btrfsvol.LogicalAddr][]*GraphEdge),
+	}
+	roots := make(map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr])
+	for i, treeID := range []btrfsprim.ObjID{305, 306, 310, 311, 312} {
+		addr := btrfsvol.LogicalAddr(0x1000 * (i + 1))
+		graph.Nodes[addr] = GraphNode{
+			Addr:       addr,
+			Level:      0,
+			Owner:      treeID,
+			Generation: 1000,
+			Items:      []KeyAndSize{{Key: btrfsprim.Key{ObjectID: 256, ItemType: btrfsitem.INODE_ITEM_KEY}}},
+		}
+		roots[treeID] = containers.NewSet(addr)
+	}
+	// 306 also gets its parent's leaf.
+	roots[306].Insert(0x1000)
+
+	rfs := NewRebuiltForrest(nil, graph, cbs, false)
+	rfs.RebuiltAddRoots(ctx, roots)
+
+	assert.Equal(t, roots, rfs.RebuiltListRoots(ctx))
+	assert.Equal(t, map[btrfsprim.ObjID]int{305: 1, 306: 2, 310: 1, 311: 1, 312: 1}, addedItems)
+	for treeID := range roots {
+		tree, err := rfs.RebuiltTree(ctx, treeID)
+		assert.NoError(t, err)
+		items := tree.RebuiltAcquireItems(ctx)
+		assert.Equal(t, 1, items.Len(), "tree %v", treeID)
+		tree.RebuiltReleaseItems()
+	}
+}
+
+func TestRebuiltDupKeyReport(t *testing.T) {
+	t.Parallel()
+
+	ctx := dlog.NewTestContext(t, false)
+
+	cbs := mockCallbacks(mockTreeRoot{
+		ID:   305,
+		UUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005"),
+	})
+	keyA := btrfsprim.Key{ObjectID: 256, ItemType: btrfsitem.INODE_ITEM_KEY}
+	keyB := btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.INODE_ITEM_KEY}
+	graph := Graph{
+		Nodes: map[btrfsvol.LogicalAddr]GraphNode{
+			0x1000: {Addr: 0x1000, Level: 0, Owner: 305, Generation: 1500, Items: []KeyAndSize{{Key: keyA}, {Key: keyB}}},
+			// Newer version of keyA: reported.
+			0x2000: {Addr: 0x2000, Level: 0, Owner: 305, Generation: 1600, Items: []KeyAndSize{{Key: keyA}}},
+			// Same-generation copy of keyB: not reported.
+			0x3000: {Addr: 0x3000, Level: 0, Owner: 305, Generation: 1500, Items: []KeyAndSize{{Key: keyB}}},
+		},
+	}
+	exp := map[btrfsprim.ObjID]map[btrfsprim.Key]DupKeyConflict{
+		305: {
+			keyA: {
+				Tree: 305,
+				Key:  keyA,
+				Candidates: []DupKeyCandidate{
+					{Ptr: ItemPtr{Node: 0x1000, Slot: 0}, Owner: 305, Generation: 1500},
+					{Ptr: ItemPtr{Node: 0x2000, Slot: 0}, Owner: 305, Generation: 1600},
+				},
+				Selected: ItemPtr{Node: 0x2000, Slot: 0},
+			},
+		},
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		rfs := NewRebuiltForrest(nil, graph, cbs, false)
+		rfs.RebuiltAddRoots(ctx, map[btrfsprim.ObjID]containers.Set[btrfsvol.LogicalAddr]{
+			305: containers.NewSet[btrfsvol.LogicalAddr](0x1000, 0x2000, 0x3000),
+		})
+		assert.Nil(t, rfs.RebuiltDupKeyReport())
+	})
+	t.Run("full", func(t *testing.T) {
+		t.Parallel()
+		rfs := NewRebuiltForrest(nil, graph, cbs, false)
+		rfs.RebuiltEnableDupKeyReport()
+		tree, err := rfs.RebuiltTree(ctx, 305)
+		assert.NoError(t, err)
+		for _, root := range []btrfsvol.LogicalAddr{0x1000, 0x2000, 0x3000} {
+			tree.RebuiltAddRoot(ctx, root)
+		}
+		tree.RebuiltAcquireItems(ctx)
+		tree.RebuiltReleaseItems()
+		assert.Equal(t, exp, rfs.RebuiltDupKeyReport())
+	})
+	t.Run("incremental", func(t *testing.T) {
+		t.Parallel()
+		rfs := NewRebuiltForrest(nil, graph, cbs, false)
+		rfs.RebuiltEnableDupKeyReport()
+		tree, err := rfs.RebuiltTree(ctx, 305)
+		assert.NoError(t, err)
+		for _, root := range []btrfsvol.LogicalAddr{0x1000, 0x2000, 0x3000} {
+			tree.RebuiltAddRoot(ctx, root)
+			tree.RebuiltAcquireItems(ctx)
+			tree.RebuiltReleaseItems()
+		}
+		assert.Equal(t, exp, rfs.RebuiltDupKeyReport())
+	})
+	t.Run("discarded-seed", func(t *testing.T) {
+		t.Parallel()
+		rfs := NewRebuiltForrest(nil, graph, cbs, false)
+		rfs.RebuiltEnableDupKeyReport()
+		tree, err := rfs.RebuiltTree(ctx, 305)
+		assert.NoError(t, err)
+		tree.RebuiltAddRoot(ctx, 0x1000)
+		tree.RebuiltAcquireItems(ctx)
+		tree.RebuiltReleaseItems()
+		// This seeds an incremental update of the items...
+		tree.RebuiltAddRoot(ctx, 0x2000)
+		// ... that this throws away before it is used.  Nothing
+		// from the seed may have been recorded.
+		tree.RebuiltAddRoot(ctx, 0x3000)
+		assert.Empty(t, rfs.RebuiltDupKeyReport())
+		tree.RebuiltAcquireItems(ctx)
+		tree.RebuiltReleaseItems()
+		assert.Equal(t, exp, rfs.RebuiltDupKeyReport())
+	})
+}
+
+func TestRebuiltLookupCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := dlog.NewTestContext(t, true)
+
+	cbs := mockCallbacks(mockTreeRoot{
+		ID:   305,
+		UUID: btrfsprim.MustParseUUID("00000000-0000-0000-0000-000000000005"),
+	})
+	graph := Graph{
+		Nodes: map[btrfsvol.LogicalAddr]GraphNode{
+			0x1000: {
+				Addr:       0x1000,
+				Level:      0,
+				Owner:      305,
+				Generation: 2000,
+				Items:      []KeyAndSize{{Key: btrfsprim.Key{ObjectID: 257, ItemType: btrfsitem.INODE_ITEM_KEY}}},
+			},
+		},
+		EdgesFrom: make(map[btrfsvol.LogicalAddr][]*GraphEdge),
+		EdgesTo:   make(map[btrfsvol.LogicalAddr][]*GraphEdge),
+	}
+	key := btrfsprim.Key{ObjectID: 256, ItemType: btrfsitem.INODE_ITEM_KEY}
+	missing := btrfsprim.Key{ObjectID: 258, ItemType: btrfsitem.INODE_ITEM_KEY}
+
+	rfs := NewRebuiltForrest(nil, graph, cbs, false)
+	assert.NoError(t, rfs.RebuiltInjectItems(ctx, []InjectedItem{
+		{Tree: 305, Key: key, Body: strings.Repeat("00", 0xa0)},
+	}))
+	tree, err := rfs.RebuiltTree(ctx, 305)
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		item, err := tree.TreeLookup(ctx, key)
+		assert.NoError(t, err)
+		assert.IsType(t, &btrfsitem.Inode{}, item.Body)
+		_, err = tree.TreeLookup(ctx, missing)
+		assert.ErrorIs(t, err, btrfstree.ErrNoItem)
+	}
+	hits, misses := rfs.RebuiltLookupCacheStats()
+	assert.Equal(t, int64(4), hits)
+	assert.Equal(t, int64(2), misses)
+
+	// Adding a root must invalidate the cache.
+	tree.RebuiltAddRoot(ctx, 0x1000)
+	_, err = tree.TreeLookup(ctx, key)
+	assert.NoError(t, err)
+	hits, misses = rfs.RebuiltLookupCacheStats()
+	assert.Equal(t, int64(4), hits)
+	assert.Equal(t, int64(3), misses)
+
+	// So must changing the graph, even for a different tree.
+	assert.NoError(t, rfs.RebuiltInjectItems(ctx, []InjectedItem{
+		{Tree: 306, Key: key, Body: strings.Repeat("00", 0xa0)},
+	}))
+	_, err = tree.TreeLookup(ctx, key)
+	assert.NoError(t, err)
+	hits, misses = rfs.RebuiltLookupCacheStats()
+	assert.Equal(t, int64(4), hits)
+	assert.Equal(t, int64(4), misses)
+}
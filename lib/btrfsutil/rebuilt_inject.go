@@ -0,0 +1,154 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// An InjectedItem is a hand-crafted item that is not present anywhere
+// on disk, but that a RebuiltForrest should treat as if it were.
+type InjectedItem struct {
+	Tree btrfsprim.ObjID
+	Key  btrfsprim.Key
+	// Body is the hex-encoded on-disk representation of the item
+	// body.
+	Body string
+}
+
+// Decode decodes and validates the item's body, returning an error
+// if the body is not valid hex, does not decode as the item type
+// given by the key, or is not exactly the size that the item type
+// calls for.
+func (item InjectedItem) Decode(csumType btrfssum.CSumType) (btrfstree.Item, error) {
+	dat, err := hex.DecodeString(item.Body)
+	if err != nil {
+		return btrfstree.Item{}, fmt.Errorf("tree %v: key %v: body: %w", item.Tree, item.Key, err)
+	}
+	body := btrfsitem.UnmarshalItem(item.Key, csumType, dat)
+	if errBody, isErr := body.(*btrfsitem.Error); isErr {
+		err := errBody.Err
+		body.Free()
+		return btrfstree.Item{}, fmt.Errorf("tree %v: key %v: body: %w", item.Tree, item.Key, err)
+	}
+	return btrfstree.Item{
+		Key:      item.Key,
+		BodySize: uint32(len(dat)),
+		Body:     body,
+	}, nil
+}
+
+// IsInjectedNode returns whether a node address refers to a synthetic
+// node holding items injected with RebuiltForrest.RebuiltInjectItems,
+// rather than to a real node on disk.
+func IsInjectedNode(addr btrfsvol.LogicalAddr) bool {
+	return addr < 0
+}
+
+// RebuiltInjectItems adds hand-crafted items to the forrest.  This is
+// an expert escape hatch for when an item that is needed for the
+// rebuild to proceed (such as a ROOT_ITEM) cannot be found anywhere on
+// disk.
+//
+// The items for each tree are placed in a synthetic leaf node (with a
+// negative address; see IsInjectedNode) that is automatically added
+// as a root of that tree, and that has a generation newer than any
+// real node, so that the injected items take priority over any
+// on-disk items with the same key.
+//
+// It must be called before any of the affected trees are first
+// accessed, and returns an error if it is not, or if any of the items
+// are invalid (see InjectedItem.Decode) or duplicated.
+func (ts *RebuiltForrest) RebuiltInjectItems(ctx context.Context, items []InjectedItem) error {
+	ctx = ts.treesMu.Lock(ctx)
+	defer ts.treesMu.Unlock()
+
+	var csumType btrfssum.CSumType
+	var nodeSize uint32
+	if ts.inner != nil {
+		sb, err := ts.inner.Superblock()
+		if err != nil {
+			return err
+		}
+		csumType = sb.ChecksumType
+		nodeSize = sb.NodeSize
+	}
+
+	byTree := make(map[btrfsprim.ObjID][]btrfstree.Item)
+	for _, item := range items {
+		if _, loaded := ts.trees[item.Tree]; loaded {
+			return fmt.Errorf("tree %v: cannot inject items: tree has already been loaded", item.Tree)
+		}
+		if _, injected := ts.injectedRoots[item.Tree]; injected {
+			return fmt.Errorf("tree %v: cannot inject items: tree already has injected items", item.Tree)
+		}
+		leafItem, err := item.Decode(csumType)
+		if err != nil {
+			return err
+		}
+		byTree[item.Tree] = append(byTree[item.Tree], leafItem)
+	}
+
+	for treeID, leafItems := range byTree {
+		sort.Slice(leafItems, func(i, j int) bool {
+			return leafItems[i].Key.Compare(leafItems[j].Key) < 0
+		})
+		for i := 1; i < len(leafItems); i++ {
+			if leafItems[i].Key == leafItems[i-1].Key {
+				return fmt.Errorf("tree %v: cannot inject items: duplicate key %v", treeID, leafItems[i].Key)
+			}
+		}
+	}
+
+	var maxGen btrfsprim.Generation
+	for _, node := range ts.graph.Nodes {
+		if node.Generation > maxGen {
+			maxGen = node.Generation
+		}
+	}
+
+	if ts.injectedNodes == nil {
+		ts.injectedNodes = make(map[btrfsvol.LogicalAddr]*btrfstree.Node)
+		ts.injectedRoots = make(map[btrfsprim.ObjID]btrfsvol.LogicalAddr)
+	}
+	for _, treeID := range maps.SortedKeys(byTree) {
+		leafItems := byTree[treeID]
+
+		addr := -btrfsvol.LogicalAddr(len(ts.injectedNodes) + 1)
+		node := &btrfstree.Node{
+			Size:         nodeSize,
+			ChecksumType: csumType,
+			Head: btrfstree.NodeHeader{
+				Addr:       addr,
+				Generation: maxGen.AddClamped(1),
+				Owner:      treeID,
+				NumItems:   uint32(len(leafItems)),
+				Level:      0,
+			},
+			BodyLeaf: leafItems,
+		}
+		ts.injectedNodes[addr] = node
+		ts.injectedRoots[treeID] = addr
+		ts.graph.InsertNode(node)
+		dlog.Warnf(ctx, "INJECTED: tree %v: %d hand-crafted items in synthetic node@%v",
+			treeID, len(leafItems), addr)
+	}
+	// The injected trees themselves haven't been loaded yet, but
+	// other trees may have been.
+	ts.invalidateGraph()
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// rebuiltLookupCacheSize is how many decoded items each RebuiltTree
+// keeps around for .TreeLookup(); the rebuild (and `inspect mount`)
+// look up the same few ROOT_ITEMs and INODE_ITEMs over and over.
+var rebuiltLookupCacheSize = textui.NewTunable("btrfsutil.rebuilt-lookup-cache-size", 32)
+
+type rebuiltLookupEntry struct {
+	item btrfstree.Item
+	err  error
+}
+
+// acquireLookupCache returns the tree's .TreeLookup() cache, creating
+// it if need be; it is created lazily because most trees are never
+// looked up in.
+func (tree *RebuiltTree) acquireLookupCache() containers.Cache[btrfsprim.Key, rebuiltLookupEntry] {
+	tree.lookupCacheOnce.Do(func() {
+		tree.lookupCache = containers.NewLRUCache[btrfsprim.Key, rebuiltLookupEntry](
+			rebuiltLookupCacheSize.Get(),
+			containers.SourceFunc[btrfsprim.Key, rebuiltLookupEntry](
+				func(ctx context.Context, key btrfsprim.Key, entry *rebuiltLookupEntry) {
+					tree.forrest.lookupLoads.Add(1)
+					// The entry is being re-used; we only
+					// ever hand out clones of the body, so
+					// it's safe to free the old one.
+					if entry.item.Body != nil {
+						entry.item.Body.Free()
+					}
+					entry.item, entry.err = tree.search(ctx, btrfstree.SearchExactKey(key))
+				}))
+	})
+	return tree.lookupCache
+}
+
+// invalidateLookupCache empties the tree's .TreeLookup() cache; it
+// must be called (with tree.mu held for writing) whenever the items in
+// the tree may have changed.  Use .invalidateItems() rather than
+// calling this directly.
+func (tree *RebuiltTree) invalidateLookupCache() {
+	if tree.lookupCache == nil {
+		return
+	}
+	for _, key := range tree.lookupCache.Keys() {
+		tree.lookupCache.Delete(key)
+	}
+}
+
+// RebuiltLookupCacheStats returns how many calls to
+// RebuiltTree.TreeLookup (across all trees) were answered from the
+// cache, and how many had to search the tree and decode the item.
+func (ts *RebuiltForrest) RebuiltLookupCacheStats() (hits, misses int64) {
+	misses = ts.lookupLoads.Load()
+	return ts.lookupAcquires.Load() - misses, misses
+}
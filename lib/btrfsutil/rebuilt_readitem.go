@@ -35,14 +35,21 @@ func (ts *RebuiltForrest) readItem(ctx context.Context, ptr ItemPtr) btrfstree.I
 		panic(fmt.Errorf("should not happen: btrfsutil.RebuiltForrest.readItem called for negative item slot: %v", ptr.Slot))
 	}
 
+	// The node itself still claims its original owner if it was
+	// reattributed by Graph.ReattributeRelocNodes.
+	expOwner := graphInfo.Owner
+	if ts.graph.RelocNodes.Has(ptr.Node) {
+		expOwner = btrfsprim.TREE_RELOC_OBJECTID
+	}
+
 	node, err := ts.AcquireNode(ctx, ptr.Node, btrfstree.NodeExpectations{
 		LAddr:      containers.OptionalValue(ptr.Node),
 		Level:      containers.OptionalValue(graphInfo.Level),
 		Generation: containers.OptionalValue(graphInfo.Generation),
 		Owner: func(treeID btrfsprim.ObjID, gen btrfsprim.Generation) error {
-			if treeID != graphInfo.Owner || gen != graphInfo.Generation {
+			if treeID != expOwner || gen != graphInfo.Generation {
 				return fmt.Errorf("expected owner=%v generation=%v but claims to have owner=%v generation=%v",
-					graphInfo.Owner, graphInfo.Generation,
+					expOwner, graphInfo.Generation,
 					treeID, gen)
 			}
 			return nil
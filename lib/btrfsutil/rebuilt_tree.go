@@ -7,8 +7,8 @@ package btrfsutil
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
-	"time"
 
 	"github.com/datawire/dlib/derror"
 	"github.com/datawire/dlib/dlog"
@@ -46,6 +46,25 @@ type RebuiltTree struct {
 
 	Roots containers.Set[btrfsvol.LogicalAddr]
 
+	// incItemsSeed, if non-nil, is an already-computed value for
+	// the next load of tree.RebuiltAcquireItems(); it is set by
+	// .RebuiltAddRoot() so that adding a root can update the
+	// index incrementally rather than re-generating it from
+	// scratch.
+	incItemsSeed *containers.SortedMap[btrfsprim.Key, ItemPtr]
+	// incItemsSeedDups is the duplicate keys that were resolved
+	// in building incItemsSeed; they are only recorded (see
+	// .RebuiltEnableDupKeyReport()) once the seed is used, as it
+	// may be discarded.
+	incItemsSeedDups []rebuiltDupKey
+
+	// lookupCache is the decoded items for .TreeLookup(); see
+	// .acquireLookupCache().  It is emptied (by
+	// .invalidateItems()) whenever the items in the tree may have
+	// changed.
+	lookupCacheOnce sync.Once
+	lookupCache     containers.Cache[btrfsprim.Key, rebuiltLookupEntry]
+
 	// There are 4 more mutable "members" that are protected by
 	// `mu`; but they live in a shared Cache.  They are all
 	// derived from tree.Roots, which is why it's OK if they get
@@ -62,42 +81,88 @@ type rebuiltSharedCache struct {
 	incItems  containers.Cache[btrfsprim.ObjID, containers.SortedMap[btrfsprim.Key, ItemPtr]]
 	excItems  containers.Cache[btrfsprim.ObjID, containers.SortedMap[btrfsprim.Key, ItemPtr]]
 	errors    containers.Cache[btrfsprim.ObjID, containers.IntervalTree[btrfsprim.Key, rebuiltTreeError]]
+
+	// leafToRoots is shared across all trees, rather than being
+	// per-tree; see rebuiltLeafRoots.
+	leafToRoots containers.Cache[btrfsvol.LogicalAddr, rebuiltLeafRoots]
 }
 
+var (
+	rebuiltNodeIndexCacheSize = textui.NewTunable("btrfsutil.rebuilt-node-index-cache-size", 8)
+	rebuiltItemsCacheSize     = textui.NewTunable("btrfsutil.rebuilt-items-cache-size", 8)
+	rebuiltErrorsCacheSize    = textui.NewTunable("btrfsutil.rebuilt-errors-cache-size", 8)
+	rebuiltLeafRootsCacheSize = textui.NewTunable("btrfsutil.rebuilt-leaf-roots-cache-size", 4*1024)
+)
+
 func makeRebuiltSharedCache(forrest *RebuiltForrest) rebuiltSharedCache {
 	var ret rebuiltSharedCache
 	ret.nodeIndex = containers.NewARCache[btrfsprim.ObjID, rebuiltNodeIndex](
-		textui.Tunable(8),
+		rebuiltNodeIndexCacheSize.Get(),
 		containers.SourceFunc[btrfsprim.ObjID, rebuiltNodeIndex](
 			func(ctx context.Context, treeID btrfsprim.ObjID, index *rebuiltNodeIndex) {
 				*index = forrest.trees[treeID].uncachedNodeIndex(ctx)
 			}))
 	ret.incItems = containers.NewARCache[btrfsprim.ObjID, containers.SortedMap[btrfsprim.Key, ItemPtr]](
-		textui.Tunable(8),
+		rebuiltItemsCacheSize.Get(),
 		containers.SourceFunc[btrfsprim.ObjID, containers.SortedMap[btrfsprim.Key, ItemPtr]](
 			func(ctx context.Context, treeID btrfsprim.ObjID, incItems *containers.SortedMap[btrfsprim.Key, ItemPtr]) {
+				forrest.itemsLoads.Add(1)
 				*incItems = forrest.trees[treeID].uncachedIncItems(ctx)
 			}))
 	ret.excItems = containers.NewARCache[btrfsprim.ObjID, containers.SortedMap[btrfsprim.Key, ItemPtr]](
-		textui.Tunable(8),
+		rebuiltItemsCacheSize.Get(),
 		containers.SourceFunc[btrfsprim.ObjID, containers.SortedMap[btrfsprim.Key, ItemPtr]](
 			func(ctx context.Context, treeID btrfsprim.ObjID, excItems *containers.SortedMap[btrfsprim.Key, ItemPtr]) {
+				forrest.itemsLoads.Add(1)
 				*excItems = forrest.trees[treeID].uncachedExcItems(ctx)
 			}))
 	ret.errors = containers.NewARCache[btrfsprim.ObjID, containers.IntervalTree[btrfsprim.Key, rebuiltTreeError]](
-		textui.Tunable(8),
+		rebuiltErrorsCacheSize.Get(),
 		containers.SourceFunc[btrfsprim.ObjID, containers.IntervalTree[btrfsprim.Key, rebuiltTreeError]](
 			func(ctx context.Context, treeID btrfsprim.ObjID, errs *containers.IntervalTree[btrfsprim.Key, rebuiltTreeError]) {
 				*errs = forrest.trees[treeID].uncachedErrors(ctx)
 			}))
+	ret.leafToRoots = containers.NewARCache[btrfsvol.LogicalAddr, rebuiltLeafRoots](
+		rebuiltLeafRootsCacheSize.Get(),
+		containers.SourceFunc[btrfsvol.LogicalAddr, rebuiltLeafRoots](
+			func(_ context.Context, leaf btrfsvol.LogicalAddr, entry *rebuiltLeafRoots) {
+				entry.load(forrest.graph, leaf)
+			}))
 	return ret
 }
 
+// RebuiltLeafToRootsStats returns how many calls to
+// RebuiltTree.RebuiltLeafToRoots (across all trees) were answered
+// from the cache, and how many had to be computed.
+func (ts *RebuiltForrest) RebuiltLeafToRootsStats() (hits, misses int64) {
+	return ts.leafToRootsHits.Load(), ts.leafToRootsMisses.Load()
+}
+
+// RebuiltItemsCacheStats returns how many calls to
+// RebuiltTree.RebuiltAcquireItems and
+// RebuiltTree.RebuiltAcquirePotentialItems (across all trees) were
+// answered from the cache, and how many had to (re-)index the tree.
+func (ts *RebuiltForrest) RebuiltItemsCacheStats() (hits, misses int64) {
+	misses = ts.itemsLoads.Load()
+	return ts.itemsAcquires.Load() - misses, misses
+}
+
+// acquireItems calls cache.Acquire(), counting it for
+// .RebuiltItemsCacheStats(); the misses are counted by the incItems
+// and excItems Sources, once per load.
+func (ts *RebuiltForrest) acquireItems(ctx context.Context, cache containers.Cache[btrfsprim.ObjID, containers.SortedMap[btrfsprim.Key, ItemPtr]], treeID btrfsprim.ObjID) *containers.SortedMap[btrfsprim.Key, ItemPtr] {
+	ts.itemsAcquires.Add(1)
+	return cache.Acquire(ctx, treeID)
+}
+
 func (tree *RebuiltTree) initRoots(ctx context.Context) {
 	tree.initRootsOnce.Do(func() {
 		if tree.Root != 0 {
 			tree.RebuiltAddRoot(ctx, tree.Root)
 		}
+		if injected, ok := tree.forrest.injectedRoots[tree.ID]; ok {
+			tree.RebuiltAddRoot(ctx, injected)
+		}
 	})
 }
 
@@ -170,7 +235,7 @@ type rebuiltNodeIndexer struct {
 
 func (indexer *rebuiltNodeIndexer) run(ctx context.Context) map[btrfsvol.LogicalAddr]rebuiltRoots {
 	indexer.stats.D = len(indexer.tree.forrest.graph.Nodes)
-	indexer.progressWriter = textui.NewProgress[textui.Portion[int]](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second))
+	indexer.progressWriter = textui.NewProgress[textui.Portion[int]](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
 	indexer.updateProgress()
 	for _, node := range maps.SortedKeys(indexer.tree.forrest.graph.Nodes) {
 		indexer.node(ctx, node, nil)
@@ -189,6 +254,9 @@ func (indexer *rebuiltNodeIndexer) node(ctx context.Context, node btrfsvol.Logic
 	if err := ctx.Err(); err != nil {
 		return
 	}
+	// This lookup is not worth prefiltering (with a Bloom filter
+	// or the like): each node misses exactly once, the first
+	// time it is indexed, and every visit after that is a hit.
 	if maps.HasKey(indexer.nodeToRoots, node) {
 		return
 	}
@@ -268,6 +336,106 @@ nextKP:
 	indexer.nodeToRoots[node] = roots
 }
 
+// shared cache: .RebuiltLeafToRoots() ////////////////////////////////////////////////////////////////////////////////
+
+// rebuiltLeafRoots caches the results of .RebuiltLeafToRoots() for a
+// single leaf, across all trees.
+//
+// The result of .RebuiltLeafToRoots() is a pure function of the
+// (static) graph and of two tree-dependent inputs that the node
+// indexer consults for nodes that the leaf is reachable from:
+//
+//  1. tree.isOwnerOK(owner, gen) for each such node, and
+//  2. whether each key-pointer's .FromTree is an ancestor of the
+//     tree (the indexer then calls that ancestor's .isOwnerOK, but
+//     ancestor trees are shared objects, so that is the same for
+//     every tree that has that ancestor).
+//
+// So the cache is keyed by the leaf and by a "signature" that packs
+// those booleans for the tree in question.  Snapshots that share a
+// subtree with their parent produce the same signature for leaves in
+// that subtree, and so share a single result.
+//
+// Because neither input depends on tree.Roots, adding roots to a tree
+// never invalidates an entry.
+type rebuiltLeafRoots struct {
+	// static
+	ownerGens []rebuiltOwnerGen
+	fromTrees []btrfsprim.ObjID
+
+	mu          sync.Mutex
+	bySignature map[string]containers.Set[btrfsvol.LogicalAddr]
+}
+
+type rebuiltOwnerGen struct {
+	Owner btrfsprim.ObjID
+	Gen   btrfsprim.Generation
+}
+
+func (entry *rebuiltLeafRoots) load(graph Graph, leaf btrfsvol.LogicalAddr) {
+	ownerGens := make(containers.Set[rebuiltOwnerGen])
+	fromTrees := make(containers.Set[btrfsprim.ObjID])
+	visited := make(containers.Set[btrfsvol.LogicalAddr])
+	queue := []btrfsvol.LogicalAddr{leaf}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if visited.Has(node) {
+			continue
+		}
+		visited.Insert(node)
+		nodeInfo := graph.Nodes[node]
+		ownerGens.Insert(rebuiltOwnerGen{Owner: nodeInfo.Owner, Gen: nodeInfo.Generation})
+		for _, kp := range graph.EdgesTo[node] {
+			fromTrees.Insert(kp.FromTree)
+			queue = append(queue, kp.FromNode)
+		}
+	}
+	entry.ownerGens = maps.Keys(ownerGens)
+	sort.Slice(entry.ownerGens, func(i, j int) bool {
+		a, b := entry.ownerGens[i], entry.ownerGens[j]
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+		return a.Gen < b.Gen
+	})
+	entry.fromTrees = maps.SortedKeys(fromTrees)
+	entry.bySignature = nil
+}
+
+func (entry *rebuiltLeafRoots) signature(tree *RebuiltTree) string {
+	bits := make([]byte, (len(entry.ownerGens)+len(entry.fromTrees)+7)/8)
+	i := 0
+	set := func(b bool) {
+		if b {
+			bits[i/8] |= 1 << (i % 8)
+		}
+		i++
+	}
+	for _, og := range entry.ownerGens {
+		set(tree.isOwnerOK(og.Owner, og.Gen))
+	}
+	for _, fromTree := range entry.fromTrees {
+		set(tree.hasAncestor(fromTree))
+	}
+	return string(bits)
+}
+
+// hasAncestor returns whether `id` is this tree or one of its
+// ancestors (the same set of trees as in rebuiltNodeIndex.idToTree).
+func (tree *RebuiltTree) hasAncestor(id btrfsprim.ObjID) bool {
+	root := tree.ancestorRoot
+	for ancestor := tree; ancestor != nil; ancestor = ancestor.Parent {
+		if ancestor.ID == id {
+			return true
+		}
+		if ancestor.ID == root {
+			break
+		}
+	}
+	return false
+}
+
 // isOwnerOK returns whether it is permissible for a node with
 // .Head.Owner=owner and .Head.Generation=gen to be in this tree.
 func (tree *RebuiltTree) isOwnerOK(owner btrfsprim.ObjID, gen btrfsprim.Generation) bool {
@@ -280,7 +448,13 @@ func (tree *RebuiltTree) isOwnerOK(owner btrfsprim.ObjID, gen btrfsprim.Generati
 		if owner == tree.ID {
 			return true
 		}
-		if tree.Parent == nil || gen > tree.ParentGen || tree.ID == root {
+		if tree.Parent == nil || tree.ID == root {
+			return false
+		}
+		// The node must be known to be no newer than the
+		// snapshot; a node with an unknown generation can't
+		// be attributed to an ancestor.
+		if cmp, ok := gen.CompareKnown(tree.ParentGen); !ok || cmp > 0 {
 			return false
 		}
 		tree = tree.Parent
@@ -302,7 +476,7 @@ func (tree *RebuiltTree) RebuiltAcquireItems(ctx context.Context) *containers.So
 	tree.mu.RLock()
 	defer tree.mu.RUnlock()
 
-	return tree.forrest.incItems.Acquire(ctx, tree.ID)
+	return tree.forrest.acquireItems(ctx, tree.forrest.incItems, tree.ID)
 }
 
 // RebuiltReleaseItems releases resources after a call to
@@ -324,7 +498,7 @@ func (tree *RebuiltTree) RebuiltAcquirePotentialItems(ctx context.Context) *cont
 	tree.mu.RLock()
 	defer tree.mu.RUnlock()
 
-	return tree.forrest.excItems.Acquire(ctx, tree.ID)
+	return tree.forrest.acquireItems(ctx, tree.forrest.excItems, tree.ID)
 }
 
 // RebuiltReleasePotentialItems releases resources after a call to
@@ -334,6 +508,17 @@ func (tree *RebuiltTree) RebuiltReleasePotentialItems() {
 }
 
 func (tree *RebuiltTree) uncachedIncItems(ctx context.Context) containers.SortedMap[btrfsprim.Key, ItemPtr] {
+	// The cache serializes calls to .Load(), so it's safe to
+	// consume the seed here even though we only hold tree.mu for
+	// reading.
+	if seed := tree.incItemsSeed; seed != nil {
+		for _, dup := range tree.incItemsSeedDups {
+			tree.forrest.addDupKey(tree.ID, dup)
+		}
+		tree.incItemsSeed = nil
+		tree.incItemsSeedDups = nil
+		return *seed
+	}
 	ctx = dlog.WithField(ctx, "btrfs.util.rebuilt-tree.index-inc-items", fmt.Sprintf("tree=%v", tree.ID))
 	return tree.uncachedItems(ctx, true)
 }
@@ -366,32 +551,71 @@ func (tree *RebuiltTree) uncachedItems(ctx context.Context, inc bool) containers
 
 	var stats rebuiltItemStats
 	stats.Leafs.D = len(leafs)
-	progressWriter := textui.NewProgress[rebuiltItemStats](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second))
-
-	var index containers.SortedMap[btrfsprim.Key, ItemPtr]
+	progressWriter := textui.NewProgress[rebuiltItemStats](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
+
+	// Rather than .Store()ing each item in to the index as we go
+	// (re-balancing the index on every insert), gather them all
+	// up, sort them, and then build the index in one pass.  The
+	// sort is stable, so that duplicate keys are resolved in the
+	// same order that they would have been if they were inserted
+	// one-by-one.
+	type keyAndPtr struct {
+		Key btrfsprim.Key
+		Ptr ItemPtr
+	}
+	var items []keyAndPtr
 	for i, leaf := range leafs {
 		stats.Leafs.N = i
 		progressWriter.Set(stats)
 		for j, itemKeyAndSize := range tree.forrest.graph.Nodes[leaf].Items {
-			newPtr := ItemPtr{
-				Node: leaf,
-				Slot: j,
-			}
-			if oldPtr, exists := index.Load(itemKeyAndSize.Key); !exists {
-				index.Store(itemKeyAndSize.Key, newPtr)
-				stats.NumItems++
-			} else {
-				if tree.RebuiltShouldReplace(oldPtr.Node, newPtr.Node) {
-					index.Store(itemKeyAndSize.Key, newPtr)
+			items = append(items, keyAndPtr{
+				Key: itemKeyAndSize.Key,
+				Ptr: ItemPtr{
+					Node: leaf,
+					Slot: j,
+				},
+			})
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Key.Compare(items[j].Key) < 0
+	})
+	var dupKeys map[btrfsprim.Key]DupKeyConflict
+	if inc && tree.forrest.dupKeysEnabled() {
+		dupKeys = make(map[btrfsprim.Key]DupKeyConflict)
+	}
+	index := containers.SortedMapFromSorted(func(yield func(btrfsprim.Key, ItemPtr)) {
+		for i := 0; i < len(items); {
+			ptr := items[i].Ptr
+			j := i + 1
+			for ; j < len(items) && items[j].Key == items[i].Key; j++ {
+				if tree.RebuiltShouldReplace(ctx, ptr.Node, items[j].Ptr.Node) {
+					ptr = items[j].Ptr
 				}
 				stats.NumDups++
 			}
-			progressWriter.Set(stats)
+			if dupKeys != nil && j > i+1 {
+				conflict := DupKeyConflict{
+					Tree:     tree.ID,
+					Key:      items[i].Key,
+					Selected: ptr,
+				}
+				for _, item := range items[i:j] {
+					conflict.Candidates = append(conflict.Candidates, tree.forrest.dupKeyCandidate(item.Ptr))
+				}
+				dupKeys[items[i].Key] = conflict
+			}
+			yield(items[i].Key, ptr)
+			stats.NumItems++
+			i = j
 		}
-	}
+	})
 	stats.Leafs.N = stats.Leafs.D
 	progressWriter.Set(stats)
 	progressWriter.Done()
+	if dupKeys != nil {
+		tree.forrest.setDupKeys(tree.ID, dupKeys)
+	}
 
 	return index
 }
@@ -458,7 +682,7 @@ func (tree *RebuiltTree) uncachedErrors(ctx context.Context) containers.Interval
 
 	var stats errorStats
 	stats.Nodes.D = len(nodesToProcess)
-	progressWriter := textui.NewProgress[errorStats](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second))
+	progressWriter := textui.NewProgress[errorStats](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
 	progressWriter.Set(stats)
 
 	var kps []*GraphEdge
@@ -641,7 +865,22 @@ func (tree *RebuiltTree) addErrs(ctx context.Context, fn func(btrfsprim.Key, uin
 
 // main public API /////////////////////////////////////////////////////////////////////////////////////////////////////
 
-func (tree *RebuiltTree) RebuiltShouldReplace(oldNode, newNode btrfsvol.LogicalAddr) bool {
+// RebuiltShouldReplace returns whether, when both `oldNode` and
+// `newNode` contain an item with the same key, the item from
+// `newNode` should be preferred over the item from `oldNode`.
+//
+// The node with the lower COW distance wins; failing that, the node
+// with the higher generation wins; failing that (which "shouldn't"
+// happen, but does on real corrupt filesystems), the node with the
+// lower logical address wins, and a warning is logged.  This is a
+// strict total order, so the result does not depend on which order
+// the nodes are encountered in.
+//
+// Items injected with RebuiltForrest.RebuiltInjectItems() always win.
+func (tree *RebuiltTree) RebuiltShouldReplace(ctx context.Context, oldNode, newNode btrfsvol.LogicalAddr) bool {
+	if IsInjectedNode(oldNode) || IsInjectedNode(newNode) {
+		return IsInjectedNode(newNode)
+	}
 	oldDist, _ := tree.RebuiltCOWDistance(tree.forrest.graph.Nodes[oldNode].Owner)
 	newDist, _ := tree.RebuiltCOWDistance(tree.forrest.graph.Nodes[newNode].Owner)
 	switch {
@@ -652,6 +891,9 @@ func (tree *RebuiltTree) RebuiltShouldReplace(oldNode, newNode btrfsvol.LogicalA
 		// Retain the old lower-dist one.
 		return false
 	default:
+		// An unknown generation (0; see
+		// btrfsprim.Generation.Known) sorts as the oldest, so a
+		// known generation always wins over it.
 		oldGen := tree.forrest.graph.Nodes[oldNode].Generation
 		newGen := tree.forrest.graph.Nodes[newNode].Generation
 		switch {
@@ -661,14 +903,12 @@ func (tree *RebuiltTree) RebuiltShouldReplace(oldNode, newNode btrfsvol.LogicalA
 		case newGen < oldGen:
 			// Retain the old higher-gen one.
 			return false
+		case oldNode == newNode:
+			return false
 		default:
-			// TODO: This is a panic because I'm not really sure what the
-			// best way to handle this is, and so if this happens I want the
-			// program to crash and force me to figure out how to handle it.
-			panic(fmt.Errorf("dup nodes in tree=%v: old=%v=%v ; new=%v=%v",
-				tree.ID,
-				oldNode, tree.forrest.graph.Nodes[oldNode],
-				newNode, tree.forrest.graph.Nodes[newNode]))
+			tree.forrest.warnDupNodes(ctx, tree.ID, oldNode, newNode)
+			// Arbitrary, but stable: Prefer the lower address.
+			return newNode < oldNode
 		}
 	}
 }
@@ -722,7 +962,7 @@ func (tree *RebuiltTree) RebuiltAddRoot(ctx context.Context, rootNode btrfsvol.L
 		var stats rebuiltRootStats
 		nodeToRoots := tree.acquireNodeIndex(ctx).nodeToRoots
 		stats.Nodes.D = len(nodeToRoots)
-		progressWriter := textui.NewProgress[rebuiltRootStats](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second))
+		progressWriter := textui.NewProgress[rebuiltRootStats](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
 		for i, node := range maps.SortedKeys(nodeToRoots) {
 			stats.Nodes.N = i
 			progressWriter.Set(stats)
@@ -750,10 +990,9 @@ func (tree *RebuiltTree) RebuiltAddRoot(ctx context.Context, rootNode btrfsvol.L
 		}
 	}
 
+	tree.seedIncItems(ctx, rootNode)
 	tree.Roots.Insert(rootNode)
-	tree.forrest.incItems.Delete(tree.ID) // force re-gen
-	tree.forrest.excItems.Delete(tree.ID) // force re-gen
-	tree.forrest.errors.Delete(tree.ID)   // force re-gen
+	tree.invalidateItems() // force re-gen (from the seed, if there is one)
 
 	if shouldFlush {
 		tree.forrest.flushNegativeCache(ctx)
@@ -761,6 +1000,76 @@ func (tree *RebuiltTree) RebuiltAddRoot(ctx context.Context, rootNode btrfsvol.L
 	tree.forrest.cb.AddedRoot(ctx, tree.ID, rootNode)
 }
 
+// invalidateItems discards everything that is derived from the set of
+// items in the tree: evictable members 2, 3, and 4, and the
+// .TreeLookup() cache.  It must be called (with tree.mu held for
+// writing) whenever tree.Roots changes, or anything else changes that
+// may change which items are in the tree.  It does not discard
+// tree.incItemsSeed.
+func (tree *RebuiltTree) invalidateItems() {
+	tree.forrest.incItems.Delete(tree.ID)
+	tree.forrest.excItems.Delete(tree.ID)
+	tree.forrest.errors.Delete(tree.ID)
+	tree.invalidateLookupCache()
+}
+
+// seedIncItems sets tree.incItemsSeed to be the current incItems plus
+// the items from rootNode; it must be called before rootNode is added
+// to tree.Roots.  If the current incItems is not cached, then it does
+// nothing; it's cheaper to wait and do a full re-gen later than it is
+// to do a full re-gen now and then an incremental update.
+func (tree *RebuiltTree) seedIncItems(ctx context.Context, rootNode btrfsvol.LogicalAddr) {
+	tree.incItemsSeed = nil
+	tree.incItemsSeedDups = nil
+	oldItems, ok := tree.forrest.incItems.TryAcquire(tree.ID)
+	if !ok {
+		return
+	}
+	newItems := oldItems.Clone()
+	tree.forrest.incItems.Release(tree.ID)
+
+	var leafs []btrfsvol.LogicalAddr
+	for node, roots := range tree.acquireNodeIndex(ctx).nodeToRoots {
+		if tree.forrest.graph.Nodes[node].Level == 0 && maps.HasKey(roots, rootNode) && !maps.HaveAnyKeysInCommon(tree.Roots, roots) {
+			leafs = append(leafs, node)
+		}
+	}
+	tree.releaseNodeIndex()
+	slices.Sort(leafs)
+
+	// This must match what .uncachedItems() would do.
+	recordDups := tree.forrest.dupKeysEnabled()
+	var dups []rebuiltDupKey
+	for _, leaf := range leafs {
+		for j, itemKeyAndSize := range tree.forrest.graph.Nodes[leaf].Items {
+			newPtr := ItemPtr{
+				Node: leaf,
+				Slot: j,
+			}
+			oldPtr, exists := newItems.Load(itemKeyAndSize.Key)
+			if !exists {
+				newItems.Store(itemKeyAndSize.Key, newPtr)
+				continue
+			}
+			selected := oldPtr
+			if tree.RebuiltShouldReplace(ctx, oldPtr.Node, newPtr.Node) {
+				selected = newPtr
+				newItems.Store(itemKeyAndSize.Key, newPtr)
+			}
+			if recordDups {
+				dups = append(dups, rebuiltDupKey{
+					Key:      itemKeyAndSize.Key,
+					OldPtr:   oldPtr,
+					NewPtr:   newPtr,
+					Selected: selected,
+				})
+			}
+		}
+	}
+	tree.incItemsSeed = &newItems
+	tree.incItemsSeedDups = dups
+}
+
 // RebuiltCOWDistance returns how many COW-snapshots down the 'tree'
 // is from the 'parent'.
 func (tree *RebuiltTree) RebuiltCOWDistance(parentID btrfsprim.ObjID) (dist int, ok bool) {
@@ -779,6 +1088,9 @@ func (tree *RebuiltTree) RebuiltCOWDistance(parentID btrfsprim.ObjID) (dist int,
 
 // RebuiltLeafToRoots returns the list of potential roots (to pass to
 // .RebuiltAddRoot) that include a given leaf-node.
+//
+// The returned set may be shared with other callers (and other
+// trees), and must not be modified.
 func (tree *RebuiltTree) RebuiltLeafToRoots(ctx context.Context, leaf btrfsvol.LogicalAddr) containers.Set[btrfsvol.LogicalAddr] {
 	if tree.forrest.graph.Nodes[leaf].Level != 0 {
 		panic(fmt.Errorf("should not happen: (tree=%v).RebuiltLeafToRoots(leaf=%v): not a leaf",
@@ -790,12 +1102,38 @@ func (tree *RebuiltTree) RebuiltLeafToRoots(ctx context.Context, leaf btrfsvol.L
 	tree.mu.RLock()
 	defer tree.mu.RUnlock()
 
-	ret := make(containers.Set[btrfsvol.LogicalAddr])
-	for root := range tree.acquireNodeIndex(ctx).nodeToRoots[leaf] {
+	entry := tree.forrest.leafToRoots.Acquire(ctx, leaf)
+	defer tree.forrest.leafToRoots.Release(leaf)
+	sig := entry.signature(tree)
+
+	entry.mu.Lock()
+	ret, ok := entry.bySignature[sig]
+	entry.mu.Unlock()
+	if ok {
+		tree.forrest.leafToRootsHits.Add(1)
+	} else {
+		tree.forrest.leafToRootsMisses.Add(1)
+		ret = tree.uncachedLeafToRoots(ctx, leaf)
+		entry.mu.Lock()
+		if entry.bySignature == nil {
+			entry.bySignature = make(map[string]containers.Set[btrfsvol.LogicalAddr])
+		}
+		entry.bySignature[sig] = ret
+		entry.mu.Unlock()
+	}
+
+	for root := range ret {
 		if tree.Roots.Has(root) {
 			panic(fmt.Errorf("should not happen: (tree=%v).RebuiltLeafToRoots(leaf=%v): tree contains root=%v but not leaf",
 				tree.ID, leaf, root))
 		}
+	}
+	return ret
+}
+
+func (tree *RebuiltTree) uncachedLeafToRoots(ctx context.Context, leaf btrfsvol.LogicalAddr) containers.Set[btrfsvol.LogicalAddr] {
+	ret := make(containers.Set[btrfsvol.LogicalAddr])
+	for root := range tree.acquireNodeIndex(ctx).nodeToRoots[leaf] {
 		ret.Insert(root)
 	}
 	tree.releaseNodeIndex()
@@ -822,8 +1160,26 @@ func (tree *RebuiltTree) TreeParentID(_ context.Context) (btrfsprim.ObjID, btrfs
 }
 
 // TreeLookup implements btrfstree.Tree.
+//
+// Unlike .TreeSearch(), recently looked-up items are cached (see
+// rebuiltLookupCacheSize), so that looking up the same key
+// repeatedly doesn't re-read and re-decode the item each time.
 func (tree *RebuiltTree) TreeLookup(ctx context.Context, key btrfsprim.Key) (btrfstree.Item, error) {
-	return tree.TreeSearch(ctx, btrfstree.SearchExactKey(key))
+	tree.forrest.commitTrees(ctx, tree.ID)
+	tree.initRoots(ctx)
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+
+	cache := tree.acquireLookupCache()
+	tree.forrest.lookupAcquires.Add(1)
+	entry := cache.Acquire(ctx, key)
+	defer cache.Release(key)
+	if entry.err != nil {
+		return btrfstree.Item{}, entry.err
+	}
+	item := entry.item
+	item.Body = item.Body.CloneItem()
+	return item, nil
 }
 
 // TreeSearch implements btrfstree.Tree.  It is a thin wrapper around
@@ -835,6 +1191,11 @@ func (tree *RebuiltTree) TreeSearch(ctx context.Context, searcher btrfstree.Tree
 	tree.mu.RLock()
 	defer tree.mu.RUnlock()
 
+	return tree.search(ctx, searcher)
+}
+
+// search is the guts of .TreeSearch(); tree.mu must be held.
+func (tree *RebuiltTree) search(ctx context.Context, searcher btrfstree.TreeSearcher) (btrfstree.Item, error) {
 	_, ptr, ok := tree.RebuiltAcquireItems(ctx).Search(func(_ btrfsprim.Key, ptr ItemPtr) int {
 		straw := tree.forrest.graph.Nodes[ptr.Node].Items[ptr.Slot]
 		return searcher.Search(straw.Key, straw.Size)
@@ -0,0 +1,250 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+)
+
+// A NamedSuperblock is one superblock mirror, along with a
+// human-readable name for where it came from (such as `file
+// "sda1" superblock 0`).
+type NamedSuperblock struct {
+	Name       string
+	Superblock btrfstree.Superblock
+}
+
+// A RootTreeCandidate is a node that might be the root of the
+// ROOT_TREE.
+type RootTreeCandidate struct {
+	Addr       btrfsvol.LogicalAddr
+	Generation btrfsprim.Generation
+	Level      uint8
+
+	// Superblocks is the superblock mirrors whose root_tree
+	// points at the candidate.
+	Superblocks []string
+	// Backups is the backup_roots (of any mirror) whose
+	// tree_root points at the candidate.
+	Backups []string
+
+	// Err is why the candidate can't be used, or nil if it can.
+	Err error
+}
+
+// Tier returns how trustworthy the source of the candidate is: 0 if a
+// superblock mirror points at it, 1 if only a backup root points at
+// it, or 2 if it was only found in the scanned graph.
+func (c RootTreeCandidate) Tier() int {
+	switch {
+	case len(c.Superblocks) > 0:
+		return 0
+	case len(c.Backups) > 0:
+		return 1
+	default:
+		return 2 //nolint:gomnd // This is just the 3rd tier.
+	}
+}
+
+// Why returns a human-readable description of where the candidate
+// came from.
+func (c RootTreeCandidate) Why() string {
+	var parts []string
+	if len(c.Superblocks) > 0 {
+		parts = append(parts, fmt.Sprintf("pointed to by %d superblock mirrors (%s)",
+			len(c.Superblocks), strings.Join(c.Superblocks, ", ")))
+	}
+	if len(c.Backups) > 0 {
+		parts = append(parts, fmt.Sprintf("pointed to by %d backup roots (%s)",
+			len(c.Backups), strings.Join(c.Backups, ", ")))
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "found only in the node scan")
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (c RootTreeCandidate) String() string {
+	ret := fmt.Sprintf("node@%v (generation %v, level %v): %s", c.Addr, c.Generation, c.Level, c.Why())
+	if c.Err != nil {
+		ret += fmt.Sprintf(": unusable: %v", c.Err)
+	}
+	return ret
+}
+
+// RankRootTreeCandidates gathers every candidate root for the
+// ROOT_TREE, and returns them best-first.  A wrong ROOT_TREE root
+// poisons every other tree, so this is deliberately conservative:
+//
+//   - A candidate is only usable if the graph has a node at that
+//     address that is owned by the ROOT_TREE, and that has the level
+//     and generation that the candidate was referred to with.
+//
+//   - Usable candidates that a superblock mirror points at are
+//     preferred over ones that only a backup root points at, which
+//     are preferred over roots that were only found in the graph (a
+//     ROOT_TREE node that no other node points at, that is no newer
+//     than the newest superblock; anything newer is from a
+//     transaction that was never committed).
+//
+//   - Within each of those tiers, the highest generation is
+//     preferred, and then the candidate pointed to by the most
+//     superblock mirrors.
+func RankRootTreeCandidates(sbs []NamedSuperblock, graph Graph) []RootTreeCandidate {
+	byAddr := make(map[btrfsvol.LogicalAddr]*RootTreeCandidate)
+	get := func(addr btrfsvol.LogicalAddr, gen btrfsprim.Generation, lvl uint8) *RootTreeCandidate {
+		cand, ok := byAddr[addr]
+		if !ok {
+			cand = &RootTreeCandidate{
+				Addr:       addr,
+				Generation: gen,
+				Level:      lvl,
+			}
+			byAddr[addr] = cand
+		}
+		if cand.Err == nil && (cand.Generation != gen || cand.Level != lvl) {
+			cand.Err = fmt.Errorf("referred to with conflicting generations/levels (%v/%v and %v/%v)",
+				cand.Generation, cand.Level, gen, lvl)
+		}
+		return cand
+	}
+
+	var maxSBGen btrfsprim.Generation
+	for _, sb := range sbs {
+		if sb.Superblock.Generation > maxSBGen {
+			maxSBGen = sb.Superblock.Generation
+		}
+		cand := get(sb.Superblock.RootTree, sb.Superblock.Generation, sb.Superblock.RootLevel)
+		cand.Superblocks = append(cand.Superblocks, sb.Name)
+		for i, backup := range sb.Superblock.SuperRoots {
+			if backup.TreeRoot == 0 {
+				continue
+			}
+			cand := get(btrfsvol.LogicalAddr(backup.TreeRoot), backup.TreeRootGen, backup.TreeRootLevel)
+			cand.Backups = append(cand.Backups, fmt.Sprintf("%s backup_roots[%d]", sb.Name, i))
+		}
+	}
+
+	for _, node := range graph.Nodes {
+		if node.Owner != btrfsprim.ROOT_TREE_OBJECTID || node.Generation > maxSBGen {
+			continue
+		}
+		if _, ok := byAddr[node.Addr]; ok {
+			continue
+		}
+		pointedTo := false
+		for _, edge := range graph.EdgesTo[node.Addr] {
+			if edge.FromNode != 0 {
+				pointedTo = true
+				break
+			}
+		}
+		if !pointedTo {
+			get(node.Addr, node.Generation, node.Level)
+		}
+	}
+
+	ret := make([]RootTreeCandidate, 0, len(byAddr))
+	for _, cand := range byAddr {
+		if cand.Err == nil {
+			cand.Err = checkRootTreeCandidate(*cand, graph, maxSBGen)
+		}
+		ret = append(ret, *cand)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		switch {
+		case (a.Err == nil) != (b.Err == nil):
+			return a.Err == nil
+		case a.Tier() != b.Tier():
+			return a.Tier() < b.Tier()
+		case a.Generation != b.Generation:
+			return a.Generation > b.Generation
+		case len(a.Superblocks) != len(b.Superblocks):
+			return len(a.Superblocks) > len(b.Superblocks)
+		default:
+			return a.Addr < b.Addr
+		}
+	})
+	return ret
+}
+
+func checkRootTreeCandidate(cand RootTreeCandidate, graph Graph, maxSBGen btrfsprim.Generation) error {
+	node, ok := graph.Nodes[cand.Addr]
+	if !ok {
+		if err, bad := graph.BadNodes[cand.Addr]; bad {
+			return err
+		}
+		return fmt.Errorf("no node at that address was found in the scan")
+	}
+	switch {
+	case node.Owner != btrfsprim.ROOT_TREE_OBJECTID:
+		return fmt.Errorf("node is owned by %v, not the ROOT_TREE", node.Owner)
+	case node.Generation != cand.Generation:
+		return fmt.Errorf("node has generation %v", node.Generation)
+	case node.Level != cand.Level:
+		return fmt.Errorf("node has level %v", node.Level)
+	case node.Generation > maxSBGen:
+		return fmt.Errorf("node is newer than the newest superblock (generation %v)", maxSBGen)
+	}
+	return nil
+}
+
+// maxLoggedRootTreeCandidates is how many passed-over candidates
+// ChooseRootTreeRoot logs; the graph may contain many old ROOT_TREE
+// roots.
+const maxLoggedRootTreeCandidates = 16
+
+// ChooseRootTreeRoot ranks the ROOT_TREE root candidates (see
+// RankRootTreeCandidates) and returns the best usable one, logging
+// which it chose and why it was preferred over each alternative.
+func ChooseRootTreeRoot(ctx context.Context, sbs []NamedSuperblock, graph Graph) (RootTreeCandidate, error) {
+	cands := RankRootTreeCandidates(sbs, graph)
+	if len(cands) == 0 || cands[0].Err != nil {
+		for i, cand := range cands {
+			if i == maxLoggedRootTreeCandidates {
+				dlog.Errorf(ctx, "ROOT_TREE root: ... and %d more unusable candidates", len(cands)-i)
+				break
+			}
+			dlog.Errorf(ctx, "ROOT_TREE root: unusable candidate: %v", cand)
+		}
+		return RootTreeCandidate{}, fmt.Errorf("no usable ROOT_TREE root among %d candidates", len(cands))
+	}
+	best := cands[0]
+	dlog.Infof(ctx, "ROOT_TREE root: chose %v", best)
+	for i, cand := range cands[1:] {
+		if i == maxLoggedRootTreeCandidates {
+			dlog.Infof(ctx, "ROOT_TREE root: ... and passed over %d more candidates", len(cands)-1-i)
+			break
+		}
+		var why string
+		switch {
+		case cand.Err != nil:
+			why = cand.Err.Error()
+		case cand.Tier() != best.Tier():
+			why = "less trusted source"
+		case cand.Generation != best.Generation:
+			why = "older generation"
+		default:
+			why = "fewer superblock mirrors"
+		}
+		dlog.Infof(ctx, "ROOT_TREE root: passed over node@%v (generation %v): %s: %s",
+			cand.Addr, cand.Generation, why, cand.Why())
+	}
+	if best.Tier() != 0 {
+		dlog.Warnf(ctx, "ROOT_TREE root: no superblock mirror points at a usable root; falling back to node@%v",
+			best.Addr)
+	}
+	return best, nil
+}
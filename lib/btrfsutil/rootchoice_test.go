@@ -0,0 +1,111 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func rootChoiceGraph(nodes ...btrfsutil.GraphNode) btrfsutil.Graph {
+	graph := btrfsutil.Graph{
+		Nodes:     make(map[btrfsvol.LogicalAddr]btrfsutil.GraphNode),
+		BadNodes:  make(map[btrfsvol.LogicalAddr]error),
+		EdgesFrom: make(map[btrfsvol.LogicalAddr][]*btrfsutil.GraphEdge),
+		EdgesTo:   make(map[btrfsvol.LogicalAddr][]*btrfsutil.GraphEdge),
+	}
+	for _, node := range nodes {
+		graph.Nodes[node.Addr] = node
+	}
+	return graph
+}
+
+func rootChoiceSuperblock(name string, root btrfsvol.LogicalAddr, gen btrfsprim.Generation, backups ...btrfstree.RootBackup) btrfsutil.NamedSuperblock {
+	sb := btrfsutil.NamedSuperblock{Name: name}
+	sb.Superblock.RootTree = root
+	sb.Superblock.Generation = gen
+	sb.Superblock.RootLevel = 1
+	copy(sb.Superblock.SuperRoots[:], backups)
+	return sb
+}
+
+func TestRankRootTreeCandidates(t *testing.T) {
+	t.Parallel()
+	const rootTree = btrfsprim.ROOT_TREE_OBJECTID
+
+	graph := rootChoiceGraph(
+		btrfsutil.GraphNode{Addr: 0x1000, Level: 1, Generation: 10, Owner: rootTree},
+		// 0x2000 (mirror C's root) is missing, as if the write was torn.
+		btrfsutil.GraphNode{Addr: 0x3000, Level: 1, Generation: 9, Owner: rootTree},
+		btrfsutil.GraphNode{Addr: 0x4000, Level: 1, Generation: 8, Owner: rootTree},
+		// Newer than any superblock: never committed.
+		btrfsutil.GraphNode{Addr: 0x5000, Level: 1, Generation: 12, Owner: rootTree},
+		// Pointed to by another node: not a root.
+		btrfsutil.GraphNode{Addr: 0x6000, Level: 0, Generation: 7, Owner: rootTree},
+		// Not owned by the ROOT_TREE.
+		btrfsutil.GraphNode{Addr: 0x7000, Level: 1, Generation: 8, Owner: btrfsprim.FS_TREE_OBJECTID},
+	)
+	graph.EdgesTo[0x6000] = []*btrfsutil.GraphEdge{{FromNode: 0x4000, FromTree: rootTree, ToNode: 0x6000}}
+
+	backup := btrfstree.RootBackup{TreeRoot: 0x3000, TreeRootGen: 9, TreeRootLevel: 1}
+	sbs := []btrfsutil.NamedSuperblock{
+		rootChoiceSuperblock("A", 0x1000, 10, backup),
+		rootChoiceSuperblock("B", 0x1000, 10),
+		rootChoiceSuperblock("C", 0x2000, 11),
+	}
+
+	cands := btrfsutil.RankRootTreeCandidates(sbs, graph)
+	var addrs []btrfsvol.LogicalAddr
+	for _, cand := range cands {
+		addrs = append(addrs, cand.Addr)
+	}
+	assert.Equal(t, []btrfsvol.LogicalAddr{0x1000, 0x3000, 0x4000, 0x2000}, addrs)
+
+	assert.NoError(t, cands[0].Err)
+	assert.Equal(t, []string{"A", "B"}, cands[0].Superblocks)
+	assert.Equal(t, 0, cands[0].Tier())
+	assert.Equal(t, []string{"A backup_roots[0]"}, cands[1].Backups)
+	assert.Equal(t, 1, cands[1].Tier())
+	assert.Equal(t, 2, cands[2].Tier())
+	assert.Error(t, cands[3].Err)
+
+	ctx := dlog.NewTestContext(t, false)
+	best, err := btrfsutil.ChooseRootTreeRoot(ctx, sbs, graph)
+	require.NoError(t, err)
+	assert.Equal(t, btrfsvol.LogicalAddr(0x1000), best.Addr)
+}
+
+func TestChooseRootTreeRootFallback(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	const rootTree = btrfsprim.ROOT_TREE_OBJECTID
+
+	backup := btrfstree.RootBackup{TreeRoot: 0x3000, TreeRootGen: 9, TreeRootLevel: 1}
+	sbs := []btrfsutil.NamedSuperblock{
+		rootChoiceSuperblock("A", 0x1000, 10, backup),
+	}
+
+	// The superblock's root has the wrong generation, so the backup
+	// root is preferred.
+	graph := rootChoiceGraph(
+		btrfsutil.GraphNode{Addr: 0x1000, Level: 1, Generation: 6, Owner: rootTree},
+		btrfsutil.GraphNode{Addr: 0x3000, Level: 1, Generation: 9, Owner: rootTree},
+	)
+	best, err := btrfsutil.ChooseRootTreeRoot(ctx, sbs, graph)
+	require.NoError(t, err)
+	assert.Equal(t, btrfsvol.LogicalAddr(0x3000), best.Addr)
+
+	// With nothing usable, it's an error.
+	_, err = btrfsutil.ChooseRootTreeRoot(ctx, sbs, rootChoiceGraph())
+	assert.Error(t, err)
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// superblockMagicOffset is the offset of Superblock.Magic within the
+// superblock.
+const superblockMagicOffset = 0x40
+
+// A SuperblockCandidate is a block found by SearchSuperblocks that
+// has the superblock magic in the right place.
+type SuperblockCandidate struct {
+	Addr btrfsvol.PhysicalAddr
+	// Mirror is the index in btrfs.SuperblockAddrs of Addr, or
+	// -1 if Addr is not one of the standard locations.
+	Mirror     int
+	Superblock btrfstree.Superblock
+	// Err is why the candidate is not plausible (a bad checksum,
+	// or fatally inconsistent fields), or nil if it is.
+	Err error
+}
+
+// Plausible returns whether the candidate has a good checksum and
+// sane field values.
+func (c SuperblockCandidate) Plausible() bool {
+	return c.Err == nil
+}
+
+// sbSearchChunkAligns is how many `align`-sized units
+// SearchSuperblocks reads at once.
+var sbSearchChunkAligns = textui.NewTunable[btrfsvol.PhysicalAddr]("btrfsutil.superblock-search-chunk-aligns", 1024)
+
+type sbSearchStats struct {
+	portion    textui.Portion[btrfsvol.PhysicalAddr]
+	candidates int
+	plausible  int
+}
+
+func (s sbSearchStats) String() string {
+	return textui.Sprintf("scanned %v (found: %v candidates, %v plausible)",
+		s.portion, s.candidates, s.plausible)
+}
+
+// SearchSuperblocks scans every `align`-byte boundary of the device
+// for the btrfs superblock magic (not just the standard superblock
+// locations), and calls fn for each candidate found, in order of
+// address.  This can find superblocks left behind by a resize, or by
+// an earlier filesystem on the same device, or superblocks of a
+// filesystem that is at an offset within the device.
+func SearchSuperblocks(ctx context.Context, dev diskio.File[btrfsvol.PhysicalAddr], align btrfsvol.PhysicalAddr, fn func(SuperblockCandidate) error) error {
+	ctx = dlog.WithField(ctx, "btrfs.util.search-superblocks.dev", dev.Name())
+	numBytes := dev.Size()
+
+	// Read in chunks that are a multiple of `align`, with enough
+	// extra at the end to hold a whole superblock starting at the
+	// last boundary in the chunk.
+	chunkSize := align * sbSearchChunkAligns.Get()
+	buf := make([]byte, chunkSize+btrfs.SuperblockSize)
+
+	progressWriter := textui.NewProgress[sbSearchStats](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
+	var stats sbSearchStats
+	stats.portion.D = numBytes
+	defer func() {
+		progressWriter.Set(stats)
+		progressWriter.Done()
+	}()
+
+	for chunkBeg := btrfsvol.PhysicalAddr(0); chunkBeg+btrfs.SuperblockSize <= numBytes; chunkBeg += chunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		stats.portion.N = chunkBeg
+		progressWriter.Set(stats)
+
+		n, err := dev.ReadAt(buf, chunkBeg)
+		if err != nil && !errors.Is(err, io.EOF) {
+			dlog.Warnf(ctx, "skipping unreadable data: %v", err)
+		}
+		dat := buf[:n]
+		for off := 0; off < int(chunkSize) && off+int(btrfs.SuperblockSize) <= len(dat); off += int(align) {
+			magic := dat[off+superblockMagicOffset : off+superblockMagicOffset+len(btrfstree.SuperblockMagic)]
+			if !bytes.Equal(magic, btrfstree.SuperblockMagic[:]) {
+				continue
+			}
+			cand := SuperblockCandidate{
+				Addr:   chunkBeg + btrfsvol.PhysicalAddr(off),
+				Mirror: -1,
+			}
+			for i, sbAddr := range btrfs.SuperblockAddrs {
+				if cand.Addr == sbAddr {
+					cand.Mirror = i
+				}
+			}
+			if _, err := binstruct.Unmarshal(dat[off:off+int(btrfs.SuperblockSize)], &cand.Superblock); err != nil {
+				cand.Err = err
+			} else if err := cand.Superblock.ValidateChecksum(); err != nil {
+				cand.Err = err
+			} else if err := cand.Superblock.Validate(nil).Err(); err != nil {
+				cand.Err = err
+			}
+			stats.candidates++
+			if cand.Plausible() {
+				stats.plausible++
+			}
+			if err := fn(cand); err != nil {
+				return err
+			}
+		}
+	}
+	stats.portion.N = numBytes
+	return nil
+}
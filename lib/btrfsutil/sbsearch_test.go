@@ -0,0 +1,99 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+func TestSearchSuperblocks(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	img := make(memFile, 0x100000)
+	putSB := func(addr btrfsvol.PhysicalAddr, gen uint64, corrupt bool) {
+		sb := btrfstree.Superblock{
+			Self:         addr,
+			Magic:        btrfstree.SuperblockMagic,
+			Generation:   btrfsprim.Generation(gen),
+			RootTree:     0x400000,
+			ChunkTree:    0x1504000,
+			TotalBytes:   0x10000000,
+			BytesUsed:    0x100000,
+			NumDevices:   1,
+			SectorSize:   btrfssum.BlockSize,
+			NodeSize:     16 * 1024,
+			LeafSize:     16 * 1024,
+			StripeSize:   btrfssum.BlockSize,
+			ChecksumType: btrfssum.TYPE_CRC32,
+			DevItem:      btrfsitem.Dev{DevID: 1, NumBytes: 0x10000000},
+		}
+		sysChunk, err := binstruct.Marshal(btrfstree.SysChunk{
+			Key: btrfsprim.Key{
+				ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID,
+				ItemType: btrfsitem.CHUNK_ITEM_KEY,
+				Offset:   0x1500000,
+			},
+			Chunk: btrfsitem.Chunk{
+				Head: btrfsitem.ChunkHeader{
+					Size:       0x800000,
+					NumStripes: 1,
+				},
+				Stripes: []btrfsitem.ChunkStripe{{DeviceID: 1, Offset: 0x1500000}},
+			},
+		})
+		require.NoError(t, err)
+		sb.SysChunkArraySize = uint32(copy(sb.SysChunkArray[:], sysChunk))
+		sb.Checksum, err = sb.CalculateChecksum()
+		require.NoError(t, err)
+		if corrupt {
+			sb.Generation++
+		}
+		dat, err := binstruct.Marshal(sb)
+		require.NoError(t, err)
+		copy(img[addr:], dat)
+	}
+	// The primary superblock is damaged, but an old one survives
+	// at an odd (sector-aligned, not block-aligned) offset.
+	putSB(btrfs.SuperblockAddrs[0], 10, true)
+	putSB(0x10000+0x7e00, 7, false)
+
+	var cands []btrfsutil.SuperblockCandidate
+	require.NoError(t, btrfsutil.SearchSuperblocks(ctx, img, 512, func(cand btrfsutil.SuperblockCandidate) error {
+		cands = append(cands, cand)
+		return nil
+	}))
+	require.Len(t, cands, 2)
+
+	assert.Equal(t, btrfs.SuperblockAddrs[0], cands[0].Addr)
+	assert.Equal(t, 0, cands[0].Mirror)
+	assert.False(t, cands[0].Plausible())
+
+	assert.Equal(t, btrfsvol.PhysicalAddr(0x17e00), cands[1].Addr)
+	assert.Equal(t, -1, cands[1].Mirror)
+	assert.True(t, cands[1].Plausible(), "%v", cands[1].Err)
+	assert.Equal(t, btrfsprim.Generation(7), cands[1].Superblock.Generation)
+
+	// With a coarser alignment, the odd one is not found.
+	cands = nil
+	require.NoError(t, btrfsutil.SearchSuperblocks(ctx, img, 4096, func(cand btrfsutil.SuperblockCandidate) error {
+		cands = append(cands, cand)
+		return nil
+	}))
+	assert.Len(t, cands, 1)
+}
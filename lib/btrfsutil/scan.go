@@ -8,8 +8,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/datawire/dlib/dgroup"
 	"github.com/datawire/dlib/dlog"
@@ -19,6 +20,7 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
 	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
 	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
@@ -44,30 +46,85 @@ func (s devScanStats[T]) String() string {
 }
 
 func ScanDevices[Stats comparable, Result any](ctx context.Context, fs *btrfs.FS, newScanner DeviceScannerFactory[Stats, Result]) (map[btrfsvol.DeviceID]Result, error) {
+	return ScanDevicesResume[Stats, Result](ctx, fs, nil, newScanner)
+}
+
+// ScanDevicesResume is like ScanDevices, but if progress is non-nil,
+// each device's scan starts from where the progress says that an
+// earlier scan got to, and the progress is updated as the scan goes.
+func ScanDevicesResume[Stats comparable, Result any](ctx context.Context, fs *btrfs.FS, progress *ScanProgress, newScanner DeviceScannerFactory[Stats, Result]) (map[btrfsvol.DeviceID]Result, error) {
+	result, _, err := scanDevices[Stats, Result](ctx, fs, progress, false, newScanner)
+	return result, err
+}
+
+// ScanDevicesHealth is like ScanDevicesResume, but also returns a
+// DeviceHealth for each device, sorted by device ID.
+func ScanDevicesHealth[Stats comparable, Result any](ctx context.Context, fs *btrfs.FS, progress *ScanProgress, newScanner DeviceScannerFactory[Stats, Result]) (map[btrfsvol.DeviceID]Result, []DeviceHealth, error) {
+	return scanDevices[Stats, Result](ctx, fs, progress, true, newScanner)
+}
+
+func scanDevices[Stats comparable, Result any](ctx context.Context, fs *btrfs.FS, progress *ScanProgress, checkHealth bool, newScanner DeviceScannerFactory[Stats, Result]) (map[btrfsvol.DeviceID]Result, []DeviceHealth, error) {
 	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{})
 	var mu sync.Mutex
 	result := make(map[btrfsvol.DeviceID]Result)
+	var health []DeviceHealth
 	for id, dev := range fs.LV.PhysicalVolumes() {
 		id := id
 		dev := dev
 		grp.Go(fmt.Sprintf("dev-%d", id), func(ctx context.Context) error {
-			devResult, err := ScanOneDevice[Stats, Result](ctx, dev, newScanner)
+			var start btrfsvol.PhysicalAddr
+			var scanned *atomic.Int64
+			if progress != nil {
+				scanned = progress.scanned[id]
+				if scanned == nil {
+					return fmt.Errorf("no scan progress for device %v", id)
+				}
+				start = btrfsvol.PhysicalAddr(scanned.Load())
+			}
+			var hc *healthChecker
+			if checkHealth {
+				hc = &healthChecker{
+					health: DeviceHealth{
+						DevID: id,
+						Name:  dev.Name(),
+						Size:  dev.Size(),
+					},
+					maxZero: healthMaxZeroRegions.Get(),
+				}
+			}
+			devResult, err := scanOneDevice[Stats, Result](ctx, dev, newScanner, start, scanned, hc)
 			if err != nil {
 				return err
 			}
 			mu.Lock()
 			result[id] = devResult
+			if hc != nil {
+				health = append(health, hc.health)
+			}
 			mu.Unlock()
 			return nil
 		})
 	}
 	if err := grp.Wait(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return result, nil
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].DevID < health[j].DevID
+	})
+	return result, health, nil
 }
 
 func ScanOneDevice[Stats comparable, Result any](ctx context.Context, dev *btrfs.Device, newScanner DeviceScannerFactory[Stats, Result]) (Result, error) {
+	return scanOneDevice[Stats, Result](ctx, dev, newScanner, 0, nil, nil)
+}
+
+// scanOneDevice scans the device starting at the sector `start`.  If
+// `scanned` is non-nil, then after each sector is scanned (including
+// any calls to the scanner for that sector), it is set to the
+// address of the end of that sector.  If `hc` is non-nil, then the
+// health of each sector that isn't part of a node is checked, using
+// the same read that checks for a node at that sector.
+func scanOneDevice[Stats comparable, Result any](ctx context.Context, dev *btrfs.Device, newScanner DeviceScannerFactory[Stats, Result], start btrfsvol.PhysicalAddr, scanned *atomic.Int64, hc *healthChecker) (Result, error) {
 	ctx = dlog.WithField(ctx, "scandevices.dev", dev.Name())
 
 	sb, err := dev.Superblock()
@@ -91,12 +148,12 @@ func ScanOneDevice[Stats comparable, Result any](ctx context.Context, dev *btrfs
 
 	scanner := newScanner(ctx, *sb, numBytes, numSectors)
 
-	progressWriter := textui.NewProgress[devScanStats[Stats]](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second))
+	progressWriter := textui.NewProgress[devScanStats[Stats]](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get())
 	var stats devScanStats[Stats]
 	stats.portion.D = numBytes
 
 	var minNextNode btrfsvol.PhysicalAddr
-	for i := 0; i < numSectors; i++ {
+	for i := int(start / btrfssum.BlockSize); i < numSectors; i++ {
 		if ctx.Err() != nil {
 			var zero Result
 			return zero, ctx.Err()
@@ -111,7 +168,7 @@ func ScanOneDevice[Stats comparable, Result any](ctx context.Context, dev *btrfs
 			return zero, err
 		}
 
-		checkForNode := pos >= minNextNode && pos+btrfsvol.PhysicalAddr(sb.NodeSize) <= numBytes
+		checkForNode := pos >= minNextNode && (pos+btrfsvol.PhysicalAddr(sb.NodeSize) <= numBytes || dev.TrustPartialNodes)
 		if checkForNode {
 			for _, sbAddr := range btrfs.SuperblockAddrs {
 				if sbAddr <= pos && pos < sbAddr+sbSize {
@@ -121,8 +178,25 @@ func ScanOneDevice[Stats comparable, Result any](ctx context.Context, dev *btrfs
 			}
 		}
 
+		// If checking health, then read the sector (and the
+		// node that might start there) just once, for both.
+		var src diskio.ReaderAt[btrfsvol.PhysicalAddr] = dev
+		var hr *healthRead
+		if hc != nil && pos >= minNextNode {
+			size := btrfssum.BlockSize
+			if checkForNode {
+				size = int(sb.NodeSize)
+			}
+			hr = hc.read(dev, pos, size)
+			src = hr
+		}
+
 		if checkForNode {
-			node, err := btrfstree.ReadNode[btrfsvol.PhysicalAddr](dev, *sb, pos)
+			node, err := btrfstree.ReadNodeWithConfig[btrfsvol.PhysicalAddr](src, *sb, pos, dev.ReadNodeConfig())
+			if err != nil && dev.TrustPartialNodes && errors.Is(err, btrfstree.ErrPartialNode) {
+				dlog.Warnf(ctx, "using partially-read node: %v", err)
+				err = nil
+			}
 			if err != nil {
 				if !errors.Is(err, btrfstree.ErrNotANode) {
 					dlog.Errorf(ctx, "error: %v", err)
@@ -133,9 +207,24 @@ func ScanOneDevice[Stats comparable, Result any](ctx context.Context, dev *btrfs
 					return zero, err
 				}
 				minNextNode = pos + btrfsvol.PhysicalAddr(sb.NodeSize)
+				if hc != nil {
+					hc.health.NumNodes++
+				}
 			}
 			node.RawFree()
 		}
+
+		if hr != nil && pos >= minNextNode {
+			hc.checkSector(dev, pos, hr)
+		}
+
+		if scanned != nil {
+			scanned.Store(int64(pos + btrfssum.BlockSize))
+		}
+	}
+
+	if hc != nil {
+		hc.health.BytesScanned = btrfsvol.PhysicalAddr((numSectors - int(start/btrfssum.BlockSize)) * btrfssum.BlockSize)
 	}
 
 	stats.portion.N = numBytes
@@ -0,0 +1,228 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+// A DeviceHealth is a summary of how a device fared in a scan.
+//
+// Every sector that isn't part of a node that was found is checked,
+// so that the sectors that could not be read and the sectors that
+// are all zeros (which were possibly never written, or were zeroed
+// by a tool such as `blkdiscard`) can be told apart.  The check
+// reuses the read that the scan already does to look for a node at
+// that sector, so it doesn't read anything a second time.
+type DeviceHealth struct {
+	DevID btrfsvol.DeviceID
+	Name  string
+	Size  btrfsvol.PhysicalAddr
+	// BytesScanned is the number of bytes that were scanned; it
+	// is less than Size if the scan was resumed part-way through.
+	BytesScanned btrfsvol.PhysicalAddr
+	// NumNodes is the number of nodes found on the device; a node
+	// that is found at several physical addresses is counted once
+	// for each.
+	NumNodes int
+	// ReadErrors is the sorted list of regions that could not be
+	// read.
+	ReadErrors []HealthRegion
+	// ZeroBytes is the total number of bytes in all-zero sectors.
+	ZeroBytes btrfsvol.PhysicalAddr
+	// ZeroRegions is the sorted list of regions that are all
+	// zeros.  A mostly-empty device can have a great many of
+	// these, so only the first "btrfsutil.health-max-zero-regions"
+	// of them are listed; ZeroRegionsTruncated is set if any were
+	// left out (ZeroBytes still counts them).
+	ZeroRegions          []HealthRegion
+	ZeroRegionsTruncated bool `json:",omitempty"`
+}
+
+var healthMaxZeroRegions = textui.NewTunable("btrfsutil.health-max-zero-regions", 4*1024)
+
+// HealthClassUnclassified is the HealthRegion.Class of a region
+// that could not be read because of an error that diskio didn't
+// classify (see diskio.ClassifyReadError); such an error says
+// nothing about whether the data on the device is bad.
+const HealthClassUnclassified = "unclassified read error"
+
+// A HealthRegion is a region of a device; see DeviceHealth.
+type HealthRegion struct {
+	Beg btrfsvol.PhysicalAddr
+	End btrfsvol.PhysicalAddr
+	// Class is the diskio class of the read error ("device I/O
+	// error", "short read", or "read beyond end of file"), or
+	// HealthClassUnclassified; it is empty for ZeroRegions.
+	Class string `json:",omitempty"`
+}
+
+// Size returns the number of bytes in the region.
+func (r HealthRegion) Size() btrfsvol.PhysicalAddr {
+	return r.End - r.Beg
+}
+
+func sumRegions(regions []HealthRegion) btrfsvol.PhysicalAddr {
+	var sum btrfsvol.PhysicalAddr
+	for _, region := range regions {
+		sum += region.Size()
+	}
+	return sum
+}
+
+// IOErrorBytes returns the number of bytes that could not be read
+// because of a device I/O error (diskio.ErrDeviceIO), as opposed to
+// because the device is shorter than expected.
+func (h DeviceHealth) IOErrorBytes() btrfsvol.PhysicalAddr {
+	var sum btrfsvol.PhysicalAddr
+	for _, region := range h.ReadErrors {
+		if region.Class == diskio.ErrDeviceIO.Error() {
+			sum += region.Size()
+		}
+	}
+	return sum
+}
+
+// appendRegion appends the region [beg, end) to `regions`, merging it
+// with the last region if they are adjacent and of the same class.
+func appendRegion(regions []HealthRegion, beg, end btrfsvol.PhysicalAddr, class string) []HealthRegion {
+	if len(regions) > 0 {
+		last := &regions[len(regions)-1]
+		if last.End == beg && last.Class == class {
+			last.End = end
+			return regions
+		}
+	}
+	return append(regions, HealthRegion{Beg: beg, End: end, Class: class})
+}
+
+func readErrorClass(err error) string {
+	switch {
+	case errors.Is(err, diskio.ErrDeviceIO):
+		return diskio.ErrDeviceIO.Error()
+	case errors.Is(err, diskio.ErrShortRead):
+		return diskio.ErrShortRead.Error()
+	case errors.Is(err, diskio.ErrBeyondEnd):
+		return diskio.ErrBeyondEnd.Error()
+	default:
+		return HealthClassUnclassified
+	}
+}
+
+// healthChecker builds the DeviceHealth for a single device as
+// scanOneDevice goes.
+type healthChecker struct {
+	health  DeviceHealth
+	maxZero int
+	buf     []byte
+	last    healthRead
+}
+
+// A healthRead is the result of the healthChecker reading at a
+// sector.  It is a diskio.ReaderAt that replays that read, so that
+// checking for a node at that sector doesn't have to read it again.
+type healthRead struct {
+	dev  *btrfs.Device
+	addr btrfsvol.PhysicalAddr
+	dat  []byte
+	n    int
+	err  error
+}
+
+var _ diskio.ReaderAt[btrfsvol.PhysicalAddr] = (*healthRead)(nil)
+
+// ReadAt implements diskio.ReaderAt.
+func (r *healthRead) ReadAt(p []byte, off btrfsvol.PhysicalAddr) (int, error) {
+	if off != r.addr || len(p) > len(r.dat) {
+		return r.dev.ReadAt(p, off)
+	}
+	n := copy(p, r.dat[:r.n])
+	if n < len(p) {
+		return n, r.err
+	}
+	return n, nil
+}
+
+// read reads `size` bytes (at least a sector) at `pos`, for both
+// checkSector and for looking for a node at `pos`.
+func (hc *healthChecker) read(dev *btrfs.Device, pos btrfsvol.PhysicalAddr, size int) *healthRead {
+	if cap(hc.buf) < size {
+		hc.buf = make([]byte, size)
+	}
+	hc.last = healthRead{
+		dev:  dev,
+		addr: pos,
+		dat:  hc.buf[:size],
+	}
+	hc.last.n, hc.last.err = dev.ReadAt(hc.last.dat, pos)
+	return &hc.last
+}
+
+// checkSector records the sector at `pos` (which is not part of a
+// node) if it couldn't be read or if it is all zeros, going by the
+// read `r` that was done at `pos`.
+func (hc *healthChecker) checkSector(dev *btrfs.Device, pos btrfsvol.PhysicalAddr, r *healthRead) {
+	end := pos + btrfssum.BlockSize
+	n, err := r.n, r.err
+	if n < btrfssum.BlockSize && len(r.dat) > btrfssum.BlockSize {
+		// The failure might have been in a later sector of
+		// the read; see whether this sector is OK on its own.
+		n, err = dev.ReadAt(r.dat[:btrfssum.BlockSize], pos)
+	}
+	if n < btrfssum.BlockSize {
+		hc.health.ReadErrors = appendRegion(hc.health.ReadErrors, pos, end, readErrorClass(err))
+		return
+	}
+	for _, b := range r.dat[:btrfssum.BlockSize] {
+		if b != 0 {
+			return
+		}
+	}
+	hc.health.ZeroBytes += btrfssum.BlockSize
+	if regions := hc.health.ZeroRegions; len(regions) < hc.maxZero || (len(regions) > 0 && regions[len(regions)-1].End == pos) {
+		hc.health.ZeroRegions = appendRegion(regions, pos, end, "")
+	} else {
+		hc.health.ZeroRegionsTruncated = true
+	}
+}
+
+// WriteHealthReport writes a human-readable table summarizing each of
+// the devices, followed by a list of the regions that could not be
+// read.
+func WriteHealthReport(w io.Writer, report []DeviceHealth) error {
+	var buf bytes.Buffer
+	table := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0) //nolint:gomnd // This is what looks nice.
+	fmt.Fprintf(table, "DEVID\tNAME\tSCANNED\tNODES\tUNREADABLE\tEIO\tZERO\n")
+	for _, dev := range report {
+		textui.Fprintf(table, "%v\t%s\t%v\t%d\t%v\t%v\t%v\n",
+			dev.DevID, dev.Name,
+			textui.Portion[btrfsvol.PhysicalAddr]{N: dev.BytesScanned, D: dev.Size},
+			dev.NumNodes,
+			textui.IEC(int64(sumRegions(dev.ReadErrors)), "B"),
+			textui.IEC(int64(dev.IOErrorBytes()), "B"),
+			textui.IEC(int64(dev.ZeroBytes), "B"))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	for _, dev := range report {
+		for _, region := range dev.ReadErrors {
+			fmt.Fprintf(&buf, "device %v: [%v, %v): %s\n",
+				dev.DevID, region.Beg, region.End, region.Class)
+		}
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
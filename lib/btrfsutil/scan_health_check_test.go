@@ -0,0 +1,83 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+)
+
+// sectorFile is an in-memory file whose sectors are each either
+// zeros, ones, or fail with a given error.  A read that touches a
+// failing sector reads nothing.
+type sectorFile struct {
+	sectors []byte // '0', '1', or 'E' (EIO), or 'X' (unclassified)
+}
+
+func (sectorFile) Name() string { return "sectors" }
+func (f sectorFile) Size() btrfsvol.PhysicalAddr {
+	return btrfsvol.PhysicalAddr(len(f.sectors)) * btrfssum.BlockSize
+}
+func (sectorFile) Close() error { return nil }
+func (sectorFile) WriteAt([]byte, btrfsvol.PhysicalAddr) (int, error) {
+	return 0, errors.New("read-only")
+}
+
+func (f sectorFile) ReadAt(p []byte, off btrfsvol.PhysicalAddr) (int, error) {
+	for i := range p {
+		sector := int((off + btrfsvol.PhysicalAddr(i)) / btrfssum.BlockSize)
+		if sector >= len(f.sectors) {
+			return i, diskio.ClassifyReadError(f.Name(), f.Size(), off, len(p), i, errors.New("EOF"))
+		}
+		switch f.sectors[sector] {
+		case 'E':
+			return 0, diskio.ClassifyReadError(f.Name(), f.Size(), off, len(p), 0, syscall.EIO)
+		case 'X':
+			return 0, syscall.EBADF
+		case '0':
+			p[i] = 0
+		default:
+			p[i] = 1
+		}
+	}
+	return len(p), nil
+}
+
+func TestHealthCheckSector(t *testing.T) {
+	t.Parallel()
+	dev := &btrfs.Device{File: sectorFile{sectors: []byte("0010100E0X00")}}
+	hc := &healthChecker{maxZero: 3}
+	for i := 0; i < 12; i++ {
+		pos := btrfsvol.PhysicalAddr(i) * btrfssum.BlockSize
+		// Read 2 sectors at a time, like looking for a node
+		// that is 2 sectors big.
+		size := 2 * btrfssum.BlockSize
+		if i == 11 {
+			size = btrfssum.BlockSize
+		}
+		hc.checkSector(dev, pos, hc.read(dev, pos, size))
+	}
+	const bs = btrfssum.BlockSize
+	assert.Equal(t, []HealthRegion{
+		{Beg: 7 * bs, End: 8 * bs, Class: diskio.ErrDeviceIO.Error()},
+		{Beg: 9 * bs, End: 10 * bs, Class: HealthClassUnclassified},
+	}, hc.health.ReadErrors)
+	assert.Equal(t, []HealthRegion{
+		{Beg: 0, End: 2 * bs},
+		{Beg: 3 * bs, End: 4 * bs},
+		{Beg: 5 * bs, End: 7 * bs},
+	}, hc.health.ZeroRegions)
+	assert.True(t, hc.health.ZeroRegionsTruncated)
+	assert.Equal(t, btrfsvol.PhysicalAddr(8*bs), hc.health.ZeroBytes)
+	assert.Equal(t, btrfsvol.PhysicalAddr(bs), hc.health.IOErrorBytes())
+}
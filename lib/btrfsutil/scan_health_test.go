@@ -0,0 +1,154 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"bytes"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+)
+
+// eioFile is a memFile that fails with EIO when reading any byte in
+// [badBeg, badEnd).
+type eioFile struct {
+	memFile
+	badBeg, badEnd btrfsvol.PhysicalAddr
+}
+
+func (f eioFile) ReadAt(p []byte, off btrfsvol.PhysicalAddr) (int, error) {
+	if off < f.badEnd && off+btrfsvol.PhysicalAddr(len(p)) > f.badBeg {
+		return 0, diskio.ClassifyReadError(f.Name(), f.Size(), off, len(p), 0, syscall.EIO)
+	}
+	return f.memFile.ReadAt(p, off)
+}
+
+// readCountingFile counts the calls to ReadAt (whereas countingFile
+// counts bytes).
+type readCountingFile struct {
+	diskio.File[btrfsvol.PhysicalAddr]
+	reads atomic.Int64
+}
+
+func (f *readCountingFile) ReadAt(p []byte, off btrfsvol.PhysicalAddr) (int, error) {
+	f.reads.Add(1)
+	return f.File.ReadAt(p, off)
+}
+
+// TestListNodesHealth builds an image with a superblock, a node, and
+// an unreadable region, and checks that the health report tells the
+// unreadable region apart from the all-zero regions.
+func TestListNodesHealth(t *testing.T) {
+	t.Parallel()
+	const (
+		nodeSize = 4096
+		imgSize  = btrfsvol.PhysicalAddr(0x40000)
+		laddr    = btrfsvol.LogicalAddr(0x100000)
+		paddr    = btrfsvol.PhysicalAddr(0x20000)
+	)
+	fsUUID := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000005")
+	ctx := dlog.NewTestContext(t, false)
+
+	img := eioFile{
+		memFile: make(memFile, imgSize),
+		badBeg:  0x30000,
+		badEnd:  0x32000,
+	}
+	builder := &btrfstree.NodeBuilder{
+		Size:         nodeSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		Head: btrfstree.NodeHeader{
+			MetadataUUID: fsUUID,
+			Flags:        btrfstree.NodeWritten,
+			BackrefRev:   btrfstree.MixedBackrefRev,
+			Generation:   42,
+			Owner:        btrfsprim.FS_TREE_OBJECTID,
+		},
+		Alloc: func() (btrfsvol.LogicalAddr, error) { return laddr, nil },
+		Emit: func(node *btrfstree.Node) error {
+			bs, err := binstruct.Marshal(*node)
+			copy(img.memFile[paddr:], bs)
+			return err
+		},
+	}
+	require.NoError(t, builder.Add(btrfstree.Item{
+		Key:  btrfsprim.Key{ObjectID: 1, ItemType: btrfsitem.ORPHAN_ITEM_KEY},
+		Body: &btrfsitem.Empty{},
+	}))
+	_, _, err := builder.Finish()
+	require.NoError(t, err)
+
+	sb := btrfstree.Superblock{
+		FSUUID:       fsUUID,
+		Self:         btrfs.SuperblockAddrs[0],
+		Magic:        [8]byte{'_', 'B', 'H', 'R', 'f', 'S', '_', 'M'},
+		Generation:   42,
+		NumDevices:   1,
+		SectorSize:   btrfssum.BlockSize,
+		NodeSize:     nodeSize,
+		LeafSize:     nodeSize,
+		StripeSize:   btrfssum.BlockSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		DevItem:      btrfsitem.Dev{DevID: 1},
+	}
+	sb.Checksum, err = sb.CalculateChecksum()
+	require.NoError(t, err)
+	sbBytes, err := binstruct.Marshal(sb)
+	require.NoError(t, err)
+	copy(img.memFile[sb.Self:], sbBytes)
+
+	file := &readCountingFile{File: img}
+	fs := new(btrfs.FS)
+	require.NoError(t, fs.AddDevice(ctx, &btrfs.Device{File: file}))
+
+	// The health check shouldn't read anything that the scan
+	// doesn't already read, other than the superblock's sector
+	// (which the scan doesn't look for a node in).
+	file.reads.Store(0)
+	_, err = btrfsutil.ListNodes(ctx, fs)
+	require.NoError(t, err)
+	plainReads := file.reads.Swap(0)
+
+	nodeList, health, err := btrfsutil.ListNodesHealth(ctx, fs)
+	require.NoError(t, err)
+	assert.Equal(t, plainReads+1, file.reads.Load())
+	assert.Equal(t, []btrfsvol.LogicalAddr{laddr}, nodeList)
+	assert.Equal(t, []btrfsutil.DeviceHealth{{
+		DevID:        1,
+		Name:         "mem",
+		Size:         imgSize,
+		BytesScanned: imgSize,
+		NumNodes:     1,
+		ReadErrors: []btrfsutil.HealthRegion{
+			{Beg: 0x30000, End: 0x32000, Class: diskio.ErrDeviceIO.Error()},
+		},
+		ZeroBytes: imgSize - btrfssum.BlockSize - nodeSize - 0x2000,
+		ZeroRegions: []btrfsutil.HealthRegion{
+			{Beg: 0, End: 0x10000},
+			{Beg: 0x10000 + btrfssum.BlockSize, End: paddr},
+			{Beg: paddr + nodeSize, End: 0x30000},
+			{Beg: 0x32000, End: imgSize},
+		},
+	}}, health)
+	assert.Equal(t, btrfsvol.PhysicalAddr(0x2000), health[0].IOErrorBytes())
+
+	var out bytes.Buffer
+	require.NoError(t, btrfsutil.WriteHealthReport(&out, health))
+	assert.Contains(t, out.String(), "device 1: [0x0000000000030000, 0x0000000000032000): device I/O error\n")
+}
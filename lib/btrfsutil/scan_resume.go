@@ -0,0 +1,119 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// A ScanMarker records how far a sector-by-sector scan has gotten on
+// each device, so that an interrupted scan may be resumed.
+type ScanMarker struct {
+	Devices []DevScanMarker
+}
+
+// A DevScanMarker records how far a scan has gotten on one device,
+// along with enough about the device to tell whether the marker
+// still applies to it.
+type DevScanMarker struct {
+	DevID   btrfsvol.DeviceID
+	DevUUID btrfsprim.UUID
+	Size    btrfsvol.PhysicalAddr
+	// Fingerprint is the checksum of the device's superblock.
+	Fingerprint btrfssum.CSum
+	// Scanned is the address below which every sector of the
+	// device has been scanned.
+	Scanned btrfsvol.PhysicalAddr
+}
+
+// ScanProgress tracks the progress of a scan (as started by
+// ScanDevicesResume) as it runs.
+type ScanProgress struct {
+	devs    []DevScanMarker
+	scanned map[btrfsvol.DeviceID]*atomic.Int64
+}
+
+// NewScanProgress returns a ScanProgress for scanning `fs`.  If
+// `marker` is nil, the scan starts from the beginning of each device;
+// otherwise it starts from where the marker says.  An error is
+// returned if the marker does not match the devices of `fs` (a
+// different set of devices, or devices that have changed size or
+// have a different superblock); the caller may then want to fall
+// back to a full scan.
+func NewScanProgress(fs *btrfs.FS, marker *ScanMarker) (*ScanProgress, error) {
+	ret := &ScanProgress{
+		scanned: make(map[btrfsvol.DeviceID]*atomic.Int64),
+	}
+	pvs := fs.LV.PhysicalVolumes()
+	for _, devID := range maps.SortedKeys(pvs) {
+		dev := pvs[devID]
+		sb, err := dev.Superblock()
+		if err != nil {
+			return nil, fmt.Errorf("device %v: %w", devID, err)
+		}
+		ret.devs = append(ret.devs, DevScanMarker{
+			DevID:       devID,
+			DevUUID:     sb.DevItem.DevUUID,
+			Size:        dev.Size(),
+			Fingerprint: sb.Checksum,
+		})
+		ret.scanned[devID] = new(atomic.Int64)
+	}
+	if marker == nil {
+		return ret, nil
+	}
+
+	if len(marker.Devices) != len(ret.devs) {
+		return nil, fmt.Errorf("scan marker: marker is for %d devices, but the filesystem has %d",
+			len(marker.Devices), len(ret.devs))
+	}
+	for _, m := range marker.Devices {
+		i := sort.Search(len(ret.devs), func(i int) bool {
+			return ret.devs[i].DevID >= m.DevID
+		})
+		if i == len(ret.devs) || ret.devs[i].DevID != m.DevID {
+			return nil, fmt.Errorf("scan marker: device %v: not in the filesystem", m.DevID)
+		}
+		dev := ret.devs[i]
+		switch {
+		case m.DevUUID != dev.DevUUID:
+			return nil, fmt.Errorf("scan marker: device %v: marker has UUID %v, but device has UUID %v",
+				m.DevID, m.DevUUID, dev.DevUUID)
+		case m.Size != dev.Size:
+			return nil, fmt.Errorf("scan marker: device %v: marker has size %v, but device has size %v",
+				m.DevID, m.Size, dev.Size)
+		case m.Fingerprint != dev.Fingerprint:
+			return nil, fmt.Errorf("scan marker: device %v: superblock has changed since the marker was written",
+				m.DevID)
+		case m.Scanned < 0 || m.Scanned > dev.Size || m.Scanned%btrfssum.BlockSize != 0:
+			return nil, fmt.Errorf("scan marker: device %v: invalid scanned offset %v",
+				m.DevID, m.Scanned)
+		}
+		ret.scanned[m.DevID].Store(int64(m.Scanned))
+	}
+	return ret, nil
+}
+
+// Marker returns a snapshot of the progress.  It is safe to call
+// while the scan is running; every node below the returned marker's
+// Scanned offsets has already been passed to the scanner.
+func (p *ScanProgress) Marker() ScanMarker {
+	ret := ScanMarker{
+		Devices: make([]DevScanMarker, len(p.devs)),
+	}
+	for i, dev := range p.devs {
+		dev.Scanned = btrfsvol.PhysicalAddr(p.scanned[dev.DevID].Load())
+		ret.Devices[i] = dev
+	}
+	return ret
+}
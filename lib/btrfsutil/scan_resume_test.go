@@ -0,0 +1,141 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+// TestListNodesStreamResume builds an image with two nodes, and
+// checks that a scan resumed from a marker between them finds only
+// the second, and that markers that don't match the image are
+// rejected.
+func TestListNodesStreamResume(t *testing.T) {
+	t.Parallel()
+	const (
+		nodeSize = 4096
+		imgSize  = btrfsvol.PhysicalAddr(0x40000)
+	)
+	nodes := map[btrfsvol.LogicalAddr]btrfsvol.PhysicalAddr{
+		0x100000: 0x20000,
+		0x200000: 0x30000,
+	}
+	fsUUID := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000004")
+	ctx := dlog.NewTestContext(t, false)
+
+	img := make(memFile, imgSize)
+	for laddr, paddr := range nodes {
+		laddr, paddr := laddr, paddr
+		builder := &btrfstree.NodeBuilder{
+			Size:         nodeSize,
+			ChecksumType: btrfssum.TYPE_CRC32,
+			Head: btrfstree.NodeHeader{
+				MetadataUUID: fsUUID,
+				Flags:        btrfstree.NodeWritten,
+				BackrefRev:   btrfstree.MixedBackrefRev,
+				Generation:   42,
+				Owner:        btrfsprim.FS_TREE_OBJECTID,
+			},
+			Alloc: func() (btrfsvol.LogicalAddr, error) { return laddr, nil },
+			Emit: func(node *btrfstree.Node) error {
+				bs, err := binstruct.Marshal(*node)
+				copy(img[paddr:], bs)
+				return err
+			},
+		}
+		require.NoError(t, builder.Add(btrfstree.Item{
+			Key:  btrfsprim.Key{ObjectID: 1, ItemType: btrfsitem.ORPHAN_ITEM_KEY},
+			Body: &btrfsitem.Empty{},
+		}))
+		_, _, err := builder.Finish()
+		require.NoError(t, err)
+	}
+
+	sb := btrfstree.Superblock{
+		FSUUID:       fsUUID,
+		Self:         btrfs.SuperblockAddrs[0],
+		Magic:        [8]byte{'_', 'B', 'H', 'R', 'f', 'S', '_', 'M'},
+		Generation:   42,
+		NumDevices:   1,
+		SectorSize:   btrfssum.BlockSize,
+		NodeSize:     nodeSize,
+		LeafSize:     nodeSize,
+		StripeSize:   btrfssum.BlockSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		DevItem:      btrfsitem.Dev{DevID: 1},
+	}
+	var err error
+	sb.Checksum, err = sb.CalculateChecksum()
+	require.NoError(t, err)
+	sbBytes, err := binstruct.Marshal(sb)
+	require.NoError(t, err)
+	copy(img[sb.Self:], sbBytes)
+
+	fs := new(btrfs.FS)
+	require.NoError(t, fs.AddDevice(ctx, &btrfs.Device{File: img}))
+
+	scan := func(marker *btrfsutil.ScanMarker) ([]btrfsvol.LogicalAddr, []btrfsutil.ScanMarker, btrfsutil.ScanMarker) {
+		progress, err := btrfsutil.NewScanProgress(fs, marker)
+		require.NoError(t, err)
+		var found []btrfsvol.LogicalAddr
+		var markers []btrfsutil.ScanMarker
+		require.NoError(t, btrfsutil.ListNodesStreamResume(ctx, fs, progress, func(addr btrfsvol.LogicalAddr) error {
+			found = append(found, addr)
+			markers = append(markers, progress.Marker())
+			return nil
+		}))
+		return found, markers, progress.Marker()
+	}
+
+	// Full scan.
+	found, markers, final := scan(nil)
+	assert.Equal(t, []btrfsvol.LogicalAddr{0x100000, 0x200000}, found)
+	require.Len(t, final.Devices, 1)
+	assert.Equal(t, imgSize, final.Devices[0].Scanned)
+	assert.Equal(t, sb.Checksum, final.Devices[0].Fingerprint)
+	// A marker taken while handling a node must not claim to be
+	// past that node.
+	require.Len(t, markers, 2)
+	assert.LessOrEqual(t, markers[0].Devices[0].Scanned, btrfsvol.PhysicalAddr(0x20000))
+	assert.LessOrEqual(t, markers[1].Devices[0].Scanned, btrfsvol.PhysicalAddr(0x30000))
+
+	// Resumed scan.
+	marker := final
+	marker.Devices = append([]btrfsutil.DevScanMarker(nil), final.Devices...)
+	marker.Devices[0].Scanned = 0x28000
+	found, _, final = scan(&marker)
+	assert.Equal(t, []btrfsvol.LogicalAddr{0x200000}, found)
+	assert.Equal(t, imgSize, final.Devices[0].Scanned)
+
+	// Inconsistent markers.
+	badMarkers := map[string]func(*btrfsutil.DevScanMarker){
+		"size":        func(m *btrfsutil.DevScanMarker) { m.Size *= 2 },
+		"fingerprint": func(m *btrfsutil.DevScanMarker) { m.Fingerprint[0] ^= 0xff },
+		"devid":       func(m *btrfsutil.DevScanMarker) { m.DevID = 2 },
+		"unaligned":   func(m *btrfsutil.DevScanMarker) { m.Scanned = 0x28001 },
+		"too-far":     func(m *btrfsutil.DevScanMarker) { m.Scanned = imgSize + btrfssum.BlockSize },
+	}
+	for tcName, mutate := range badMarkers {
+		bad := btrfsutil.ScanMarker{
+			Devices: append([]btrfsutil.DevScanMarker(nil), marker.Devices...),
+		}
+		mutate(&bad.Devices[0])
+		_, err := btrfsutil.NewScanProgress(fs, &bad)
+		assert.Error(t, err, tcName)
+	}
+}
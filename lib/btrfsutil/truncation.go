@@ -0,0 +1,217 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// An OutOfBoundsNode is a node that is reachable from a set of roots,
+// but that maps to a physical address past the end of its device.
+type OutOfBoundsNode struct {
+	Tree    btrfsprim.ObjID
+	LAddr   btrfsvol.LogicalAddr
+	PAddr   btrfsvol.QualifiedPhysicalAddr
+	DevSize btrfsvol.PhysicalAddr
+}
+
+func (n OutOfBoundsNode) String() string {
+	return fmt.Sprintf("tree %v: node@%v maps to %v, but the device is only %v bytes",
+		n.Tree, n.LAddr, n.PAddr, n.DevSize)
+}
+
+// A RootSet is one generation's worth of tree roots: either the
+// roots that the superblock itself points at, or one of the
+// superblock's backup roots.
+type RootSet struct {
+	// Source is "superblock" or "backup_roots[N]".
+	Source     string
+	Generation btrfsprim.Generation
+	// Backup is the backup root that the RootSet came from; it is
+	// nil if Source is "superblock".
+	Backup *btrfstree.RootBackup
+
+	// OutOfBounds is the nodes reachable from the roots that are
+	// past the end of the device that they map to.  Nodes below an
+	// out-of-bounds node are not checked (as they can't be read).
+	OutOfBounds []OutOfBoundsNode
+}
+
+// InBounds returns whether all of the nodes reachable from the roots
+// are within the bounds of their devices.
+func (rs RootSet) InBounds() bool {
+	return len(rs.OutOfBounds) == 0
+}
+
+// CheckTruncation checks whether the filesystem's images have been
+// truncated (or were captured while the filesystem was growing) such
+// that nodes reachable from the superblock are past the end of the
+// device that they map to.  It checks the superblock's own roots and
+// each of its backup roots, returning a RootSet for each, newest
+// generation first.
+//
+// Every node that is reachable from the roots (including the roots of
+// the trees listed in the ROOT_TREE) is checked, following
+// key-pointers; nodes that can't be read for other reasons (or that
+// are in an unmapped region) are skipped, as they are not evidence of
+// truncation.
+func CheckTruncation(ctx context.Context, fs *btrfs.FS) ([]RootSet, error) {
+	sb, err := fs.Superblock()
+	if err != nil {
+		return nil, err
+	}
+	devSizes := make(map[btrfsvol.DeviceID]btrfsvol.PhysicalAddr)
+	for devID, dev := range fs.LV.PhysicalVolumes() {
+		devSizes[devID] = dev.Size()
+	}
+	c := &truncationChecker{
+		ctx:      ctx,
+		fs:       fs,
+		nodeSize: btrfsvol.AddrDelta(sb.NodeSize),
+		devSizes: devSizes,
+	}
+
+	check := func(rs *RootSet, roots ...truncationRoot) {
+		c.visited = make(containers.Set[btrfsvol.LogicalAddr])
+		c.ret = nil
+		for _, r := range roots {
+			if r.addr == 0 {
+				continue
+			}
+			c.checkNode(r)
+		}
+		rs.OutOfBounds = c.ret
+	}
+
+	ret := make([]RootSet, 0, 1+len(sb.SuperRoots))
+	rs := RootSet{
+		Source:     "superblock",
+		Generation: sb.Generation,
+	}
+	check(&rs,
+		truncationRoot{btrfsprim.ROOT_TREE_OBJECTID, sb.RootTree, sb.RootLevel, sb.Generation},
+		truncationRoot{btrfsprim.CHUNK_TREE_OBJECTID, sb.ChunkTree, sb.ChunkLevel, sb.ChunkRootGeneration},
+		truncationRoot{btrfsprim.TREE_LOG_OBJECTID, sb.LogTree, sb.LogLevel, 0})
+	ret = append(ret, rs)
+	for i := range sb.SuperRoots {
+		backup := sb.SuperRoots[i]
+		if !backup.TreeRootGen.Known() || backup.TreeRootGen > sb.Generation {
+			continue
+		}
+		rs := RootSet{
+			Source:     fmt.Sprintf("backup_roots[%d]", i),
+			Generation: backup.TreeRootGen,
+			Backup:     &backup,
+		}
+		check(&rs,
+			truncationRoot{btrfsprim.ROOT_TREE_OBJECTID, btrfsvol.LogicalAddr(backup.TreeRoot), backup.TreeRootLevel, backup.TreeRootGen},
+			truncationRoot{btrfsprim.CHUNK_TREE_OBJECTID, btrfsvol.LogicalAddr(backup.ChunkRoot), backup.ChunkRootLevel, backup.ChunkRootGen},
+			truncationRoot{btrfsprim.EXTENT_TREE_OBJECTID, btrfsvol.LogicalAddr(backup.ExtentRoot), backup.ExtentRootLevel, backup.ExtentRootGen},
+			truncationRoot{btrfsprim.FS_TREE_OBJECTID, btrfsvol.LogicalAddr(backup.FSRoot), backup.FSRootLevel, backup.FSRootGen},
+			truncationRoot{btrfsprim.DEV_TREE_OBJECTID, btrfsvol.LogicalAddr(backup.DevRoot), backup.DevRootLevel, backup.DevRootGen},
+			truncationRoot{btrfsprim.CSUM_TREE_OBJECTID, btrfsvol.LogicalAddr(backup.ChecksumRoot), backup.ChecksumRootLevel, backup.ChecksumRootGen})
+		ret = append(ret, rs)
+	}
+	// The backup roots are a ring, so they aren't necessarily in
+	// order.
+	for i := 1; i < len(ret); i++ {
+		for j := i; j > 0 && ret[j].Generation > ret[j-1].Generation; j-- {
+			ret[j], ret[j-1] = ret[j-1], ret[j]
+		}
+	}
+	return ret, nil
+}
+
+type truncationRoot struct {
+	tree  btrfsprim.ObjID
+	addr  btrfsvol.LogicalAddr
+	level uint8
+	gen   btrfsprim.Generation
+}
+
+type truncationChecker struct {
+	ctx      context.Context //nolint:containedctx // only lives for the duration of CheckTruncation
+	fs       *btrfs.FS
+	nodeSize btrfsvol.AddrDelta
+	devSizes map[btrfsvol.DeviceID]btrfsvol.PhysicalAddr
+
+	visited containers.Set[btrfsvol.LogicalAddr]
+	ret     []OutOfBoundsNode
+}
+
+func (c *truncationChecker) checkNode(r truncationRoot) {
+	if c.visited.Has(r.addr) {
+		return
+	}
+	c.visited.Insert(r.addr)
+
+	paddrs, _ := c.fs.LV.Resolve(r.addr)
+	if len(paddrs) == 0 {
+		dlog.Debugf(c.ctx, "check truncation: tree %v: node@%v is not mapped", r.tree, r.addr)
+		return
+	}
+	sortedPAddrs := maps.Keys(paddrs)
+	sort.Slice(sortedPAddrs, func(i, j int) bool {
+		return sortedPAddrs[i].Compare(sortedPAddrs[j]) < 0
+	})
+	inBounds := false
+	for _, paddr := range sortedPAddrs {
+		if devSize := c.devSizes[paddr.Dev]; paddr.Addr.Add(c.nodeSize) > devSize {
+			c.ret = append(c.ret, OutOfBoundsNode{
+				Tree:    r.tree,
+				LAddr:   r.addr,
+				PAddr:   paddr,
+				DevSize: devSize,
+			})
+		} else {
+			inBounds = true
+		}
+	}
+	if !inBounds {
+		return
+	}
+
+	exp := btrfstree.NodeExpectations{
+		LAddr: containers.OptionalValue(r.addr),
+		Level: containers.OptionalValue(r.level),
+	}
+	if r.gen != 0 {
+		exp.Generation = containers.OptionalValue(r.gen)
+	}
+	node, err := c.fs.AcquireNode(c.ctx, r.addr, exp)
+	if err != nil {
+		dlog.Debugf(c.ctx, "check truncation: tree %v: node@%v: %v", r.tree, r.addr, err)
+		return
+	}
+	var next []truncationRoot
+	if node.Head.Level > 0 {
+		for _, kp := range node.BodyInterior {
+			next = append(next, truncationRoot{r.tree, kp.BlockPtr, node.Head.Level - 1, kp.Generation})
+		}
+	} else if r.tree == btrfsprim.ROOT_TREE_OBJECTID {
+		for _, item := range node.BodyLeaf {
+			if body, ok := item.Body.(*btrfsitem.Root); ok {
+				next = append(next, truncationRoot{item.Key.ObjectID, body.ByteNr, body.Level, body.Generation})
+			}
+		}
+	}
+	c.fs.ReleaseNode(node)
+
+	for _, child := range next {
+		c.checkNode(child)
+	}
+}
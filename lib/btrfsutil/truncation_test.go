@@ -0,0 +1,124 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+)
+
+// TestCheckTruncation builds an image whose superblock points at a
+// ROOT_TREE node past the end of the image, but whose backup root
+// points at an older ROOT_TREE node that is within the image.
+func TestCheckTruncation(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	const (
+		nodeSize = 4096
+		imgSize  = btrfsvol.PhysicalAddr(0x40000)
+		laddrOld = btrfsvol.LogicalAddr(0x100000)
+		paddrOld = btrfsvol.PhysicalAddr(0x20000)
+		laddrNew = btrfsvol.LogicalAddr(0x200000)
+		paddrNew = btrfsvol.PhysicalAddr(0x40000)
+	)
+	fsUUID := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000002")
+
+	var oldNode []byte
+	builder := &btrfstree.NodeBuilder{
+		Size:         nodeSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		Head: btrfstree.NodeHeader{
+			MetadataUUID: fsUUID,
+			Flags:        btrfstree.NodeWritten,
+			BackrefRev:   btrfstree.MixedBackrefRev,
+			Generation:   41,
+			Owner:        btrfsprim.ROOT_TREE_OBJECTID,
+		},
+		Alloc: func() (btrfsvol.LogicalAddr, error) { return laddrOld, nil },
+		Emit: func(node *btrfstree.Node) error {
+			var err error
+			oldNode, err = binstruct.Marshal(*node)
+			return err
+		},
+	}
+	require.NoError(t, builder.Add(btrfstree.Item{
+		Key:  btrfsprim.Key{ObjectID: 1, ItemType: btrfsitem.ORPHAN_ITEM_KEY},
+		Body: &btrfsitem.Empty{},
+	}))
+	_, _, err := builder.Finish()
+	require.NoError(t, err)
+
+	img := make(memFile, imgSize)
+	sb := btrfstree.Superblock{
+		FSUUID:       fsUUID,
+		Self:         btrfs.SuperblockAddrs[0],
+		Magic:        [8]byte{'_', 'B', 'H', 'R', 'f', 'S', '_', 'M'},
+		Generation:   42,
+		RootTree:     laddrNew,
+		NumDevices:   1,
+		SectorSize:   btrfssum.BlockSize,
+		NodeSize:     nodeSize,
+		LeafSize:     nodeSize,
+		StripeSize:   btrfssum.BlockSize,
+		ChecksumType: btrfssum.TYPE_CRC32,
+		DevItem:      btrfsitem.Dev{DevID: 1},
+	}
+	sb.SuperRoots[0] = btrfstree.RootBackup{
+		TreeRoot:    btrfsprim.ObjID(laddrOld),
+		TreeRootGen: 41,
+	}
+	sb.Checksum, err = sb.CalculateChecksum()
+	require.NoError(t, err)
+	sbBytes, err := binstruct.Marshal(sb)
+	require.NoError(t, err)
+	copy(img[sb.Self:], sbBytes)
+	copy(img[paddrOld:], oldNode)
+
+	fs := new(btrfs.FS)
+	require.NoError(t, fs.AddDevice(ctx, &btrfs.Device{File: img}))
+	for laddr, paddr := range map[btrfsvol.LogicalAddr]btrfsvol.PhysicalAddr{laddrOld: paddrOld, laddrNew: paddrNew} {
+		require.NoError(t, fs.LV.AddMapping(btrfsvol.Mapping{
+			LAddr:      laddr,
+			PAddr:      btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: paddr},
+			Size:       0x10000,
+			SizeLocked: true,
+			Flags:      containers.OptionalValue(btrfsvol.BLOCK_GROUP_METADATA),
+		}))
+	}
+
+	sets, err := btrfsutil.CheckTruncation(ctx, fs)
+	require.NoError(t, err)
+	require.Len(t, sets, 2)
+
+	assert.Equal(t, "superblock", sets[0].Source)
+	assert.Equal(t, btrfsprim.Generation(42), sets[0].Generation)
+	assert.False(t, sets[0].InBounds())
+	assert.Equal(t, []btrfsutil.OutOfBoundsNode{{
+		Tree:    btrfsprim.ROOT_TREE_OBJECTID,
+		LAddr:   laddrNew,
+		PAddr:   btrfsvol.QualifiedPhysicalAddr{Dev: 1, Addr: paddrNew},
+		DevSize: imgSize,
+	}}, sets[0].OutOfBounds)
+
+	assert.Equal(t, "backup_roots[0]", sets[1].Source)
+	assert.Equal(t, btrfsprim.Generation(41), sets[1].Generation)
+	assert.True(t, sets[1].InBounds())
+	require.NotNil(t, sets[1].Backup)
+	assert.Equal(t, btrfsprim.ObjID(laddrOld), sets[1].Backup.TreeRoot)
+}
@@ -0,0 +1,1037 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/datawire/dlib/derror"
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/containers"
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+	"git.lukeshu.com/btrfs-progs-ng/lib/slices"
+)
+
+const (
+	// writeTreesAlign is the alignment of the chunks that
+	// WriteTrees allocates, in both the logical and the physical
+	// address spaces.
+	writeTreesAlign = 1 << 20 // 1MiB
+	// writeTreesStripeLen is BTRFS_STRIPE_LEN.
+	writeTreesStripeLen = 64 << 10
+	// writeTreesMinSysChunk is the smallest SYSTEM chunk that
+	// WriteTrees allocates (the same as mkfs.btrfs).
+	writeTreesMinSysChunk = 4 << 20
+	// DefaultMetadataChunkSize is the default for
+	// WriteTreesConfig.MetadataChunkSize.
+	DefaultMetadataChunkSize = 256 << 20
+	// writeTreesMaxAttempts bounds the search for a layout of the
+	// bookkeeping trees that describes itself; in practice it
+	// settles within 2 or 3 attempts.
+	writeTreesMaxAttempts = 16
+)
+
+// WriteTreesConfig controls WriteTrees.
+type WriteTreesConfig struct {
+	// MetadataChunkSize is the size of each METADATA chunk to
+	// allocate; it must be a multiple of the node size.  If
+	// zero, DefaultMetadataChunkSize is used.
+	MetadataChunkSize btrfsvol.AddrDelta
+	// SkipData is whether to not copy the contents of the data
+	// extents in to the new image; the data chunks are still
+	// laid out, but are left as holes.
+	SkipData bool
+}
+
+// A WrittenTree describes a tree written by WriteTrees.
+type WrittenTree struct {
+	ID    btrfsprim.ObjID
+	Root  btrfsvol.LogicalAddr
+	Level uint8
+	Nodes int
+	Items int
+}
+
+// A WriteTreesReport describes the image written by WriteTrees.
+type WriteTreesReport struct {
+	Generation btrfsprim.Generation
+	// Size is the size of the image; the caller should extend the
+	// output file to this size, as the end of the image may be a
+	// hole that was never written to.
+	Size btrfsvol.PhysicalAddr
+
+	Trees []WrittenTree
+	// Dropped is the trees that had a ROOT_ITEM but were not
+	// written, and why.
+	Dropped map[btrfsprim.ObjID]string
+	// SkippedItems is the number of items that were unreadable,
+	// or could not be added to their tree (such as for being
+	// out-of-order), and so were left out.
+	SkippedItems int
+
+	ExtentProblems []ExtentProblem
+
+	DataBytes  int64
+	DataErrors int
+}
+
+type writeTreesAction int
+
+const (
+	writeTreesDrop writeTreesAction = iota
+	writeTreesCopy
+	writeTreesRegenerate
+)
+
+// writeTreesDisposition returns what WriteTrees does with the tree
+// that a ROOT_ITEM describes, and if it is dropped, then why.
+func writeTreesDisposition(treeID btrfsprim.ObjID) (writeTreesAction, string) {
+	switch {
+	case treeID == btrfsprim.FS_TREE_OBJECTID,
+		treeID == btrfsprim.CSUM_TREE_OBJECTID,
+		treeID == btrfsprim.UUID_TREE_OBJECTID,
+		treeID == btrfsprim.DATA_RELOC_TREE_OBJECTID,
+		treeID >= btrfsprim.FIRST_FREE_OBJECTID && treeID <= btrfsprim.LAST_FREE_OBJECTID:
+		return writeTreesCopy, ""
+	case treeID == btrfsprim.EXTENT_TREE_OBJECTID,
+		treeID == btrfsprim.DEV_TREE_OBJECTID:
+		return writeTreesRegenerate, ""
+	case treeID == btrfsprim.QUOTA_TREE_OBJECTID:
+		return writeTreesDrop, "qgroup accounting is not carried over"
+	case treeID == btrfsprim.FREE_SPACE_TREE_OBJECTID:
+		return writeTreesDrop, "free space is not tracked in the new image"
+	case treeID == btrfsprim.BLOCK_GROUP_TREE_OBJECTID:
+		return writeTreesDrop, "block groups are written to the EXTENT_TREE instead"
+	case treeID == btrfsprim.TREE_RELOC_OBJECTID:
+		return writeTreesDrop, "an interrupted balance is not carried over"
+	default:
+		return writeTreesDrop, "unknown kind of tree"
+	}
+}
+
+type writtenChunk struct {
+	LAddr btrfsvol.LogicalAddr
+	PAddr btrfsvol.PhysicalAddr
+	Size  btrfsvol.AddrDelta
+	Flags btrfsvol.BlockGroupFlags
+}
+
+func (c writtenChunk) Key() btrfsprim.Key {
+	return btrfsprim.Key{
+		ObjectID: btrfsprim.FIRST_CHUNK_TREE_OBJECTID,
+		ItemType: btrfsitem.CHUNK_ITEM_KEY,
+		Offset:   uint64(c.LAddr),
+	}
+}
+
+// treeWriterAlloc is the allocation state of a treeWriter; it is a
+// plain value so that it can be saved and restored.
+type treeWriterAlloc struct {
+	phys      btrfsvol.PhysicalAddr // next free physical address
+	nextLAddr btrfsvol.LogicalAddr  // where the next new chunk goes
+	numChunks int
+	metaNext  btrfsvol.LogicalAddr // next free node in the current METADATA chunk
+	metaEnd   btrfsvol.LogicalAddr // end of the current METADATA chunk
+}
+
+type treeWriter struct {
+	ctx    context.Context //nolint:containedctx // The treeWriter is only used within a single WriteTrees call.
+	src    btrfs.ReadableFS
+	out    diskio.File[btrfsvol.PhysicalAddr]
+	cfg    WriteTreesConfig
+	report *WriteTreesReport
+
+	sb   btrfstree.Superblock // the new superblock
+	head btrfstree.NodeHeader // the template for new nodes
+
+	alloc  treeWriterAlloc
+	chunks []writtenChunk // sorted by LAddr
+
+	extents     *ExtentTreeBuilder
+	dataExtents map[btrfsvol.LogicalAddr]btrfsvol.AddrDelta
+	maxItemGen  btrfsprim.Generation
+	writeErr    error
+}
+
+func alignUp[T ~int64](x, align T) T {
+	return (x + align - 1) / align * align
+}
+
+func (w *treeWriter) allocPhys(size btrfsvol.AddrDelta) btrfsvol.PhysicalAddr {
+	paddr := w.alloc.phys
+	// Keep clear of the superblock mirrors.
+	for _, sbAddr := range btrfs.SuperblockAddrs[1:] {
+		if paddr < sbAddr+btrfs.SuperblockSize && sbAddr < paddr.Add(size) {
+			paddr = alignUp(sbAddr+btrfs.SuperblockSize, writeTreesAlign)
+		}
+	}
+	w.alloc.phys = paddr.Add(size)
+	return paddr
+}
+
+func (w *treeWriter) addChunk(laddr btrfsvol.LogicalAddr, size btrfsvol.AddrDelta, flags btrfsvol.BlockGroupFlags) writtenChunk {
+	chunk := writtenChunk{
+		LAddr: laddr,
+		PAddr: w.allocPhys(size),
+		Size:  size,
+		Flags: flags,
+	}
+	w.chunks = append(w.chunks, chunk)
+	w.alloc.numChunks = len(w.chunks)
+	if end := alignUp(laddr.Add(size), writeTreesAlign); end > w.alloc.nextLAddr {
+		w.alloc.nextLAddr = end
+	}
+	return chunk
+}
+
+func (w *treeWriter) saveAlloc() treeWriterAlloc {
+	return w.alloc
+}
+
+func (w *treeWriter) restoreAlloc(saved treeWriterAlloc) {
+	w.alloc = saved
+	w.chunks = w.chunks[:saved.numChunks]
+}
+
+func (w *treeWriter) allocNode() btrfsvol.LogicalAddr {
+	nodeSize := btrfsvol.AddrDelta(w.sb.NodeSize)
+	if w.alloc.metaNext.Add(nodeSize) > w.alloc.metaEnd {
+		chunk := w.addChunk(w.alloc.nextLAddr, w.cfg.MetadataChunkSize, btrfsvol.BLOCK_GROUP_METADATA)
+		w.alloc.metaNext = chunk.LAddr
+		w.alloc.metaEnd = chunk.LAddr.Add(chunk.Size)
+	}
+	addr := w.alloc.metaNext
+	w.alloc.metaNext = addr.Add(nodeSize)
+	return addr
+}
+
+func (w *treeWriter) chunkAt(laddr btrfsvol.LogicalAddr) (writtenChunk, bool) {
+	i := sort.Search(len(w.chunks), func(i int) bool {
+		return w.chunks[i].LAddr.Add(w.chunks[i].Size) > laddr
+	})
+	if i == len(w.chunks) || w.chunks[i].LAddr > laddr {
+		return writtenChunk{}, false
+	}
+	return w.chunks[i], true
+}
+
+func (w *treeWriter) writeNode(node *btrfstree.Node) error {
+	chunk, ok := w.chunkAt(node.Head.Addr)
+	if !ok {
+		return fmt.Errorf("node@%v: not in any chunk", node.Head.Addr)
+	}
+	dat, err := binstruct.Marshal(*node)
+	if err != nil {
+		return fmt.Errorf("node@%v: %w", node.Head.Addr, err)
+	}
+	if _, err := w.out.WriteAt(dat, chunk.PAddr.Add(node.Head.Addr.Sub(chunk.LAddr))); err != nil {
+		return fmt.Errorf("node@%v: %w", node.Head.Addr, err)
+	}
+	return nil
+}
+
+func (w *treeWriter) newBuilder(treeID btrfsprim.ObjID, alloc func() (btrfsvol.LogicalAddr, error), emit func(*btrfstree.Node) error) *btrfstree.NodeBuilder {
+	head := w.head
+	head.Owner = treeID
+	return &btrfstree.NodeBuilder{
+		Size:         w.sb.NodeSize,
+		ChecksumType: w.sb.ChecksumType,
+		Head:         head,
+		Alloc:        alloc,
+		Emit:         emit,
+	}
+}
+
+// copyTree copies a tree from the source filesystem in to newly
+// allocated nodes, recording its tree blocks and file extents in
+// w.extents.  If the tree cannot be read at all, then it is recorded
+// as dropped and nil is returned.  An error is only returned if
+// writing to the output fails.
+func (w *treeWriter) copyTree(treeID btrfsprim.ObjID) (*WrittenTree, error) {
+	ctx := dlog.WithField(w.ctx, "btrfs.util.write-trees.tree", treeID)
+	tree, err := w.src.ForrestLookup(ctx, treeID)
+	if err != nil {
+		w.report.Dropped[treeID] = err.Error()
+		dlog.Errorf(ctx, "dropping tree: %v", err)
+		return nil, nil
+	}
+	ret := &WrittenTree{ID: treeID}
+	builder := w.newBuilder(treeID,
+		func() (btrfsvol.LogicalAddr, error) { return w.allocNode(), nil },
+		func(node *btrfstree.Node) error {
+			ret.Nodes++
+			firstKey, _ := node.MinItem()
+			w.extents.AddTreeBlock(node.Head.Addr, node.Head.Generation, node.Head.Level, firstKey, treeID)
+			if err := w.writeNode(node); err != nil {
+				w.writeErr = err
+				return err
+			}
+			return nil
+		})
+	if err := tree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		switch body := item.Body.(type) {
+		case *btrfsitem.Error:
+			dlog.Errorf(ctx, "skipping item %v: %v", item.Key, body.Err)
+			w.report.SkippedItems++
+			return true
+		case *btrfsitem.FileExtent:
+			w.extents.AddFileExtent(treeID, item.Key, *body)
+			if body.Type != btrfsitem.FILE_EXTENT_INLINE && body.BodyExtent.DiskByteNr != 0 {
+				if body.BodyExtent.DiskNumBytes > w.dataExtents[body.BodyExtent.DiskByteNr] {
+					w.dataExtents[body.BodyExtent.DiskByteNr] = body.BodyExtent.DiskNumBytes
+				}
+			}
+			if body.Generation > w.maxItemGen {
+				w.maxItemGen = body.Generation
+			}
+		case *btrfsitem.Inode:
+			if body.Generation > w.maxItemGen {
+				w.maxItemGen = body.Generation
+			}
+			if gen := btrfsprim.Generation(body.TransID); body.TransID > 0 && gen > w.maxItemGen {
+				w.maxItemGen = gen
+			}
+		}
+		item.Body = item.Body.CloneItem()
+		if err := builder.Add(item); err != nil {
+			if w.writeErr != nil {
+				return false
+			}
+			dlog.Errorf(ctx, "skipping item: %v", err)
+			w.report.SkippedItems++
+			return true
+		}
+		ret.Items++
+		return true
+	}); err != nil {
+		if w.writeErr != nil {
+			return nil, w.writeErr
+		}
+		// Write out what could be read.
+		dlog.Errorf(ctx, "tree is incomplete: %v", err)
+	}
+	if w.writeErr != nil {
+		return nil, w.writeErr
+	}
+	kp, level, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+	ret.Root = kp.BlockPtr
+	ret.Level = level
+	return ret, nil
+}
+
+// dryRun returns the levels of the nodes that a NodeBuilder would
+// emit for `items`, in the order that it would emit them.
+func (w *treeWriter) dryRun(items []btrfstree.Item) ([]uint8, error) {
+	var levels []uint8
+	builder := w.newBuilder(0,
+		func() (btrfsvol.LogicalAddr, error) { return 0, nil },
+		func(node *btrfstree.Node) error {
+			levels = append(levels, node.Head.Level)
+			return nil
+		})
+	for _, item := range items {
+		if err := builder.Add(item); err != nil {
+			return nil, err
+		}
+	}
+	if _, _, err := builder.Finish(); err != nil {
+		return nil, err
+	}
+	return levels, nil
+}
+
+// writeReservedTree writes a tree in to nodes that have already been
+// reserved (and entered in to the EXTENT_TREE); a NodeBuilder emits
+// the same sequence of nodes for the same items, so the nodes are
+// reserved by way of a dryRun.
+func (w *treeWriter) writeReservedTree(treeID btrfsprim.ObjID, addrs []btrfsvol.LogicalAddr, items []btrfstree.Item) (WrittenTree, error) {
+	ret := WrittenTree{ID: treeID}
+	builder := w.newBuilder(treeID,
+		func() (btrfsvol.LogicalAddr, error) {
+			if ret.Nodes == len(addrs) {
+				return 0, fmt.Errorf("needs more than the %v reserved nodes", len(addrs))
+			}
+			ret.Nodes++
+			return addrs[ret.Nodes-1], nil
+		},
+		w.writeNode)
+	for _, item := range items {
+		if err := builder.Add(item); err != nil {
+			return ret, fmt.Errorf("tree %v: %w", treeID, err)
+		}
+		ret.Items++
+	}
+	kp, level, err := builder.Finish()
+	if err != nil {
+		return ret, fmt.Errorf("tree %v: %w", treeID, err)
+	}
+	if ret.Nodes != len(addrs) {
+		return ret, fmt.Errorf("tree %v: used %v of the %v reserved nodes", treeID, ret.Nodes, len(addrs))
+	}
+	ret.Root = kp.BlockPtr
+	ret.Level = level
+	return ret, nil
+}
+
+func (w *treeWriter) chunkItem(chunk writtenChunk) btrfsitem.Chunk {
+	return btrfsitem.Chunk{
+		Head: btrfsitem.ChunkHeader{
+			Size:           chunk.Size,
+			Owner:          btrfsprim.EXTENT_TREE_OBJECTID,
+			StripeLen:      writeTreesStripeLen,
+			Type:           chunk.Flags,
+			IOOptimalAlign: w.sb.SectorSize,
+			IOOptimalWidth: w.sb.SectorSize,
+			IOMinSize:      w.sb.SectorSize,
+			NumStripes:     1,
+			SubStripes:     1,
+		},
+		Stripes: []btrfsitem.ChunkStripe{{
+			DeviceID:   w.sb.DevItem.DevID,
+			Offset:     chunk.PAddr,
+			DeviceUUID: w.sb.DevItem.DevUUID,
+		}},
+	}
+}
+
+func (w *treeWriter) devItem() btrfsitem.Dev {
+	dev := w.sb.DevItem
+	dev.NumBytes = uint64(w.alloc.phys)
+	dev.NumBytesUsed = 0
+	for _, chunk := range w.chunks {
+		dev.NumBytesUsed += uint64(chunk.Size)
+	}
+	return dev
+}
+
+func (w *treeWriter) decodeItems(injected []InjectedItem) ([]btrfstree.Item, error) {
+	items := make([]btrfstree.Item, 0, len(injected))
+	for _, item := range injected {
+		decoded, err := item.Decode(w.sb.ChecksumType)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, decoded)
+	}
+	return items, nil
+}
+
+func (w *treeWriter) devTreeItems() ([]btrfstree.Item, error) {
+	builder := NewDevTreeBuilder()
+	builder.ChunkTreeUUID = w.head.ChunkTreeUUID
+	builder.All = true
+	for _, chunk := range w.chunks {
+		builder.AddChunk(chunk.Key(), w.chunkItem(chunk))
+	}
+	// Every stripe is reported as a problem for not being in
+	// the (empty) DEV_TREE that we gave the builder; that is
+	// expected.
+	injected, _, err := builder.Items()
+	if err != nil {
+		return nil, err
+	}
+	return w.decodeItems(injected)
+}
+
+func (w *treeWriter) chunkTreeItems() []btrfstree.Item {
+	dev := w.devItem()
+	items := []btrfstree.Item{{
+		Key: btrfsprim.Key{
+			ObjectID: btrfsprim.DEV_ITEMS_OBJECTID,
+			ItemType: btrfsitem.DEV_ITEM_KEY,
+			Offset:   uint64(dev.DevID),
+		},
+		Body: &dev,
+	}}
+	for _, chunk := range w.chunks {
+		chunkItem := w.chunkItem(chunk)
+		items = append(items, btrfstree.Item{
+			Key:  chunk.Key(),
+			Body: &chunkItem,
+		})
+	}
+	return items
+}
+
+type bookkeepingSizes struct {
+	Dev, Extent, Root, Chunk int
+}
+
+type bookkeepingLayout struct {
+	Dev, Extent, Root, Chunk []btrfsvol.LogicalAddr
+}
+
+func (w *treeWriter) reserveNodes(n int) []btrfsvol.LogicalAddr {
+	ret := make([]btrfsvol.LogicalAddr, n)
+	for i := range ret {
+		ret[i] = w.allocNode()
+	}
+	return ret
+}
+
+func (w *treeWriter) layoutBookkeeping(sizes bookkeepingSizes) bookkeepingLayout {
+	var layout bookkeepingLayout
+	layout.Dev = w.reserveNodes(sizes.Dev)
+	layout.Extent = w.reserveNodes(sizes.Extent)
+	layout.Root = w.reserveNodes(sizes.Root)
+
+	nodeSize := btrfsvol.AddrDelta(w.sb.NodeSize)
+	sysSize := slices.Max(alignUp(btrfsvol.AddrDelta(sizes.Chunk)*nodeSize, writeTreesAlign), writeTreesMinSysChunk)
+	sys := w.addChunk(w.alloc.nextLAddr, sysSize, btrfsvol.BLOCK_GROUP_SYSTEM)
+	for i := 0; i < sizes.Chunk; i++ {
+		layout.Chunk = append(layout.Chunk, sys.LAddr.Add(btrfsvol.AddrDelta(i)*nodeSize))
+	}
+	return layout
+}
+
+// writeBookkeeping writes the DEV_TREE, EXTENT_TREE, ROOT_TREE, and
+// CHUNK_TREE.
+//
+// These trees describe each other (and themselves): the EXTENT_TREE
+// has an item for each of their nodes, the DEV_TREE and CHUNK_TREE
+// have an item for each chunk that those nodes live in, and the
+// ROOT_TREE points at the roots.  So a layout is guessed (starting
+// with one node per tree), the items are generated for that layout,
+// and the number of nodes that the items actually need is counted;
+// this repeats with the new counts until the counts stop changing.
+func (w *treeWriter) writeBookkeeping(rootTree []btrfstree.Item, extentRoot, devRoot *btrfsitem.Root) error {
+	saved := w.saveAlloc()
+	sizes := bookkeepingSizes{Dev: 1, Extent: 1, Root: 1, Chunk: 1}
+	extentLevels := []uint8{0}
+	for attempt := 0; ; attempt++ {
+		if attempt == writeTreesMaxAttempts {
+			return fmt.Errorf("could not settle on a layout for the bookkeeping trees after %v attempts", attempt)
+		}
+		w.restoreAlloc(saved)
+		layout := w.layoutBookkeeping(sizes)
+
+		devItems, err := w.devTreeItems()
+		if err != nil {
+			return err
+		}
+		chunkItems := w.chunkTreeItems()
+		devLevels, err := w.dryRun(devItems)
+		if err != nil {
+			return fmt.Errorf("DEV_TREE: %w", err)
+		}
+		rootLevels, err := w.dryRun(rootTree)
+		if err != nil {
+			return fmt.Errorf("ROOT_TREE: %w", err)
+		}
+		chunkLevels, err := w.dryRun(chunkItems)
+		if err != nil {
+			return fmt.Errorf("CHUNK_TREE: %w", err)
+		}
+
+		extents := w.extents.Clone()
+		for _, chunk := range w.chunks {
+			extents.AddChunk(chunk.Key(), w.chunkItem(chunk))
+		}
+		for _, tree := range []struct {
+			ID     btrfsprim.ObjID
+			Addrs  []btrfsvol.LogicalAddr
+			Levels []uint8
+		}{
+			{btrfsprim.DEV_TREE_OBJECTID, layout.Dev, devLevels},
+			{btrfsprim.EXTENT_TREE_OBJECTID, layout.Extent, extentLevels},
+			{btrfsprim.ROOT_TREE_OBJECTID, layout.Root, rootLevels},
+			{btrfsprim.CHUNK_TREE_OBJECTID, layout.Chunk, chunkLevels},
+		} {
+			for i, addr := range tree.Addrs {
+				var level uint8
+				if i < len(tree.Levels) {
+					level = tree.Levels[i]
+				}
+				extents.AddTreeBlock(addr, w.sb.Generation, level, btrfsprim.Key{}, tree.ID)
+			}
+		}
+		injected, problems, err := extents.Items()
+		if err != nil {
+			return err
+		}
+		extentItems, err := w.decodeItems(injected)
+		if err != nil {
+			return err
+		}
+		newExtentLevels, err := w.dryRun(extentItems)
+		if err != nil {
+			return fmt.Errorf("EXTENT_TREE: %w", err)
+		}
+
+		newSizes := bookkeepingSizes{
+			Dev:    len(devLevels),
+			Extent: len(newExtentLevels),
+			Root:   len(rootLevels),
+			Chunk:  len(chunkLevels),
+		}
+		if newSizes != sizes || string(newExtentLevels) != string(extentLevels) {
+			dlog.Debugf(w.ctx, "bookkeeping layout attempt %v: guessed %+v, but need %+v", attempt, sizes, newSizes)
+			sizes, extentLevels = newSizes, newExtentLevels
+			continue
+		}
+
+		// The layout is self-consistent; write it.
+		w.report.ExtentProblems = problems
+		devTree, err := w.writeReservedTree(btrfsprim.DEV_TREE_OBJECTID, layout.Dev, devItems)
+		if err != nil {
+			return err
+		}
+		extentTree, err := w.writeReservedTree(btrfsprim.EXTENT_TREE_OBJECTID, layout.Extent, extentItems)
+		if err != nil {
+			return err
+		}
+		w.setRoot(devRoot, devTree)
+		w.setRoot(extentRoot, extentTree)
+		rootTreeInfo, err := w.writeReservedTree(btrfsprim.ROOT_TREE_OBJECTID, layout.Root, rootTree)
+		if err != nil {
+			return err
+		}
+		chunkTree, err := w.writeReservedTree(btrfsprim.CHUNK_TREE_OBJECTID, layout.Chunk, chunkItems)
+		if err != nil {
+			return err
+		}
+		w.report.Trees = append(w.report.Trees, devTree, extentTree, rootTreeInfo, chunkTree)
+
+		w.sb.RootTree, w.sb.RootLevel = rootTreeInfo.Root, rootTreeInfo.Level
+		w.sb.ChunkTree, w.sb.ChunkLevel = chunkTree.Root, chunkTree.Level
+		w.sb.ChunkRootGeneration = w.sb.Generation
+		w.sb.BytesUsed = 0
+		for _, item := range extentItems {
+			if bg, ok := item.Body.(*btrfsitem.BlockGroup); ok {
+				w.sb.BytesUsed += uint64(bg.Used)
+			}
+		}
+		w.sb.DevItem = w.devItem()
+		w.sb.SysChunkArraySize = 0
+		for _, chunk := range w.chunks {
+			if chunk.Flags&btrfsvol.BLOCK_GROUP_SYSTEM == 0 {
+				continue
+			}
+			dat, err := binstruct.Marshal(btrfstree.SysChunk{
+				Key:   chunk.Key(),
+				Chunk: w.chunkItem(chunk),
+			})
+			if err != nil {
+				return err
+			}
+			if int(w.sb.SysChunkArraySize)+len(dat) > len(w.sb.SysChunkArray) {
+				return fmt.Errorf("too many SYSTEM chunks to fit in the superblock")
+			}
+			copy(w.sb.SysChunkArray[w.sb.SysChunkArraySize:], dat)
+			w.sb.SysChunkArraySize += uint32(len(dat))
+		}
+		return nil
+	}
+}
+
+func (w *treeWriter) setRoot(root *btrfsitem.Root, tree WrittenTree) {
+	root.ByteNr = tree.Root
+	root.Level = tree.Level
+	root.Generation = w.sb.Generation
+	root.GenerationV2 = w.sb.Generation
+	root.BytesUsed = int64(tree.Nodes) * int64(w.sb.NodeSize)
+}
+
+// copyData copies the data extents referenced by the copied trees
+// from the source filesystem in to the new image.
+func (w *treeWriter) copyData() error {
+	buf := make([]byte, writeTreesAlign)
+	for _, addr := range maps.SortedKeys(w.dataExtents) {
+		size := w.dataExtents[addr]
+		chunk, ok := w.chunkAt(addr)
+		if !ok || chunk.Flags&btrfsvol.BLOCK_GROUP_DATA == 0 || addr.Add(size) > chunk.LAddr.Add(chunk.Size) {
+			// Already reported as an ExtentProblem.
+			continue
+		}
+		for off := btrfsvol.AddrDelta(0); off < size; {
+			dat := buf[:slices.Min(size-off, btrfsvol.AddrDelta(len(buf)))]
+			if _, err := w.src.ReadAt(dat, addr.Add(off)); err != nil {
+				dlog.Errorf(w.ctx, "data extent [%v,%v): read at %v: %v", addr, addr.Add(size), addr.Add(off), err)
+				w.report.DataErrors++
+			} else {
+				if _, err := w.out.WriteAt(dat, chunk.PAddr.Add(addr.Sub(chunk.LAddr)+off)); err != nil {
+					return err
+				}
+				w.report.DataBytes += int64(len(dat))
+			}
+			off += btrfsvol.AddrDelta(len(dat))
+		}
+	}
+	return nil
+}
+
+func (w *treeWriter) writeSuperblocks() error {
+	for _, addr := range btrfs.SuperblockAddrs {
+		if addr+btrfs.SuperblockSize > w.alloc.phys {
+			break
+		}
+		sb := w.sb
+		sb.Self = addr
+		var err error
+		sb.Checksum, err = sb.CalculateChecksum()
+		if err != nil {
+			return err
+		}
+		dat, err := binstruct.Marshal(sb)
+		if err != nil {
+			return err
+		}
+		if _, err := w.out.WriteAt(dat, addr); err != nil {
+			return fmt.Errorf("superblock at %v: %w", addr, err)
+		}
+	}
+	return nil
+}
+
+// WriteTrees materializes the trees of `src` (which is usually a
+// RebuiltForrest) as a fresh single-device filesystem image, written
+// to `out`.
+//
+// Every tree is written in to new nodes from its items (as read with
+// TreeRange), so the nodes of the new image are packed and
+// consistent, but snapshots no longer share any nodes with each
+// other.  The new image is laid out as follows:
+//
+//   - There is one device, and every chunk has the SINGLE profile.
+//   - Data chunks keep the logical addresses that they had in `src`,
+//     so FILE_EXTENT and EXTENT_CSUM items are copied unchanged (that
+//     is, data extents are copied by reference); only the data
+//     extents that are referenced by a copied tree are copied (unless
+//     cfg.SkipData).
+//   - METADATA chunks are allocated above the data chunks, and a
+//     SYSTEM chunk above those.
+//   - The subvolume trees, the DATA_RELOC_TREE, the CSUM_TREE, and
+//     the UUID_TREE are copied.  The EXTENT_TREE, DEV_TREE,
+//     CHUNK_TREE, and ROOT_TREE are regenerated to describe the new
+//     image.  Everything else (the QUOTA_TREE, the FREE_SPACE_TREE,
+//     the BLOCK_GROUP_TREE, log trees, relocation trees, and the v1
+//     free space cache) is dropped, and the superblock flags are
+//     adjusted to match.
+//   - Every node has the same generation, newer than anything in
+//     `src`.
+//
+// Filesystems with mixed block groups, the extent-tree-v2 feature, or
+// zoned devices are not supported.
+//
+// The layout is meant to be acceptable to the kernel (mounted
+// read-only) and to `btrfs check`, but neither has been tested; the
+// only check of the image is that btrfs-rec can read each tree back
+// (see VerifyWrittenTrees).
+//
+// An error is returned only if the image could not be written at all;
+// items and trees that could not be read are logged and reported.
+func WriteTrees(ctx context.Context, src btrfs.ReadableFS, out diskio.File[btrfsvol.PhysicalAddr], cfg WriteTreesConfig) (*WriteTreesReport, error) {
+	oldSB, err := src.Superblock()
+	if err != nil {
+		return nil, err
+	}
+	for _, unsupported := range []struct {
+		Flag btrfstree.IncompatFlags
+		Name string
+	}{
+		{btrfstree.FeatureIncompatMixedGroups, "mixed block groups"},
+		{btrfstree.FeatureIncompatExtentTreeV2, "extent-tree-v2"},
+		{btrfstree.FeatureIncompatZoned, "zoned devices"},
+	} {
+		if oldSB.IncompatFlags.Has(unsupported.Flag) {
+			return nil, fmt.Errorf("filesystems with %s are not supported", unsupported.Name)
+		}
+	}
+	if cfg.MetadataChunkSize == 0 {
+		cfg.MetadataChunkSize = DefaultMetadataChunkSize
+	}
+	if cfg.MetadataChunkSize <= 0 || cfg.MetadataChunkSize%btrfsvol.AddrDelta(oldSB.NodeSize) != 0 {
+		return nil, fmt.Errorf("metadata chunk size %v is not a positive multiple of the node size %v",
+			cfg.MetadataChunkSize, oldSB.NodeSize)
+	}
+
+	// Read the ROOT_TREE and the CHUNK_TREE up front.
+	readAll := func(treeID btrfsprim.ObjID) ([]btrfstree.Item, error) {
+		tree, err := src.ForrestLookup(ctx, treeID)
+		if err != nil {
+			return nil, err
+		}
+		var items []btrfstree.Item
+		if err := tree.TreeRange(ctx, func(item btrfstree.Item) bool {
+			if _, isErr := item.Body.(*btrfsitem.Error); !isErr {
+				item.Body = item.Body.CloneItem()
+				items = append(items, item)
+			}
+			return true
+		}); err != nil {
+			dlog.Errorf(ctx, "tree %v is incomplete: %v", treeID, err)
+		}
+		return items, nil
+	}
+	oldRootTree, err := readAll(btrfsprim.ROOT_TREE_OBJECTID)
+	if err != nil {
+		return nil, fmt.Errorf("ROOT_TREE: %w", err)
+	}
+	oldChunkTree, err := readAll(btrfsprim.CHUNK_TREE_OBJECTID)
+	if err != nil {
+		return nil, fmt.Errorf("CHUNK_TREE: %w", err)
+	}
+
+	gen := oldSB.Generation
+	for _, item := range oldRootTree {
+		if root, ok := item.Body.(*btrfsitem.Root); ok && root.Generation > gen {
+			gen = root.Generation
+		}
+	}
+	gen = gen.AddClamped(1)
+
+	chunkTreeUUID := oldSB.FSUUID
+	if node, err := src.AcquireNode(ctx, oldSB.ChunkTree, btrfstree.NodeExpectations{
+		LAddr: containers.OptionalValue(oldSB.ChunkTree),
+	}); err == nil && node != nil {
+		chunkTreeUUID = node.Head.ChunkTreeUUID
+		src.ReleaseNode(node)
+	} else {
+		dlog.Warnf(ctx, "could not read the chunk root for the chunk tree UUID; using the filesystem UUID instead: %v", err)
+	}
+
+	w := &treeWriter{
+		ctx: ctx,
+		src: src,
+		out: out,
+		cfg: cfg,
+		report: &WriteTreesReport{
+			Generation: gen,
+			Dropped:    make(map[btrfsprim.ObjID]string),
+		},
+
+		sb: *oldSB,
+		head: btrfstree.NodeHeader{
+			MetadataUUID:  oldSB.EffectiveMetadataUUID(),
+			Flags:         btrfstree.NodeWritten,
+			BackrefRev:    btrfstree.MixedBackrefRev,
+			ChunkTreeUUID: chunkTreeUUID,
+			Generation:    gen,
+		},
+
+		alloc: treeWriterAlloc{
+			phys:      writeTreesAlign,
+			nextLAddr: writeTreesAlign,
+		},
+
+		dataExtents: make(map[btrfsvol.LogicalAddr]btrfsvol.AddrDelta),
+	}
+	w.sb.Generation = gen
+	w.sb.IncompatFlags |= btrfstree.FeatureIncompatSkinnyMetadata
+	w.sb.CompatROFlags &^= btrfstree.FeatureCompatROFreeSpaceTree |
+		btrfstree.FeatureCompatROFreeSpaceTreeValid |
+		btrfstree.FeatureCompatROBlockGroupTree
+	w.sb.LogTree, w.sb.LogLevel, w.sb.LogRootTransID = 0, 0, 0
+	w.sb.BlockGroupRoot, w.sb.BlockGroupRootGeneration, w.sb.BlockGroupRootLevel = 0, 0, 0
+	w.sb.NumGlobalRoots = 0
+	w.sb.NumDevices = 1
+	w.sb.CacheGeneration = 0
+	w.sb.UUIDTreeGeneration = 0
+	w.sb.SuperRoots = [4]btrfstree.RootBackup{}
+	w.sb.SysChunkArray = [0x800]byte{}
+	w.sb.DevItem.DevID = 1
+	w.sb.DevItem.FSUUID = oldSB.EffectiveMetadataUUID()
+	w.extents = NewExtentTreeBuilder(w.sb)
+
+	// Lay out the data chunks.
+	for _, item := range oldChunkTree {
+		chunk, ok := item.Body.(*btrfsitem.Chunk)
+		if !ok || chunk.Head.Type&btrfsvol.BLOCK_GROUP_DATA == 0 {
+			continue
+		}
+		laddr := btrfsvol.LogicalAddr(item.Key.Offset)
+		if n := len(w.chunks); n > 0 && w.chunks[n-1].LAddr.Add(w.chunks[n-1].Size) > laddr {
+			dlog.Errorf(ctx, "skipping data chunk at laddr=%v: overlaps the chunk at laddr=%v",
+				laddr, w.chunks[n-1].LAddr)
+			continue
+		}
+		w.addChunk(laddr, chunk.Head.Size, btrfsvol.BLOCK_GROUP_DATA)
+	}
+
+	// Copy the trees.
+	var (
+		rootItems  []btrfstree.Item
+		written    = make(containers.Set[btrfsprim.ObjID])
+		extentRoot *btrfsitem.Root
+		devRoot    *btrfsitem.Root
+	)
+	for _, item := range oldRootTree {
+		if item.Key.ItemType != btrfsitem.ROOT_ITEM_KEY {
+			continue
+		}
+		treeID := item.Key.ObjectID
+		root, ok := item.Body.(*btrfsitem.Root)
+		if !ok {
+			continue
+		}
+		action, why := writeTreesDisposition(treeID)
+		if action != writeTreesDrop && (written.Has(treeID) ||
+			(treeID == btrfsprim.EXTENT_TREE_OBJECTID && extentRoot != nil) ||
+			(treeID == btrfsprim.DEV_TREE_OBJECTID && devRoot != nil)) {
+			dlog.Errorf(ctx, "skipping duplicate ROOT_ITEM %v", item.Key)
+			continue
+		}
+		switch action {
+		case writeTreesCopy:
+			tree, err := w.copyTree(treeID)
+			if err != nil {
+				return nil, err
+			}
+			if tree == nil {
+				continue
+			}
+			w.setRoot(root, *tree)
+			w.report.Trees = append(w.report.Trees, *tree)
+			written.Insert(treeID)
+			if treeID == btrfsprim.UUID_TREE_OBJECTID {
+				w.sb.UUIDTreeGeneration = gen
+			}
+		case writeTreesRegenerate:
+			switch treeID {
+			case btrfsprim.EXTENT_TREE_OBJECTID:
+				extentRoot = root
+			case btrfsprim.DEV_TREE_OBJECTID:
+				devRoot = root
+			}
+		default:
+			w.report.Dropped[treeID] = why
+			dlog.Infof(ctx, "dropping tree %v: %s", treeID, why)
+			continue
+		}
+		rootItems = append(rootItems, item)
+	}
+	if w.maxItemGen >= gen {
+		dlog.Warnf(ctx, "some inodes or file extents have a generation (up to %v) that is not older than the new image's generation %v; "+
+			"the kernel's tree-checker may reject them", w.maxItemGen, gen)
+	}
+
+	// Fill in the rest of the ROOT_TREE.
+	for _, missing := range []struct {
+		TreeID btrfsprim.ObjID
+		Root   **btrfsitem.Root
+	}{
+		{btrfsprim.EXTENT_TREE_OBJECTID, &extentRoot},
+		{btrfsprim.DEV_TREE_OBJECTID, &devRoot},
+	} {
+		if *missing.Root != nil {
+			continue
+		}
+		*missing.Root = &btrfsitem.Root{
+			Inode: btrfsitem.Inode{
+				Generation: 1,
+				Size:       3, //nolint:gomnd // Same as mkfs.btrfs.
+				NumBytes:   int64(w.sb.NodeSize),
+				NLink:      1,
+				Mode:       btrfsitem.ModeFmtDir | 0o755, //nolint:gomnd // Same as mkfs.btrfs.
+			},
+			Refs: 1,
+		}
+		rootItems = append(rootItems, btrfstree.Item{
+			Key: btrfsprim.Key{
+				ObjectID: missing.TreeID,
+				ItemType: btrfsitem.ROOT_ITEM_KEY,
+			},
+			Body: *missing.Root,
+		})
+	}
+	for _, item := range oldRootTree {
+		switch {
+		case item.Key.ItemType == btrfsitem.ROOT_ITEM_KEY:
+			// Already handled.
+			continue
+		case item.Key.ObjectID == btrfsprim.FREE_SPACE_OBJECTID,
+			item.Key.ObjectID == btrfsprim.BALANCE_OBJECTID:
+			continue
+		case item.Key.ItemType == btrfsitem.ROOT_REF_KEY,
+			item.Key.ItemType == btrfsitem.ROOT_BACKREF_KEY:
+			if !written.Has(item.Key.ObjectID) || !written.Has(btrfsprim.ObjID(item.Key.Offset)) {
+				continue
+			}
+		case item.Key.ObjectID == btrfsprim.ORPHAN_OBJECTID && item.Key.ItemType == btrfsitem.ORPHAN_ITEM_KEY:
+			if !written.Has(btrfsprim.ObjID(item.Key.Offset)) {
+				continue
+			}
+		}
+		rootItems = append(rootItems, item)
+	}
+	sort.Slice(rootItems, func(i, j int) bool {
+		return rootItems[i].Key.Compare(rootItems[j].Key) < 0
+	})
+
+	if err := w.writeBookkeeping(rootItems, extentRoot, devRoot); err != nil {
+		return nil, err
+	}
+	if !cfg.SkipData {
+		if err := w.copyData(); err != nil {
+			return nil, err
+		}
+	}
+	w.sb.TotalBytes = uint64(w.alloc.phys)
+	w.report.Size = w.alloc.phys
+	if err := w.writeSuperblocks(); err != nil {
+		return nil, err
+	}
+	return w.report, nil
+}
+
+// VerifyWrittenTrees opens an image written by WriteTrees with this
+// package's own reader, and checks that the superblock is valid, that
+// the chunks load, and that each of the reported trees reads back in
+// full with the same number of items.
+func VerifyWrittenTrees(ctx context.Context, img diskio.File[btrfsvol.PhysicalAddr], report *WriteTreesReport) error {
+	fs := new(btrfs.FS)
+	if err := fs.AddDevice(ctx, &btrfs.Device{File: img}); err != nil {
+		return err
+	}
+	sbReport, err := fs.ValidateSuperblock()
+	if err != nil {
+		return err
+	}
+	if err := sbReport.Err(); err != nil {
+		return err
+	}
+	if err := fs.InitChunks(ctx); err != nil {
+		return err
+	}
+	var errs derror.MultiError
+	for _, want := range report.Trees {
+		tree, err := fs.ForrestLookup(ctx, want.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tree %v: %w", want.ID, err))
+			continue
+		}
+		var items int
+		if err := tree.TreeRange(ctx, func(item btrfstree.Item) bool {
+			if errBody, isErr := item.Body.(*btrfsitem.Error); isErr {
+				errs = append(errs, fmt.Errorf("tree %v: item %v: %w", want.ID, item.Key, errBody.Err))
+			}
+			items++
+			return true
+		}); err != nil {
+			errs = append(errs, fmt.Errorf("tree %v: %w", want.ID, err))
+			continue
+		}
+		if items != want.Items {
+			errs = append(errs, fmt.Errorf("tree %v: read back %v items, but wrote %v", want.ID, items, want.Items))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,329 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package btrfsutil_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsitem"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsprim"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfssum"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfsvol"
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfsutil"
+)
+
+// memTree is a btrfstree.Tree that only supports TreeRange.
+type memTree []btrfstree.Item
+
+func (memTree) TreeParentID(context.Context) (btrfsprim.ObjID, btrfsprim.Generation, error) {
+	return 0, 0, nil
+}
+
+func (memTree) TreeLookup(_ context.Context, key btrfsprim.Key) (btrfstree.Item, error) {
+	return btrfstree.Item{}, fmt.Errorf("%v: %w", key, btrfstree.ErrNoItem)
+}
+
+func (memTree) TreeSearch(_ context.Context, search btrfstree.TreeSearcher) (btrfstree.Item, error) {
+	return btrfstree.Item{}, fmt.Errorf("%v: %w", search, btrfstree.ErrNoItem)
+}
+
+func (t memTree) TreeRange(_ context.Context, handleFn func(btrfstree.Item) bool) error {
+	for _, item := range t {
+		if !handleFn(item) {
+			break
+		}
+	}
+	return nil
+}
+
+func (memTree) TreeSubrange(_ context.Context, _ int, search btrfstree.TreeSearcher, _ func(btrfstree.Item) bool) error {
+	return fmt.Errorf("%v: %w", search, btrfstree.ErrNoItem)
+}
+
+func (memTree) TreeWalk(context.Context, btrfstree.TreeWalkHandler) {}
+
+// memForrest is a btrfs.ReadableFS whose trees are memTrees, and
+// whose logical address space is a single byte slice.
+type memForrest struct {
+	sb    btrfstree.Superblock
+	trees map[btrfsprim.ObjID]memTree
+	data  []byte // logical address space, starting at dataAddr
+}
+
+const memForrestDataAddr = btrfsvol.LogicalAddr(0x100000)
+
+func (*memForrest) Name() string { return "mem" }
+
+func (fs *memForrest) ForrestLookup(_ context.Context, treeID btrfsprim.ObjID) (btrfstree.Tree, error) {
+	tree, ok := fs.trees[treeID]
+	if !ok {
+		return nil, btrfstree.ErrNoTree
+	}
+	return tree, nil
+}
+
+func (fs *memForrest) Superblock() (*btrfstree.Superblock, error) { return &fs.sb, nil }
+
+func (*memForrest) AcquireNode(_ context.Context, addr btrfsvol.LogicalAddr, _ btrfstree.NodeExpectations) (*btrfstree.Node, error) {
+	return nil, fmt.Errorf("node@%v: memForrest has no nodes", addr)
+}
+
+func (*memForrest) ReleaseNode(*btrfstree.Node) {}
+
+func (fs *memForrest) ReadAt(p []byte, off btrfsvol.LogicalAddr) (int, error) {
+	if off < memForrestDataAddr || off.Add(btrfsvol.AddrDelta(len(p))) > memForrestDataAddr.Add(btrfsvol.AddrDelta(len(fs.data))) {
+		return 0, fmt.Errorf("read [%v,%v): out of bounds", off, off.Add(btrfsvol.AddrDelta(len(p))))
+	}
+	return copy(p, fs.data[off-memForrestDataAddr:]), nil
+}
+
+func treeItems(t *testing.T, ctx context.Context, fs btrfs.ReadableFS, treeID btrfsprim.ObjID) map[btrfsprim.Key][]byte {
+	t.Helper()
+	tree, err := fs.ForrestLookup(ctx, treeID)
+	require.NoError(t, err)
+	ret := make(map[btrfsprim.Key][]byte)
+	require.NoError(t, tree.TreeRange(ctx, func(item btrfstree.Item) bool {
+		dat, err := binstruct.Marshal(item.Body)
+		require.NoError(t, err)
+		ret[item.Key] = dat
+		return true
+	}))
+	return ret
+}
+
+// TestWriteTrees writes the trees of an in-memory filesystem out to an
+// image, reads that image back with btrfs.FS, and then writes that
+// back out to a second image.
+func TestWriteTrees(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	const (
+		nodeSize = 4096
+		subvol   = btrfsprim.ObjID(256)
+		sharedAt = memForrestDataAddr + 0x2000
+	)
+	fsUUID := btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-000000000003")
+	key := func(objID btrfsprim.ObjID, typ btrfsprim.ItemType, off uint64) btrfsprim.Key {
+		return btrfsprim.Key{ObjectID: objID, ItemType: typ, Offset: off}
+	}
+	rootItem := func(gen btrfsprim.Generation) *btrfsitem.Root {
+		return &btrfsitem.Root{
+			Generation:   gen,
+			GenerationV2: gen,
+			RootDirID:    btrfsprim.FIRST_FREE_OBJECTID,
+			Refs:         1,
+		}
+	}
+	fileExtent := func(addr btrfsvol.LogicalAddr) *btrfsitem.FileExtent {
+		return &btrfsitem.FileExtent{
+			Generation: 5,
+			RAMBytes:   0x1000,
+			Type:       btrfsitem.FILE_EXTENT_REG,
+			BodyExtent: btrfsitem.FileExtentExtent{
+				DiskByteNr:   addr,
+				DiskNumBytes: 0x1000,
+				NumBytes:     0x1000,
+			},
+		}
+	}
+
+	// The FS_TREE has enough inodes to need an interior node.
+	var fsTree memTree
+	for ino := btrfsprim.FIRST_FREE_OBJECTID; ino < btrfsprim.FIRST_FREE_OBJECTID+100; ino++ {
+		fsTree = append(fsTree, btrfstree.Item{
+			Key:  key(ino, btrfsitem.INODE_ITEM_KEY, 0),
+			Body: &btrfsitem.Inode{Generation: 5, TransID: 5, NLink: 1, Mode: btrfsitem.ModeFmtRegular | 0o644},
+		})
+		switch ino {
+		case btrfsprim.FIRST_FREE_OBJECTID:
+			fsTree = append(fsTree, btrfstree.Item{
+				Key:  key(ino, btrfsitem.EXTENT_DATA_KEY, 0),
+				Body: fileExtent(memForrestDataAddr),
+			})
+		case btrfsprim.FIRST_FREE_OBJECTID + 1:
+			fsTree = append(fsTree, btrfstree.Item{
+				Key:  key(ino, btrfsitem.EXTENT_DATA_KEY, 0),
+				Body: fileExtent(sharedAt),
+			})
+		}
+	}
+
+	data := make([]byte, 0x100000)
+	for i := range data {
+		data[i] = byte(i / 0x1000)
+	}
+	src := &memForrest{
+		sb: btrfstree.Superblock{
+			FSUUID:          fsUUID,
+			Magic:           btrfstree.SuperblockMagic,
+			Generation:      9,
+			RootDirObjectID: btrfsprim.ROOT_TREE_DIR_OBJECTID,
+			NumDevices:      2,
+			SectorSize:      btrfssum.BlockSize,
+			NodeSize:        nodeSize,
+			LeafSize:        nodeSize,
+			StripeSize:      btrfssum.BlockSize,
+			ChecksumType:    btrfssum.TYPE_CRC32,
+			CompatROFlags:   btrfstree.FeatureCompatROFreeSpaceTree | btrfstree.FeatureCompatROFreeSpaceTreeValid,
+			DevItem: btrfsitem.Dev{
+				DevID:   2,
+				DevUUID: btrfsprim.MustParseUUID("c0ffee00-0000-0000-0000-0000000000de"),
+			},
+		},
+		trees: map[btrfsprim.ObjID]memTree{
+			btrfsprim.ROOT_TREE_OBJECTID: {
+				{Key: key(btrfsprim.EXTENT_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0), Body: rootItem(9)},
+				{Key: key(btrfsprim.FS_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0), Body: rootItem(10)},
+				{Key: key(btrfsprim.FS_TREE_OBJECTID, btrfsitem.ROOT_REF_KEY, uint64(subvol)), Body: &btrfsitem.RootRef{DirID: 256, Sequence: 2, Name: []byte("sub")}},
+				{Key: key(btrfsprim.FS_TREE_OBJECTID, btrfsitem.ROOT_REF_KEY, 300), Body: &btrfsitem.RootRef{DirID: 256, Sequence: 3, Name: []byte("lost")}},
+				{Key: key(btrfsprim.ROOT_TREE_DIR_OBJECTID, btrfsitem.INODE_ITEM_KEY, 0), Body: &btrfsitem.Inode{Generation: 1, NLink: 1, Mode: btrfsitem.ModeFmtDir | 0o755}},
+				{Key: key(btrfsprim.CSUM_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0), Body: rootItem(9)},
+				{Key: key(btrfsprim.QUOTA_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0), Body: rootItem(9)},
+				{Key: key(btrfsprim.FREE_SPACE_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0), Body: rootItem(9)},
+				{Key: key(subvol, btrfsitem.ROOT_ITEM_KEY, 0), Body: rootItem(8)},
+				{Key: key(subvol, btrfsitem.ROOT_BACKREF_KEY, uint64(btrfsprim.FS_TREE_OBJECTID)), Body: &btrfsitem.RootRef{DirID: 256, Sequence: 2, Name: []byte("sub")}},
+				{Key: key(300, btrfsitem.ROOT_ITEM_KEY, 0), Body: rootItem(8)},
+				{Key: key(btrfsprim.FREE_SPACE_OBJECTID, btrfsitem.INODE_ITEM_KEY, 0), Body: &btrfsitem.Inode{Generation: 1, NLink: 1, Mode: btrfsitem.ModeFmtRegular | 0o600}},
+				{Key: key(btrfsprim.DATA_RELOC_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0), Body: rootItem(9)},
+			},
+			btrfsprim.CHUNK_TREE_OBJECTID: {
+				{Key: key(btrfsprim.FIRST_CHUNK_TREE_OBJECTID, btrfsitem.CHUNK_ITEM_KEY, uint64(memForrestDataAddr)), Body: &btrfsitem.Chunk{
+					Head: btrfsitem.ChunkHeader{Size: btrfsvol.AddrDelta(len(data)), Type: btrfsvol.BLOCK_GROUP_DATA | btrfsvol.BLOCK_GROUP_RAID1},
+				}},
+				{Key: key(btrfsprim.FIRST_CHUNK_TREE_OBJECTID, btrfsitem.CHUNK_ITEM_KEY, 0x400000), Body: &btrfsitem.Chunk{
+					Head: btrfsitem.ChunkHeader{Size: 0x100000, Type: btrfsvol.BLOCK_GROUP_METADATA},
+				}},
+			},
+			btrfsprim.FS_TREE_OBJECTID: fsTree,
+			subvol: {
+				{Key: key(256, btrfsitem.INODE_ITEM_KEY, 0), Body: &btrfsitem.Inode{Generation: 8, TransID: 8, NLink: 1, Mode: btrfsitem.ModeFmtRegular | 0o644}},
+				{Key: key(256, btrfsitem.EXTENT_DATA_KEY, 0), Body: fileExtent(sharedAt)},
+			},
+			btrfsprim.CSUM_TREE_OBJECTID: {
+				{Key: key(btrfsprim.EXTENT_CSUM_OBJECTID, btrfsprim.EXTENT_CSUM_KEY, uint64(memForrestDataAddr)), Body: &btrfsitem.ExtentCSum{
+					SumRun: btrfssum.SumRun[btrfsvol.LogicalAddr]{
+						ChecksumSize: 4,
+						Addr:         memForrestDataAddr,
+						Sums:         "\x01\x02\x03\x04",
+					},
+				}},
+			},
+			btrfsprim.DATA_RELOC_TREE_OBJECTID: {
+				{Key: key(btrfsprim.FIRST_FREE_OBJECTID, btrfsitem.INODE_ITEM_KEY, 0), Body: &btrfsitem.Inode{Generation: 1, NLink: 1, Mode: btrfsitem.ModeFmtDir | 0o755}},
+			},
+			// Tree 300 has a ROOT_ITEM, but is missing.
+		},
+		data: data,
+	}
+
+	img := make(memFile, 16<<20)
+	report, err := btrfsutil.WriteTrees(ctx, src, img, btrfsutil.WriteTreesConfig{MetadataChunkSize: 0x100000})
+	require.NoError(t, err)
+	require.LessOrEqual(t, int(report.Size), len(img))
+	img = img[:report.Size]
+
+	assert.Equal(t, btrfsprim.Generation(11), report.Generation)
+	assert.Empty(t, report.ExtentProblems)
+	assert.Equal(t, 0, report.SkippedItems)
+	assert.Equal(t, int64(0x2000), report.DataBytes)
+	var written []btrfsprim.ObjID
+	for _, tree := range report.Trees {
+		written = append(written, tree.ID)
+	}
+	assert.Equal(t, []btrfsprim.ObjID{
+		btrfsprim.FS_TREE_OBJECTID,
+		btrfsprim.CSUM_TREE_OBJECTID,
+		subvol,
+		btrfsprim.DATA_RELOC_TREE_OBJECTID,
+		btrfsprim.DEV_TREE_OBJECTID,
+		btrfsprim.EXTENT_TREE_OBJECTID,
+		btrfsprim.ROOT_TREE_OBJECTID,
+		btrfsprim.CHUNK_TREE_OBJECTID,
+	}, written)
+	assert.Equal(t, uint8(1), report.Trees[0].Level)
+	assert.ElementsMatch(t, []btrfsprim.ObjID{
+		btrfsprim.QUOTA_TREE_OBJECTID,
+		btrfsprim.FREE_SPACE_TREE_OBJECTID,
+		300,
+	}, func() []btrfsprim.ObjID {
+		var ret []btrfsprim.ObjID
+		for id := range report.Dropped {
+			ret = append(ret, id)
+		}
+		return ret
+	}())
+
+	// Read it back.
+	require.NoError(t, btrfsutil.VerifyWrittenTrees(ctx, img, report))
+	fs := new(btrfs.FS)
+	require.NoError(t, fs.AddDevice(ctx, &btrfs.Device{File: img}))
+	require.NoError(t, fs.InitChunks(ctx))
+	sb, err := fs.Superblock()
+	require.NoError(t, err)
+	assert.Equal(t, btrfsprim.Generation(11), sb.Generation)
+	assert.Equal(t, uint64(1), sb.NumDevices)
+	assert.Equal(t, btrfsvol.DeviceID(1), sb.DevItem.DevID)
+	assert.Equal(t, uint64(report.Size), sb.TotalBytes)
+	assert.True(t, sb.IncompatFlags.Has(btrfstree.FeatureIncompatSkinnyMetadata))
+	assert.False(t, sb.CompatROFlags.Has(btrfstree.FeatureCompatROFreeSpaceTree))
+
+	for _, treeID := range []btrfsprim.ObjID{btrfsprim.FS_TREE_OBJECTID, subvol, btrfsprim.CSUM_TREE_OBJECTID} {
+		assert.Equal(t, treeItems(t, ctx, src, treeID), treeItems(t, ctx, fs, treeID), "tree %v", treeID)
+	}
+	rootTree := treeItems(t, ctx, fs, btrfsprim.ROOT_TREE_OBJECTID)
+	assert.Contains(t, rootTree, key(btrfsprim.FS_TREE_OBJECTID, btrfsitem.ROOT_REF_KEY, uint64(subvol)))
+	assert.NotContains(t, rootTree, key(btrfsprim.FS_TREE_OBJECTID, btrfsitem.ROOT_REF_KEY, 300))
+	assert.Contains(t, rootTree, key(btrfsprim.DEV_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0))
+	assert.NotContains(t, rootTree, key(btrfsprim.QUOTA_TREE_OBJECTID, btrfsitem.ROOT_ITEM_KEY, 0))
+	assert.NotContains(t, rootTree, key(btrfsprim.FREE_SPACE_OBJECTID, btrfsitem.INODE_ITEM_KEY, 0))
+
+	// The data was copied, and the shared extent is accounted for.
+	buf := make([]byte, 0x1000)
+	_, err = fs.ReadAt(buf, sharedAt)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data[sharedAt-memForrestDataAddr:][:0x1000], buf))
+	extentTree := treeItems(t, ctx, fs, btrfsprim.EXTENT_TREE_OBJECTID)
+	var extent btrfsitem.Extent
+	_, err = binstruct.Unmarshal(extentTree[key(btrfsprim.ObjID(sharedAt), btrfsitem.EXTENT_ITEM_KEY, 0x1000)], &extent)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), extent.Head.Refs)
+	var blockGroups, devExtents int
+	for key := range extentTree {
+		if key.ItemType == btrfsitem.BLOCK_GROUP_ITEM_KEY {
+			blockGroups++
+		}
+	}
+	for key := range treeItems(t, ctx, fs, btrfsprim.DEV_TREE_OBJECTID) {
+		if key.ItemType == btrfsitem.DEV_EXTENT_KEY {
+			devExtents++
+		}
+	}
+	chunks := fs.LV.Mappings()
+	assert.Equal(t, len(chunks), blockGroups)
+	assert.Equal(t, len(chunks), devExtents)
+
+	// And it can be written back out again.
+	img2 := make(memFile, 16<<20)
+	report2, err := btrfsutil.WriteTrees(ctx, fs, img2, btrfsutil.WriteTreesConfig{MetadataChunkSize: 0x100000})
+	require.NoError(t, err)
+	img2 = img2[:report2.Size]
+	require.NoError(t, btrfsutil.VerifyWrittenTrees(ctx, img2, report2))
+	assert.Equal(t, btrfsprim.Generation(12), report2.Generation)
+	fs2 := new(btrfs.FS)
+	require.NoError(t, fs2.AddDevice(ctx, &btrfs.Device{File: img2}))
+	require.NoError(t, fs2.InitChunks(ctx))
+	assert.Equal(t, treeItems(t, ctx, src, btrfsprim.FS_TREE_OBJECTID), treeItems(t, ctx, fs2, btrfsprim.FS_TREE_OBJECTID))
+}
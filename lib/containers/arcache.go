@@ -552,6 +552,25 @@ func (c *arCache[K, V]) Acquire(ctx context.Context, k K) *V {
 //   Given everything that we've already explained, I think it's fair to call
 //   the remaining code "boilerplate".
 
+// TryAcquire implements the 'Cache' interface.  A hit is treated
+// exactly the same as a hit in Acquire; a miss does not touch any of
+// the lists, not even the ghost lists.
+func (c *arCache[K, V]) TryAcquire(k K) (*V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.liveByName[k]
+	if entry == nil {
+		return nil, false
+	}
+	if entry.List != &c.frequentPinned && entry.List != &c.recentPinned {
+		entry.List.Delete(entry)
+		c.frequentPinned.Store(entry)
+	}
+	entry.Value.refs++
+	return &entry.Value.val, true
+}
+
 // Delete implements the 'Cache' interface.
 func (c *arCache[K, V]) Delete(k K) {
 	c.mu.Lock()
@@ -610,6 +629,99 @@ func (c *arCache[K, V]) Release(k K) {
 	}
 }
 
+// Resize implements the 'Cache' interface.
+//
+// Resizing isn't something that the ARC paper considers; the
+// approach here is to make sure that once we're done, the cache
+// looks like something that ARC(c') could have produced with the new
+// capacity c':
+//
+//   - there are exactly c' live entries (counting the unused ones)
+//     and exactly c' ghost entries (counting the unused ones);
+//   - the DBL(2c') invariants hold; since there are only c' live
+//     and c' ghost entries, that is just `0 ≤ |L₁| ≤ c'`;
+//   - the FRC(p, c') invariant `0 ≤ p ≤ c'` holds.
+//
+// When shrinking, live entries are evicted by the same T₁-vs-T₂
+// decision as in arcReplace, but they are flushed and discarded
+// rather than being recorded as ghosts (there are fewer ghost entries
+// to go around, not more); dropping the LRU end of a list never
+// violates A.4.
+//
+//nolint:predeclared // 'cap' is the best name for it.
+func (c *arCache[K, V]) Resize(ctx context.Context, cap int) {
+	if cap <= 0 {
+		panic(fmt.Errorf("containers.arCache.Resize: invalid capacity: %v", cap))
+	}
+	c.mu.Lock()
+
+	// Shrink the live entries, blocking in .waitForAvail() if
+	// everything left is pinned.
+	for liveCap := c.cap; liveCap > cap; liveCap-- {
+		c.waitForAvail()
+		if entry := c.unusedLive.Oldest; entry != nil {
+			c.unusedLive.Delete(entry)
+			continue
+		}
+		evictFrom := &c.frequentLive
+		recentLive := c.recentPinned.Len + c.recentLive.Len
+		if c.frequentLive.IsEmpty() || (recentLive > min(c.recentLiveTarget, cap) && !c.recentLive.IsEmpty()) {
+			evictFrom = &c.recentLive
+		}
+		entry := evictFrom.Oldest
+		delete(c.liveByName, entry.Value.key)
+		evictFrom.Delete(entry)
+		c.src.Flush(ctx, &entry.Value.val)
+	}
+
+	// Shrink the ghost entries: first enforce `|L₁| ≤ c'`, and
+	// then discard unused ghosts before discarding the LRU
+	// ghosts.
+	ghostCap := c.cap
+	dropGhost := func(entry *LinkedListEntry[arcGhostEntry[K]]) {
+		if entry.List != &c.unusedGhost {
+			delete(c.ghostByName, entry.Value.key)
+		}
+		entry.List.Delete(entry)
+		if ghostCap > cap {
+			ghostCap--
+		} else {
+			c.unusedGhost.Store(entry)
+		}
+	}
+	for c.recentPinned.Len+c.recentLive.Len+c.recentGhost.Len > cap {
+		// The live entries now number at most c', so
+		// `|L₁| > c'` implies that B₁ is non-empty.
+		dropGhost(c.recentGhost.Oldest)
+	}
+	for ghostCap > cap {
+		switch {
+		case !c.unusedGhost.IsEmpty():
+			dropGhost(c.unusedGhost.Oldest)
+		case !c.frequentGhost.IsEmpty():
+			dropGhost(c.frequentGhost.Oldest)
+		default:
+			dropGhost(c.recentGhost.Oldest)
+		}
+	}
+
+	// Grow.
+	for ; ghostCap < cap; ghostCap++ {
+		c.unusedLive.Store(new(LinkedListEntry[arcLiveEntry[K, V]]))
+		c.unusedGhost.Store(new(LinkedListEntry[arcGhostEntry[K]]))
+	}
+
+	c.cap = cap
+	c.recentLiveTarget = min(c.recentLiveTarget, cap)
+
+	// Growing may have made room for more than one waiter.
+	for !c.waiters.IsEmpty() && !(c.recentLive.IsEmpty() && c.frequentLive.IsEmpty() && c.unusedLive.IsEmpty()) {
+		c.unlockAndNotifyAvail()
+		c.mu.Lock()
+	}
+	c.mu.Unlock()
+}
+
 // Flush implements the 'Cache' interface.
 func (c *arCache[K, V]) Flush(ctx context.Context) {
 	c.mu.Lock()
@@ -622,10 +734,31 @@ func (c *arCache[K, V]) Flush(ctx context.Context) {
 		&c.frequentLive,
 		&c.unusedLive,
 	} {
-		for entry := list.Oldest; entry != nil; entry = entry.Newer {
+		list.Range(func(entry *LinkedListEntry[arcLiveEntry[K, V]]) bool {
 			c.src.Flush(ctx, &entry.Value.val)
-		}
+			return true
+		})
+	}
+}
+
+// Keys implements the 'Cache' interface.
+func (c *arCache[K, V]) Keys() []K {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ret := make([]K, 0, len(c.liveByName))
+	for _, list := range []*LinkedList[arcLiveEntry[K, V]]{
+		&c.recentPinned,
+		&c.recentLive,
+		&c.frequentPinned,
+		&c.frequentLive,
+	} {
+		list.Range(func(entry *LinkedListEntry[arcLiveEntry[K, V]]) bool {
+			ret = append(ret, entry.Value.key)
+			return true
+		})
 	}
+	return ret
 }
 
 func min(a, b int) int {
@@ -14,10 +14,13 @@ import (
 	"fmt"
 	"math/big"
 	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/datawire/dlib/derror"
 	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -707,3 +710,125 @@ func TestARC_Peek(t *testing.T) {
 		t.Errorf("should not have updated recent-ness of 1")
 	}
 }
+
+func TestARC_Resize(t *testing.T) {
+	t.Parallel()
+	l, err := NewARC[int, int](t, 128)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	counts := func() (live, ghost int) {
+		live = l.unusedLive.Len + l.recentPinned.Len + l.recentLive.Len + l.frequentPinned.Len + l.frequentLive.Len
+		ghost = l.unusedGhost.Len + l.recentGhost.Len + l.frequentGhost.Len
+		return live, ghost
+	}
+
+	// Fill the cache, with some frequent entries and some
+	// ghosts.
+	for i := 0; i < 256; i++ {
+		l.Add(i, i)
+	}
+	for i := 192; i < 224; i++ {
+		l.Get(i)
+	}
+	for i := 256; i < 320; i++ {
+		l.Add(i, i)
+	}
+
+	l.Resize(l.ctx, 32)
+	l.check()
+	require.Equal(t, 32, l.Len())
+	live, ghost := counts()
+	require.Equal(t, 32, live)
+	require.Equal(t, 32, ghost)
+
+	l.Resize(l.ctx, 64)
+	l.check()
+	live, ghost = counts()
+	require.Equal(t, 64, live)
+	require.Equal(t, 64, ghost)
+	for i := 1000; i < 1064; i++ {
+		l.Add(i, i)
+	}
+	require.Equal(t, 64, l.Len())
+
+	// Interleave resizes with random operations.
+	for i := 0; i < 20000; i++ {
+		key := int(getRand(t, 512))
+		switch getRand(t, 100) {
+		case 0:
+			l.Resize(l.ctx, int(getRand(t, 256))+1)
+			l.check()
+			live, ghost := counts()
+			require.Equal(t, l.cap, live)
+			require.Equal(t, l.cap, ghost)
+		case 1, 2, 3, 4, 5, 6, 7, 8, 9, 10:
+			l.Remove(key)
+		default:
+			if _, ok := l.Get(key); !ok {
+				l.Add(key, key)
+			}
+		}
+	}
+}
+
+func TestARC_ResizeFlush(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	src := new(dirtySource)
+	cache := NewARCache[int, dirtyVal](4, src)
+	for i := 1; i <= 4; i++ {
+		cache.Acquire(ctx, i)
+		cache.Release(i)
+	}
+	cache.Resize(ctx, 1)
+	assert.ElementsMatch(t, []int{1, 2, 3}, src.written)
+	assert.Equal(t, []int{4}, cache.Keys())
+
+	cache.Flush(ctx)
+	assert.ElementsMatch(t, []int{1, 2, 3, 4}, src.written)
+}
+
+func TestARC_ResizePinned(t *testing.T) {
+	t.Parallel()
+	const tick = time.Second / 2
+
+	ctx := dlog.NewTestContext(t, false)
+	cache := NewARCache[int, int](4,
+		SourceFunc[int, int](func(_ context.Context, k int, v *int) { *v = k * k }))
+	for i := 1; i <= 4; i++ {
+		cache.Acquire(ctx, i)
+	}
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		cache.Resize(ctx, 2)
+		close(done)
+	}()
+	go func() {
+		time.Sleep(tick)
+		cache.Release(1)
+		time.Sleep(tick)
+		cache.Release(2)
+	}()
+	<-done
+	require.Greater(t, time.Since(start), 2*tick)
+	require.ElementsMatch(t, []int{3, 4}, cache.Keys())
+
+	// Growing wakes up everyone who is waiting for room.
+	var wg sync.WaitGroup
+	for i := 5; i <= 6; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, i*i, *cache.Acquire(ctx, i))
+		}()
+	}
+	time.Sleep(tick)
+	cache.Resize(ctx, 4)
+	wg.Wait()
+	require.ElementsMatch(t, []int{3, 4, 5, 6}, cache.Keys())
+}
@@ -33,6 +33,11 @@ type Cache[K comparable, V any] interface {
 	// `Release`).
 	Acquire(context.Context, K) *V
 
+	// TryAcquire is like Acquire, but if the value for `k` is not
+	// already in the cache, then it does not load it, and instead
+	// returns (nil, false).
+	TryAcquire(K) (*V, bool)
+
 	// Release decrements the in-use counter for the cache entry
 	// for `k`.  If the in-use counter drops to 0, then that entry
 	// may be evicted.
@@ -52,6 +57,25 @@ type Cache[K comparable, V any] interface {
 	// the program exited right now, no one would be upset.  Flush
 	// does not empty the cache.
 	Flush(context.Context)
+
+	// Resize changes the capacity of the cache.  Growing the
+	// cache takes effect immediately.  Shrinking the cache evicts
+	// entries until it fits within the new capacity; if more
+	// entries than that are in-use, then Resize blocks until
+	// enough of them are released (via `Release`).  Evicted
+	// entries are passed to the Source's Flush before being
+	// discarded, as (unlike a normal eviction) they won't be
+	// passed to Load again.
+	//
+	// It is invalid (runtime-panic) to call Resize with a
+	// non-positive capacity.
+	Resize(ctx context.Context, cap int)
+
+	// Keys returns a snapshot of the keys of the entries that are
+	// currently live in the cache (whether or not they are
+	// in-use), in no particular order.  The snapshot is
+	// consistent, but may be stale by the time it is returned.
+	Keys() []K
 }
 
 // SourceFunc implements Source.  Load calls the function, and Flush
@@ -154,3 +154,30 @@ func (t *IntervalTree[K, V]) subrange(node *RBNode[intervalValue[K, V]], rangeFn
 	}
 	return true
 }
+
+// Overlaps returns all values whose [MinFn(val), MaxFn(val)] interval
+// intersects the closed interval [min, max], ordered by their
+// intervals.  It returns nil (without allocating) if there are none.
+func (t *IntervalTree[K, V]) Overlaps(min, max K) []V {
+	var ret []V
+	t.overlaps(t.inner.root, min, max, &ret)
+	return ret
+}
+
+func (t *IntervalTree[K, V]) overlaps(node *RBNode[intervalValue[K, V]], min, max K, ret *[]V) {
+	if node == nil {
+		return
+	}
+	if node.Value.ChildSpan.Max.Compare(min) < 0 || node.Value.ChildSpan.Min.Compare(max) > 0 {
+		return
+	}
+	t.overlaps(node.Left, min, max, ret)
+	if node.Value.ValSpan.Min.Compare(max) > 0 {
+		// Everything to the right starts even later.
+		return
+	}
+	if node.Value.ValSpan.Max.Compare(min) >= 0 {
+		*ret = append(*ret, node.Value.Val)
+	}
+	t.overlaps(node.Right, min, max, ret)
+}
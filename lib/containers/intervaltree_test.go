@@ -86,3 +86,79 @@ func TestIntervalTree(t *testing.T) {
 		},
 		intervals)
 }
+
+func TestIntervalTreeOverlaps(t *testing.T) {
+	t.Parallel()
+	tree := IntervalTree[NativeOrdered[int], SimpleInterval]{
+		MinFn: func(ival SimpleInterval) NativeOrdered[int] { return NativeOrdered[int]{ival.Min} },
+		MaxFn: func(ival SimpleInterval) NativeOrdered[int] { return NativeOrdered[int]{ival.Max} },
+	}
+	overlaps := func(min, max int) []SimpleInterval {
+		return tree.Overlaps(NativeOrdered[int]{min}, NativeOrdered[int]{max})
+	}
+
+	assert.Nil(t, overlaps(0, 100))
+
+	tree.Insert(SimpleInterval{0, 100}) // outer
+	tree.Insert(SimpleInterval{10, 20}) // nested
+	tree.Insert(SimpleInterval{12, 14}) // doubly nested
+	tree.Insert(SimpleInterval{20, 30}) // adjacent to [10,20], sharing 20
+	tree.Insert(SimpleInterval{31, 40}) // adjacent to [20,30], sharing nothing
+	tree.Insert(SimpleInterval{90, 110})
+	tree.Insert(SimpleInterval{200, 300})
+
+	assert.Equal(t,
+		[]SimpleInterval{{0, 100}, {10, 20}, {12, 14}},
+		overlaps(13, 13))
+	assert.Equal(t,
+		[]SimpleInterval{{0, 100}, {10, 20}, {20, 30}},
+		overlaps(20, 20))
+	assert.Equal(t,
+		[]SimpleInterval{{0, 100}, {20, 30}, {31, 40}},
+		overlaps(25, 35))
+	assert.Equal(t,
+		[]SimpleInterval{{0, 100}, {90, 110}},
+		overlaps(95, 150))
+	assert.Equal(t,
+		[]SimpleInterval{{90, 110}, {200, 300}},
+		overlaps(105, 200))
+	assert.Nil(t, overlaps(111, 199))
+	assert.Nil(t, overlaps(301, 400))
+	assert.Nil(t, overlaps(-10, -1))
+
+	// Agrees with the more general Subrange.
+	for min := -5; min <= 305; min += 5 {
+		for max := min; max <= 305; max += 15 {
+			var exp []SimpleInterval
+			tree.Subrange(
+				func(k NativeOrdered[int]) int {
+					switch {
+					case k.Val < min:
+						return 1
+					case k.Val > max:
+						return -1
+					default:
+						return 0
+					}
+				},
+				func(v SimpleInterval) bool {
+					exp = append(exp, v)
+					return true
+				})
+			assert.Equal(t, exp, overlaps(min, max), "[%v,%v]", min, max)
+		}
+	}
+}
+
+//nolint:paralleltest // Can't be parallel because we test testing.AllocsPerRun.
+func TestIntervalTreeOverlapsAllocs(t *testing.T) {
+	tree := IntervalTree[NativeOrdered[int], SimpleInterval]{
+		MinFn: func(ival SimpleInterval) NativeOrdered[int] { return NativeOrdered[int]{ival.Min} },
+		MaxFn: func(ival SimpleInterval) NativeOrdered[int] { return NativeOrdered[int]{ival.Max} },
+	}
+	tree.Insert(SimpleInterval{0, 100})
+	tree.Insert(SimpleInterval{200, 300})
+	assert.Equal(t, float64(0), testing.AllocsPerRun(100, func() {
+		_ = tree.Overlaps(NativeOrdered[int]{150}, NativeOrdered[int]{160})
+	}))
+}
@@ -119,3 +119,39 @@ func (l *LinkedList[T]) MoveToNewest(entry *LinkedListEntry[T]) {
 	entry.Newer = nil
 	l.Newest = entry
 }
+
+// Range calls fn for each entry in the list, from oldest to newest,
+// stopping early if fn returns false.
+//
+// LinkedList does no locking of its own.  If the list is shared
+// between goroutines, then the caller must hold whatever lock guards
+// the list for the entire duration of the call to Range; that is what
+// makes the traversal consistent with respect to concurrent
+// evictions.  If the lock cannot be held that long, use Snapshot
+// instead.
+//
+// It is valid for fn to Delete (or MoveToNewest) the entry that it is
+// passed, but not to modify any other entry in the list.  An entry
+// moved to the newest position will be visited again.
+func (l *LinkedList[T]) Range(fn func(*LinkedListEntry[T]) bool) {
+	for entry := l.Oldest; entry != nil; {
+		next := entry.Newer
+		if !fn(entry) {
+			return
+		}
+		entry = next
+	}
+}
+
+// Snapshot returns a copy of the values in the list, from oldest to
+// newest.  As with Range, the caller must hold whatever lock guards
+// the list for the duration of the call; but the returned slice may
+// be used after the lock is released.
+func (l *LinkedList[T]) Snapshot() []T {
+	ret := make([]T, 0, l.Len)
+	l.Range(func(entry *LinkedListEntry[T]) bool {
+		ret = append(ret, entry.Value)
+		return true
+	})
+	return ret
+}
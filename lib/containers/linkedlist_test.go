@@ -0,0 +1,59 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package containers
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkedListRange(t *testing.T) {
+	t.Parallel()
+	var list LinkedList[int]
+	for i := 0; i < 5; i++ {
+		list.Store(&LinkedListEntry[int]{Value: i})
+	}
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, list.Snapshot())
+
+	// Deleting the current entry during Range is OK.
+	list.Range(func(entry *LinkedListEntry[int]) bool {
+		if entry.Value%2 == 1 {
+			list.Delete(entry)
+		}
+		return true
+	})
+	assert.Equal(t, []int{0, 2, 4}, list.Snapshot())
+	assert.Equal(t, 3, list.Len)
+
+	var seen []int
+	list.Range(func(entry *LinkedListEntry[int]) bool {
+		seen = append(seen, entry.Value)
+		return entry.Value < 2
+	})
+	assert.Equal(t, []int{0, 2}, seen)
+}
+
+func TestCacheKeys(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	src := SourceFunc[int, int](func(_ context.Context, k int, v *int) { *v = k })
+	for name, cache := range map[string]Cache[int, int]{
+		"lru": NewLRUCache[int, int](4, src),
+		"arc": NewARCache[int, int](4, src),
+	} {
+		for i := 0; i < 6; i++ {
+			cache.Acquire(ctx, i)
+			cache.Release(i)
+		}
+		cache.Acquire(ctx, 4) // pinned entries are included
+		keys := cache.Keys()
+		sort.Ints(keys)
+		assert.Equal(t, []int{2, 3, 4, 5}, keys, name)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"context"
 	"fmt"
 	"sync"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
 )
 
 // NewLRUCache returns a new thread-safe Cache with a simple
@@ -158,6 +160,22 @@ func (c *lruCache[K, V]) Acquire(ctx context.Context, k K) *V {
 	return &entry.Value.val
 }
 
+// TryAcquire implements the 'Cache' interface.
+func (c *lruCache[K, V]) TryAcquire(k K) (*V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.byName[k]
+	if entry == nil {
+		return nil, false
+	}
+	if entry.Value.refs == 0 {
+		c.evictable.Delete(entry)
+	}
+	entry.Value.refs++
+	return &entry.Value.val, true
+}
+
 // Delete implements the 'Cache' interface.
 func (c *lruCache[K, V]) Delete(k K) {
 	c.mu.Lock()
@@ -206,6 +224,45 @@ func (c *lruCache[K, V]) Release(k K) {
 	}
 }
 
+// Resize implements the 'Cache' interface.
+//
+//nolint:predeclared // 'cap' is the best name for it.
+func (c *lruCache[K, V]) Resize(ctx context.Context, cap int) {
+	if cap <= 0 {
+		panic(fmt.Errorf("containers.lruCache.Resize: invalid capacity: %v", cap))
+	}
+	c.mu.Lock()
+
+	// Shrink: discard unused entries first, and then flush and
+	// evict the least-recently-used entries; blocking in
+	// .waitForAvail() if everything left is pinned.
+	for c.cap > cap {
+		c.waitForAvail()
+		if entry := c.unused.Oldest; entry != nil {
+			c.unused.Delete(entry)
+		} else {
+			entry := c.evictable.Oldest
+			c.evictable.Delete(entry)
+			delete(c.byName, entry.Value.key)
+			c.src.Flush(ctx, &entry.Value.val)
+		}
+		c.cap--
+	}
+
+	// Grow.
+	for c.cap < cap {
+		c.unused.Store(new(LinkedListEntry[lruEntry[K, V]]))
+		c.cap++
+	}
+
+	// Growing may have made room for more than one waiter.
+	for !c.waiters.IsEmpty() && !(c.unused.IsEmpty() && c.evictable.IsEmpty()) {
+		c.unlockAndNotifyAvail()
+		c.mu.Lock()
+	}
+	c.mu.Unlock()
+}
+
 // Flush implements the 'Cache' interface.
 func (c *lruCache[K, V]) Flush(ctx context.Context) {
 	c.mu.Lock()
@@ -214,7 +271,16 @@ func (c *lruCache[K, V]) Flush(ctx context.Context) {
 	for _, entry := range c.byName {
 		c.src.Flush(ctx, &entry.Value.val)
 	}
-	for entry := c.unused.Oldest; entry != nil; entry = entry.Newer {
+	c.unused.Range(func(entry *LinkedListEntry[lruEntry[K, V]]) bool {
 		c.src.Flush(ctx, &entry.Value.val)
-	}
+		return true
+	})
+}
+
+// Keys implements the 'Cache' interface.
+func (c *lruCache[K, V]) Keys() []K {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return maps.Keys(c.byName)
 }
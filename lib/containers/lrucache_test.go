@@ -6,6 +6,7 @@ package containers
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -99,3 +100,85 @@ func TestLRUAllocs(t *testing.T) {
 		}
 	}
 }
+
+func TestLRUResize(t *testing.T) {
+	t.Parallel()
+	const tick = time.Second / 2
+
+	ctx := dlog.NewTestContext(t, false)
+
+	cache := NewLRUCache[int, int](4,
+		SourceFunc[int, int](func(_ context.Context, k int, v *int) { *v = k * k }))
+	for i := 1; i <= 4; i++ {
+		cache.Acquire(ctx, i)
+	}
+	cache.Release(1)
+	cache.Release(2)
+
+	// 1 and 2 can be evicted right away, but 3 is pinned.
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		cache.Resize(ctx, 1)
+		close(done)
+	}()
+	go func() {
+		time.Sleep(tick)
+		cache.Release(3)
+	}()
+	<-done
+	assert.Greater(t, time.Since(start), tick)
+	assert.Equal(t, []int{4}, cache.Keys())
+
+	cache.Resize(ctx, 3)
+	assert.Equal(t, 2, cache.(*lruCache[int, int]).unused.Len)
+	for i := 5; i <= 6; i++ {
+		assert.Equal(t, i*i, *cache.Acquire(ctx, i))
+	}
+	assert.ElementsMatch(t, []int{4, 5, 6}, cache.Keys())
+}
+
+// dirtySource is a write-back Source: values are "dirty" until they
+// are flushed, either by .Flush or by being re-used by .Load.
+type dirtySource struct {
+	mu      sync.Mutex
+	written []int
+}
+
+type dirtyVal struct {
+	key   int
+	dirty bool
+}
+
+func (src *dirtySource) Load(ctx context.Context, k int, v *dirtyVal) {
+	src.Flush(ctx, v)
+	*v = dirtyVal{key: k, dirty: true}
+}
+
+func (src *dirtySource) Flush(_ context.Context, v *dirtyVal) {
+	if !v.dirty {
+		return
+	}
+	src.mu.Lock()
+	src.written = append(src.written, v.key)
+	src.mu.Unlock()
+	v.dirty = false
+}
+
+func TestLRUResizeFlush(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+
+	src := new(dirtySource)
+	cache := NewLRUCache[int, dirtyVal](4, src)
+	for i := 1; i <= 4; i++ {
+		cache.Acquire(ctx, i)
+		cache.Release(i)
+	}
+	cache.Resize(ctx, 1)
+	assert.Equal(t, []int{1, 2, 3}, src.written)
+	assert.Equal(t, []int{4}, cache.Keys())
+
+	cache.Flush(ctx)
+	assert.Equal(t, []int{1, 2, 3, 4}, src.written)
+}
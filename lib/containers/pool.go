@@ -0,0 +1,134 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package containers
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"git.lukeshu.com/go/typedsync"
+)
+
+// Pool is a typedsync.Pool that may be instrumented with
+// SetPoolDebug.  As with typedsync.Pool, the zero Pool is ready to
+// use.
+type Pool[T comparable] struct {
+	// Name identifies the pool in PoolReport.
+	Name string
+	// New optionally specifies a function to generate a value
+	// when Get would otherwise return ok=false.
+	New func() T
+
+	inner typedsync.Pool[T]
+	debug poolDebugState
+}
+
+func (p *Pool[T]) Get() (val T, ok bool) {
+	val, ok = p.inner.Get()
+	if poolDebug.Load() {
+		stats := p.debug.init(p.Name)
+		if !ok && p.New != nil {
+			stats.news.Add(1)
+		}
+		if ok || p.New != nil {
+			stats.gets.Add(1)
+		}
+	}
+	if !ok && p.New != nil {
+		val, ok = p.New(), true
+	}
+	return val, ok
+}
+
+func (p *Pool[T]) Put(val T) {
+	if poolDebug.Load() {
+		p.debug.init(p.Name).puts.Add(1)
+	}
+	p.inner.Put(val)
+}
+
+// Instrumentation /////////////////////////////////////////////////////////////
+
+var (
+	poolDebug atomic.Bool
+
+	poolRegistryMu sync.Mutex
+	poolRegistry   []*poolCounters
+)
+
+// SetPoolDebug turns instrumentation of every Pool and SlicePool on or
+// off.  It should be called before any of the pools are used, as
+// objects that cross the boundary are miscounted.
+//
+// When instrumentation is on, each pool counts its Gets and Puts (see
+// PoolReport).  This is just a few atomic increments per call, and
+// does not change how (or how long) free objects are held.
+func SetPoolDebug(enabled bool) {
+	poolDebug.Store(enabled)
+}
+
+// PoolStats are the counters for a single pool; see SetPoolDebug.
+type PoolStats struct {
+	Name string
+	// Gets is the number of calls to Get that returned an object,
+	// and News is how many of those had to allocate a new object.
+	Gets, News int64
+	// Puts is the number of calls to Put.
+	Puts int64
+}
+
+// Outstanding returns the number of objects that have been gotten
+// but not put back; that is, objects that are either still in use or
+// have been leaked.  A negative number means that something was Put
+// more times than it was gotten (a double-free).
+func (s PoolStats) Outstanding() int64 {
+	return s.Gets - s.Puts
+}
+
+// PoolReport returns the stats of every pool that has been used while
+// instrumentation was turned on, sorted by name.
+func PoolReport() []PoolStats {
+	poolRegistryMu.Lock()
+	defer poolRegistryMu.Unlock()
+	ret := make([]PoolStats, 0, len(poolRegistry))
+	for _, c := range poolRegistry {
+		ret = append(ret, PoolStats{
+			Name: c.name,
+			Gets: c.gets.Load(),
+			News: c.news.Load(),
+			Puts: c.puts.Load(),
+		})
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+type poolCounters struct {
+	name             string
+	gets, news, puts atomic.Int64
+}
+
+// poolDebugState is the lazily-registered counters of an
+// instrumented pool.
+type poolDebugState struct {
+	once     sync.Once
+	counters *poolCounters
+}
+
+func (s *poolDebugState) init(name string) *poolCounters {
+	s.once.Do(func() {
+		if name == "" {
+			name = "(unnamed)"
+		}
+		s.counters = &poolCounters{name: name}
+		poolRegistryMu.Lock()
+		poolRegistry = append(poolRegistry, s.counters)
+		poolRegistryMu.Unlock()
+	})
+	return s.counters
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package containers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func findPoolStats(t *testing.T, name string) PoolStats {
+	t.Helper()
+	for _, stats := range PoolReport() {
+		if stats.Name == name {
+			return stats
+		}
+	}
+	t.Fatalf("no pool named %q in report", name)
+	return PoolStats{}
+}
+
+// freeCheckingPool wraps a Pool to detect double-frees in tests.  It
+// remembers (at most) the `limit` most-recently Put objects that have
+// not since been gotten again, and flags a Put of any of those.  The
+// bound means that it may miss a double-free of an object that has
+// been sitting free for a while, but it never holds on to more than
+// `limit` objects.
+type freeCheckingPool[T comparable] struct {
+	*Pool[T]
+	limit int
+
+	free        map[T]struct{}
+	order       []T
+	doubleFrees int
+}
+
+func (p *freeCheckingPool[T]) Get() (T, bool) {
+	val, ok := p.Pool.Get()
+	if ok {
+		delete(p.free, val)
+	}
+	return val, ok
+}
+
+func (p *freeCheckingPool[T]) Put(val T) {
+	if _, dup := p.free[val]; dup {
+		p.doubleFrees++
+		return
+	}
+	if p.free == nil {
+		p.free = make(map[T]struct{}, p.limit)
+	}
+	p.free[val] = struct{}{}
+	p.order = append(p.order, val)
+	if len(p.order) > p.limit {
+		delete(p.free, p.order[0])
+		p.order = p.order[1:]
+	}
+	p.Pool.Put(val)
+}
+
+//nolint:paralleltest // Can't be parallel because SetPoolDebug is global.
+func TestPoolDebug(t *testing.T) {
+	SetPoolDebug(true)
+	defer SetPoolDebug(false)
+
+	// Pool
+	pool := &Pool[*int]{
+		Name: "test.Pool",
+		New:  func() *int { return new(int) },
+	}
+	a, ok := pool.Get()
+	require.True(t, ok)
+	b, ok := pool.Get()
+	require.True(t, ok)
+	assert.NotSame(t, a, b)
+	pool.Put(a)
+	_, ok = pool.Get()
+	require.True(t, ok)
+	stats := findPoolStats(t, "test.Pool")
+	assert.Equal(t, int64(3), stats.Gets)
+	assert.Equal(t, int64(1), stats.Puts)
+	// Whether the 3rd Get got `a` back is up to the sync.Pool.
+	assert.GreaterOrEqual(t, stats.News, int64(2))
+	assert.LessOrEqual(t, stats.News, int64(3))
+	assert.Equal(t, int64(2), stats.Outstanding())
+
+	// SlicePool
+	slicePool := &SlicePool[byte]{Name: "test.SlicePool"}
+	x := slicePool.Get(16)
+	assert.Len(t, x, 16)
+	slicePool.Put(x)
+	y := slicePool.Get(8)
+	assert.Len(t, y, 8)
+	slicePool.Put(y)
+	slicePool.Put(y) // double-free
+	stats = findPoolStats(t, "test.SlicePool")
+	assert.Equal(t, int64(2), stats.Gets)
+	assert.Equal(t, int64(3), stats.Puts)
+	assert.Equal(t, int64(-1), stats.Outstanding())
+}
+
+func TestFreeCheckingPool(t *testing.T) {
+	t.Parallel()
+	pool := &freeCheckingPool[*int]{
+		Pool: &Pool[*int]{
+			New: func() *int { return new(int) },
+		},
+		limit: 2,
+	}
+	a, _ := pool.Get()
+	b, _ := pool.Get()
+	c, _ := pool.Get()
+
+	pool.Put(a)
+	pool.Put(a)
+	assert.Equal(t, 1, pool.doubleFrees)
+
+	// The free-list is bounded; `a` falls out of it.
+	pool.Put(b)
+	pool.Put(c)
+	assert.Len(t, pool.free, 2)
+	pool.Put(a)
+	assert.Equal(t, 1, pool.doubleFrees)
+	pool.Put(c)
+	assert.Equal(t, 2, pool.doubleFrees)
+}
@@ -6,6 +6,7 @@ package containers
 
 import (
 	"fmt"
+	"math/bits"
 	"reflect"
 )
 
@@ -35,6 +36,11 @@ type RBTree[T Ordered[T]] struct {
 	AttrFn func(*RBNode[T])
 	root   *RBNode[T]
 	len    int
+
+	// free is a list (linked by .Right) of nodes to be re-used
+	// by Insert; see .Free() and .Clear().
+	free    *RBNode[T]
+	numFree int
 }
 
 func (t *RBTree[T]) Len() int {
@@ -163,7 +169,25 @@ func (cur *RBNode[T]) Prev() *RBNode[T] {
 // Subrange is like Search, but for when there may be more than one
 // result.
 func (t *RBTree[T]) Subrange(rangeFn func(T) int, handleFn func(*RBNode[T]) bool) {
-	// Find the left-most acceptable node.
+	// Walk forward from the left-most acceptable node until we hit
+	// the end.
+	for node := t.subrangeFirst(rangeFn); node != nil && rangeFn(node.Value) == 0; node = node.Next() {
+		if keepGoing := handleFn(node); !keepGoing {
+			return
+		}
+	}
+}
+
+// SubrangeHas returns whether Subrange would visit any nodes, in
+// O(log n).
+func (t *RBTree[T]) SubrangeHas(rangeFn func(T) int) bool {
+	node := t.subrangeFirst(rangeFn)
+	return node != nil && rangeFn(node.Value) == 0
+}
+
+// subrangeFirst returns the left-most node for which rangeFn returns
+// 0, or else the node after where it would be (or nil).
+func (t *RBTree[T]) subrangeFirst(rangeFn func(T) int) *RBNode[T] {
 	_, node := t.root.search(func(v T) int {
 		if rangeFn(v) <= 0 {
 			return -1
@@ -173,13 +197,77 @@ func (t *RBTree[T]) Subrange(rangeFn func(T) int, handleFn func(*RBNode[T]) bool
 	for node != nil && rangeFn(node.Value) > 0 {
 		node = node.Next()
 	}
-	// Now walk forward until we hit the end.
-	for node != nil && rangeFn(node.Value) == 0 {
-		if keepGoing := handleFn(node); !keepGoing {
-			return
+	return node
+}
+
+// Clone returns a deep copy of the tree.  The copy has the exact same
+// shape as the original (so no re-balancing is done, and iteration
+// order is identical), but shares no nodes with it; mutating one
+// does not affect the other.  The values themselves are copied with
+// plain assignment.
+func (t *RBTree[T]) Clone() RBTree[T] {
+	return RBTree[T]{
+		AttrFn: t.AttrFn,
+		root:   t.root.clone(nil),
+		len:    t.len,
+	}
+}
+
+// rbTreeFromSorted builds a tree from a list of values that is
+// already sorted and free of duplicates, in O(n) and without any
+// comparisons or re-balancing.  The result is perfectly balanced:
+// every level is full except for the deepest, whose nodes are red.
+func rbTreeFromSorted[T Ordered[T]](vals []T) RBTree[T] {
+	nodes := make([]*RBNode[T], len(vals))
+	for i := range vals {
+		nodes[i] = &RBNode[T]{Value: vals[i]}
+	}
+	var ret RBTree[T]
+	ret.relink(nodes)
+	return ret
+}
+
+// relink makes the tree be exactly `nodes` (which must be in order),
+// re-using the nodes rather than allocating new ones.  Like
+// rbTreeFromSorted, it is O(n), without any comparisons or
+// re-balancing, and the result is perfectly balanced.
+func (t *RBTree[T]) relink(nodes []*RBNode[T]) {
+	redDepth := bits.Len(uint(len(nodes))) - 1
+	var build func(parent *RBNode[T], nodes []*RBNode[T], depth int) *RBNode[T]
+	build = func(parent *RBNode[T], nodes []*RBNode[T], depth int) *RBNode[T] {
+		if len(nodes) == 0 {
+			return nil
 		}
-		node = node.Next()
+		mid := len(nodes) / 2
+		node := nodes[mid]
+		node.Parent = parent
+		node.Color = Black
+		if depth > 0 && depth == redDepth {
+			node.Color = Red
+		}
+		node.Left = build(node, nodes[:mid], depth+1)
+		node.Right = build(node, nodes[mid+1:], depth+1)
+		if t.AttrFn != nil {
+			t.AttrFn(node)
+		}
+		return node
+	}
+	t.root = build(nil, nodes, 0)
+	t.len = len(nodes)
+}
+
+func (node *RBNode[T]) clone(parent *RBNode[T]) *RBNode[T] {
+	if node == nil {
+		return nil
+	}
+	ret := &RBNode[T]{
+		Parent: parent,
+		Color:  node.Color,
+		Value:  node.Value,
 	}
+	ret.Left = node.Left.clone(ret)
+	ret.Right = node.Right.clone(ret)
+	return ret
 }
 
 func (t *RBTree[T]) Equal(u *RBTree[T]) bool {
@@ -312,7 +400,8 @@ func (t *RBTree[T]) Insert(val T) {
 	}
 	t.len++
 
-	node := &RBNode[T]{
+	node := t.alloc()
+	*node = RBNode[T]{
 		Color:  Red,
 		Parent: parent,
 		Value:  val,
@@ -370,6 +459,119 @@ func (t *RBTree[T]) Insert(val T) {
 	t.root.Color = Black
 }
 
+func (t *RBTree[T]) alloc() *RBNode[T] {
+	if t.free == nil {
+		return new(RBNode[T])
+	}
+	node := t.free
+	t.free = node.Right
+	t.numFree--
+	return node
+}
+
+func (t *RBTree[T]) recycle(node *RBNode[T]) {
+	*node = RBNode[T]{
+		Right: t.free,
+	}
+	t.free = node
+	t.numFree++
+}
+
+// Free is like Delete, but also allows the node to be re-used by a
+// later Insert.  The caller must not hold on to the node (or to any
+// pointers in to its Value) after calling Free.
+func (t *RBTree[T]) Free(node *RBNode[T]) {
+	if node == nil {
+		return
+	}
+	t.Delete(node)
+	t.recycle(node)
+}
+
+// Clear removes every value from the tree, keeping the nodes to be
+// re-used by later Inserts; it is a cheaper alternative to
+// allocating a new tree for each use of a short-lived tree.  As with
+// Free, the caller must not hold on to any of the nodes.
+func (t *RBTree[T]) Clear() {
+	var recycleAll func(*RBNode[T])
+	recycleAll = func(node *RBNode[T]) {
+		if node == nil {
+			return
+		}
+		recycleAll(node.Left)
+		recycleAll(node.Right)
+		t.recycle(node)
+	}
+	recycleAll(t.root)
+	t.root = nil
+	t.len = 0
+}
+
+// Cap returns the number of nodes that the tree holds, whether they
+// are in use or are waiting to be re-used.
+func (t *RBTree[T]) Cap() int {
+	return t.len + t.numFree
+}
+
+// DeleteRange removes the nodes `min` and `max`, and every node
+// between them, recycling them to be re-used by later Inserts (as
+// with Free).  It returns the number of nodes removed.  `max` must
+// not come before `min`.
+//
+// Removing k nodes one at a time is O(k log n); if k is a large
+// enough fraction of the tree that rebuilding the tree from the
+// remaining nodes (in O(n), without any comparisons or re-balancing)
+// is cheaper, then DeleteRange does that instead.
+func (t *RBTree[T]) DeleteRange(min, max *RBNode[T]) int {
+	if min == nil || max == nil {
+		return 0
+	}
+	k := 1
+	for node := min; node != max; node = node.Next() {
+		if node == nil {
+			panic(fmt.Errorf("RBTree.DeleteRange: max node %p is not after min node %p", max, min))
+		}
+		k++
+	}
+
+	if k*bits.Len(uint(t.len)) <= t.len {
+		for node := min; ; {
+			next := node.Next()
+			last := node == max
+			t.Free(node)
+			if last {
+				break
+			}
+			node = next
+		}
+		return k
+	}
+
+	kept := make([]*RBNode[T], 0, t.len-k)
+	deleted := make([]*RBNode[T], 0, k)
+	inRange := false
+	for node := t.Min(); node != nil; node = node.Next() {
+		if node == min {
+			inRange = true
+		}
+		if inRange {
+			deleted = append(deleted, node)
+		} else {
+			kept = append(kept, node)
+		}
+		if node == max {
+			inRange = false
+		}
+	}
+	// Don't recycle the nodes until after the walk, since .Next()
+	// may pass through them.
+	for _, node := range deleted {
+		t.recycle(node)
+	}
+	t.relink(kept)
+	return k
+}
+
 func (t *RBTree[T]) transplant(oldNode, newNode *RBNode[T]) {
 	*t.parentChild(oldNode) = newNode
 	if newNode != nil {
@@ -110,6 +110,7 @@ func checkRBTree[T constraints.Ordered](t *testing.T, expectedSet Set[T], tree *
 func FuzzRBTree(f *testing.F) {
 	ins := uint8(0b0100_0000)
 	del := uint8(0)
+	free := uint8(0b1000_0000)
 
 	f.Add([]uint8{})
 	f.Add([]uint8{ins | 5, del | 5})
@@ -128,6 +129,7 @@ func FuzzRBTree(f *testing.F) {
 
 		ins | 4,
 	})
+	f.Add([]uint8{ins | 1, ins | 2, ins | 3, free | 2, ins | 4, free | 1, ins | 2})
 
 	f.Fuzz(func(t *testing.T, dat []uint8) {
 		tree := new(RBTree[NativeOrdered[uint8]])
@@ -136,8 +138,10 @@ func FuzzRBTree(f *testing.F) {
 		t.Logf("\n%s\n", tree.ASCIIArt())
 		for _, b := range dat {
 			ins := (b & 0b0100_0000) != 0
+			free := (b & 0b1000_0000) != 0
 			val := (b & 0b0011_1111)
-			if ins {
+			switch {
+			case ins:
 				t.Logf("Insert(%v)", val)
 				tree.Insert(NativeOrdered[uint8]{Val: val})
 				set.Insert(val)
@@ -145,7 +149,13 @@ func FuzzRBTree(f *testing.F) {
 				node := tree.Search(NativeOrdered[uint8]{Val: val}.Compare)
 				require.NotNil(t, node)
 				require.Equal(t, val, node.Value.Val)
-			} else {
+			case free:
+				t.Logf("Free(%v)", val)
+				tree.Free(tree.Search(NativeOrdered[uint8]{Val: val}.Compare))
+				delete(set, val)
+				t.Logf("\n%s\n", tree.ASCIIArt())
+				require.Nil(t, tree.Search(NativeOrdered[uint8]{Val: val}.Compare))
+			default:
 				t.Logf("Delete(%v)", val)
 				tree.Delete(tree.Search(NativeOrdered[uint8]{Val: val}.Compare))
 				delete(set, val)
@@ -154,5 +164,69 @@ func FuzzRBTree(f *testing.F) {
 			}
 			checkRBTree(t, set, tree)
 		}
+
+		// Clearing, then re-using the recycled nodes, must
+		// give the same result as a fresh tree.
+		capBefore := tree.Cap()
+		tree.Clear()
+		checkRBTree(t, Set[uint8]{}, tree)
+		require.Equal(t, capBefore, tree.Cap())
+		for val := range set {
+			tree.Insert(NativeOrdered[uint8]{Val: val})
+		}
+		checkRBTree(t, set, tree)
 	})
 }
+
+// TestRBTreeDeleteRange checks that DeleteRange gives the same result
+// as deleting the same nodes one at a time, both for short ranges
+// (which are deleted one at a time) and for long ranges (for which
+// the tree is rebuilt).
+func TestRBTreeDeleteRange(t *testing.T) {
+	t.Parallel()
+	const n = 100
+	for _, tc := range [][2]int{{0, 0}, {10, 10}, {10, 12}, {0, 49}, {30, 89}, {0, 99}, {99, 99}, {50, 99}} {
+		beg, end := tc[0], tc[1]
+		build := func() *RBTree[NativeOrdered[int]] {
+			tree := new(RBTree[NativeOrdered[int]])
+			for i := 0; i < n; i++ {
+				tree.Insert(NativeOrdered[int]{Val: i})
+			}
+			return tree
+		}
+		search := func(tree *RBTree[NativeOrdered[int]], i int) *RBNode[NativeOrdered[int]] {
+			return tree.Search(NativeOrdered[int]{Val: i}.Compare)
+		}
+
+		single := build()
+		for i := beg; i <= end; i++ {
+			single.Free(search(single, i))
+		}
+
+		bulk := build()
+		capBefore := bulk.Cap()
+		require.Equal(t, end-beg+1, bulk.DeleteRange(search(bulk, beg), search(bulk, end)), "range=%v", tc)
+		require.Equal(t, capBefore, bulk.Cap(), "range=%v", tc)
+
+		expected := make(Set[int])
+		for i := 0; i < n; i++ {
+			if i < beg || i > end {
+				expected.Insert(i)
+			}
+		}
+		checkRBTree(t, expected, bulk)
+		require.True(t, single.Equal(bulk), "range=%v", tc)
+
+		// Check the parent pointers, by walking with .Next().
+		var walked []int
+		for node := bulk.Min(); node != nil; node = node.Next() {
+			walked = append(walked, node.Value.Val)
+		}
+		require.Equal(t, len(expected), len(walked), "range=%v", tc)
+
+		// And check that it can still be mutated.
+		bulk.Insert(NativeOrdered[int]{Val: beg})
+		expected.Insert(beg)
+		checkRBTree(t, expected, bulk)
+	}
+}
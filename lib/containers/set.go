@@ -145,15 +145,43 @@ func (a Set[T]) HasAny(b Set[T]) bool {
 	return maps.HaveAnyKeysInCommon(a, b)
 }
 
+// IsDisjoint returns whether the sets have no members in common; it
+// is the opposite of HasAny.
+func (a Set[T]) IsDisjoint(b Set[T]) bool {
+	return !maps.HaveAnyKeysInCommon(a, b)
+}
+
+// Intersection returns a new set of the members that are in both
+// sets.
+//
+// The result is only allocated if it is non-empty; an empty result is
+// a nil Set, which may be read from (len, Has, range) but not
+// inserted in to.
 func (small Set[T]) Intersection(big Set[T]) Set[T] {
 	if len(big) < len(small) {
 		small, big = big, small
 	}
-	ret := make(Set[T])
+	var ret Set[T]
 	for v := range small {
 		if maps.HasKey(big, v) {
+			if ret == nil {
+				ret = make(Set[T])
+			}
 			ret.Insert(v)
 		}
 	}
 	return ret
 }
+
+// Union returns a new set of the members that are in either set.
+//
+// As with Intersection, an empty result is a nil Set.
+func (a Set[T]) Union(b Set[T]) Set[T] {
+	if len(a)+len(b) == 0 {
+		return nil
+	}
+	ret := make(Set[T], len(a)+len(b))
+	ret.InsertFrom(a)
+	ret.InsertFrom(b)
+	return ret
+}
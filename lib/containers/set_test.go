@@ -0,0 +1,76 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package containers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetOps(t *testing.T) {
+	t.Parallel()
+	type testcase struct {
+		A, B            Set[int]
+		ExpIntersection Set[int]
+		ExpUnion        Set[int]
+	}
+	testcases := map[string]testcase{
+		"both-empty":  {A: nil, B: NewSet[int](), ExpIntersection: nil, ExpUnion: nil},
+		"one-empty":   {A: NewSet(1, 2), B: nil, ExpIntersection: nil, ExpUnion: NewSet(1, 2)},
+		"disjoint":    {A: NewSet(1, 2), B: NewSet(3), ExpIntersection: nil, ExpUnion: NewSet(1, 2, 3)},
+		"overlapping": {A: NewSet(1, 2, 3), B: NewSet(3, 4), ExpIntersection: NewSet(3), ExpUnion: NewSet(1, 2, 3, 4)},
+		"equal":       {A: NewSet(1, 2), B: NewSet(2, 1), ExpIntersection: NewSet(1, 2), ExpUnion: NewSet(1, 2)},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.ExpIntersection, tc.A.Intersection(tc.B))
+			assert.Equal(t, tc.ExpIntersection, tc.B.Intersection(tc.A))
+			assert.Equal(t, tc.ExpUnion, tc.A.Union(tc.B))
+			assert.Equal(t, tc.ExpUnion, tc.B.Union(tc.A))
+			assert.Equal(t, len(tc.ExpIntersection) == 0, tc.A.IsDisjoint(tc.B))
+			assert.Equal(t, len(tc.ExpIntersection) > 0, tc.A.HasAny(tc.B))
+		})
+	}
+
+	// The results must not alias the inputs.
+	a := NewSet(1)
+	u := a.Union(nil)
+	u.Insert(2)
+	assert.Equal(t, NewSet(1), a)
+}
+
+var benchSetSink Set[int]
+
+// BenchmarkSetIntersection mimics the logging loop at the end of the
+// rebuild-trees augment resolution, which intersects each of the many
+// small candidate lists with the set of accepted augments; most of
+// the intersections are empty.
+func BenchmarkSetIntersection(b *testing.B) {
+	const (
+		numLists = 1000
+		listLen  = 3
+	)
+	lists := make([]Set[int], numLists)
+	for i := range lists {
+		lists[i] = make(Set[int], listLen)
+		for j := 0; j < listLen; j++ {
+			lists[i].Insert(i*listLen + j)
+		}
+	}
+	accepted := make(Set[int])
+	for i := 0; i < numLists*listLen; i += 10 * listLen {
+		accepted.Insert(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, list := range lists {
+			benchSetSink = list.Intersection(accepted)
+		}
+	}
+}
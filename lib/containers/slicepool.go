@@ -8,10 +8,16 @@ import (
 	"git.lukeshu.com/go/typedsync"
 )
 
+// SlicePool is a pool of slices that may be instrumented with
+// SetPoolDebug.  The zero SlicePool is ready to use.
 type SlicePool[T any] struct {
+	// Name identifies the pool in PoolReport.
+	Name string
+
 	// TODO(lukeshu): Consider bucketing slices by size, to
 	// increase odds that the `cap(ret) >= size` check passes.
 	inner typedsync.Pool[[]T]
+	debug poolDebugState
 }
 
 func (p *SlicePool[T]) Get(size int) []T {
@@ -19,6 +25,13 @@ func (p *SlicePool[T]) Get(size int) []T {
 		return nil
 	}
 	ret, ok := p.inner.Get()
+	if poolDebug.Load() {
+		stats := p.debug.init(p.Name)
+		stats.gets.Add(1)
+		if !ok || cap(ret) < size {
+			stats.news.Add(1)
+		}
+	}
 	if ok && cap(ret) >= size {
 		ret = ret[:size]
 	} else {
@@ -31,5 +44,8 @@ func (p *SlicePool[T]) Put(slice []T) {
 	if slice == nil {
 		return
 	}
+	if poolDebug.Load() {
+		p.debug.init(p.Name).puts.Add(1)
+	}
 	p.inner.Put(slice)
 }
@@ -4,6 +4,10 @@
 
 package containers
 
+import (
+	"fmt"
+)
+
 type orderedKV[K Ordered[K], V any] struct {
 	K K
 	V V
@@ -62,6 +66,22 @@ func (m *SortedMap[K, V]) Subrange(rangeFn func(K, V) int, handleFn func(K, V) b
 		func(node *RBNode[orderedKV[K, V]]) bool { return handleFn(node.Value.K, node.Value.V) })
 }
 
+// SubrangeHas returns whether there are any keys in the inclusive
+// range [lo, hi], in O(log n); this is useful for skipping work on
+// empty ranges.
+func (m *SortedMap[K, V]) SubrangeHas(lo, hi K) bool {
+	return m.inner.SubrangeHas(func(kv orderedKV[K, V]) int {
+		switch {
+		case kv.K.Compare(lo) < 0:
+			return 1
+		case kv.K.Compare(hi) > 0:
+			return -1
+		default:
+			return 0
+		}
+	})
+}
+
 func (m *SortedMap[K, V]) Search(fn func(K, V) int) (K, V, bool) {
 	node := m.inner.Search(func(kv orderedKV[K, V]) int {
 		return fn(kv.K, kv.V)
@@ -77,3 +97,40 @@ func (m *SortedMap[K, V]) Search(fn func(K, V) int) (K, V, bool) {
 func (m *SortedMap[K, V]) Len() int {
 	return m.inner.Len()
 }
+
+// SortedMapFromSorted builds a SortedMap from entries that are
+// already sorted by key; `each` should call `yield` for each entry,
+// in order.  As with .Store(), if several entries have the same key,
+// the last one wins.  This is O(n), and much cheaper than calling
+// .Store() for each entry, as it does not need to re-balance the map
+// as it goes.
+//
+// It panics if the entries are not sorted.
+func SortedMapFromSorted[K Ordered[K], V any](each func(yield func(K, V))) SortedMap[K, V] {
+	var kvs []orderedKV[K, V]
+	each(func(k K, v V) {
+		if n := len(kvs); n > 0 {
+			switch cmp := k.Compare(kvs[n-1].K); {
+			case cmp < 0:
+				panic(fmt.Errorf("containers.SortedMapFromSorted: keys are out of order: %v after %v", k, kvs[n-1].K))
+			case cmp == 0:
+				kvs[n-1].V = v
+				return
+			}
+		}
+		kvs = append(kvs, orderedKV[K, V]{K: k, V: v})
+	})
+	return SortedMap[K, V]{
+		inner: rbTreeFromSorted(kvs),
+	}
+}
+
+// Clone returns a copy of the map that may be mutated without
+// affecting the original.  This is O(n), but is much cheaper than
+// re-inserting every entry in to a fresh map, as it does not need to
+// do any comparisons or re-balancing.
+func (m *SortedMap[K, V]) Clone() SortedMap[K, V] {
+	return SortedMap[K, V]{
+		inner: m.inner.Clone(),
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package containers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sortedMapKeys[K Ordered[K], V any](m *SortedMap[K, V]) []K {
+	var ret []K
+	m.Range(func(k K, _ V) bool {
+		ret = append(ret, k)
+		return true
+	})
+	return ret
+}
+
+func TestSortedMapClone(t *testing.T) {
+	t.Parallel()
+	var orig SortedMap[NativeOrdered[int], string]
+	for _, k := range []int{5, 3, 8, 1, 4, 7, 9} {
+		orig.Store(NativeOrdered[int]{k}, "orig")
+	}
+
+	clone := orig.Clone()
+	assert.Equal(t, sortedMapKeys(&orig), sortedMapKeys(&clone))
+	assert.True(t, orig.inner.Equal(&clone.inner))
+
+	clone.Store(NativeOrdered[int]{6}, "clone")
+	clone.Store(NativeOrdered[int]{3}, "clone")
+	clone.Delete(NativeOrdered[int]{9})
+
+	assert.Equal(t, 7, orig.Len())
+	assert.Equal(t, 7, clone.Len())
+	assert.False(t, orig.Has(NativeOrdered[int]{6}))
+	assert.True(t, orig.Has(NativeOrdered[int]{9}))
+	v, _ := orig.Load(NativeOrdered[int]{3})
+	assert.Equal(t, "orig", v)
+	v, _ = clone.Load(NativeOrdered[int]{3})
+	assert.Equal(t, "clone", v)
+
+	var cloneTree RBTree[NativeOrdered[int]]
+	clone.Range(func(k NativeOrdered[int], _ string) bool {
+		cloneTree.Insert(k)
+		return true
+	})
+	checkRBTree(t, NewSet[int](1, 3, 4, 5, 6, 7, 8), &cloneTree)
+}
+
+func TestSortedMapFromSorted(t *testing.T) {
+	t.Parallel()
+	for n := 0; n < 300; n++ {
+		var incremental SortedMap[NativeOrdered[int], int]
+		var vals []NativeOrdered[int]
+		for i := 0; i < n; i++ {
+			incremental.Store(NativeOrdered[int]{i}, i)
+			vals = append(vals, NativeOrdered[int]{i})
+		}
+		bulk := SortedMapFromSorted(func(yield func(NativeOrdered[int], int)) {
+			for i := 0; i < n; i++ {
+				yield(NativeOrdered[int]{i}, i)
+			}
+		})
+		assert.Equal(t, n, bulk.Len())
+		assert.Equal(t, sortedMapKeys(&incremental), sortedMapKeys(&bulk))
+
+		// Check the red-black invariants.
+		tree := rbTreeFromSorted(vals)
+		checkRBTree(t, NewSet(func() []int {
+			ret := make([]int, n)
+			for i := range ret {
+				ret[i] = i
+			}
+			return ret
+		}()...), &tree)
+		if t.Failed() {
+			t.Logf("n=%v:\n%s", n, tree.ASCIIArt())
+			return
+		}
+
+		// And check that it can still be mutated.
+		bulk.Store(NativeOrdered[int]{-1}, -1)
+		bulk.Delete(NativeOrdered[int]{n / 2})
+		incremental.Store(NativeOrdered[int]{-1}, -1)
+		incremental.Delete(NativeOrdered[int]{n / 2})
+		assert.Equal(t, sortedMapKeys(&incremental), sortedMapKeys(&bulk))
+	}
+}
+
+func TestSortedMapFromSortedDups(t *testing.T) {
+	t.Parallel()
+	entries := []struct {
+		K int
+		V string
+	}{{1, "a"}, {2, "b"}, {2, "c"}, {3, "d"}, {3, "e"}, {3, "f"}, {4, "g"}}
+
+	var incremental SortedMap[NativeOrdered[int], string]
+	for _, e := range entries {
+		incremental.Store(NativeOrdered[int]{e.K}, e.V)
+	}
+	bulk := SortedMapFromSorted(func(yield func(NativeOrdered[int], string)) {
+		for _, e := range entries {
+			yield(NativeOrdered[int]{e.K}, e.V)
+		}
+	})
+	assert.Equal(t, incremental.Len(), bulk.Len())
+	for k := 0; k <= 5; k++ {
+		expV, expOK := incremental.Load(NativeOrdered[int]{k})
+		actV, actOK := bulk.Load(NativeOrdered[int]{k})
+		assert.Equal(t, expOK, actOK, k)
+		assert.Equal(t, expV, actV, k)
+	}
+
+	assert.Panics(t, func() {
+		SortedMapFromSorted(func(yield func(NativeOrdered[int], string)) {
+			yield(NativeOrdered[int]{2}, "x")
+			yield(NativeOrdered[int]{1}, "y")
+		})
+	})
+}
+
+const benchSortedMapSize = 100_000
+
+func benchSortedMapBase() SortedMap[NativeOrdered[int], int] {
+	var m SortedMap[NativeOrdered[int], int]
+	for i := 0; i < benchSortedMapSize; i++ {
+		m.Store(NativeOrdered[int]{i * 2}, i)
+	}
+	return m
+}
+
+// BenchmarkSortedMapRegenerate is the cost of adding a few entries to
+// a map by re-building it from scratch.
+func BenchmarkSortedMapRegenerate(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		m := benchSortedMapBase()
+		for j := 0; j < 100; j++ {
+			m.Store(NativeOrdered[int]{j*2 + 1}, j)
+		}
+	}
+}
+
+// BenchmarkSortedMapFromSorted is the cost of building the same map as
+// benchSortedMapBase, but in bulk.
+func BenchmarkSortedMapFromSorted(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_ = SortedMapFromSorted(func(yield func(NativeOrdered[int], int)) {
+			for j := 0; j < benchSortedMapSize; j++ {
+				yield(NativeOrdered[int]{j * 2}, j)
+			}
+		})
+	}
+}
+
+// BenchmarkSortedMapStore is the cost of building benchSortedMapBase.
+func BenchmarkSortedMapStore(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_ = benchSortedMapBase()
+	}
+}
+
+// BenchmarkSortedMapCloneAndAdd is the cost of adding a few entries
+// to a clone of a map; that is, the incremental update that
+// RebuiltTree does in place of BenchmarkSortedMapRegenerate.  The
+// clone itself is not timed (see BenchmarkSortedMapClone).
+func BenchmarkSortedMapCloneAndAdd(b *testing.B) {
+	base := benchSortedMapBase()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		m := base.Clone()
+		b.StartTimer()
+		for j := 0; j < 100; j++ {
+			m.Store(NativeOrdered[int]{j*2 + 1}, j)
+		}
+	}
+}
+
+// BenchmarkSortedMapClone is the cost of cloning benchSortedMapBase.
+func BenchmarkSortedMapClone(b *testing.B) {
+	base := benchSortedMapBase()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = base.Clone()
+	}
+}
+
+func TestSortedMapSubrangeHas(t *testing.T) {
+	t.Parallel()
+	k := func(i int) NativeOrdered[int] { return NativeOrdered[int]{i} }
+
+	var empty SortedMap[NativeOrdered[int], string]
+	assert.False(t, empty.SubrangeHas(k(0), k(100)))
+
+	var m SortedMap[NativeOrdered[int], string]
+	for _, i := range []int{10, 20, 30, 40, 50} {
+		m.Store(k(i), "")
+	}
+	testcases := map[string]struct {
+		lo, hi int
+		exp    int
+	}{
+		"full":           {0, 100, 5},
+		"exact-full":     {10, 50, 5},
+		"partial":        {15, 45, 3},
+		"inclusive":      {20, 40, 3},
+		"single":         {30, 30, 1},
+		"between-keys":   {31, 39, 0},
+		"before-all":     {0, 9, 0},
+		"after-all":      {51, 100, 0},
+		"inverted-range": {40, 20, 0},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			n := 0
+			m.Subrange(
+				func(key NativeOrdered[int], _ string) int {
+					switch {
+					case key.Val < tc.lo:
+						return 1
+					case key.Val > tc.hi:
+						return -1
+					default:
+						return 0
+					}
+				},
+				func(NativeOrdered[int], string) bool { n++; return true })
+			assert.Equal(t, tc.exp > 0, m.SubrangeHas(k(tc.lo), k(tc.hi)))
+			if tc.lo <= tc.hi {
+				assert.Equal(t, tc.exp, n)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@
 package diskio
 
 import (
+	"errors"
 	"io"
 )
 
@@ -23,6 +24,10 @@ type File[A ~int64] interface {
 
 type assertAddr int64
 
+// ErrReadOnly is returned when attempting to write to a read-only
+// File.
+var ErrReadOnly = errors.New("file is read-only")
+
 var (
 	_ io.WriterAt = File[int64](nil)
 	_ io.ReaderAt = File[int64](nil)
@@ -0,0 +1,122 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+//go:build unix
+
+package diskio
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"syscall"
+)
+
+// MmapFile is a read-only File that is backed by a memory-mapping of
+// a regular file, rather than by pread(2) calls.  This lets the OS
+// page cache serve repeated reads without any syscalls or extra
+// buffering.
+//
+// It should be used instead of (not in front of) a buffered file.
+//
+// The kernel reports an I/O error while reading the mapping (or a
+// read past the end of a file that has been truncated since it was
+// mapped) by raising SIGBUS, rather than by failing a syscall.
+// ReadAt catches that fault and returns it as an ErrDeviceIO
+// *ReadError, the same as a failed pread(2) would be; but any other
+// access to the mapping would crash the program, which is why the
+// mapped bytes are never handed out.
+type MmapFile[A ~int64] struct {
+	name string
+	data []byte
+}
+
+var _ File[assertAddr] = (*MmapFile[assertAddr])(nil)
+
+// NewMmapFile maps the entire contents of `file` in to memory.  The
+// file must be a regular file (the size of block devices can't be
+// determined with stat(2)).  On success, `file` may be closed by the
+// caller without affecting the mapping.
+func NewMmapFile[A ~int64](file *os.File) (*MmapFile[A], error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("mmap %q: not a regular file", file.Name())
+	}
+	size := info.Size()
+	if int64(int(size)) != size {
+		// e.g. a >2GiB file on a 32-bit system.
+		return nil, fmt.Errorf("mmap %q: size %d exceeds the address space", file.Name(), size)
+	}
+	ret := &MmapFile[A]{
+		name: file.Name(),
+	}
+	if size == 0 {
+		// mmap(2) rejects zero-length mappings.
+		return ret, nil
+	}
+	// The kernel rounds the mapping up to a whole number of pages
+	// (zero-filled), but we never expose anything past `size`.
+	ret.data, err = syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, &os.PathError{Op: "mmap", Path: file.Name(), Err: err}
+	}
+	return ret, nil
+}
+
+func (f *MmapFile[A]) Name() string { return f.name }
+func (f *MmapFile[A]) Size() A      { return A(len(f.data)) }
+
+// Close unmaps the file.  It is safe to call Close more than once.
+func (f *MmapFile[A]) Close() error {
+	if f.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(f.data)
+	f.data = nil
+	if err != nil {
+		return &os.PathError{Op: "munmap", Path: f.name, Err: err}
+	}
+	return nil
+}
+
+func (f *MmapFile[A]) ReadAt(dat []byte, off A) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("mmap %q: negative offset %d", f.name, off)
+	}
+	if int64(off) >= int64(len(f.data)) {
+		return 0, ClassifyReadError(f.name, f.Size(), off, len(dat), 0, io.EOF)
+	}
+	n, err := f.copyAt(dat, off)
+	if err != nil {
+		return 0, ClassifyReadError(f.name, f.Size(), off, len(dat), 0, err)
+	}
+	if n < len(dat) {
+		return n, ClassifyReadError(f.name, f.Size(), off, len(dat), n, io.EOF)
+	}
+	return n, nil
+}
+
+// copyAt copies from the mapping, turning a SIGBUS (or SIGSEGV) while
+// doing so in to an error wrapping syscall.EIO.
+func (f *MmapFile[A]) copyAt(dat []byte, off A) (n int, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			fault, ok := r.(interface{ Addr() uintptr })
+			if !ok {
+				panic(r)
+			}
+			n, err = 0, fmt.Errorf("mmap %q: fault at address %#x: %w", f.name, fault.Addr(), syscall.EIO)
+		}
+	}()
+	return copy(dat, f.data[off:]), nil
+}
+
+func (f *MmapFile[A]) WriteAt([]byte, A) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: ErrReadOnly}
+}
@@ -0,0 +1,23 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+//go:build !unix
+
+package diskio
+
+import (
+	"fmt"
+	"os"
+)
+
+// MmapFile is not supported on this platform; NewMmapFile always
+// returns an error, so that callers fall back to an OSFile.
+type MmapFile[A ~int64] struct {
+	File[A]
+}
+
+// NewMmapFile always fails on this platform.
+func NewMmapFile[A ~int64](file *os.File) (*MmapFile[A], error) {
+	return nil, fmt.Errorf("mmap %q: not supported on this platform", file.Name())
+}
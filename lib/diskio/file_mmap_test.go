@@ -0,0 +1,87 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+//go:build unix
+
+package diskio_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+)
+
+func TestMmapFile(t *testing.T) {
+	t.Parallel()
+	// Deliberately not a multiple of the page size.
+	content := make([]byte, 5000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	filename := filepath.Join(t.TempDir(), "img")
+	require.NoError(t, os.WriteFile(filename, content, 0o600))
+
+	osFile, err := os.Open(filename)
+	require.NoError(t, err)
+	file, err := diskio.NewMmapFile[int64](osFile)
+	require.NoError(t, err)
+	require.NoError(t, osFile.Close())
+
+	assert.Equal(t, int64(5000), file.Size())
+
+	buf := make([]byte, 100)
+	n, err := file.ReadAt(buf, 4096)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, content[4096:4196], buf)
+
+	n, err = file.ReadAt(buf, 4950)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.ErrorIs(t, err, diskio.ErrShortRead)
+	assert.Equal(t, 50, n)
+	assert.Equal(t, content[4950:], buf[:n])
+
+	_, err = file.ReadAt(buf, 5000)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.ErrorIs(t, err, diskio.ErrBeyondEnd)
+
+	_, err = file.WriteAt(buf, 0)
+	assert.ErrorIs(t, err, diskio.ErrReadOnly)
+
+	assert.NoError(t, file.Close())
+	assert.NoError(t, file.Close())
+}
+
+// TestMmapFileFault checks that the SIGBUS from reading a page of the
+// mapping that no longer exists in the file is returned as an error,
+// rather than crashing.
+func TestMmapFileFault(t *testing.T) {
+	t.Parallel()
+	pageSize := os.Getpagesize()
+	filename := filepath.Join(t.TempDir(), "img")
+	require.NoError(t, os.WriteFile(filename, make([]byte, 3*pageSize), 0o600))
+
+	osFile, err := os.Open(filename)
+	require.NoError(t, err)
+	file, err := diskio.NewMmapFile[int64](osFile)
+	require.NoError(t, err)
+	require.NoError(t, osFile.Close())
+	t.Cleanup(func() { assert.NoError(t, file.Close()) })
+
+	require.NoError(t, os.Truncate(filename, int64(pageSize)))
+
+	buf := make([]byte, 100)
+	_, err = file.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	_, err = file.ReadAt(buf, int64(2*pageSize))
+	assert.ErrorIs(t, err, diskio.ErrDeviceIO)
+	assert.ErrorIs(t, err, syscall.EIO)
+}
@@ -1,12 +1,12 @@
-// Copyright (C) 2022  Luke Shumaker <lukeshu@lukeshu.com>
+// Copyright (C) 2022-2023  Luke Shumaker <lukeshu@lukeshu.com>
 //
 // SPDX-License-Identifier: GPL-2.0-or-later
 
 package diskio
 
 import (
-	"os"
 	"io"
+	"os"
 )
 
 type OSFile[A ~int64] struct {
@@ -23,8 +23,14 @@ func (f *OSFile[A]) Size() A {
 	return A(size)
 }
 
+// ReadAt implements [File].  Errors are classified with
+// ClassifyReadError.
 func (f *OSFile[A]) ReadAt(dat []byte, paddr A) (int, error) {
-	return f.File.ReadAt(dat, int64(paddr))
+	n, err := f.File.ReadAt(dat, int64(paddr))
+	if err != nil {
+		err = ClassifyReadError(f.Name(), f.Size(), paddr, len(dat), n, err)
+	}
+	return n, err
 }
 
 func (f *OSFile[A]) WriteAt(dat []byte, paddr A) (int, error) {
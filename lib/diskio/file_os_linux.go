@@ -0,0 +1,19 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package diskio
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// SyncAndDropCache flushes the file to stable storage, and then asks
+// the kernel to drop the file from the page cache, so that
+// subsequent reads come from the device.
+func (f *OSFile[A]) SyncAndDropCache() error {
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	return unix.Fadvise(int(f.File.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
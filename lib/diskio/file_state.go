@@ -1,9 +1,14 @@
-// Copyright (C) 2022  Luke Shumaker <lukeshu@lukeshu.com>
+// Copyright (C) 2022-2023  Luke Shumaker <lukeshu@lukeshu.com>
 //
 // SPDX-License-Identifier: GPL-2.0-or-later
 
 package diskio
 
+import (
+	"errors"
+	"io"
+)
+
 type statefulFile[A ~int64] struct {
 	inner File[A]
 	pos   A
@@ -26,6 +31,11 @@ func (sf *statefulFile[A]) WriteAt(dat []byte, off A) (int, error) { return sf.i
 func (sf *statefulFile[A]) Read(dat []byte) (n int, err error) {
 	n, err = sf.ReadAt(dat, sf.pos)
 	sf.pos += A(n)
+	if errors.Is(err, io.EOF) {
+		// Unlike ReadAt, io.Reader consumers compare against
+		// io.EOF directly, so unwrap any *ReadError.
+		err = io.EOF
+	}
 	return n, err
 }
 
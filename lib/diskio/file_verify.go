@@ -0,0 +1,156 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package diskio
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/datawire/dlib/dlog"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/maps"
+)
+
+// A cacheDropper is a File that can push its writes to stable storage
+// and then discard any copy of them that the OS is holding in memory,
+// so that subsequent reads come from the device.
+type cacheDropper interface {
+	SyncAndDropCache() error
+}
+
+// WriteMismatchError is returned when closing a file from
+// [NewVerifyingFile] if any write did not read back correctly.
+type WriteMismatchError[A ~int64] struct {
+	Name string
+	// Addrs are the addresses of the writes that did not read
+	// back correctly.
+	Addrs []A
+}
+
+func (e *WriteMismatchError[A]) Error() string {
+	return fmt.Sprintf("%s: %d writes did not read back correctly (first at %v); the device may be failing",
+		e.Name, len(e.Addrs), e.Addrs[0])
+}
+
+type verifyingFile[A ~int64] struct {
+	ctx       context.Context //nolint:containedctx // don't have an option while keeping the io.Closer API
+	inner     File[A]
+	blockSize A
+
+	mu     sync.Mutex
+	writes map[A]verifyingWrite
+}
+
+// verifyingWrite is what is remembered about a write; just a
+// checksum, rather than the data itself, so that verifying a large
+// write-out doesn't hold a copy of all of it in memory.
+type verifyingWrite struct {
+	size int
+	sum  [sha256.Size]byte
+}
+
+var _ File[assertAddr] = (*verifyingFile[assertAddr])(nil)
+
+// NewVerifyingFile wraps a File such that (a checksum of) every write
+// made through it is remembered, and when the file is closed each of
+// those writes is read back from the inner File and compared against
+// what was written.  Any discrepancy is logged and causes Close to
+// return a *WriteMismatchError.
+//
+// Writes are remembered by address, with a later write to the same
+// address replacing an earlier one; a write that partially overlaps
+// an earlier one would leave a stale checksum for the earlier one.
+// So it must be placed underneath a [NewBufferedFile] with the same
+// blockSize, which only ever writes whole, aligned blocks; WriteAt
+// panics if it is given anything else.
+func NewVerifyingFile[A ~int64](ctx context.Context, file File[A], blockSize A) *verifyingFile[A] {
+	return &verifyingFile[A]{
+		ctx:       ctx,
+		inner:     file,
+		blockSize: blockSize,
+		writes:    make(map[A]verifyingWrite),
+	}
+}
+
+func (vf *verifyingFile[A]) Name() string                          { return vf.inner.Name() }
+func (vf *verifyingFile[A]) Size() A                               { return vf.inner.Size() }
+func (vf *verifyingFile[A]) ReadAt(dat []byte, off A) (int, error) { return vf.inner.ReadAt(dat, off) }
+
+// WriteAt implements [File].
+func (vf *verifyingFile[A]) WriteAt(dat []byte, off A) (int, error) {
+	if off%vf.blockSize != 0 || A(len(dat)) != vf.blockSize {
+		panic(fmt.Errorf("should not happen: %s: write of %v bytes at %v is not a whole block (block size %v)",
+			vf.Name(), len(dat), off, vf.blockSize))
+	}
+	n, err := vf.inner.WriteAt(dat, off)
+	vf.mu.Lock()
+	vf.writes[off] = verifyingWrite{
+		size: n,
+		sum:  sha256.Sum256(dat[:n]),
+	}
+	vf.mu.Unlock()
+	return n, err
+}
+
+// Close implements [File] and [io.Closer].
+func (vf *verifyingFile[A]) Close() error {
+	verifyErr := vf.Verify()
+	if err := vf.inner.Close(); err != nil {
+		return err
+	}
+	return verifyErr
+}
+
+// Verify reads back every write made so far, and compares it with
+// what was written.  It is called automatically by Close.
+func (vf *verifyingFile[A]) Verify() error {
+	vf.mu.Lock()
+	defer vf.mu.Unlock()
+
+	if len(vf.writes) == 0 {
+		return nil
+	}
+	if dropper, ok := vf.inner.(cacheDropper); ok {
+		if err := dropper.SyncAndDropCache(); err != nil {
+			return fmt.Errorf("%s: verify: %w", vf.Name(), err)
+		}
+	} else {
+		dlog.Warnf(vf.ctx, "%s: verify: cannot bypass the OS cache; read-back may not reflect what is on the device", vf.Name())
+	}
+
+	var bad []A
+	var buf []byte
+	for _, addr := range maps.SortedKeys(vf.writes) {
+		want := vf.writes[addr]
+		if cap(buf) < want.size {
+			buf = make([]byte, want.size)
+		}
+		got := buf[:want.size]
+		n, err := vf.inner.ReadAt(got, addr)
+		switch {
+		case err != nil:
+			dlog.Errorf(vf.ctx, "%s: verify: write of %v bytes at %v: read back: %v",
+				vf.Name(), want.size, addr, err)
+		case n != want.size || sha256.Sum256(got) != want.sum:
+			dlog.Errorf(vf.ctx, "%s: verify: write of %v bytes at %v: read back different data",
+				vf.Name(), want.size, addr)
+		default:
+			continue
+		}
+		bad = append(bad, addr)
+	}
+	dlog.Infof(vf.ctx, "%s: verify: read back %v writes, %v bad",
+		vf.Name(), len(vf.writes), len(bad))
+	vf.writes = make(map[A]verifyingWrite)
+	if len(bad) > 0 {
+		return &WriteMismatchError[A]{
+			Name:  vf.Name(),
+			Addrs: bad,
+		}
+	}
+	return nil
+}
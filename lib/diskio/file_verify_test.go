@@ -0,0 +1,112 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package diskio_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+)
+
+// flakyFile silently fails to write the first byte of any write at
+// the given address, like a failing device might.
+type flakyFile struct {
+	diskio.File[int64]
+	badAddr int64
+}
+
+func (f flakyFile) WriteAt(dat []byte, off int64) (int, error) {
+	if off == f.badAddr && len(dat) > 0 {
+		if _, err := f.File.WriteAt(dat[1:], off+1); err != nil {
+			return 0, err
+		}
+		return len(dat), nil
+	}
+	return f.File.WriteAt(dat, off)
+}
+
+func TestVerifyingFile(t *testing.T) {
+	t.Parallel()
+	const blockSize = 4096
+	block := func(s string) []byte {
+		return append([]byte(s), make([]byte, blockSize-len(s))...)
+	}
+	ctx := dlog.NewTestContext(t, false)
+	openFile := func(t *testing.T) *diskio.OSFile[int64] {
+		t.Helper()
+		filename := filepath.Join(t.TempDir(), "img")
+		require.NoError(t, os.WriteFile(filename, make([]byte, 8192), 0o600))
+		osFile, err := os.OpenFile(filename, os.O_RDWR, 0)
+		require.NoError(t, err)
+		return &diskio.OSFile[int64]{File: osFile}
+	}
+
+	t.Run("good", func(t *testing.T) {
+		t.Parallel()
+		file := diskio.NewVerifyingFile[int64](ctx, openFile(t), blockSize)
+		_, err := file.WriteAt(block("hello"), 0)
+		require.NoError(t, err)
+		_, err = file.WriteAt(block("world"), 4096)
+		require.NoError(t, err)
+		assert.NoError(t, file.Close())
+	})
+
+	t.Run("rewrite", func(t *testing.T) {
+		t.Parallel()
+		file := diskio.NewVerifyingFile[int64](ctx, openFile(t), blockSize)
+		buf := block("hello")
+		_, err := file.WriteAt(buf, 0)
+		require.NoError(t, err)
+		copy(buf, "HELLO") // the caller may re-use the buffer
+		_, err = file.WriteAt(buf, 0)
+		require.NoError(t, err)
+		assert.NoError(t, file.Close())
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		t.Parallel()
+		file := diskio.NewVerifyingFile[int64](ctx, flakyFile{File: openFile(t), badAddr: 4096}, blockSize)
+		_, err := file.WriteAt(block("hello"), 0)
+		require.NoError(t, err)
+		_, err = file.WriteAt(block("world"), 4096)
+		require.NoError(t, err)
+		err = file.Close()
+		var mismatch *diskio.WriteMismatchError[int64]
+		if assert.ErrorAs(t, err, &mismatch) {
+			assert.Equal(t, []int64{4096}, mismatch.Addrs)
+		}
+	})
+
+	t.Run("not-whole-blocks", func(t *testing.T) {
+		t.Parallel()
+		file := diskio.NewVerifyingFile[int64](ctx, openFile(t), blockSize)
+		assert.Panics(t, func() { _, _ = file.WriteAt([]byte("hello"), 0) })
+		assert.Panics(t, func() { _, _ = file.WriteAt(block("hello"), 2) })
+		assert.NoError(t, file.Close())
+	})
+
+	// Overlapping writes at different offsets are fine through a
+	// BufferedFile, which turns them in to whole-block writes.
+	t.Run("buffered", func(t *testing.T) {
+		t.Parallel()
+		file := diskio.NewBufferedFile[int64](ctx,
+			diskio.NewVerifyingFile[int64](ctx, openFile(t), blockSize),
+			blockSize, 1)
+		_, err := file.WriteAt(bytes.Repeat([]byte{'a'}, 6000), 10)
+		require.NoError(t, err)
+		_, err = file.WriteAt(bytes.Repeat([]byte{'b'}, 100), 4000)
+		require.NoError(t, err)
+		_, err = file.WriteAt(bytes.Repeat([]byte{'c'}, 100), 50)
+		require.NoError(t, err)
+		assert.NoError(t, file.Close())
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package diskio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+// Classes of read errors.  A *ReadError matches (with errors.Is)
+// exactly one of these, and also matches the underlying error.
+// Errors that don't fit any of these classes aren't wrapped in a
+// *ReadError.
+var (
+	// ErrDeviceIO means that the device failed to read the
+	// requested bytes; the data there is genuinely unreadable.
+	ErrDeviceIO = errors.New("device I/O error")
+	// ErrShortRead means that the read started within the file,
+	// but the file ended before all of the requested bytes were
+	// read.
+	ErrShortRead = errors.New("short read")
+	// ErrBeyondEnd means that the read started at or past the end
+	// of the file; the data is absent rather than bad.
+	ErrBeyondEnd = errors.New("read beyond end of file")
+)
+
+// A ReadError is a classified error from reading a File.
+type ReadError[A ~int64] struct {
+	Name  string
+	Off   A
+	Len   int
+	N     int   // the number of bytes that were read
+	Class error // ErrDeviceIO, ErrShortRead, or ErrBeyondEnd
+	Err   error // the underlying error
+}
+
+func (e *ReadError[A]) Error() string {
+	return fmt.Sprintf("read %q: off=%v len=%v: %v (read %v bytes): %v",
+		e.Name, e.Off, e.Len, e.Class, e.N, e.Err)
+}
+
+func (e *ReadError[A]) Unwrap() error { return e.Err }
+
+func (e *ReadError[A]) Is(target error) bool { return target == e.Class } //nolint:errorlint // comparing sentinels
+
+// ClassifyReadError wraps an error returned from reading `reqLen` bytes
+// at `off` in a file of size `size` in a *ReadError; it returns nil
+// if err is nil, and returns err unchanged if it is already a
+// *ReadError.  io.EOF and io.ErrUnexpectedEOF become ErrBeyondEnd or
+// ErrShortRead depending on where the read started, and
+// syscall.EIO becomes ErrDeviceIO.  Any other error (EBADF, EINVAL,
+// a closed file, ...) says nothing about the data on the device, and
+// is returned unchanged rather than being classified.
+func ClassifyReadError[A ~int64](name string, size, off A, reqLen, n int, err error) error {
+	if err == nil {
+		return nil
+	}
+	var already *ReadError[A]
+	if errors.As(err, &already) {
+		return err
+	}
+	ret := &ReadError[A]{
+		Name: name,
+		Off:  off,
+		Len:  reqLen,
+		N:    n,
+		Err:  err,
+	}
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		if off >= size {
+			ret.Class = ErrBeyondEnd
+		} else {
+			ret.Class = ErrShortRead
+		}
+	case errors.Is(err, syscall.EIO):
+		ret.Class = ErrDeviceIO
+	default:
+		return err
+	}
+	return ret
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package diskio_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/btrfs/btrfstree"
+	"git.lukeshu.com/btrfs-progs-ng/lib/diskio"
+)
+
+func TestClassifyReadError(t *testing.T) {
+	t.Parallel()
+	type testcase struct {
+		Off      int64
+		Err      error
+		ExpClass error
+	}
+	testcases := map[string]testcase{
+		"nil":        {Off: 0, Err: nil, ExpClass: nil},
+		"short":      {Off: 10, Err: io.EOF, ExpClass: diskio.ErrShortRead},
+		"unexpected": {Off: 10, Err: io.ErrUnexpectedEOF, ExpClass: diskio.ErrShortRead},
+		"at-end":     {Off: 100, Err: io.EOF, ExpClass: diskio.ErrBeyondEnd},
+		"past-end":   {Off: 200, Err: io.EOF, ExpClass: diskio.ErrBeyondEnd},
+		"eio":        {Off: 10, Err: &os.PathError{Op: "read", Path: "img", Err: syscall.EIO}, ExpClass: diskio.ErrDeviceIO},
+		"ebadf":      {Off: 10, Err: &os.PathError{Op: "read", Path: "img", Err: syscall.EBADF}, ExpClass: nil},
+		"closed":     {Off: 10, Err: os.ErrClosed, ExpClass: nil},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			err := diskio.ClassifyReadError[int64]("img", 100, tc.Off, 50, 0, tc.Err)
+			if tc.ExpClass == nil {
+				// Unclassified errors are passed through.
+				assert.Equal(t, tc.Err, err)
+				var readErr *diskio.ReadError[int64]
+				assert.False(t, errors.As(err, &readErr))
+				return
+			}
+			assert.ErrorIs(t, err, tc.ExpClass)
+			assert.ErrorIs(t, err, tc.Err)
+			for _, other := range []error{diskio.ErrDeviceIO, diskio.ErrShortRead, diskio.ErrBeyondEnd} {
+				if other != tc.ExpClass {
+					assert.False(t, errors.Is(err, other), other)
+				}
+			}
+			// Classifying is idempotent.
+			assert.Equal(t, err, diskio.ClassifyReadError[int64]("img", 100, 0, 50, 0, err))
+		})
+	}
+}
+
+func TestOSFileReadError(t *testing.T) {
+	t.Parallel()
+	filename := filepath.Join(t.TempDir(), "img")
+	require.NoError(t, os.WriteFile(filename, make([]byte, 5000), 0o600))
+	osFile, err := os.Open(filename)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = osFile.Close() })
+	file := &diskio.OSFile[int64]{File: osFile}
+
+	buf := make([]byte, 100)
+	n, err := file.ReadAt(buf, 4950)
+	assert.Equal(t, 50, n)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.ErrorIs(t, err, diskio.ErrShortRead)
+
+	// ReadNode's *IOError must let the classification through.
+	_, err = btrfstree.ReadNode[int64](file, btrfstree.Superblock{NodeSize: 4096}, 8192)
+	var ioErr *btrfstree.IOError
+	assert.True(t, errors.As(err, &ioErr), err)
+	assert.ErrorIs(t, err, diskio.ErrBeyondEnd)
+
+	// io.Reader consumers get a bare io.EOF.
+	sf := diskio.NewStatefulFile[int64](file)
+	all, err := io.ReadAll(sf)
+	assert.NoError(t, err)
+	assert.Len(t, all, 5000)
+}
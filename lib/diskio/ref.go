@@ -1,4 +1,4 @@
-// Copyright (C) 2022  Luke Shumaker <lukeshu@lukeshu.com>
+// Copyright (C) 2022-2023  Luke Shumaker <lukeshu@lukeshu.com>
 //
 // SPDX-License-Identifier: GPL-2.0-or-later
 
@@ -10,6 +10,9 @@ import (
 	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
 )
 
+// A Ref is a T that is stored at Addr in File.  .Read decodes it from
+// a freshly allocated buffer (not from a pool), so .Data never
+// aliases memory that is recycled, and is safe to retain.
 type Ref[A ~int64, T any] struct {
 	File File[A]
 	Addr A
@@ -12,7 +12,6 @@ import (
 	"git.lukeshu.com/go/lowmemjson"
 
 	"git.lukeshu.com/btrfs-progs-ng/lib/binstruct"
-	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
 type Binary[T any] struct {
@@ -29,7 +28,7 @@ func (o Binary[T]) EncodeJSON(w io.Writer) error {
 	if err != nil {
 		return err
 	}
-	return EncodeSplitHexString(w, bs, textui.Tunable(80))
+	return EncodeSplitHexString(w, bs, HexLineWidth.Get())
 }
 
 func (o *Binary[T]) DecodeJSON(r io.RuneScanner) error {
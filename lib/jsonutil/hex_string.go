@@ -10,6 +10,8 @@ import (
 	"io"
 
 	"git.lukeshu.com/go/lowmemjson"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
 )
 
 func EncodeHexString[T ~[]byte | ~string](w io.Writer, str T) error {
@@ -41,6 +43,10 @@ func DecodeHexString(r io.RuneScanner, dst io.ByteWriter) error {
 	return dec.Close()
 }
 
+// HexLineWidth is the maxStrLen that is used for hex strings that
+// are split across lines.
+var HexLineWidth = textui.NewTunable("json.hex-line-width", 80)
+
 func EncodeSplitHexString[T ~[]byte | ~string](w io.Writer, str T, maxStrLen int) error {
 	if maxStrLen <= 0 || len(str) <= maxStrLen/2 {
 		return EncodeHexString(w, str)
@@ -11,7 +11,6 @@ import (
 	"context"
 	"io"
 	"os"
-	"time"
 
 	"github.com/datawire/dlib/dlog"
 
@@ -53,7 +52,7 @@ func NewRuneScanner(ctx context.Context, fh *os.File) (RuneScanner, error) {
 		progress: textui.Portion[int64]{
 			D: fi.Size(),
 		},
-		progressWriter: textui.NewProgress[textui.Portion[int64]](ctx, dlog.LogLevelInfo, textui.Tunable(1*time.Second)),
+		progressWriter: textui.NewProgress[textui.Portion[int64]](ctx, dlog.LogLevelInfo, textui.ProgressInterval.Get()),
 		reader:         bufio.NewReader(fh),
 		closer:         fh,
 	}
@@ -69,8 +68,7 @@ func isClosed(ch <-chan struct{}) bool {
 	}
 }
 
-//nolint:gomnd // False positive: gomnd.ignored-functions=[textui.Tunable] doesn't support type params.
-var runeThrottle = textui.Tunable[int64](64)
+var runeThrottle = textui.NewTunable[int64]("streamio.rune-progress-throttle", 64)
 
 // ReadRune implements io.RuneReader.
 func (rs *runeScanner) ReadRune() (r rune, size int, err error) {
@@ -85,7 +83,8 @@ func (rs *runeScanner) ReadRune() (r rune, size int, err error) {
 		rs.unreadCnt--
 	} else {
 		rs.progress.N += int64(size)
-		if rs.progress.D < runeThrottle || rs.progress.N%runeThrottle == 0 || rs.progress.N > rs.progress.D-runeThrottle {
+		throttle := runeThrottle.Get()
+		if rs.progress.D < throttle || rs.progress.N%throttle == 0 || rs.progress.N > rs.progress.D-throttle {
 			rs.progressWriter.Set(rs.progress)
 		}
 	}
@@ -0,0 +1,122 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package textui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// A ColorMode is when to colorize output; it is a pflag.Value, for
+// use as a `--color=auto|always|never` flag.  The zero value is
+// ColorAuto.
+type ColorMode int
+
+const (
+	// ColorAuto colorizes output only if it is going to a
+	// terminal (and the NO_COLOR environment variable is not set,
+	// and TERM is not "dumb").
+	ColorAuto ColorMode = iota
+	// ColorAlways always colorizes output.
+	ColorAlways
+	// ColorNever never colorizes output.
+	ColorNever
+)
+
+var _ pflag.Value = (*ColorMode)(nil)
+
+// Type implements pflag.Value.
+func (*ColorMode) Type() string { return "when" }
+
+// Set implements pflag.Value.
+func (m *ColorMode) Set(str string) error {
+	switch strings.ToLower(str) {
+	case "auto":
+		*m = ColorAuto
+	case "always":
+		*m = ColorAlways
+	case "never":
+		*m = ColorNever
+	default:
+		return fmt.Errorf("invalid color mode: %q (must be 'auto', 'always', or 'never')", str)
+	}
+	return nil
+}
+
+// String implements fmt.Stringer (and pflag.Value).
+func (m *ColorMode) String() string {
+	switch *m {
+	case ColorAuto:
+		return "auto"
+	case ColorAlways:
+		return "always"
+	case ColorNever:
+		return "never"
+	default:
+		panic(fmt.Errorf("invalid color mode: %#v", *m))
+	}
+}
+
+// Enabled returns whether output written to `w` should be colorized.
+func (m ColorMode) Enabled(w io.Writer) bool {
+	switch m {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	default:
+		if _, noColor := os.LookupEnv("NO_COLOR"); noColor || os.Getenv("TERM") == "dumb" {
+			return false
+		}
+		return isTerminal(w)
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	fh, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	stat, err := fh.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// A Color is an ANSI "Select Graphic Rendition" parameter.
+type Color string
+
+const (
+	ColorBold    Color = "1"
+	ColorRed     Color = "31"
+	ColorGreen   Color = "32"
+	ColorYellow  Color = "33"
+	ColorBlue    Color = "34"
+	ColorMagenta Color = "35"
+	ColorCyan    Color = "36"
+)
+
+// Paint returns `str` wrapped in the escape sequences to render it in
+// the color `c`.  Leading tabs and a trailing newline are left
+// outside of the escape sequences, so that painting an entire line
+// doesn't leave the terminal colored past the end of it.
+func (c Color) Paint(str string) string {
+	body := strings.TrimLeft(str, "\t")
+	prefix := str[:len(str)-len(body)]
+	body, hasNL := strings.CutSuffix(body, "\n")
+	if body == "" {
+		return str
+	}
+	ret := prefix + "\x1b[" + string(c) + "m" + body + "\x1b[0m"
+	if hasNL {
+		ret += "\n"
+	}
+	return ret
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package textui_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+func TestColorPaint(t *testing.T) {
+	t.Parallel()
+	testcases := map[string]struct {
+		In, Out string
+	}{
+		"plain":   {In: "foo", Out: "\x1b[31mfoo\x1b[0m"},
+		"line":    {In: "foo\n", Out: "\x1b[31mfoo\x1b[0m\n"},
+		"indent":  {In: "\t\tfoo\n", Out: "\t\t\x1b[31mfoo\x1b[0m\n"},
+		"empty":   {In: "", Out: ""},
+		"blankln": {In: "\t\n", Out: "\t\n"},
+	}
+	for tcName, tc := range testcases {
+		tc := tc
+		t.Run(tcName, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.Out, textui.ColorRed.Paint(tc.In))
+		})
+	}
+}
+
+func TestColorMode(t *testing.T) {
+	t.Parallel()
+	var mode textui.ColorMode
+	assert.Equal(t, "auto", mode.String())
+	assert.False(t, mode.Enabled(new(bytes.Buffer)))
+	assert.NoError(t, mode.Set("Always"))
+	assert.True(t, mode.Enabled(new(bytes.Buffer)))
+	assert.NoError(t, mode.Set("never"))
+	assert.False(t, mode.Enabled(new(bytes.Buffer)))
+	assert.Error(t, mode.Set("sometimes"))
+}
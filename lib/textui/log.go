@@ -76,10 +76,53 @@ func (lvl *LogLevelFlag) String() string {
 	}
 }
 
+// A LogFormat is how a logger created by NewLoggerWithFormat renders
+// each log line.
+type LogFormat int
+
+const (
+	// LogFormatText renders each log line as human-friendly text.
+	LogFormatText LogFormat = iota
+	// LogFormatJSON renders each log line as a single JSON object,
+	// for consumption by log-aggregation tools.
+	LogFormatJSON
+)
+
+var _ pflag.Value = (*LogFormat)(nil)
+
+// Type implements pflag.Value.
+func (*LogFormat) Type() string { return "logformat" }
+
+// Set implements pflag.Value.
+func (f *LogFormat) Set(str string) error {
+	switch strings.ToLower(str) {
+	case "text":
+		*f = LogFormatText
+	case "json":
+		*f = LogFormatJSON
+	default:
+		return fmt.Errorf("invalid log format: %q", str)
+	}
+	return nil
+}
+
+// String implements fmt.Stringer (and pflag.Value).
+func (f *LogFormat) String() string {
+	switch *f {
+	case LogFormatText:
+		return "text"
+	case LogFormatJSON:
+		return "json"
+	default:
+		panic(fmt.Errorf("invalid log format: %#v", *f))
+	}
+}
+
 type logger struct {
 	parent *logger
 	out    io.Writer
 	lvl    dlog.LogLevel
+	format LogFormat
 
 	// only valid if parent is non-nil
 	fieldKey string
@@ -89,9 +132,14 @@ type logger struct {
 var _ dlog.OptimizedLogger = (*logger)(nil)
 
 func NewLogger(out io.Writer, lvl dlog.LogLevel) dlog.Logger {
+	return NewLoggerWithFormat(out, lvl, LogFormatText)
+}
+
+func NewLoggerWithFormat(out io.Writer, lvl dlog.LogLevel, format LogFormat) dlog.Logger {
 	return &logger{
-		out: out,
-		lvl: lvl,
+		out:    out,
+		lvl:    lvl,
+		format: format,
 	}
 }
 
@@ -104,6 +152,7 @@ func (l *logger) WithField(key string, value any) dlog.Logger {
 		parent: l,
 		out:    l.out,
 		lvl:    l.lvl,
+		format: l.format,
 
 		fieldKey: key,
 		fieldVal: value,
@@ -179,6 +228,11 @@ func (l *logger) log(lvl dlog.LogLevel, writeMsg func(io.Writer)) {
 	defer logBufPool.Put(logBuf)
 	defer logBuf.Reset()
 
+	if l.format == LogFormatJSON {
+		l.logJSON(logBuf, lvl, writeMsg)
+		return
+	}
+
 	// time ////////////////////////////////////////////////////////////////
 	now := time.Now()
 	const timeFmt = "15:04:05.0000"
@@ -200,23 +254,7 @@ func (l *logger) log(lvl dlog.LogLevel, writeMsg func(io.Writer)) {
 	}
 
 	// fields (early) //////////////////////////////////////////////////////
-	fields := make(map[string]any)
-	var fieldKeys []string
-	for f := l; f.parent != nil; f = f.parent {
-		if maps.HasKey(fields, f.fieldKey) {
-			continue
-		}
-		fields[f.fieldKey] = f.fieldVal
-		fieldKeys = append(fieldKeys, f.fieldKey)
-	}
-	sort.Slice(fieldKeys, func(i, j int) bool {
-		iOrd := fieldOrd(fieldKeys[i])
-		jOrd := fieldOrd(fieldKeys[j])
-		if iOrd != jOrd {
-			return iOrd < jOrd
-		}
-		return fieldKeys[i] < fieldKeys[j]
-	})
+	fields, fieldKeys := l.fields()
 	nextField := len(fieldKeys)
 	for i, fieldKey := range fieldKeys {
 		if fieldOrd(fieldKey) >= 0 {
@@ -240,28 +278,11 @@ func (l *logger) log(lvl dlog.LogLevel, writeMsg func(io.Writer)) {
 
 	// caller //////////////////////////////////////////////////////////////
 	if lvl >= dlog.LogLevelDebug {
-		const (
-			thisModule             = "git.lukeshu.com/btrfs-progs-ng"
-			thisPackage            = "git.lukeshu.com/btrfs-progs-ng/lib/textui"
-			maximumCallerDepth int = 25
-			minimumCallerDepth int = 3 // runtime.Callers + .log + .Log
-		)
-		var pcs [maximumCallerDepth]uintptr
-		depth := runtime.Callers(minimumCallerDepth, pcs[:])
-		frames := runtime.CallersFrames(pcs[:depth])
-		for f, again := frames.Next(); again; f, again = frames.Next() {
-			if !strings.HasPrefix(f.Function, thisModule+"/") {
-				continue
-			}
-			if strings.HasPrefix(f.Function, thisPackage+".") {
-				continue
-			}
+		if file, line, ok := caller(); ok {
 			if nextField == len(fieldKeys) {
 				logBuf.WriteString(" :")
 			}
-			file := f.File[strings.LastIndex(f.File, thisModDir+"/")+len(thisModDir+"/"):]
-			fmt.Fprintf(logBuf, " (from %s:%d)", file, f.Line)
-			break
+			fmt.Fprintf(logBuf, " (from %s:%d)", file, line)
 		}
 	}
 
@@ -273,6 +294,53 @@ func (l *logger) log(lvl dlog.LogLevel, writeMsg func(io.Writer)) {
 	logMu.Unlock()
 }
 
+// fields returns the fields attached to the logger, and the keys of
+// those fields sorted by fieldOrd.
+func (l *logger) fields() (map[string]any, []string) {
+	fields := make(map[string]any)
+	var fieldKeys []string
+	for f := l; f.parent != nil; f = f.parent {
+		if maps.HasKey(fields, f.fieldKey) {
+			continue
+		}
+		fields[f.fieldKey] = f.fieldVal
+		fieldKeys = append(fieldKeys, f.fieldKey)
+	}
+	sort.Slice(fieldKeys, func(i, j int) bool {
+		iOrd := fieldOrd(fieldKeys[i])
+		jOrd := fieldOrd(fieldKeys[j])
+		if iOrd != jOrd {
+			return iOrd < jOrd
+		}
+		return fieldKeys[i] < fieldKeys[j]
+	})
+	return fields, fieldKeys
+}
+
+// caller returns the source location (relative to the root of this
+// module) of the code outside of this package that is logging.
+func caller() (file string, line int, ok bool) {
+	const (
+		thisModule             = "git.lukeshu.com/btrfs-progs-ng"
+		thisPackage            = "git.lukeshu.com/btrfs-progs-ng/lib/textui"
+		maximumCallerDepth int = 25
+		minimumCallerDepth int = 4 // runtime.Callers + caller + .log + .Log
+	)
+	var pcs [maximumCallerDepth]uintptr
+	depth := runtime.Callers(minimumCallerDepth, pcs[:])
+	frames := runtime.CallersFrames(pcs[:depth])
+	for f, again := frames.Next(); again; f, again = frames.Next() {
+		if !strings.HasPrefix(f.Function, thisModule+"/") {
+			continue
+		}
+		if strings.HasPrefix(f.Function, thisPackage+".") {
+			continue
+		}
+		return f.File[strings.LastIndex(f.File, thisModDir+"/")+len(thisModDir+"/"):], f.Line, true
+	}
+	return "", 0, false
+}
+
 // fieldOrd returns the sort-position for a given log-field-key.  Lower return
 // values should be positioned on the left when logging, and higher values
 // should be positioned on the right; values <0 should be on the left of the log
@@ -0,0 +1,127 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package textui
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"git.lukeshu.com/go/lowmemjson"
+	"github.com/datawire/dlib/dlog"
+)
+
+// logJSON is the LogFormatJSON counterpart to the text formatting in
+// (*logger).log.  Each log line is a single JSON object:
+//
+//	{"time":"...","level":"info","msg":"...","fields":{...},"caller":"file.go:123"}
+//
+// The "fields" object contains every dlog.WithField field, keyed by
+// the full field name, in the same order that the text format uses;
+// "caller" is only present for debug and trace lines, same as the
+// text format.
+func (l *logger) logJSON(logBuf *bytes.Buffer, lvl dlog.LogLevel, writeMsg func(io.Writer)) {
+	// time, level /////////////////////////////////////////////////////////
+	logBuf.WriteString(`{"time":`)
+	writeJSONValue(logBuf, time.Now().Format(time.RFC3339Nano))
+	logBuf.WriteString(`,"level":`)
+	writeJSONValue(logBuf, (&LogLevelFlag{Level: lvl}).String())
+
+	// message /////////////////////////////////////////////////////////////
+	msgBuf, _ := logBufPool.Get()
+	writeMsg(msgBuf)
+	logBuf.WriteString(`,"msg":`)
+	writeJSONValue(logBuf, strings.TrimSuffix(msgBuf.String(), "\n"))
+	msgBuf.Reset()
+	logBufPool.Put(msgBuf)
+
+	// fields //////////////////////////////////////////////////////////////
+	fields, fieldKeys := l.fields()
+	if len(fieldKeys) > 0 {
+		logBuf.WriteString(`,"fields":{`)
+		for i, fieldKey := range fieldKeys {
+			if i > 0 {
+				logBuf.WriteByte(',')
+			}
+			writeJSONValue(logBuf, fieldKey)
+			logBuf.WriteByte(':')
+			writeJSONValue(logBuf, jsonFieldValue(fields[fieldKey]))
+		}
+		logBuf.WriteByte('}')
+	}
+
+	// caller //////////////////////////////////////////////////////////////
+	if lvl >= dlog.LogLevelDebug {
+		if file, line, ok := caller(); ok {
+			logBuf.WriteString(`,"caller":`)
+			writeJSONValue(logBuf, fmt.Sprintf("%s:%d", file, line))
+		}
+	}
+
+	// boilerplate /////////////////////////////////////////////////////////
+	logBuf.WriteString("}\n")
+
+	logMu.Lock()
+	_, _ = l.out.Write(logBuf.Bytes())
+	logMu.Unlock()
+}
+
+// jsonFieldValue returns a representation of a log field's value
+// that is suitable for encoding as JSON.
+//
+// Values that know how to encode themselves as JSON (such as
+// *LiveMemUse) do so; plain numbers and booleans are kept as JSON
+// numbers and booleans (without the digit-grouping that the text
+// format uses); and anything else (such as Portion, or progress
+// stats) is rendered as the same string that the text format would
+// use.
+func jsonFieldValue(val any) any {
+	switch val := val.(type) {
+	case nil:
+		return nil
+	case lowmemjson.Encodable, interface{ MarshalJSON() ([]byte, error) }:
+		return val
+	case error:
+		return val.Error()
+	case fmt.Stringer:
+		return val.String()
+	case encoding.TextMarshaler:
+		return val
+	}
+	rVal := reflect.ValueOf(val)
+	switch rVal.Kind() {
+	case reflect.Bool:
+		return rVal.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rVal.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rVal.Uint()
+	case reflect.Float32, reflect.Float64:
+		if f := rVal.Float(); !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f
+		}
+	case reflect.String:
+		return rVal.String()
+	}
+	return printer.Sprint(val)
+}
+
+func writeJSONValue(w *bytes.Buffer, val any) {
+	valBuf, _ := logBufPool.Get()
+	defer logBufPool.Put(valBuf)
+	defer valBuf.Reset()
+	if err := lowmemjson.NewEncoder(valBuf).Encode(val); err != nil {
+		// Don't let one bad field value make the whole line
+		// invalid JSON.
+		valBuf.Reset()
+		_ = lowmemjson.NewEncoder(valBuf).Encode(fmt.Sprintf("%%!(JSON=%v)", err))
+	}
+	_, _ = w.Write(valBuf.Bytes())
+}
@@ -5,10 +5,13 @@
 package textui
 
 import (
+	"bytes"
 	"fmt"
 	"runtime"
 	"sync"
 	"time"
+
+	"git.lukeshu.com/go/lowmemjson"
 )
 
 // LiveMemUse is an object that stringifies as the live memory use of
@@ -30,15 +33,47 @@ var _ fmt.Stringer = (*LiveMemUse)(nil)
 // LiveMemUse is willing to update; we have this minimum interval
 // because it stops the world to collect memory statistics, so we
 // don't want to be updating the statistics too often.
-var LiveMemUseUpdateInterval = Tunable(1 * time.Second)
+var LiveMemUseUpdateInterval = NewTunable("log.mem-use-update-interval", 1*time.Second)
+
+// liveMemUseStats is the breakdown of memory use that LiveMemUse
+// reports; all values are in bytes.
+type liveMemUseStats struct {
+	Ready        uint64 `json:"ready"`
+	Prepared     uint64 `json:"prepared"`
+	Data         uint64 `json:"data"`
+	FragOverhead uint64 `json:"fragOverhead"`
+	Idle         uint64 `json:"idle"`
+}
 
 // String implements fmt.Stringer.
 func (o *LiveMemUse) String() string {
+	stats := o.read()
+	return Sprintf("Ready+Prepared=%.1f (Ready=%.1f (data:%.1f + fragOverhead:%.1f + idle:%.1f) ; Prepared=%.1f)",
+		IEC(stats.Ready+stats.Prepared, "B"),
+		IEC(stats.Ready, "B"),
+		IEC(stats.Data, "B"),
+		IEC(stats.FragOverhead, "B"),
+		IEC(stats.Idle, "B"),
+		IEC(stats.Prepared, "B"))
+}
+
+// MarshalJSON implements json.Marshaler, rendering the memory use as
+// an object of byte counts, rather than as the human-friendly string
+// that String returns.
+func (o *LiveMemUse) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := lowmemjson.NewEncoder(&buf).Encode(o.read()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (o *LiveMemUse) read() liveMemUseStats {
 	o.mu.Lock()
 
 	// runtime.ReadMemStats() calls stopTheWorld(), so we want to
 	// rate-limit how often we call it.
-	if now := time.Now(); now.Sub(o.last) > LiveMemUseUpdateInterval {
+	if now := time.Now(); now.Sub(o.last) > LiveMemUseUpdateInterval.Get() {
 		runtime.ReadMemStats(&o.stats)
 		o.last = now
 	}
@@ -134,11 +169,11 @@ func (o *LiveMemUse) String() string {
 
 	o.mu.Unlock()
 
-	return Sprintf("Ready+Prepared=%.1f (Ready=%.1f (data:%.1f + fragOverhead:%.1f + idle:%.1f) ; Prepared=%.1f)",
-		IEC(ready+prepared, "B"),
-		IEC(ready, "B"),
-		IEC(readyData, "B"),
-		IEC(readyFragOverhead, "B"),
-		IEC(readyIdle, "B"),
-		IEC(prepared, "B"))
+	return liveMemUseStats{
+		Ready:        ready,
+		Prepared:     prepared,
+		Data:         readyData,
+		FragOverhead: readyFragOverhead,
+		Idle:         readyIdle,
+	}
 }
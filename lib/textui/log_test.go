@@ -9,6 +9,7 @@ import (
 	"strings"
 	"testing"
 
+	"git.lukeshu.com/go/lowmemjson"
 	"github.com/datawire/dlib/dlog"
 	"github.com/stretchr/testify/assert"
 
@@ -70,3 +71,36 @@ func TestLogField(t *testing.T) {
 		`^`+logLineRegexp(false, `INF : msg : foo=12,345`)+`$`,
 		out.String())
 }
+
+func TestLogJSON(t *testing.T) {
+	t.Parallel()
+	var out strings.Builder
+	ctx := dlog.WithLogger(context.Background(), textui.NewLoggerWithFormat(&out, dlog.LogLevelInfo, textui.LogFormatJSON))
+	ctx = dlog.WithField(ctx, "foo", 12345)
+	ctx = dlog.WithField(ctx, "btrfs.inspect.rebuild-trees.step", "rebuild")
+	ctx = dlog.WithField(ctx, "progress", textui.Portion[int]{N: 1, D: 12345})
+	ctx = dlog.WithField(ctx, "mem", new(textui.LiveMemUse))
+	dlog.Debug(ctx, "filtered")
+	dlog.Infof(ctx, "msg %q", "quoted")
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if !assert.Len(t, lines, 1) {
+		return
+	}
+	var line struct {
+		Time   string         `json:"time"`
+		Level  string         `json:"level"`
+		Msg    string         `json:"msg"`
+		Fields map[string]any `json:"fields"`
+	}
+	if !assert.NoError(t, lowmemjson.NewDecoder(strings.NewReader(lines[0])).DecodeThenEOF(&line)) {
+		return
+	}
+	assert.Equal(t, "info", line.Level)
+	assert.Equal(t, `msg "quoted"`, line.Msg)
+	assert.Equal(t, float64(12345), line.Fields["foo"])
+	assert.Equal(t, "rebuild", line.Fields["btrfs.inspect.rebuild-trees.step"])
+	assert.Equal(t, "0% (1/12,345)", line.Fields["progress"])
+	assert.Contains(t, line.Fields["mem"], "ready")
+	assert.Regexp(t, `^\{"time":"[^"]+","level":"info","msg":.*,"fields":\{"btrfs\.inspect\.rebuild-trees\.step":`, lines[0])
+}
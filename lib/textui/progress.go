@@ -13,6 +13,15 @@ import (
 	"github.com/datawire/dlib/dlog"
 )
 
+// ProgressInterval is the interval on which a Progress is usually
+// printed.
+var ProgressInterval = NewTunable("progress.interval", 1*time.Second)
+
+var (
+	progressHangTickTimeout  = NewTunable("progress.hang-tick-timeout", 1*time.Minute)
+	progressHangWriteTimeout = NewTunable("progress.hang-write-timeout", 2*time.Minute)
+)
+
 type Stats interface {
 	comparable
 	fmt.Stringer
@@ -90,8 +99,8 @@ func (p *Progress[T]) flush(now time.Time, cur T) {
 	// If this grows too big, it probably means that either the
 	// program deadlocked or that we forgot to call .Done().
 	if !p.lastTick.IsZero() && !p.lastWrite.IsZero() {
-		tickTimeout := Tunable(1 * time.Minute)
-		writeTimeout := Tunable(2 * time.Minute)
+		tickTimeout := progressHangTickTimeout.Get()
+		writeTimeout := progressHangWriteTimeout.Get()
 		if now.Sub(p.lastTick) < tickTimeout && now.Sub(p.lastWrite) > writeTimeout {
 			err := fmt.Errorf("textui.Progress: hang detected: no updates for %v (from %v to %v)",
 				writeTimeout, p.lastWrite, now)
@@ -1,13 +1,225 @@
-// Copyright (C) 2022  Luke Shumaker <lukeshu@lukeshu.com>
+// Copyright (C) 2022-2023  Luke Shumaker <lukeshu@lukeshu.com>
 //
 // SPDX-License-Identifier: GPL-2.0-or-later
 
 package textui
 
-// Tunable annotates a value as something that might want to be tuned
-// as the program gets optimized.
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TunableValue is the set of types that a Tunable may have.
+type TunableValue interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64
+}
+
+// A Tunable is a value that might want to be tuned as the program
+// gets optimized, such as a cache size or a buffer size.  Tunables
+// are registered by name (when NewTunable is called, which should be
+// in a package-level variable declaration, so that every tunable is
+// registered before main() runs), and may be overridden by name at
+// runtime with SetTunable.
+//
+// A Tunable must be > 0, and may have an upper bound set with
+// .WithMax.
+type Tunable[T TunableValue] struct {
+	name string
+	def  T
+	val  T
+	max  *T
+}
+
+type anyTunable interface {
+	set(string) error
+	info() TunableInfo
+}
+
+var (
+	tunablesMu sync.Mutex
+	tunables   = make(map[string]anyTunable)
+)
+
+// NewTunable registers a tunable named `name` with the default value
+// `def`.  It panics if a tunable with that name has already been
+// registered.
 //
-// TODO(lukeshu): Have Tunable be runtime-configurable.
-func Tunable[T any](x T) T {
-	return x
+// Names should be lower-case, dash-separated words, prefixed with the
+// name of the subsystem and a ".", such as "btrfs.node-cache-size".
+func NewTunable[T TunableValue](name string, def T) *Tunable[T] {
+	tunablesMu.Lock()
+	defer tunablesMu.Unlock()
+	if _, dup := tunables[name]; dup {
+		panic(fmt.Errorf("textui.NewTunable: duplicate tunable %q", name))
+	}
+	ret := &Tunable[T]{
+		name: name,
+		def:  def,
+		val:  def,
+	}
+	tunables[name] = ret
+	return ret
+}
+
+// WithMax sets an upper bound (inclusive) on the values that the
+// tunable may be set to, and returns the tunable.
+func (t *Tunable[T]) WithMax(max T) *Tunable[T] {
+	t.max = &max
+	return t
+}
+
+// Get returns the current value of the tunable.
+func (t *Tunable[T]) Get() T {
+	return t.val
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func (t *Tunable[T]) parse(str string) (T, error) {
+	var val T
+	rVal := reflect.ValueOf(&val).Elem()
+	switch {
+	case rVal.Type() == durationType:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return val, err
+		}
+		rVal.SetInt(int64(d))
+	case rVal.CanInt():
+		i, err := strconv.ParseInt(str, 0, rVal.Type().Bits())
+		if err != nil {
+			return val, err
+		}
+		rVal.SetInt(i)
+	case rVal.CanUint():
+		u, err := strconv.ParseUint(str, 0, rVal.Type().Bits())
+		if err != nil {
+			return val, err
+		}
+		rVal.SetUint(u)
+	case rVal.CanFloat():
+		f, err := strconv.ParseFloat(str, rVal.Type().Bits())
+		if err != nil {
+			return val, err
+		}
+		rVal.SetFloat(f)
+	default:
+		panic(fmt.Errorf("should not happen: unhandled tunable type %v", rVal.Type()))
+	}
+	return val, nil
+}
+
+func (t *Tunable[T]) set(str string) error {
+	val, err := t.parse(str)
+	if err != nil {
+		return fmt.Errorf("invalid %v: %w", t.typeName(), err)
+	}
+	if val <= 0 {
+		return fmt.Errorf("must be > 0, but is %v", t.format(val))
+	}
+	if t.max != nil && val > *t.max {
+		return fmt.Errorf("must be <= %v, but is %v", t.format(*t.max), t.format(val))
+	}
+	t.val = val
+	return nil
+}
+
+func (*Tunable[T]) typeName() string {
+	typ := reflect.TypeOf(*new(T))
+	if typ == durationType {
+		return "duration"
+	}
+	return typ.Kind().String()
+}
+
+// format formats the value in the syntax that .parse accepts; it
+// doesn't use fmt.Sprint, since some of our types (such as
+// btrfsvol.PhysicalAddr) format themselves in ways that are nice for
+// logs, but that .parse doesn't accept.
+func (*Tunable[T]) format(val T) string {
+	rVal := reflect.ValueOf(val)
+	switch {
+	case rVal.Type() == durationType:
+		return time.Duration(rVal.Int()).String()
+	case rVal.CanInt():
+		return strconv.FormatInt(rVal.Int(), 10)
+	case rVal.CanUint():
+		return strconv.FormatUint(rVal.Uint(), 10)
+	default:
+		return strconv.FormatFloat(rVal.Float(), 'g', -1, rVal.Type().Bits())
+	}
+}
+
+func (t *Tunable[T]) info() TunableInfo {
+	return TunableInfo{
+		Name:    t.name,
+		Type:    t.typeName(),
+		Default: t.format(t.def),
+		Value:   t.format(t.val),
+	}
+}
+
+// TunableInfo describes a tunable, for listing them.
+type TunableInfo struct {
+	Name    string
+	Type    string // "int", "float64", "duration", ...
+	Default string
+	Value   string
+}
+
+// Tunables returns information about every registered tunable, sorted
+// by name.
+func Tunables() []TunableInfo {
+	tunablesMu.Lock()
+	defer tunablesMu.Unlock()
+	ret := make([]TunableInfo, 0, len(tunables))
+	for _, t := range tunables {
+		ret = append(ret, t.info())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// SetTunable overrides the value of the named tunable, after
+// validating it.  It is not safe to call SetTunable concurrently with
+// the tunable being used; it should be called at startup.
+func SetTunable(name, value string) error {
+	tunablesMu.Lock()
+	defer tunablesMu.Unlock()
+	t, ok := tunables[name]
+	if !ok {
+		return fmt.Errorf("unknown tunable %q", name)
+	}
+	if err := t.set(value); err != nil {
+		return fmt.Errorf("tunable %q: %w", name, err)
+	}
+	return nil
+}
+
+// SetTunables parses a comma-separated list of "name=value" pairs,
+// and calls SetTunable for each.
+func SetTunables(str string) error {
+	for _, pair := range strings.Split(str, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid tunable setting %q: must be NAME=VALUE", pair)
+		}
+		if err := SetTunable(strings.TrimSpace(name), strings.TrimSpace(value)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
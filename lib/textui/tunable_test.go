@@ -0,0 +1,62 @@
+// Copyright (C) 2023  Luke Shumaker <lukeshu@lukeshu.com>
+//
+// SPDX-License-Identifier: GPL-2.0-or-later
+
+package textui_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.lukeshu.com/btrfs-progs-ng/lib/textui"
+)
+
+type tunableAddr int64
+
+func (a tunableAddr) String() string { return "not a number" }
+
+func TestTunable(t *testing.T) {
+	t.Parallel()
+	count := textui.NewTunable("test.count", 8)
+	frac := textui.NewTunable("test.frac", 0.5).WithMax(1)
+	interval := textui.NewTunable("test.interval", 1*time.Second)
+	addr := textui.NewTunable[tunableAddr]("test.addr", 0x1000)
+
+	assert.Equal(t, 8, count.Get())
+	assert.NoError(t, textui.SetTunables("test.count=16, test.frac=0.25,test.interval=500ms"))
+	assert.NoError(t, textui.SetTunable("test.addr", "0x2000"))
+	assert.Equal(t, 16, count.Get())
+	assert.Equal(t, 0.25, frac.Get())
+	assert.Equal(t, 500*time.Millisecond, interval.Get())
+	assert.Equal(t, tunableAddr(0x2000), addr.Get())
+
+	assert.EqualError(t, textui.SetTunable("test.frac", "1.5"),
+		`tunable "test.frac": must be <= 1, but is 1.5`)
+	assert.EqualError(t, textui.SetTunable("test.count", "0"),
+		`tunable "test.count": must be > 0, but is 0`)
+	assert.EqualError(t, textui.SetTunable("test.count", "lots"),
+		`tunable "test.count": invalid int: strconv.ParseInt: parsing "lots": invalid syntax`)
+	assert.EqualError(t, textui.SetTunable("test.nonexistent", "1"),
+		`unknown tunable "test.nonexistent"`)
+	assert.EqualError(t, textui.SetTunables("test.count"),
+		`invalid tunable setting "test.count": must be NAME=VALUE`)
+	assert.Equal(t, 16, count.Get())
+
+	var found bool
+	for _, info := range textui.Tunables() {
+		if info.Name == "test.addr" {
+			found = true
+			assert.Equal(t, textui.TunableInfo{
+				Name:    "test.addr",
+				Type:    "int64",
+				Default: "4096",
+				Value:   "8192",
+			}, info)
+		}
+	}
+	assert.True(t, found)
+
+	assert.Panics(t, func() { textui.NewTunable("test.count", 1) })
+}